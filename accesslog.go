@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLogTimeFormat is the timestamp format of the common log format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes one line per SFTP request to ACCESS_LOG, in a format
+// modeled on the common log format of web servers:
+//
+//	203.0.113.7 9f86d081884c7d65 alice [15/Jan/2024:14:30:45 +0000] "Put /uploads/a.csv" OK 2048
+//
+// The fields are the client IP, session ID, user, time the request
+// finished, method and path (plus the target of a rename), the result and
+// the bytes written. Fields that are unknown are "-". A nil accessLog
+// writes nothing.
+type accessLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	timeFunc func() time.Time
+}
+
+func newAccessLog(w io.Writer) *accessLog {
+	return &accessLog{w: w, timeFunc: time.Now}
+}
+
+// accessRequest identifies the session a request was made on.
+type accessRequest struct {
+	clientIP  string
+	sessionID string
+	user      string
+}
+
+// log writes the line for a request with method on path, or on path and
+// target for renames.
+func (l *accessLog) log(req accessRequest, method, path, target string, err error, bytes int64) {
+	if l == nil {
+		return
+	}
+	request := method + " " + path
+	if target != "" {
+		request += " " + target
+	}
+	line := fmt.Sprintf("%s %s %s [%s] %s %s %d\n",
+		accessLogField(req.clientIP),
+		accessLogField(req.sessionID),
+		accessLogField(req.user),
+		l.timeFunc().Format(accessLogTimeFormat),
+		strconv.Quote(request),
+		accessResult(err),
+		bytes,
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.w, line); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write access log: %v\n", err)
+	}
+}
+
+// accessLogField keeps an unquoted field parseable: empty values become "-"
+// and values with spaces or quotes are quoted.
+func accessLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// accessResult names the outcome of a request that returned err, after the
+// SFTP status codes.
+func accessResult(err error) string {
+	switch {
+	case err == nil:
+		return "OK"
+	case errors.Is(err, os.ErrPermission):
+		return "PERMISSION_DENIED"
+	case errors.Is(err, os.ErrNotExist):
+		return "NO_SUCH_FILE"
+	case errors.Is(err, os.ErrInvalid):
+		return "OP_UNSUPPORTED"
+	default:
+		return "FAILURE"
+	}
+}
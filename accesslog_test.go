@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func newTestAccessLog() (*accessLog, *strings.Builder) {
+	var out strings.Builder
+	l := newAccessLog(&out)
+	l.timeFunc = func() time.Time { return time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC) }
+	return l, &out
+}
+
+func TestAccessLog_Format(t *testing.T) {
+	l, out := newTestAccessLog()
+	req := accessRequest{clientIP: "203.0.113.7", sessionID: "9f86d081884c7d65", user: "alice"}
+
+	l.log(req, "Put", "/uploads/a.csv", "", nil, 2048)
+	l.log(req, "Rename", "/uploads/b.csv.part", "/uploads/b.csv", nil, 0)
+	l.log(req, "Remove", `/uploads/my "file".csv`, "", os.ErrPermission, 0)
+	l.log(accessRequest{clientIP: "203.0.113.7"}, "Put", "/uploads/c.csv", "", fmt.Errorf("upload failed: %w", errors.New("AccessDenied")), 10)
+	l.log(accessRequest{clientIP: "203.0.113.7", sessionID: "9f86d081884c7d65", user: "bob smith"}, "Stat", "/uploads/d.csv", "", nil, 0)
+
+	want := `203.0.113.7 9f86d081884c7d65 alice [15/Jan/2024:14:30:45 +0000] "Put /uploads/a.csv" OK 2048
+203.0.113.7 9f86d081884c7d65 alice [15/Jan/2024:14:30:45 +0000] "Rename /uploads/b.csv.part /uploads/b.csv" OK 0
+203.0.113.7 9f86d081884c7d65 alice [15/Jan/2024:14:30:45 +0000] "Remove /uploads/my \"file\".csv" PERMISSION_DENIED 0
+203.0.113.7 - - [15/Jan/2024:14:30:45 +0000] "Put /uploads/c.csv" FAILURE 10
+203.0.113.7 9f86d081884c7d65 "bob smith" [15/Jan/2024:14:30:45 +0000] "Stat /uploads/d.csv" OK 0
+`
+	if got := out.String(); got != want {
+		t.Errorf("access log =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAccessLog_Nil(t *testing.T) {
+	var l *accessLog
+	l.log(accessRequest{}, "Put", "/uploads/a.csv", "", nil, 0)
+}
+
+func TestSessionSFTPHandler_AccessLog(t *testing.T) {
+	handler := NewSFTPHandler(&Config{VirtualDir: "/uploads", MaxFileSize: 1024}, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	l, out := newTestAccessLog()
+	handler.accessLog = l
+	session := &SessionSFTPHandler{handler: handler, clientIP: "203.0.113.7", sessionID: "9f86d081884c7d65", user: "alice"}
+
+	session.Filecmd(&sftp.Request{Method: "Remove", Filepath: "/uploads/a.csv"})
+	session.Filewrite(&sftp.Request{Method: "Put", Filepath: "/etc/passwd"})
+
+	writer := &FileWriter{
+		upload:  &FileUpload{path: "/uploads/b.csv", clientIP: "203.0.113.7", sessionID: "9f86d081884c7d65", user: "alice", data: make([]byte, 0, 1024)},
+		handler: handler,
+		logger:  handler.logger,
+	}
+	writer.WriteAt([]byte("abc"), 0)
+	writer.TransferError(errors.New("connection lost"))
+	writer.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		`"Remove /uploads/a.csv" PERMISSION_DENIED 0`,
+		`"Put /etc/passwd" PERMISSION_DENIED 0`,
+		`"Put /uploads/b.csv" FAILURE 3`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("access log has %d lines, want %d:\n%s", len(lines), len(want), out)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "203.0.113.7 9f86d081884c7d65 alice ") || !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %s, want it to end in %s", i, line, want[i])
+		}
+	}
+}
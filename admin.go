@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// awsProbeTimeout bounds the reachability check of /readyz.
+const awsProbeTimeout = 5 * time.Second
+
+// adminMux serves the endpoints of the admin listener:
+//
+//	/healthz        the process is alive
+//	/version        version, commit and build date of the binary
+//	/readyz         the SFTP listeners accept connections and, with
+//	                READY_CHECK_AWS, STS and S3 can be reached
+//	/metrics        upload counters and histograms, in the Prometheus
+//	                text format
+//	/debug/pprof/   runtime profiles, with ADMIN_PPROF
+//	/sessions       logged in SSH sessions, with ADMIN_TOKEN; DELETE
+//	                /sessions/{id} closes one
+//	/uploads        files being received or stored and the memory they
+//	                hold, with ADMIN_TOKEN; DELETE /uploads?path= cancels
+//	                one
+//	/events         logins, sessions, requests and uploads as they happen,
+//	                as server-sent events, with ADMIN_TOKEN
+//	/bans           client IPs banned by BAN_THRESHOLD, with ADMIN_TOKEN;
+//	                DELETE /bans/{ip} lifts one
+func (s *SFTPServer) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentBuildInfo())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkReady(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if s.metrics != nil {
+		mux.Handle("GET /metrics", s.metrics)
+	}
+	if s.config.AdminPprof {
+		// no /debug/pprof/cmdline: secrets such as --admin-token may be
+		// flags, and the admin port isn't authenticated
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if s.config.AdminToken != "" {
+		mux.Handle("GET /sessions", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"sessions": s.sessionStatuses()})
+		}))
+		mux.Handle("GET /uploads", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"uploads": s.uploadStatuses(), "memory": s.bufferUsage()})
+		}))
+		if s.audit != nil {
+			mux.Handle("GET /events", s.requireAdminToken(s.audit.live.ServeHTTP))
+		}
+		mux.Handle("DELETE /sessions/{id}", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+			writeAdminResult(w, s.terminateSession(r.PathValue("id")))
+		}))
+		mux.Handle("DELETE /uploads", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+			writeAdminResult(w, s.cancelUpload(r.URL.Query().Get("path")))
+		}))
+		if s.bans != nil {
+			mux.Handle("GET /bans", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, map[string]any{"bans": s.bans.list()})
+			}))
+			mux.Handle("DELETE /bans/{ip}", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+				writeAdminResult(w, s.bans.lift(r.PathValue("ip")))
+			}))
+		}
+	}
+	return mux
+}
+
+// writeAdminResult answers an admin action with 204 No Content, or the
+// status for its error.
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errSessionNotFound), errors.Is(err, errUploadNotFound), errors.Is(err, errBanNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errUploadStoring):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requireAdminToken only lets requests with ADMIN_TOKEN as bearer token
+// through to next.
+func (s *SFTPServer) requireAdminToken(next http.HandlerFunc) http.Handler {
+	want := []byte("Bearer " + s.config.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+			s.logger.Warn("admin request rejected: invalid token",
+				slog.String("remote_ip", remoteIP),
+				slog.String("path", r.URL.Path),
+			)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkReady tells whether the gateway should get new connections.
+func (s *SFTPServer) checkReady(ctx context.Context) error {
+	if !s.ready.Load() {
+		return errors.New("not accepting connections")
+	}
+	if s.config.ReadyCheckAWS {
+		ctx, cancel := context.WithTimeout(ctx, awsProbeTimeout)
+		defer cancel()
+		for _, endpoint := range s.awsEndpoints() {
+			if err := checkReachable(ctx, s.awsHTTPClient, endpoint); err != nil {
+				return fmt.Errorf("%s unreachable: %w", endpoint, err)
+			}
+		}
+	}
+	return nil
+}
+
+// awsEndpoints returns the STS and S3 endpoints sessions depend on.
+func (s *SFTPServer) awsEndpoints() []string {
+	sts, s3 := "https://sts.amazonaws.com", "https://s3.amazonaws.com"
+	if s.config.S3Region != "" {
+		sts = "https://sts." + s.config.S3Region + ".amazonaws.com"
+		s3 = "https://s3." + s.config.S3Region + ".amazonaws.com"
+	}
+	if s.config.S3EndpointURL != "" {
+		s3 = s.config.S3EndpointURL
+	}
+	return []string{sts, s3}
+}
+
+// checkReachable sends an unauthenticated request to endpoint. Any HTTP
+// response, even an error, shows that it can be reached.
+func checkReachable(ctx context.Context, client aws.HTTPClient, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// serveAdmin runs the admin listener until ctx is done.
+func (s *SFTPServer) serveAdmin(ctx context.Context, listener net.Listener) {
+	// no write timeout, CPU profiles and traces take as long as requested
+	server := &http.Server{
+		Handler:           s.adminMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	s.logger.Info("admin server listening", slog.String("address", listener.Addr().String()))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("admin server failed", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/st3fan/sftpgw/adminclient"
+)
+
+func TestAdminMux_HealthAndReadiness(t *testing.T) {
+	s := &SFTPServer{
+		config: &Config{},
+		logger: slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d", got, http.StatusOK)
+	}
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz status before start = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	s.ready.Store(true)
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestAdminMux_Version(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "3f2a9c1e", "2024-01-15T14:30:45Z"
+
+	s := &SFTPServer{config: &Config{}}
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/version")
+	if err != nil {
+		t.Fatalf("GET /version failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var got buildInfo
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("GET /version: invalid JSON: %v", err)
+	}
+	want := buildInfo{Version: "1.4.0", Commit: "3f2a9c1e", BuildDate: "2024-01-15T14:30:45Z", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("/version = %+v, want %+v", got, want)
+	}
+	if s := got.String(); s != "sftpgw 1.4.0 (3f2a9c1e, built 2024-01-15T14:30:45Z) "+runtime.Version() {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestAdminMux_Pprof(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		s := &SFTPServer{config: &Config{AdminPprof: enabled}}
+		server := httptest.NewServer(s.adminMux())
+
+		resp, err := http.Get(server.URL + "/debug/pprof/heap")
+		if err != nil {
+			t.Fatalf("GET /debug/pprof/heap failed: %v", err)
+		}
+		resp.Body.Close()
+		cmdline, err := http.Get(server.URL + "/debug/pprof/cmdline")
+		if err != nil {
+			t.Fatalf("GET /debug/pprof/cmdline failed: %v", err)
+		}
+		cmdline.Body.Close()
+		server.Close()
+
+		if cmdline.StatusCode != http.StatusNotFound {
+			t.Errorf("/debug/pprof/cmdline status with AdminPprof %v = %d, want it not served", enabled, cmdline.StatusCode)
+		}
+
+		if want := map[bool]int{false: http.StatusNotFound, true: http.StatusOK}[enabled]; resp.StatusCode != want {
+			t.Errorf("/debug/pprof/heap status with AdminPprof %v = %d, want %d", enabled, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestAWSEndpoints(t *testing.T) {
+	s := &SFTPServer{config: &Config{S3Region: "eu-west-1"}}
+	want := []string{"https://sts.eu-west-1.amazonaws.com", "https://s3.eu-west-1.amazonaws.com"}
+	if got := s.awsEndpoints(); !slices.Equal(got, want) {
+		t.Errorf("awsEndpoints() = %v, want %v", got, want)
+	}
+
+	s.config.S3EndpointURL = "https://minio.internal:9000"
+	if got := s.awsEndpoints(); got[1] != s.config.S3EndpointURL {
+		t.Errorf("awsEndpoints() = %v, want the S3 endpoint %s", got, s.config.S3EndpointURL)
+	}
+}
+
+func TestCheckReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	url := server.URL
+
+	if err := checkReachable(context.Background(), http.DefaultClient, url); err != nil {
+		t.Errorf("checkReachable() error = %v, want an error response to count as reachable", err)
+	}
+
+	server.Close()
+	if err := checkReachable(context.Background(), http.DefaultClient, url); err == nil {
+		t.Error("checkReachable() of a closed server: expected error")
+	}
+}
+
+func TestAdminMux_SessionsAndUploads(t *testing.T) {
+	s := &SFTPServer{
+		config:  &Config{AdminToken: "0123456789abcdef"},
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		handler: &SFTPHandler{},
+	}
+	conn := &timeoutConn{}
+	conn.received.Store(4096)
+	connected := time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC)
+	s.sessions.Store("0123456789abcdef", &activeSession{
+		id:        "0123456789abcdef",
+		user:      "alice",
+		remoteIP:  "203.0.113.7",
+		port:      2222,
+		connected: connected,
+		conn:      conn,
+	})
+	upload := &FileUpload{sessionID: "0123456789abcdef", user: "alice", clientIP: "203.0.113.7", path: "/uploads/a.csv", opened: connected}
+	upload.sizeSeen.Store(1024)
+	upload.buffered.Store(4096)
+	upload.state.Store(uploadClosed)
+	s.handler.activeUploads.Store(upload.path, upload)
+	small := &FileUpload{sessionID: "fedcba9876543210", user: "bob", path: "/uploads/b.csv", opened: connected}
+	small.buffered.Store(1024)
+	s.handler.activeUploads.Store(small.path, small)
+
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	get := func(path, token string, v any) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("GET %s: invalid JSON: %v", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	for _, token := range []string{"", "wrong-token-0123456"} {
+		if got := get("/sessions", token, nil); got != http.StatusUnauthorized {
+			t.Errorf("/sessions with token %q status = %d, want %d", token, got, http.StatusUnauthorized)
+		}
+	}
+
+	var sessions struct{ Sessions []sessionStatus }
+	if got := get("/sessions", "0123456789abcdef", &sessions); got != http.StatusOK {
+		t.Fatalf("/sessions status = %d, want %d", got, http.StatusOK)
+	}
+	want := sessionStatus{SessionID: "0123456789abcdef", User: "alice", RemoteIP: "203.0.113.7", Port: 2222, ConnectedAt: connected, BytesReceived: 4096, Uploads: 1}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0] != want {
+		t.Errorf("/sessions = %+v, want %+v", sessions.Sessions, want)
+	}
+
+	var uploads struct {
+		Uploads []uploadStatus
+		Memory  bufferUsage
+	}
+	if got := get("/uploads", "0123456789abcdef", &uploads); got != http.StatusOK {
+		t.Fatalf("/uploads status = %d, want %d", got, http.StatusOK)
+	}
+	if len(uploads.Uploads) != 2 || uploads.Uploads[0].FilePath != "/uploads/a.csv" || uploads.Uploads[0].BytesReceived != 1024 || uploads.Uploads[0].BufferedBytes != 4096 || uploads.Uploads[0].State != "storing" {
+		t.Errorf("/uploads = %+v, want /uploads/a.csv with 1024 bytes being stored", uploads.Uploads)
+	}
+	if want := (bufferUsage{BufferedBytes: 5120, LargestBufferBytes: 4096, LargestBufferPath: "/uploads/a.csv"}); uploads.Memory != want {
+		t.Errorf("/uploads memory = %+v, want %+v", uploads.Memory, want)
+	}
+
+	s.config.AdminToken = ""
+	disabled := httptest.NewServer(s.adminMux())
+	defer disabled.Close()
+	resp, err := http.Get(disabled.URL + "/sessions")
+	if err != nil {
+		t.Fatalf("GET /sessions failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/sessions without ADMIN_TOKEN status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAdminMux_Bans(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	s := &SFTPServer{
+		config: &Config{AdminToken: "0123456789abcdef"},
+		logger: logger,
+		bans:   newIPBans(&Config{BanThreshold: 1, BanFindTime: time.Minute, BanDuration: time.Hour}, logger),
+	}
+	s.bans.recordFailure("203.0.113.7")
+
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	do := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/bans", "wrong-token-0123456")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/bans with a wrong token status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp = do(http.MethodGet, "/bans", "0123456789abcdef")
+	var bans struct{ Bans []banStatus }
+	json.NewDecoder(resp.Body).Decode(&bans)
+	resp.Body.Close()
+	if len(bans.Bans) != 1 || bans.Bans[0].RemoteIP != "203.0.113.7" {
+		t.Errorf("/bans = %+v, want 203.0.113.7", bans.Bans)
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		resp := do(http.MethodDelete, "/bans/203.0.113.7", "0123456789abcdef")
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("DELETE /bans/203.0.113.7 status = %d, want %d", resp.StatusCode, want)
+		}
+	}
+	if s.bans.isBanned("203.0.113.7") {
+		t.Error("expected DELETE /bans/203.0.113.7 to lift the ban")
+	}
+}
+
+// TestAdminClient keeps the client package in step with the admin API.
+func TestAdminClient(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	s := &SFTPServer{
+		config:  &Config{AdminToken: "0123456789abcdef"},
+		logger:  logger,
+		handler: &SFTPHandler{},
+		metrics: newMetrics(),
+		bans:    newIPBans(&Config{BanThreshold: 1, BanFindTime: time.Minute, BanDuration: time.Hour}, logger),
+	}
+	conn, _ := newTestTimeoutConn(t)
+	s.sessions.Store("0123456789abcdef", &activeSession{id: "0123456789abcdef", user: "alice", port: 2222, conn: conn})
+	upload := &FileUpload{sessionID: "0123456789abcdef", user: "alice", path: "/uploads/a.csv"}
+	s.handler.activeUploads.Store(upload.path, upload)
+	s.bans.recordFailure("203.0.113.7")
+	s.metrics.observeConnection(2222)
+
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+	client := adminclient.New(server.URL+"/", "0123456789abcdef")
+	ctx := context.Background()
+
+	sessions, err := client.Sessions(ctx)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Port != 2222 || sessions[0].Uploads != 1 {
+		t.Errorf("Sessions() = %+v, want alice's session on port 2222 with 1 upload", sessions)
+	}
+
+	uploads, memory, err := client.Uploads(ctx)
+	if err != nil {
+		t.Fatalf("Uploads() unexpected error: %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].FilePath != "/uploads/a.csv" || uploads[0].State != "receiving" || memory == nil {
+		t.Errorf("Uploads() = %+v, %+v, want /uploads/a.csv receiving", uploads, memory)
+	}
+
+	bans, err := client.Bans(ctx)
+	if err != nil {
+		t.Fatalf("Bans() unexpected error: %v", err)
+	}
+	if len(bans) != 1 || bans[0].RemoteIP != "203.0.113.7" || bans[0].Until.IsZero() {
+		t.Errorf("Bans() = %+v, want 203.0.113.7", bans)
+	}
+
+	metrics, err := client.Metrics(ctx)
+	if err != nil {
+		t.Fatalf("Metrics() unexpected error: %v", err)
+	}
+	if got := metrics[`sftpgw_connections_total{port="2222"}`]; got != 1 {
+		t.Errorf("Metrics() connections on port 2222 = %v, want 1", got)
+	}
+
+	if err := client.CancelUpload(ctx, "/uploads/a.csv"); err != nil {
+		t.Errorf("CancelUpload() unexpected error: %v", err)
+	}
+	if err := client.LiftBan(ctx, "203.0.113.7"); err != nil {
+		t.Errorf("LiftBan() unexpected error: %v", err)
+	}
+	if err := client.TerminateSession(ctx, "0123456789abcdef"); err != nil {
+		t.Errorf("TerminateSession() unexpected error: %v", err)
+	}
+
+	var statusErr *adminclient.StatusError
+	if err := client.TerminateSession(ctx, "unknown"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("TerminateSession() of an unknown session = %v, want a 404 StatusError", err)
+	}
+	if _, err := adminclient.New(server.URL, "wrong-token-0123456").Sessions(ctx); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Sessions() with a wrong token = %v, want a 401 StatusError", err)
+	}
+}
+
+func TestAdminMux_TerminateAndCancel(t *testing.T) {
+	s := &SFTPServer{
+		config:  &Config{AdminToken: "0123456789abcdef"},
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		handler: &SFTPHandler{},
+	}
+	conn, client := newTestTimeoutConn(t)
+	s.sessions.Store("0123456789abcdef", &activeSession{id: "0123456789abcdef", user: "alice", conn: conn})
+	receiving := &FileUpload{user: "alice", path: "/uploads/a.csv"}
+	storing := &FileUpload{user: "alice", path: "/uploads/b.csv"}
+	storing.state.Store(uploadClosed)
+	s.handler.activeUploads.Store(receiving.path, receiving)
+	s.handler.activeUploads.Store(storing.path, storing)
+
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	del := func(path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/sessions/unknown", http.StatusNotFound},
+		{"/sessions/0123456789abcdef", http.StatusNoContent},
+		{"/uploads?path=/uploads/missing.csv", http.StatusNotFound},
+		{"/uploads?path=/uploads/a.csv", http.StatusNoContent},
+		{"/uploads?path=/uploads/a.csv", http.StatusNoContent},
+		{"/uploads?path=/uploads/b.csv", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got := del(tt.path); got != tt.want {
+			t.Errorf("DELETE %s status = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("terminated session's connection is still open")
+	}
+	if got := receiving.state.Load(); got != uploadCancelled {
+		t.Errorf("cancelled upload state = %d, want %d", got, uploadCancelled)
+	}
+	if got := storing.state.Load(); got != uploadClosed {
+		t.Errorf("stored upload state = %d, want %d", got, uploadClosed)
+	}
+}
@@ -0,0 +1,246 @@
+// Package adminclient is a client for the admin API of the sftpgw gateway,
+// for tooling that lists and ends sessions, cancels uploads, lifts IP bans
+// or reads the metrics without parsing the JSON itself.
+//
+// The API is served on ADMIN_ADDR. Everything but Version and Metrics needs
+// ADMIN_TOKEN:
+//
+//	client := adminclient.New("http://gateway:8080", os.Getenv("ADMIN_TOKEN"))
+//	sessions, err := client.Sessions(ctx)
+package adminclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the admin API of one gateway. Its zero value isn't usable;
+// create one with New.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// New returns a client for the admin API at baseURL, such as
+// http://localhost:8080, that authenticates with token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithHTTPClient returns a copy of c that sends its requests with
+// httpClient, for example one with TLS settings for a proxy in front of
+// the admin port.
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	clone := *c
+	clone.httpClient = httpClient
+	return &clone
+}
+
+// StatusError is the error for a response other than 2xx. The admin API
+// answers 401 for a missing or wrong token, 404 for an unknown session,
+// upload or ban, and 409 for an upload that can no longer be cancelled.
+type StatusError struct {
+	StatusCode int
+	Message    string // the body of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("admin API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// BuildInfo identifies the binary of the gateway.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Session is a logged in SSH connection.
+type Session struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	RemoteIP      string    `json:"remote_ip"`
+	Port          int       `json:"port"`
+	ClientVersion string    `json:"client_version"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	BytesReceived int64     `json:"bytes_received"` // on the connection, including SSH overhead
+	BytesSent     int64     `json:"bytes_sent"`
+	Uploads       int       `json:"uploads"`
+}
+
+// Upload is a file being received or stored.
+type Upload struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	RemoteIP      string    `json:"remote_ip"`
+	FilePath      string    `json:"file_path"`
+	OpenedAt      time.Time `json:"opened_at"`
+	BytesReceived int64     `json:"bytes_received"`
+	BufferedBytes int64     `json:"buffered_bytes"` // held in memory
+	Streaming     bool      `json:"streaming"`
+	State         string    `json:"state"` // "receiving", "storing" once closed, or "cancelled"
+}
+
+// Memory is the memory held by all open files together.
+type Memory struct {
+	BufferedBytes      int64  `json:"buffered_bytes"`
+	LargestBufferBytes int64  `json:"largest_buffer_bytes"`
+	LargestBufferPath  string `json:"largest_buffer_path,omitempty"`
+}
+
+// Ban is a client IP banned by BAN_THRESHOLD.
+type Ban struct {
+	RemoteIP string    `json:"remote_ip"`
+	Until    time.Time `json:"until"`
+}
+
+// Version returns the version of the gateway.
+func (c *Client) Version(ctx context.Context) (*BuildInfo, error) {
+	var info BuildInfo
+	if err := c.getJSON(ctx, "/version", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Sessions lists the logged in SSH connections, oldest first.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := c.getJSON(ctx, "/sessions", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// TerminateSession closes the connection of a session. Files it still had
+// open can be resumed within RESUME_TIMEOUT.
+func (c *Client) TerminateSession(ctx context.Context, sessionID string) error {
+	return c.delete(ctx, "/sessions/"+url.PathEscape(sessionID))
+}
+
+// Uploads lists the open files and the memory they hold.
+func (c *Client) Uploads(ctx context.Context) ([]Upload, *Memory, error) {
+	var resp struct {
+		Uploads []Upload `json:"uploads"`
+		Memory  Memory   `json:"memory"`
+	}
+	if err := c.getJSON(ctx, "/uploads", &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Uploads, &resp.Memory, nil
+}
+
+// CancelUpload discards the open file at path instead of storing it.
+func (c *Client) CancelUpload(ctx context.Context, path string) error {
+	return c.delete(ctx, "/uploads?path="+url.QueryEscape(path))
+}
+
+// Bans lists the banned client IPs, those ending first first.
+func (c *Client) Bans(ctx context.Context) ([]Ban, error) {
+	var resp struct {
+		Bans []Ban `json:"bans"`
+	}
+	if err := c.getJSON(ctx, "/bans", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Bans, nil
+}
+
+// LiftBan ends the ban of a client IP early and forgets its failures.
+func (c *Client) LiftBan(ctx context.Context, ip string) error {
+	return c.delete(ctx, "/bans/"+url.PathEscape(ip))
+}
+
+// Metrics returns a snapshot of the counters, gauges and histograms of
+// /metrics, keyed by the series as the Prometheus text format writes them,
+// such as sftpgw_uploads_total{bucket="b",prefix="",outcome="success"}.
+func (c *Client) Metrics(ctx context.Context) (map[string]float64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("admin API: invalid metrics line %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("admin API: invalid metrics line %q: %w", line, err)
+		}
+		metrics[line[:i]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("admin API: reading metrics: %w", err)
+	}
+	return metrics, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("admin API: decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Client) delete(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodDelete, path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request and returns the response if it succeeded, or a
+// StatusError otherwise.
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return resp, nil
+}
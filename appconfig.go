@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hotReloadSettings are applied while the gateway runs when they change in
+// the AppConfig profile. Changes to any other setting restart the gateway,
+// as with CONFIG_PARAMETER_REFRESH. ALLOWED_PRINCIPALS is left out on
+// purpose: with ALLOW_ANY_ACCOUNT, whether untagged principals may log in
+// depends on it, which is decided when the gateway starts.
+var hotReloadSettings = map[string]bool{
+	"ALLOWED_EXTENSIONS": true,
+	"DENIED_EXTENSIONS":  true,
+	"MAX_FILE_SIZE":      true,
+	"SESSION_MAX_BYTES":  true,
+	"SESSION_MAX_FILES":  true,
+	"UPLOAD_ROUTES":      true,
+}
+
+// configProfile keeps settings in an AWS AppConfig configuration profile, a
+// JSON object of settings named after their environment variable, such as
+// {"MAX_FILE_SIZE": 10485760}. Variables set in the environment, directly or
+// through Parameter Store, take precedence. Like Parameter Store, the values
+// are resolved into the environment before LoadConfig reads it.
+type configProfile struct {
+	application string
+	environment string
+	profile     string
+	interval    time.Duration   // between polls, at least what AppConfig asks for
+	direct      map[string]bool // environment variables set outside the profile
+	client      *awsJSONClient
+	token       string            // for the next poll, empty to start a new session
+	applied     map[string]string // values resolved into the environment
+}
+
+// parseAppConfigProfile splits APPCONFIG_PROFILE, such as
+// "sftpgw/prod/settings", into the application, environment and
+// configuration profile, each given by name or ID.
+func parseAppConfigProfile(value string) (application, environment, profile string, err error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 || slices.Contains(parts, "") {
+		return "", "", "", fmt.Errorf("%q is not application/environment/profile", value)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// loadConfigProfile resolves the settings of APPCONFIG_PROFILE into the
+// environment, with the gateway's own credentials. It returns nil if the
+// variable isn't set.
+func loadConfigProfile(ctx context.Context) (*configProfile, error) {
+	value := getenv("APPCONFIG_PROFILE")
+	if value == "" {
+		return nil, nil
+	}
+	application, environment, profile, err := parseAppConfigProfile(value)
+	if err != nil {
+		return nil, invalidSetting("APPCONFIG_PROFILE", "%w", err)
+	}
+
+	p := &configProfile{
+		application: application,
+		environment: environment,
+		profile:     profile,
+		interval:    time.Minute,
+		direct:      make(map[string]bool),
+	}
+	if refresh := getenv("APPCONFIG_REFRESH"); refresh != "" {
+		d, err := time.ParseDuration(refresh)
+		if err != nil {
+			return nil, invalidSetting("APPCONFIG_REFRESH", "%w", err)
+		}
+		if d < 15*time.Second {
+			return nil, invalidSetting("APPCONFIG_REFRESH", "must be at least 15s")
+		}
+		p.interval = d
+	}
+	for _, name := range configEnvVars {
+		if getenv(name) != "" {
+			p.direct[name] = true
+		}
+	}
+
+	cfg := &Config{S3Region: getenv("AWS_REGION")}
+	awsConfig, err := loadGatewayAWSConfig(ctx, cfg, newAWSHTTPClient(cfg, false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config for AppConfig: %w", err)
+	}
+	// AppConfig Data signs as appconfig but has an endpoint of its own
+	p.client = newAWSJSONClient(awsConfig, "appconfig", "", "1.1")
+	p.client.endpoint = "https://appconfigdata." + awsConfig.Region + ".amazonaws.com"
+
+	values, _, err := p.poll(ctx)
+	if err != nil {
+		return nil, invalidSetting("APPCONFIG_PROFILE", "%w", err)
+	}
+	p.apply(values)
+	return p, nil
+}
+
+// startSession starts an AppConfig configuration session, whose first poll
+// returns the deployed configuration.
+func (p *configProfile) startSession(ctx context.Context) error {
+	body, err := json.Marshal(map[string]any{
+		"ApplicationIdentifier":                p.application,
+		"EnvironmentIdentifier":                p.environment,
+		"ConfigurationProfileIdentifier":       p.profile,
+		"RequiredMinimumPollIntervalInSeconds": 15,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.send(ctx, http.MethodPost, "/configurationsessions", body, map[string]string{
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := appConfigError(resp, "StartConfigurationSession"); err != nil {
+		return err
+	}
+
+	var result struct {
+		InitialConfigurationToken string `json:"InitialConfigurationToken"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return err
+	}
+	p.token = result.InitialConfigurationToken
+	return nil
+}
+
+// poll returns the settings of the profile and true if a new version was
+// deployed since the last poll. AppConfig only sends the configuration when
+// it changed.
+func (p *configProfile) poll(ctx context.Context) (map[string]string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if p.token == "" {
+		if err := p.startSession(ctx); err != nil {
+			return nil, false, err
+		}
+	}
+
+	resp, err := p.client.send(ctx, http.MethodGet, "/configuration?configuration_token="+url.QueryEscape(p.token), nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if err := appConfigError(resp, "GetLatestConfiguration"); err != nil {
+		// the token may have expired, start over next time
+		p.token = ""
+		return nil, false, err
+	}
+
+	p.token = resp.Header.Get("Next-Poll-Configuration-Token")
+	if seconds, err := strconv.Atoi(resp.Header.Get("Next-Poll-Interval-In-Seconds")); err == nil {
+		p.interval = max(p.interval, time.Duration(seconds)*time.Second)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) == 0 {
+		return nil, false, nil
+	}
+	values, err := p.parse(body)
+	if err != nil {
+		return nil, false, err
+	}
+	return values, true, nil
+}
+
+// parse reads the settings of a profile. Values may be strings, numbers or
+// booleans. Settings also set in the environment are left out.
+func (p *configProfile) parse(body []byte) (map[string]string, error) {
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return nil, fmt.Errorf("profile is not a JSON object: %w", err)
+	}
+
+	values := make(map[string]string)
+	var errs []error
+	for name, raw := range settings {
+		if !slices.Contains(configEnvVars, name) {
+			errs = append(errs, fmt.Errorf("unknown setting %s", name))
+			continue
+		}
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		case float64, bool:
+			values[name] = string(raw)
+		default:
+			errs = append(errs, fmt.Errorf("%s must be a string, number or boolean", name))
+		}
+		if p.direct[name] {
+			delete(values, name)
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+// apply sets the environment variables to values, and clears the ones no
+// longer in the profile.
+func (p *configProfile) apply(values map[string]string) {
+	for name := range p.applied {
+		if _, ok := values[name]; !ok {
+			os.Unsetenv(name)
+		}
+	}
+	for name, value := range values {
+		os.Setenv(name, value)
+	}
+	p.applied = values
+}
+
+// refresh polls the profile and returns the settings that changed along with
+// the configuration that results. Changes that make the configuration
+// invalid are not applied; AppConfig doesn't send that version again, so
+// the previous values stay in effect until the next deployment.
+func (p *configProfile) refresh(ctx context.Context) ([]string, *Config, error) {
+	values, updated, err := p.poll(ctx)
+	if err != nil || !updated {
+		return nil, nil, err
+	}
+
+	var changed []string
+	for name, value := range values {
+		if previous, ok := p.applied[name]; !ok || previous != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range p.applied {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil, nil
+	}
+	slices.Sort(changed)
+
+	previous := p.applied
+	p.apply(values)
+	config, err := LoadConfig()
+	if err != nil {
+		p.apply(previous)
+		return nil, nil, fmt.Errorf("new values of %s are invalid: %w", strings.Join(changed, ", "), err)
+	}
+	return changed, config, nil
+}
+
+// run polls the profile until ctx is done. Changes to hot-reloadable
+// settings only are passed to reload; any other change calls restart to shut
+// the gateway down gracefully, so its supervisor starts it with the new
+// values.
+func (p *configProfile) run(ctx context.Context, logger *slog.Logger, restart func(), reload func(*Config)) {
+	timer := time.NewTimer(p.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		changed, config, err := p.refresh(ctx)
+		timer.Reset(p.interval)
+		if err != nil {
+			logger.Error("failed to refresh configuration profile", slog.String("error", err.Error()))
+			continue
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if slices.ContainsFunc(changed, func(name string) bool { return !hotReloadSettings[name] }) {
+			logger.Info("configuration profile changed, shutting down to apply it",
+				slog.String("settings", strings.Join(changed, ",")),
+			)
+			restart()
+			return
+		}
+		reload(config)
+		logger.Info("configuration profile changed, applied without restart",
+			slog.String("settings", strings.Join(changed, ",")),
+		)
+	}
+}
+
+// appConfigError returns the error of a failed AppConfig response. The REST
+// API names the error in a header rather than in the body.
+func appConfigError(resp *http.Response, operation string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var failure struct {
+		Message string `json:"Message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&failure)
+	code, _, _ := strings.Cut(resp.Header.Get("X-Amzn-ErrorType"), ":")
+	return &awsAPIError{
+		service:   "appconfig",
+		operation: operation,
+		status:    resp.Status,
+		Code:      code,
+		Message:   failure.Message,
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAppConfig serves StartConfigurationSession and GetLatestConfiguration.
+// It sends the configuration once after each deployment, like AppConfig.
+type fakeAppConfig struct {
+	configuration string
+	deployed      bool // a new configuration the client hasn't seen yet
+	sessions      int
+}
+
+func (f *fakeAppConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/configurationsessions":
+		f.sessions++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"InitialConfigurationToken":"token-0"}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/configuration":
+		if r.URL.Query().Get("configuration_token") == "" {
+			w.Header().Set("X-Amzn-ErrorType", "BadRequestException")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"Message":"token required"}`))
+			return
+		}
+		w.Header().Set("Next-Poll-Configuration-Token", "token-next")
+		w.Header().Set("Next-Poll-Interval-In-Seconds", "30")
+		if f.deployed {
+			f.deployed = false
+			w.Write([]byte(f.configuration))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAppConfig) deploy(configuration string) {
+	f.configuration = configuration
+	f.deployed = true
+}
+
+func newTestConfigProfile(t *testing.T, fake *fakeAppConfig) *configProfile {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	p := &configProfile{application: "sftpgw", environment: "prod", profile: "settings", direct: make(map[string]bool)}
+	for _, name := range configEnvVars {
+		if getenv(name) != "" {
+			p.direct[name] = true
+		}
+	}
+	p.client = newAWSJSONClient(testAWSConfig(server), "appconfig", "", "1.1")
+	p.client.endpoint = server.URL
+	return p
+}
+
+func TestParseAppConfigProfile(t *testing.T) {
+	application, environment, profile, err := parseAppConfigProfile("sftpgw/prod/settings")
+	if err != nil || application != "sftpgw" || environment != "prod" || profile != "settings" {
+		t.Errorf("parseAppConfigProfile() = %q, %q, %q, %v", application, environment, profile, err)
+	}
+	for _, value := range []string{"sftpgw/prod", "sftpgw//settings", "a/b/c/d"} {
+		if _, _, _, err := parseAppConfigProfile(value); err == nil {
+			t.Errorf("parseAppConfigProfile(%q) expected error", value)
+		}
+	}
+}
+
+func TestLoadConfigProfile_InvalidRefresh(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("APPCONFIG_PROFILE", "sftpgw/prod/settings")
+
+	for _, refresh := range []string{"often", "5s"} {
+		os.Setenv("APPCONFIG_REFRESH", refresh)
+		_, err := loadConfigProfile(context.Background())
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "APPCONFIG_REFRESH" {
+			t.Errorf("loadConfigProfile() with APPCONFIG_REFRESH=%s = %v, want it reported", refresh, err)
+		}
+	}
+}
+
+func TestConfigProfile_Poll(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("MAX_CONNECTIONS", "10")
+
+	fake := &fakeAppConfig{}
+	fake.deploy(`{"MAX_FILE_SIZE": 4096, "STREAM_UPLOADS": true, "UPLOAD_ROUTES": "user=acme-*,prefix=acme", "MAX_CONNECTIONS": 50}`)
+	p := newTestConfigProfile(t, fake)
+
+	values, updated, err := p.poll(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("poll() = %v, %v, want the deployed configuration", updated, err)
+	}
+	want := map[string]string{"MAX_FILE_SIZE": "4096", "STREAM_UPLOADS": "true", "UPLOAD_ROUTES": "user=acme-*,prefix=acme"}
+	if len(values) != len(want) {
+		t.Errorf("poll() = %v, want %v without MAX_CONNECTIONS set in the environment", values, want)
+	}
+	for name, value := range want {
+		if values[name] != value {
+			t.Errorf("poll() %s = %q, want %q", name, values[name], value)
+		}
+	}
+	if p.token != "token-next" || p.interval < 30*time.Second {
+		t.Errorf("Expected the next token and at least the interval AppConfig asks for, got %q and %v", p.token, p.interval)
+	}
+
+	if _, updated, err := p.poll(context.Background()); err != nil || updated {
+		t.Errorf("second poll() = %v, %v, want no new configuration", updated, err)
+	}
+
+	fake.deploy(`{"MAX_FILE_SIZ": 4096, "SSH_BANNER": ["a"]}`)
+	_, _, err = p.poll(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unknown setting MAX_FILE_SIZ") || !strings.Contains(err.Error(), "SSH_BANNER must be a string") {
+		t.Errorf("poll() error = %v, want errors for the unknown setting and the list", err)
+	}
+}
+
+func TestConfigProfile_Refresh(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	fake := &fakeAppConfig{}
+	fake.deploy(`{"MAX_FILE_SIZE": "4096", "SSH_BANNER": "Authorized use only"}`)
+	p := newTestConfigProfile(t, fake)
+	values, _, err := p.poll(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p.apply(values)
+
+	if changed, _, err := p.refresh(context.Background()); err != nil || len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", changed, err)
+	}
+
+	fake.deploy(`{"MAX_FILE_SIZE": "-1", "SSH_BANNER": "Authorized use only"}`)
+	if _, _, err := p.refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid MAX_FILE_SIZE") {
+		t.Errorf("Expected error for invalid new value, got: %v", err)
+	}
+	if os.Getenv("MAX_FILE_SIZE") != "4096" {
+		t.Errorf("Expected invalid value not applied, got MAX_FILE_SIZE=%s", os.Getenv("MAX_FILE_SIZE"))
+	}
+
+	fake.deploy(`{"MAX_FILE_SIZE": "8192"}`)
+	changed, config, err := p.refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !slices.Equal(changed, []string{"MAX_FILE_SIZE", "SSH_BANNER"}) {
+		t.Errorf("Expected MAX_FILE_SIZE and SSH_BANNER changed, got %v", changed)
+	}
+	if config.MaxFileSize != 8192 || os.Getenv("SSH_BANNER") != "" {
+		t.Errorf("Expected the new values, got MaxFileSize %d and SSH_BANNER=%s", config.MaxFileSize, os.Getenv("SSH_BANNER"))
+	}
+}
+
+func TestConfigProfile_ExpiredToken(t *testing.T) {
+	fake := &fakeAppConfig{}
+	fake.deploy(`{}`)
+	p := newTestConfigProfile(t, fake)
+	if _, _, err := p.poll(context.Background()); err != nil {
+		t.Fatalf("poll() unexpected error: %v", err)
+	}
+
+	p.token = ""
+	if _, _, err := p.poll(context.Background()); err != nil || fake.sessions != 2 {
+		t.Errorf("poll() without a token = %v after %d sessions, want a new session", err, fake.sessions)
+	}
+}
+
+func TestSFTPHandler_Settings(t *testing.T) {
+	config := &Config{MaxFileSize: 1024}
+	handler := NewSFTPHandler(config, nil, nil)
+	if handler.settings() != config {
+		t.Error("settings() before a reload should be the startup configuration")
+	}
+
+	reloaded := &Config{MaxFileSize: 4096, DeniedExtensions: []string{".exe"}}
+	handler.live.Store(reloaded)
+	if got := (&FileUpload{}).maxSize(handler.settings()); got != 4096 {
+		t.Errorf("maxSize() after a reload = %d, want 4096", got)
+	}
+	if err := handler.checkExtension("/uploads/setup.exe", nil); err == nil {
+		t.Error("checkExtension() expected the reloaded DENIED_EXTENSIONS to apply")
+	}
+}
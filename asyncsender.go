@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// asyncSender sends what the gateway reports about sessions and uploads to
+// an AWS API in the background. Items are queued and sent in batches by run;
+// when the queue is full they are dropped rather than holding up the client
+// whose session or file they are about.
+type asyncSender[T any] struct {
+	what      string // the items, for logs
+	client    *awsJSONClient
+	timeFunc  func() time.Time
+	logger    *slog.Logger
+	logAttrs  []any // the destination, for logs
+	batchSize int   // the most items deliver is called with
+	deliver   func(ctx context.Context, batch []T) error
+
+	queue chan T
+}
+
+func newAsyncSender[T any](what string, client *awsJSONClient, queueSize, batchSize int, logger *slog.Logger) asyncSender[T] {
+	return asyncSender[T]{
+		what:      what,
+		client:    client,
+		timeFunc:  time.Now,
+		logger:    logger,
+		batchSize: batchSize,
+		queue:     make(chan T, queueSize),
+	}
+}
+
+// enqueue queues an item for run, or drops it when the queue is full. attrs
+// identify the item in the log.
+func (s *asyncSender[T]) enqueue(item T, attrs ...any) {
+	select {
+	case s.queue <- item:
+	default:
+		s.logger.Warn(s.what+" dropped: queue full", attrs...)
+	}
+}
+
+// run delivers queued items until ctx is done.
+func (s *asyncSender[T]) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-s.queue:
+			batch := []T{item}
+			for len(batch) < s.batchSize && len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+
+			sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := s.deliver(sendCtx, batch)
+			cancel()
+			if err != nil {
+				s.logger.Error("failed to send "+s.what, append(slices.Clip(s.logAttrs),
+					slog.Int("count", len(batch)),
+					slog.String("error", err.Error()),
+				)...)
+			}
+		}
+	}
+}
+
+// uploadFields describes a file of a session in the messages sent about it.
+type uploadFields struct {
+	User        string `json:"user"`
+	AccessKeyID string `json:"access_key_id,omitempty"`
+	AccountID   string `json:"account_id,omitempty"`
+	SessionID   string `json:"session_id"`
+	RemoteIP    string `json:"remote_ip"`
+	FilePath    string `json:"file_path"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key,omitempty"` // empty if it wasn't chosen yet
+	Size        int64  `json:"size"`
+}
+
+func newUploadFields(session uploadSession, filePath, bucket, key string, size int64) uploadFields {
+	return uploadFields{
+		User:        session.user,
+		AccessKeyID: session.accessKeyID,
+		AccountID:   session.accountID,
+		SessionID:   session.sessionID,
+		RemoteIP:    session.clientIP,
+		FilePath:    filePath,
+		Bucket:      bucket,
+		Key:         key,
+		Size:        size,
+	}
+}
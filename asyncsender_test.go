@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// useTestServer sends the requests of s to server and stops its clock at
+// now.
+func (s *asyncSender[T]) useTestServer(server *httptest.Server, now time.Time) {
+	s.client.endpoint = server.URL
+	s.timeFunc = func() time.Time { return now }
+}
+
+// newTestAWSSender builds a sender with newSender for a test server running
+// handler, with its clock stopped at now.
+func newTestAWSSender[S interface {
+	useTestServer(*httptest.Server, time.Time)
+}](t *testing.T, now time.Time, handler http.HandlerFunc, newSender func(aws.Config) S) S {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	s := newSender(testAWSConfig(server))
+	s.useTestServer(server, now)
+	return s
+}
+
+func TestAsyncSender_Run(t *testing.T) {
+	s := newAsyncSender[int]("numbers", nil, 3, 2, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	batches := make(chan []int, 3)
+	s.deliver = func(ctx context.Context, batch []int) error {
+		batches <- batch
+		return nil
+	}
+
+	for i := range 4 {
+		s.enqueue(i)
+	}
+	if len(s.queue) != 3 {
+		t.Fatalf("queued %d items, want 3 with the last one dropped", len(s.queue))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	first, second := <-batches, <-batches
+	if len(first) != 2 || first[0] != 0 || first[1] != 1 || len(second) != 1 || second[0] != 2 {
+		t.Errorf("batches = %v %v, want [0 1] [2]", first, second)
+	}
+}
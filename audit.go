@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/crypto/ssh"
+)
+
+const maxPendingAuditBytes = 64 * 1024 * 1024 // records beyond this are dropped until a batch is written
+
+// Types of audit records, next to the lifecycle event types.
+const (
+	auditLoginSucceeded    = "LoginSucceeded"
+	auditLoginFailed       = "LoginFailed"
+	auditRequest           = "Request"
+	auditSessionTerminated = "SessionTerminated" // by an administrator
+	auditUploadCancelled   = "UploadCancelled"
+)
+
+// auditRecord is one line of an audit batch. Fields that don't apply to its
+// type are left out.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	RemoteIP  string    `json:"remote_ip,omitempty"`
+	Method    string    `json:"method,omitempty"` // SFTP method, or authentication method of logins
+	Path      string    `json:"path,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Result    string    `json:"result,omitempty"` // see accessResult
+	Bytes     int64     `json:"bytes,omitempty"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditS3API is the part of the S3 API the audit trail uses.
+type auditS3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// auditTrail collects logins, sessions, SFTP requests, stored files and
+// admin actions, and writes them every AUDIT_INTERVAL as a gzipped JSON
+// Lines object under AUDIT_PREFIX in AUDIT_BUCKET, with the gateway's own
+// credentials. With AUDIT_RETENTION the objects are locked against changes
+// and deletion. Batches that can't be written are kept for the next
+// attempt. The records are also streamed to the watchers of /events on the
+// admin API, which works without AUDIT_BUCKET. A nil auditTrail records
+// nothing.
+type auditTrail struct {
+	bucket    string // no batches are written if empty
+	prefix    string
+	retention time.Duration
+	host      string
+	client    auditS3API
+	timeFunc  func() time.Time
+	logger    *slog.Logger
+	live      *liveEvents // nil without ADMIN_TOKEN
+
+	flushing sync.Mutex // one batch at a time
+
+	mu      sync.Mutex
+	pending bytes.Buffer // JSON lines
+	records int
+	dropped int
+	seq     int // batches written, so keys stay unique within a second
+}
+
+func newAuditTrail(config *Config, client auditS3API, logger *slog.Logger) *auditTrail {
+	a := &auditTrail{
+		bucket:    config.AuditBucket,
+		prefix:    config.AuditPrefix,
+		retention: config.AuditRetention,
+		host:      "sftpgw",
+		client:    client,
+		timeFunc:  time.Now,
+		logger:    logger,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		a.host = hostname
+	}
+	return a
+}
+
+func (a *auditTrail) record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	r.Time = a.timeFunc().UTC()
+	a.live.publish(r)
+	if a.bucket == "" {
+		return
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending.Len()+len(line) >= maxPendingAuditBytes {
+		a.dropped++
+		return
+	}
+	a.pending.Write(line)
+	a.pending.WriteByte('\n')
+	a.records++
+}
+
+// authAttempt records a login attempt; it is the AuthLogCallback of the SSH
+// server. The "none" method clients start with is left out.
+func (a *auditTrail) authAttempt(conn ssh.ConnMetadata, method string, err error) {
+	if a == nil || method == "none" {
+		return
+	}
+	r := auditRecord{
+		Type:      auditLoginSucceeded,
+		SessionID: getSessionID(conn),
+		User:      conn.User(),
+		RemoteIP:  getClientIP(conn.RemoteAddr()),
+		Method:    method,
+		Result:    "OK",
+	}
+	var partial *ssh.PartialSuccessError
+	switch {
+	case errors.As(err, &partial):
+		r.Result = "PARTIAL" // a second factor follows
+	case err != nil:
+		r.Type, r.Result, r.Error = auditLoginFailed, "FAILURE", err.Error()
+	}
+	a.record(r)
+}
+
+func (a *auditTrail) session(eventType string, session *activeSession) {
+	if a == nil {
+		return
+	}
+	r := auditRecord{Type: eventType, SessionID: session.id, User: session.user, RemoteIP: session.remoteIP}
+	if eventType == eventSessionEnded {
+		r.Bytes = session.conn.received.Load()
+	}
+	a.record(r)
+}
+
+func (a *auditTrail) request(req accessRequest, method, filePath, target string, err error, bytes int64) {
+	if a == nil {
+		return
+	}
+	r := auditRecord{
+		Type:      auditRequest,
+		SessionID: req.sessionID,
+		User:      req.user,
+		RemoteIP:  req.clientIP,
+		Method:    method,
+		Path:      filePath,
+		Target:    target,
+		Result:    accessResult(err),
+		Bytes:     bytes,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	a.record(r)
+}
+
+// upload records a file stored under key in bucket, or one that couldn't be.
+func (a *auditTrail) upload(session uploadSession, filePath, bucket, key string, size int64, err error) {
+	if a == nil {
+		return
+	}
+	r := auditRecord{
+		Type:      eventUploadCompleted,
+		SessionID: session.sessionID,
+		User:      session.user,
+		RemoteIP:  session.clientIP,
+		Path:      filePath,
+		Result:    "OK",
+		Bytes:     size,
+		Bucket:    bucket,
+		Key:       key,
+	}
+	if err != nil {
+		r.Type, r.Result, r.Error = eventUploadFailed, "FAILURE", err.Error()
+	}
+	a.record(r)
+}
+
+// run writes a batch every interval until ctx is done. The last batch is
+// written by flush once the sessions have ended.
+func (a *auditTrail) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.flush(ctx)
+		}
+	}
+}
+
+// flush writes the records collected since the last batch.
+func (a *auditTrail) flush(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	a.mu.Lock()
+	data := bytes.Clone(a.pending.Bytes())
+	records, dropped := a.records, a.dropped
+	a.dropped = 0
+	a.seq++
+	seq := a.seq
+	a.mu.Unlock()
+
+	if dropped > 0 {
+		a.logger.Error("audit records dropped: batch too large", slog.Int("records", dropped))
+	}
+	if records == 0 {
+		return
+	}
+
+	key, err := a.write(ctx, data, seq)
+	if err != nil {
+		// the records stay pending for the next batch
+		a.logger.Error("failed to write audit batch",
+			slog.String("bucket", a.bucket),
+			slog.Int("records", records),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	a.mu.Lock()
+	a.pending.Next(len(data))
+	a.records -= records
+	if a.pending.Len() == 0 {
+		a.pending.Reset()
+	}
+	a.mu.Unlock()
+
+	a.logger.Info("audit batch written",
+		slog.String("bucket", a.bucket),
+		slog.String("s3_key", key),
+		slog.Int("records", records),
+	)
+}
+
+// write stores a batch as a gzipped object named after the time and host,
+// such as audit/2024/01/15/20240115T143000Z-gw1-000042.jsonl.gz.
+func (a *auditTrail) write(ctx context.Context, data []byte, seq int) (string, error) {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	now := a.timeFunc().UTC()
+	key := path.Join(a.prefix, now.Format("2006/01/02"), fmt.Sprintf("%s-%s-%06d.jsonl.gz", now.Format("20060102T150405Z"), a.host, seq))
+	input := &s3.PutObjectInput{
+		Bucket:          aws.String(a.bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body.Bytes()),
+		ContentLength:   aws.Int64(int64(body.Len())),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+		// never replace a batch that was already written
+		IfNoneMatch: aws.String("*"),
+	}
+	if a.retention > 0 {
+		input.ObjectLockMode = types.ObjectLockModeCompliance
+		input.ObjectLockRetainUntilDate = aws.Time(now.Add(a.retention))
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	if _, err := a.client.PutObject(ctx, input); err != nil {
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeAuditS3 records the batches written, or fails with err.
+type fakeAuditS3 struct {
+	err     error
+	inputs  []*s3.PutObjectInput
+	records [][]auditRecord
+}
+
+func (f *fakeAuditS3) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	zr, err := gzip.NewReader(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	var records []auditRecord
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	f.inputs = append(f.inputs, input)
+	f.records = append(f.records, records)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func newTestAuditTrail(client auditS3API, retention time.Duration) *auditTrail {
+	a := newAuditTrail(&Config{AuditBucket: "audit-bucket", AuditPrefix: "audit", AuditRetention: retention}, client, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	a.host = "gw1"
+	a.timeFunc = func() time.Time { return time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC) }
+	return a
+}
+
+func TestAuditTrail_Flush(t *testing.T) {
+	client := &fakeAuditS3{}
+	a := newTestAuditTrail(client, 0)
+
+	req := accessRequest{clientIP: "203.0.113.7", sessionID: "9f86d081884c7d65", user: "alice"}
+	a.authAttempt(testConnMetadata{user: "alice"}, "none", errors.New("no auth passed yet"))
+	a.authAttempt(testConnMetadata{user: "alice"}, "password", errors.New("invalid credentials"))
+	a.authAttempt(testConnMetadata{user: "alice"}, "password", &ssh.PartialSuccessError{})
+	a.request(req, "Remove", "/uploads/a.csv", "", os.ErrPermission, 0)
+	a.upload(uploadSession{user: "alice", sessionID: "9f86d081884c7d65", clientIP: "203.0.113.7"}, "/uploads/b.csv", "partner-drops", "2024-01-15/b.csv", 2048, nil)
+	a.flush(context.Background())
+
+	if len(client.inputs) != 1 {
+		t.Fatalf("%d batches written, want 1", len(client.inputs))
+	}
+	input := client.inputs[0]
+	if aws.ToString(input.Bucket) != "audit-bucket" || aws.ToString(input.Key) != "audit/2024/01/15/20240115T143000Z-gw1-000001.jsonl.gz" {
+		t.Errorf("batch written to %s/%s", aws.ToString(input.Bucket), aws.ToString(input.Key))
+	}
+	if aws.ToString(input.IfNoneMatch) != "*" || input.ObjectLockMode != "" {
+		t.Errorf("batch IfNoneMatch = %q, ObjectLockMode = %q, want * and no lock", aws.ToString(input.IfNoneMatch), input.ObjectLockMode)
+	}
+
+	records := client.records[0]
+	if len(records) != 4 {
+		t.Fatalf("batch has %d records, want 4: %+v", len(records), records)
+	}
+	if r := records[0]; r.Type != auditLoginFailed || r.User != "alice" || r.RemoteIP != "192.168.1.100" || r.Method != "password" || r.Error != "invalid credentials" {
+		t.Errorf("first record = %+v, want a failed password login", r)
+	}
+	if r := records[1]; r.Type != auditLoginSucceeded || r.Result != "PARTIAL" {
+		t.Errorf("second record = %+v, want a partial login", r)
+	}
+	if r := records[2]; r.Type != auditRequest || r.Method != "Remove" || r.Result != "PERMISSION_DENIED" || r.SessionID != "9f86d081884c7d65" {
+		t.Errorf("third record = %+v, want the denied Remove", r)
+	}
+	if r := records[3]; r.Type != eventUploadCompleted || r.Bucket != "partner-drops" || r.Key != "2024-01-15/b.csv" || r.Bytes != 2048 || !r.Time.Equal(a.timeFunc()) {
+		t.Errorf("fourth record = %+v, want the stored file", r)
+	}
+
+	a.flush(context.Background())
+	if len(client.inputs) != 1 {
+		t.Errorf("%d batches written, want no batch without records", len(client.inputs))
+	}
+}
+
+func TestAuditTrail_FlushRetriesFailedBatch(t *testing.T) {
+	client := &fakeAuditS3{err: errors.New("SlowDown")}
+	a := newTestAuditTrail(client, 90*24*time.Hour)
+
+	a.record(auditRecord{Type: auditUploadCancelled, Path: "/uploads/a.csv"})
+	a.flush(context.Background())
+	a.record(auditRecord{Type: auditSessionTerminated, SessionID: "9f86d081884c7d65"})
+
+	client.err = nil
+	a.flush(context.Background())
+	if len(client.records) != 1 || len(client.records[0]) != 2 {
+		t.Fatalf("batches = %+v, want one with both records", client.records)
+	}
+	input := client.inputs[0]
+	if input.ObjectLockMode != types.ObjectLockModeCompliance || !input.ObjectLockRetainUntilDate.Equal(time.Date(2024, 4, 14, 14, 30, 0, 0, time.UTC)) {
+		t.Errorf("batch locked with %q until %v, want compliance mode for 90 days", input.ObjectLockMode, input.ObjectLockRetainUntilDate)
+	}
+}
+
+func TestAuditTrail_Nil(t *testing.T) {
+	var a *auditTrail
+	a.record(auditRecord{Type: auditRequest})
+	a.authAttempt(testConnMetadata{}, "password", nil)
+	a.flush(context.Background())
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -16,41 +18,86 @@ import (
 
 type Authenticator struct {
 	requiredAccountID string
+	anyAccount        bool // skip the account check, see ALLOW_ANY_ACCOUNT
 	region            string
+	defaultRole       string         // role assumed when the user name names none, see ASSUME_ROLE_ARN
+	roleDuration      time.Duration  // lifetime of assumed role credentials, STS default if zero
+	cache             *identityCache // recent GetCallerIdentity results, nil if AUTH_CACHE_TTL is unset
+	principals        principalAllowlist
+	writeCheck        func(ctx context.Context, session uploadSession) error // see VERIFY_WRITE_ACCESS
+	httpClient        aws.HTTPClient
+	findings          *securityFindings // reports wrong-account logins, nil without SECURITY_FINDINGS
+	tracer            *tracer           // nil without OTEL_EXPORTER_OTLP_ENDPOINT
 	logger            *slog.Logger
 }
 
-func NewAuthenticator(requiredAccountID, region string, logger *slog.Logger) *Authenticator {
+func NewAuthenticator(config *Config, httpClient aws.HTTPClient, logger *slog.Logger) *Authenticator {
 	return &Authenticator{
-		requiredAccountID: requiredAccountID,
-		region:            region,
+		requiredAccountID: config.RequiredAccountID,
+		anyAccount:        config.AllowAnyAccount,
+		region:            config.S3Region,
+		defaultRole:       config.AssumeRoleARN,
+		roleDuration:      config.AssumeRoleDuration,
+		cache:             newIdentityCache(config.AuthCacheTTL, config.AuthCacheSize),
+		principals:        newPrincipalAllowlist(config.AllowedPrincipals),
+		httpClient:        httpClient,
 		logger:            logger,
 	}
 }
 
 func (a *Authenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	accessKeyID, _ := parseUsername(conn.User())
+	ctx, span := a.tracer.start(context.Background(), "authenticate",
+		slog.String("client.address", getClientIP(conn.RemoteAddr())),
+		slog.String("aws.access_key_id", accessKeyID),
+	)
+
+	permissions, err := a.authenticate(ctx, conn, password)
+	span.finish(err)
+	if permissions != nil && span != nil {
+		// uploads of the session are traced as part of the login
+		permissions.Extensions["traceparent"] = span.traceParent()
+	}
+	return permissions, err
+}
+
+func (a *Authenticator) authenticate(ctx context.Context, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	remoteAddr := conn.RemoteAddr()
 	clientIP := getClientIP(remoteAddr)
-	accessKeyID := conn.User()
+	accessKeyID, role := parseUsername(conn.User())
+	if role == "" {
+		role = a.defaultRole
+	}
 
 	logCtx := slog.Group("auth",
 		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
 		"access_key_id", accessKeyID,
+		"role", role,
 	)
 
 	a.logger.Info("authentication attempt", logCtx)
 
-	secretAccessKey := string(password)
+	secretAccessKey, sessionToken := parsePassword(string(password))
 	if accessKeyID == "" || secretAccessKey == "" {
 		a.logger.Warn("authentication failed: empty credentials", logCtx)
 		return nil, fmt.Errorf("credentials cannot be empty")
 	}
 
+	var roleARN string
+	if role != "" {
+		var err error
+		if roleARN, err = resolveRoleARN(role, a.requiredAccountID); err != nil {
+			a.logger.Warn("authentication failed: invalid role", logCtx, slog.String("error", err.Error()))
+			return nil, fmt.Errorf("invalid role")
+		}
+	}
+
 	configOptions := []func(*config.LoadOptions) error{
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
 			accessKeyID,
 			secretAccessKey,
-			"",
+			sessionToken,
 		)),
 	}
 
@@ -58,7 +105,11 @@ func (a *Authenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*s
 		configOptions = append(configOptions, config.WithRegion(a.region))
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), configOptions...)
+	if a.httpClient != nil {
+		configOptions = append(configOptions, config.WithHTTPClient(a.httpClient))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, configOptions...)
 	if err != nil {
 		a.logger.Error("failed to load AWS config", logCtx, slog.String("error", err.Error()))
 		return nil, fmt.Errorf("invalid credentials")
@@ -66,45 +117,135 @@ func (a *Authenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*s
 
 	stsClient := sts.NewFromConfig(cfg)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	result, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
-	if err != nil {
-		a.logger.Warn("STS GetCallerIdentity failed", logCtx, slog.String("error", err.Error()))
-		return nil, fmt.Errorf("invalid credentials")
-	}
+	cacheKey := identityCacheKey(accessKeyID, secretAccessKey, sessionToken)
+	identity, cached := a.cache.get(cacheKey)
+	if !cached {
+		result, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			a.logger.Warn("STS GetCallerIdentity failed", logCtx, slog.String("error", err.Error()))
+			return nil, fmt.Errorf("invalid credentials")
+		}
 
-	if result.Account == nil {
-		a.logger.Error("STS GetCallerIdentity returned nil account", logCtx)
-		return nil, fmt.Errorf("invalid credentials")
+		if result.Account == nil {
+			a.logger.Error("STS GetCallerIdentity returned nil account", logCtx)
+			return nil, fmt.Errorf("invalid credentials")
+		}
+
+		identity = callerIdentity{
+			accountID: *result.Account,
+			userID:    aws.ToString(result.UserId),
+			arn:       aws.ToString(result.Arn),
+		}
 	}
 
-	accountID := *result.Account
-	if accountID != a.requiredAccountID {
+	accountID := identity.accountID
+	if !a.anyAccount && accountID != a.requiredAccountID {
 		a.logger.Warn("authentication failed: wrong account ID",
 			logCtx,
 			slog.String("actual_account_id", accountID),
 			slog.String("required_account_id", a.requiredAccountID),
 		)
+		if a.findings != nil {
+			a.findings.wrongAccount(clientIP, accessKeyID, accountID)
+		}
 		return nil, fmt.Errorf("unauthorized account")
 	}
 
+	if !a.principals.allows(identity.arn) {
+		a.logger.Warn("authentication failed: principal not allowed", logCtx, slog.String("arn", identity.arn))
+		return nil, fmt.Errorf("unauthorized principal")
+	}
+
+	extensions := map[string]string{
+		"user":                  accessKeyID,
+		"aws_access_key_id":     accessKeyID,
+		"aws_secret_access_key": secretAccessKey,
+		"aws_session_token":     sessionToken,
+		"aws_account_id":        accountID,
+		"principal_arn":         identity.arn,
+		"client_ip":             clientIP,
+	}
+
+	// Uploads are signed with the role's temporary credentials instead of
+	// the user's own keys.
+	if roleARN != "" {
+		creds, err := a.assumeRole(ctx, stsClient, roleARN, accessKeyID)
+		if err != nil {
+			a.logger.Warn("STS AssumeRole failed", logCtx,
+				slog.String("role_arn", roleARN),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("unauthorized role")
+		}
+
+		a.logger.Info("assumed role", logCtx,
+			slog.String("role_arn", roleARN),
+			slog.Time("expiration", aws.ToTime(creds.Expiration)),
+		)
+
+		extensions["aws_access_key_id"] = aws.ToString(creds.AccessKeyId)
+		extensions["aws_secret_access_key"] = aws.ToString(creds.SecretAccessKey)
+		extensions["aws_session_token"] = aws.ToString(creds.SessionToken)
+		extensions["role_arn"] = roleARN
+	}
+
+	if a.writeCheck != nil && !cached {
+		err := a.writeCheck(ctx, uploadSession{
+			user:            accessKeyID,
+			accessKeyID:     extensions["aws_access_key_id"],
+			secretAccessKey: extensions["aws_secret_access_key"],
+			sessionToken:    extensions["aws_session_token"],
+			accountID:       accountID,
+			clientIP:        clientIP,
+		})
+		if err != nil {
+			a.logger.Warn("authentication failed: no write access to the upload location", logCtx,
+				slog.String("arn", identity.arn),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("no write access")
+		}
+	}
+
+	// only fresh results, so a hit doesn't extend the entry and revoked
+	// keys stop working once AUTH_CACHE_TTL has passed
+	if !cached {
+		a.cache.put(cacheKey, identity)
+	}
+
 	a.logger.Info("authentication successful",
 		logCtx,
 		slog.String("account_id", accountID),
-		slog.String("user_id", aws.ToString(result.UserId)),
-		slog.String("arn", aws.ToString(result.Arn)),
+		slog.String("user_id", identity.userID),
+		slog.String("arn", identity.arn),
+		slog.Bool("session_token", sessionToken != ""),
+		slog.Bool("cached", cached),
 	)
 
-	return &ssh.Permissions{
-		Extensions: map[string]string{
-			"aws_access_key_id":     accessKeyID,
-			"aws_secret_access_key": secretAccessKey,
-			"aws_account_id":        accountID,
-			"client_ip":             clientIP,
-		},
-	}, nil
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// passwordTokenSeparator separates the secret access key from the session
+// token of temporary credentials in the password. Neither contains it.
+const passwordTokenSeparator = ":"
+
+// parsePassword splits a password of the form SECRET or SECRET:TOKEN into
+// the secret access key and the optional session token.
+func parsePassword(password string) (secretAccessKey, sessionToken string) {
+	secretAccessKey, sessionToken, _ = strings.Cut(password, passwordTokenSeparator)
+	return secretAccessKey, sessionToken
+}
+
+// getSessionID returns the ID that correlates the log entries and S3 objects
+// of one SSH connection. It is the start of the session identifier from the
+// key exchange, so the authenticators and the upload handlers agree on it
+// without passing it around.
+func getSessionID(conn ssh.ConnMetadata) string {
+	id := conn.SessionID()
+	return hex.EncodeToString(id[:min(len(id), 8)])
 }
 
 func getClientIP(addr net.Addr) string {
@@ -112,4 +253,13 @@ func getClientIP(addr net.Addr) string {
 		return tcpAddr.IP.String()
 	}
 	return addr.String()
-}
\ No newline at end of file
+}
+
+// getPort returns the port of a TCP address, such as the listener a
+// client connected to, or 0 for other addresses.
+func getPort(addr net.Addr) int {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.Port
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"net"
 	"testing"
 )
@@ -17,7 +18,7 @@ func TestGetClientIP(t *testing.T) {
 			expected: "192.168.1.1",
 		},
 		{
-			name:     "TCP address with IPv6", 
+			name:     "TCP address with IPv6",
 			addr:     &net.TCPAddr{IP: net.ParseIP("::1"), Port: 12345},
 			expected: "::1",
 		},
@@ -43,6 +44,27 @@ func TestGetClientIP(t *testing.T) {
 	}
 }
 
+func TestGetSessionID(t *testing.T) {
+	if got := getSessionID(testConnMetadata{}); got != hex.EncodeToString([]byte("session")) {
+		t.Errorf("getSessionID() = %q, want the whole short session identifier", got)
+	}
+	if got := getSessionID(hashConnMetadata{}); got != "0001020304050607" {
+		t.Errorf("getSessionID() = %q, want the first 8 bytes of the session identifier", got)
+	}
+}
+
+// hashConnMetadata has a session identifier as long as a SHA-256 exchange
+// hash.
+type hashConnMetadata struct{ testConnMetadata }
+
+func (hashConnMetadata) SessionID() []byte {
+	id := make([]byte, 32)
+	for i := range id {
+		id[i] = byte(i)
+	}
+	return id
+}
+
 type testAddr struct {
 	addr string
 }
@@ -53,4 +75,22 @@ func (t *testAddr) Network() string {
 
 func (t *testAddr) String() string {
 	return t.addr
-}
\ No newline at end of file
+}
+func TestParsePassword(t *testing.T) {
+	tests := []struct {
+		password        string
+		secretAccessKey string
+		sessionToken    string
+	}{
+		{"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", ""},
+		{"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY:IQoJb3JpZ2luX2VjEA+token==", "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "IQoJb3JpZ2luX2VjEA+token=="},
+		{"secret:", "secret", ""},
+	}
+
+	for _, tt := range tests {
+		secretAccessKey, sessionToken := parsePassword(tt.password)
+		if secretAccessKey != tt.secretAccessKey || sessionToken != tt.sessionToken {
+			t.Errorf("parsePassword(%q) = %q, %q, want %q, %q", tt.password, secretAccessKey, sessionToken, tt.secretAccessKey, tt.sessionToken)
+		}
+	}
+}
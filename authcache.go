@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// callerIdentity is the part of a GetCallerIdentity result the
+// Authenticator uses.
+type callerIdentity struct {
+	accountID string
+	userID    string
+	arn       string
+}
+
+type cachedIdentity struct {
+	identity callerIdentity
+	expires  time.Time
+}
+
+// identityCache remembers successful GetCallerIdentity results for a short
+// time, so clients that reconnect often don't pay for an STS round trip on
+// every login. Entries are keyed by a hash of the credentials; the
+// credentials themselves are not kept. A nil cache stores nothing.
+type identityCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]cachedIdentity
+	timeFunc   func() time.Time
+}
+
+func newIdentityCache(ttl time.Duration, maxEntries int) *identityCache {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &identityCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]cachedIdentity),
+		timeFunc:   time.Now,
+	}
+}
+
+// identityCacheKey hashes a set of credentials into a cache key.
+func identityCacheKey(accessKeyID, secretAccessKey, sessionToken string) string {
+	h := sha256.New()
+	for _, s := range []string{accessKeyID, secretAccessKey, sessionToken} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *identityCache) get(key string) (callerIdentity, bool) {
+	if c == nil {
+		return callerIdentity{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return callerIdentity{}, false
+	}
+	if !c.timeFunc().Before(entry.expires) {
+		delete(c.entries, key)
+		return callerIdentity{}, false
+	}
+	return entry.identity, true
+}
+
+func (c *identityCache) put(key string, identity callerIdentity) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.timeFunc()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = cachedIdentity{identity: identity, expires: now.Add(c.ttl)}
+}
+
+// evict drops expired entries, or the entry closest to expiring if none
+// have expired yet, to make room for a new one.
+func (c *identityCache) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIdentityCache_Expires(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	cache := newIdentityCache(time.Minute, 10)
+	cache.timeFunc = func() time.Time { return now }
+
+	key := identityCacheKey("AKIATEST", "secret", "")
+	cache.put(key, callerIdentity{accountID: "123456789012"})
+
+	if identity, ok := cache.get(key); !ok || identity.accountID != "123456789012" {
+		t.Errorf("get() = %v, %v, want cached identity", identity, ok)
+	}
+	if _, ok := cache.get(identityCacheKey("AKIATEST", "other", "")); ok {
+		t.Error("get() with a different secret expected a miss")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.get(key); ok {
+		t.Error("get() after TTL expected a miss")
+	}
+}
+
+func TestIdentityCache_Bounded(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	cache := newIdentityCache(time.Minute, 2)
+	cache.timeFunc = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		cache.put(key, callerIdentity{accountID: key})
+		now = now.Add(time.Second)
+	}
+
+	if len(cache.entries) != 2 {
+		t.Errorf("cache holds %d entries, want 2", len(cache.entries))
+	}
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+	if _, ok := cache.get("c"); !ok {
+		t.Error("expected the newest entry to be cached")
+	}
+}
+
+func TestIdentityCache_Disabled(t *testing.T) {
+	cache := newIdentityCache(0, 10)
+	cache.put("a", callerIdentity{accountID: "123456789012"})
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected a disabled cache to miss")
+	}
+}
+
+// redirectTransport sends every request to a test server, whatever host the
+// SDK resolved for it.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestAuthenticator_CacheHitsDontExtendTTL(t *testing.T) {
+	// the SDK can't add a CA bundle to a custom http.Client
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::123456789012:user/alice</Arn>
+    <UserId>AIDATEST</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	auth := NewAuthenticator(&Config{
+		RequiredAccountID: "123456789012",
+		S3Region:          "us-east-1",
+		AuthCacheTTL:      time.Minute,
+		AuthCacheSize:     10,
+	}, &http.Client{Transport: redirectTransport{target: target}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	auth.cache.timeFunc = func() time.Time { return now }
+
+	// a client that keeps reconnecting within the TTL
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 50 * time.Second, 59 * time.Second} {
+		now = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC).Add(elapsed)
+		if _, err := auth.Authenticate(testConnMetadata{user: "AKIATEST"}, []byte("secret")); err != nil {
+			t.Fatalf("Authenticate() after %v unexpected error: %v", elapsed, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("STS was called %d times within the TTL, want 1", calls)
+	}
+
+	now = time.Date(2024, 1, 15, 12, 1, 0, 0, time.UTC)
+	if _, err := auth.Authenticate(testConnMetadata{user: "AKIATEST"}, []byte("secret")); err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("STS was called %d times, want the credentials checked again once the TTL passed", calls)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// awsJSONClient calls AWS services that use the JSON protocol, such as
+// DynamoDB and Secrets Manager. The gateway makes a single call to each, so
+// requests are signed and sent directly instead of pulling in the service
+// SDK clients.
+type awsJSONClient struct {
+	service      string // signing name and endpoint prefix, e.g. "dynamodb"
+	targetPrefix string // X-Amz-Target prefix, e.g. "DynamoDB_20120810"
+	contentType  string
+	endpoint     string
+	region       string
+	credentials  aws.CredentialsProvider
+	signer       *v4.Signer
+	httpClient   aws.HTTPClient
+}
+
+// loadGatewayAWSConfig loads the gateway's own AWS configuration from the
+// default credential chain.
+func loadGatewayAWSConfig(ctx context.Context, cfg *Config, httpClient aws.HTTPClient) (aws.Config, error) {
+	var configOptions []func(*config.LoadOptions) error
+	if cfg.S3Region != "" {
+		configOptions = append(configOptions, config.WithRegion(cfg.S3Region))
+	}
+	configOptions = append(configOptions, config.WithHTTPClient(httpClient))
+
+	awsConfig, err := config.LoadDefaultConfig(ctx, configOptions...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if awsConfig.Region == "" {
+		return aws.Config{}, fmt.Errorf("no AWS region configured")
+	}
+	return awsConfig, nil
+}
+
+func newAWSJSONClient(awsConfig aws.Config, service, targetPrefix, jsonVersion string) *awsJSONClient {
+	return &awsJSONClient{
+		service:      service,
+		targetPrefix: targetPrefix,
+		contentType:  "application/x-amz-json-" + jsonVersion,
+		endpoint:     "https://" + service + "." + awsConfig.Region + ".amazonaws.com",
+		region:       awsConfig.Region,
+		credentials:  awsConfig.Credentials,
+		signer:       v4.NewSigner(),
+		httpClient:   awsConfig.HTTPClient,
+	}
+}
+
+// call sends a signed request for an API operation and decodes the response
+// into v. Operations without a result, which send an empty body, pass nil.
+func (c *awsJSONClient) call(ctx context.Context, operation string, input, v any) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(ctx, "/", body, map[string]string{
+		"Content-Type": c.contentType,
+		"X-Amz-Target": c.targetPrefix + "." + operation,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		decoder.Decode(&failure)
+		errorType := failure.Type
+		if _, after, ok := strings.Cut(errorType, "#"); ok {
+			errorType = after
+		}
+		return &awsAPIError{
+			service:   c.service,
+			operation: operation,
+			status:    resp.Status,
+			Code:      errorType,
+			Message:   failure.Message,
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	return decoder.Decode(v)
+}
+
+// awsAPIError is an error response of an AWS JSON API. Code is the error
+// type without its namespace, such as "ResourceNotFoundException".
+type awsAPIError struct {
+	service   string
+	operation string
+	status    string
+	Code      string
+	Message   string
+}
+
+func (e *awsAPIError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s %s: %s", e.service, e.operation, e.status, e.Code, e.Message)
+}
+
+// isAWSErrorCode reports whether err is an AWS API error with code.
+func isAWSErrorCode(err error, code string) bool {
+	var apiErr *awsAPIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// post sends a signed POST request with body to path on the service endpoint.
+func (c *awsJSONClient) post(ctx context.Context, path string, body []byte, headers map[string]string) (*http.Response, error) {
+	return c.send(ctx, http.MethodPost, path, body, headers)
+}
+
+// send sends a signed request to path, which may include a query, on the
+// service endpoint. REST APIs such as AppConfig use it directly.
+func (c *awsJSONClient) send(ctx context.Context, method, path string, body []byte, headers map[string]string) (*http.Response, error) {
+	creds, err := c.credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := sha256.Sum256(body)
+	if err := c.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), c.service, c.region, time.Now()); err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+var errBanNotFound = errors.New("client IP not banned")
+
+// ipBans bans client IPs that fail the SSH handshake, including
+// authentication, too often: after BAN_THRESHOLD failures within
+// BAN_FIND_TIME new connections from the IP are dropped right after accept
+// for BAN_DURATION, before any SSH traffic. Bans and their end are logged
+// and recorded in the audit trail, and /bans on the admin port lists them.
+type ipBans struct {
+	threshold int
+	findTime  time.Duration
+	duration  time.Duration
+	timeFunc  func() time.Time
+	findings  *securityFindings // reports bans, nil without SECURITY_FINDINGS
+	audit     *auditTrail       // records bans and their end, nil without one
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // recent failures per IP, oldest first
+	banned   map[string]time.Time   // ban expiry per IP
+}
+
+func newIPBans(config *Config, logger *slog.Logger) *ipBans {
+	if config.BanThreshold <= 0 {
+		return nil
+	}
+	return &ipBans{
+		threshold: config.BanThreshold,
+		findTime:  config.BanFindTime,
+		duration:  config.BanDuration,
+		timeFunc:  time.Now,
+		logger:    logger,
+		failures:  make(map[string][]time.Time),
+		banned:    make(map[string]time.Time),
+	}
+}
+
+// isBanned reports whether connections from ip are to be dropped.
+func (b *ipBans) isBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(b.timeFunc())
+	_, banned := b.banned[ip]
+	return banned
+}
+
+// recordFailure counts a failed handshake from ip and bans it once the
+// threshold is reached.
+func (b *ipBans) recordFailure(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.timeFunc()
+	if len(b.failures) >= maxTrackedClients {
+		for other, times := range b.failures {
+			if now.Sub(times[len(times)-1]) >= b.findTime {
+				delete(b.failures, other)
+			}
+		}
+	}
+
+	times := b.failures[ip]
+	for len(times) > 0 && now.Sub(times[0]) >= b.findTime {
+		times = times[1:]
+	}
+	times = append(times, now)
+
+	if len(times) < b.threshold {
+		b.failures[ip] = times
+		return
+	}
+
+	delete(b.failures, ip)
+	b.banned[ip] = now.Add(b.duration)
+	b.logger.Warn("client IP banned",
+		slog.String("remote_ip", ip),
+		slog.Int("failures", len(times)),
+		slog.Duration("ban_duration", b.duration),
+	)
+	b.audit.record(auditRecord{Type: "IPBanned", RemoteIP: ip, Result: "FAIL"})
+	if b.findings != nil {
+		b.findings.repeatedFailures(ip, len(times))
+	}
+}
+
+// banStatus is a banned client IP as the admin port reports it.
+type banStatus struct {
+	RemoteIP string    `json:"remote_ip"`
+	Until    time.Time `json:"until"`
+}
+
+// list returns the current bans, those ending first first.
+func (b *ipBans) list() []banStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(b.timeFunc())
+	bans := make([]banStatus, 0, len(b.banned))
+	for ip, until := range b.banned {
+		bans = append(bans, banStatus{RemoteIP: ip, Until: until.UTC()})
+	}
+	slices.SortFunc(bans, func(a, b banStatus) int {
+		return a.Until.Compare(b.Until)
+	})
+	return bans
+}
+
+// lift ends the ban of ip before BAN_DURATION runs out, and forgets its
+// failures.
+func (b *ipBans) lift(ip string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.banned[ip]; !ok {
+		return errBanNotFound
+	}
+	delete(b.banned, ip)
+	delete(b.failures, ip)
+	b.logger.Info("client IP ban lifted", slog.String("remote_ip", ip), slog.String("by", "admin"))
+	b.audit.record(auditRecord{Type: "IPUnbanned", RemoteIP: ip, Method: "admin"})
+	return nil
+}
+
+// expire lifts bans that have run out.
+func (b *ipBans) expire(now time.Time) {
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, ip)
+			b.logger.Info("client IP ban lifted", slog.String("remote_ip", ip))
+			b.audit.record(auditRecord{Type: "IPUnbanned", RemoteIP: ip})
+		}
+	}
+}
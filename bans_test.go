@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIPBans(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	bans := newIPBans(&Config{BanThreshold: 3, BanFindTime: time.Minute, BanDuration: time.Hour}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	bans.timeFunc = func() time.Time { return now }
+
+	bans.recordFailure("192.168.1.100")
+	bans.recordFailure("192.168.1.100")
+	now = now.Add(time.Minute)
+	bans.recordFailure("192.168.1.100")
+	if bans.isBanned("192.168.1.100") {
+		t.Fatal("expected failures older than the find time not to count")
+	}
+
+	bans.recordFailure("192.168.1.100")
+	bans.recordFailure("192.168.1.100")
+	if !bans.isBanned("192.168.1.100") {
+		t.Fatal("expected IP to be banned after three failures within the find time")
+	}
+	if bans.isBanned("192.168.1.101") {
+		t.Error("expected other IPs not to be banned")
+	}
+
+	now = now.Add(time.Hour)
+	if bans.isBanned("192.168.1.100") {
+		t.Error("expected the ban to be lifted after the ban duration")
+	}
+}
+
+func TestIPBans_ListAndLift(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	bans := newIPBans(&Config{BanThreshold: 1, BanFindTime: time.Minute, BanDuration: time.Hour}, logger)
+	bans.timeFunc = func() time.Time { return now }
+	bans.audit = newAuditTrail(&Config{}, nil, logger)
+	bans.audit.live = newLiveEvents()
+	watcher := bans.audit.live.watch("")
+
+	bans.recordFailure("192.168.1.100")
+	now = now.Add(time.Minute)
+	bans.recordFailure("192.168.1.101")
+
+	want := []banStatus{
+		{RemoteIP: "192.168.1.100", Until: time.Date(2024, 1, 15, 13, 0, 0, 0, time.UTC)},
+		{RemoteIP: "192.168.1.101", Until: time.Date(2024, 1, 15, 13, 1, 0, 0, time.UTC)},
+	}
+	if got := bans.list(); !slices.Equal(got, want) {
+		t.Errorf("list() = %v, want %v", got, want)
+	}
+
+	if err := bans.lift("192.168.1.100"); err != nil {
+		t.Fatalf("lift() unexpected error: %v", err)
+	}
+	if bans.isBanned("192.168.1.100") {
+		t.Error("expected the lifted ban to end")
+	}
+	if err := bans.lift("192.168.1.100"); !errors.Is(err, errBanNotFound) {
+		t.Errorf("lift() of an IP that isn't banned = %v, want %v", err, errBanNotFound)
+	}
+
+	now = now.Add(time.Hour)
+	if got := bans.list(); len(got) != 0 {
+		t.Errorf("list() after the ban duration = %v, want none", got)
+	}
+
+	var events []string
+	for len(watcher.records) > 0 {
+		r := <-watcher.records
+		events = append(events, r.Type+" "+r.RemoteIP)
+	}
+	wantEvents := []string{"IPBanned 192.168.1.100", "IPBanned 192.168.1.101", "IPUnbanned 192.168.1.100", "IPUnbanned 192.168.1.101"}
+	if !slices.Equal(events, wantEvents) {
+		t.Errorf("events = %v, want %v", events, wantEvents)
+	}
+}
+
+func TestNewIPBans_Disabled(t *testing.T) {
+	if bans := newIPBans(&Config{}, nil); bans != nil {
+		t.Error("expected no bans without a threshold")
+	}
+}
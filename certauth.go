@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// principalPattern limits certificate principals to names that are safe to
+// use as an S3 key prefix.
+var principalPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// CertAuthenticator accepts SSH user certificates signed by a trusted CA.
+// Certificate users have no AWS credentials; their uploads are stored with
+// the gateway's own credentials under a prefix named after the principal.
+type CertAuthenticator struct {
+	checker *ssh.CertChecker
+	logger  *slog.Logger
+}
+
+func NewCertAuthenticator(caKeys []ssh.PublicKey, logger *slog.Logger) *CertAuthenticator {
+	return &CertAuthenticator{
+		checker: &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				for _, caKey := range caKeys {
+					if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+						return true
+					}
+				}
+				return false
+			},
+		},
+		logger: logger,
+	}
+}
+
+// Authenticate verifies the certificate's CA signature and validity period
+// and that the user logs in as one of its principals.
+func (a *CertAuthenticator) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+	principal := conn.User()
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"principal", principal,
+		"method", "certificate",
+	)
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		a.logger.Warn("authentication failed: public key is not a certificate", logCtx)
+		return nil, fmt.Errorf("certificate required")
+	}
+
+	logCtx = slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"principal", principal,
+		"method", "certificate",
+		"key_id", cert.KeyId,
+		"serial", cert.Serial,
+	)
+
+	if !principalPattern.MatchString(principal) {
+		a.logger.Warn("authentication failed: invalid principal", logCtx)
+		return nil, fmt.Errorf("invalid principal")
+	}
+
+	checked, err := a.checker.Authenticate(conn, key)
+	if err != nil {
+		a.logger.Warn("authentication failed: certificate rejected", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("certificate rejected")
+	}
+
+	a.logger.Info("authentication successful", logCtx)
+
+	// The critical options, such as source-address, are enforced by the SSH
+	// server from the permissions we return, not by the CertChecker.
+	return &ssh.Permissions{
+		CriticalOptions: checked.CriticalOptions,
+		Extensions: map[string]string{
+			"user":          principal,
+			"upload_prefix": principal,
+			"client_ip":     clientIP,
+		},
+	}, nil
+}
+
+// loadCAKeys reads the trusted CA public keys from a file in
+// authorized_keys format.
+func loadCAKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA key: %w", err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no CA keys found in %s", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+	user string
+}
+
+func (c testConnMetadata) User() string          { return c.user }
+func (c testConnMetadata) SessionID() []byte     { return []byte("session") }
+func (c testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (c testConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-SFTPGW") }
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 12345}
+}
+func (c testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func newTestCert(t *testing.T, ca ssh.Signer, principals []string, validBefore time.Time) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test-cert",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCertAuthenticator_Authenticate(t *testing.T) {
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	auth := NewCertAuthenticator([]ssh.PublicKey{ca.PublicKey()}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	valid := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		user    string
+		key     ssh.PublicKey
+		wantErr bool
+	}{
+		{"valid certificate", "alice", newTestCert(t, ca, []string{"alice"}, valid), false},
+		{"wrong principal", "bob", newTestCert(t, ca, []string{"alice"}, valid), true},
+		{"expired certificate", "alice", newTestCert(t, ca, []string{"alice"}, time.Now().Add(-time.Minute)), true},
+		{"untrusted CA", "alice", newTestCert(t, otherCA, []string{"alice"}, valid), true},
+		{"plain public key", "alice", newTestSigner(t).PublicKey(), true},
+		{"unsafe principal", "../alice", newTestCert(t, ca, []string{"../alice"}, valid), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, err := auth.Authenticate(testConnMetadata{user: tt.user}, tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Authenticate() expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() unexpected error: %v", err)
+			}
+			if perms.Extensions["upload_prefix"] != tt.user {
+				t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], tt.user)
+			}
+			if perms.Extensions["aws_access_key_id"] != "" {
+				t.Error("expected no AWS credentials for certificate users")
+			}
+		})
+	}
+}
+
+// sshLogin runs a handshake against a server with config and reports whether
+// the client got in with signer.
+func sshLogin(t *testing.T, config *ssh.ServerConfig, user string, signer ssh.Signer) error {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ssh.NewServerConn(conn, config)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+func TestCertAuthenticator_SourceAddress(t *testing.T) {
+	ca := newTestSigner(t)
+	auth := NewCertAuthenticator([]ssh.PublicKey{ca.PublicKey()}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	config := &ssh.ServerConfig{PublicKeyCallback: auth.Authenticate}
+	config.AddHostKey(newTestSigner(t))
+
+	for _, tt := range []struct {
+		sourceAddress string
+		wantErr       bool
+	}{
+		{"127.0.0.1/32", false},
+		{"10.0.0.0/8", true},
+	} {
+		t.Run(tt.sourceAddress, func(t *testing.T) {
+			key := newTestSigner(t)
+			cert := &ssh.Certificate{
+				Key:             key.PublicKey(),
+				CertType:        ssh.UserCert,
+				ValidPrincipals: []string{"alice"},
+				ValidBefore:     ssh.CertTimeInfinity,
+				Permissions: ssh.Permissions{
+					CriticalOptions: map[string]string{"source-address": tt.sourceAddress},
+				},
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatalf("failed to sign certificate: %v", err)
+			}
+			signer, err := ssh.NewCertSigner(cert, key)
+			if err != nil {
+				t.Fatalf("failed to create certificate signer: %v", err)
+			}
+
+			if err := sshLogin(t, config, "alice", signer); (err != nil) != tt.wantErr {
+				t.Errorf("login with source-address %s = %v, wantErr %v", tt.sourceAddress, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadCAKeys(t *testing.T) {
+	ca := newTestSigner(t)
+	path := filepath.Join(t.TempDir(), "ca.pub")
+	os.WriteFile(path, append([]byte("# trusted CAs\n"), ssh.MarshalAuthorizedKey(ca.PublicKey())...), 0600)
+
+	keys, err := loadCAKeys(path)
+	if err != nil {
+		t.Fatalf("loadCAKeys() unexpected error: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("loadCAKeys() returned %d keys, want 1", len(keys))
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pub")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := loadCAKeys(empty); err == nil {
+		t.Error("loadCAKeys() expected error for a file without keys")
+	}
+}
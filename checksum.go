@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checksum computes the integrity checksum that S3 verifies when an object
+// or part is stored. The zero value disables checksums.
+type checksum struct {
+	algorithm types.ChecksumAlgorithm
+}
+
+func newChecksum(algorithm string) checksum {
+	switch strings.ToUpper(algorithm) {
+	case "SHA256":
+		return checksum{algorithm: types.ChecksumAlgorithmSha256}
+	case "CRC32":
+		return checksum{algorithm: types.ChecksumAlgorithmCrc32}
+	default:
+		return checksum{}
+	}
+}
+
+func (c checksum) enabled() bool {
+	return c.algorithm != ""
+}
+
+func (c checksum) digest(data []byte) []byte {
+	h := c.newHash()
+	if h == nil {
+		return nil
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// digestReader is like digest but reads the data from r.
+func (c checksum) digestReader(r io.Reader) ([]byte, error) {
+	h := c.newHash()
+	if h == nil {
+		return nil, nil
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (c checksum) newHash() hash.Hash {
+	switch c.algorithm {
+	case types.ChecksumAlgorithmSha256:
+		return sha256.New()
+	case types.ChecksumAlgorithmCrc32:
+		return crc32.NewIEEE()
+	default:
+		return nil
+	}
+}
+
+// fields returns the base64 encoded digest in the request field that
+// matches the algorithm, ready to be set on PutObject or UploadPart.
+func (c checksum) fields(digest []byte) (sha256Sum, crc32Sum *string) {
+	if digest == nil {
+		return nil, nil
+	}
+
+	encoded := aws.String(base64.StdEncoding.EncodeToString(digest))
+	if c.algorithm == types.ChecksumAlgorithmSha256 {
+		return encoded, nil
+	}
+	return nil, encoded
+}
+
+// addMetadata records the hex encoded digest of the whole file in the
+// object metadata, in the form tools like sha256sum print it.
+func (c checksum) addMetadata(metadata map[string]string, digest []byte) map[string]string {
+	if digest == nil {
+		return metadata
+	}
+
+	withChecksum := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		withChecksum[k] = v
+	}
+	withChecksum["checksum-"+strings.ToLower(string(c.algorithm))] = hex.EncodeToString(digest)
+	return withChecksum
+}
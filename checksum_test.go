@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestChecksum_fields(t *testing.T) {
+	tests := []struct {
+		name           string
+		algorithm      string
+		expectedSHA256 string
+		expectedCRC32  string
+	}{
+		{
+			name:           "SHA256",
+			algorithm:      "sha256",
+			expectedSHA256: "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+		},
+		{
+			name:          "CRC32",
+			algorithm:     "CRC32",
+			expectedCRC32: "NhCmhg==",
+		},
+		{
+			name:      "disabled",
+			algorithm: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChecksum(tt.algorithm)
+			sha256Sum, crc32Sum := c.fields(c.digest([]byte("hello")))
+
+			if aws.ToString(sha256Sum) != tt.expectedSHA256 {
+				t.Errorf("ChecksumSHA256 = %q, want %q", aws.ToString(sha256Sum), tt.expectedSHA256)
+			}
+			if aws.ToString(crc32Sum) != tt.expectedCRC32 {
+				t.Errorf("ChecksumCRC32 = %q, want %q", aws.ToString(crc32Sum), tt.expectedCRC32)
+			}
+		})
+	}
+}
+
+func TestChecksum_addMetadata(t *testing.T) {
+	metadata := map[string]string{"client-ip": "127.0.0.1"}
+
+	c := newChecksum("SHA256")
+	result := c.addMetadata(metadata, c.digest([]byte("hello")))
+
+	if result["checksum-sha256"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("checksum-sha256 = %q, want hex digest of %q", result["checksum-sha256"], "hello")
+	}
+	if result["client-ip"] != "127.0.0.1" {
+		t.Error("expected existing metadata to be kept")
+	}
+	if _, ok := metadata["checksum-sha256"]; ok {
+		t.Error("expected the original metadata map not to be modified")
+	}
+
+	disabled := newChecksum("")
+	if result := disabled.addMetadata(metadata, disabled.digest([]byte("hello"))); len(result) != 1 {
+		t.Errorf("expected no checksum metadata when disabled, got %v", result)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// configEnvVars are the environment variables LoadConfig reads, each also
+// under its namespaced name, see envPrefix. serve and validate-config take
+// each of them as a flag too, such as --s3-bucket for S3_BUCKET; flags win
+// over the environment.
+var configEnvVars = []string{
+	"ACCESS_LOG", "ADMIN_ADDR", "ADMIN_PPROF", "ADMIN_TOKEN",
+	"ALLOWED_EXTENSIONS", "ALLOWED_IPS_TAG", "ALLOWED_PRINCIPALS",
+	"ALLOW_ANY_ACCOUNT", "APPCONFIG_PROFILE", "APPCONFIG_REFRESH",
+	"ASSUME_ROLE_ARN", "ASSUME_ROLE_DURATION", "AUDIT_BUCKET", "AUDIT_INTERVAL",
+	"AUDIT_PREFIX", "AUDIT_RETENTION", "AUTH_CACHE_SIZE", "AUTH_CACHE_TTL",
+	"AUTH_LOCKOUT_DURATION", "AUTH_LOCKOUT_THRESHOLD", "AUTH_RATE_BURST",
+	"AUTH_RATE_LIMIT", "AUTH_WEBHOOK_TIMEOUT", "AUTH_WEBHOOK_TOKEN",
+	"AUTH_WEBHOOK_URL", "AWS_ACCOUNT_ID", "AWS_HTTP_DIAL_TIMEOUT",
+	"AWS_HTTP_MAX_IDLE_CONNS_PER_HOST", "AWS_HTTP_PROXY",
+	"AWS_HTTP_RESPONSE_HEADER_TIMEOUT", "AWS_HTTP_TLS_HANDSHAKE_TIMEOUT",
+	"AWS_REGION", "BAN_DURATION", "BAN_FIND_TIME", "BAN_THRESHOLD",
+	"CLIENT_VERSION_ALLOW", "CLIENT_VERSION_DENY",
+	"CLOUDWATCH_LOG_FLUSH_INTERVAL", "CLOUDWATCH_LOG_GROUP",
+	"CLOUDWATCH_LOG_STREAM", "CONFIG_PARAMETER_PATH",
+	"CONFIG_PARAMETER_REFRESH", "CONNECTION_TIMEOUT",
+	"DELIVERY_WEBHOOK_SECRET", "DELIVERY_WEBHOOK_URL", "DENIED_EXTENSIONS",
+	"EVENTBRIDGE_BUS", "FAILOVER_BUCKET", "FTPS_CERT_FILE",
+	"FTPS_KEY_FILE", "FTPS_PASSIVE_PORTS", "FTPS_PORT", "FTPS_PUBLIC_IP",
+	"GEOIP_ALLOW_COUNTRIES", "GEOIP_DB", "GEOIP_DENY_COUNTRIES",
+	"GUEST_PASSWORD", "GUEST_PREFIX", "GUEST_QUOTA", "GUEST_USER",
+	"HANDSHAKE_TIMEOUT", "HOST_KEY_PARAMETER", "HOST_KEY_ROLLOVER",
+	"HOST_KEY_SECRET", "JWT_AUDIENCE", "JWT_ISSUER", "JWT_JWKS_URL",
+	"KAFKA_BROKERS", "KAFKA_MAX_MESSAGE_SIZE", "KAFKA_SASL_PASSWORD",
+	"KAFKA_SASL_USERNAME", "KAFKA_STORE_S3", "KAFKA_TLS", "KAFKA_TOPIC",
+	"KEY_DATE_LAYOUT", "KEY_TIMESTAMP_TOLERANCE", "KEY_TIMESTAMP_TZ",
+	"LDAP_BASE_DN",
+	"LDAP_BIND_DN", "LDAP_GROUP_PREFIXES", "LDAP_TIMEOUT", "LDAP_URL",
+	"LDAP_USER_ATTRIBUTE", "LOG_FILE", "LOG_FILE_COMPRESS",
+	"LOG_FILE_MAX_AGE", "LOG_FILE_MAX_BACKUPS", "LOG_FILE_MAX_SIZE",
+	"LOG_SAMPLE_BURST", "LOG_SAMPLE_INTERVAL", "MAX_CONNECTIONS",
+	"MAX_FILE_SIZE", "MAX_PREAUTH_CONNECTIONS", "MFA_REQUIRED",
+	"MULTIPART_CONCURRENCY", "MULTIPART_PART_SIZE", "OBJECT_METADATA",
+	"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_LOGS_EXPORTER",
+	"OTEL_SERVICE_NAME", "PARTNER_ID_PATTERN", "POLICY_TAG_PREFIX",
+	"PROGRESS_LOG_INTERVAL", "READY_CHECK_AWS", "READ_TIMEOUT",
+	"REPLICA_POLICY", "RESUME_TIMEOUT", "S3_BUCKET",
+	"S3_BUCKET_PREFIX", "S3_ENDPOINT_URL", "S3_FORCE_PATH_STYLE",
+	"S3_INSECURE_SKIP_VERIFY", "S3_KEY_COLLISION", "S3_KEY_TEMPLATE",
+	"S3_SSE", "S3_SSE_KMS_KEY_ID", "S3_STORAGE_CLASS", "SECURITY_FINDINGS",
+	"SECURITY_FINDINGS_BUS", "SENTRY_DSN", "SENTRY_ENVIRONMENT",
+	"SESSION_MAX_BYTES", "SESSION_MAX_FILES", "SFTP_PORT", "SPILL_DIR",
+	"SPILL_THRESHOLD", "SSH_BANNER", "SSH_BANNER_FILE", "SSH_CA_KEYS",
+	"SSH_CIPHERS", "SSH_KEX_ALGORITHMS", "SSH_MACS", "SSH_SERVER_VERSION",
+	"STREAM_UPLOADS", "TCP_KEEPALIVE", "TCP_KEEPALIVE_COUNT",
+	"TCP_KEEPALIVE_INTERVAL", "TEMP_FILE_SUFFIXES", "TOTP_SECRETS_FILE",
+	"UPLOAD_CHECKSUM", "UPLOAD_FAILURE_TOPIC", "UPLOAD_QUEUE_URL",
+	"UPLOAD_RETRY_ATTEMPTS", "UPLOAD_RETRY_BASE_DELAY",
+	"UPLOAD_RETRY_JITTER", "UPLOAD_ROUTES",
+	"USERS_FILE", "USERS_SECRET", "USERS_SECRET_REFRESH", "USER_CONFIG_KEY",
+	"USER_CONFIG_TABLE", "VAULT_ADDR", "VAULT_AWS_MOUNT", "VAULT_AWS_ROLE",
+	"VERIFY_WRITE_ACCESS", "VIRTUAL_DIR", "WRITE_TIMEOUT",
+}
+
+// command is a subcommand of the sftpgw binary.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, stdout, stderr io.Writer) int // returns the exit code
+}
+
+var commands = []command{
+	{"serve", "run the SFTP gateway (the default)", runServe},
+	{"validate-config", "check the configuration without starting the gateway", runValidateConfig},
+	{"genkey", "generate a set of SSH host keys in PEM form", runGenKey},
+	{"version", "print the version", runVersion},
+}
+
+// runCLI runs the subcommand named by the first argument. Without one, or
+// with only flags, the gateway is started as it was before there were
+// subcommands; --version still prints the version.
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		for _, arg := range args {
+			if arg == "-version" || arg == "--version" {
+				return runVersion(nil, stdout, stderr)
+			}
+			if arg == "-h" || arg == "-help" || arg == "--help" {
+				printUsage(stdout)
+				return 0
+			}
+		}
+		return runServe(args, stdout, stderr)
+	}
+
+	if args[0] == "help" {
+		printUsage(stdout)
+		return 0
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], stdout, stderr)
+		}
+	}
+	fmt.Fprintf(stderr, "sftpgw: unknown command %q\n\n", args[0])
+	printUsage(stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: sftpgw [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'sftpgw <command> -h' for the flags of a command.")
+}
+
+// envFlagName returns the flag for an environment variable, such as
+// s3-bucket for S3_BUCKET.
+func envFlagName(env string) string {
+	return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// configFlags returns the flags of a command that loads the configuration.
+// Every flag sets its environment variable when it is parsed.
+func configFlags(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("sftpgw "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, env := range configEnvVars {
+		// the namespaced variable, so the flag also wins over that
+		fs.Func(envFlagName(env), "sets "+env, func(value string) error {
+			return os.Setenv(namespacedEnv(env), value)
+		})
+	}
+	return fs
+}
+
+func runServe(args []string, stdout, stderr io.Writer) int {
+	fs := configFlags("serve", stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "sftpgw serve: unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+	return serve()
+}
+
+func runValidateConfig(args []string, stdout, stderr io.Writer) int {
+	fs := configFlags("validate-config", stderr)
+	jsonOutput := fs.Bool("json", false, "print the result as JSON, with the field, value and reason of each problem")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := validateConfig(context.Background())
+	if *jsonOutput {
+		return printValidationJSON(stdout, config, err)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid configuration:")
+		for _, problem := range configErrors(err) {
+			fmt.Fprintf(stderr, "  %s\n", strings.ReplaceAll(problem.Error(), "\n", "\n  "))
+		}
+		return 1
+	}
+	destination := "s3://" + config.S3Bucket
+	if config.DeliveryWebhookURL != "" {
+		destination = redactURL(config.DeliveryWebhookURL)
+	}
+	fmt.Fprintf(stdout, "configuration is valid: SFTP on port %d, uploads to %s\n", config.ServerPort, destination)
+	return 0
+}
+
+// validateConfig loads the configuration as serve does, settings from
+// Parameter Store and AppConfig included.
+func validateConfig(ctx context.Context) (*Config, error) {
+	if _, err := loadConfigParameters(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := loadConfigProfile(ctx); err != nil {
+		return nil, err
+	}
+	return LoadConfig()
+}
+
+// printValidationJSON prints the result of validate-config --json, such as
+// {"valid":false,"errors":[{"field":"SFTP_PORT","value":"0","reason":"0 is
+// not a valid port"}]}, for deployment tooling.
+func printValidationJSON(stdout io.Writer, config *Config, err error) int {
+	result := struct {
+		Valid  bool           `json:"valid"`
+		Port   int            `json:"port,omitempty"`
+		Bucket string         `json:"bucket,omitempty"`
+		Errors []*ConfigError `json:"errors,omitempty"`
+	}{Valid: err == nil, Errors: configErrors(err)}
+	if config != nil {
+		result.Port, result.Bucket = config.ServerPort, config.S3Bucket
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func runGenKey(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("sftpgw genkey", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "", "write the keys to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	keys, err := generateHostKeys()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to generate host keys: %v\n", err)
+		return 1
+	}
+	signers, err := parseHostKeys(keys)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to generate host keys: %v\n", err)
+		return 1
+	}
+
+	if *out == "" {
+		stdout.Write(keys)
+	} else if err := os.WriteFile(*out, keys, 0o600); err != nil {
+		fmt.Fprintf(stderr, "failed to write host keys: %v\n", err)
+		return 1
+	}
+	// to stderr, so the keys can be piped into a secret
+	for _, signer := range signers {
+		fmt.Fprintf(stderr, "%s %s\n", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return 0
+}
+
+func runVersion(args []string, stdout, stderr io.Writer) int {
+	fmt.Fprintln(stdout, currentBuildInfo())
+	return 0
+}
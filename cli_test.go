@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigEnvVars_MatchLoadConfig(t *testing.T) {
+	src, err := os.ReadFile("config.go")
+	if err != nil {
+		t.Fatalf("Failed to read config.go: %v", err)
+	}
+	for _, m := range regexp.MustCompile(`"([A-Z][A-Z0-9]*_[A-Z0-9_]+)"`).FindAllStringSubmatch(string(src), -1) {
+		if !slices.Contains(configEnvVars, m[1]) {
+			t.Errorf("%s is read by LoadConfig but has no flag", m[1])
+		}
+	}
+}
+
+func TestRunCLI_ValidateConfig(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"validate-config", "--s3-bucket", "test-bucket", "--aws-account-id", "123456789012", "--sftp-port", "2223"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("validate-config exited with %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "port 2223") || !strings.Contains(stdout.String(), "s3://test-bucket") {
+		t.Errorf("validate-config printed %q", stdout.String())
+	}
+
+	stdout.Reset()
+	code = runCLI([]string{"validate-config", "--max-file-size", "lots", "--sftp-port", "0"}, &stdout, &stderr)
+	if code != 1 {
+		t.Errorf("validate-config exited with %d for an invalid configuration, want 1", code)
+	}
+	want := "invalid configuration:\n  invalid SFTP_PORT: 0 is not a valid port\n  invalid MAX_FILE_SIZE: "
+	if !strings.HasPrefix(stderr.String(), want) {
+		t.Errorf("validate-config reported %q, want both problems", stderr.String())
+	}
+}
+
+func TestRunCLI_ValidateConfigJSON(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	var stdout, stderr bytes.Buffer
+	code := runCLI([]string{"validate-config", "--json", "--s3-bucket", "test-bucket", "--aws-account-id", "123456789012", "--sftp-port", "0"}, &stdout, &stderr)
+	if code != 1 {
+		t.Errorf("validate-config --json exited with %d for an invalid configuration, want 1", code)
+	}
+	var result struct {
+		Valid  bool `json:"valid"`
+		Errors []struct {
+			Field  string `json:"field"`
+			Value  string `json:"value"`
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Fatalf("validate-config --json printed %q: %v", stdout.String(), err)
+	}
+	if result.Valid || len(result.Errors) != 1 || result.Errors[0].Field != "SFTP_PORT" || result.Errors[0].Value != "0" || result.Errors[0].Reason != "0 is not a valid port" {
+		t.Errorf("validate-config --json = %+v", result)
+	}
+
+	stdout.Reset()
+	code = runCLI([]string{"validate-config", "--json", "--sftp-port", "2223"}, &stdout, &stderr)
+	if code != 0 || !strings.Contains(stdout.String(), `"valid": true`) || !strings.Contains(stdout.String(), `"port": 2223`) {
+		t.Errorf("validate-config --json exited with %d and printed %q", code, stdout.String())
+	}
+}
+
+func TestRunCLI_GenKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host_keys.pem")
+
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"genkey", "-o", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("genkey exited with %d: %s", code, stderr.String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read keys: %v", err)
+	}
+	signers, err := parseHostKeys(data)
+	if err != nil || len(signers) != 3 {
+		t.Fatalf("genkey wrote %d keys (%v), want 3", len(signers), err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("keys written with mode %v, want 0600", info.Mode().Perm())
+	}
+	if n := strings.Count(stderr.String(), "SHA256:"); n != 3 {
+		t.Errorf("genkey printed %d fingerprints, want 3: %q", n, stderr.String())
+	}
+}
+
+func TestRunCLI_Version(t *testing.T) {
+	for _, args := range [][]string{{"version"}, {"--version"}} {
+		var stdout, stderr bytes.Buffer
+		if code := runCLI(args, &stdout, &stderr); code != 0 {
+			t.Errorf("%v exited with %d", args, code)
+		}
+		if !strings.HasPrefix(stdout.String(), "sftpgw ") {
+			t.Errorf("%v printed %q", args, stdout.String())
+		}
+	}
+}
+
+func TestRunCLI_UnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCLI([]string{"serv"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unknown command exited with %d, want 2", code)
+	}
+	if !strings.Contains(stderr.String(), "validate-config") {
+		t.Errorf("unknown command printed %q, want the usage", stderr.String())
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// PutLogEvents limits. Every event counts 26 bytes on top of its message.
+const (
+	cloudWatchMaxBatchEvents = 10000
+	cloudWatchMaxBatchBytes  = 1024 * 1024
+	cloudWatchEventOverhead  = 26
+	cloudWatchMaxEventBytes  = 256*1024 - cloudWatchEventOverhead
+)
+
+const (
+	cloudWatchMaxPendingBytes = 8 * 1024 * 1024 // entries beyond this are dropped until the next batch is sent
+	cloudWatchSendAttempts    = 3
+)
+
+type cloudWatchLogEvent struct {
+	Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+	Message   string `json:"message"`
+}
+
+// cloudWatchLogs sends the gateway's log entries to a CloudWatch Logs
+// stream, for installs outside of container platforms that would otherwise
+// not collect them. Entries are buffered and sent in batches by run every
+// CLOUDWATCH_LOG_FLUSH_INTERVAL, or sooner when a batch is full. Failed
+// batches are retried a few times; problems are reported on stderr, since
+// logging them would feed them back into the stream.
+type cloudWatchLogs struct {
+	group      string
+	stream     string
+	interval   time.Duration
+	client     *awsJSONClient
+	timeFunc   func() time.Time
+	retryDelay time.Duration // before the first retry, doubling after that
+
+	mu           sync.Mutex
+	pending      []cloudWatchLogEvent
+	pendingBytes int
+	dropped      int
+
+	full chan struct{} // signals run that a batch is ready
+	stop context.CancelFunc
+	done chan struct{} // closed when run returns
+}
+
+func newCloudWatchLogs(cfg *Config, awsConfig aws.Config) *cloudWatchLogs {
+	c := &cloudWatchLogs{
+		group:      cfg.CloudWatchLogGroup,
+		stream:     cfg.CloudWatchLogStream,
+		interval:   cfg.CloudWatchLogFlushInterval,
+		client:     newAWSJSONClient(awsConfig, "logs", "Logs_20140328", "1.1"),
+		timeFunc:   time.Now,
+		retryDelay: time.Second,
+		full:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if c.stream == "" {
+		c.stream = "sftpgw"
+		if hostname, err := os.Hostname(); err == nil {
+			c.stream = hostname
+		}
+	}
+	return c
+}
+
+// startCloudWatchLogs creates the log stream with the gateway's own AWS
+// credentials and starts sending log entries to it.
+func startCloudWatchLogs(ctx context.Context, cfg *Config) (*cloudWatchLogs, error) {
+	awsConfig, err := loadGatewayAWSConfig(ctx, cfg, newAWSHTTPClient(cfg, false))
+	if err != nil {
+		return nil, err
+	}
+	c := newCloudWatchLogs(cfg, awsConfig)
+	if err := c.createStream(ctx); err != nil {
+		return nil, err
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	go c.run(runCtx)
+	return c, nil
+}
+
+// close sends the remaining entries and stops run.
+func (c *cloudWatchLogs) close() {
+	c.stop()
+	<-c.done
+}
+
+// Write queues one log entry. It never fails, so a CloudWatch outage can't
+// stop logging to stdout or LOG_FILE next to it.
+func (c *cloudWatchLogs) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	if len(message) > cloudWatchMaxEventBytes {
+		message = message[:cloudWatchMaxEventBytes]
+	}
+	if message == "" {
+		return len(p), nil
+	}
+	size := len(message) + cloudWatchEventOverhead
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingBytes+size > cloudWatchMaxPendingBytes {
+		c.dropped++
+		return len(p), nil
+	}
+	c.pending = append(c.pending, cloudWatchLogEvent{Timestamp: c.timeFunc().UnixMilli(), Message: message})
+	c.pendingBytes += size
+
+	if len(c.pending) >= cloudWatchMaxBatchEvents || c.pendingBytes >= cloudWatchMaxBatchBytes {
+		select {
+		case c.full <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// run sends the buffered entries until ctx is done, then sends what is left.
+func (c *cloudWatchLogs) run(ctx context.Context) {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			c.flush(ctx)
+			cancel()
+			return
+		case <-ticker.C:
+			c.flush(ctx)
+		case <-c.full:
+			c.flush(ctx)
+		}
+	}
+}
+
+// flush sends all buffered entries, a batch at a time.
+func (c *cloudWatchLogs) flush(ctx context.Context) {
+	for {
+		batch, dropped := c.nextBatch()
+		if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "dropped %d log entries for CloudWatch Logs: buffer full\n", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := c.send(ctx, batch); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send %d log entries to CloudWatch Logs group %s: %v\n", len(batch), c.group, err)
+		}
+	}
+}
+
+// nextBatch takes the oldest entries that fit in one PutLogEvents request.
+func (c *cloudWatchLogs) nextBatch() ([]cloudWatchLogEvent, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, size := 0, 0
+	for n < len(c.pending) && n < cloudWatchMaxBatchEvents {
+		eventSize := len(c.pending[n].Message) + cloudWatchEventOverhead
+		if size+eventSize > cloudWatchMaxBatchBytes {
+			break
+		}
+		size += eventSize
+		n++
+	}
+
+	batch := c.pending[:n:n]
+	c.pending = c.pending[n:]
+	c.pendingBytes -= size
+	dropped := c.dropped
+	c.dropped = 0
+	return batch, dropped
+}
+
+// send puts a batch of entries, retrying throttling, server errors and
+// network failures. A stream or group deleted while the gateway runs is
+// created again.
+func (c *cloudWatchLogs) send(ctx context.Context, batch []cloudWatchLogEvent) error {
+	input := map[string]any{
+		"logGroupName":  c.group,
+		"logStreamName": c.stream,
+		"logEvents":     batch,
+	}
+
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		var result struct {
+			RejectedLogEventsInfo *struct {
+				TooNewLogEventStartIndex *int `json:"tooNewLogEventStartIndex"`
+				TooOldLogEventEndIndex   *int `json:"tooOldLogEventEndIndex"`
+				ExpiredLogEventEndIndex  *int `json:"expiredLogEventEndIndex"`
+			} `json:"rejectedLogEventsInfo"`
+		}
+		err := c.client.call(ctx, "PutLogEvents", input, &result)
+		if err == nil {
+			if result.RejectedLogEventsInfo != nil {
+				fmt.Fprintf(os.Stderr, "CloudWatch Logs rejected log entries that are too old or too new\n")
+			}
+			return nil
+		}
+
+		if isAWSErrorCode(err, "ResourceNotFoundException") {
+			if err := c.createStream(ctx); err != nil {
+				return err
+			}
+		} else if !retryableCloudWatchError(err) {
+			return err
+		}
+		if attempt == cloudWatchSendAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retryableCloudWatchError tells whether sending a batch again may succeed:
+// anything but a client error, except throttling.
+func retryableCloudWatchError(err error) bool {
+	var apiErr *awsAPIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return !strings.HasPrefix(apiErr.status, "4") || apiErr.Code == "ThrottlingException"
+}
+
+// createStream creates the log stream, and the log group if it doesn't
+// exist yet. Existing ones are fine.
+func (c *cloudWatchLogs) createStream(ctx context.Context) error {
+	stream := map[string]string{"logGroupName": c.group, "logStreamName": c.stream}
+	err := c.client.call(ctx, "CreateLogStream", stream, nil)
+	if isAWSErrorCode(err, "ResourceNotFoundException") {
+		err = c.client.call(ctx, "CreateLogGroup", map[string]string{"logGroupName": c.group}, nil)
+		if err != nil && !isAWSErrorCode(err, "ResourceAlreadyExistsException") {
+			return err
+		}
+		err = c.client.call(ctx, "CreateLogStream", stream, nil)
+	}
+	if err != nil && !isAWSErrorCode(err, "ResourceAlreadyExistsException") {
+		return err
+	}
+	return nil
+}
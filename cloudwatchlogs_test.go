@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type cloudWatchRequest struct {
+	Operation     string
+	LogGroupName  string
+	LogStreamName string
+	LogEvents     []cloudWatchLogEvent
+}
+
+// newTestCloudWatchLogs returns a sink sending to a fake CloudWatch Logs
+// endpoint. respond answers a request, or lets it succeed if it returns
+// false.
+func newTestCloudWatchLogs(t *testing.T, respond func(w http.ResponseWriter, req cloudWatchRequest) bool) (*cloudWatchLogs, func() []cloudWatchRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []cloudWatchRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req cloudWatchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		req.Operation = strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		if respond == nil || !respond(w, req) {
+			w.Write([]byte(`{}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	c := newCloudWatchLogs(&Config{
+		CloudWatchLogGroup:         "/sftpgw",
+		CloudWatchLogStream:        "gateway-1",
+		CloudWatchLogFlushInterval: time.Hour,
+	}, testAWSConfig(server))
+	c.client.endpoint = server.URL
+	c.retryDelay = time.Millisecond
+	c.timeFunc = func() time.Time { return time.UnixMilli(1705329045000) }
+	return c, func() []cloudWatchRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]cloudWatchRequest(nil), requests...)
+	}
+}
+
+func awsErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	w.Write([]byte(`{"__type": "com.amazonaws.logs#` + code + `", "message": "test"}`))
+}
+
+func TestCloudWatchLogs_SendsBatches(t *testing.T) {
+	c, requests := newTestCloudWatchLogs(t, nil)
+
+	c.Write([]byte(`{"msg":"first"}` + "\n"))
+	c.Write([]byte(`{"msg":"second"}` + "\n"))
+	c.flush(context.Background())
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(got))
+	}
+	req := got[0]
+	if req.Operation != "PutLogEvents" || req.LogGroupName != "/sftpgw" || req.LogStreamName != "gateway-1" {
+		t.Errorf("request = %+v, want PutLogEvents to /sftpgw gateway-1", req)
+	}
+	if len(req.LogEvents) != 2 || req.LogEvents[0].Message != `{"msg":"first"}` || req.LogEvents[0].Timestamp != 1705329045000 {
+		t.Errorf("log events = %+v, want both entries without newlines", req.LogEvents)
+	}
+
+	c.flush(context.Background())
+	if len(requests()) != 1 {
+		t.Error("flush() sent a request without new entries")
+	}
+}
+
+func TestCloudWatchLogs_SplitsBatches(t *testing.T) {
+	c, requests := newTestCloudWatchLogs(t, nil)
+
+	line := []byte(strings.Repeat("x", cloudWatchMaxEventBytes) + "\n")
+	for range 5 {
+		c.Write(line)
+	}
+	select {
+	case <-c.full:
+	default:
+		t.Error("Write() didn't signal a full batch")
+	}
+	c.flush(context.Background())
+
+	got := requests()
+	if len(got) != 2 || len(got[0].LogEvents) != 4 || len(got[1].LogEvents) != 1 {
+		t.Errorf("sent %d requests, want batches of 4 and 1 entries up to 1MB", len(got))
+	}
+}
+
+func TestCloudWatchLogs_Retries(t *testing.T) {
+	attempts := 0
+	c, requests := newTestCloudWatchLogs(t, func(w http.ResponseWriter, req cloudWatchRequest) bool {
+		attempts++
+		if attempts < 3 {
+			awsErrorResponse(w, http.StatusBadRequest, "ThrottlingException")
+			return true
+		}
+		return false
+	})
+
+	if err := c.send(context.Background(), []cloudWatchLogEvent{{Timestamp: 1, Message: "entry"}}); err != nil {
+		t.Fatalf("send() unexpected error after throttling: %v", err)
+	}
+	if got := len(requests()); got != 3 {
+		t.Errorf("sent %d requests, want 3", got)
+	}
+}
+
+func TestCloudWatchLogs_DoesNotRetryClientErrors(t *testing.T) {
+	c, requests := newTestCloudWatchLogs(t, func(w http.ResponseWriter, req cloudWatchRequest) bool {
+		awsErrorResponse(w, http.StatusBadRequest, "AccessDeniedException")
+		return true
+	})
+
+	if err := c.send(context.Background(), []cloudWatchLogEvent{{Timestamp: 1, Message: "entry"}}); !isAWSErrorCode(err, "AccessDeniedException") {
+		t.Errorf("send() error = %v, want AccessDeniedException", err)
+	}
+	if got := len(requests()); got != 1 {
+		t.Errorf("sent %d requests, want no retries", got)
+	}
+}
+
+func TestCloudWatchLogs_CreatesStream(t *testing.T) {
+	groupExists, streamExists := false, false
+	c, requests := newTestCloudWatchLogs(t, func(w http.ResponseWriter, req cloudWatchRequest) bool {
+		switch req.Operation {
+		case "CreateLogGroup":
+			groupExists = true
+		case "CreateLogStream":
+			if !groupExists {
+				awsErrorResponse(w, http.StatusBadRequest, "ResourceNotFoundException")
+				return true
+			}
+			streamExists = true
+		case "PutLogEvents":
+			if !streamExists {
+				awsErrorResponse(w, http.StatusBadRequest, "ResourceNotFoundException")
+				return true
+			}
+		}
+		return false
+	})
+
+	if err := c.send(context.Background(), []cloudWatchLogEvent{{Timestamp: 1, Message: "entry"}}); err != nil {
+		t.Fatalf("send() unexpected error: %v", err)
+	}
+
+	var operations []string
+	for _, req := range requests() {
+		operations = append(operations, req.Operation)
+	}
+	want := "PutLogEvents CreateLogStream CreateLogGroup CreateLogStream PutLogEvents"
+	if got := strings.Join(operations, " "); got != want {
+		t.Errorf("operations = %s, want %s", got, want)
+	}
+
+	if err := c.createStream(context.Background()); err != nil {
+		t.Errorf("createStream() of an existing stream: %v", err)
+	}
+}
+
+func TestCloudWatchLogs_DropsWhenFull(t *testing.T) {
+	c, requests := newTestCloudWatchLogs(t, nil)
+
+	line := []byte(strings.Repeat("x", cloudWatchMaxEventBytes) + "\n")
+	for range 40 {
+		if n, err := c.Write(line); n != len(line) || err != nil {
+			t.Fatalf("Write() = %d, %v; want the entry accepted", n, err)
+		}
+	}
+	dropped := c.dropped
+	if dropped == 0 {
+		t.Fatal("no entries dropped beyond the buffer limit")
+	}
+
+	c.flush(context.Background())
+	sent := 0
+	for _, req := range requests() {
+		sent += len(req.LogEvents)
+	}
+	if sent+dropped != 40 {
+		t.Errorf("sent %d and dropped %d entries, want 40 in total", sent, dropped)
+	}
+}
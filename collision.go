@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// errObjectExists is returned when the collision policy is reject and the
+// key is already taken.
+var errObjectExists = errors.New("object already exists")
+
+// putObject stores a whole file. Unless the collision policy is overwrite the
+// request is conditional on the key being free; with uniquify a taken key is
+// replaced by uniqueKey and the upload is tried again. input.Key holds the
+// key that was used when putObject returns.
+func (u *S3Uploader) putObject(ctx context.Context, client s3API, logCtx slog.Attr, input *s3.PutObjectInput, body io.ReaderAt, size int64, optFns ...func(*s3.Options)) error {
+	for {
+		err := u.retry.do(ctx, u.logger, logCtx, "PutObject", func() error {
+			uploadCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			input.Body = io.NewSectionReader(body, 0, size)
+			input.ContentLength = aws.Int64(size)
+			_, err := client.PutObject(uploadCtx, input, optFns...)
+			return err
+		})
+
+		if !isPreconditionFailed(err) {
+			return err
+		}
+
+		if u.keyCollision != keyCollisionUniquify {
+			return errObjectExists
+		}
+
+		key := uniqueKey(aws.ToString(input.Key))
+		u.logger.Info("S3 key already exists, using unique key", logCtx,
+			slog.String("s3_key", aws.ToString(input.Key)),
+			slog.String("unique_key", key),
+		)
+		input.Key = aws.String(key)
+	}
+}
+
+// Exists reports whether key is already stored in the bucket of session,
+// signing the request with the session's credentials.
+func (u *S3Uploader) Exists(ctx context.Context, session uploadSession, key string) (bool, error) {
+	s3Client, err := u.newClient(ctx, session.accessKeyID, session.secretAccessKey, session.sessionToken)
+	if err != nil {
+		return false, fmt.Errorf("failed to configure AWS client: %w", err)
+	}
+	return objectExists(ctx, s3Client, u.bucketFor(session), key)
+}
+
+// objectExists is Exists with a client that has been created already.
+func objectExists(ctx context.Context, client s3API, bucket, key string) (bool, error) {
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ifNoneMatch returns the condition that makes a write fail when the key is
+// already taken, or nil when existing objects may be overwritten.
+func (u *S3Uploader) ifNoneMatch() *string {
+	if u.keyCollision == "" || u.keyCollision == keyCollisionOverwrite {
+		return nil
+	}
+	return aws.String("*")
+}
+
+// uniqueKey appends a UUID to the file name in key, keeping the extension so
+// the object still opens with the right application.
+func uniqueKey(key string) string {
+	ext := path.Ext(key)
+	if ext == path.Base(key) {
+		ext = "" // a dot file like .env has no extension
+	}
+	return strings.TrimSuffix(key, ext) + "-" + newUUID() + ext
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
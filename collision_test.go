@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newCollisionTestUploader(policy string) *S3Uploader {
+	return &S3Uploader{
+		bucket:       "test-bucket",
+		logger:       slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		keyCollision: policy,
+	}
+}
+
+func TestPutObject_KeyCollision(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr error
+		wantNew bool
+	}{
+		{"overwrite", keyCollisionOverwrite, nil, false},
+		{"reject", keyCollisionReject, errObjectExists, false},
+		{"uniquify", keyCollisionUniquify, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeS3Client{existing: map[string]bool{"2023-12-25/test.txt": true}}
+			uploader := newCollisionTestUploader(tt.policy)
+
+			data := []byte("hello")
+			input := uploader.putObjectInput("2023-12-25/test.txt", "text/plain", nil, nil)
+			err := uploader.putObject(context.Background(), client, slog.Group("test"), input, bytes.NewReader(data), int64(len(data)))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("putObject() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if tt.wantNew {
+				if client.putKey == "2023-12-25/test.txt" || !strings.HasPrefix(client.putKey, "2023-12-25/test-") || !strings.HasSuffix(client.putKey, ".txt") {
+					t.Errorf("Expected a unique key like 2023-12-25/test-<uuid>.txt, got %s", client.putKey)
+				}
+			} else if client.putKey != "2023-12-25/test.txt" {
+				t.Errorf("Expected key 2023-12-25/test.txt, got %s", client.putKey)
+			}
+		})
+	}
+}
+
+func TestS3Stream_KeyCollision(t *testing.T) {
+	client := &fakeS3Client{existing: map[string]bool{"2023-12-25/test.txt": true}}
+	stream := newTestStream(client, 4)
+	stream.uploader.keyCollision = keyCollisionReject
+
+	if _, err := stream.Write([]byte("abcdefgh")); !errors.Is(err, errObjectExists) {
+		t.Fatalf("Write() error = %v, want %v", err, errObjectExists)
+	}
+	if client.created {
+		t.Error("Expected no multipart upload for an existing key")
+	}
+
+	client = &fakeS3Client{existing: map[string]bool{"2023-12-25/test.txt": true}}
+	stream = newTestStream(client, 4)
+	stream.uploader.keyCollision = keyCollisionUniquify
+
+	stream.Write([]byte("abcdefgh"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+	if !client.completed || client.putKey == "2023-12-25/test.txt" {
+		t.Errorf("Expected multipart upload to a unique key, got %s", client.putKey)
+	}
+}
+
+func TestObjectExists(t *testing.T) {
+	client := &fakeS3Client{existing: map[string]bool{"2023-12-25/test.txt": true}}
+
+	if exists, err := objectExists(context.Background(), client, "test-bucket", "2023-12-25/test.txt"); err != nil || !exists {
+		t.Errorf("objectExists() = %v, %v, want true", exists, err)
+	}
+	if exists, err := objectExists(context.Background(), client, "test-bucket", "2023-12-25/other.txt"); err != nil || exists {
+		t.Errorf("objectExists() of a free key = %v, %v, want false", exists, err)
+	}
+}
+
+func TestUniqueKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		prefix string
+		suffix string
+	}{
+		{"2023-12-25/report.csv", "2023-12-25/report-", ".csv"},
+		{"2023-12-25/archive.tar.gz", "2023-12-25/archive.tar-", ".gz"},
+		{"2023-12-25/README", "2023-12-25/README-", ""},
+		{"2023-12-25/.env", "2023-12-25/.env-", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			key := uniqueKey(tt.key)
+			if !strings.HasPrefix(key, tt.prefix) || !strings.HasSuffix(key, tt.suffix) || len(key) != len(tt.prefix)+36+len(tt.suffix) {
+				t.Errorf("uniqueKey(%q) = %q, want %s<uuid>%s", tt.key, key, tt.prefix, tt.suffix)
+			}
+		})
+	}
+}
@@ -1,108 +1,1703 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
-	ServerPort         int
-	VirtualDir         string
-	MaxFileSize        int64
-	S3Bucket           string
-	S3BucketPrefix     string
-	S3Region           string
-	RequiredAccountID  string
-	ConnectionTimeout  time.Duration
-	ReadTimeout        time.Duration
-	WriteTimeout       time.Duration
-	MaxConnections     int
+	ServerPort            int
+	VirtualDir            string
+	MaxFileSize           int64
+	S3Bucket              string
+	S3BucketPrefix        string
+	S3Region              string
+	RequiredAccountID     string
+	AllowAnyAccount       bool // logins from any account, authorized by AllowedPrincipals or PolicyTagPrefix
+	ConnectionTimeout     time.Duration
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	MaxConnections        int
+	TCPKeepAlive          bool          // probe idle client connections so dead peers are dropped
+	TCPKeepAliveInterval  time.Duration // idle time before the first probe and between probes
+	TCPKeepAliveCount     int           // unanswered probes before a connection is dropped
+	KeyTimestampTZ        *time.Location
+	KeyTimestampTolerance time.Duration
+	KeyDateLayout         string // layout of {date} in S3 keys, see keyDateDay
+	StreamUploads         bool
+	MultipartPartSize     int64
+	MultipartConcurrency  int
+	UploadRetryAttempts   int
+	UploadRetryBaseDelay  time.Duration
+	UploadRetryJitter     float64
+	UploadChecksum        string
+	S3StorageClass        string
+	S3SSE                 string
+	S3SSEKMSKeyID         string
+	S3EndpointURL         string
+	S3InsecureSkipVerify  bool
+	S3ForcePathStyle      bool
+	S3KeyTemplate         string
+	S3KeyCollision        string
+	UploadRoutes          []uploadRoute // first match picks the bucket and prefix of an upload
+	ReplicaPolicy         string        // whether a failed replica of a route fails the upload
+	FailoverBucket        regionalBucket
+	ObjectMetadata        []metadataEntry // extra metadata stored with every object
+	PartnerIDPattern      *regexp.Regexp  // derives {partner} in ObjectMetadata from the user name
+	TempFileSuffixes      []string
+	AllowedExtensions     []string // lower case, with the leading dot; any if empty
+	DeniedExtensions      []string
+	ResumeTimeout         time.Duration
+	ProgressLogInterval   time.Duration
+	SpillThreshold        int64
+	SpillDir              string
+
+	AWSHTTPDialTimeout           time.Duration
+	AWSHTTPTLSHandshakeTimeout   time.Duration
+	AWSHTTPResponseHeaderTimeout time.Duration
+	AWSHTTPMaxIdleConnsPerHost   int
+	AWSHTTPProxy                 string
+
+	SSHCAKeys string
+
+	AssumeRoleARN      string
+	AssumeRoleDuration time.Duration
+
+	AuthCacheTTL  time.Duration
+	AuthCacheSize int
+
+	UsersFile          string
+	UsersSecret        string
+	UsersSecretRefresh time.Duration
+
+	AllowedPrincipals []string
+	VerifyWriteAccess bool
+
+	TOTPSecretsFile string
+	MFARequired     bool
+
+	AuthRateLimit        int // password attempts per minute per client IP
+	AuthRateBurst        int
+	AuthLockoutThreshold int
+	AuthLockoutDuration  time.Duration
+
+	BanThreshold int
+	BanFindTime  time.Duration
+	BanDuration  time.Duration
+
+	GeoIPDB             string
+	GeoIPAllowCountries []string
+	GeoIPDenyCountries  []string
+
+	AuthWebhookURL     string
+	AuthWebhookToken   string
+	AuthWebhookTimeout time.Duration
+
+	DeliveryWebhookURL    string // files are POSTed here instead of stored in S3
+	DeliveryWebhookSecret string // signs the requests to DeliveryWebhookURL
+
+	KafkaBrokers        []string // files are published to KafkaTopic through these
+	KafkaTopic          string
+	KafkaStoreS3        bool  // also store the files in S3
+	KafkaMaxMessageSize int64 // larger files aren't published
+	KafkaTLS            bool
+	KafkaSASLUsername   string // SASL/PLAIN, if set
+	KafkaSASLPassword   string
+
+	LDAPURL           string
+	LDAPBindDN        string // DN template for the user bind, {user} is replaced by the user name
+	LDAPBaseDN        string
+	LDAPUserAttribute string
+	LDAPGroupPrefixes []ldapGroup
+	LDAPTimeout       time.Duration
+
+	JWTIssuer   string
+	JWTJWKSURL  string // found through OIDC discovery if empty
+	JWTAudience string
+
+	VaultAddr     string
+	VaultAWSMount string
+	VaultAWSRole  string
+
+	UserConfigTable string
+	UserConfigKey   string // partition key attribute of UserConfigTable
+
+	AllowedIPsTag   string // IAM tag with the networks a principal may log in from
+	PolicyTagPrefix string // prefix of the IAM tags with per-principal settings, disabled if empty
+
+	SecurityFindings    string // "securityhub" or "eventbridge", disabled if empty
+	SecurityFindingsBus string // EventBridge bus for findings
+
+	UploadFailureTopic string // SNS topic notified of files that couldn't be stored
+	UploadQueueURL     string // SQS queue that gets a message for every stored file
+	EventBridgeBus     string // bus that gets session and upload events, disabled if empty
+
+	AuditBucket    string        // bucket that gets batches of audit records, disabled if empty
+	AuditPrefix    string        // key prefix of the batches in AuditBucket
+	AuditInterval  time.Duration // how often a batch is written
+	AuditRetention time.Duration // Object Lock retention of the batches, none if zero
+
+	GuestUser     string // user name of the anonymous drop-box, disabled if empty
+	GuestPassword string // password of GuestUser, none needed if empty
+	GuestPrefix   string // prefix for guest uploads below S3BucketPrefix
+	GuestQuota    int64  // bytes all guests together may upload per day, unlimited if zero
+
+	HostKeySecret    string        // Secrets Manager secret with the shared host key
+	HostKeyParameter string        // SSM parameter with the shared host key
+	HostKeyRollover  time.Duration // how long reloaded host keys are announced before they are used
+
+	ConfigParameterPath    string        // SSM path with settings named after their environment variable
+	ConfigParameterRefresh time.Duration // how often parameters are checked for changes, never if zero
+
+	AppConfigProfile string        // AppConfig application/environment/profile with settings, disabled if empty
+	AppConfigRefresh time.Duration // how often the profile is polled for changes
+
+	SSHCiphers      []string // offered ciphers in preference order, SSH package defaults if empty
+	SSHMACs         []string
+	SSHKeyExchanges []string
+
+	SSHBanner     string // shown to clients before authentication
+	SSHBannerFile string // file with the banner, read at startup
+
+	SSHServerVersion string // identification string sent to clients
+
+	ClientVersionAllow *regexp.Regexp // client versions that may connect, all if nil
+	ClientVersionDeny  *regexp.Regexp // client versions that are rejected
+
+	HandshakeTimeout      time.Duration // time for the key exchange, before authentication starts
+	MaxPreAuthConnections int           // connections still logging in, unlimited if zero
+
+	ServerPorts []int // ports to listen on, starting with ServerPort; only ServerPort if empty
+
+	FTPSPort         int    // explicit FTPS listener for clients that can't do SFTP, disabled if zero
+	FTPSCertFile     string // PEM certificate chain of the FTPS listener
+	FTPSKeyFile      string
+	FTPSPassivePorts []int  // first and last port of passive data connections, any if empty
+	FTPSPublicIP     net.IP // announced for passive data connections instead of the listener's
+
+	AdminAddr     string // address of the HTTP health check listener, disabled if empty
+	ReadyCheckAWS bool   // /readyz also checks that STS and S3 can be reached
+	AdminPprof    bool   // serve net/http/pprof profiles on the admin listener
+	AdminToken    string // bearer token for the session and upload endpoints, disabled if empty
+
+	OTLPEndpoint    string // OpenTelemetry collector for traces, disabled if empty
+	OTelServiceName string
+	OTLPLogs        bool // also send logs to OTLPEndpoint
+
+	LogFile           string        // write logs to this file instead of stdout
+	LogFileMaxSize    int64         // rotate the log file beyond this size, never if zero
+	LogFileMaxAge     time.Duration // rotate the log file after this long, never if zero
+	LogFileMaxBackups int           // rotated log files kept, all if zero
+	LogFileCompress   bool          // gzip rotated log files
+
+	AccessLog string // file with one line per SFTP request, rotated like LogFile
+
+	LogSampleBurst    int // entries of the same event written per LogSampleInterval, all if zero
+	LogSampleInterval time.Duration
+
+	SentryDSN         string // report errors and panics to this Sentry project
+	SentryEnvironment string
+
+	CloudWatchLogGroup         string        // also send logs to this CloudWatch Logs group, disabled if empty
+	CloudWatchLogStream        string        // the host name if empty
+	CloudWatchLogFlushInterval time.Duration // how often buffered log entries are sent
+
+	SessionMaxFiles int   // files one SFTP session may upload, unlimited if zero
+	SessionMaxBytes int64 // bytes one SFTP session may upload, unlimited if zero
 }
 
+// minMultipartPartSize is the smallest part size S3 accepts for all but the
+// last part of a multipart upload.
+const minMultipartPartSize = 5 * 1024 * 1024
+
+// Policies for an upload whose S3 key already exists.
+const (
+	keyCollisionOverwrite = "overwrite" // replace the existing object
+	keyCollisionReject    = "reject"    // fail the upload
+	keyCollisionUniquify  = "uniquify"  // store the file under a new key
+)
+
+// LoadConfig reads the configuration from the environment. The error lists
+// all invalid settings at once.
 func LoadConfig() (*Config, error) {
 	config := &Config{
-		ServerPort:        2222,
-		VirtualDir:        "/uploads",
-		MaxFileSize:       1024 * 1024, // 1MB default
-		ConnectionTimeout: 30 * time.Second,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		MaxConnections:    100,
+		ServerPort:                 2222,
+		VirtualDir:                 "/uploads",
+		MaxFileSize:                1024 * 1024, // 1MB default
+		ConnectionTimeout:          30 * time.Second,
+		ReadTimeout:                30 * time.Second,
+		WriteTimeout:               30 * time.Second,
+		MaxConnections:             100,
+		TCPKeepAlive:               true,
+		TCPKeepAliveInterval:       15 * time.Second,
+		TCPKeepAliveCount:          9,
+		KeyTimestampTZ:             time.UTC,
+		KeyDateLayout:              keyDateDay,
+		MultipartPartSize:          8 * 1024 * 1024, // 8MB default
+		MultipartConcurrency:       4,
+		UploadRetryAttempts:        3,
+		UploadRetryBaseDelay:       time.Second,
+		UploadRetryJitter:          0.2,
+		S3KeyCollision:             keyCollisionOverwrite,
+		ReplicaPolicy:              replicaPolicyPrimary,
+		ProgressLogInterval:        30 * time.Second,
+		AuthCacheSize:              1000,
+		AuthRateBurst:              5,
+		AuthLockoutDuration:        15 * time.Minute,
+		BanFindTime:                10 * time.Minute,
+		BanDuration:                time.Hour,
+		AuthWebhookTimeout:         10 * time.Second,
+		KafkaMaxMessageSize:        1000000,
+		LDAPUserAttribute:          "uid",
+		LDAPTimeout:                10 * time.Second,
+		VaultAWSMount:              "aws",
+		UserConfigKey:              "principal",
+		UsersSecretRefresh:         5 * time.Minute,
+		AppConfigRefresh:           time.Minute,
+		SecurityFindingsBus:        "default",
+		GuestPrefix:                "quarantine",
+		SSHServerVersion:           "SSH-2.0-SFTPGW",
+		HandshakeTimeout:           10 * time.Second,
+		MaxPreAuthConnections:      50,
+		OTelServiceName:            "sftpgw",
+		LogFileMaxSize:             100 * 1024 * 1024, // 100MB default
+		LogFileMaxBackups:          7,
+		LogFileCompress:            true,
+		CloudWatchLogFlushInterval: 5 * time.Second,
+		LogSampleBurst:             100,
+		LogSampleInterval:          time.Minute,
+		AuditPrefix:                "audit",
+		AuditInterval:              5 * time.Minute,
 	}
 
-	if port := os.Getenv("SFTP_PORT"); port != "" {
-		if p, err := strconv.Atoi(port); err != nil {
-			return nil, fmt.Errorf("invalid SFTP_PORT: %w", err)
-		} else {
-			config.ServerPort = p
+	// every problem is reported, not just the first
+	var errs []error
+
+	if ports := getenv("SFTP_PORT"); ports != "" {
+		for _, port := range strings.Split(ports, ",") {
+			p, err := strconv.Atoi(strings.TrimSpace(port))
+			if err != nil {
+				errs = append(errs, invalidSetting("SFTP_PORT", "%w", err))
+			} else if p < 1 || p > 65535 {
+				errs = append(errs, invalidSetting("SFTP_PORT", "%d is not a valid port", p))
+			} else if slices.Contains(config.ServerPorts, p) {
+				errs = append(errs, invalidSetting("SFTP_PORT", "port %d listed twice", p))
+			} else {
+				config.ServerPorts = append(config.ServerPorts, p)
+			}
+		}
+		if len(config.ServerPorts) > 0 {
+			config.ServerPort = config.ServerPorts[0]
 		}
 	}
 
-	if vdir := os.Getenv("VIRTUAL_DIR"); vdir != "" {
-		config.VirtualDir = vdir
+	if vdir := getenv("VIRTUAL_DIR"); vdir != "" {
+		if !path.IsAbs(vdir) || path.Clean(vdir) == "/" {
+			errs = append(errs, invalidSetting("VIRTUAL_DIR", "%q must be an absolute path below /", vdir))
+		} else {
+			config.VirtualDir = path.Clean(vdir)
+		}
 	}
 
-	if maxSize := os.Getenv("MAX_FILE_SIZE"); maxSize != "" {
+	if maxSize := getenv("MAX_FILE_SIZE"); maxSize != "" {
 		if size, err := strconv.ParseInt(maxSize, 10, 64); err != nil {
-			return nil, fmt.Errorf("invalid MAX_FILE_SIZE: %w", err)
+			errs = append(errs, invalidSetting("MAX_FILE_SIZE", "%w", err))
+		} else if size < 1 {
+			errs = append(errs, invalidSetting("MAX_FILE_SIZE", "must be at least 1"))
 		} else {
 			config.MaxFileSize = size
 		}
 	}
 
-	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+	if bucket := getenv("S3_BUCKET"); bucket != "" {
+		if err := validateBucketName(bucket); err != nil {
+			errs = append(errs, invalidSetting("S3_BUCKET", "%w", err))
+		}
 		config.S3Bucket = bucket
-	} else {
-		return nil, fmt.Errorf("S3_BUCKET environment variable is required")
+	} else if kafkaStoreS3, _ := strconv.ParseBool(getenv("KAFKA_STORE_S3")); getenv("DELIVERY_WEBHOOK_URL") == "" && (getenv("KAFKA_BROKERS") == "" || kafkaStoreS3) {
+		errs = append(errs, missingSetting("S3_BUCKET", "environment variable is required"))
 	}
 
-	if prefix := os.Getenv("S3_BUCKET_PREFIX"); prefix != "" {
-		config.S3BucketPrefix = prefix
+	if prefix := getenv("S3_BUCKET_PREFIX"); prefix != "" {
+		if cleaned, err := normalizeKeyPrefix(prefix); err != nil {
+			errs = append(errs, invalidSetting("S3_BUCKET_PREFIX", "%w", err))
+		} else {
+			config.S3BucketPrefix = cleaned
+		}
 	}
 
-	if region := os.Getenv("AWS_REGION"); region != "" {
+	if region := getenv("AWS_REGION"); region != "" {
 		config.S3Region = region
 	}
 
-	if accountID := os.Getenv("AWS_ACCOUNT_ID"); accountID != "" {
+	if anyAccount := getenv("ALLOW_ANY_ACCOUNT"); anyAccount != "" {
+		if b, err := strconv.ParseBool(anyAccount); err != nil {
+			errs = append(errs, invalidSetting("ALLOW_ANY_ACCOUNT", "%w", err))
+		} else {
+			config.AllowAnyAccount = b
+		}
+	}
+
+	if accountID := getenv("AWS_ACCOUNT_ID"); accountID != "" {
+		if !accountIDPattern.MatchString(accountID) {
+			errs = append(errs, invalidSetting("AWS_ACCOUNT_ID", "%q is not a 12-digit account ID", accountID))
+		}
 		config.RequiredAccountID = accountID
-	} else {
-		return nil, fmt.Errorf("AWS_ACCOUNT_ID environment variable is required")
+	} else if !config.AllowAnyAccount {
+		errs = append(errs, missingSetting("AWS_ACCOUNT_ID", "environment variable is required"))
 	}
 
-	if timeout := os.Getenv("CONNECTION_TIMEOUT"); timeout != "" {
+	if timeout := getenv("CONNECTION_TIMEOUT"); timeout != "" {
 		if t, err := time.ParseDuration(timeout); err != nil {
-			return nil, fmt.Errorf("invalid CONNECTION_TIMEOUT: %w", err)
+			errs = append(errs, invalidSetting("CONNECTION_TIMEOUT", "%w", err))
+		} else if t <= 0 {
+			errs = append(errs, invalidSetting("CONNECTION_TIMEOUT", "must be positive"))
 		} else {
 			config.ConnectionTimeout = t
 		}
 	}
 
-	if timeout := os.Getenv("READ_TIMEOUT"); timeout != "" {
+	if timeout := getenv("READ_TIMEOUT"); timeout != "" {
 		if t, err := time.ParseDuration(timeout); err != nil {
-			return nil, fmt.Errorf("invalid read_TIMEOUT: %w", err)
+			errs = append(errs, invalidSetting("READ_TIMEOUT", "%w", err))
+		} else if t < 0 {
+			errs = append(errs, invalidSetting("READ_TIMEOUT", "must not be negative"))
 		} else {
 			config.ReadTimeout = t
 		}
 	}
 
-	if timeout := os.Getenv("WRITE_TIMEOUT"); timeout != "" {
+	if timeout := getenv("WRITE_TIMEOUT"); timeout != "" {
 		if t, err := time.ParseDuration(timeout); err != nil {
-			return nil, fmt.Errorf("invalid WRITE_TIMEOUT: %w", err)
+			errs = append(errs, invalidSetting("WRITE_TIMEOUT", "%w", err))
+		} else if t < 0 {
+			errs = append(errs, invalidSetting("WRITE_TIMEOUT", "must not be negative"))
 		} else {
 			config.WriteTimeout = t
 		}
 	}
 
-	if maxConns := os.Getenv("MAX_CONNECTIONS"); maxConns != "" {
+	if maxConns := getenv("MAX_CONNECTIONS"); maxConns != "" {
 		if max, err := strconv.Atoi(maxConns); err != nil {
-			return nil, fmt.Errorf("invalid MAX_CONNECTIONS: %w", err)
+			errs = append(errs, invalidSetting("MAX_CONNECTIONS", "%w", err))
+		} else if max < 0 {
+			errs = append(errs, invalidSetting("MAX_CONNECTIONS", "must not be negative"))
 		} else {
 			config.MaxConnections = max
 		}
 	}
 
-	return config, nil
-}
\ No newline at end of file
+	if timeout := getenv("HANDSHAKE_TIMEOUT"); timeout != "" {
+		if t, err := time.ParseDuration(timeout); err != nil {
+			errs = append(errs, invalidSetting("HANDSHAKE_TIMEOUT", "%w", err))
+		} else if t <= 0 {
+			errs = append(errs, invalidSetting("HANDSHAKE_TIMEOUT", "must be positive"))
+		} else {
+			config.HandshakeTimeout = t
+		}
+	}
+
+	if maxConns := getenv("MAX_PREAUTH_CONNECTIONS"); maxConns != "" {
+		if max, err := strconv.Atoi(maxConns); err != nil {
+			errs = append(errs, invalidSetting("MAX_PREAUTH_CONNECTIONS", "%w", err))
+		} else if max < 0 {
+			errs = append(errs, invalidSetting("MAX_PREAUTH_CONNECTIONS", "must not be negative"))
+		} else {
+			config.MaxPreAuthConnections = max
+		}
+	}
+
+	if maxFiles := getenv("SESSION_MAX_FILES"); maxFiles != "" {
+		if n, err := strconv.Atoi(maxFiles); err != nil {
+			errs = append(errs, invalidSetting("SESSION_MAX_FILES", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("SESSION_MAX_FILES", "must not be negative"))
+		} else {
+			config.SessionMaxFiles = n
+		}
+	}
+
+	if maxBytes := getenv("SESSION_MAX_BYTES"); maxBytes != "" {
+		if n, err := strconv.ParseInt(maxBytes, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("SESSION_MAX_BYTES", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("SESSION_MAX_BYTES", "must not be negative"))
+		} else {
+			config.SessionMaxBytes = n
+		}
+	}
+
+	if addr := getenv("ADMIN_ADDR"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, invalidSetting("ADMIN_ADDR", "%w", err))
+		}
+		config.AdminAddr = addr
+	}
+
+	if port := getenv("FTPS_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err != nil {
+			errs = append(errs, invalidSetting("FTPS_PORT", "%w", err))
+		} else if p < 1 || p > 65535 {
+			errs = append(errs, invalidSetting("FTPS_PORT", "%d is not a valid port", p))
+		} else if p == config.ServerPort || slices.Contains(config.ServerPorts, p) {
+			errs = append(errs, invalidSetting("FTPS_PORT", "port %d is already used by SFTP_PORT", p))
+		} else {
+			config.FTPSPort = p
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"FTPS_CERT_FILE": &config.FTPSCertFile,
+		"FTPS_KEY_FILE":  &config.FTPSKeyFile,
+	} {
+		if file := getenv(name); file != "" {
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			}
+			*field = file
+		} else if config.FTPSPort != 0 {
+			errs = append(errs, missingSetting(name, "is required with FTPS_PORT"))
+		}
+	}
+
+	if ports := getenv("FTPS_PASSIVE_PORTS"); ports != "" {
+		first, last, _ := strings.Cut(ports, "-")
+		p1, err1 := strconv.Atoi(strings.TrimSpace(first))
+		p2, err2 := strconv.Atoi(strings.TrimSpace(last))
+		if err1 != nil || err2 != nil || p1 < 1 || p2 > 65535 || p1 > p2 {
+			errs = append(errs, invalidSetting("FTPS_PASSIVE_PORTS", "%q is not a port range such as 50000-50100", ports))
+		} else {
+			config.FTPSPassivePorts = []int{p1, p2}
+		}
+	}
+
+	if ip := getenv("FTPS_PUBLIC_IP"); ip != "" {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+			errs = append(errs, invalidSetting("FTPS_PUBLIC_IP", "%q is not an IPv4 address", ip))
+		} else {
+			config.FTPSPublicIP = parsed.To4()
+		}
+	}
+
+	if check := getenv("READY_CHECK_AWS"); check != "" {
+		if b, err := strconv.ParseBool(check); err != nil {
+			errs = append(errs, invalidSetting("READY_CHECK_AWS", "%w", err))
+		} else {
+			config.ReadyCheckAWS = b
+		}
+	}
+
+	if enabled := getenv("ADMIN_PPROF"); enabled != "" {
+		if b, err := strconv.ParseBool(enabled); err != nil {
+			errs = append(errs, invalidSetting("ADMIN_PPROF", "%w", err))
+		} else if b && config.AdminAddr == "" {
+			errs = append(errs, invalidSetting("ADMIN_PPROF", "requires ADMIN_ADDR"))
+		} else {
+			config.AdminPprof = b
+		}
+	}
+
+	if token := getenv("ADMIN_TOKEN"); token != "" {
+		if config.AdminAddr == "" {
+			errs = append(errs, invalidSetting("ADMIN_TOKEN", "requires ADMIN_ADDR"))
+		} else if len(token) < 16 {
+			errs = append(errs, invalidSetting("ADMIN_TOKEN", "must be at least 16 characters"))
+		}
+		config.AdminToken = token
+	}
+
+	if endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil {
+			errs = append(errs, invalidSetting("OTEL_EXPORTER_OTLP_ENDPOINT", "%w", err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, invalidSetting("OTEL_EXPORTER_OTLP_ENDPOINT", "must be an http or https URL with a host"))
+		} else {
+			config.OTLPEndpoint = endpoint
+		}
+	}
+
+	if name := getenv("OTEL_SERVICE_NAME"); name != "" {
+		config.OTelServiceName = name
+	}
+
+	if exporter := getenv("OTEL_LOGS_EXPORTER"); exporter != "" {
+		switch exporter {
+		case "otlp":
+			if config.OTLPEndpoint == "" {
+				errs = append(errs, invalidSetting("OTEL_LOGS_EXPORTER", "otlp requires OTEL_EXPORTER_OTLP_ENDPOINT"))
+			}
+			config.OTLPLogs = true
+		case "none":
+		default:
+			errs = append(errs, invalidSetting("OTEL_LOGS_EXPORTER", "must be otlp or none"))
+		}
+	}
+
+	if path := getenv("LOG_FILE"); path != "" {
+		config.LogFile = path
+	}
+
+	if maxSize := getenv("LOG_FILE_MAX_SIZE"); maxSize != "" {
+		if size, err := strconv.ParseInt(maxSize, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_SIZE", "%w", err))
+		} else if size < 0 {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_SIZE", "must not be negative"))
+		} else {
+			config.LogFileMaxSize = size
+		}
+	}
+
+	if maxAge := getenv("LOG_FILE_MAX_AGE"); maxAge != "" {
+		if d, err := time.ParseDuration(maxAge); err != nil {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_AGE", "%w", err))
+		} else if d < 0 {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_AGE", "must not be negative"))
+		} else {
+			config.LogFileMaxAge = d
+		}
+	}
+
+	if backups := getenv("LOG_FILE_MAX_BACKUPS"); backups != "" {
+		if n, err := strconv.Atoi(backups); err != nil {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_BACKUPS", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("LOG_FILE_MAX_BACKUPS", "must not be negative"))
+		} else {
+			config.LogFileMaxBackups = n
+		}
+	}
+
+	if compress := getenv("LOG_FILE_COMPRESS"); compress != "" {
+		if b, err := strconv.ParseBool(compress); err != nil {
+			errs = append(errs, invalidSetting("LOG_FILE_COMPRESS", "%w", err))
+		} else {
+			config.LogFileCompress = b
+		}
+	}
+
+	if path := getenv("ACCESS_LOG"); path != "" {
+		if path == config.LogFile {
+			errs = append(errs, invalidSetting("ACCESS_LOG", "must differ from LOG_FILE"))
+		}
+		config.AccessLog = path
+	}
+
+	if burst := getenv("LOG_SAMPLE_BURST"); burst != "" {
+		if n, err := strconv.Atoi(burst); err != nil {
+			errs = append(errs, invalidSetting("LOG_SAMPLE_BURST", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("LOG_SAMPLE_BURST", "must not be negative"))
+		} else {
+			config.LogSampleBurst = n
+		}
+	}
+
+	if interval := getenv("LOG_SAMPLE_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil {
+			errs = append(errs, invalidSetting("LOG_SAMPLE_INTERVAL", "%w", err))
+		} else if d <= 0 {
+			errs = append(errs, invalidSetting("LOG_SAMPLE_INTERVAL", "must be positive"))
+		} else {
+			config.LogSampleInterval = d
+		}
+	}
+
+	if dsn := getenv("SENTRY_DSN"); dsn != "" {
+		if _, _, err := parseSentryDSN(dsn); err != nil {
+			errs = append(errs, invalidSetting("SENTRY_DSN", "%w", err))
+		}
+		config.SentryDSN = dsn
+	}
+
+	if environment := getenv("SENTRY_ENVIRONMENT"); environment != "" {
+		config.SentryEnvironment = environment
+	}
+
+	if group := getenv("CLOUDWATCH_LOG_GROUP"); group != "" {
+		config.CloudWatchLogGroup = group
+	}
+
+	if stream := getenv("CLOUDWATCH_LOG_STREAM"); stream != "" {
+		if strings.ContainsAny(stream, ":*") {
+			errs = append(errs, invalidSetting("CLOUDWATCH_LOG_STREAM", "must not contain ':' or '*'"))
+		}
+		config.CloudWatchLogStream = stream
+	}
+
+	if interval := getenv("CLOUDWATCH_LOG_FLUSH_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil {
+			errs = append(errs, invalidSetting("CLOUDWATCH_LOG_FLUSH_INTERVAL", "%w", err))
+		} else if d <= 0 {
+			errs = append(errs, invalidSetting("CLOUDWATCH_LOG_FLUSH_INTERVAL", "must be positive"))
+		} else {
+			config.CloudWatchLogFlushInterval = d
+		}
+	}
+
+	if keepAlive := getenv("TCP_KEEPALIVE"); keepAlive != "" {
+		if b, err := strconv.ParseBool(keepAlive); err != nil {
+			errs = append(errs, invalidSetting("TCP_KEEPALIVE", "%w", err))
+		} else {
+			config.TCPKeepAlive = b
+		}
+	}
+
+	if interval := getenv("TCP_KEEPALIVE_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil {
+			errs = append(errs, invalidSetting("TCP_KEEPALIVE_INTERVAL", "%w", err))
+		} else if d < time.Second {
+			errs = append(errs, invalidSetting("TCP_KEEPALIVE_INTERVAL", "must be at least 1s"))
+		} else {
+			config.TCPKeepAliveInterval = d
+		}
+	}
+
+	if count := getenv("TCP_KEEPALIVE_COUNT"); count != "" {
+		if n, err := strconv.Atoi(count); err != nil {
+			errs = append(errs, invalidSetting("TCP_KEEPALIVE_COUNT", "%w", err))
+		} else if n < 1 {
+			errs = append(errs, invalidSetting("TCP_KEEPALIVE_COUNT", "must be at least 1"))
+		} else {
+			config.TCPKeepAliveCount = n
+		}
+	}
+
+	if tz := getenv("KEY_TIMESTAMP_TZ"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err != nil {
+			errs = append(errs, invalidSetting("KEY_TIMESTAMP_TZ", "%w", err))
+		} else {
+			config.KeyTimestampTZ = loc
+		}
+	}
+
+	if tolerance := getenv("KEY_TIMESTAMP_TOLERANCE"); tolerance != "" {
+		if t, err := time.ParseDuration(tolerance); err != nil {
+			errs = append(errs, invalidSetting("KEY_TIMESTAMP_TOLERANCE", "%w", err))
+		} else if t < 0 {
+			errs = append(errs, invalidSetting("KEY_TIMESTAMP_TOLERANCE", "must not be negative"))
+		} else {
+			config.KeyTimestampTolerance = t
+		}
+	}
+
+	if layout := getenv("KEY_DATE_LAYOUT"); layout != "" {
+		switch strings.ToLower(layout) {
+		case keyDateDay, keyDateYMD, keyDateHourly, keyDateNone:
+			config.KeyDateLayout = strings.ToLower(layout)
+		default:
+			errs = append(errs, invalidSetting("KEY_DATE_LAYOUT", "must be day, ymd, hourly or none"))
+		}
+	}
+
+	if stream := getenv("STREAM_UPLOADS"); stream != "" {
+		if b, err := strconv.ParseBool(stream); err != nil {
+			errs = append(errs, invalidSetting("STREAM_UPLOADS", "%w", err))
+		} else {
+			config.StreamUploads = b
+		}
+	}
+
+	if partSize := getenv("MULTIPART_PART_SIZE"); partSize != "" {
+		if size, err := strconv.ParseInt(partSize, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("MULTIPART_PART_SIZE", "%w", err))
+		} else if size < minMultipartPartSize {
+			errs = append(errs, invalidSetting("MULTIPART_PART_SIZE", "must be at least %d bytes", minMultipartPartSize))
+		} else {
+			config.MultipartPartSize = size
+		}
+	}
+
+	if concurrency := getenv("MULTIPART_CONCURRENCY"); concurrency != "" {
+		if c, err := strconv.Atoi(concurrency); err != nil {
+			errs = append(errs, invalidSetting("MULTIPART_CONCURRENCY", "%w", err))
+		} else if c < 1 {
+			errs = append(errs, invalidSetting("MULTIPART_CONCURRENCY", "must be at least 1"))
+		} else {
+			config.MultipartConcurrency = c
+		}
+	}
+
+	if attempts := getenv("UPLOAD_RETRY_ATTEMPTS"); attempts != "" {
+		if a, err := strconv.Atoi(attempts); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_ATTEMPTS", "%w", err))
+		} else if a < 1 {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_ATTEMPTS", "must be at least 1"))
+		} else {
+			config.UploadRetryAttempts = a
+		}
+	}
+
+	if delay := getenv("UPLOAD_RETRY_BASE_DELAY"); delay != "" {
+		if d, err := time.ParseDuration(delay); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_BASE_DELAY", "%w", err))
+		} else if d < 0 {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_BASE_DELAY", "must not be negative"))
+		} else {
+			config.UploadRetryBaseDelay = d
+		}
+	}
+
+	if jitter := getenv("UPLOAD_RETRY_JITTER"); jitter != "" {
+		if j, err := strconv.ParseFloat(jitter, 64); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_JITTER", "%w", err))
+		} else if j < 0 || j > 1 {
+			errs = append(errs, invalidSetting("UPLOAD_RETRY_JITTER", "must be between 0 and 1"))
+		} else {
+			config.UploadRetryJitter = j
+		}
+	}
+
+	if algorithm := getenv("UPLOAD_CHECKSUM"); algorithm != "" {
+		switch strings.ToUpper(algorithm) {
+		case "SHA256", "CRC32":
+			config.UploadChecksum = strings.ToUpper(algorithm)
+		case "NONE":
+			config.UploadChecksum = ""
+		default:
+			errs = append(errs, invalidSetting("UPLOAD_CHECKSUM", "must be SHA256, CRC32 or NONE"))
+		}
+	}
+
+	if storageClass := getenv("S3_STORAGE_CLASS"); storageClass != "" {
+		if !slices.Contains(types.StorageClass("").Values(), types.StorageClass(storageClass)) {
+			errs = append(errs, invalidSetting("S3_STORAGE_CLASS", "unknown storage class %q", storageClass))
+		}
+		config.S3StorageClass = storageClass
+	}
+
+	if sse := getenv("S3_SSE"); sse != "" {
+		if !slices.Contains(types.ServerSideEncryption("").Values(), types.ServerSideEncryption(sse)) {
+			errs = append(errs, invalidSetting("S3_SSE", "unknown server-side encryption %q", sse))
+		}
+		config.S3SSE = sse
+	}
+
+	if keyID := getenv("S3_SSE_KMS_KEY_ID"); keyID != "" {
+		switch types.ServerSideEncryption(config.S3SSE) {
+		case "":
+			config.S3SSE = string(types.ServerSideEncryptionAwsKms)
+		case types.ServerSideEncryptionAes256:
+			errs = append(errs, invalidSetting("S3_SSE_KMS_KEY_ID", "requires S3_SSE to be aws:kms or aws:kms:dsse"))
+		}
+		config.S3SSEKMSKeyID = keyID
+	}
+
+	if endpoint := getenv("S3_ENDPOINT_URL"); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil {
+			errs = append(errs, invalidSetting("S3_ENDPOINT_URL", "%w", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, invalidSetting("S3_ENDPOINT_URL", "must be an http or https URL"))
+		}
+		config.S3EndpointURL = endpoint
+	}
+
+	if skipVerify := getenv("S3_INSECURE_SKIP_VERIFY"); skipVerify != "" {
+		if b, err := strconv.ParseBool(skipVerify); err != nil {
+			errs = append(errs, invalidSetting("S3_INSECURE_SKIP_VERIFY", "%w", err))
+		} else {
+			config.S3InsecureSkipVerify = b
+		}
+	}
+
+	if pathStyle := getenv("S3_FORCE_PATH_STYLE"); pathStyle != "" {
+		if b, err := strconv.ParseBool(pathStyle); err != nil {
+			errs = append(errs, invalidSetting("S3_FORCE_PATH_STYLE", "%w", err))
+		} else {
+			config.S3ForcePathStyle = b
+		}
+	}
+
+	if template := getenv("S3_KEY_TEMPLATE"); template != "" {
+		if err := validateKeyTemplate(template); err != nil {
+			errs = append(errs, invalidSetting("S3_KEY_TEMPLATE", "%w", err))
+		}
+		config.S3KeyTemplate = template
+	}
+
+	if collision := getenv("S3_KEY_COLLISION"); collision != "" {
+		switch strings.ToLower(collision) {
+		case keyCollisionOverwrite, keyCollisionReject, keyCollisionUniquify:
+			config.S3KeyCollision = strings.ToLower(collision)
+		default:
+			errs = append(errs, invalidSetting("S3_KEY_COLLISION", "must be overwrite, reject or uniquify"))
+		}
+	}
+
+	if routes := getenv("UPLOAD_ROUTES"); routes != "" {
+		if r, err := parseUploadRoutes(routes); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_ROUTES", "%w", err))
+		} else {
+			config.UploadRoutes = r
+		}
+	}
+
+	if policy := getenv("REPLICA_POLICY"); policy != "" {
+		switch strings.ToLower(policy) {
+		case replicaPolicyPrimary, replicaPolicyAll:
+			config.ReplicaPolicy = strings.ToLower(policy)
+		default:
+			errs = append(errs, invalidSetting("REPLICA_POLICY", "must be primary or all"))
+		}
+	}
+
+	if failover := getenv("FAILOVER_BUCKET"); failover != "" {
+		if bucket, err := parseRegionalBucket(failover); err != nil {
+			errs = append(errs, invalidSetting("FAILOVER_BUCKET", "%w", err))
+		} else {
+			config.FailoverBucket = bucket
+		}
+	}
+
+	if metadata := getenv("OBJECT_METADATA"); metadata != "" {
+		if entries, err := parseObjectMetadata(metadata); err != nil {
+			errs = append(errs, invalidSetting("OBJECT_METADATA", "%w", err))
+		} else {
+			config.ObjectMetadata = entries
+		}
+	}
+
+	if pattern := getenv("PARTNER_ID_PATTERN"); pattern != "" {
+		if re, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, invalidSetting("PARTNER_ID_PATTERN", "%w", err))
+		} else {
+			config.PartnerIDPattern = re
+		}
+	}
+
+	for _, setting := range []struct {
+		env        string
+		extensions *[]string
+	}{
+		{"ALLOWED_EXTENSIONS", &config.AllowedExtensions},
+		{"DENIED_EXTENSIONS", &config.DeniedExtensions},
+	} {
+		for _, extension := range normalizeExtensions(strings.Split(getenv(setting.env), ",")) {
+			if extension == "." || strings.Contains(extension, "/") {
+				errs = append(errs, invalidSetting(setting.env, "%q is not a file extension", extension))
+				continue
+			}
+			*setting.extensions = append(*setting.extensions, extension)
+		}
+	}
+	for _, extension := range config.DeniedExtensions {
+		if slices.Contains(config.AllowedExtensions, extension) {
+			errs = append(errs, invalidSetting("DENIED_EXTENSIONS", "%s is also in ALLOWED_EXTENSIONS", extension))
+		}
+	}
+
+	if suffixes := getenv("TEMP_FILE_SUFFIXES"); suffixes != "" {
+		for _, suffix := range strings.Split(suffixes, ",") {
+			suffix = strings.TrimSpace(suffix)
+			if suffix == "" {
+				continue
+			}
+			if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "/") {
+				errs = append(errs, invalidSetting("TEMP_FILE_SUFFIXES", "%q must start with a dot and not contain a slash", suffix))
+				continue
+			}
+			config.TempFileSuffixes = append(config.TempFileSuffixes, suffix)
+		}
+	}
+
+	if timeout := getenv("RESUME_TIMEOUT"); timeout != "" {
+		if t, err := time.ParseDuration(timeout); err != nil {
+			errs = append(errs, invalidSetting("RESUME_TIMEOUT", "%w", err))
+		} else if t < 0 {
+			errs = append(errs, invalidSetting("RESUME_TIMEOUT", "must not be negative"))
+		} else {
+			config.ResumeTimeout = t
+		}
+	}
+
+	if interval := getenv("PROGRESS_LOG_INTERVAL"); interval != "" {
+		if t, err := time.ParseDuration(interval); err != nil {
+			errs = append(errs, invalidSetting("PROGRESS_LOG_INTERVAL", "%w", err))
+		} else if t < 0 {
+			errs = append(errs, invalidSetting("PROGRESS_LOG_INTERVAL", "must not be negative"))
+		} else {
+			config.ProgressLogInterval = t
+		}
+	}
+
+	if threshold := getenv("SPILL_THRESHOLD"); threshold != "" {
+		if size, err := strconv.ParseInt(threshold, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("SPILL_THRESHOLD", "%w", err))
+		} else if size < 0 {
+			errs = append(errs, invalidSetting("SPILL_THRESHOLD", "must not be negative"))
+		} else {
+			config.SpillThreshold = size
+		}
+	}
+
+	config.SpillDir = getenv("SPILL_DIR")
+	if config.SpillThreshold > 0 {
+		dir := config.SpillDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, invalidSetting("SPILL_DIR", "%w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, invalidSetting("SPILL_DIR", "%s is not a directory", dir))
+		}
+	}
+
+	for name, field := range map[string]*time.Duration{
+		"AWS_HTTP_DIAL_TIMEOUT":            &config.AWSHTTPDialTimeout,
+		"AWS_HTTP_TLS_HANDSHAKE_TIMEOUT":   &config.AWSHTTPTLSHandshakeTimeout,
+		"AWS_HTTP_RESPONSE_HEADER_TIMEOUT": &config.AWSHTTPResponseHeaderTimeout,
+	} {
+		if timeout := getenv(name); timeout != "" {
+			if t, err := time.ParseDuration(timeout); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			} else if t < 0 {
+				errs = append(errs, invalidSetting(name, "must not be negative"))
+			} else {
+				*field = t
+			}
+		}
+	}
+
+	if maxIdle := getenv("AWS_HTTP_MAX_IDLE_CONNS_PER_HOST"); maxIdle != "" {
+		if n, err := strconv.Atoi(maxIdle); err != nil {
+			errs = append(errs, invalidSetting("AWS_HTTP_MAX_IDLE_CONNS_PER_HOST", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("AWS_HTTP_MAX_IDLE_CONNS_PER_HOST", "must not be negative"))
+		} else {
+			config.AWSHTTPMaxIdleConnsPerHost = n
+		}
+	}
+
+	if proxy := getenv("AWS_HTTP_PROXY"); proxy != "" {
+		if u, err := url.Parse(proxy); err != nil {
+			errs = append(errs, invalidSetting("AWS_HTTP_PROXY", "%w", err))
+		} else if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			errs = append(errs, invalidSetting("AWS_HTTP_PROXY", "must be an http, https or socks5 URL with a host"))
+		} else {
+			config.AWSHTTPProxy = proxy
+		}
+	}
+
+	if caKeys := getenv("SSH_CA_KEYS"); caKeys != "" {
+		if _, err := os.Stat(caKeys); err != nil {
+			errs = append(errs, invalidSetting("SSH_CA_KEYS", "%w", err))
+		}
+		config.SSHCAKeys = caKeys
+	}
+
+	if role := getenv("ASSUME_ROLE_ARN"); role != "" {
+		if _, err := resolveRoleARN(role, config.RequiredAccountID); err != nil {
+			errs = append(errs, invalidSetting("ASSUME_ROLE_ARN", "%w", err))
+		}
+		config.AssumeRoleARN = role
+	}
+
+	if duration := getenv("ASSUME_ROLE_DURATION"); duration != "" {
+		if d, err := time.ParseDuration(duration); err != nil {
+			errs = append(errs, invalidSetting("ASSUME_ROLE_DURATION", "%w", err))
+		} else if d < 15*time.Minute || d > 12*time.Hour {
+			errs = append(errs, invalidSetting("ASSUME_ROLE_DURATION", "must be between 15m and 12h"))
+		} else {
+			config.AssumeRoleDuration = d
+		}
+	}
+
+	if ttl := getenv("AUTH_CACHE_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil {
+			errs = append(errs, invalidSetting("AUTH_CACHE_TTL", "%w", err))
+		} else if d < 0 {
+			errs = append(errs, invalidSetting("AUTH_CACHE_TTL", "must not be negative"))
+		} else {
+			config.AuthCacheTTL = d
+		}
+	}
+
+	if size := getenv("AUTH_CACHE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err != nil {
+			errs = append(errs, invalidSetting("AUTH_CACHE_SIZE", "%w", err))
+		} else if n < 1 {
+			errs = append(errs, invalidSetting("AUTH_CACHE_SIZE", "must be at least 1"))
+		} else {
+			config.AuthCacheSize = n
+		}
+	}
+
+	if usersFile := getenv("USERS_FILE"); usersFile != "" {
+		if _, err := os.Stat(usersFile); err != nil {
+			errs = append(errs, invalidSetting("USERS_FILE", "%w", err))
+		}
+		config.UsersFile = usersFile
+	}
+
+	if secret := getenv("USERS_SECRET"); secret != "" {
+		if config.UsersFile != "" {
+			errs = append(errs, invalidSetting("USERS_SECRET", "cannot be combined with USERS_FILE"))
+		}
+		config.UsersSecret = secret
+	}
+
+	if refresh := getenv("USERS_SECRET_REFRESH"); refresh != "" {
+		if d, err := time.ParseDuration(refresh); err != nil {
+			errs = append(errs, invalidSetting("USERS_SECRET_REFRESH", "%w", err))
+		} else if d < time.Minute {
+			errs = append(errs, invalidSetting("USERS_SECRET_REFRESH", "must be at least 1m"))
+		} else {
+			config.UsersSecretRefresh = d
+		}
+	}
+
+	if principals := getenv("ALLOWED_PRINCIPALS"); principals != "" {
+		for _, principal := range strings.Split(principals, ",") {
+			principal = strings.TrimSpace(principal)
+			if principal == "" {
+				continue
+			}
+			if !strings.HasPrefix(principal, "arn:") {
+				errs = append(errs, invalidSetting("ALLOWED_PRINCIPALS", "%q is not an ARN pattern", principal))
+				continue
+			}
+			config.AllowedPrincipals = append(config.AllowedPrincipals, principal)
+		}
+	}
+
+	if verify := getenv("VERIFY_WRITE_ACCESS"); verify != "" {
+		if b, err := strconv.ParseBool(verify); err != nil {
+			errs = append(errs, invalidSetting("VERIFY_WRITE_ACCESS", "%w", err))
+		} else {
+			config.VerifyWriteAccess = b
+		}
+	}
+
+	if totpFile := getenv("TOTP_SECRETS_FILE"); totpFile != "" {
+		if _, err := os.Stat(totpFile); err != nil {
+			errs = append(errs, invalidSetting("TOTP_SECRETS_FILE", "%w", err))
+		}
+		config.TOTPSecretsFile = totpFile
+	}
+
+	if required := getenv("MFA_REQUIRED"); required != "" {
+		if b, err := strconv.ParseBool(required); err != nil {
+			errs = append(errs, invalidSetting("MFA_REQUIRED", "%w", err))
+		} else if b && config.TOTPSecretsFile == "" {
+			errs = append(errs, invalidSetting("MFA_REQUIRED", "requires TOTP_SECRETS_FILE"))
+		} else {
+			config.MFARequired = b
+		}
+	}
+
+	for name, field := range map[string]*int{
+		"AUTH_RATE_LIMIT":        &config.AuthRateLimit,
+		"AUTH_RATE_BURST":        &config.AuthRateBurst,
+		"AUTH_LOCKOUT_THRESHOLD": &config.AuthLockoutThreshold,
+	} {
+		if value := getenv(name); value != "" {
+			if n, err := strconv.Atoi(value); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			} else if n < 0 {
+				errs = append(errs, invalidSetting(name, "must not be negative"))
+			} else {
+				*field = n
+			}
+		}
+	}
+	if config.AuthRateLimit > 0 && config.AuthRateBurst < 1 {
+		errs = append(errs, invalidSetting("AUTH_RATE_BURST", "must be at least 1"))
+	}
+
+	if duration := getenv("AUTH_LOCKOUT_DURATION"); duration != "" {
+		if d, err := time.ParseDuration(duration); err != nil {
+			errs = append(errs, invalidSetting("AUTH_LOCKOUT_DURATION", "%w", err))
+		} else if d <= 0 {
+			errs = append(errs, invalidSetting("AUTH_LOCKOUT_DURATION", "must be positive"))
+		} else {
+			config.AuthLockoutDuration = d
+		}
+	}
+
+	if threshold := getenv("BAN_THRESHOLD"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err != nil {
+			errs = append(errs, invalidSetting("BAN_THRESHOLD", "%w", err))
+		} else if n < 0 {
+			errs = append(errs, invalidSetting("BAN_THRESHOLD", "must not be negative"))
+		} else {
+			config.BanThreshold = n
+		}
+	}
+
+	for name, field := range map[string]*time.Duration{
+		"BAN_FIND_TIME": &config.BanFindTime,
+		"BAN_DURATION":  &config.BanDuration,
+	} {
+		if value := getenv(name); value != "" {
+			if d, err := time.ParseDuration(value); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			} else if d <= 0 {
+				errs = append(errs, invalidSetting(name, "must be positive"))
+			} else {
+				*field = d
+			}
+		}
+	}
+
+	if geoIPDB := getenv("GEOIP_DB"); geoIPDB != "" {
+		if info, err := os.Stat(geoIPDB); err != nil {
+			errs = append(errs, invalidSetting("GEOIP_DB", "%w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, invalidSetting("GEOIP_DB", "%s is not a directory", geoIPDB))
+		}
+		config.GeoIPDB = geoIPDB
+	}
+
+	for name, field := range map[string]*[]string{
+		"GEOIP_ALLOW_COUNTRIES": &config.GeoIPAllowCountries,
+		"GEOIP_DENY_COUNTRIES":  &config.GeoIPDenyCountries,
+	} {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		if config.GeoIPDB == "" {
+			errs = append(errs, invalidSetting(name, "requires GEOIP_DB"))
+			continue
+		}
+		for _, country := range strings.Split(value, ",") {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if country == "" {
+				continue
+			}
+			if len(country) != 2 {
+				errs = append(errs, invalidSetting(name, "%q is not a two-letter country code", country))
+				continue
+			}
+			*field = append(*field, country)
+		}
+	}
+
+	if webhook := getenv("AUTH_WEBHOOK_URL"); webhook != "" {
+		if u, err := url.Parse(webhook); err != nil {
+			errs = append(errs, invalidSetting("AUTH_WEBHOOK_URL", "%w", err))
+		} else if u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+			errs = append(errs, invalidSetting("AUTH_WEBHOOK_URL", "must be an https URL (http only for localhost)"))
+		} else if config.UsersFile != "" || config.UsersSecret != "" {
+			errs = append(errs, invalidSetting("AUTH_WEBHOOK_URL", "cannot be combined with USERS_FILE or USERS_SECRET"))
+		} else {
+			config.AuthWebhookURL = webhook
+		}
+	}
+
+	if token := getenv("AUTH_WEBHOOK_TOKEN"); token != "" {
+		config.AuthWebhookToken = token
+	}
+
+	if timeout := getenv("AUTH_WEBHOOK_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err != nil {
+			errs = append(errs, invalidSetting("AUTH_WEBHOOK_TIMEOUT", "%w", err))
+		} else if d <= 0 {
+			errs = append(errs, invalidSetting("AUTH_WEBHOOK_TIMEOUT", "must be positive"))
+		} else {
+			config.AuthWebhookTimeout = d
+		}
+	}
+
+	if webhook := getenv("DELIVERY_WEBHOOK_URL"); webhook != "" {
+		if u, err := url.Parse(webhook); err != nil {
+			errs = append(errs, invalidSetting("DELIVERY_WEBHOOK_URL", "%w", err))
+		} else if u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+			errs = append(errs, invalidSetting("DELIVERY_WEBHOOK_URL", "must be an https URL (http only for localhost)"))
+		} else if config.StreamUploads || config.VerifyWriteAccess {
+			errs = append(errs, invalidSetting("DELIVERY_WEBHOOK_URL", "cannot be combined with STREAM_UPLOADS or VERIFY_WRITE_ACCESS"))
+		} else if len(config.UploadRoutes) > 0 || config.FailoverBucket.bucket != "" {
+			// files don't go to a bucket, so these would be ignored
+			errs = append(errs, invalidSetting("DELIVERY_WEBHOOK_URL", "cannot be combined with UPLOAD_ROUTES or FAILOVER_BUCKET"))
+		} else {
+			config.DeliveryWebhookURL = webhook
+		}
+	}
+
+	if secret := getenv("DELIVERY_WEBHOOK_SECRET"); secret != "" {
+		config.DeliveryWebhookSecret = secret
+	}
+
+	if store := getenv("KAFKA_STORE_S3"); store != "" {
+		if b, err := strconv.ParseBool(store); err != nil {
+			errs = append(errs, invalidSetting("KAFKA_STORE_S3", "%w", err))
+		} else {
+			config.KafkaStoreS3 = b
+		}
+	}
+
+	if brokers := getenv("KAFKA_BROKERS"); brokers != "" {
+		var list []string
+		for _, broker := range strings.Split(brokers, ",") {
+			broker = strings.TrimSpace(broker)
+			if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+				errs = append(errs, invalidSetting("KAFKA_BROKERS", "%q is not host:port", broker))
+				continue
+			}
+			list = append(list, broker)
+		}
+
+		if config.DeliveryWebhookURL != "" || config.StreamUploads {
+			errs = append(errs, invalidSetting("KAFKA_BROKERS", "cannot be combined with DELIVERY_WEBHOOK_URL or STREAM_UPLOADS"))
+		} else if !config.KafkaStoreS3 && (config.VerifyWriteAccess || len(config.UploadRoutes) > 0 || config.FailoverBucket.bucket != "") {
+			// files don't go to a bucket, so these would be ignored
+			errs = append(errs, invalidSetting("KAFKA_BROKERS", "cannot be combined with VERIFY_WRITE_ACCESS, UPLOAD_ROUTES or FAILOVER_BUCKET unless KAFKA_STORE_S3 is set"))
+		} else {
+			config.KafkaBrokers = list
+		}
+
+		if topic := getenv("KAFKA_TOPIC"); topic == "" {
+			errs = append(errs, missingSetting("KAFKA_TOPIC", "required with KAFKA_BROKERS"))
+		} else if !kafkaTopicPattern.MatchString(topic) || topic == "." || topic == ".." {
+			errs = append(errs, invalidSetting("KAFKA_TOPIC", "must be up to 249 letters, digits, '.', '_' and '-'"))
+		} else {
+			config.KafkaTopic = topic
+		}
+	}
+
+	if maxSize := getenv("KAFKA_MAX_MESSAGE_SIZE"); maxSize != "" {
+		if size, err := strconv.ParseInt(maxSize, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("KAFKA_MAX_MESSAGE_SIZE", "%w", err))
+		} else if size < 1 {
+			errs = append(errs, invalidSetting("KAFKA_MAX_MESSAGE_SIZE", "must be at least 1"))
+		} else {
+			config.KafkaMaxMessageSize = size
+		}
+	}
+
+	if useTLS := getenv("KAFKA_TLS"); useTLS != "" {
+		if b, err := strconv.ParseBool(useTLS); err != nil {
+			errs = append(errs, invalidSetting("KAFKA_TLS", "%w", err))
+		} else {
+			config.KafkaTLS = b
+		}
+	}
+
+	if username := getenv("KAFKA_SASL_USERNAME"); username != "" {
+		if getenv("KAFKA_SASL_PASSWORD") == "" {
+			errs = append(errs, missingSetting("KAFKA_SASL_PASSWORD", "required with KAFKA_SASL_USERNAME"))
+		} else if !config.KafkaTLS {
+			errs = append(errs, invalidSetting("KAFKA_SASL_USERNAME", "requires KAFKA_TLS, as SASL/PLAIN sends the password in the clear"))
+		} else {
+			config.KafkaSASLUsername = username
+			config.KafkaSASLPassword = getenv("KAFKA_SASL_PASSWORD")
+		}
+	}
+
+	if ldapURL := getenv("LDAP_URL"); ldapURL != "" {
+		if u, err := url.Parse(ldapURL); err != nil {
+			errs = append(errs, invalidSetting("LDAP_URL", "%w", err))
+		} else if u.Host == "" || (u.Scheme != "ldaps" && u.Scheme != "ldap") {
+			errs = append(errs, invalidSetting("LDAP_URL", "must be an ldaps:// or ldap:// URL"))
+		} else if config.UsersFile != "" || config.UsersSecret != "" || config.AuthWebhookURL != "" {
+			errs = append(errs, invalidSetting("LDAP_URL", "cannot be combined with USERS_FILE, USERS_SECRET or AUTH_WEBHOOK_URL"))
+		} else {
+			config.LDAPURL = ldapURL
+		}
+	}
+
+	if bindDN := getenv("LDAP_BIND_DN"); bindDN != "" {
+		if !strings.Contains(bindDN, "{user}") {
+			errs = append(errs, invalidSetting("LDAP_BIND_DN", "must contain {user}"))
+		}
+		config.LDAPBindDN = bindDN
+	}
+	if config.LDAPURL != "" && config.LDAPBindDN == "" {
+		errs = append(errs, missingSetting("LDAP_BIND_DN", "is required with LDAP_URL"))
+	}
+
+	if baseDN := getenv("LDAP_BASE_DN"); baseDN != "" {
+		config.LDAPBaseDN = baseDN
+	}
+
+	if attribute := getenv("LDAP_USER_ATTRIBUTE"); attribute != "" {
+		config.LDAPUserAttribute = attribute
+	}
+
+	if groups := getenv("LDAP_GROUP_PREFIXES"); groups != "" {
+		if g, err := parseLDAPGroups(groups); err != nil {
+			errs = append(errs, invalidSetting("LDAP_GROUP_PREFIXES", "%w", err))
+		} else if config.LDAPURL == "" || config.LDAPBaseDN == "" {
+			errs = append(errs, invalidSetting("LDAP_GROUP_PREFIXES", "requires LDAP_URL and LDAP_BASE_DN"))
+		} else {
+			config.LDAPGroupPrefixes = g
+		}
+	}
+
+	if timeout := getenv("LDAP_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err != nil {
+			errs = append(errs, invalidSetting("LDAP_TIMEOUT", "%w", err))
+		} else if d <= 0 {
+			errs = append(errs, invalidSetting("LDAP_TIMEOUT", "must be positive"))
+		} else {
+			config.LDAPTimeout = d
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"JWT_ISSUER":   &config.JWTIssuer,
+		"JWT_JWKS_URL": &config.JWTJWKSURL,
+	} {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil {
+			errs = append(errs, invalidSetting(name, "%w", err))
+		} else if u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+			errs = append(errs, invalidSetting(name, "must be an https URL (http only for localhost)"))
+		}
+		*field = value
+	}
+	if config.JWTJWKSURL != "" && config.JWTIssuer == "" {
+		errs = append(errs, invalidSetting("JWT_JWKS_URL", "requires JWT_ISSUER"))
+	}
+
+	if audience := getenv("JWT_AUDIENCE"); audience != "" {
+		config.JWTAudience = audience
+	}
+
+	if vaultAddr := getenv("VAULT_ADDR"); vaultAddr != "" {
+		if u, err := url.Parse(vaultAddr); err != nil {
+			errs = append(errs, invalidSetting("VAULT_ADDR", "%w", err))
+		} else if u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+			errs = append(errs, invalidSetting("VAULT_ADDR", "must be an https URL (http only for localhost)"))
+		} else {
+			config.VaultAddr = vaultAddr
+		}
+	}
+
+	if mount := getenv("VAULT_AWS_MOUNT"); mount != "" {
+		config.VaultAWSMount = strings.Trim(mount, "/")
+	}
+
+	if role := getenv("VAULT_AWS_ROLE"); role != "" {
+		if config.VaultAddr == "" {
+			errs = append(errs, invalidSetting("VAULT_AWS_ROLE", "requires VAULT_ADDR"))
+		}
+		config.VaultAWSRole = role
+	}
+
+	if table := getenv("USER_CONFIG_TABLE"); table != "" {
+		config.UserConfigTable = table
+	}
+
+	if key := getenv("USER_CONFIG_KEY"); key != "" {
+		config.UserConfigKey = key
+	}
+
+	if tag := getenv("ALLOWED_IPS_TAG"); tag != "" {
+		config.AllowedIPsTag = tag
+	}
+
+	if prefix := getenv("POLICY_TAG_PREFIX"); prefix != "" {
+		config.PolicyTagPrefix = prefix
+	}
+
+	// Without the account check something else has to decide who may log in.
+	if config.AllowAnyAccount && len(config.AllowedPrincipals) == 0 && config.PolicyTagPrefix == "" {
+		errs = append(errs, invalidSetting("ALLOW_ANY_ACCOUNT", "requires ALLOWED_PRINCIPALS or POLICY_TAG_PREFIX"))
+	}
+
+	if target := getenv("SECURITY_FINDINGS"); target != "" {
+		switch strings.ToLower(target) {
+		case findingsSecurityHub, findingsEventBridge:
+			config.SecurityFindings = strings.ToLower(target)
+		default:
+			errs = append(errs, invalidSetting("SECURITY_FINDINGS", "must be securityhub or eventbridge"))
+		}
+	}
+
+	if bus := getenv("SECURITY_FINDINGS_BUS"); bus != "" {
+		if config.SecurityFindings != findingsEventBridge {
+			errs = append(errs, invalidSetting("SECURITY_FINDINGS_BUS", "requires SECURITY_FINDINGS=eventbridge"))
+		}
+		config.SecurityFindingsBus = bus
+	}
+
+	if topic := getenv("UPLOAD_FAILURE_TOPIC"); topic != "" {
+		if parsed, err := arn.Parse(topic); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_FAILURE_TOPIC", "%w", err))
+		} else if parsed.Service != "sns" {
+			errs = append(errs, invalidSetting("UPLOAD_FAILURE_TOPIC", "%q is not an SNS topic ARN", topic))
+		} else {
+			config.UploadFailureTopic = topic
+		}
+	}
+
+	if queueURL := getenv("UPLOAD_QUEUE_URL"); queueURL != "" {
+		if u, err := url.Parse(queueURL); err != nil {
+			errs = append(errs, invalidSetting("UPLOAD_QUEUE_URL", "%w", err))
+		} else if (u.Scheme != "https" && u.Scheme != "http") || strings.Count(strings.Trim(u.Path, "/"), "/") != 1 {
+			errs = append(errs, invalidSetting("UPLOAD_QUEUE_URL", "%q is not an SQS queue URL", queueURL))
+		} else {
+			config.UploadQueueURL = queueURL
+		}
+	}
+
+	if bus := getenv("EVENTBRIDGE_BUS"); bus != "" {
+		config.EventBridgeBus = bus
+	}
+
+	if bucket := getenv("AUDIT_BUCKET"); bucket != "" {
+		if err := validateBucketName(bucket); err != nil {
+			errs = append(errs, invalidSetting("AUDIT_BUCKET", "%w", err))
+		}
+		config.AuditBucket = bucket
+	}
+
+	if prefix := getenv("AUDIT_PREFIX"); prefix != "" {
+		if cleaned, err := normalizeKeyPrefix(prefix); err != nil {
+			errs = append(errs, invalidSetting("AUDIT_PREFIX", "%w", err))
+		} else {
+			config.AuditPrefix = cleaned
+		}
+	}
+
+	if interval := getenv("AUDIT_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil {
+			errs = append(errs, invalidSetting("AUDIT_INTERVAL", "%w", err))
+		} else if d < time.Second {
+			errs = append(errs, invalidSetting("AUDIT_INTERVAL", "must be at least 1s"))
+		} else {
+			config.AuditInterval = d
+		}
+	}
+
+	if retention := getenv("AUDIT_RETENTION"); retention != "" {
+		if d, err := time.ParseDuration(retention); err != nil {
+			errs = append(errs, invalidSetting("AUDIT_RETENTION", "%w", err))
+		} else if d < 0 {
+			errs = append(errs, invalidSetting("AUDIT_RETENTION", "must not be negative"))
+		} else {
+			config.AuditRetention = d
+		}
+	}
+
+	if user := getenv("GUEST_USER"); user != "" {
+		if !principalPattern.MatchString(user) {
+			errs = append(errs, invalidSetting("GUEST_USER", "%q is not a valid user name", user))
+		}
+		config.GuestUser = user
+	}
+
+	if password := getenv("GUEST_PASSWORD"); password != "" {
+		if config.GuestUser == "" {
+			errs = append(errs, invalidSetting("GUEST_PASSWORD", "requires GUEST_USER"))
+		}
+		config.GuestPassword = password
+	}
+
+	if prefix := getenv("GUEST_PREFIX"); prefix != "" {
+		cleaned := path.Clean(strings.Trim(prefix, "/"))
+		if cleaned == "." || strings.HasPrefix(cleaned, "..") {
+			errs = append(errs, invalidSetting("GUEST_PREFIX", "%q", prefix))
+		}
+		config.GuestPrefix = cleaned
+	}
+
+	if quota := getenv("GUEST_QUOTA"); quota != "" {
+		if q, err := strconv.ParseInt(quota, 10, 64); err != nil {
+			errs = append(errs, invalidSetting("GUEST_QUOTA", "%w", err))
+		} else if q < 0 {
+			errs = append(errs, invalidSetting("GUEST_QUOTA", "must not be negative"))
+		} else {
+			config.GuestQuota = q
+		}
+	}
+
+	if secret := getenv("HOST_KEY_SECRET"); secret != "" {
+		config.HostKeySecret = secret
+	}
+
+	if parameter := getenv("HOST_KEY_PARAMETER"); parameter != "" {
+		if config.HostKeySecret != "" {
+			errs = append(errs, invalidSetting("HOST_KEY_PARAMETER", "can't be combined with HOST_KEY_SECRET"))
+		}
+		config.HostKeyParameter = parameter
+	}
+
+	if rollover := getenv("HOST_KEY_ROLLOVER"); rollover != "" {
+		if d, err := time.ParseDuration(rollover); err != nil {
+			errs = append(errs, invalidSetting("HOST_KEY_ROLLOVER", "%w", err))
+		} else if d < 0 {
+			errs = append(errs, invalidSetting("HOST_KEY_ROLLOVER", "must not be negative"))
+		} else {
+			config.HostKeyRollover = d
+		}
+	}
+
+	if parameterPath := getenv("CONFIG_PARAMETER_PATH"); parameterPath != "" {
+		if !strings.HasPrefix(parameterPath, "/") {
+			errs = append(errs, invalidSetting("CONFIG_PARAMETER_PATH", "%q must start with /", parameterPath))
+		}
+		config.ConfigParameterPath = parameterPath
+	}
+
+	if refresh := getenv("CONFIG_PARAMETER_REFRESH"); refresh != "" {
+		if d, err := time.ParseDuration(refresh); err != nil {
+			errs = append(errs, invalidSetting("CONFIG_PARAMETER_REFRESH", "%w", err))
+		} else if d < time.Minute {
+			errs = append(errs, invalidSetting("CONFIG_PARAMETER_REFRESH", "must be at least 1m"))
+		} else {
+			config.ConfigParameterRefresh = d
+		}
+	}
+
+	if profile := getenv("APPCONFIG_PROFILE"); profile != "" {
+		if _, _, _, err := parseAppConfigProfile(profile); err != nil {
+			errs = append(errs, invalidSetting("APPCONFIG_PROFILE", "%w", err))
+		}
+		config.AppConfigProfile = profile
+	}
+
+	if refresh := getenv("APPCONFIG_REFRESH"); refresh != "" {
+		if d, err := time.ParseDuration(refresh); err != nil {
+			errs = append(errs, invalidSetting("APPCONFIG_REFRESH", "%w", err))
+		} else if d < 15*time.Second {
+			errs = append(errs, invalidSetting("APPCONFIG_REFRESH", "must be at least 15s"))
+		} else {
+			config.AppConfigRefresh = d
+		}
+	}
+
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	for name, setting := range map[string]struct {
+		field               *[]string
+		supported, insecure []string
+	}{
+		"SSH_CIPHERS":        {&config.SSHCiphers, supported.Ciphers, insecure.Ciphers},
+		"SSH_MACS":           {&config.SSHMACs, supported.MACs, insecure.MACs},
+		"SSH_KEX_ALGORITHMS": {&config.SSHKeyExchanges, supported.KeyExchanges, insecure.KeyExchanges},
+	} {
+		if value := getenv(name); value != "" {
+			if algorithms, err := parseSSHAlgorithms(value, setting.supported, setting.insecure); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			} else {
+				*setting.field = algorithms
+			}
+		}
+	}
+
+	if banner := getenv("SSH_BANNER"); banner != "" {
+		config.SSHBanner = banner
+	}
+
+	if file := getenv("SSH_BANNER_FILE"); file != "" {
+		if config.SSHBanner != "" {
+			errs = append(errs, invalidSetting("SSH_BANNER_FILE", "can't be combined with SSH_BANNER"))
+		}
+		config.SSHBannerFile = file
+	}
+
+	if version := getenv("SSH_SERVER_VERSION"); version != "" {
+		if v, err := parseSSHServerVersion(version); err != nil {
+			errs = append(errs, invalidSetting("SSH_SERVER_VERSION", "%w", err))
+		} else {
+			config.SSHServerVersion = v
+		}
+	}
+
+	for name, field := range map[string]**regexp.Regexp{
+		"CLIENT_VERSION_ALLOW": &config.ClientVersionAllow,
+		"CLIENT_VERSION_DENY":  &config.ClientVersionDeny,
+	} {
+		if expr := getenv(name); expr != "" {
+			if re, err := regexp.Compile(expr); err != nil {
+				errs = append(errs, invalidSetting(name, "%w", err))
+			} else {
+				*field = re
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return config, nil
+}
+
+var (
+	accountIDPattern  = regexp.MustCompile(`^[0-9]{12}$`)
+	bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+	kafkaTopicPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+)
+
+// validateBucketName applies the S3 rules for general purpose bucket names.
+func validateBucketName(name string) error {
+	switch {
+	case len(name) < 3 || len(name) > 63:
+		return fmt.Errorf("%q must be 3 to 63 characters long", name)
+	case !bucketNamePattern.MatchString(name):
+		return fmt.Errorf("%q must consist of lowercase letters, digits, dots and hyphens, and begin and end with a letter or digit", name)
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("%q must not contain two adjacent dots", name)
+	case net.ParseIP(name) != nil:
+		return fmt.Errorf("%q must not be formatted as an IP address", name)
+	case strings.HasPrefix(name, "xn--") || strings.HasPrefix(name, "sthree-"):
+		return fmt.Errorf("%q starts with a reserved prefix", name)
+	case strings.HasSuffix(name, "-s3alias") || strings.HasSuffix(name, "--ol-s3"):
+		return fmt.Errorf("%q ends with a reserved suffix", name)
+	}
+	return nil
+}
+
+// normalizeKeyPrefix removes leading and trailing slashes and empty or "."
+// segments from an S3 key prefix, so "/uploads//sftp/" becomes
+// "uploads/sftp". Prefixes that climb out with ".." are rejected.
+func normalizeKeyPrefix(prefix string) (string, error) {
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%q must not contain ..", prefix)
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+prefix), "/"), nil
+}
+
+// parseSSHServerVersion checks an SSH identification string as described in
+// RFC 4253 section 4.2. The "SSH-2.0-" prefix is added if it is missing, so
+// "OpenSSH_9.6" is accepted too.
+func parseSSHServerVersion(version string) (string, error) {
+	if !strings.HasPrefix(version, "SSH-") {
+		version = "SSH-2.0-" + version
+	} else if !strings.HasPrefix(version, "SSH-2.0-") {
+		return "", fmt.Errorf("must start with SSH-2.0-")
+	}
+	if len(version) > 253 {
+		return "", fmt.Errorf("longer than 253 characters")
+	}
+
+	software, _, _ := strings.Cut(strings.TrimPrefix(version, "SSH-2.0-"), " ")
+	if software == "" || strings.Contains(software, "-") {
+		return "", fmt.Errorf("software version must not be empty or contain '-'")
+	}
+	for _, c := range version {
+		if c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("must only contain printable ASCII characters")
+		}
+	}
+	return version, nil
+}
+
+// isLoopbackHost reports whether host names the local machine, where plain
+// HTTP doesn't expose secrets on the network.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,16 +12,16 @@ import (
 func TestLoadConfig_RequiredFields(t *testing.T) {
 	// Clear all environment variables
 	clearEnv()
-	
-	// Test missing S3_BUCKET
+
+	// Test missing S3_BUCKET and AWS_ACCOUNT_ID, reported together
 	_, err := LoadConfig()
 	if err == nil {
 		t.Error("Expected error when S3_BUCKET is missing")
 	}
-	if err.Error() != "S3_BUCKET environment variable is required" {
-		t.Errorf("Expected S3_BUCKET error, got: %v", err)
+	if err.Error() != "S3_BUCKET environment variable is required\nAWS_ACCOUNT_ID environment variable is required" {
+		t.Errorf("Expected S3_BUCKET and AWS_ACCOUNT_ID errors, got: %v", err)
 	}
-	
+
 	// Set S3_BUCKET but missing AWS_ACCOUNT_ID
 	os.Setenv("S3_BUCKET", "test-bucket")
 	_, err = LoadConfig()
@@ -35,12 +38,12 @@ func TestLoadConfig_Defaults(t *testing.T) {
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
-	
+
 	config, err := LoadConfig()
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
-	
+
 	// Test default values
 	if config.ServerPort != 2222 {
 		t.Errorf("Expected ServerPort 2222, got %d", config.ServerPort)
@@ -91,12 +94,12 @@ func TestLoadConfig_CustomValues(t *testing.T) {
 	os.Setenv("READ_TIMEOUT", "45s")
 	os.Setenv("WRITE_TIMEOUT", "90s")
 	os.Setenv("MAX_CONNECTIONS", "50")
-	
+
 	config, err := LoadConfig()
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
-	
+
 	// Test custom values
 	if config.ServerPort != 2223 {
 		t.Errorf("Expected ServerPort 2223, got %d", config.ServerPort)
@@ -139,62 +142,62 @@ func TestLoadConfig_InvalidValues(t *testing.T) {
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("SFTP_PORT", "invalid")
-	
+
 	_, err := LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid SFTP_PORT")
 	}
-	
+
 	// Test invalid MAX_FILE_SIZE
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("MAX_FILE_SIZE", "invalid")
-	
+
 	_, err = LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid MAX_FILE_SIZE")
 	}
-	
+
 	// Test invalid CONNECTION_TIMEOUT
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("CONNECTION_TIMEOUT", "invalid")
-	
+
 	_, err = LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid CONNECTION_TIMEOUT")
 	}
-	
+
 	// Test invalid READ_TIMEOUT
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("READ_TIMEOUT", "invalid")
-	
+
 	_, err = LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid READ_TIMEOUT")
 	}
-	
+
 	// Test invalid WRITE_TIMEOUT
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("WRITE_TIMEOUT", "invalid")
-	
+
 	_, err = LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid WRITE_TIMEOUT")
 	}
-	
+
 	// Test invalid MAX_CONNECTIONS
 	clearEnv()
 	os.Setenv("S3_BUCKET", "test-bucket")
 	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
 	os.Setenv("MAX_CONNECTIONS", "invalid")
-	
+
 	_, err = LoadConfig()
 	if err == nil {
 		t.Error("Expected error for invalid MAX_CONNECTIONS")
@@ -210,12 +213,12 @@ func TestLoadConfig_EmptyValues(t *testing.T) {
 	os.Setenv("VIRTUAL_DIR", "")
 	os.Setenv("S3_BUCKET_PREFIX", "")
 	os.Setenv("AWS_REGION", "")
-	
+
 	config, err := LoadConfig()
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
-	
+
 	// Should use defaults for empty values
 	if config.ServerPort != 2222 {
 		t.Errorf("Expected default ServerPort 2222, got %d", config.ServerPort)
@@ -225,23 +228,2344 @@ func TestLoadConfig_EmptyValues(t *testing.T) {
 	}
 }
 
-// Helper function to clear relevant environment variables
-func clearEnv() {
-	envVars := []string{
-		"SFTP_PORT",
-		"VIRTUAL_DIR",
-		"MAX_FILE_SIZE",
-		"S3_BUCKET",
-		"S3_BUCKET_PREFIX",
-		"AWS_REGION",
-		"AWS_ACCOUNT_ID",
-		"CONNECTION_TIMEOUT",
-		"READ_TIMEOUT",
-		"WRITE_TIMEOUT",
-		"MAX_CONNECTIONS",
+func TestLoadConfig_KeyTimestamp(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
 	}
-	
-	for _, env := range envVars {
-		os.Unsetenv(env)
+	if config.KeyTimestampTZ != time.UTC {
+		t.Errorf("Expected default KeyTimestampTZ UTC, got %v", config.KeyTimestampTZ)
+	}
+	if config.KeyTimestampTolerance != 0 {
+		t.Errorf("Expected default KeyTimestampTolerance 0, got %v", config.KeyTimestampTolerance)
+	}
+
+	os.Setenv("KEY_TIMESTAMP_TZ", "America/New_York")
+	os.Setenv("KEY_TIMESTAMP_TOLERANCE", "5m")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.KeyTimestampTZ.String() != "America/New_York" {
+		t.Errorf("Expected KeyTimestampTZ 'America/New_York', got %v", config.KeyTimestampTZ)
+	}
+	if config.KeyTimestampTolerance != 5*time.Minute {
+		t.Errorf("Expected KeyTimestampTolerance 5m, got %v", config.KeyTimestampTolerance)
+	}
+
+	os.Setenv("KEY_TIMESTAMP_TZ", "Not/AZone")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid KEY_TIMESTAMP_TZ")
+	}
+
+	os.Setenv("KEY_TIMESTAMP_TZ", "UTC")
+	os.Setenv("KEY_TIMESTAMP_TOLERANCE", "-1m")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative KEY_TIMESTAMP_TOLERANCE")
+	}
+}
+
+func TestLoadConfig_KeyDateLayout(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.KeyDateLayout != keyDateDay {
+		t.Errorf("Expected default KeyDateLayout %q, got %q", keyDateDay, config.KeyDateLayout)
+	}
+
+	os.Setenv("KEY_DATE_LAYOUT", "Hourly")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.KeyDateLayout != keyDateHourly {
+		t.Errorf("Expected KeyDateLayout %q, got %q", keyDateHourly, config.KeyDateLayout)
+	}
+
+	os.Setenv("KEY_DATE_LAYOUT", "weekly")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid KEY_DATE_LAYOUT")
+	}
+}
+
+func TestLoadConfig_StreamUploads(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.StreamUploads {
+		t.Error("Expected StreamUploads to default to false")
+	}
+	if config.MultipartPartSize != 8*1024*1024 {
+		t.Errorf("Expected MultipartPartSize 8388608, got %d", config.MultipartPartSize)
+	}
+
+	os.Setenv("STREAM_UPLOADS", "true")
+	os.Setenv("MULTIPART_PART_SIZE", "16777216")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.StreamUploads {
+		t.Error("Expected StreamUploads true")
+	}
+	if config.MultipartPartSize != 16*1024*1024 {
+		t.Errorf("Expected MultipartPartSize 16777216, got %d", config.MultipartPartSize)
+	}
+
+	os.Setenv("MULTIPART_PART_SIZE", "1024")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for MULTIPART_PART_SIZE below the S3 minimum")
+	}
+
+	os.Setenv("MULTIPART_PART_SIZE", "")
+	os.Setenv("STREAM_UPLOADS", "maybe")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid STREAM_UPLOADS")
+	}
+}
+
+func TestLoadConfig_UploadRetry(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UploadRetryAttempts != 3 {
+		t.Errorf("Expected UploadRetryAttempts 3, got %d", config.UploadRetryAttempts)
+	}
+	if config.UploadRetryBaseDelay != time.Second {
+		t.Errorf("Expected UploadRetryBaseDelay 1s, got %v", config.UploadRetryBaseDelay)
+	}
+	if config.UploadRetryJitter != 0.2 {
+		t.Errorf("Expected UploadRetryJitter 0.2, got %v", config.UploadRetryJitter)
+	}
+
+	os.Setenv("UPLOAD_RETRY_ATTEMPTS", "5")
+	os.Setenv("UPLOAD_RETRY_BASE_DELAY", "250ms")
+	os.Setenv("UPLOAD_RETRY_JITTER", "0")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UploadRetryAttempts != 5 {
+		t.Errorf("Expected UploadRetryAttempts 5, got %d", config.UploadRetryAttempts)
+	}
+	if config.UploadRetryBaseDelay != 250*time.Millisecond {
+		t.Errorf("Expected UploadRetryBaseDelay 250ms, got %v", config.UploadRetryBaseDelay)
+	}
+	if config.UploadRetryJitter != 0 {
+		t.Errorf("Expected UploadRetryJitter 0, got %v", config.UploadRetryJitter)
+	}
+
+	for env, value := range map[string]string{
+		"UPLOAD_RETRY_ATTEMPTS":   "0",
+		"UPLOAD_RETRY_BASE_DELAY": "soon",
+		"UPLOAD_RETRY_JITTER":     "1.5",
+	} {
+		clearEnv()
+		os.Setenv("S3_BUCKET", "test-bucket")
+		os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+		os.Setenv(env, value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for %s=%s", env, value)
+		}
+	}
+}
+
+func TestLoadConfig_UploadChecksum(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    string
+		expectError bool
+	}{
+		{value: "", expected: ""},
+		{value: "sha256", expected: "SHA256"},
+		{value: "CRC32", expected: "CRC32"},
+		{value: "none", expected: ""},
+		{value: "md5", expectError: true},
+	}
+
+	for _, tt := range tests {
+		clearEnv()
+		os.Setenv("S3_BUCKET", "test-bucket")
+		os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+		os.Setenv("UPLOAD_CHECKSUM", tt.value)
+
+		config, err := LoadConfig()
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("Expected error for UPLOAD_CHECKSUM=%q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected no error for UPLOAD_CHECKSUM=%q, got: %v", tt.value, err)
+		}
+		if config.UploadChecksum != tt.expected {
+			t.Errorf("UPLOAD_CHECKSUM=%q: expected UploadChecksum %q, got %q", tt.value, tt.expected, config.UploadChecksum)
+		}
+	}
+}
+
+func TestLoadConfig_S3StorageClass(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3StorageClass != "" {
+		t.Errorf("Expected empty S3StorageClass, got '%s'", config.S3StorageClass)
+	}
+
+	os.Setenv("S3_STORAGE_CLASS", "INTELLIGENT_TIERING")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3StorageClass != "INTELLIGENT_TIERING" {
+		t.Errorf("Expected S3StorageClass 'INTELLIGENT_TIERING', got '%s'", config.S3StorageClass)
+	}
+
+	os.Setenv("S3_STORAGE_CLASS", "CHEAP")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for unknown S3_STORAGE_CLASS")
+	}
+}
+
+func TestLoadConfig_S3SSE(t *testing.T) {
+	keyARN := "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+	tests := []struct {
+		name          string
+		sse           string
+		kmsKeyID      string
+		expectedSSE   string
+		expectedKeyID string
+		expectError   bool
+	}{
+		{name: "disabled by default"},
+		{name: "SSE-S3", sse: "AES256", expectedSSE: "AES256"},
+		{name: "SSE-KMS with AWS managed key", sse: "aws:kms", expectedSSE: "aws:kms"},
+		{name: "KMS key implies SSE-KMS", kmsKeyID: keyARN, expectedSSE: "aws:kms", expectedKeyID: keyARN},
+		{name: "DSSE-KMS with key", sse: "aws:kms:dsse", kmsKeyID: keyARN, expectedSSE: "aws:kms:dsse", expectedKeyID: keyARN},
+		{name: "KMS key with AES256", sse: "AES256", kmsKeyID: keyARN, expectError: true},
+		{name: "unknown algorithm", sse: "rot13", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv()
+			os.Setenv("S3_BUCKET", "test-bucket")
+			os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+			os.Setenv("S3_SSE", tt.sse)
+			os.Setenv("S3_SSE_KMS_KEY_ID", tt.kmsKeyID)
+
+			config, err := LoadConfig()
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if config.S3SSE != tt.expectedSSE {
+				t.Errorf("Expected S3SSE '%s', got '%s'", tt.expectedSSE, config.S3SSE)
+			}
+			if config.S3SSEKMSKeyID != tt.expectedKeyID {
+				t.Errorf("Expected S3SSEKMSKeyID '%s', got '%s'", tt.expectedKeyID, config.S3SSEKMSKeyID)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_S3Endpoint(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("S3_ENDPOINT_URL", "https://minio.internal:9000")
+	os.Setenv("S3_INSECURE_SKIP_VERIFY", "true")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3EndpointURL != "https://minio.internal:9000" {
+		t.Errorf("Expected S3EndpointURL 'https://minio.internal:9000', got '%s'", config.S3EndpointURL)
+	}
+	if !config.S3InsecureSkipVerify {
+		t.Error("Expected S3InsecureSkipVerify true")
+	}
+
+	for _, endpoint := range []string{"minio.internal:9000", "ftp://minio.internal", "http://"} {
+		os.Setenv("S3_ENDPOINT_URL", endpoint)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for S3_ENDPOINT_URL=%q", endpoint)
+		}
+	}
+
+	os.Setenv("S3_ENDPOINT_URL", "")
+	os.Setenv("S3_INSECURE_SKIP_VERIFY", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid S3_INSECURE_SKIP_VERIFY")
+	}
+}
+
+func TestLoadConfig_S3ForcePathStyle(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3ForcePathStyle {
+		t.Error("Expected S3ForcePathStyle to default to false")
+	}
+
+	os.Setenv("S3_FORCE_PATH_STYLE", "true")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.S3ForcePathStyle {
+		t.Error("Expected S3ForcePathStyle true")
+	}
+
+	os.Setenv("S3_FORCE_PATH_STYLE", "path")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid S3_FORCE_PATH_STYLE")
+	}
+}
+
+func TestLoadConfig_S3KeyTemplate(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("S3_KEY_TEMPLATE", "{prefix}/{account_id}/{yyyy}/{mm}/{dd}/{filename}")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3KeyTemplate != "{prefix}/{account_id}/{yyyy}/{mm}/{dd}/{filename}" {
+		t.Errorf("Expected S3KeyTemplate to be set, got '%s'", config.S3KeyTemplate)
+	}
+
+	os.Setenv("S3_KEY_TEMPLATE", "{prefix}/{bucket}/{filename}")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for S3_KEY_TEMPLATE with unknown variable")
+	}
+}
+
+func TestLoadConfig_S3KeyCollision(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3KeyCollision != "overwrite" {
+		t.Errorf("Expected S3KeyCollision to default to 'overwrite', got '%s'", config.S3KeyCollision)
+	}
+
+	os.Setenv("S3_KEY_COLLISION", "Uniquify")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3KeyCollision != "uniquify" {
+		t.Errorf("Expected S3KeyCollision to be 'uniquify', got '%s'", config.S3KeyCollision)
+	}
+
+	os.Setenv("S3_KEY_COLLISION", "rename")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid S3_KEY_COLLISION")
+	}
+}
+
+func TestLoadConfig_NamespacedEnv(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("S3_BUCKET", "legacy-bucket")
+	os.Setenv("SFTPGW_S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SFTPGW_PORT", "2223")
+	os.Setenv("SFTPGW_AWS_REGION", "eu-west-1")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3Bucket != "test-bucket" {
+		t.Errorf("Expected SFTPGW_S3_BUCKET to win over S3_BUCKET, got '%s'", config.S3Bucket)
+	}
+	if config.ServerPort != 2223 || config.S3Region != "eu-west-1" || config.RequiredAccountID != "123456789012" {
+		t.Errorf("Expected port 2223, region eu-west-1 and account 123456789012, got %d, '%s' and '%s'", config.ServerPort, config.S3Region, config.RequiredAccountID)
+	}
+
+	os.Setenv("SFTPGW_MAX_FILE_SIZE", "lots")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid MAX_FILE_SIZE") {
+		t.Errorf("Expected error for SFTPGW_MAX_FILE_SIZE, got: %v", err)
+	}
+}
+
+func TestLoadConfig_UploadRoutes(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("UPLOAD_ROUTES", "user=acme-*,bucket=acme-ingest; dir=/invoices/,prefix=finance")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(config.UploadRoutes) != 2 || config.UploadRoutes[0].bucket != "acme-ingest" || config.UploadRoutes[1].dir != "invoices" {
+		t.Errorf("Expected two routes, got %+v", config.UploadRoutes)
+	}
+
+	os.Setenv("UPLOAD_ROUTES", "bucket=acme-ingest")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for UPLOAD_ROUTES without a condition")
+	}
+}
+
+func TestLoadConfig_FailoverBucket(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("FAILOVER_BUCKET", "test-bucket-dr@us-west-2")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
 	}
-}
\ No newline at end of file
+	if config.FailoverBucket != (regionalBucket{bucket: "test-bucket-dr", region: "us-west-2"}) {
+		t.Errorf("Expected failover to test-bucket-dr in us-west-2, got %+v", config.FailoverBucket)
+	}
+
+	os.Setenv("FAILOVER_BUCKET", "test-bucket-dr@mars")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for FAILOVER_BUCKET with an invalid region")
+	}
+}
+
+func TestLoadConfig_ObjectMetadata(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("OBJECT_METADATA", "Environment=production, partner={partner}")
+	os.Setenv("PARTNER_ID_PATTERN", "^([a-z]+)-")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(config.ObjectMetadata) != 2 || config.ObjectMetadata[0] != (metadataEntry{"environment", "production"}) {
+		t.Errorf("Expected two metadata entries, got %+v", config.ObjectMetadata)
+	}
+	if config.PartnerIDPattern == nil {
+		t.Error("Expected PartnerIDPattern to be set")
+	}
+
+	os.Setenv("OBJECT_METADATA", "client-ip=1.2.3.4")
+	os.Setenv("PARTNER_ID_PATTERN", "([a-z")
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "OBJECT_METADATA") || !strings.Contains(err.Error(), "PARTNER_ID_PATTERN") {
+		t.Errorf("Expected errors for OBJECT_METADATA and PARTNER_ID_PATTERN, got: %v", err)
+	}
+}
+
+func TestLoadConfig_TempFileSuffixes(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("TEMP_FILE_SUFFIXES", ".filepart, .part,")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(config.TempFileSuffixes) != 2 || config.TempFileSuffixes[0] != ".filepart" || config.TempFileSuffixes[1] != ".part" {
+		t.Errorf("Expected TempFileSuffixes [.filepart .part], got %v", config.TempFileSuffixes)
+	}
+
+	os.Setenv("TEMP_FILE_SUFFIXES", "part")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for TEMP_FILE_SUFFIXES without a leading dot")
+	}
+}
+
+func TestLoadConfig_Extensions(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ALLOWED_EXTENSIONS", "csv, .PGP,")
+	os.Setenv("DENIED_EXTENSIONS", ".exe,bat")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !slices.Equal(config.AllowedExtensions, []string{".csv", ".pgp"}) || !slices.Equal(config.DeniedExtensions, []string{".exe", ".bat"}) {
+		t.Errorf("Expected [.csv .pgp] allowed and [.exe .bat] denied, got %v and %v", config.AllowedExtensions, config.DeniedExtensions)
+	}
+
+	os.Setenv("ALLOWED_EXTENSIONS", "csv,exe")
+	os.Setenv("DENIED_EXTENSIONS", "exe,a/b")
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), ".exe is also in ALLOWED_EXTENSIONS") || !strings.Contains(err.Error(), `".a/b" is not a file extension`) {
+		t.Errorf("Expected errors for the overlap and the slash, got: %v", err)
+	}
+}
+
+func TestLoadConfig_ResumeTimeout(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("RESUME_TIMEOUT", "15m")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.ResumeTimeout != 15*time.Minute {
+		t.Errorf("Expected ResumeTimeout 15m, got %v", config.ResumeTimeout)
+	}
+
+	os.Setenv("RESUME_TIMEOUT", "-1m")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative RESUME_TIMEOUT")
+	}
+}
+
+func TestLoadConfig_ProgressLogInterval(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.ProgressLogInterval != 30*time.Second {
+		t.Errorf("Expected ProgressLogInterval to default to 30s, got %v", config.ProgressLogInterval)
+	}
+
+	os.Setenv("PROGRESS_LOG_INTERVAL", "0")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.ProgressLogInterval != 0 {
+		t.Errorf("Expected ProgressLogInterval 0, got %v", config.ProgressLogInterval)
+	}
+
+	os.Setenv("PROGRESS_LOG_INTERVAL", "often")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid PROGRESS_LOG_INTERVAL")
+	}
+}
+
+func TestLoadConfig_Spill(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SPILL_THRESHOLD", "1048576")
+	os.Setenv("SPILL_DIR", t.TempDir())
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SpillThreshold != 1048576 {
+		t.Errorf("Expected SpillThreshold 1048576, got %d", config.SpillThreshold)
+	}
+
+	os.Setenv("SPILL_DIR", "/nonexistent/spill")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for missing SPILL_DIR")
+	}
+
+	os.Setenv("SPILL_THRESHOLD", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative SPILL_THRESHOLD")
+	}
+}
+
+func TestLoadConfig_MultipartConcurrency(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.MultipartConcurrency != 4 {
+		t.Errorf("Expected MultipartConcurrency to default to 4, got %d", config.MultipartConcurrency)
+	}
+
+	os.Setenv("MULTIPART_CONCURRENCY", "8")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.MultipartConcurrency != 8 {
+		t.Errorf("Expected MultipartConcurrency 8, got %d", config.MultipartConcurrency)
+	}
+
+	os.Setenv("MULTIPART_CONCURRENCY", "0")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for MULTIPART_CONCURRENCY below 1")
+	}
+}
+
+func TestLoadConfig_AWSHTTPClient(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("AWS_HTTP_DIAL_TIMEOUT", "5s")
+	os.Setenv("AWS_HTTP_TLS_HANDSHAKE_TIMEOUT", "15s")
+	os.Setenv("AWS_HTTP_RESPONSE_HEADER_TIMEOUT", "1m")
+	os.Setenv("AWS_HTTP_MAX_IDLE_CONNS_PER_HOST", "64")
+	os.Setenv("AWS_HTTP_PROXY", "http://proxy.example.com:3128")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AWSHTTPDialTimeout != 5*time.Second {
+		t.Errorf("Expected AWSHTTPDialTimeout 5s, got %v", config.AWSHTTPDialTimeout)
+	}
+	if config.AWSHTTPTLSHandshakeTimeout != 15*time.Second {
+		t.Errorf("Expected AWSHTTPTLSHandshakeTimeout 15s, got %v", config.AWSHTTPTLSHandshakeTimeout)
+	}
+	if config.AWSHTTPResponseHeaderTimeout != time.Minute {
+		t.Errorf("Expected AWSHTTPResponseHeaderTimeout 1m, got %v", config.AWSHTTPResponseHeaderTimeout)
+	}
+	if config.AWSHTTPMaxIdleConnsPerHost != 64 {
+		t.Errorf("Expected AWSHTTPMaxIdleConnsPerHost 64, got %d", config.AWSHTTPMaxIdleConnsPerHost)
+	}
+	if config.AWSHTTPProxy != "http://proxy.example.com:3128" {
+		t.Errorf("Expected AWSHTTPProxy to be set, got '%s'", config.AWSHTTPProxy)
+	}
+
+	os.Setenv("AWS_HTTP_PROXY", "proxy.example.com:3128")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for AWS_HTTP_PROXY without a scheme")
+	}
+
+	os.Setenv("AWS_HTTP_PROXY", "")
+	os.Setenv("AWS_HTTP_DIAL_TIMEOUT", "-1s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative AWS_HTTP_DIAL_TIMEOUT")
+	}
+}
+
+func TestLoadConfig_SSHCAKeys(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	path := filepath.Join(t.TempDir(), "ca.pub")
+	os.WriteFile(path, []byte("ssh-ed25519 AAAA"), 0600)
+	os.Setenv("SSH_CA_KEYS", path)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SSHCAKeys != path {
+		t.Errorf("Expected SSHCAKeys '%s', got '%s'", path, config.SSHCAKeys)
+	}
+
+	os.Setenv("SSH_CA_KEYS", "/nonexistent/ca.pub")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for missing SSH_CA_KEYS file")
+	}
+}
+
+func TestLoadConfig_AssumeRole(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ASSUME_ROLE_ARN", "sftp-upload")
+	os.Setenv("ASSUME_ROLE_DURATION", "2h")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AssumeRoleARN != "sftp-upload" {
+		t.Errorf("Expected AssumeRoleARN 'sftp-upload', got '%s'", config.AssumeRoleARN)
+	}
+	if config.AssumeRoleDuration != 2*time.Hour {
+		t.Errorf("Expected AssumeRoleDuration 2h, got %v", config.AssumeRoleDuration)
+	}
+
+	os.Setenv("ASSUME_ROLE_ARN", "arn:aws:iam::210987654321:role/sftp-upload")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for role in another account")
+	}
+
+	os.Setenv("ASSUME_ROLE_ARN", "sftp-upload")
+	os.Setenv("ASSUME_ROLE_DURATION", "5m")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for ASSUME_ROLE_DURATION below 15m")
+	}
+}
+
+func TestLoadConfig_AuthCache(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuthCacheTTL != 0 {
+		t.Errorf("Expected auth cache disabled by default, got TTL %v", config.AuthCacheTTL)
+	}
+
+	os.Setenv("AUTH_CACHE_TTL", "5m")
+	os.Setenv("AUTH_CACHE_SIZE", "50")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuthCacheTTL != 5*time.Minute {
+		t.Errorf("Expected AuthCacheTTL 5m, got %v", config.AuthCacheTTL)
+	}
+	if config.AuthCacheSize != 50 {
+		t.Errorf("Expected AuthCacheSize 50, got %d", config.AuthCacheSize)
+	}
+
+	os.Setenv("AUTH_CACHE_SIZE", "0")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for AUTH_CACHE_SIZE 0")
+	}
+}
+
+func TestLoadConfig_UsersFile(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte("alice:$2y$10$hash\n"), 0600)
+	os.Setenv("USERS_FILE", path)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UsersFile != path {
+		t.Errorf("Expected UsersFile '%s', got '%s'", path, config.UsersFile)
+	}
+
+	os.Setenv("USERS_FILE", "/nonexistent/users")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for missing USERS_FILE")
+	}
+}
+
+func TestLoadConfig_UsersSecret(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("USERS_SECRET", "sftpgw/users")
+	os.Setenv("USERS_SECRET_REFRESH", "10m")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UsersSecret != "sftpgw/users" {
+		t.Errorf("Expected UsersSecret 'sftpgw/users', got '%s'", config.UsersSecret)
+	}
+	if config.UsersSecretRefresh != 10*time.Minute {
+		t.Errorf("Expected UsersSecretRefresh 10m, got %v", config.UsersSecretRefresh)
+	}
+
+	os.Setenv("USERS_SECRET_REFRESH", "5s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for refresh interval below one minute")
+	}
+	os.Unsetenv("USERS_SECRET_REFRESH")
+
+	os.Setenv("AUTH_WEBHOOK_URL", "https://idp.example.com/sftp/auth")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for USERS_SECRET combined with AUTH_WEBHOOK_URL")
+	}
+}
+
+func TestLoadConfig_AllowedPrincipals(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ALLOWED_PRINCIPALS", "arn:aws:iam::123456789012:user/partners/*, arn:aws:iam::123456789012:user/ops")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []string{"arn:aws:iam::123456789012:user/partners/*", "arn:aws:iam::123456789012:user/ops"}
+	if len(config.AllowedPrincipals) != len(expected) {
+		t.Fatalf("Expected AllowedPrincipals %v, got %v", expected, config.AllowedPrincipals)
+	}
+	for i := range expected {
+		if config.AllowedPrincipals[i] != expected[i] {
+			t.Errorf("Expected AllowedPrincipals[%d] '%s', got '%s'", i, expected[i], config.AllowedPrincipals[i])
+		}
+	}
+
+	os.Setenv("ALLOWED_PRINCIPALS", "partners/*")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for pattern that is not an ARN")
+	}
+}
+
+func TestLoadConfig_AllowAnyAccount(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("ALLOW_ANY_ACCOUNT", "true")
+
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "requires ALLOWED_PRINCIPALS or POLICY_TAG_PREFIX") {
+		t.Errorf("Expected error without an allowlist or tag policy, got: %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "AWS_ACCOUNT_ID") {
+		t.Errorf("Expected AWS_ACCOUNT_ID to be optional, got: %v", err)
+	}
+
+	os.Setenv("ALLOWED_PRINCIPALS", "arn:aws:iam::*:role/partner-upload")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.AllowAnyAccount || config.RequiredAccountID != "" {
+		t.Errorf("Expected any account without a required one, got %v and '%s'", config.AllowAnyAccount, config.RequiredAccountID)
+	}
+
+	os.Setenv("ASSUME_ROLE_ARN", "upload")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid ASSUME_ROLE_ARN") {
+		t.Errorf("Expected error for a role name without AWS_ACCOUNT_ID, got: %v", err)
+	}
+
+	os.Setenv("ALLOW_ANY_ACCOUNT", "sometimes")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid ALLOW_ANY_ACCOUNT") {
+		t.Errorf("Expected error for invalid ALLOW_ANY_ACCOUNT, got: %v", err)
+	}
+}
+
+func TestLoadConfig_VerifyWriteAccess(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("VERIFY_WRITE_ACCESS", "true")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.VerifyWriteAccess {
+		t.Error("Expected VerifyWriteAccess to be true")
+	}
+
+	os.Setenv("VERIFY_WRITE_ACCESS", "sometimes")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid VERIFY_WRITE_ACCESS")
+	}
+}
+
+func TestLoadConfig_TOTP(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("MFA_REQUIRED", "true")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for MFA_REQUIRED without TOTP_SECRETS_FILE")
+	}
+
+	path := filepath.Join(t.TempDir(), "totp")
+	os.WriteFile(path, []byte("alice:GEZDGNBVGY3TQOJQ\n"), 0600)
+	os.Setenv("TOTP_SECRETS_FILE", path)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.TOTPSecretsFile != path {
+		t.Errorf("Expected TOTPSecretsFile '%s', got '%s'", path, config.TOTPSecretsFile)
+	}
+	if !config.MFARequired {
+		t.Error("Expected MFARequired to be true")
+	}
+}
+
+func TestLoadConfig_AuthRateLimit(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("AUTH_RATE_LIMIT", "10")
+	os.Setenv("AUTH_LOCKOUT_THRESHOLD", "5")
+	os.Setenv("AUTH_LOCKOUT_DURATION", "1h")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuthRateLimit != 10 {
+		t.Errorf("Expected AuthRateLimit 10, got %d", config.AuthRateLimit)
+	}
+	if config.AuthRateBurst != 5 {
+		t.Errorf("Expected default AuthRateBurst 5, got %d", config.AuthRateBurst)
+	}
+	if config.AuthLockoutThreshold != 5 {
+		t.Errorf("Expected AuthLockoutThreshold 5, got %d", config.AuthLockoutThreshold)
+	}
+	if config.AuthLockoutDuration != time.Hour {
+		t.Errorf("Expected AuthLockoutDuration 1h, got %v", config.AuthLockoutDuration)
+	}
+
+	os.Setenv("AUTH_RATE_BURST", "0")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for AUTH_RATE_BURST 0 with a rate limit")
+	}
+}
+
+func TestLoadConfig_Bans(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("BAN_THRESHOLD", "10")
+	os.Setenv("BAN_DURATION", "24h")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.BanThreshold != 10 {
+		t.Errorf("Expected BanThreshold 10, got %d", config.BanThreshold)
+	}
+	if config.BanFindTime != 10*time.Minute {
+		t.Errorf("Expected default BanFindTime 10m, got %v", config.BanFindTime)
+	}
+	if config.BanDuration != 24*time.Hour {
+		t.Errorf("Expected BanDuration 24h, got %v", config.BanDuration)
+	}
+
+	os.Setenv("BAN_FIND_TIME", "0s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for BAN_FIND_TIME 0s")
+	}
+}
+
+func TestLoadConfig_GeoIP(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("GEOIP_DENY_COUNTRIES", "kp")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for GEOIP_DENY_COUNTRIES without GEOIP_DB")
+	}
+
+	dir := t.TempDir()
+	os.Setenv("GEOIP_DB", dir)
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.GeoIPDB != dir {
+		t.Errorf("Expected GeoIPDB '%s', got '%s'", dir, config.GeoIPDB)
+	}
+	if len(config.GeoIPDenyCountries) != 1 || config.GeoIPDenyCountries[0] != "KP" {
+		t.Errorf("Expected GeoIPDenyCountries [KP], got %v", config.GeoIPDenyCountries)
+	}
+
+	os.Setenv("GEOIP_ALLOW_COUNTRIES", "Netherlands")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for country name instead of code")
+	}
+}
+
+func TestLoadConfig_DeliveryWebhook(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("DELIVERY_WEBHOOK_URL", "https://ingest.example.com/files")
+	os.Setenv("DELIVERY_WEBHOOK_SECRET", "s3cret")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error without S3_BUCKET, got: %v", err)
+	}
+	if config.DeliveryWebhookURL != "https://ingest.example.com/files" || config.DeliveryWebhookSecret != "s3cret" {
+		t.Errorf("Expected the delivery webhook and its secret, got '%s' and '%s'", config.DeliveryWebhookURL, config.DeliveryWebhookSecret)
+	}
+
+	os.Setenv("STREAM_UPLOADS", "true")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for DELIVERY_WEBHOOK_URL with STREAM_UPLOADS")
+	}
+
+	os.Unsetenv("STREAM_UPLOADS")
+	os.Setenv("UPLOAD_ROUTES", "user=*,replica=partner-drops-dr@eu-west-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for DELIVERY_WEBHOOK_URL with UPLOAD_ROUTES")
+	}
+
+	os.Unsetenv("UPLOAD_ROUTES")
+	os.Setenv("FAILOVER_BUCKET", "partner-drops-failover@eu-west-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for DELIVERY_WEBHOOK_URL with FAILOVER_BUCKET")
+	}
+
+	os.Unsetenv("FAILOVER_BUCKET")
+	os.Setenv("DELIVERY_WEBHOOK_URL", "http://ingest.example.com/files")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for plain http delivery webhook on another host")
+	}
+}
+
+func TestLoadConfig_Kafka(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("KAFKA_BROKERS", "kafka-1.example.com:9093, kafka-2.example.com:9093")
+	os.Setenv("KAFKA_TOPIC", "partner-files")
+	os.Setenv("KAFKA_TLS", "true")
+	os.Setenv("KAFKA_SASL_USERNAME", "sftpgw")
+	os.Setenv("KAFKA_SASL_PASSWORD", "s3cret")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error without S3_BUCKET, got: %v", err)
+	}
+	if len(config.KafkaBrokers) != 2 || config.KafkaBrokers[1] != "kafka-2.example.com:9093" || config.KafkaTopic != "partner-files" {
+		t.Errorf("Expected both brokers and the topic, got %v and '%s'", config.KafkaBrokers, config.KafkaTopic)
+	}
+	if !config.KafkaTLS || config.KafkaSASLUsername != "sftpgw" || config.KafkaSASLPassword != "s3cret" || config.KafkaMaxMessageSize != 1000000 {
+		t.Errorf("Expected TLS, the SASL credentials and the default message size, got %+v", config)
+	}
+
+	os.Setenv("KAFKA_TLS", "false")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for KAFKA_SASL_USERNAME without KAFKA_TLS")
+	}
+
+	os.Unsetenv("KAFKA_SASL_USERNAME")
+	os.Setenv("FAILOVER_BUCKET", "partner-drops-failover@eu-west-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for KAFKA_BROKERS with FAILOVER_BUCKET")
+	}
+
+	os.Unsetenv("FAILOVER_BUCKET")
+	os.Setenv("KAFKA_STORE_S3", "true")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for KAFKA_STORE_S3 without S3_BUCKET")
+	}
+	os.Setenv("S3_BUCKET", "test-bucket")
+	if config, err := LoadConfig(); err != nil || !config.KafkaStoreS3 {
+		t.Errorf("Expected KAFKA_STORE_S3 with S3_BUCKET, got %v", err)
+	}
+
+	for env, value := range map[string]string{
+		"KAFKA_BROKERS":          "kafka-1.example.com",
+		"KAFKA_TOPIC":            "partner files",
+		"KAFKA_MAX_MESSAGE_SIZE": "0",
+		"STREAM_UPLOADS":         "true",
+	} {
+		old := os.Getenv(env)
+		os.Setenv(env, value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for %s=%s", env, value)
+		}
+		os.Setenv(env, old)
+	}
+
+	os.Unsetenv("KAFKA_TOPIC")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for KAFKA_BROKERS without KAFKA_TOPIC")
+	}
+}
+
+func TestLoadConfig_AuthWebhook(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("AUTH_WEBHOOK_URL", "https://idp.example.com/sftp/auth")
+	os.Setenv("AUTH_WEBHOOK_TIMEOUT", "3s")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuthWebhookURL != "https://idp.example.com/sftp/auth" {
+		t.Errorf("Expected AuthWebhookURL 'https://idp.example.com/sftp/auth', got '%s'", config.AuthWebhookURL)
+	}
+	if config.AuthWebhookTimeout != 3*time.Second {
+		t.Errorf("Expected AuthWebhookTimeout 3s, got %v", config.AuthWebhookTimeout)
+	}
+
+	os.Setenv("AUTH_WEBHOOK_URL", "http://127.0.0.1:8080/auth")
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("Expected http to be allowed for localhost, got: %v", err)
+	}
+
+	os.Setenv("AUTH_WEBHOOK_URL", "http://idp.example.com/sftp/auth")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for plain http webhook on another host")
+	}
+}
+
+func TestLoadConfig_LDAP(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("LDAP_URL", "ldaps://dc1.corp.example.com")
+	os.Setenv("LDAP_BIND_DN", "{user}@corp.example.com")
+	os.Setenv("LDAP_BASE_DN", "DC=corp,DC=example,DC=com")
+	os.Setenv("LDAP_USER_ATTRIBUTE", "sAMAccountName")
+	os.Setenv("LDAP_GROUP_PREFIXES", "sftp-acme:partners/acme, sftp-globex:/partners/globex/")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.LDAPUserAttribute != "sAMAccountName" {
+		t.Errorf("Expected LDAPUserAttribute 'sAMAccountName', got '%s'", config.LDAPUserAttribute)
+	}
+	want := []ldapGroup{{name: "sftp-acme", prefix: "partners/acme"}, {name: "sftp-globex", prefix: "partners/globex"}}
+	if !slices.Equal(config.LDAPGroupPrefixes, want) {
+		t.Errorf("Expected LDAPGroupPrefixes %v, got %v", want, config.LDAPGroupPrefixes)
+	}
+	if config.LDAPTimeout != 10*time.Second {
+		t.Errorf("Expected default LDAPTimeout 10s, got %v", config.LDAPTimeout)
+	}
+
+	os.Setenv("LDAP_GROUP_PREFIXES", "sftp-acme:../acme")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for group prefix outside the bucket prefix")
+	}
+	os.Unsetenv("LDAP_GROUP_PREFIXES")
+
+	os.Setenv("LDAP_BIND_DN", "cn=sftp,dc=example,dc=com")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for LDAP_BIND_DN without {user}")
+	}
+
+	os.Unsetenv("LDAP_BIND_DN")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for LDAP_URL without LDAP_BIND_DN")
+	}
+
+	os.Setenv("LDAP_BIND_DN", "{user}@corp.example.com")
+	os.Setenv("LDAP_URL", "https://dc1.corp.example.com")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for non-LDAP URL")
+	}
+}
+
+func TestLoadConfig_JWT(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("JWT_ISSUER", "https://login.example.com")
+	os.Setenv("JWT_AUDIENCE", "sftpgw")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.JWTIssuer != "https://login.example.com" {
+		t.Errorf("Expected JWTIssuer 'https://login.example.com', got '%s'", config.JWTIssuer)
+	}
+	if config.JWTAudience != "sftpgw" {
+		t.Errorf("Expected JWTAudience 'sftpgw', got '%s'", config.JWTAudience)
+	}
+
+	os.Setenv("JWT_JWKS_URL", "http://login.example.com/keys")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for plain http JWKS URL on another host")
+	}
+
+	os.Setenv("JWT_JWKS_URL", "https://login.example.com/keys")
+	os.Unsetenv("JWT_ISSUER")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for JWT_JWKS_URL without JWT_ISSUER")
+	}
+}
+
+func TestLoadConfig_Vault(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("VAULT_ADDR", "https://vault.example.com:8200")
+	os.Setenv("VAULT_AWS_ROLE", "sftp-upload")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.VaultAWSRole != "sftp-upload" {
+		t.Errorf("Expected VaultAWSRole 'sftp-upload', got '%s'", config.VaultAWSRole)
+	}
+	if config.VaultAWSMount != "aws" {
+		t.Errorf("Expected default VaultAWSMount 'aws', got '%s'", config.VaultAWSMount)
+	}
+
+	os.Unsetenv("VAULT_ADDR")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for VAULT_AWS_ROLE without VAULT_ADDR")
+	}
+}
+
+func TestLoadConfig_UserConfigTable(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("USER_CONFIG_TABLE", "sftpgw-users")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UserConfigTable != "sftpgw-users" {
+		t.Errorf("Expected UserConfigTable 'sftpgw-users', got '%s'", config.UserConfigTable)
+	}
+	if config.UserConfigKey != "principal" {
+		t.Errorf("Expected default UserConfigKey 'principal', got '%s'", config.UserConfigKey)
+	}
+}
+
+func TestLoadConfig_AllowedIPsTag(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ALLOWED_IPS_TAG", "sftpgw:allowed-ips")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AllowedIPsTag != "sftpgw:allowed-ips" {
+		t.Errorf("Expected AllowedIPsTag 'sftpgw:allowed-ips', got '%s'", config.AllowedIPsTag)
+	}
+}
+
+func TestLoadConfig_PolicyTagPrefix(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("POLICY_TAG_PREFIX", "sftpgw:")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.PolicyTagPrefix != "sftpgw:" {
+		t.Errorf("Expected PolicyTagPrefix 'sftpgw:', got '%s'", config.PolicyTagPrefix)
+	}
+}
+
+func TestLoadConfig_SecurityFindings(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SECURITY_FINDINGS", "EventBridge")
+	os.Setenv("SECURITY_FINDINGS_BUS", "security")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SecurityFindings != "eventbridge" {
+		t.Errorf("Expected SecurityFindings 'eventbridge', got '%s'", config.SecurityFindings)
+	}
+	if config.SecurityFindingsBus != "security" {
+		t.Errorf("Expected SecurityFindingsBus 'security', got '%s'", config.SecurityFindingsBus)
+	}
+
+	os.Setenv("SECURITY_FINDINGS", "securityhub")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for SECURITY_FINDINGS_BUS with Security Hub")
+	}
+
+	os.Setenv("SECURITY_FINDINGS", "guardduty")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid SECURITY_FINDINGS")
+	}
+}
+
+func TestLoadConfig_Guest(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("GUEST_USER", "dropbox")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.GuestUser != "dropbox" {
+		t.Errorf("Expected GuestUser 'dropbox', got '%s'", config.GuestUser)
+	}
+	if config.GuestPrefix != "quarantine" {
+		t.Errorf("Expected default GuestPrefix 'quarantine', got '%s'", config.GuestPrefix)
+	}
+
+	os.Setenv("GUEST_PREFIX", "/incoming/guests/")
+	os.Setenv("GUEST_QUOTA", "1073741824")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.GuestPrefix != "incoming/guests" {
+		t.Errorf("Expected GuestPrefix 'incoming/guests', got '%s'", config.GuestPrefix)
+	}
+	if config.GuestQuota != 1073741824 {
+		t.Errorf("Expected GuestQuota 1073741824, got %d", config.GuestQuota)
+	}
+
+	os.Setenv("GUEST_PREFIX", "../other")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for GUEST_PREFIX outside the bucket prefix")
+	}
+
+	os.Unsetenv("GUEST_PREFIX")
+	os.Unsetenv("GUEST_USER")
+	os.Setenv("GUEST_PASSWORD", "welcome")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for GUEST_PASSWORD without GUEST_USER")
+	}
+}
+
+func TestLoadConfig_HostKeyStore(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("HOST_KEY_PARAMETER", "/sftpgw/host-key")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.HostKeyParameter != "/sftpgw/host-key" {
+		t.Errorf("Expected HostKeyParameter '/sftpgw/host-key', got '%s'", config.HostKeyParameter)
+	}
+
+	os.Setenv("HOST_KEY_SECRET", "sftpgw/host-key")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for HOST_KEY_SECRET combined with HOST_KEY_PARAMETER")
+	}
+}
+
+func TestLoadConfig_SSHAlgorithms(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SSH_CIPHERS", "chacha20-poly1305@openssh.com, aes256-gcm@openssh.com")
+	os.Setenv("SSH_MACS", "hmac-sha2-256-etm@openssh.com")
+	os.Setenv("SSH_KEX_ALGORITHMS", "curve25519-sha256,diffie-hellman-group14-sha1")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if want := []string{"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com"}; !slices.Equal(config.SSHCiphers, want) {
+		t.Errorf("Expected SSHCiphers %v, got %v", want, config.SSHCiphers)
+	}
+	if want := []string{"hmac-sha2-256-etm@openssh.com"}; !slices.Equal(config.SSHMACs, want) {
+		t.Errorf("Expected SSHMACs %v, got %v", want, config.SSHMACs)
+	}
+	if want := []string{"curve25519-sha256", "diffie-hellman-group14-sha1"}; !slices.Equal(config.SSHKeyExchanges, want) {
+		t.Errorf("Expected SSHKeyExchanges %v, got %v", want, config.SSHKeyExchanges)
+	}
+
+	os.Setenv("SSH_CIPHERS", "blowfish-cbc")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for unknown cipher")
+	}
+}
+
+func TestLoadConfig_SSHBanner(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SSH_BANNER", "Authorized use only")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SSHBanner != "Authorized use only" {
+		t.Errorf("Expected SSHBanner 'Authorized use only', got '%s'", config.SSHBanner)
+	}
+
+	os.Setenv("SSH_BANNER_FILE", "/etc/sftpgw/banner.txt")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for SSH_BANNER combined with SSH_BANNER_FILE")
+	}
+}
+
+func TestLoadConfig_SSHServerVersion(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SSHServerVersion != "SSH-2.0-SFTPGW" {
+		t.Errorf("Expected default SSHServerVersion 'SSH-2.0-SFTPGW', got '%s'", config.SSHServerVersion)
+	}
+
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"SSH-2.0-OpenSSH_9.6", "SSH-2.0-OpenSSH_9.6", false},
+		{"OpenSSH_9.6 Ubuntu", "SSH-2.0-OpenSSH_9.6 Ubuntu", false},
+		{"SSH-1.99-OpenSSH", "", true},
+		{"SSH-2.0-", "", true},
+		{"my-server", "", true},
+		{"SSH-2.0-Server\r\nEvil", "", true},
+	}
+	for _, tt := range tests {
+		os.Setenv("SSH_SERVER_VERSION", tt.value)
+		config, err := LoadConfig()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Expected error for SSH_SERVER_VERSION %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected no error for %q, got: %v", tt.value, err)
+		}
+		if config.SSHServerVersion != tt.want {
+			t.Errorf("Expected SSHServerVersion '%s', got '%s'", tt.want, config.SSHServerVersion)
+		}
+	}
+}
+
+func TestLoadConfig_HostKeyRollover(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.HostKeyRollover != 0 {
+		t.Errorf("Expected no default HostKeyRollover, got %v", config.HostKeyRollover)
+	}
+
+	os.Setenv("HOST_KEY_ROLLOVER", "24h")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.HostKeyRollover != 24*time.Hour {
+		t.Errorf("Expected HostKeyRollover 24h, got %v", config.HostKeyRollover)
+	}
+
+	for _, value := range []string{"-1h", "tomorrow"} {
+		os.Setenv("HOST_KEY_ROLLOVER", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for HOST_KEY_ROLLOVER %q", value)
+		}
+	}
+}
+
+func TestLoadConfig_ClientVersionRules(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("CLIENT_VERSION_ALLOW", "^SSH-2.0-(OpenSSH|WinSCP)")
+	os.Setenv("CLIENT_VERSION_DENY", `OpenSSH_[1-6]\.`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.ClientVersionAllow == nil || !config.ClientVersionAllow.MatchString("SSH-2.0-WinSCP_release_6.3") {
+		t.Errorf("Expected ClientVersionAllow to match WinSCP, got %v", config.ClientVersionAllow)
+	}
+	if config.ClientVersionDeny == nil || !config.ClientVersionDeny.MatchString("SSH-2.0-OpenSSH_5.3") {
+		t.Errorf("Expected ClientVersionDeny to match OpenSSH 5.3, got %v", config.ClientVersionDeny)
+	}
+
+	os.Setenv("CLIENT_VERSION_DENY", "OpenSSH_(")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for invalid CLIENT_VERSION_DENY")
+	}
+}
+
+func TestLoadConfig_PreAuthLimits(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.HandshakeTimeout != 10*time.Second {
+		t.Errorf("Expected default HandshakeTimeout 10s, got %v", config.HandshakeTimeout)
+	}
+	if config.MaxPreAuthConnections != 50 {
+		t.Errorf("Expected default MaxPreAuthConnections 50, got %d", config.MaxPreAuthConnections)
+	}
+
+	os.Setenv("HANDSHAKE_TIMEOUT", "5s")
+	os.Setenv("MAX_PREAUTH_CONNECTIONS", "0")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.HandshakeTimeout != 5*time.Second {
+		t.Errorf("Expected HandshakeTimeout 5s, got %v", config.HandshakeTimeout)
+	}
+	if config.MaxPreAuthConnections != 0 {
+		t.Errorf("Expected MaxPreAuthConnections 0, got %d", config.MaxPreAuthConnections)
+	}
+
+	for name, value := range map[string]string{
+		"HANDSHAKE_TIMEOUT":       "0s",
+		"MAX_PREAUTH_CONNECTIONS": "-1",
+	} {
+		clearEnv()
+		os.Setenv("S3_BUCKET", "test-bucket")
+		os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+		os.Setenv(name, value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for %s %q", name, value)
+		}
+	}
+}
+
+func TestLoadConfig_ServerPorts(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SFTP_PORT", "2222, 22")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !slices.Equal(config.ServerPorts, []int{2222, 22}) {
+		t.Errorf("Expected ServerPorts [2222 22], got %v", config.ServerPorts)
+	}
+	if config.ServerPort != 2222 {
+		t.Errorf("Expected ServerPort 2222, got %d", config.ServerPort)
+	}
+
+	for _, value := range []string{"2222,2222", "2222,0", "2222,"} {
+		os.Setenv("SFTP_PORT", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for SFTP_PORT %q", value)
+		}
+	}
+}
+
+func TestLoadConfig_FTPS(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("FTPS_PORT", "2121")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for FTPS_PORT without FTPS_CERT_FILE and FTPS_KEY_FILE")
+	}
+
+	certFile := filepath.Join(t.TempDir(), "ftps.pem")
+	if err := os.WriteFile(certFile, []byte("test"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FTPS_CERT_FILE", certFile)
+	os.Setenv("FTPS_KEY_FILE", certFile)
+	os.Setenv("FTPS_PASSIVE_PORTS", "50000-50100")
+	os.Setenv("FTPS_PUBLIC_IP", "203.0.113.10")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.FTPSPort != 2121 {
+		t.Errorf("Expected FTPSPort 2121, got %d", config.FTPSPort)
+	}
+	if !slices.Equal(config.FTPSPassivePorts, []int{50000, 50100}) {
+		t.Errorf("Expected FTPSPassivePorts [50000 50100], got %v", config.FTPSPassivePorts)
+	}
+	if config.FTPSPublicIP.String() != "203.0.113.10" {
+		t.Errorf("Expected FTPSPublicIP 203.0.113.10, got %v", config.FTPSPublicIP)
+	}
+
+	for name, value := range map[string]string{
+		"FTPS_PORT":          "2222",
+		"FTPS_CERT_FILE":     filepath.Join(t.TempDir(), "missing.pem"),
+		"FTPS_PASSIVE_PORTS": "50100-50000",
+		"FTPS_PUBLIC_IP":     "2001:db8::1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			old := os.Getenv(name)
+			defer os.Setenv(name, old)
+			os.Setenv(name, value)
+			if _, err := LoadConfig(); err == nil {
+				t.Errorf("Expected error for %s %q", name, value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Admin(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ADMIN_ADDR", ":8080")
+	os.Setenv("READY_CHECK_AWS", "true")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AdminAddr != ":8080" {
+		t.Errorf("Expected AdminAddr ':8080', got '%s'", config.AdminAddr)
+	}
+	if !config.ReadyCheckAWS {
+		t.Error("Expected ReadyCheckAWS to be true")
+	}
+
+	os.Setenv("ADMIN_ADDR", "8080")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for ADMIN_ADDR without a port separator")
+	}
+
+	os.Unsetenv("ADMIN_ADDR")
+	os.Setenv("ADMIN_PPROF", "true")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for ADMIN_PPROF without ADMIN_ADDR")
+	}
+
+	os.Unsetenv("ADMIN_PPROF")
+	os.Setenv("ADMIN_TOKEN", "0123456789abcdef")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for ADMIN_TOKEN without ADMIN_ADDR")
+	}
+
+	os.Setenv("ADMIN_ADDR", ":8080")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AdminToken != "0123456789abcdef" {
+		t.Errorf("Expected AdminToken from the environment, got '%s'", config.AdminToken)
+	}
+
+	os.Setenv("ADMIN_TOKEN", "short")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for an ADMIN_TOKEN shorter than 16 characters")
+	}
+}
+
+func TestLoadConfig_Tracing(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.OTLPEndpoint != "" || config.OTelServiceName != "sftpgw" {
+		t.Errorf("Expected tracing disabled with service name 'sftpgw', got '%s' and '%s'", config.OTLPEndpoint, config.OTelServiceName)
+	}
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://otel-collector:4318")
+	os.Setenv("OTEL_SERVICE_NAME", "sftpgw-prod")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.OTLPEndpoint != "http://otel-collector:4318" || config.OTelServiceName != "sftpgw-prod" {
+		t.Errorf("Expected OTLP endpoint and service name from the environment, got '%s' and '%s'", config.OTLPEndpoint, config.OTelServiceName)
+	}
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for OTEL_EXPORTER_OTLP_ENDPOINT without a scheme")
+	}
+}
+
+func TestLoadConfig_OTLPLogs(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("OTEL_LOGS_EXPORTER", "otlp")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for OTEL_LOGS_EXPORTER without OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://otel-collector:4318")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.OTLPLogs {
+		t.Error("Expected OTLPLogs to be true")
+	}
+
+	os.Setenv("OTEL_LOGS_EXPORTER", "none")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.OTLPLogs {
+		t.Error("Expected OTLPLogs to be false")
+	}
+
+	os.Setenv("OTEL_LOGS_EXPORTER", "console")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for OTEL_LOGS_EXPORTER console")
+	}
+}
+
+func TestLoadConfig_LogFile(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.LogFile != "" || config.LogFileMaxSize != 100*1024*1024 || config.LogFileMaxBackups != 7 || !config.LogFileCompress {
+		t.Errorf("Expected logging to stdout with default rotation, got %+v", config)
+	}
+
+	os.Setenv("LOG_FILE", "/var/log/sftpgw/sftpgw.log")
+	os.Setenv("LOG_FILE_MAX_SIZE", "1048576")
+	os.Setenv("LOG_FILE_MAX_AGE", "24h")
+	os.Setenv("LOG_FILE_MAX_BACKUPS", "30")
+	os.Setenv("LOG_FILE_COMPRESS", "false")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.LogFile != "/var/log/sftpgw/sftpgw.log" || config.LogFileMaxSize != 1048576 ||
+		config.LogFileMaxAge != 24*time.Hour || config.LogFileMaxBackups != 30 || config.LogFileCompress {
+		t.Errorf("Expected log file settings from the environment, got %+v", config)
+	}
+
+	for name, value := range map[string]string{
+		"LOG_FILE_MAX_SIZE":    "-1",
+		"LOG_FILE_MAX_AGE":     "daily",
+		"LOG_FILE_MAX_BACKUPS": "-1",
+		"LOG_FILE_COMPRESS":    "maybe",
+	} {
+		old := os.Getenv(name)
+		os.Setenv(name, value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for %s=%s", name, value)
+		}
+		os.Setenv(name, old)
+	}
+}
+
+func TestLoadConfig_CloudWatchLogs(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.CloudWatchLogGroup != "" || config.CloudWatchLogFlushInterval != 5*time.Second {
+		t.Errorf("Expected CloudWatch Logs disabled with a 5s flush interval, got '%s' and %v", config.CloudWatchLogGroup, config.CloudWatchLogFlushInterval)
+	}
+
+	os.Setenv("CLOUDWATCH_LOG_GROUP", "/sftpgw/prod")
+	os.Setenv("CLOUDWATCH_LOG_STREAM", "gateway-1")
+	os.Setenv("CLOUDWATCH_LOG_FLUSH_INTERVAL", "1s")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.CloudWatchLogGroup != "/sftpgw/prod" || config.CloudWatchLogStream != "gateway-1" || config.CloudWatchLogFlushInterval != time.Second {
+		t.Errorf("Expected CloudWatch Logs settings from the environment, got '%s', '%s' and %v",
+			config.CloudWatchLogGroup, config.CloudWatchLogStream, config.CloudWatchLogFlushInterval)
+	}
+
+	os.Setenv("CLOUDWATCH_LOG_STREAM", "gateway:1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for CLOUDWATCH_LOG_STREAM with a colon")
+	}
+
+	os.Setenv("CLOUDWATCH_LOG_STREAM", "gateway-1")
+	os.Setenv("CLOUDWATCH_LOG_FLUSH_INTERVAL", "0s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for zero CLOUDWATCH_LOG_FLUSH_INTERVAL")
+	}
+}
+
+func TestLoadConfig_UploadFailureTopic(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("UPLOAD_FAILURE_TOPIC", "arn:aws:sns:us-east-1:123456789012:sftp-failures")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UploadFailureTopic != "arn:aws:sns:us-east-1:123456789012:sftp-failures" {
+		t.Errorf("Expected UploadFailureTopic to be set, got '%s'", config.UploadFailureTopic)
+	}
+
+	for _, topic := range []string{"sftp-failures", "arn:aws:sqs:us-east-1:123456789012:sftp-failures"} {
+		os.Setenv("UPLOAD_FAILURE_TOPIC", topic)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for UPLOAD_FAILURE_TOPIC %q", topic)
+		}
+	}
+}
+
+func TestLoadConfig_UploadQueueURL(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("UPLOAD_QUEUE_URL", "https://sqs.us-east-1.amazonaws.com/123456789012/sftp-uploads")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.UploadQueueURL != "https://sqs.us-east-1.amazonaws.com/123456789012/sftp-uploads" {
+		t.Errorf("Expected UploadQueueURL to be set, got '%s'", config.UploadQueueURL)
+	}
+
+	for _, queueURL := range []string{"sftp-uploads", "arn:aws:sqs:us-east-1:123456789012:sftp-uploads", "https://sqs.us-east-1.amazonaws.com/sftp-uploads"} {
+		os.Setenv("UPLOAD_QUEUE_URL", queueURL)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("Expected error for UPLOAD_QUEUE_URL %q", queueURL)
+		}
+	}
+}
+
+func TestLoadConfig_EventBridgeBus(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("EVENTBRIDGE_BUS", "sftp-events")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.EventBridgeBus != "sftp-events" {
+		t.Errorf("Expected EventBridgeBus 'sftp-events', got '%s'", config.EventBridgeBus)
+	}
+}
+
+func TestLoadConfig_Audit(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("AUDIT_BUCKET", "audit-bucket")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuditBucket != "audit-bucket" || config.AuditPrefix != "audit" || config.AuditInterval != 5*time.Minute || config.AuditRetention != 0 {
+		t.Errorf("Expected audit batches every 5m under 'audit', got '%s' every %v with retention %v", config.AuditPrefix, config.AuditInterval, config.AuditRetention)
+	}
+
+	os.Setenv("AUDIT_PREFIX", "/sftpgw/audit/")
+	os.Setenv("AUDIT_INTERVAL", "1m")
+	os.Setenv("AUDIT_RETENTION", "2160h")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AuditPrefix != "sftpgw/audit" || config.AuditInterval != time.Minute || config.AuditRetention != 2160*time.Hour {
+		t.Errorf("Expected audit settings from the environment, got '%s', %v and %v", config.AuditPrefix, config.AuditInterval, config.AuditRetention)
+	}
+
+	os.Setenv("AUDIT_INTERVAL", "100ms")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for AUDIT_INTERVAL below 1s")
+	}
+}
+
+func TestLoadConfig_ReportsAllProblems(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "My_Bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "12345")
+	os.Setenv("SFTP_PORT", "70000")
+	os.Setenv("MAX_FILE_SIZE", "-1")
+	os.Setenv("MAX_CONNECTIONS", "-5")
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("Expected error for invalid settings")
+	}
+	for _, want := range []string{
+		"invalid SFTP_PORT: 70000 is not a valid port",
+		"invalid MAX_FILE_SIZE: must be at least 1",
+		"invalid S3_BUCKET: \"My_Bucket\" must consist of lowercase letters",
+		"invalid AWS_ACCOUNT_ID: \"12345\" is not a 12-digit account ID",
+		"invalid MAX_CONNECTIONS: must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error, got: %v", want, err)
+		}
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 5 {
+		t.Errorf("Expected 5 problems, got %d: %v", n, err)
+	}
+}
+
+func TestLoadConfig_SemanticValidation(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"SFTP_PORT", "0"},
+		{"MAX_FILE_SIZE", "0"},
+		{"CONNECTION_TIMEOUT", "0s"},
+		{"READ_TIMEOUT", "-1s"},
+		{"WRITE_TIMEOUT", "-1s"},
+		{"VIRTUAL_DIR", "uploads"},
+		{"VIRTUAL_DIR", "/"},
+		{"S3_BUCKET", "ab"},
+		{"S3_BUCKET", "my..bucket"},
+		{"S3_BUCKET", "192.168.1.1"},
+		{"S3_BUCKET", "xn--bucket"},
+		{"S3_BUCKET", "bucket-"},
+		{"S3_BUCKET_PREFIX", "uploads/../other"},
+		{"AUDIT_BUCKET", "Audit"},
+		{"AUDIT_PREFIX", "../audit"},
+		{"AWS_ACCOUNT_ID", "12345678901a"},
+	}
+	for _, tt := range tests {
+		clearEnv()
+		os.Setenv("S3_BUCKET", "test-bucket")
+		os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+		os.Setenv(tt.name, tt.value)
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid "+tt.name) {
+			t.Errorf("Expected error for %s=%q, got: %v", tt.name, tt.value, err)
+		}
+	}
+}
+
+func TestLoadConfig_NormalizesPaths(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket.example.com")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("S3_BUCKET_PREFIX", "/uploads//sftp/./")
+	os.Setenv("VIRTUAL_DIR", "/custom-uploads/")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.S3BucketPrefix != "uploads/sftp" {
+		t.Errorf("Expected S3BucketPrefix 'uploads/sftp', got '%s'", config.S3BucketPrefix)
+	}
+	if config.VirtualDir != "/custom-uploads" {
+		t.Errorf("Expected VirtualDir '/custom-uploads', got '%s'", config.VirtualDir)
+	}
+}
+
+func TestLoadConfig_AccessLog(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("ACCESS_LOG", "/var/log/sftpgw/access.log")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AccessLog != "/var/log/sftpgw/access.log" {
+		t.Errorf("Expected AccessLog '/var/log/sftpgw/access.log', got '%s'", config.AccessLog)
+	}
+
+	os.Setenv("LOG_FILE", "/var/log/sftpgw/access.log")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for ACCESS_LOG equal to LOG_FILE")
+	}
+}
+
+func TestLoadConfig_LogSample(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.LogSampleBurst != 100 || config.LogSampleInterval != time.Minute {
+		t.Errorf("Expected 100 entries per minute by default, got %d per %v", config.LogSampleBurst, config.LogSampleInterval)
+	}
+
+	os.Setenv("LOG_SAMPLE_BURST", "0")
+	os.Setenv("LOG_SAMPLE_INTERVAL", "10s")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.LogSampleBurst != 0 || config.LogSampleInterval != 10*time.Second {
+		t.Errorf("Expected sampling disabled with a 10s interval, got %d per %v", config.LogSampleBurst, config.LogSampleInterval)
+	}
+
+	os.Setenv("LOG_SAMPLE_BURST", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative LOG_SAMPLE_BURST")
+	}
+	os.Setenv("LOG_SAMPLE_BURST", "100")
+	os.Setenv("LOG_SAMPLE_INTERVAL", "0s")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for zero LOG_SAMPLE_INTERVAL")
+	}
+}
+
+func TestLoadConfig_SentryDSN(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SENTRY_DSN", "https://abc123@o42.ingest.sentry.io/4506")
+	os.Setenv("SENTRY_ENVIRONMENT", "production")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SentryDSN != "https://abc123@o42.ingest.sentry.io/4506" {
+		t.Errorf("Expected SentryDSN 'https://abc123@o42.ingest.sentry.io/4506', got '%s'", config.SentryDSN)
+	}
+	if config.SentryEnvironment != "production" {
+		t.Errorf("Expected SentryEnvironment 'production', got '%s'", config.SentryEnvironment)
+	}
+
+	os.Setenv("SENTRY_DSN", "https://o42.ingest.sentry.io/4506")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for SENTRY_DSN without key")
+	}
+}
+
+func TestLoadConfig_TCPKeepAlive(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !config.TCPKeepAlive || config.TCPKeepAliveInterval != 15*time.Second || config.TCPKeepAliveCount != 9 {
+		t.Errorf("Expected keepalive enabled every 15s with 9 probes, got %v, %v, %d",
+			config.TCPKeepAlive, config.TCPKeepAliveInterval, config.TCPKeepAliveCount)
+	}
+
+	os.Setenv("TCP_KEEPALIVE", "false")
+	os.Setenv("TCP_KEEPALIVE_INTERVAL", "1m")
+	os.Setenv("TCP_KEEPALIVE_COUNT", "3")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.TCPKeepAlive || config.TCPKeepAliveInterval != time.Minute || config.TCPKeepAliveCount != 3 {
+		t.Errorf("Expected keepalive disabled, 1m, 3 probes, got %v, %v, %d",
+			config.TCPKeepAlive, config.TCPKeepAliveInterval, config.TCPKeepAliveCount)
+	}
+
+	os.Setenv("TCP_KEEPALIVE_INTERVAL", "10ms")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for TCP_KEEPALIVE_INTERVAL below 1s")
+	}
+}
+
+func TestLoadConfig_SessionLimits(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("SESSION_MAX_FILES", "100")
+	os.Setenv("SESSION_MAX_BYTES", "1073741824")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.SessionMaxFiles != 100 {
+		t.Errorf("Expected SessionMaxFiles 100, got %d", config.SessionMaxFiles)
+	}
+	if config.SessionMaxBytes != 1073741824 {
+		t.Errorf("Expected SessionMaxBytes 1073741824, got %d", config.SessionMaxBytes)
+	}
+
+	os.Setenv("SESSION_MAX_FILES", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected error for negative SESSION_MAX_FILES")
+	}
+}
+
+// Helper function to clear relevant environment variables
+func clearEnv() {
+	envVars := []string{
+		"SFTP_PORT",
+		"FTPS_PORT",
+		"FTPS_CERT_FILE",
+		"FTPS_KEY_FILE",
+		"FTPS_PASSIVE_PORTS",
+		"FTPS_PUBLIC_IP",
+		"VIRTUAL_DIR",
+		"POLICY_TAG_PREFIX",
+		"CONFIG_PARAMETER_PATH",
+		"CONFIG_PARAMETER_REFRESH",
+		"APPCONFIG_PROFILE",
+		"APPCONFIG_REFRESH",
+		"MAX_FILE_SIZE",
+		"S3_BUCKET",
+		"S3_BUCKET_PREFIX",
+		"AWS_REGION",
+		"AWS_ACCOUNT_ID",
+		"CONNECTION_TIMEOUT",
+		"READ_TIMEOUT",
+		"WRITE_TIMEOUT",
+		"MAX_CONNECTIONS",
+		"SESSION_MAX_FILES",
+		"SESSION_MAX_BYTES",
+		"TCP_KEEPALIVE",
+		"TCP_KEEPALIVE_INTERVAL",
+		"TCP_KEEPALIVE_COUNT",
+		"KEY_DATE_LAYOUT",
+		"KEY_TIMESTAMP_TZ",
+		"KEY_TIMESTAMP_TOLERANCE",
+		"STREAM_UPLOADS",
+		"MULTIPART_PART_SIZE",
+		"MULTIPART_CONCURRENCY",
+		"UPLOAD_RETRY_ATTEMPTS",
+		"UPLOAD_RETRY_BASE_DELAY",
+		"UPLOAD_RETRY_JITTER",
+		"UPLOAD_CHECKSUM",
+		"S3_STORAGE_CLASS",
+		"S3_SSE",
+		"S3_SSE_KMS_KEY_ID",
+		"S3_ENDPOINT_URL",
+		"S3_INSECURE_SKIP_VERIFY",
+		"S3_FORCE_PATH_STYLE",
+		"S3_KEY_TEMPLATE",
+		"S3_KEY_COLLISION",
+		"UPLOAD_ROUTES",
+		"REPLICA_POLICY",
+		"FAILOVER_BUCKET",
+		"OBJECT_METADATA",
+		"PARTNER_ID_PATTERN",
+		"TEMP_FILE_SUFFIXES",
+		"ALLOWED_EXTENSIONS",
+		"DENIED_EXTENSIONS",
+		"RESUME_TIMEOUT",
+		"PROGRESS_LOG_INTERVAL",
+		"SPILL_THRESHOLD",
+		"SPILL_DIR",
+		"AWS_HTTP_DIAL_TIMEOUT",
+		"AWS_HTTP_TLS_HANDSHAKE_TIMEOUT",
+		"AWS_HTTP_RESPONSE_HEADER_TIMEOUT",
+		"AWS_HTTP_MAX_IDLE_CONNS_PER_HOST",
+		"AWS_HTTP_PROXY",
+		"SSH_CA_KEYS",
+		"ASSUME_ROLE_ARN",
+		"ASSUME_ROLE_DURATION",
+		"AUTH_CACHE_TTL",
+		"AUTH_CACHE_SIZE",
+		"USERS_FILE",
+		"USERS_SECRET",
+		"USERS_SECRET_REFRESH",
+		"ALLOWED_PRINCIPALS",
+		"ALLOW_ANY_ACCOUNT",
+		"VERIFY_WRITE_ACCESS",
+		"TOTP_SECRETS_FILE",
+		"MFA_REQUIRED",
+		"AUTH_RATE_LIMIT",
+		"AUTH_RATE_BURST",
+		"AUTH_LOCKOUT_THRESHOLD",
+		"AUTH_LOCKOUT_DURATION",
+		"BAN_THRESHOLD",
+		"BAN_FIND_TIME",
+		"BAN_DURATION",
+		"GEOIP_DB",
+		"GEOIP_ALLOW_COUNTRIES",
+		"GEOIP_DENY_COUNTRIES",
+		"AUTH_WEBHOOK_URL",
+		"AUTH_WEBHOOK_TOKEN",
+		"AUTH_WEBHOOK_TIMEOUT",
+		"DELIVERY_WEBHOOK_URL",
+		"DELIVERY_WEBHOOK_SECRET",
+		"KAFKA_BROKERS",
+		"KAFKA_TOPIC",
+		"KAFKA_STORE_S3",
+		"KAFKA_MAX_MESSAGE_SIZE",
+		"KAFKA_TLS",
+		"KAFKA_SASL_USERNAME",
+		"KAFKA_SASL_PASSWORD",
+		"LDAP_URL",
+		"LDAP_BIND_DN",
+		"LDAP_BASE_DN",
+		"LDAP_USER_ATTRIBUTE",
+		"LDAP_GROUP_PREFIXES",
+		"LDAP_TIMEOUT",
+		"JWT_ISSUER",
+		"JWT_JWKS_URL",
+		"JWT_AUDIENCE",
+		"VAULT_ADDR",
+		"VAULT_AWS_MOUNT",
+		"VAULT_AWS_ROLE",
+		"USER_CONFIG_TABLE",
+		"USER_CONFIG_KEY",
+		"ALLOWED_IPS_TAG",
+		"SECURITY_FINDINGS",
+		"SECURITY_FINDINGS_BUS",
+		"UPLOAD_FAILURE_TOPIC",
+		"UPLOAD_QUEUE_URL",
+		"EVENTBRIDGE_BUS",
+		"AUDIT_BUCKET",
+		"AUDIT_PREFIX",
+		"AUDIT_INTERVAL",
+		"AUDIT_RETENTION",
+		"GUEST_USER",
+		"GUEST_PASSWORD",
+		"GUEST_PREFIX",
+		"GUEST_QUOTA",
+		"HOST_KEY_SECRET",
+		"HOST_KEY_PARAMETER",
+		"HOST_KEY_ROLLOVER",
+		"SSH_CIPHERS",
+		"SSH_MACS",
+		"SSH_KEX_ALGORITHMS",
+		"SSH_BANNER",
+		"SSH_BANNER_FILE",
+		"SSH_SERVER_VERSION",
+		"CLIENT_VERSION_ALLOW",
+		"CLIENT_VERSION_DENY",
+		"HANDSHAKE_TIMEOUT",
+		"MAX_PREAUTH_CONNECTIONS",
+		"ADMIN_ADDR",
+		"READY_CHECK_AWS",
+		"ADMIN_PPROF",
+		"ADMIN_TOKEN",
+		"OTEL_EXPORTER_OTLP_ENDPOINT",
+		"OTEL_SERVICE_NAME",
+		"OTEL_LOGS_EXPORTER",
+		"LOG_FILE",
+		"LOG_FILE_MAX_SIZE",
+		"LOG_FILE_MAX_AGE",
+		"LOG_FILE_MAX_BACKUPS",
+		"LOG_FILE_COMPRESS",
+		"ACCESS_LOG",
+		"CLOUDWATCH_LOG_GROUP",
+		"CLOUDWATCH_LOG_STREAM",
+		"CLOUDWATCH_LOG_FLUSH_INTERVAL",
+		"LOG_SAMPLE_BURST",
+		"LOG_SAMPLE_INTERVAL",
+		"SENTRY_DSN",
+		"SENTRY_ENVIRONMENT",
+	}
+
+	for _, env := range envVars {
+		os.Unsetenv(env)
+	}
+	for _, env := range configEnvVars {
+		os.Unsetenv(namespacedEnv(env))
+	}
+}
+func TestLoadConfig_AppConfig(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AppConfigProfile != "" || config.AppConfigRefresh != time.Minute {
+		t.Errorf("Expected no profile polled every 1m by default, got '%s' every %v", config.AppConfigProfile, config.AppConfigRefresh)
+	}
+
+	os.Setenv("APPCONFIG_PROFILE", "sftpgw/prod/settings")
+	os.Setenv("APPCONFIG_REFRESH", "30s")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.AppConfigProfile != "sftpgw/prod/settings" || config.AppConfigRefresh != 30*time.Second {
+		t.Errorf("Expected sftpgw/prod/settings every 30s, got '%s' every %v", config.AppConfigProfile, config.AppConfigRefresh)
+	}
+
+	os.Setenv("APPCONFIG_PROFILE", "sftpgw/settings")
+	os.Setenv("APPCONFIG_REFRESH", "5s")
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "invalid APPCONFIG_PROFILE") || !strings.Contains(err.Error(), "invalid APPCONFIG_REFRESH") {
+		t.Errorf("Expected errors for the profile and the short refresh, got: %v", err)
+	}
+}
+
+func TestLoadConfig_ConfigParameters(t *testing.T) {
+	clearEnv()
+	os.Setenv("S3_BUCKET", "test-bucket")
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("CONFIG_PARAMETER_PATH", "/sftpgw/prod")
+	os.Setenv("CONFIG_PARAMETER_REFRESH", "10m")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.ConfigParameterPath != "/sftpgw/prod" || config.ConfigParameterRefresh != 10*time.Minute {
+		t.Errorf("Expected parameters below /sftpgw/prod refreshed every 10m, got '%s' every %v", config.ConfigParameterPath, config.ConfigParameterRefresh)
+	}
+
+	os.Setenv("CONFIG_PARAMETER_PATH", "sftpgw/prod")
+	os.Setenv("CONFIG_PARAMETER_REFRESH", "30s")
+	_, err = LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "invalid CONFIG_PARAMETER_PATH") || !strings.Contains(err.Error(), "invalid CONFIG_PARAMETER_REFRESH") {
+		t.Errorf("Expected errors for relative path and short refresh, got: %v", err)
+	}
+}
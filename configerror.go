@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ConfigError is an invalid or missing setting, for tooling that reports
+// misconfigurations without parsing the text of the error. LoadConfig joins
+// one for every problem it finds; configErrors takes them apart again.
+type ConfigError struct {
+	Field   string `json:"field"`           // environment variable, such as MAX_FILE_SIZE
+	Value   string `json:"value,omitempty"` // as set, REDACTED for secrets
+	Reason  string `json:"reason"`
+	Missing bool   `json:"missing,omitempty"` // required but not set
+	Err     error  `json:"-"`                 // underlying error, if any
+}
+
+func (e *ConfigError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	if e.Missing {
+		return e.Field + " " + e.Reason
+	}
+	return "invalid " + e.Field + ": " + e.Reason
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// invalidSetting returns the error for a setting whose value is wrong, with
+// the reason formatted like fmt.Errorf, %w included.
+func invalidSetting(field, format string, args ...any) *ConfigError {
+	err := fmt.Errorf(format, args...)
+	return &ConfigError{
+		Field:  field,
+		Value:  settingValue(field),
+		Reason: err.Error(),
+		Err:    errors.Unwrap(err),
+	}
+}
+
+// missingSetting returns the error for a required setting that isn't set.
+func missingSetting(field, reason string) *ConfigError {
+	return &ConfigError{Field: field, Reason: reason, Missing: true}
+}
+
+// settingValue returns the value of an environment variable as an error may
+// show it, with secrets and the passwords in URLs redacted.
+func settingValue(field string) string {
+	value := getenv(field)
+	if value != "" && isSecretEnv(field) {
+		return redacted
+	}
+	return redactURL(value)
+}
+
+// configErrors lists the problems of an error returned while loading the
+// configuration. Errors that aren't a ConfigError are listed by their text.
+func configErrors(err error) []*ConfigError {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var problems []*ConfigError
+		for _, err := range joined.Unwrap() {
+			problems = append(problems, configErrors(err)...)
+		}
+		return problems
+	}
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return []*ConfigError{configErr}
+	}
+	return []*ConfigError{{Reason: err.Error()}}
+}
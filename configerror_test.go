@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestLoadConfig_ConfigErrors(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("AWS_ACCOUNT_ID", "123456789012")
+	os.Setenv("MAX_FILE_SIZE", "lots")
+	os.Setenv("GUEST_PASSWORD", "guest-secret")
+
+	_, err := LoadConfig()
+	problems := configErrors(err)
+	byField := make(map[string]*ConfigError)
+	for _, problem := range problems {
+		byField[problem.Field] = problem
+	}
+
+	if bucket := byField["S3_BUCKET"]; bucket == nil || !bucket.Missing || bucket.Error() != "S3_BUCKET environment variable is required" {
+		t.Errorf("S3_BUCKET problem = %+v, want it missing", bucket)
+	}
+
+	size := byField["MAX_FILE_SIZE"]
+	if size == nil || size.Value != "lots" || size.Error() != "invalid MAX_FILE_SIZE: "+size.Reason {
+		t.Fatalf("MAX_FILE_SIZE problem = %+v", size)
+	}
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Errorf("Expected the parse error to be wrapped, got %v", err)
+	}
+
+	if password := byField["GUEST_PASSWORD"]; password == nil || password.Value != redacted {
+		t.Errorf("GUEST_PASSWORD problem = %+v, want its value redacted", password)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	if problems := configErrors(nil); problems != nil {
+		t.Errorf("configErrors(nil) = %v, want none", problems)
+	}
+
+	problems := configErrors(errors.Join(invalidSetting("SFTP_PORT", "must be positive"), errors.New("failed to load AWS config")))
+	if len(problems) != 2 || problems[0].Field != "SFTP_PORT" || problems[1].Field != "" || problems[1].Reason != "failed to load AWS config" {
+		t.Errorf("configErrors() = %+v", problems)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ingestContentTypes covers file types common in partner drops that the
+// standard library doesn't know about without a system mime.types file,
+// which the scratch image doesn't have.
+var ingestContentTypes = map[string]string{
+	".csv":     "text/csv",
+	".tsv":     "text/tab-separated-values",
+	".txt":     "text/plain; charset=utf-8",
+	".log":     "text/plain; charset=utf-8",
+	".json":    "application/json",
+	".xml":     "application/xml",
+	".zip":     "application/zip",
+	".gz":      "application/gzip",
+	".tgz":     "application/gzip",
+	".tar":     "application/x-tar",
+	".7z":      "application/x-7z-compressed",
+	".pgp":     "application/pgp-encrypted",
+	".gpg":     "application/pgp-encrypted",
+	".asc":     "application/pgp-signature",
+	".xls":     "application/vnd.ms-excel",
+	".xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".doc":     "application/msword",
+	".docx":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".edi":     "application/edi-x12",
+	".parquet": "application/vnd.apache.parquet",
+}
+
+// readHead returns the first bytes of body, enough for detectContentType.
+func readHead(body io.ReaderAt, size int64) []byte {
+	head := make([]byte, min(size, 512))
+	n, _ := body.ReadAt(head, 0)
+	return head[:n]
+}
+
+// detectContentType picks the Content-Type for an uploaded file from its
+// extension, falling back to sniffing the first bytes of its content.
+func detectContentType(filePath string, head []byte) string {
+	ext := strings.ToLower(path.Ext(filePath))
+	if contentType, ok := ingestContentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); ext != "" && contentType != "" {
+		return contentType
+	}
+
+	// http.DetectContentType considers at most 512 bytes
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return http.DetectContentType(head)
+}
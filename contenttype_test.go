@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestDetectContentType(t *testing.T) {
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	tests := []struct {
+		name     string
+		filePath string
+		head     []byte
+		expected string
+	}{
+		{
+			name:     "csv by extension",
+			filePath: "/uploads/report.csv",
+			head:     []byte("a,b,c\n1,2,3\n"),
+			expected: "text/csv",
+		},
+		{
+			name:     "extension is case insensitive",
+			filePath: "/uploads/REPORT.CSV",
+			expected: "text/csv",
+		},
+		{
+			name:     "pgp by extension",
+			filePath: "/uploads/payload.csv.pgp",
+			head:     []byte{0x85, 0x01, 0x0c, 0x03},
+			expected: "application/pgp-encrypted",
+		},
+		{
+			name:     "standard library extension",
+			filePath: "/uploads/invoice.pdf",
+			expected: "application/pdf",
+		},
+		{
+			name:     "sniffed when extension is missing",
+			filePath: "/uploads/image",
+			head:     pngHeader,
+			expected: "image/png",
+		},
+		{
+			name:     "sniffed when extension is unknown",
+			filePath: "/uploads/data.bin",
+			head:     []byte{0x00, 0x01, 0x02, 0x03},
+			expected: "application/octet-stream",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := detectContentType(tt.filePath, tt.head); result != tt.expected {
+				t.Errorf("detectContentType(%q) = %q, want %q", tt.filePath, result, tt.expected)
+			}
+		})
+	}
+}
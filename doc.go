@@ -0,0 +1,19 @@
+// Command sftpgw is an SFTP and SCP server that stores uploaded files in S3.
+//
+// The gateway is a single package main. The pieces an embedding program
+// would need are:
+//
+//   - Config and LoadConfig, the settings read from the environment;
+//   - SFTPServer, which accepts SSH connections and sets up the login
+//     callbacks (Authenticator and the wrap* functions around it);
+//   - SFTPHandler and SessionSFTPHandler, which receive the files of a
+//     session and apply the path, size, quota and extension limits;
+//   - S3Uploader and S3Stream, which store a file in S3 in one request or as
+//     a multipart upload.
+//
+// These are not importable yet. Moving them into packages below pkg/ needs a
+// stable constructor API first, because they share unexported state such as
+// uploadSession and the ssh.Permissions extensions set at login; until then
+// other programs run the gateway as a separate process, and can manage it
+// through its admin API with the client in package adminclient.
+package main
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+)
+
+// configSecrets are the settings holding credentials, by field of Config
+// and by environment variable. Their values never show up in the logs or in
+// a ConfigError.
+var configSecrets = []struct {
+	field, env string
+}{
+	{"AdminToken", "ADMIN_TOKEN"},
+	{"AuthWebhookToken", "AUTH_WEBHOOK_TOKEN"},
+	{"DeliveryWebhookSecret", "DELIVERY_WEBHOOK_SECRET"},
+	{"GuestPassword", "GUEST_PASSWORD"},
+	{"KafkaSASLPassword", "KAFKA_SASL_PASSWORD"},
+}
+
+// isSecretField reports whether the field of Config holds a credential.
+func isSecretField(name string) bool {
+	return slices.ContainsFunc(configSecrets, func(secret struct{ field, env string }) bool { return secret.field == name })
+}
+
+// isSecretEnv reports whether the environment variable holds a credential.
+func isSecretEnv(name string) bool {
+	return slices.ContainsFunc(configSecrets, func(secret struct{ field, env string }) bool { return secret.env == name })
+}
+
+const redacted = "REDACTED"
+
+// effectiveConfig returns the settings the gateway runs with, after defaults,
+// the environment, flags and Parameter Store were applied, as log
+// attributes named after the fields of Config. Settings that are unset or
+// zero are left out. Secrets are replaced by REDACTED, as are passwords and
+// keys in URLs such as SENTRY_DSN or AWS_HTTP_PROXY.
+func effectiveConfig(config *Config) []any {
+	var attrs []any
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if value.IsZero() {
+			continue
+		}
+		if isSecretField(field.Name) {
+			attrs = append(attrs, slog.String(field.Name, redacted))
+			continue
+		}
+		attrs = append(attrs, slog.Any(field.Name, configValue(value)))
+	}
+	return attrs
+}
+
+// configValue turns a setting into something every log handler prints
+// readably, such as a pattern instead of a compiled regexp.
+func configValue(v reflect.Value) any {
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return redactURL(v.String())
+	case reflect.Slice:
+		values := make([]any, v.Len())
+		for i := range values {
+			values[i] = configValue(v.Index(i))
+		}
+		return values
+	}
+	return v.Interface()
+}
+
+// redactURL hides the user info of a URL, which holds the key of a Sentry
+// DSN or the password of a proxy. Other values are returned unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil || u.Host == "" {
+		return value
+	}
+	u.User = url.User(redacted)
+	return u.String()
+}
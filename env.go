@@ -0,0 +1,34 @@
+package main
+
+import "os"
+
+// envPrefix namespaces the settings, so they don't collide with variables
+// other software reads: SFTPGW_S3_BUCKET sets S3_BUCKET, and
+// SFTPGW_AWS_REGION sets the gateway's region without changing the one
+// other programs using the AWS SDK pick. The names without the prefix keep
+// working.
+const envPrefix = "SFTPGW_"
+
+// namespacedEnvNames are the namespaced names that aren't just the prefix
+// followed by the setting's name.
+var namespacedEnvNames = map[string]string{
+	"SFTP_PORT": "SFTPGW_PORT",
+}
+
+// namespacedEnv returns the namespaced name of a setting, such as
+// SFTPGW_S3_BUCKET for S3_BUCKET.
+func namespacedEnv(name string) string {
+	if namespaced, ok := namespacedEnvNames[name]; ok {
+		return namespaced
+	}
+	return envPrefix + name
+}
+
+// getenv returns the value of a setting from its namespaced variable, or
+// from the variable without the prefix if that isn't set.
+func getenv(name string) string {
+	if value := os.Getenv(namespacedEnv(name)); value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
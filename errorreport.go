@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPendingReports = 100 // reports beyond this are dropped until the queue drains
+	sentryClient      = "sftpgw/1.0"
+)
+
+// Attributes that become searchable tags of a report, wherever they appear
+// in the log record's groups.
+var reportTags = []string{"session_id", "remote_ip", "user", "access_key_id", "file_path", "bucket", "s3_key"}
+
+// appPackage is the name of this package in stack traces: main, or its
+// import path in tests.
+var appPackage = reflect.TypeOf(errorReporter{}).PkgPath()
+
+// errorReporter sends errors and panics to Sentry, or a compatible service
+// such as GlitchTip, at SENTRY_DSN, with a stack trace and the session, key
+// and path they happened for. Reports are sent in the background with the
+// envelope API, which is simple enough to implement here instead of pulling
+// in the Sentry SDK. Problems sending them are reported on stderr, since
+// logging them would report them again. A nil errorReporter reports
+// nothing.
+type errorReporter struct {
+	endpoint    string // envelope URL of the project
+	auth        string // X-Sentry-Auth header
+	dsn         string
+	environment string
+	release     string // the version, see version.go
+	serverName  string
+	client      *http.Client
+	timeFunc    func() time.Time
+
+	mu     sync.Mutex
+	queue  chan []byte // envelopes
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// parseSentryDSN returns the envelope URL and public key of a DSN of the
+// form https://KEY@HOST/PROJECT.
+func parseSentryDSN(s string) (string, string, error) {
+	dsn, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	key := dsn.User.Username()
+	// the project ID may follow a path prefix
+	path, project := "", strings.Trim(dsn.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		path, project = project[:i+1], project[i+1:]
+	}
+	if key == "" || project == "" || (dsn.Scheme != "https" && dsn.Scheme != "http") {
+		return "", "", fmt.Errorf("not a DSN of the form https://KEY@HOST/PROJECT")
+	}
+	return fmt.Sprintf("%s://%s/%sapi/%s/envelope/", dsn.Scheme, dsn.Host, path, project), key, nil
+}
+
+func newErrorReporter(config *Config) (*errorReporter, error) {
+	endpoint, key, err := parseSentryDSN(config.SentryDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &errorReporter{
+		endpoint:    endpoint,
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=%s", key, sentryClient),
+		dsn:         config.SentryDSN,
+		environment: config.SentryEnvironment,
+		release:     "sftpgw@" + version,
+		serverName:  "sftpgw",
+		client:      &http.Client{Timeout: 10 * time.Second},
+		timeFunc:    time.Now,
+		queue:       make(chan []byte, maxPendingReports),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		r.serverName = hostname
+	}
+	return r, nil
+}
+
+// sentryFrame is a stack frame, sent oldest first.
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"` // "error", or "fatal" for panics
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger,omitempty"`
+	ServerName  string            `json:"server_name"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Message     string            `json:"message"`
+	Exception   []sentryException `json:"exception"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+}
+
+// start sends reports until close is called.
+func (r *errorReporter) start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for envelope := range r.queue {
+			if err := r.send(envelope); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to send error report: %v\n", err)
+			}
+		}
+	}()
+}
+
+// close sends the queued reports and stops.
+func (r *errorReporter) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		fmt.Fprintf(os.Stderr, "gave up sending %d error reports\n", len(r.queue))
+	}
+}
+
+// report queues an event with the stack of its caller, skipping skip
+// frames, and with attrs as tags and extra data.
+func (r *errorReporter) report(level, errorType, message string, attrs map[string]any, skip int) {
+	envelope, err := r.envelope(r.newEvent(level, errorType, message, attrs, skip+1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode error report: %v\n", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- envelope:
+	default:
+		fmt.Fprintf(os.Stderr, "error report dropped: queue full\n")
+	}
+}
+
+func (r *errorReporter) newEvent(level, errorType, message string, attrs map[string]any, skip int) sentryEvent {
+	event := sentryEvent{
+		EventID:     newEventID(),
+		Timestamp:   r.timeFunc().UTC().Format(time.RFC3339Nano),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "sftpgw",
+		ServerName:  r.serverName,
+		Environment: r.environment,
+		Release:     r.release,
+		Message:     message,
+		Extra:       attrs,
+	}
+	for _, tag := range reportTags {
+		if value, ok := attrs[tag].(string); ok && value != "" {
+			if event.Tags == nil {
+				event.Tags = make(map[string]string)
+			}
+			event.Tags[tag] = value
+		}
+	}
+
+	exception := sentryException{Type: errorType, Value: message}
+	if err, ok := attrs["error"].(string); ok {
+		exception.Value = message + ": " + err
+	}
+	exception.Stacktrace.Frames = stackFrames(skip + 1)
+	event.Exception = []sentryException{exception}
+	return event
+}
+
+// recoverPanic reports a panic of the calling goroutine and panics again,
+// so the gateway still crashes as it would without SENTRY_DSN. The report
+// is sent right away, since the process is about to exit. It must be
+// deferred directly.
+func (r *errorReporter) recoverPanic() {
+	if r == nil {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	// skip recoverPanic and the runtime's panic frame
+	envelope, err := r.envelope(r.newEvent("fatal", "panic", fmt.Sprint(v), nil, 2))
+	if err == nil {
+		err = r.send(envelope)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send panic report: %v\n", err)
+	}
+	panic(v)
+}
+
+// envelope encodes event as a single item envelope.
+func (r *errorReporter) envelope(event sentryEvent) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	header, _ := json.Marshal(map[string]string{"event_id": event.EventID, "dsn": r.dsn, "sent_at": event.Timestamp})
+	buf.Write(header)
+	buf.WriteByte('\n')
+	fmt.Fprintf(&buf, `{"type":"event","length":%d}`+"\n", len(payload))
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (r *errorReporter) send(envelope []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", r.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func newEventID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// stackFrames returns the stack of the caller, skipping skip frames, oldest
+// first as Sentry expects.
+func stackFrames(skip int) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		module, function := splitFunctionName(frame.Function)
+		stack = append(stack, sentryFrame{
+			Function: function,
+			Module:   module,
+			Filename: frame.File[strings.LastIndex(frame.File, "/")+1:],
+			AbsPath:  frame.File,
+			Lineno:   frame.Line,
+			InApp:    module == appPackage,
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// splitFunctionName splits a name such as log/slog.(*Logger).Error into
+// the package and the function.
+func splitFunctionName(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot], name[slash+2+dot:]
+	}
+	return "", name
+}
+
+// reportingHandler reports log entries at level Error and above before
+// passing them on, with their attributes flattened into the report.
+type reportingHandler struct {
+	slog.Handler
+	reporter *errorReporter
+	attrs    map[string]any // from WithAttrs, keyed by their full name
+	group    string         // prefix of the attributes added later
+}
+
+func newReportingHandler(next slog.Handler, reporter *errorReporter) slog.Handler {
+	return &reportingHandler{Handler: next, reporter: reporter}
+}
+
+func (h *reportingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError {
+		attrs := make(map[string]any, len(h.attrs)+record.NumAttrs())
+		for name, value := range h.attrs {
+			attrs[name] = value
+		}
+		record.Attrs(func(a slog.Attr) bool {
+			flattenAttr(attrs, h.group, a)
+			return true
+		})
+		// skip Handle and the slog frames that called it
+		h.reporter.report("error", "error", record.Message, attrs, 3)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *reportingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	flattened := make(map[string]any, len(h.attrs)+len(attrs))
+	for name, value := range h.attrs {
+		flattened[name] = value
+	}
+	for _, a := range attrs {
+		flattenAttr(flattened, h.group, a)
+	}
+	return &reportingHandler{Handler: h.Handler.WithAttrs(attrs), reporter: h.reporter, attrs: flattened, group: h.group}
+}
+
+func (h *reportingHandler) WithGroup(name string) slog.Handler {
+	return &reportingHandler{Handler: h.Handler.WithGroup(name), reporter: h.reporter, attrs: h.attrs, group: h.group + name + "."}
+}
+
+// flattenAttr adds a to attrs. Attributes in groups, such as the s3_upload
+// context of upload logs, are added under their own key as well as their
+// full name, so the tags are found wherever they are logged.
+func flattenAttr(attrs map[string]any, prefix string, a slog.Attr) {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			flattenAttr(attrs, prefix+a.Key+".", member)
+		}
+		return
+	}
+	switch value.Kind() {
+	case slog.KindBool, slog.KindInt64, slog.KindUint64, slog.KindFloat64:
+		attrs[prefix+a.Key] = value.Any()
+	default:
+		// anything else as text, so the report always encodes
+		attrs[prefix+a.Key] = value.String()
+	}
+	if prefix != "" {
+		if _, ok := attrs[a.Key]; !ok {
+			attrs[a.Key] = attrs[prefix+a.Key]
+		}
+	}
+}
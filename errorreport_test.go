@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		endpoint string
+		wantErr  bool
+	}{
+		{dsn: "https://abc123@o42.ingest.sentry.io/4506", endpoint: "https://o42.ingest.sentry.io/api/4506/envelope/"},
+		{dsn: "https://abc123@glitchtip.example.com/errors/7", endpoint: "https://glitchtip.example.com/errors/api/7/envelope/"},
+		{dsn: "http://abc123@localhost:9000/1/", endpoint: "http://localhost:9000/api/1/envelope/"},
+		{dsn: "https://o42.ingest.sentry.io/4506", wantErr: true},
+		{dsn: "https://abc123@o42.ingest.sentry.io/", wantErr: true},
+		{dsn: "ftp://abc123@o42.ingest.sentry.io/4506", wantErr: true},
+	}
+	for _, tt := range tests {
+		endpoint, key, err := parseSentryDSN(tt.dsn)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSentryDSN(%q) expected error", tt.dsn)
+			}
+			continue
+		}
+		if err != nil || endpoint != tt.endpoint || key != "abc123" {
+			t.Errorf("parseSentryDSN(%q) = %q, %q, %v, want %q, abc123", tt.dsn, endpoint, key, err, tt.endpoint)
+		}
+	}
+}
+
+// newTestErrorReporter returns a reporter sending to a server that records
+// the events it receives.
+func newTestErrorReporter(t *testing.T) (*errorReporter, func() []sentryEvent) {
+	t.Helper()
+	var mu sync.Mutex
+	var events []sentryEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/4506/envelope/" {
+			t.Errorf("request to %s, want /api/4506/envelope/", r.URL.Path)
+		}
+		if auth := r.Header.Get("X-Sentry-Auth"); auth != "Sentry sentry_version=7, sentry_key=abc123, sentry_client=sftpgw/1.0" {
+			t.Errorf("X-Sentry-Auth = %s", auth)
+		}
+		body, _ := io.ReadAll(r.Body)
+		lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+		if len(lines) != 3 {
+			t.Errorf("envelope has %d lines, want 3:\n%s", len(lines), body)
+			return
+		}
+		var event sentryEvent
+		if err := json.Unmarshal(lines[2], &event); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	r, err := newErrorReporter(&Config{SentryDSN: "http://abc123@" + server.Listener.Addr().String() + "/4506", SentryEnvironment: "test"})
+	if err != nil {
+		t.Fatalf("newErrorReporter() unexpected error: %v", err)
+	}
+	return r, func() []sentryEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+}
+
+func TestReportingHandler(t *testing.T) {
+	r, received := newTestErrorReporter(t)
+	r.start()
+	logger := slog.New(newReportingHandler(slog.NewJSONHandler(io.Discard, nil), r))
+
+	logger.Info("file upload started")
+	logger.With("session_id", "9f86d081884c7d65").Error("failed to upload file to S3", slog.Group("s3_upload",
+		slog.String("file_path", "/uploads/a.csv"),
+		slog.String("error", "AccessDenied"),
+		slog.Int64("size", 2048),
+	))
+	r.close()
+
+	events := received()
+	if len(events) != 1 {
+		t.Fatalf("received %d events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Level != "error" || event.Environment != "test" || event.Message != "failed to upload file to S3" {
+		t.Errorf("event = %+v", event)
+	}
+	if event.Tags["session_id"] != "9f86d081884c7d65" || event.Tags["file_path"] != "/uploads/a.csv" {
+		t.Errorf("tags = %v, want session_id and file_path", event.Tags)
+	}
+	if event.Extra["s3_upload.size"] != float64(2048) {
+		t.Errorf("extra = %v, want s3_upload.size 2048", event.Extra)
+	}
+	if len(event.Exception) != 1 || event.Exception[0].Value != "failed to upload file to S3: AccessDenied" {
+		t.Fatalf("exception = %+v", event.Exception)
+	}
+	frames := event.Exception[0].Stacktrace.Frames
+	if len(frames) == 0 || frames[len(frames)-1].Function != "TestReportingHandler" || !frames[len(frames)-1].InApp {
+		t.Errorf("stack ends in %+v, want TestReportingHandler", frames[len(frames)-1])
+	}
+}
+
+func TestErrorReporter_RecoverPanic(t *testing.T) {
+	r, received := newTestErrorReporter(t)
+
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("recovered %v, want the panic to continue", v)
+			}
+		}()
+		defer r.recoverPanic()
+		panicForTest()
+	}()
+
+	events := received()
+	if len(events) != 1 || events[0].Level != "fatal" || events[0].Message != "boom" {
+		t.Fatalf("events = %+v, want one fatal event", events)
+	}
+	frames := events[0].Exception[0].Stacktrace.Frames
+	if last := frames[len(frames)-1]; last.Function != "panicForTest" {
+		t.Errorf("stack ends in %+v, want panicForTest", last)
+	}
+}
+
+func panicForTest() {
+	panic("boom")
+}
+
+func TestErrorReporter_Nil(t *testing.T) {
+	var r *errorReporter
+	defer r.close()
+	defer r.recoverPanic()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Detail types of lifecycle events.
+const (
+	eventSessionStarted  = "SessionStarted"
+	eventSessionEnded    = "SessionEnded"
+	eventUploadCompleted = "UploadCompleted"
+	eventUploadFailed    = "UploadFailed"
+)
+
+// sessionEventDetail is the detail of SessionStarted and SessionEnded.
+type sessionEventDetail struct {
+	SessionID     string  `json:"session_id"`
+	User          string  `json:"user"`
+	RemoteIP      string  `json:"remote_ip"`
+	Country       string  `json:"country,omitempty"`
+	Port          int     `json:"port"`
+	ClientVersion string  `json:"client_version"`
+	Duration      float64 `json:"duration_seconds,omitempty"` // SessionEnded only
+	BytesReceived int64   `json:"bytes_received,omitempty"`
+	BytesSent     int64   `json:"bytes_sent,omitempty"`
+}
+
+// uploadEventDetail is the detail of UploadCompleted and UploadFailed.
+type uploadEventDetail struct {
+	uploadFields
+	Error string `json:"error,omitempty"` // UploadFailed only
+}
+
+// eventEntry is a PutEvents request entry.
+type eventEntry struct {
+	Time         int64 // seconds since the epoch
+	Source       string
+	DetailType   string
+	Detail       string
+	EventBusName string
+}
+
+// lifecycleEvents puts an EventBridge event on EVENTBRIDGE_BUS when a
+// session starts or ends and when a file was stored or couldn't be, so
+// downstream automation can react to new files without polling S3. A nil
+// lifecycleEvents sends nothing.
+type lifecycleEvents struct {
+	asyncSender[eventEntry]
+
+	bus string
+}
+
+func newLifecycleEvents(cfg *Config, awsConfig aws.Config, logger *slog.Logger) *lifecycleEvents {
+	client := newAWSJSONClient(awsConfig, "events", "AWSEvents", "1.1")
+	e := &lifecycleEvents{
+		asyncSender: newAsyncSender[eventEntry]("lifecycle events", client, 1000, 10, logger),
+		bus:         cfg.EventBridgeBus,
+	}
+	e.logAttrs = []any{slog.String("bus", e.bus)}
+	e.deliver = e.send
+	return e
+}
+
+func (e *lifecycleEvents) sessionStarted(session *activeSession) {
+	if e == nil {
+		return
+	}
+	e.put(eventSessionStarted, session.eventDetail())
+}
+
+func (e *lifecycleEvents) sessionEnded(session *activeSession) {
+	if e == nil {
+		return
+	}
+	detail := session.eventDetail()
+	detail.Duration = e.timeFunc().Sub(session.connected).Seconds()
+	detail.BytesReceived = session.conn.received.Load()
+	detail.BytesSent = session.conn.sent.Load()
+	e.put(eventSessionEnded, detail)
+}
+
+func (s *activeSession) eventDetail() sessionEventDetail {
+	return sessionEventDetail{
+		SessionID:     s.id,
+		User:          s.user,
+		RemoteIP:      s.remoteIP,
+		Country:       s.country,
+		Port:          s.port,
+		ClientVersion: s.clientVersion,
+	}
+}
+
+// uploadCompleted reports a file of session stored under key in bucket.
+func (e *lifecycleEvents) uploadCompleted(session uploadSession, filePath, bucket, key string, size int64) {
+	if e == nil {
+		return
+	}
+	e.put(eventUploadCompleted, uploadEventDetail{uploadFields: newUploadFields(session, filePath, bucket, key, size)})
+}
+
+// uploadFailed reports a file of session that couldn't be stored. key is
+// empty if it wasn't chosen yet.
+func (e *lifecycleEvents) uploadFailed(session uploadSession, filePath, bucket, key string, size int64, err error) {
+	if e == nil {
+		return
+	}
+	e.put(eventUploadFailed, uploadEventDetail{
+		uploadFields: newUploadFields(session, filePath, bucket, key, size),
+		Error:        err.Error(),
+	})
+}
+
+// put queues an event.
+func (e *lifecycleEvents) put(detailType string, detail any) {
+	body, err := json.Marshal(detail)
+	if err != nil {
+		return
+	}
+	e.enqueue(eventEntry{
+		Time:         e.timeFunc().Unix(),
+		Source:       "sftpgw",
+		DetailType:   detailType,
+		Detail:       string(body),
+		EventBusName: e.bus,
+	}, slog.String("detail_type", detailType))
+}
+
+// send puts a batch of at most 10 events with PutEvents.
+func (e *lifecycleEvents) send(ctx context.Context, batch []eventEntry) error {
+	var result struct {
+		FailedEntryCount int
+		Entries          []struct{ ErrorCode, ErrorMessage string }
+	}
+	if err := e.client.call(ctx, "PutEvents", map[string]any{"Entries": batch}, &result); err != nil {
+		return err
+	}
+	if result.FailedEntryCount > 0 {
+		for _, r := range result.Entries {
+			if r.ErrorCode != "" {
+				return fmt.Errorf("eventbridge rejected %d events: %s: %s", result.FailedEntryCount, r.ErrorCode, r.ErrorMessage)
+			}
+		}
+		return fmt.Errorf("eventbridge rejected %d events", result.FailedEntryCount)
+	}
+	return nil
+}
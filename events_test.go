@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func newTestLifecycleEvents(t *testing.T, handler http.HandlerFunc) *lifecycleEvents {
+	return newTestAWSSender(t, time.Date(2024, 1, 15, 15, 30, 45, 0, time.UTC), handler, func(awsConfig aws.Config) *lifecycleEvents {
+		return newLifecycleEvents(&Config{EventBridgeBus: "sftp"}, awsConfig, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	})
+}
+
+func TestLifecycleEvents_Sessions(t *testing.T) {
+	e := newTestLifecycleEvents(t, nil)
+
+	conn := &timeoutConn{}
+	conn.received.Store(4096)
+	session := &activeSession{
+		id:            "0123456789abcdef",
+		user:          "alice",
+		remoteIP:      "203.0.113.7",
+		country:       "NL",
+		port:          2222,
+		clientVersion: "SSH-2.0-OpenSSH_9.6",
+		connected:     time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC),
+		conn:          conn,
+	}
+	e.sessionStarted(session)
+	e.sessionEnded(session)
+
+	started, ended := <-e.queue, <-e.queue
+	if started.DetailType != eventSessionStarted || started.Source != "sftpgw" || started.EventBusName != "sftp" {
+		t.Errorf("first event = %+v, want SessionStarted from sftpgw on sftp", started)
+	}
+	if ended.DetailType != eventSessionEnded || ended.Time != 1705332645 {
+		t.Errorf("second event = %+v, want SessionEnded at 15:30:45", ended)
+	}
+
+	var detail sessionEventDetail
+	if err := json.Unmarshal([]byte(ended.Detail), &detail); err != nil {
+		t.Fatalf("invalid detail: %v", err)
+	}
+	want := sessionEventDetail{
+		SessionID:     "0123456789abcdef",
+		User:          "alice",
+		RemoteIP:      "203.0.113.7",
+		Country:       "NL",
+		Port:          2222,
+		ClientVersion: "SSH-2.0-OpenSSH_9.6",
+		Duration:      3600,
+		BytesReceived: 4096,
+	}
+	if detail != want {
+		t.Errorf("SessionEnded detail = %+v, want %+v", detail, want)
+	}
+}
+
+func TestLifecycleEvents_Send(t *testing.T) {
+	var entries []eventEntry
+	e := newTestLifecycleEvents(t, func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AWSEvents.PutEvents" {
+			t.Errorf("X-Amz-Target = %s, want AWSEvents.PutEvents", target)
+		}
+		var input struct{ Entries []eventEntry }
+		json.NewDecoder(r.Body).Decode(&input)
+		entries = input.Entries
+		w.Write([]byte(`{"FailedEntryCount": 0, "Entries": [{"EventId": "1"}, {"EventId": "2"}]}`))
+	})
+
+	session := uploadSession{user: "acme", sessionID: "0123456789abcdef", clientIP: "203.0.113.7"}
+	e.uploadCompleted(session, "/uploads/orders.csv", "partner-drops", "2024-01-15/orders.csv", 2048)
+	e.uploadFailed(session, "/uploads/invoices.csv", "partner-drops", "", 512, errors.New("AccessDenied"))
+	if err := e.send(context.Background(), []eventEntry{<-e.queue, <-e.queue}); err != nil {
+		t.Fatalf("send() unexpected error: %v", err)
+	}
+
+	if len(entries) != 2 || entries[0].DetailType != eventUploadCompleted || entries[1].DetailType != eventUploadFailed {
+		t.Fatalf("entries = %+v, want UploadCompleted and UploadFailed", entries)
+	}
+	var detail uploadEventDetail
+	json.Unmarshal([]byte(entries[1].Detail), &detail)
+	if detail.FilePath != "/uploads/invoices.csv" || detail.Bucket != "partner-drops" || detail.Size != 512 || detail.Error != "AccessDenied" {
+		t.Errorf("UploadFailed detail = %+v", detail)
+	}
+}
+
+func TestLifecycleEvents_SendRejected(t *testing.T) {
+	e := newTestLifecycleEvents(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"FailedEntryCount": 1, "Entries": [{"ErrorCode": "InternalFailure", "ErrorMessage": "try again"}]}`))
+	})
+	if err := e.send(context.Background(), []eventEntry{{DetailType: eventSessionStarted}}); err == nil {
+		t.Error("send() expected error for rejected events")
+	}
+}
+
+func TestFileWriter_Close_PutsUploadCompleted(t *testing.T) {
+	config := &Config{MaxFileSize: 1024, StreamUploads: true, MultipartPartSize: 1024}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	handler.events = &lifecycleEvents{asyncSender: newAsyncSender[eventEntry]("lifecycle events", nil, 1, 10, handler.logger)}
+
+	writer := &FileWriter{
+		upload:  &FileUpload{path: "/uploads/test.txt", user: "acme", stream: newTestStream(&fakeS3Client{}, config.MultipartPartSize)},
+		handler: handler,
+		logger:  handler.logger,
+	}
+	writer.WriteAt([]byte("abc"), 0)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	select {
+	case entry := <-handler.events.queue:
+		var detail uploadEventDetail
+		json.Unmarshal([]byte(entry.Detail), &detail)
+		if entry.DetailType != eventUploadCompleted || detail.Key != "2023-12-25/test.txt" || detail.Bucket != "test-bucket" || detail.Size != 3 {
+			t.Errorf("event = %s %+v, want UploadCompleted of the stored file", entry.DetailType, detail)
+		}
+	default:
+		t.Error("no event queued for the stored file")
+	}
+}
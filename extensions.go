@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errExtensionNotAllowed is returned for files rejected by ALLOWED_EXTENSIONS,
+// DENIED_EXTENSIONS or the allowed extensions of the user. SFTP clients
+// show it as permission denied along with the reason.
+var errExtensionNotAllowed = fmt.Errorf("file extension not allowed: %w", os.ErrPermission)
+
+// extensionDenied reports whether the file name ends in one of denied.
+func extensionDenied(name string, denied []string) bool {
+	lower := strings.ToLower(name)
+	for _, extension := range denied {
+		if strings.HasSuffix(lower, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExtension applies the gateway's extension policy and the allowed
+// extensions of the user to the name a file is stored under. A file must
+// pass both lists; DENIED_EXTENSIONS wins over any of them.
+func (h *SFTPHandler) checkExtension(name string, userAllowed []string) error {
+	settings := h.settings()
+	if extensionDenied(name, settings.DeniedExtensions) ||
+		!extensionAllowed(name, settings.AllowedExtensions) ||
+		!extensionAllowed(name, userAllowed) {
+		return errExtensionNotAllowed
+	}
+	return nil
+}
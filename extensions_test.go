@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestSFTPHandler_CheckExtension(t *testing.T) {
+	config := &Config{
+		AllowedExtensions: []string{".csv", ".pgp", ".csv.gz"},
+		DeniedExtensions:  []string{".exe"},
+	}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	tests := []struct {
+		name        string
+		userAllowed []string
+		wantErr     bool
+	}{
+		{"/uploads/report.csv", nil, false},
+		{"/uploads/REPORT.PGP", nil, false},
+		{"/uploads/report.csv.gz", nil, false},
+		{"/uploads/setup.exe", nil, true},
+		{"/uploads/notes.txt", nil, true},
+		{"/uploads/report", nil, true},
+		{"/uploads/report.csv", []string{".pgp"}, true},
+		{"/uploads/report.pgp", []string{".pgp"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handler.checkExtension(tt.name, tt.userAllowed)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkExtension(%q, %v) = %v, wantErr %v", tt.name, tt.userAllowed, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, os.ErrPermission) {
+				t.Errorf("checkExtension(%q) = %v, want a permission error", tt.name, err)
+			}
+		})
+	}
+
+	config.AllowedExtensions = nil
+	if err := handler.checkExtension("/uploads/notes.txt", nil); err != nil {
+		t.Errorf("checkExtension() with only denied extensions = %v, want nil", err)
+	}
+	if err := handler.checkExtension("/uploads/setup.EXE", nil); err == nil {
+		t.Error("checkExtension() expected error for a denied extension in upper case")
+	}
+}
+
+func TestFileWriter_CloseRechecksExtension(t *testing.T) {
+	config := &Config{
+		VirtualDir:        "/uploads",
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 1024,
+	}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	client := &fakeS3Client{}
+	writer := &FileWriter{
+		upload: &FileUpload{
+			path:   "/uploads/setup.exe",
+			stream: newTestStream(client, config.MultipartPartSize),
+		},
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+	writer.WriteAt([]byte("MZ"), 0)
+
+	// resumed by a session whose user may only upload .csv files
+	writer.upload.extensions = []string{".csv"}
+	if err := writer.Close(); !errors.Is(err, errExtensionNotAllowed) {
+		t.Errorf("Close() = %v, want %v", err, errExtensionNotAllowed)
+	}
+	if client.completed || client.putObject != nil {
+		t.Error("Close() stored a file whose extension is not allowed")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// failoverTag is the object tag that records which bucket a file stored in
+// FAILOVER_BUCKET was meant for.
+const failoverTag = "sftpgw-failover-from"
+
+// storeFailover stores a file in FAILOVER_BUCKET when putting it into its own
+// bucket with input failed with cause because that bucket couldn't be
+// reached, rather than because it refused the file. The object is tagged
+// with the bucket it was meant for, so it can be moved there later. On
+// success input names the bucket and key the file was stored under;
+// otherwise the error includes cause.
+func (u *S3Uploader) storeFailover(ctx context.Context, client s3API, logCtx slog.Attr, input *s3.PutObjectInput, body io.ReaderAt, size int64, cause error) error {
+	bucket := aws.ToString(input.Bucket)
+	if u.failover.bucket == "" || u.failover.bucket == bucket || !canFailover(cause) {
+		return cause
+	}
+
+	u.logger.Warn("S3 upload failed, storing file in failover bucket", logCtx,
+		slog.String("failover_bucket", u.failover.String()),
+		slog.String("error", cause.Error()),
+	)
+
+	put := *input
+	put.Bucket = aws.String(u.failover.bucket)
+	put.SSEKMSKeyId = nil
+	put.Tagging = aws.String(failoverTag + "=" + url.QueryEscape(bucket))
+	if err := u.putObject(ctx, client, logCtx, &put, body, size, u.failover.inRegion); err != nil {
+		u.logger.Error("S3 failover upload failed", logCtx,
+			slog.String("failover_bucket", u.failover.String()),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf("%w (failover to %s failed too: %v)", cause, u.failover.bucket, err)
+	}
+
+	u.logger.Info("S3 failover upload successful", logCtx,
+		slog.String("failover_bucket", u.failover.String()),
+		slog.String("s3_key", aws.ToString(put.Key)),
+	)
+	*input = put
+	return nil
+}
+
+// canFailover reports whether an upload that failed with err may be
+// stored in FAILOVER_BUCKET: S3 couldn't be reached or kept failing, but
+// neither the credentials nor the key were refused.
+func canFailover(err error) bool {
+	return !errors.Is(err, errObjectExists) && isRetryableError(err)
+}
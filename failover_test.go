@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestS3Stream_Failover(t *testing.T) {
+	client := &fakeS3Client{failBucket: "test-bucket"}
+	stream := newTestStream(client, 10)
+	stream.uploader.failover = regionalBucket{bucket: "acme-failover", region: "eu-west-1"}
+	stream.Write([]byte("hello"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+	if stream.bucket != "acme-failover" || client.replicas["acme-failover@eu-west-1"] != "2023-12-25/test.txt" {
+		t.Errorf("expected the file in the failover bucket, got bucket %q and %v", stream.bucket, client.replicas)
+	}
+	if client.tagging != "sftpgw-failover-from=test-bucket" {
+		t.Errorf("tagging = %q, want the bucket the file was meant for", client.tagging)
+	}
+
+	// without FAILOVER_BUCKET the upload fails
+	client = &fakeS3Client{failBucket: "test-bucket"}
+	stream = newTestStream(client, 10)
+	stream.Write([]byte("hello"))
+	if err := stream.Complete(); err == nil {
+		t.Error("expected an error without a failover bucket")
+	}
+
+	// a file the bucket refuses isn't stored elsewhere
+	client = &fakeS3Client{existing: map[string]bool{"2023-12-25/test.txt": true}}
+	stream = newTestStream(client, 10)
+	stream.uploader.keyCollision = keyCollisionReject
+	stream.uploader.failover = regionalBucket{bucket: "acme-failover"}
+	stream.Write([]byte("hello"))
+	if err := stream.Complete(); !errors.Is(err, errObjectExists) || len(client.replicas) > 0 {
+		t.Errorf("Complete() error = %v and failover %v, want errObjectExists and no failover", err, client.replicas)
+	}
+}
+
+func TestCanFailover(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("dial tcp: i/o timeout"), true},
+		{&smithy.GenericAPIError{Code: "ServiceUnavailable"}, true},
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, false},
+		{fmt.Errorf("upload: %w", errObjectExists), false},
+		{context.Canceled, false},
+	} {
+		if got := canFailover(tt.err); got != tt.want {
+			t.Errorf("canFailover(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
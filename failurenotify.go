@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// uploadFailure is the message published for a file that couldn't be
+// stored.
+type uploadFailure struct {
+	Event string    `json:"event"` // always "UploadFailed"
+	Time  time.Time `json:"time"`
+	uploadFields
+	Error string `json:"error"`
+}
+
+// failureNotifier publishes a message to the SNS topic UPLOAD_FAILURE_TOPIC
+// for every file the gateway gave up on storing in S3, so on-call hears
+// about dropped partner files. A nil failureNotifier publishes nothing.
+type failureNotifier struct {
+	asyncSender[uploadFailure]
+
+	topicARN string
+}
+
+func newFailureNotifier(cfg *Config, awsConfig aws.Config, logger *slog.Logger) *failureNotifier {
+	client := newAWSJSONClient(awsConfig, "sns", "", "")
+	// the topic may live in another region than the gateway
+	if topic, err := arn.Parse(cfg.UploadFailureTopic); err == nil && topic.Region != "" {
+		client.region = topic.Region
+		client.endpoint = "https://sns." + topic.Region + ".amazonaws.com"
+	}
+	n := &failureNotifier{
+		asyncSender: newAsyncSender[uploadFailure]("upload failure notification", client, 100, 1, logger),
+		topicARN:    cfg.UploadFailureTopic,
+	}
+	n.logAttrs = []any{slog.String("topic", n.topicARN)}
+	n.deliver = func(ctx context.Context, batch []uploadFailure) error {
+		return n.publish(ctx, batch[0])
+	}
+	return n
+}
+
+// uploadFailed queues a notification for a file of session that couldn't be
+// stored under key in bucket. key is empty if it wasn't chosen yet.
+func (n *failureNotifier) uploadFailed(session uploadSession, filePath, bucket, key string, size int64, err error) {
+	if n == nil {
+		return
+	}
+	n.enqueue(uploadFailure{
+		Event:        "UploadFailed",
+		Time:         n.timeFunc().UTC(),
+		uploadFields: newUploadFields(session, filePath, bucket, key, size),
+		Error:        err.Error(),
+	}, slog.String("file_path", filePath))
+}
+
+// publish sends one notification with SNS Publish. SNS speaks the query
+// protocol, so the request is form encoded and errors are XML.
+func (n *failureNotifier) publish(ctx context.Context, failure uploadFailure) error {
+	message, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	subject := "SFTP upload failed: " + failure.FilePath
+	if len(subject) > 100 {
+		subject = subject[:97] + "..."
+	}
+	params := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {n.topicARN},
+		"Subject":  {asciiSubject(subject)},
+		"Message":  {string(message)},
+	}
+
+	resp, err := n.client.post(ctx, "/", []byte(params.Encode()), map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&failure)
+		return fmt.Errorf("sns Publish failed: %s %s: %s", resp.Status, failure.Code, failure.Message)
+	}
+	return nil
+}
+
+// asciiSubject replaces what SNS doesn't allow in subjects: anything but
+// printable ASCII.
+func asciiSubject(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c < ' ' || c > '~' {
+			b[i] = '?'
+		}
+	}
+	return string(b)
+}
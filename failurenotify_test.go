@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func newTestFailureNotifier(t *testing.T, handler http.HandlerFunc) *failureNotifier {
+	return newTestAWSSender(t, time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC), handler, func(awsConfig aws.Config) *failureNotifier {
+		return newFailureNotifier(&Config{UploadFailureTopic: "arn:aws:sns:eu-west-1:123456789012:sftp-failures"}, awsConfig, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	})
+}
+
+func TestFailureNotifier_Publish(t *testing.T) {
+	var form url.Values
+	var authorization string
+	n := newTestFailureNotifier(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`))
+	})
+	if n.client.region != "eu-west-1" {
+		t.Errorf("region = %s, want the topic's region eu-west-1", n.client.region)
+	}
+
+	session := uploadSession{user: "acme", accessKeyID: "AKIATEST", sessionID: "0123456789abcdef", clientIP: "203.0.113.7"}
+	n.uploadFailed(session, "/uploads/orders.csv", "partner-drops", "2024-01-15/orders.csv", 2048, errors.New("AccessDenied"))
+	if err := n.publish(context.Background(), <-n.queue); err != nil {
+		t.Fatalf("publish() unexpected error: %v", err)
+	}
+
+	if form.Get("Action") != "Publish" || form.Get("TopicArn") != "arn:aws:sns:eu-west-1:123456789012:sftp-failures" {
+		t.Errorf("request = %v, want Publish to the topic", form)
+	}
+	if !strings.Contains(authorization, "/eu-west-1/sns/") {
+		t.Errorf("Authorization = %s, want signed for sns in eu-west-1", authorization)
+	}
+	if got := form.Get("Subject"); got != "SFTP upload failed: /uploads/orders.csv" {
+		t.Errorf("Subject = %q", got)
+	}
+
+	var message uploadFailure
+	if err := json.Unmarshal([]byte(form.Get("Message")), &message); err != nil {
+		t.Fatalf("Message is not JSON: %v", err)
+	}
+	want := uploadFailure{
+		Event: "UploadFailed",
+		Time:  time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC),
+		uploadFields: uploadFields{
+			User:        "acme",
+			AccessKeyID: "AKIATEST",
+			SessionID:   "0123456789abcdef",
+			RemoteIP:    "203.0.113.7",
+			FilePath:    "/uploads/orders.csv",
+			Bucket:      "partner-drops",
+			Key:         "2024-01-15/orders.csv",
+			Size:        2048,
+		},
+		Error: "AccessDenied",
+	}
+	if message != want {
+		t.Errorf("Message = %+v, want %+v", message, want)
+	}
+}
+
+func TestFailureNotifier_PublishError(t *testing.T) {
+	n := newTestFailureNotifier(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<ErrorResponse><Error><Code>AuthorizationError</Code><Message>not allowed</Message></Error></ErrorResponse>`))
+	})
+
+	err := n.publish(context.Background(), uploadFailure{uploadFields: uploadFields{FilePath: "/uploads/a.csv"}})
+	if err == nil || !strings.Contains(err.Error(), "AuthorizationError") {
+		t.Errorf("publish() error = %v, want AuthorizationError", err)
+	}
+}
+
+func TestAsciiSubject(t *testing.T) {
+	if got := asciiSubject("SFTP upload failed: /uploads/bestellung-ü.csv\n"); got != "SFTP upload failed: /uploads/bestellung-??.csv?" {
+		t.Errorf("asciiSubject() = %q", got)
+	}
+}
+
+func TestFileWriter_Close_NotifiesFailure(t *testing.T) {
+	config := &Config{MaxFileSize: 1024, StreamUploads: true, MultipartPartSize: 1024}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	handler.notifier = &failureNotifier{asyncSender: newAsyncSender[uploadFailure]("upload failure notification", nil, 1, 1, handler.logger)}
+
+	writer := &FileWriter{
+		upload: &FileUpload{
+			path:   "/uploads/test.txt",
+			user:   "acme",
+			stream: newTestStream(&fakeS3Client{}, config.MultipartPartSize),
+		},
+		handler: handler,
+		logger:  handler.logger,
+	}
+	writer.WriteAt([]byte("later"), 10)
+	if err := writer.Close(); err == nil {
+		t.Fatal("Close() expected error for upload with missing data")
+	}
+
+	select {
+	case failure := <-handler.notifier.queue:
+		if failure.FilePath != "/uploads/test.txt" || failure.User != "acme" || failure.Bucket != "test-bucket" || failure.Key != "2023-12-25/test.txt" {
+			t.Errorf("notification = %+v, want the failed file", failure)
+		}
+	default:
+		t.Error("no notification queued for the failed upload")
+	}
+}
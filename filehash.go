@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// quickCheckSize is how much of the start of a file md5-hash compares
+// against the client's quick-check hash before hashing the whole range.
+const quickCheckSize = 2048
+
+// checkFileMinBlockSize is the smallest block size check-file accepts.
+const checkFileMinBlockSize = 256
+
+// receivedDigestTimeout is how long the hashes of a stored file can still be
+// queried, long enough for a client to verify a file right after closing it.
+const receivedDigestTimeout = 10 * time.Minute
+
+// hashAlgorithms are the algorithms check-file supports.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// fileDigest hashes a file that is written from start to end. A nil
+// fileDigest ignores writes.
+type fileDigest struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	quick  hash.Hash // md5 of the first quickCheckSize bytes
+	size   int64
+}
+
+func newFileDigest() *fileDigest {
+	return &fileDigest{md5: md5.New(), sha256: sha256.New(), quick: md5.New()}
+}
+
+func (d *fileDigest) Write(p []byte) (int, error) {
+	if d == nil {
+		return len(p), nil
+	}
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	if d.size < quickCheckSize {
+		d.quick.Write(p[:min(int64(len(p)), quickCheckSize-d.size)])
+	}
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+// fileDigests are the hashes of a whole file.
+type fileDigests struct {
+	size   int64
+	md5    []byte
+	sha256 []byte
+	quick  []byte
+}
+
+func (d *fileDigest) sums() fileDigests {
+	return fileDigests{
+		size:   d.size,
+		md5:    d.md5.Sum(nil),
+		sha256: d.sha256.Sum(nil),
+		quick:  d.quick.Sum(nil),
+	}
+}
+
+func (d fileDigests) sum(algorithm string) []byte {
+	if algorithm == "sha256" {
+		return d.sha256
+	}
+	return d.md5
+}
+
+// receivedFile holds the hashes of a file that has been stored in S3.
+type receivedFile struct {
+	digests fileDigests
+	timer   *time.Timer
+}
+
+// recordDigests keeps the hashes of a stored upload for check-file and
+// md5-hash requests, under both names of a temp file. It returns them, or
+// no hashes if the upload couldn't be hashed.
+func (h *SFTPHandler) recordDigests(upload *FileUpload) fileDigests {
+	var digests fileDigests
+	if upload.stream != nil {
+		if upload.digest == nil {
+			return fileDigests{}
+		}
+		digests = upload.digest.sums()
+	} else {
+		d := newFileDigest()
+		body, size := upload.body()
+		if _, err := io.Copy(d, io.NewSectionReader(body, 0, size)); err != nil {
+			h.logger.Warn("failed to hash stored file", slog.String("file_path", upload.path), slog.String("error", err.Error()))
+			return fileDigests{}
+		}
+		digests = d.sums()
+	}
+
+	for _, path := range []string{upload.path, upload.commitPath} {
+		if path == "" {
+			continue
+		}
+		key := resumeKey(upload.user, path)
+		received := &receivedFile{digests: digests}
+		received.timer = time.AfterFunc(receivedDigestTimeout, func() {
+			h.receivedFiles.CompareAndDelete(key, received)
+		})
+		if previous, ok := h.receivedFiles.Swap(key, received); ok {
+			previous.(*receivedFile).timer.Stop()
+		}
+	}
+	return digests
+}
+
+// hashFile answers a check-file or md5-hash request for one of the user's
+// own uploads, open or recently stored. It returns the algorithm used and
+// one hash per blockSize bytes of the range, or a single hash if blockSize
+// is zero. A length of zero means up to the end of the file. If quickCheck
+// is set and doesn't match the start of the file, no hash is returned.
+//
+// Ranges are supported while the data is still held by the gateway; for
+// streaming uploads and stored files only the hash of the whole file is
+// known.
+func (h *SessionSFTPHandler) hashFile(path string, algorithms []string, start, length, blockSize int64, quickCheck []byte) (string, []byte, error) {
+	if !h.handler.isPathAllowed(path) {
+		return "", nil, os.ErrPermission
+	}
+
+	algorithm := ""
+	for _, name := range algorithms {
+		if _, ok := hashAlgorithms[name]; ok {
+			algorithm = name
+			break
+		}
+	}
+	if algorithm == "" || (blockSize != 0 && blockSize < checkFileMinBlockSize) {
+		return "", nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	var digests fileDigests
+	if upload := h.findUpload(path); upload != nil {
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+
+		if upload.stream == nil {
+			body, size := upload.body()
+			if quickCheck != nil && !bytes.Equal(quickCheck, hashRange(body, size, md5.New, 0, quickCheckSize, 0)) {
+				return algorithm, nil, nil
+			}
+			return algorithm, hashRange(body, size, hashAlgorithms[algorithm], start, length, blockSize), nil
+		}
+		if upload.digest == nil {
+			return "", nil, sftp.ErrSSHFxOpUnsupported
+		}
+		digests = upload.digest.sums()
+	} else if value, ok := h.handler.receivedFiles.Load(resumeKey(h.user, path)); ok {
+		digests = value.(*receivedFile).digests
+	} else {
+		return "", nil, os.ErrNotExist
+	}
+
+	if start != 0 || (length != 0 && length < digests.size) || (blockSize != 0 && blockSize < digests.size) {
+		return "", nil, sftp.ErrSSHFxOpUnsupported
+	}
+	if quickCheck != nil && !bytes.Equal(quickCheck, digests.quick) {
+		return algorithm, nil, nil
+	}
+	return algorithm, digests.sum(algorithm), nil
+}
+
+// findUpload returns the user's upload of path that is still open, or a temp
+// file waiting to be renamed.
+func (h *SessionSFTPHandler) findUpload(path string) *FileUpload {
+	if value, ok := h.handler.activeUploads.Load(path); ok && value.(*FileUpload).user == h.user {
+		return value.(*FileUpload)
+	}
+	if value, ok := h.handler.stagedUploads.Load(resumeKey(h.user, path)); ok {
+		return value.(*stagedUpload).upload
+	}
+	return nil
+}
+
+// hashRange hashes [start, start+length) of body in blocks of blockSize.
+func hashRange(body io.ReaderAt, size int64, newHash func() hash.Hash, start, length, blockSize int64) []byte {
+	end := size
+	if length > 0 {
+		end = min(start+length, size)
+	}
+	start = min(start, end)
+	if blockSize == 0 {
+		blockSize = max(end-start, 1)
+	}
+
+	var hashes []byte
+	for off := start; ; off += blockSize {
+		h := newHash()
+		io.Copy(h, io.NewSectionReader(body, off, min(blockSize, end-off)))
+		hashes = h.Sum(hashes)
+		if off+blockSize >= end {
+			return hashes
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func newHashTestHandler() *SessionSFTPHandler {
+	config := &Config{VirtualDir: "/uploads", MaxFileSize: 4096}
+	return &SessionSFTPHandler{
+		handler:  NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil))),
+		clientIP: "192.168.1.100",
+		user:     "alice",
+	}
+}
+
+func TestHashRange(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 60)
+	body := bytes.NewReader(data)
+
+	whole := md5.Sum(data)
+	if got := hashRange(body, int64(len(data)), md5.New, 0, 0, 0); !bytes.Equal(got, whole[:]) {
+		t.Errorf("hashRange() whole file = %x, want %x", got, whole)
+	}
+
+	var blocks []byte
+	for _, block := range [][]byte{data[100:356], data[356:600]} {
+		sum := md5.Sum(block)
+		blocks = append(blocks, sum[:]...)
+	}
+	if got := hashRange(body, int64(len(data)), md5.New, 100, 0, 256); !bytes.Equal(got, blocks) {
+		t.Errorf("hashRange() blocks = %x, want %x", got, blocks)
+	}
+
+	empty := md5.Sum(nil)
+	if got := hashRange(body, int64(len(data)), md5.New, 1000, 10, 0); !bytes.Equal(got, empty[:]) {
+		t.Errorf("hashRange() beyond the end = %x, want %x", got, empty)
+	}
+}
+
+func TestHashFile_OpenUpload(t *testing.T) {
+	h := newHashTestHandler()
+	data := []byte("hello world")
+	h.handler.activeUploads.Store("/uploads/a.txt", &FileUpload{path: "/uploads/a.txt", user: "alice", data: data})
+
+	want := sha256.Sum256(data[6:])
+	algorithm, hashes, err := h.hashFile("/uploads/a.txt", []string{"sha512", "sha256", "md5"}, 6, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("hashFile() unexpected error: %v", err)
+	}
+	if algorithm != "sha256" || !bytes.Equal(hashes, want[:]) {
+		t.Errorf("hashFile() = %s %x, want sha256 %x", algorithm, hashes, want)
+	}
+
+	quick := md5.Sum([]byte("other"))
+	if _, hashes, err := h.hashFile("/uploads/a.txt", []string{"md5"}, 0, 0, 0, quick[:]); err != nil || hashes != nil {
+		t.Errorf("hashFile() with wrong quick check = %x, %v, want no hash", hashes, err)
+	}
+}
+
+func TestHashFile_StoredUpload(t *testing.T) {
+	h := newHashTestHandler()
+	data := []byte("hello world")
+	h.handler.recordDigests(&FileUpload{path: "/uploads/a.txt.part", commitPath: "/uploads/a.txt", user: "alice", data: data})
+
+	want := md5.Sum(data)
+	for _, path := range []string{"/uploads/a.txt.part", "/uploads/a.txt"} {
+		if _, hashes, err := h.hashFile(path, []string{"md5"}, 0, 0, 0, want[:]); err != nil || !bytes.Equal(hashes, want[:]) {
+			t.Errorf("hashFile(%s) = %x, %v, want %x", path, hashes, err, want)
+		}
+	}
+
+	if _, _, err := h.hashFile("/uploads/a.txt", []string{"md5"}, 2, 0, 0, nil); !errors.Is(err, sftp.ErrSSHFxOpUnsupported) {
+		t.Errorf("hashFile() of a range of a stored file error = %v, want %v", err, sftp.ErrSSHFxOpUnsupported)
+	}
+}
+
+func TestHashFile_Errors(t *testing.T) {
+	h := newHashTestHandler()
+	h.handler.activeUploads.Store("/uploads/bob.txt", &FileUpload{path: "/uploads/bob.txt", user: "bob", data: []byte("secret")})
+
+	tests := []struct {
+		name       string
+		path       string
+		algorithms []string
+		blockSize  int64
+		want       error
+	}{
+		{"outside virtual dir", "/etc/passwd", []string{"md5"}, 0, os.ErrPermission},
+		{"upload of another user", "/uploads/bob.txt", []string{"md5"}, 0, os.ErrNotExist},
+		{"unknown file", "/uploads/missing.txt", []string{"md5"}, 0, os.ErrNotExist},
+		{"unsupported algorithm", "/uploads/bob.txt", []string{"crc32"}, 0, sftp.ErrSSHFxOpUnsupported},
+		{"block size too small", "/uploads/bob.txt", []string{"md5"}, 16, sftp.ErrSSHFxOpUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := h.hashFile(tt.path, tt.algorithms, 0, 0, tt.blockSize, nil); !errors.Is(err, tt.want) {
+				t.Errorf("hashFile() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
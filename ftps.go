@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxFTPSLoginAttempts is the number of failed logins after which an FTPS
+// connection is closed, like the attempts an SSH client gets.
+const maxFTPSLoginAttempts = 3
+
+// ftpsServer is the listener of FTPS_PORT, for partners whose tools can't
+// do SFTP. It speaks FTP with explicit TLS (AUTH TLS, RFC 4217), in passive
+// mode only, and takes uploads but no downloads.
+type ftpsServer struct {
+	listener     net.Listener
+	tlsConfig    *tls.Config
+	passivePorts []int  // see FTPS_PASSIVE_PORTS
+	publicIP     net.IP // see FTPS_PUBLIC_IP
+}
+
+func newFTPSServer(config *Config, listenConfig net.ListenConfig) (*ftpsServer, error) {
+	cert, err := tls.LoadX509KeyPair(config.FTPSCertFile, config.FTPSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", config.FTPSPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", config.FTPSPort, err)
+	}
+	return &ftpsServer{
+		listener: listener,
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		passivePorts: config.FTPSPassivePorts,
+		publicIP:     config.FTPSPublicIP,
+	}, nil
+}
+
+// listenPassive opens the listener for the next data connection on ip, the
+// address the client reached the control connection on.
+func (f *ftpsServer) listenPassive(ip net.IP) (net.Listener, error) {
+	if len(f.passivePorts) == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+	// start at a random port, so concurrent sessions don't all race for
+	// the first one
+	first, count := f.passivePorts[0], f.passivePorts[1]-f.passivePorts[0]+1
+	offset := mathrand.IntN(count)
+	for i := range count {
+		port := first + (offset+i)%count
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in FTPS_PASSIVE_PORTS %d-%d", f.passivePorts[0], f.passivePorts[1])
+}
+
+// ftpConnMetadata describes an FTPS connection to the password callbacks
+// and the session code, which were written for SSH connections.
+type ftpConnMetadata struct {
+	user      string
+	sessionID []byte
+	remote    net.Addr
+	local     net.Addr
+}
+
+func newFTPConnMetadata(conn net.Conn) *ftpConnMetadata {
+	id := make([]byte, 32)
+	rand.Read(id)
+	return &ftpConnMetadata{sessionID: id, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+}
+
+func (m *ftpConnMetadata) User() string          { return m.user }
+func (m *ftpConnMetadata) SessionID() []byte     { return m.sessionID }
+func (m *ftpConnMetadata) ClientVersion() []byte { return []byte("FTPS") }
+func (m *ftpConnMetadata) ServerVersion() []byte { return []byte("FTPS") }
+func (m *ftpConnMetadata) RemoteAddr() net.Addr  { return m.remote }
+func (m *ftpConnMetadata) LocalAddr() net.Addr   { return m.local }
+
+// ftpsConn is the control connection of an FTPS client. Files are stored
+// through the session's SFTP handler, so they get the same path checks,
+// limits and S3 pipeline as SFTP uploads.
+type ftpsConn struct {
+	server *SFTPServer
+	conn   net.Conn     // the TCP connection
+	tconn  *timeoutConn // conn, see READ_TIMEOUT and WRITE_TIMEOUT
+	rw     io.ReadWriter
+	in     *bufio.Reader
+	meta   *ftpConnMetadata
+	logger *slog.Logger
+
+	secure     bool                // AUTH TLS is done
+	protected  bool                // PROT P, data connections use TLS
+	failures   int                 // failed logins
+	handler    *SessionSFTPHandler // nil until logged in
+	session    *activeSession      // nil until logged in
+	cwd        string
+	passive    net.Listener // nil until PASV or EPSV
+	renameFrom string       // set by RNFR
+}
+
+func (s *SFTPServer) handleFTPSConnection(_ context.Context, conn net.Conn) {
+	defer s.reporter.recoverPanic()
+	defer s.activeConns.Done()
+	defer conn.Close()
+	if s.connSlots != nil {
+		defer func() { <-s.connSlots }()
+	}
+
+	// the login, TLS handshake included, must finish within
+	// CONNECTION_TIMEOUT
+	conn.SetDeadline(time.Now().Add(s.config.ConnectionTimeout))
+	if s.preAuth != nil {
+		s.preAuth.add(conn)
+		defer s.preAuth.done(conn)
+	}
+
+	tconn := newTimeoutConn(conn, s.config, s.logger)
+	c := &ftpsConn{
+		server: s,
+		conn:   conn,
+		tconn:  tconn,
+		rw:     tconn,
+		in:     bufio.NewReader(tconn),
+		meta:   newFTPConnMetadata(conn),
+		logger: s.logger,
+		cwd:    s.config.VirtualDir,
+	}
+	defer c.closePassive()
+
+	c.serve()
+
+	if c.session != nil {
+		s.sessions.Delete(c.session.id)
+		s.events.sessionEnded(c.session)
+		s.audit.session(eventSessionEnded, c.session)
+		s.logger.Info("FTPS session ended",
+			slog.String("remote_ip", c.session.remoteIP),
+			slog.String("session_id", c.session.id),
+		)
+	}
+}
+
+// serve reads and answers commands until the client quits or the
+// connection fails.
+func (c *ftpsConn) serve() {
+	c.reply(220, "Upload-only FTPS server, use AUTH TLS")
+	for {
+		line, err := c.in.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			c.reply(500, "Command too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		if !c.command(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+// command handles one command. It returns false to close the connection.
+func (c *ftpsConn) command(verb, arg string) bool {
+	switch verb {
+	case "QUIT":
+		c.reply(221, "Goodbye")
+		return false
+	case "NOOP":
+		c.reply(200, "OK")
+		return true
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+		return true
+	case "FEAT":
+		fmt.Fprint(c.rw, "211-Features:\r\n AUTH TLS\r\n PBSZ\r\n PROT\r\n EPSV\r\n UTF8\r\n211 End\r\n")
+		return true
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			c.reply(200, "UTF8 mode enabled")
+		} else {
+			c.reply(501, "Option not supported")
+		}
+		return true
+	case "AUTH":
+		return c.startTLS(arg)
+	}
+
+	if !c.secure {
+		c.reply(530, "Use AUTH TLS first")
+		return true
+	}
+
+	switch verb {
+	case "USER":
+		if c.handler != nil {
+			c.reply(503, "Already logged in")
+		} else {
+			c.meta.user = arg
+			c.reply(331, "Password required")
+		}
+		return true
+	case "PASS":
+		return c.login(arg)
+	case "PBSZ":
+		c.reply(200, "PBSZ=0")
+		return true
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "P":
+			c.protected = true
+			c.reply(200, "Protection level set to Private")
+		case "C":
+			c.reply(536, "Data connections must be protected, use PROT P")
+		default:
+			c.reply(504, "Protection level not supported")
+		}
+		return true
+	}
+
+	if c.handler == nil {
+		c.reply(530, "Log in with USER and PASS")
+		return true
+	}
+
+	switch verb {
+	case "PWD", "XPWD":
+		c.reply(257, `"`+strings.ReplaceAll(c.cwd, `"`, `""`)+`" is the current directory`)
+	case "CWD", "XCWD":
+		c.changeDir(arg)
+	case "CDUP", "XCUP":
+		c.changeDir("..")
+	case "TYPE":
+		// files are stored as sent, ASCII mode included
+		c.reply(200, "Type set to "+strings.ToUpper(arg))
+	case "MODE":
+		c.replyIf(strings.EqualFold(arg, "S"), 200, "Mode set to S", 504, "Only stream mode is supported")
+	case "STRU":
+		c.replyIf(strings.EqualFold(arg, "F"), 200, "Structure set to F", 504, "Only file structure is supported")
+	case "PASV":
+		c.openPassive(false)
+	case "EPSV":
+		if strings.EqualFold(arg, "ALL") {
+			c.reply(200, "EPSV ALL accepted")
+		} else {
+			c.openPassive(true)
+		}
+	case "PORT", "EPRT":
+		c.reply(502, "Active mode is not supported, use passive mode")
+	case "STOR":
+		c.store(arg)
+	case "LIST", "NLST", "MLSD":
+		c.list()
+	case "MKD", "XMKD":
+		name := c.path(arg)
+		if err := c.handler.Filecmd(sftp.NewRequest("Mkdir", name)); err != nil {
+			c.reply(550, scpErrorMessage(err))
+		} else {
+			c.reply(257, `"`+strings.ReplaceAll(name, `"`, `""`)+`" created`)
+		}
+	case "DELE":
+		c.fileCmd("Remove", arg)
+	case "RMD", "XRMD":
+		c.fileCmd("Rmdir", arg)
+	case "RNFR":
+		c.renameFrom = c.path(arg)
+		c.reply(350, "Ready for RNTO")
+	case "RNTO":
+		c.rename(arg)
+	case "ALLO":
+		c.reply(202, "No storage allocation necessary")
+	case "REST":
+		c.replyIf(arg == "0", 350, "Restarting at 0", 502, "Resuming uploads is not supported")
+	case "RETR":
+		c.reply(550, "Downloads are not allowed")
+	case "SIZE", "MDTM":
+		c.reply(550, "Not available")
+	case "ABOR":
+		c.reply(225, "No transfer to abort")
+	default:
+		c.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// startTLS handles AUTH TLS and switches the control connection to TLS.
+func (c *ftpsConn) startTLS(mechanism string) bool {
+	if c.secure {
+		c.reply(503, "Already using TLS")
+		return true
+	}
+	switch strings.ToUpper(mechanism) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		c.reply(504, "Only AUTH TLS is supported")
+		return true
+	}
+	// commands sent along with AUTH would be taken as sent over TLS
+	if c.in.Buffered() > 0 {
+		c.reply(503, "Commands sent before the TLS handshake")
+		return false
+	}
+	c.reply(234, "Using TLS")
+
+	tlsConn := tls.Server(c.tconn, c.server.ftps.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.logger.Warn("FTPS TLS handshake failed",
+			slog.String("remote_ip", getClientIP(c.conn.RemoteAddr())),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+	c.rw = tlsConn
+	c.in = bufio.NewReader(tlsConn)
+	c.secure = true
+	return true
+}
+
+// login handles PASS with the same callbacks, rate limits and bans as SSH
+// password logins. Logins that need a second factor fail, as FTP has no
+// way to ask for it.
+func (c *ftpsConn) login(password string) bool {
+	if c.handler != nil {
+		c.reply(503, "Already logged in")
+		return true
+	}
+	if c.meta.user == "" {
+		c.reply(503, "Send USER first")
+		return true
+	}
+
+	s := c.server
+	clientIP := getClientIP(c.conn.RemoteAddr())
+	permissions, err := c.authenticate(password)
+	if err != nil {
+		s.logger.Warn("FTPS login failed",
+			slog.String("remote_ip", clientIP),
+			slog.String("user", c.meta.user),
+			slog.String("error", err.Error()),
+		)
+		if s.bans != nil {
+			s.bans.recordFailure(clientIP)
+		}
+		c.failures++
+		if c.failures >= maxFTPSLoginAttempts {
+			c.reply(421, "Too many failed logins")
+			return false
+		}
+		c.reply(530, "Login incorrect")
+		return true
+	}
+
+	if s.preAuth != nil && s.preAuth.done(c.conn) {
+		s.logger.Warn("connection dropped: too many connections logging in",
+			slog.String("remote_ip", clientIP),
+			slog.Int("max_preauth_connections", s.config.MaxPreAuthConnections),
+		)
+		return false
+	}
+	c.conn.SetDeadline(time.Time{})
+	c.tconn.start()
+
+	port := getPort(c.conn.LocalAddr())
+	country := ""
+	if s.geoIP != nil {
+		country = s.geoIP.db.country(clientIP)
+	}
+	if permissions != nil && permissions.Extensions != nil {
+		permissions.Extensions["country"] = country
+	}
+
+	s.logger.Info("FTPS connection established",
+		slog.String("remote_ip", clientIP),
+		slog.String("session_id", getSessionID(c.meta)),
+		slog.Int("port", port),
+		slog.String("country", country),
+		slog.String("user", c.meta.user),
+	)
+	s.metrics.observeConnection(port)
+
+	c.handler = s.newSessionHandler(c.meta, permissions, c.tconn, "FTPS session started")
+	if c.handler == nil {
+		c.reply(421, "Login failed")
+		return false
+	}
+	c.session = newActiveSession(c.meta, permissions, c.tconn)
+	s.sessions.Store(c.session.id, c.session)
+	s.events.sessionStarted(c.session)
+	s.audit.session(eventSessionStarted, c.session)
+
+	c.reply(230, "Login successful")
+	return true
+}
+
+// authenticate checks a password, or logs in the guest user without one.
+func (c *ftpsConn) authenticate(password string) (*ssh.Permissions, error) {
+	sshConfig := c.server.sshConfig
+	method := "password"
+	var permissions *ssh.Permissions
+	var err error
+	switch {
+	case password == "" && sshConfig.NoClientAuthCallback != nil:
+		method = "none"
+		permissions, err = sshConfig.NoClientAuthCallback(c.meta)
+	case sshConfig.PasswordCallback != nil:
+		permissions, err = sshConfig.PasswordCallback(c.meta, []byte(password))
+	default:
+		err = errors.New("password logins are not enabled")
+	}
+
+	var partial *ssh.PartialSuccessError
+	if errors.As(err, &partial) {
+		err = errors.New("a second factor is required, which FTPS can't provide")
+	}
+	if sshConfig.AuthLogCallback != nil {
+		sshConfig.AuthLogCallback(c.meta, method, err)
+	}
+	return permissions, err
+}
+
+// path resolves a path argument against the working directory.
+func (c *ftpsConn) path(arg string) string {
+	if !path.IsAbs(arg) {
+		arg = path.Join(c.cwd, arg)
+	}
+	return path.Clean(arg)
+}
+
+// changeDir handles CWD. Only VIRTUAL_DIR and the directories below it can
+// be entered; they all exist, as in SFTP.
+func (c *ftpsConn) changeDir(arg string) {
+	dir := c.path(arg)
+	if !c.server.handler.isPathAllowed(dir) {
+		c.reply(550, "No such directory")
+		return
+	}
+	c.cwd = dir
+	c.reply(250, "Directory changed to "+dir)
+}
+
+// fileCmd handles DELE and RMD, which the SFTP handler refuses.
+func (c *ftpsConn) fileCmd(method, arg string) {
+	if err := c.handler.Filecmd(sftp.NewRequest(method, c.path(arg))); err != nil {
+		c.reply(550, scpErrorMessage(err))
+		return
+	}
+	c.reply(250, "OK")
+}
+
+// rename handles RNTO, which renames temporary files like SFTP does.
+func (c *ftpsConn) rename(arg string) {
+	from := c.renameFrom
+	c.renameFrom = ""
+	if from == "" {
+		c.reply(503, "Send RNFR first")
+		return
+	}
+	r := sftp.NewRequest("Rename", from)
+	r.Target = c.path(arg)
+	if err := c.handler.Filecmd(r); err != nil {
+		c.reply(553, scpErrorMessage(err))
+		return
+	}
+	c.reply(250, "Rename successful")
+}
+
+// openPassive handles PASV and EPSV, opening a port for the data connection
+// of the next transfer.
+func (c *ftpsConn) openPassive(extended bool) {
+	if !c.protected {
+		c.reply(521, "Data connections must be protected, use PROT P")
+		return
+	}
+	c.closePassive()
+
+	localIP := c.conn.LocalAddr().(*net.TCPAddr).IP
+	listener, err := c.server.ftps.listenPassive(localIP)
+	if err != nil {
+		c.logger.Error("failed to open FTPS passive port",
+			slog.String("remote_ip", getClientIP(c.conn.RemoteAddr())),
+			slog.String("error", err.Error()),
+		)
+		c.reply(425, "Can't open data connection")
+		return
+	}
+	port := getPort(listener.Addr())
+
+	if extended {
+		c.passive = listener
+		c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	ip := c.server.ftps.publicIP
+	if ip == nil {
+		ip = localIP.To4()
+	}
+	if ip == nil {
+		listener.Close()
+		c.reply(425, "Use EPSV with IPv6")
+		return
+	}
+	c.passive = listener
+	c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+func (c *ftpsConn) closePassive() {
+	if c.passive != nil {
+		c.passive.Close()
+		c.passive = nil
+	}
+}
+
+// openData accepts the data connection of a transfer on the passive port
+// and starts TLS on it. Connections from other addresses than the client's
+// are refused, so nobody else can slip a file into the session.
+func (c *ftpsConn) openData() (*tls.Conn, error) {
+	listener := c.passive
+	c.passive = nil
+	if listener == nil {
+		return nil, errors.New("no passive port")
+	}
+	defer listener.Close()
+
+	if l, ok := listener.(*net.TCPListener); ok {
+		l.SetDeadline(time.Now().Add(c.server.config.ConnectionTimeout))
+	}
+	var conn net.Conn
+	for conn == nil {
+		accepted, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if getClientIP(accepted.RemoteAddr()) != getClientIP(c.conn.RemoteAddr()) {
+			c.logger.Warn("FTPS data connection rejected: wrong address",
+				slog.String("remote_ip", getClientIP(c.conn.RemoteAddr())),
+				slog.String("data_ip", getClientIP(accepted.RemoteAddr())),
+			)
+			accepted.Close()
+			continue
+		}
+		conn = accepted
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.server.config.HandshakeTimeout)
+	defer cancel()
+	data := newTimeoutConn(conn, c.server.config, c.logger)
+	tlsConn := tls.Server(data, c.server.ftps.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	data.start()
+	return tlsConn, nil
+}
+
+// closeData closes a data connection and counts its bytes for the session.
+func (c *ftpsConn) closeData(data *tls.Conn) {
+	data.Close()
+	if conn, ok := data.NetConn().(*timeoutConn); ok {
+		c.tconn.received.Add(conn.received.Load())
+		c.tconn.sent.Add(conn.sent.Load())
+	}
+}
+
+// store handles STOR. The file is committed once the client closes the data
+// connection, and the reply tells whether it was stored.
+func (c *ftpsConn) store(arg string) {
+	if c.passive == nil {
+		c.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	name := c.path(arg)
+
+	r := sftp.NewRequest("Put", name)
+	r.Flags = scpOpenFlags
+	writer, err := c.handler.Filewrite(r)
+	if err != nil {
+		c.closePassive()
+		c.reject(name, err)
+		return
+	}
+	fw := writer.(*FileWriter)
+
+	c.reply(150, "Ready to receive "+name)
+	data, err := c.openData()
+	if err != nil {
+		fw.discard(err)
+		c.reply(425, "Can't open data connection")
+		return
+	}
+	// READ_TIMEOUT applies to the data connection while the file is open
+	data.NetConn().(*timeoutConn).startTransfer()
+
+	var writeErr error
+	buf := make([]byte, 32*1024)
+	for off := int64(0); writeErr == nil; {
+		n, err := data.Read(buf)
+		if n > 0 {
+			_, writeErr = fw.WriteAt(buf[:n], off)
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.closeData(data)
+			fw.discard(err)
+			c.reply(426, "Connection closed, transfer aborted")
+			return
+		}
+	}
+	c.closeData(data)
+
+	if writeErr != nil {
+		fw.discard(writeErr)
+		c.reject(name, writeErr)
+		return
+	}
+	if err := fw.Close(); err != nil {
+		c.reject(name, err)
+		return
+	}
+	c.reply(226, "Transfer complete")
+}
+
+// list handles LIST and friends with an empty listing, as stored files
+// can't be listed; many clients list a directory before uploading to it.
+func (c *ftpsConn) list() {
+	if c.passive == nil {
+		c.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	c.reply(150, "Here comes the directory listing")
+	data, err := c.openData()
+	if err != nil {
+		c.reply(425, "Can't open data connection")
+		return
+	}
+	c.closeData(data)
+	c.reply(226, "Directory send OK")
+}
+
+// reject tells the client a file failed.
+func (c *ftpsConn) reject(name string, err error) {
+	c.logger.Warn("FTPS file rejected",
+		slog.String("remote_ip", getClientIP(c.conn.RemoteAddr())),
+		slog.String("session_id", getSessionID(c.meta)),
+		slog.String("file_path", name),
+		slog.String("error", err.Error()),
+	)
+	code := 451
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, errExtensionNotAllowed) {
+		code = 553
+	}
+	c.reply(code, scpErrorMessage(err))
+}
+
+func (c *ftpsConn) reply(code int, msg string) error {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	_, err := fmt.Fprintf(c.rw, "%d %s\r\n", code, msg)
+	return err
+}
+
+// replyIf replies with the first code and message if ok, with the second
+// otherwise.
+func (c *ftpsConn) replyIf(ok bool, code int, msg string, otherCode int, otherMsg string) {
+	if ok {
+		c.reply(code, msg)
+	} else {
+		c.reply(otherCode, otherMsg)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newTestFTPSServer starts an FTPS listener that stores files in store and
+// lets alice log in with "secret".
+func newTestFTPSServer(t *testing.T, store objectStore) (string, *tls.Config) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	cert, pool := newTestCertificate(t)
+	config := &Config{
+		VirtualDir:        "/uploads",
+		MaxFileSize:       1024,
+		ConnectionTimeout: time.Minute,
+		HandshakeTimeout:  time.Minute,
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	s := &SFTPServer{
+		config: config,
+		logger: logger,
+		sshConfig: &ssh.ServerConfig{
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if conn.User() != "alice" || string(password) != "secret" {
+					return nil, errors.New("invalid credentials")
+				}
+				return &ssh.Permissions{Extensions: map[string]string{"user": "alice", "upload_prefix": "alice"}}, nil
+			},
+		},
+		handler: NewSFTPHandler(config, store, logger),
+		ftps: &ftpsServer{
+			listener:  listener,
+			tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.acceptConnections(ctx, listener, s.handleFTPSConnection)
+
+	return listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+// ftpsTestClient is the control connection of an FTPS client.
+type ftpsTestClient struct {
+	t    *testing.T
+	conn *textproto.Conn
+}
+
+func (c *ftpsTestClient) cmd(expectCode int, format string, args ...any) string {
+	c.t.Helper()
+	if err := c.conn.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("failed to send %q: %v", fmt.Sprintf(format, args...), err)
+	}
+	return c.expect(expectCode)
+}
+
+func (c *ftpsTestClient) expect(expectCode int) string {
+	c.t.Helper()
+	code, msg, err := c.conn.ReadResponse(expectCode)
+	if err != nil {
+		c.t.Fatalf("expected %d, got %d %s (%v)", expectCode, code, msg, err)
+	}
+	return msg
+}
+
+// dialFTPS connects and switches to TLS with AUTH TLS.
+func dialFTPS(t *testing.T, addr string, tlsConfig *tls.Config) *ftpsTestClient {
+	t.Helper()
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := &ftpsTestClient{t: t, conn: textproto.NewConn(raw)}
+	c.expect(220)
+	c.cmd(530, "USER alice")
+	c.cmd(234, "AUTH TLS")
+	c.conn = textproto.NewConn(tls.Client(raw, tlsConfig))
+	return c
+}
+
+func TestFTPS_Upload(t *testing.T) {
+	store := &fakeObjectStore{}
+	addr, tlsConfig := newTestFTPSServer(t, store)
+	c := dialFTPS(t, addr, tlsConfig)
+
+	c.cmd(530, "PWD")
+	c.cmd(331, "USER alice")
+	c.cmd(530, "PASS wrong")
+	c.cmd(331, "USER alice")
+	c.cmd(230, "PASS secret")
+
+	c.cmd(521, "EPSV")
+	c.cmd(200, "PBSZ 0")
+	c.cmd(536, "PROT C")
+	c.cmd(200, "PROT P")
+	c.cmd(200, "TYPE I")
+	c.cmd(550, "CWD /etc")
+	c.cmd(250, "CWD reports")
+	if msg := c.cmd(257, "PWD"); msg != `"/uploads/reports" is the current directory` {
+		t.Errorf("PWD = %q", msg)
+	}
+	c.cmd(502, "PORT 127,0,0,1,4,1")
+	c.cmd(550, "RETR a.csv")
+
+	var port int
+	msg := c.cmd(229, "EPSV")
+	if _, err := fmt.Sscanf(msg, "Entering Extended Passive Mode (|||%d|)", &port); err != nil {
+		t.Fatalf("unexpected EPSV reply %q", msg)
+	}
+	c.cmd(150, "STOR a.csv")
+	data, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to open data connection: %v", err)
+	}
+	data.Write([]byte("id,name\n1,alice\n"))
+	data.Close()
+	c.expect(226)
+
+	if got := string(store.files["/uploads/reports/a.csv"]); got != "id,name\n1,alice\n" {
+		t.Errorf("stored file = %q, want the data sent", got)
+	}
+
+	c.cmd(425, "STOR b.csv")
+	c.cmd(229, "EPSV")
+	c.cmd(553, "STOR ../../etc/passwd")
+	c.cmd(550, "DELE a.csv")
+	c.cmd(221, "QUIT")
+}
+
+func TestFTPS_TooManyFailedLogins(t *testing.T) {
+	addr, tlsConfig := newTestFTPSServer(t, &fakeObjectStore{})
+	c := dialFTPS(t, addr, tlsConfig)
+
+	for range maxFTPSLoginAttempts - 1 {
+		c.cmd(331, "USER alice")
+		c.cmd(530, "PASS wrong")
+	}
+	c.cmd(331, "USER alice")
+	c.cmd(421, "PASS wrong")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// The gateway's credentials are checked every gatewayCredentialsCheck and
+// refreshed once they expire within gatewayCredentialsWindow, long enough
+// for a check to come around before they do.
+const (
+	gatewayCredentialsCheck  = time.Minute
+	gatewayCredentialsWindow = 5 * time.Minute
+)
+
+// gatewayClient is the S3 client that signs requests with the gateway's own
+// credentials, shared by all uploads that use them. Creating a client for
+// every upload would fetch the credentials from the instance metadata
+// service or STS again each time.
+type gatewayClient struct {
+	mu     sync.Mutex
+	client *s3.Client
+}
+
+// usesGatewayCredentials reports whether some logins upload with the
+// gateway's own credentials rather than AWS keys of the user.
+func usesGatewayCredentials(config *Config) bool {
+	return config.UsersFile != "" ||
+		config.UsersSecret != "" ||
+		config.AuthWebhookURL != "" ||
+		config.LDAPURL != "" ||
+		config.JWTIssuer != "" ||
+		(config.VaultAddr != "" && config.VaultAWSRole == "") ||
+		config.GuestUser != "" ||
+		config.SSHCAKeys != ""
+}
+
+// gatewayClient returns the S3 client with the gateway's own credentials,
+// creating it on first use.
+func (u *S3Uploader) gatewayClient(ctx context.Context) (*s3.Client, error) {
+	u.gateway.mu.Lock()
+	defer u.gateway.mu.Unlock()
+
+	if u.gateway.client == nil {
+		client, err := u.loadClient(ctx, config.WithCredentialsCacheOptions(func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = gatewayCredentialsWindow
+		}))
+		if err != nil {
+			return nil, err
+		}
+		u.gateway.client = client
+	}
+	return u.gateway.client, nil
+}
+
+// warmGatewayClient fetches the gateway's credentials right away and keeps
+// refreshing them ahead of their expiry until ctx is done, so the first
+// upload after startup, and any after, don't wait for them.
+func (u *S3Uploader) warmGatewayClient(ctx context.Context) {
+	ticker := time.NewTicker(gatewayCredentialsCheck)
+	defer ticker.Stop()
+
+	for {
+		if err := u.refreshGatewayCredentials(ctx); err != nil && ctx.Err() == nil {
+			u.logger.Warn("failed to refresh the gateway's AWS credentials", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshGatewayCredentials fetches the gateway's credentials if they are
+// missing or about to expire.
+func (u *S3Uploader) refreshGatewayCredentials(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	client, err := u.gatewayClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = client.Options().Credentials.Retrieve(ctx)
+	return err
+}
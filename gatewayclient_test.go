@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3Uploader_GatewayClient(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAGATEWAY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	uploader := NewS3Uploader(&Config{S3Bucket: "test-bucket", S3Region: "us-east-1"}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if err := uploader.refreshGatewayCredentials(context.Background()); err != nil {
+		t.Fatalf("refreshGatewayCredentials() unexpected error: %v", err)
+	}
+
+	first, err := uploader.newClient(context.Background(), "", "", "")
+	if err != nil {
+		t.Fatalf("newClient() unexpected error: %v", err)
+	}
+	second, err := uploader.newClient(context.Background(), "", "", "")
+	if err != nil {
+		t.Fatalf("newClient() unexpected error: %v", err)
+	}
+	if first != second {
+		t.Error("expected uploads with the gateway's credentials to share one client")
+	}
+	creds, err := first.Options().Credentials.Retrieve(context.Background())
+	if err != nil || creds.AccessKeyID != "AKIAGATEWAY" {
+		t.Errorf("gateway credentials = %q, %v, want AKIAGATEWAY", creds.AccessKeyID, err)
+	}
+
+	user, err := uploader.newClient(context.Background(), "AKIAUSER", "secret", "")
+	if err != nil {
+		t.Fatalf("newClient() unexpected error: %v", err)
+	}
+	if user == first {
+		t.Error("expected a client of its own for the user's keys")
+	}
+}
+
+func TestUsesGatewayCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{"AWS keys only", Config{}, false},
+		{"webhook", Config{AuthWebhookURL: "https://auth.example.com"}, true},
+		{"guest", Config{GuestUser: "dropbox"}, true},
+		{"Vault with a role", Config{VaultAddr: "https://vault.example.com", VaultAWSRole: "sftp"}, false},
+		{"Vault without a role", Config{VaultAddr: "https://vault.example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usesGatewayCredentials(&tt.config); got != tt.want {
+				t.Errorf("usesGatewayCredentials() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
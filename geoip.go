@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// GeoLite2 Country CSV files, as extracted from MaxMind's download.
+const (
+	geoIPBlocksIPv4 = "GeoLite2-Country-Blocks-IPv4.csv"
+	geoIPBlocksIPv6 = "GeoLite2-Country-Blocks-IPv6.csv"
+	geoIPLocations  = "GeoLite2-Country-Locations-en.csv"
+)
+
+type geoIPRange struct {
+	network netip.Prefix
+	country string
+}
+
+// geoIPDB maps IP addresses to ISO country codes. Networks are sorted by
+// their first address and don't overlap, so a lookup is a binary search.
+type geoIPDB struct {
+	ranges []geoIPRange
+}
+
+// loadGeoIPDB reads the GeoLite2 Country database in CSV format from dir.
+func loadGeoIPDB(dir string) (*geoIPDB, error) {
+	countries := make(map[string]string)
+	err := readCSV(filepath.Join(dir, geoIPLocations), func(row map[string]string) error {
+		countries[row["geoname_id"]] = row["country_iso_code"]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db := &geoIPDB{}
+	for _, name := range []string{geoIPBlocksIPv4, geoIPBlocksIPv6} {
+		err := readCSV(filepath.Join(dir, name), func(row map[string]string) error {
+			network, err := netip.ParsePrefix(row["network"])
+			if err != nil {
+				return err
+			}
+			geonameID := row["geoname_id"]
+			if geonameID == "" {
+				geonameID = row["registered_country_geoname_id"]
+			}
+			if country := countries[geonameID]; country != "" {
+				db.ranges = append(db.ranges, geoIPRange{network: network.Masked(), country: country})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(db.ranges) == 0 {
+		return nil, fmt.Errorf("no networks found in %s", dir)
+	}
+
+	slices.SortFunc(db.ranges, func(a, b geoIPRange) int {
+		return a.network.Addr().Compare(b.network.Addr())
+	})
+	return db, nil
+}
+
+// country returns the ISO code of the country ip is in, or "" if the
+// address is unknown, such as a private address.
+func (db *geoIPDB) country(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	i, found := slices.BinarySearchFunc(db.ranges, addr, func(r geoIPRange, addr netip.Addr) int {
+		return r.network.Addr().Compare(addr)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || !db.ranges[i].network.Contains(addr) {
+		return ""
+	}
+	return db.ranges[i].country
+}
+
+// readCSV calls fn for every row of a CSV file with a header line, passing
+// the row as a map from column name to value.
+func readCSV(path string, fn func(row map[string]string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	row := make(map[string]string, len(header))
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		clear(row)
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+	}
+}
+
+// geoIPPolicy allows or denies connections by the country of the client.
+type geoIPPolicy struct {
+	db    *geoIPDB
+	allow map[string]bool // only these countries, if not empty
+	deny  map[string]bool
+}
+
+func newGeoIPPolicy(db *geoIPDB, allow, deny []string) *geoIPPolicy {
+	policy := &geoIPPolicy{db: db, allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, country := range allow {
+		policy.allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range deny {
+		policy.deny[strings.ToUpper(country)] = true
+	}
+	return policy
+}
+
+// check looks up the country of ip and reports whether it may connect.
+// Addresses of unknown country are only allowed without an allow list.
+func (p *geoIPPolicy) check(ip string) (country string, allowed bool) {
+	country = p.db.country(ip)
+	if p.deny[country] {
+		return country, false
+	}
+	if len(p.allow) > 0 && !p.allow[country] {
+		return country, false
+	}
+	return country, true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestGeoIPDB(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		geoIPLocations: `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+2750405,en,EU,Europe,NL,Netherlands,1
+6252001,en,NA,"North America",US,"United States",0
+`,
+		geoIPBlocksIPv4: `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+203.0.113.0/24,2750405,2750405,,0,0
+198.51.100.0/24,,6252001,,0,0
+`,
+		geoIPBlocksIPv6: `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider
+2001:db8::/32,6252001,6252001,,0,0
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestGeoIPDB_Country(t *testing.T) {
+	db, err := loadGeoIPDB(writeTestGeoIPDB(t))
+	if err != nil {
+		t.Fatalf("loadGeoIPDB() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.7", "NL"},
+		{"198.51.100.255", "US"},
+		{"::ffff:203.0.113.7", "NL"},
+		{"2001:db8::1", "US"},
+		{"192.0.2.1", ""},
+		{"10.0.0.1", ""},
+		{"not-an-ip", ""},
+	}
+
+	for _, tt := range tests {
+		if got := db.country(tt.ip); got != tt.want {
+			t.Errorf("country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGeoIPPolicy_Check(t *testing.T) {
+	db, err := loadGeoIPDB(writeTestGeoIPDB(t))
+	if err != nil {
+		t.Fatalf("loadGeoIPDB() unexpected error: %v", err)
+	}
+
+	deny := newGeoIPPolicy(db, nil, []string{"us"})
+	if _, allowed := deny.check("198.51.100.1"); allowed {
+		t.Error("expected denied country to be rejected")
+	}
+	if _, allowed := deny.check("10.0.0.1"); !allowed {
+		t.Error("expected unknown country to be allowed without an allow list")
+	}
+
+	allow := newGeoIPPolicy(db, []string{"NL"}, nil)
+	if country, allowed := allow.check("203.0.113.7"); !allowed || country != "NL" {
+		t.Errorf("check() = %q, %v, want NL allowed", country, allowed)
+	}
+	if _, allowed := allow.check("10.0.0.1"); allowed {
+		t.Error("expected unknown country to be rejected with an allow list")
+	}
+}
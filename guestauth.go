@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GuestAuthenticator implements the drop-box mode for public "send us a
+// file" use cases. GUEST_USER logs in with GUEST_PASSWORD, or without any
+// password if none is set, and its uploads are made with the gateway's own
+// credentials into GUEST_PREFIX, where they can be scanned before anyone
+// trusts them.
+type GuestAuthenticator struct {
+	user     string
+	password string // no password needed if empty
+	prefix   string
+	quota    int64 // bytes all guests together may upload per day, unlimited if zero
+	logger   *slog.Logger
+}
+
+func NewGuestAuthenticator(config *Config, logger *slog.Logger) *GuestAuthenticator {
+	return &GuestAuthenticator{
+		user:     config.GuestUser,
+		password: config.GuestPassword,
+		prefix:   config.GuestPrefix,
+		quota:    config.GuestQuota,
+		logger:   logger,
+	}
+}
+
+// wrapGuest sends logins of the guest user to g and all others to next.
+func wrapGuest(g *GuestAuthenticator, next func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if conn.User() == g.user {
+			return g.Authenticate(conn, password)
+		}
+		return next(conn, password)
+	}
+}
+
+// Authenticate checks a password login of the guest user. Without
+// GUEST_PASSWORD any password is accepted, for clients that insist on
+// sending one.
+func (g *GuestAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if g.password != "" && subtle.ConstantTimeCompare(password, []byte(g.password)) != 1 {
+		g.logger.Warn("authentication failed: wrong guest password", g.logCtx(conn))
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	return g.permissions(conn), nil
+}
+
+// AuthenticateNone is the NoClientAuthCallback used when no GUEST_PASSWORD
+// is set, so the guest user can log in without being asked for a password.
+func (g *GuestAuthenticator) AuthenticateNone(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if conn.User() != g.user {
+		return nil, fmt.Errorf("authentication required")
+	}
+	return g.permissions(conn), nil
+}
+
+// guestNoneCallback returns the NoClientAuthCallback for next, which is
+// AuthenticateNone with the source IP, rate limit and other checks around
+// it. Clients try "none" before every other method; only attempts as the
+// guest user reach next, so those of other users don't count as failures.
+func guestNoneCallback(user string, next func(ssh.ConnMetadata, struct{}) (*ssh.Permissions, error)) func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+		if conn.User() != user {
+			return nil, fmt.Errorf("authentication required")
+		}
+		return next(conn, struct{}{})
+	}
+}
+
+func (g *GuestAuthenticator) permissions(conn ssh.ConnMetadata) *ssh.Permissions {
+	g.logger.Info("guest authentication successful", g.logCtx(conn), slog.String("upload_prefix", g.prefix))
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":          g.user,
+			"upload_prefix": g.prefix,
+			"quota":         strconv.FormatInt(g.quota, 10),
+			"client_ip":     getClientIP(conn.RemoteAddr()),
+		},
+	}
+}
+
+func (g *GuestAuthenticator) logCtx(conn ssh.ConnMetadata) slog.Attr {
+	return slog.Group("auth",
+		"remote_ip", getClientIP(conn.RemoteAddr()),
+		"session_id", getSessionID(conn),
+		"user", conn.User(),
+		"method", "guest",
+	)
+}
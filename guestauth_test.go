@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWrapGuest(t *testing.T) {
+	guest := NewGuestAuthenticator(&Config{GuestUser: "dropbox", GuestPassword: "welcome", GuestPrefix: "quarantine"},
+		slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	errNext := errors.New("next")
+	callback := wrapGuest(guest, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return nil, errNext
+	})
+
+	perms, err := callback(testConnMetadata{user: "dropbox"}, []byte("welcome"))
+	if err != nil {
+		t.Fatalf("guest login unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "quarantine" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "quarantine")
+	}
+	if _, ok := perms.Extensions["aws_access_key_id"]; ok {
+		t.Error("guest sessions must upload with the gateway's own credentials")
+	}
+
+	if _, err := callback(testConnMetadata{user: "dropbox"}, []byte("wrong")); err == nil || errors.Is(err, errNext) {
+		t.Errorf("wrong guest password: error = %v, want invalid credentials", err)
+	}
+	if _, err := callback(testConnMetadata{user: "alice"}, []byte("welcome")); !errors.Is(err, errNext) {
+		t.Errorf("other user: error = %v, want login passed on", err)
+	}
+}
+
+func TestGuestAuthenticator_AuthenticateNone(t *testing.T) {
+	guest := NewGuestAuthenticator(&Config{GuestUser: "dropbox", GuestPrefix: "quarantine"},
+		slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	if _, err := guest.AuthenticateNone(testConnMetadata{user: "dropbox"}); err != nil {
+		t.Errorf("AuthenticateNone(dropbox) unexpected error: %v", err)
+	}
+	if _, err := guest.AuthenticateNone(testConnMetadata{user: "alice"}); err == nil {
+		t.Error("AuthenticateNone(alice) expected error")
+	}
+	if _, err := guest.Authenticate(testConnMetadata{user: "dropbox"}, []byte("anything")); err != nil {
+		t.Errorf("Authenticate() without GUEST_PASSWORD unexpected error: %v", err)
+	}
+}
+
+func TestGuestNoneCallback(t *testing.T) {
+	guest := NewGuestAuthenticator(&Config{GuestUser: "dropbox", GuestPrefix: "quarantine"},
+		slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	calls := 0
+	none := func(conn ssh.ConnMetadata, _ struct{}) (*ssh.Permissions, error) {
+		calls++
+		perms, err := guest.AuthenticateNone(conn)
+		if err == nil {
+			perms.Extensions["allowed_ips"] = "10.0.0.0/8" // as from USER_CONFIG_TABLE
+		}
+		return perms, err
+	}
+	sourceIPs := &sourceIPPolicy{logger: slog.New(slog.NewTextHandler(os.Stderr, nil))}
+	callback := guestNoneCallback("dropbox", wrapSourceIP(sourceIPs, none))
+
+	if _, err := callback(testConnMetadata{user: "dropbox"}); err == nil {
+		t.Error("guest login from outside allowed_ips expected error")
+	}
+	if _, err := callback(testConnMetadata{user: "alice"}); err == nil || calls != 1 {
+		t.Errorf("other user: error = %v after %d checks, want it refused before the checks", err, calls)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyRing holds the host keys presented to new connections, so they can
+// be rotated without a restart. Connections keep the keys they started with.
+//
+// With HOST_KEY_ROLLOVER, reloaded keys are first only announced to clients
+// with the OpenSSH hostkeys-00 extension, and used once the rollover window
+// ends. Clients with UpdateHostKeys enabled learn the new keys while the old
+// ones are still in use, so the switch doesn't trigger a host key warning.
+type hostKeyRing struct {
+	template *ssh.ServerConfig // server settings, without host keys
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	current []ssh.Signer
+	next    []ssh.Signer // announced, used once the rollover window ends
+	timer   *time.Timer
+	config  *ssh.ServerConfig // template with the current keys
+}
+
+func newHostKeyRing(template *ssh.ServerConfig, signers []ssh.Signer, logger *slog.Logger) *hostKeyRing {
+	return &hostKeyRing{
+		template: template,
+		logger:   logger,
+		current:  signers,
+	}
+}
+
+// serverConfig returns the config for a new connection.
+func (r *hostKeyRing) serverConfig() *ssh.ServerConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.config == nil {
+		config := *r.template
+		for _, signer := range r.current {
+			config.AddHostKey(signer)
+		}
+		r.config = &config
+	}
+	return r.config
+}
+
+// rotate replaces the host keys for new connections, right away or after
+// the rollover window.
+func (r *hostKeyRing) rotate(signers []ssh.Signer, rollover time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sameHostKeys(signers, r.current) {
+		r.logger.Info("host keys unchanged")
+		return
+	}
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if rollover <= 0 {
+		r.use(signers)
+		return
+	}
+
+	r.next = signers
+	r.timer = time.AfterFunc(rollover, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.next != nil {
+			r.use(r.next)
+		}
+	})
+	for _, signer := range signers {
+		r.logger.Info("new host key announced",
+			slog.String("type", signer.PublicKey().Type()),
+			slog.String("fingerprint", ssh.FingerprintSHA256(signer.PublicKey())),
+			slog.Duration("rollover", rollover),
+		)
+	}
+}
+
+// use switches to signers. r.mu must be held.
+func (r *hostKeyRing) use(signers []ssh.Signer) {
+	r.current = signers
+	r.next = nil
+	r.config = nil
+	for _, signer := range signers {
+		r.logger.Info("host key rotated",
+			slog.String("type", signer.PublicKey().Type()),
+			slog.String("fingerprint", ssh.FingerprintSHA256(signer.PublicKey())),
+		)
+	}
+}
+
+// announced returns the current keys and those waiting for the end of the
+// rollover window.
+func (r *hostKeyRing) announced() []ssh.Signer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(append([]ssh.Signer(nil), r.current...), r.next...)
+}
+
+// announce tells the client about all host keys with the hostkeys-00
+// extension, as OpenSSH does after authentication.
+func (r *hostKeyRing) announce(conn ssh.Conn) {
+	var payload []byte
+	for _, signer := range r.announced() {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{signer.PublicKey().Marshal()})...)
+	}
+	conn.SendRequest("hostkeys-00@openssh.com", false, payload)
+}
+
+// handleGlobalRequests answers the hostkeys-prove-00 requests clients send
+// to check that the server holds announced keys, and rejects all other
+// global requests.
+func (r *hostKeyRing) handleGlobalRequests(conn ssh.ConnMetadata, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "hostkeys-prove-00@openssh.com" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		proof, err := r.prove(conn.SessionID(), req.Payload)
+		if err != nil {
+			r.logger.Warn("host key proof failed",
+				slog.String("remote_ip", getClientIP(conn.RemoteAddr())),
+				slog.String("session_id", getSessionID(conn)),
+				slog.String("error", err.Error()),
+			)
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, proof)
+	}
+}
+
+// prove signs the session ID with each of the requested keys.
+func (r *hostKeyRing) prove(sessionID, payload []byte) ([]byte, error) {
+	signers := r.announced()
+
+	var proof []byte
+	for len(payload) > 0 {
+		if len(payload) < 4 || uint32(len(payload)-4) < binary.BigEndian.Uint32(payload) {
+			return nil, fmt.Errorf("malformed request")
+		}
+		blob := payload[4 : 4+binary.BigEndian.Uint32(payload)]
+		payload = payload[4+len(blob):]
+
+		var signer ssh.Signer
+		for _, s := range signers {
+			if bytes.Equal(s.PublicKey().Marshal(), blob) {
+				signer = s
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("unknown host key requested")
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", sessionID, blob})
+
+		var signature *ssh.Signature
+		var err error
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			// OpenSSH doesn't accept SHA-1 signatures here
+			signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			signature, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(signature)})...)
+	}
+	return proof, nil
+}
+
+// sameHostKeys reports whether a and b hold the same public keys.
+func sameHostKeys(a, b []ssh.Signer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].PublicKey().Marshal(), b[i].PublicKey().Marshal()) {
+			return false
+		}
+	}
+	return true
+}
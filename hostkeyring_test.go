@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKeyRing(t *testing.T) (*hostKeyRing, ssh.Signer) {
+	t.Helper()
+	signer := newTestSigner(t)
+	return newHostKeyRing(&ssh.ServerConfig{NoClientAuth: true}, []ssh.Signer{signer}, slog.New(slog.NewTextHandler(os.Stderr, nil))), signer
+}
+
+func TestHostKeyRing_RotateNow(t *testing.T) {
+	ring, _ := newTestHostKeyRing(t)
+	before := ring.serverConfig()
+	if ring.serverConfig() != before {
+		t.Error("serverConfig() changed without a rotation")
+	}
+
+	ring.rotate([]ssh.Signer{ring.current[0]}, 0)
+	if ring.serverConfig() != before {
+		t.Error("serverConfig() changed after a rotation to the same keys")
+	}
+
+	signer := newTestSigner(t)
+	ring.rotate([]ssh.Signer{signer}, 0)
+	if ring.serverConfig() == before {
+		t.Error("serverConfig() unchanged after a rotation")
+	}
+	if got := ring.announced(); len(got) != 1 || got[0] != signer {
+		t.Errorf("announced() = %v, want only the new key", got)
+	}
+	if !ring.serverConfig().NoClientAuth {
+		t.Error("serverConfig() lost the template settings")
+	}
+}
+
+func TestHostKeyRing_Rollover(t *testing.T) {
+	ring, old := newTestHostKeyRing(t)
+	before := ring.serverConfig()
+
+	signer := newTestSigner(t)
+	ring.rotate([]ssh.Signer{signer}, 50*time.Millisecond)
+	if ring.serverConfig() != before {
+		t.Error("serverConfig() changed during the rollover window")
+	}
+	if got := ring.announced(); len(got) != 2 || got[0] != old || got[1] != signer {
+		t.Errorf("announced() = %v, want the old and the new key", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if ring.serverConfig() == before {
+		t.Error("serverConfig() unchanged after the rollover window")
+	}
+	if got := ring.announced(); len(got) != 1 || got[0] != signer {
+		t.Errorf("announced() = %v, want only the new key", got)
+	}
+}
+
+func TestHostKeyRing_Prove(t *testing.T) {
+	ring, old := newTestHostKeyRing(t)
+	signer := newTestSigner(t)
+	ring.rotate([]ssh.Signer{signer}, time.Hour)
+
+	sessionID := []byte("session")
+	var request []byte
+	for _, s := range []ssh.Signer{old, signer} {
+		request = append(request, ssh.Marshal(struct{ Key []byte }{s.PublicKey().Marshal()})...)
+	}
+	proof, err := ring.prove(sessionID, request)
+	if err != nil {
+		t.Fatalf("prove() unexpected error: %v", err)
+	}
+
+	for _, s := range []ssh.Signer{old, signer} {
+		var reply struct {
+			Signature []byte
+			Rest      []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(proof, &reply); err != nil {
+			t.Fatalf("failed to parse proof: %v", err)
+		}
+		proof = reply.Rest
+
+		var signature ssh.Signature
+		if err := ssh.Unmarshal(reply.Signature, &signature); err != nil {
+			t.Fatalf("failed to parse signature: %v", err)
+		}
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", sessionID, s.PublicKey().Marshal()})
+		if err := s.PublicKey().Verify(data, &signature); err != nil {
+			t.Errorf("proof for %s doesn't verify: %v", ssh.FingerprintSHA256(s.PublicKey()), err)
+		}
+	}
+	if len(proof) != 0 {
+		t.Errorf("proof has %d trailing bytes", len(proof))
+	}
+
+	unknown := ssh.Marshal(struct{ Key []byte }{newTestSigner(t).PublicKey().Marshal()})
+	if _, err := ring.prove(sessionID, unknown); err == nil {
+		t.Error("prove() of an unknown key: expected error")
+	}
+	if _, err := ring.prove(sessionID, []byte{0, 0, 1}); err == nil {
+		t.Error("prove() of a malformed request: expected error")
+	}
+}
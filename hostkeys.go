@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"golang.org/x/crypto/ssh"
+)
+
+// generateHostKeys creates a new set of host keys in PEM form: Ed25519 and
+// ECDSA for modern clients, and RSA for older ones.
+func generateHostKeys() ([]byte, error) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []byte
+	for _, key := range []crypto.PrivateKey{ed25519Key, ecdsaKey, rsaKey} {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pem.EncodeToMemory(block)...)
+	}
+	return keys, nil
+}
+
+// parseHostKeys parses one or more PEM encoded private keys.
+func parseHostKeys(data []byte) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		signer, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key: %w", err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	return signers, nil
+}
+
+// hostKeyStore keeps the host key outside the container, so every replica
+// of the gateway presents the same key and clients don't see a changed host
+// key after a restart.
+type hostKeyStore interface {
+	// get returns the stored key, and false if there is none yet.
+	get(ctx context.Context) ([]byte, bool, error)
+	// create stores key unless another replica stored one first, in which
+	// case it returns false.
+	create(ctx context.Context, key []byte) (bool, error)
+	// name identifies the store in logs.
+	name() string
+}
+
+// loadSharedHostKeys returns the host keys from store. On first boot a key
+// is generated and written back; if another replica wins that race, its key
+// is used instead.
+func loadSharedHostKeys(ctx context.Context, store hostKeyStore, logger *slog.Logger) ([]ssh.Signer, error) {
+	key, found, err := store.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		if key, err = generateHostKeys(); err != nil {
+			return nil, fmt.Errorf("failed to generate host keys: %w", err)
+		}
+		created, err := store.create(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			logger.Info("generated and stored new host keys", slog.String("store", store.name()))
+		} else if key, found, err = store.get(ctx); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, fmt.Errorf("host key disappeared from %s", store.name())
+		}
+	}
+
+	return parseHostKeys(key)
+}
+
+// secretHostKey stores the host key as the string value of a Secrets Manager
+// secret, see HOST_KEY_SECRET.
+type secretHostKey struct {
+	secretID string
+	client   *awsJSONClient
+}
+
+func newSecretHostKey(cfg *Config, awsConfig aws.Config) *secretHostKey {
+	return &secretHostKey{
+		secretID: cfg.HostKeySecret,
+		client:   newAWSJSONClient(awsConfig, "secretsmanager", "secretsmanager", "1.1"),
+	}
+}
+
+func (s *secretHostKey) name() string { return "secret " + s.secretID }
+
+func (s *secretHostKey) get(ctx context.Context) ([]byte, bool, error) {
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	err := s.client.call(ctx, "GetSecretValue", map[string]string{"SecretId": s.secretID}, &secret)
+	if isAWSErrorCode(err, "ResourceNotFoundException") {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return []byte(secret.SecretString), true, nil
+}
+
+func (s *secretHostKey) create(ctx context.Context, key []byte) (bool, error) {
+	err := s.client.call(ctx, "CreateSecret", map[string]string{
+		"Name":         s.secretID,
+		"Description":  "SSH host key of the SFTP gateway",
+		"SecretString": string(key),
+	}, &struct{}{})
+	if isAWSErrorCode(err, "ResourceExistsException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// parameterHostKey stores the host key in an SSM Parameter Store
+// SecureString parameter, see HOST_KEY_PARAMETER.
+type parameterHostKey struct {
+	parameter string
+	client    *awsJSONClient
+}
+
+func newParameterHostKey(cfg *Config, awsConfig aws.Config) *parameterHostKey {
+	return &parameterHostKey{
+		parameter: cfg.HostKeyParameter,
+		client:    newAWSJSONClient(awsConfig, "ssm", "AmazonSSM", "1.1"),
+	}
+}
+
+func (p *parameterHostKey) name() string { return "parameter " + p.parameter }
+
+func (p *parameterHostKey) get(ctx context.Context) ([]byte, bool, error) {
+	var result struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	err := p.client.call(ctx, "GetParameter", map[string]any{"Name": p.parameter, "WithDecryption": true}, &result)
+	if isAWSErrorCode(err, "ParameterNotFound") {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return []byte(result.Parameter.Value), true, nil
+}
+
+func (p *parameterHostKey) create(ctx context.Context, key []byte) (bool, error) {
+	err := p.client.call(ctx, "PutParameter", map[string]any{
+		"Name":        p.parameter,
+		"Description": "SSH host key of the SFTP gateway",
+		"Value":       string(key),
+		"Type":        "SecureString",
+		"Overwrite":   false,
+	}, &struct{}{})
+	if isAWSErrorCode(err, "ParameterAlreadyExists") {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeKeyService answers GetSecretValue/CreateSecret and
+// GetParameter/PutParameter from a single stored value.
+type fakeKeyService struct {
+	mu      sync.Mutex
+	value   string
+	creates int
+}
+
+func (f *fakeKeyService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var input map[string]any
+	json.NewDecoder(r.Body).Decode(&input)
+
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": code})
+	}
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "secretsmanager.GetSecretValue":
+		if f.value == "" {
+			fail("ResourceNotFoundException")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": f.value})
+	case "secretsmanager.CreateSecret":
+		f.creates++
+		if f.value != "" {
+			fail("ResourceExistsException")
+			return
+		}
+		f.value = input["SecretString"].(string)
+		w.Write([]byte(`{}`))
+	case "AmazonSSM.GetParameter":
+		if f.value == "" {
+			fail("ParameterNotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Parameter": map[string]string{"Value": f.value}})
+	case "AmazonSSM.PutParameter":
+		f.creates++
+		if f.value != "" {
+			fail("ParameterAlreadyExists")
+			return
+		}
+		f.value = input["Value"].(string)
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestLoadSharedHostKeys(t *testing.T) {
+	for _, kind := range []string{"secret", "parameter"} {
+		t.Run(kind, func(t *testing.T) {
+			service := &fakeKeyService{}
+			server := httptest.NewServer(service)
+			defer server.Close()
+
+			var store hostKeyStore
+			if kind == "secret" {
+				s := newSecretHostKey(&Config{HostKeySecret: "sftpgw/host-key"}, testAWSConfig(server))
+				s.client.endpoint = server.URL
+				store = s
+			} else {
+				p := newParameterHostKey(&Config{HostKeyParameter: "/sftpgw/host-key"}, testAWSConfig(server))
+				p.client.endpoint = server.URL
+				store = p
+			}
+			logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+			first, err := loadSharedHostKeys(context.Background(), store, logger)
+			if err != nil {
+				t.Fatalf("first boot unexpected error: %v", err)
+			}
+			second, err := loadSharedHostKeys(context.Background(), store, logger)
+			if err != nil {
+				t.Fatalf("second boot unexpected error: %v", err)
+			}
+
+			if service.creates != 1 {
+				t.Errorf("stored a key %d times, want once", service.creates)
+			}
+			if !bytes.Equal(first[0].PublicKey().Marshal(), second[0].PublicKey().Marshal()) {
+				t.Error("replicas loaded different host keys")
+			}
+		})
+	}
+}
+
+func TestLoadSharedHostKeys_LostRace(t *testing.T) {
+	existing, err := generateHostKeys()
+	if err != nil {
+		t.Fatalf("generateHostKeys() unexpected error: %v", err)
+	}
+
+	// The secret is created by another replica between our get and create.
+	service := &fakeKeyService{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "secretsmanager.CreateSecret" {
+			service.value = string(existing)
+		}
+		service.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	store := newSecretHostKey(&Config{HostKeySecret: "sftpgw/host-key"}, testAWSConfig(server))
+	store.client.endpoint = server.URL
+
+	signers, err := loadSharedHostKeys(context.Background(), store, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if err != nil {
+		t.Fatalf("loadSharedHostKeys() unexpected error: %v", err)
+	}
+	want, _ := parseHostKeys(existing)
+	if !bytes.Equal(signers[0].PublicKey().Marshal(), want[0].PublicKey().Marshal()) {
+		t.Error("expected the key stored by the other replica")
+	}
+}
+
+func TestGenerateHostKeys(t *testing.T) {
+	keys, err := generateHostKeys()
+	if err != nil {
+		t.Fatalf("generateHostKeys() unexpected error: %v", err)
+	}
+
+	signers, err := parseHostKeys(keys)
+	if err != nil {
+		t.Fatalf("parseHostKeys() unexpected error: %v", err)
+	}
+	var types []string
+	for _, signer := range signers {
+		types = append(types, signer.PublicKey().Type())
+	}
+	want := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA}
+	if !slices.Equal(types, want) {
+		t.Errorf("host key types = %v, want %v", types, want)
+	}
+}
+
+func TestParseHostKeys(t *testing.T) {
+	first, _ := generateHostKeys()
+	second, _ := generateHostKeys()
+
+	signers, err := parseHostKeys(append(first, second...))
+	if err != nil {
+		t.Fatalf("parseHostKeys() unexpected error: %v", err)
+	}
+	if len(signers) != 6 {
+		t.Errorf("parseHostKeys() returned %d keys, want 6", len(signers))
+	}
+
+	if _, err := parseHostKeys([]byte("not a key")); err == nil {
+		t.Error("parseHostKeys() expected error for data without a key")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// newAWSHTTPClient builds the HTTP client for requests to AWS. It is shared
+// by all sessions so connections are pooled, and tuned from the AWS_HTTP_*
+// settings. HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored unless
+// AWS_HTTP_PROXY overrides them.
+func newAWSHTTPClient(config *Config, skipVerify bool) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().
+		WithDialerOptions(func(d *net.Dialer) {
+			if config.AWSHTTPDialTimeout > 0 {
+				d.Timeout = config.AWSHTTPDialTimeout
+			}
+		}).
+		WithTransportOptions(func(tr *http.Transport) {
+			if config.AWSHTTPTLSHandshakeTimeout > 0 {
+				tr.TLSHandshakeTimeout = config.AWSHTTPTLSHandshakeTimeout
+			}
+			if config.AWSHTTPResponseHeaderTimeout > 0 {
+				tr.ResponseHeaderTimeout = config.AWSHTTPResponseHeaderTimeout
+			}
+			if config.AWSHTTPMaxIdleConnsPerHost > 0 {
+				tr.MaxIdleConnsPerHost = config.AWSHTTPMaxIdleConnsPerHost
+				tr.MaxIdleConns = max(tr.MaxIdleConns, config.AWSHTTPMaxIdleConnsPerHost)
+			}
+			if config.AWSHTTPProxy != "" {
+				proxy, _ := url.Parse(config.AWSHTTPProxy) // validated by LoadConfig
+				tr.Proxy = http.ProxyURL(proxy)
+			}
+			if skipVerify {
+				if tr.TLSClientConfig == nil {
+					tr.TLSClientConfig = &tls.Config{}
+				}
+				tr.TLSClientConfig.InsecureSkipVerify = true
+			}
+		})
+}
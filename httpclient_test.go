@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewAWSHTTPClient(t *testing.T) {
+	config := &Config{
+		AWSHTTPDialTimeout:           5 * time.Second,
+		AWSHTTPTLSHandshakeTimeout:   15 * time.Second,
+		AWSHTTPResponseHeaderTimeout: time.Minute,
+		AWSHTTPMaxIdleConnsPerHost:   64,
+		AWSHTTPProxy:                 "http://proxy.example.com:3128",
+	}
+
+	client := newAWSHTTPClient(config, false)
+
+	if client.GetDialer().Timeout != 5*time.Second {
+		t.Errorf("dial timeout = %v, want 5s", client.GetDialer().Timeout)
+	}
+
+	tr := client.GetTransport()
+	if tr.TLSHandshakeTimeout != 15*time.Second {
+		t.Errorf("TLS handshake timeout = %v, want 15s", tr.TLSHandshakeTimeout)
+	}
+	if tr.ResponseHeaderTimeout != time.Minute {
+		t.Errorf("response header timeout = %v, want 1m", tr.ResponseHeaderTimeout)
+	}
+	if tr.MaxIdleConnsPerHost != 64 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 64", tr.MaxIdleConnsPerHost)
+	}
+	if tr.TLSClientConfig != nil && tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("expected TLS verification to be enabled")
+	}
+
+	req, _ := http.NewRequest("GET", "https://s3.amazonaws.com/", nil)
+	proxy, err := tr.Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example.com:3128" {
+		t.Errorf("proxy = %v, %v; want proxy.example.com:3128", proxy, err)
+	}
+
+	if tr := newAWSHTTPClient(&Config{}, true).GetTransport(); !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("expected TLS verification to be skipped")
+	}
+}
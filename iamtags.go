@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// errForeignPrincipal is returned for principals of another AWS account than
+// the gateway's. IAM would look up a user or role of the same name in the
+// gateway's account instead, so their tags are never read.
+var errForeignPrincipal = errors.New("principal belongs to another AWS account")
+
+// iamTag is a member of the Tags list in IAM responses.
+type iamTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// iamTagLookup reads the tags of the IAM user or role behind a caller ARN.
+// IAM only speaks the query protocol, so requests are form encoded and
+// responses are XML.
+type iamTagLookup struct {
+	client    *awsJSONClient
+	accountID string // of the gateway, whose principals IAM returns tags of
+}
+
+// newIAMTagLookup creates a lookup against the global IAM endpoint, which is
+// signed for us-east-1 in the aws partition.
+func newIAMTagLookup(awsConfig aws.Config, accountID string) *iamTagLookup {
+	client := newAWSJSONClient(awsConfig, "iam", "", "")
+	client.endpoint = "https://iam.amazonaws.com"
+	client.region = "us-east-1"
+	return &iamTagLookup{client: client, accountID: accountID}
+}
+
+// gatewayAccountID returns the AWS account tags are looked up in:
+// AWS_ACCOUNT_ID, or else the account of the gateway's own credentials.
+func gatewayAccountID(ctx context.Context, config *Config, awsConfig aws.Config) (string, error) {
+	if config.RequiredAccountID != "" {
+		return config.RequiredAccountID, nil
+	}
+	identity, err := sts.NewFromConfig(awsConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(identity.Account), nil
+}
+
+// tag returns the value of the tag key on the principal, and whether it is
+// set.
+func (l *iamTagLookup) tag(ctx context.Context, principalARN, key string) (string, bool, error) {
+	tags, err := l.tags(ctx, principalARN)
+	if err != nil {
+		return "", false, err
+	}
+	value, found := tags[key]
+	return value, found, nil
+}
+
+// tags returns the tags on the principal by key. Assumed-role ARNs are
+// looked up on their role; principals that are neither users nor roles have
+// no tags. Principals of other accounts get errForeignPrincipal.
+func (l *iamTagLookup) tags(ctx context.Context, principalARN string) (map[string]string, error) {
+	parsed, err := arn.Parse(principalARN)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.AccountID != l.accountID {
+		return nil, errForeignPrincipal
+	}
+
+	params := url.Values{"Version": {"2010-05-08"}}
+	kind, rest, _ := strings.Cut(parsed.Resource, "/")
+	switch kind {
+	case "user":
+		params.Set("Action", "ListUserTags")
+		params.Set("UserName", rest[strings.LastIndex(rest, "/")+1:])
+	case "assumed-role":
+		role, _, _ := strings.Cut(rest, "/")
+		params.Set("Action", "ListRoleTags")
+		params.Set("RoleName", role)
+	case "role":
+		params.Set("Action", "ListRoleTags")
+		params.Set("RoleName", rest[strings.LastIndex(rest, "/")+1:])
+	default:
+		return nil, nil
+	}
+
+	tags, err := l.query(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		values[tag.Key] = tag.Value
+	}
+	return values, nil
+}
+
+func (l *iamTagLookup) query(ctx context.Context, params url.Values) ([]iamTag, error) {
+	resp, err := l.client.post(ctx, "/", []byte(params.Encode()), map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(body).Decode(&failure)
+		return nil, fmt.Errorf("iam %s failed: %s %s: %s", params.Get("Action"), resp.Status, failure.Code, failure.Message)
+	}
+
+	var result struct {
+		UserTags []iamTag `xml:"ListUserTagsResult>Tags>member"`
+		RoleTags []iamTag `xml:"ListRoleTagsResult>Tags>member"`
+	}
+	if err := xml.NewDecoder(body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid IAM response: %w", err)
+	}
+	return append(result.UserTags, result.RoleTags...), nil
+}
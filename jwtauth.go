@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Clock skew tolerated for exp and nbf, and how often the JWKS is fetched:
+// at most once per jwksMinRefresh when a token names an unknown key, and at
+// least once per jwksMaxAge so removed keys stop being accepted.
+const (
+	jwtLeeway      = time.Minute
+	jwksMinRefresh = time.Minute
+	jwksMaxAge     = time.Hour
+)
+
+// jwtAlgorithms maps the accepted signature algorithms to their hash. Tokens
+// with "none" or HMAC algorithms are always rejected.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// jwtClaims are the token claims the gateway uses. The sftp_* claims are
+// optional: the prefix defaults to the subject, the bucket to S3_BUCKET and
+// a quota of zero means unlimited.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Prefix    string      `json:"sftp_prefix"`
+	Bucket    string      `json:"sftp_bucket"`
+	Quota     int64       `json:"sftp_quota"`
+}
+
+// jwtAudience is the aud claim, which may be a string or a list of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// JWTAuthenticator accepts a signed JWT, such as an OIDC access token, in
+// place of a password. Tokens are verified against the issuer's published
+// keys, so automated uploaders can use short-lived tokens instead of AWS
+// secret keys. Token users have no AWS credentials and their uploads are
+// stored with the gateway's own credentials.
+type JWTAuthenticator struct {
+	issuer   string
+	audience string // required in aud if set
+	keys     *jwks
+	timeFunc func() time.Time
+	logger   *slog.Logger
+}
+
+func NewJWTAuthenticator(config *Config, logger *slog.Logger) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		issuer:   config.JWTIssuer,
+		audience: config.JWTAudience,
+		keys: &jwks{
+			url:    config.JWTJWKSURL,
+			issuer: config.JWTIssuer,
+			client: &http.Client{Timeout: 10 * time.Second},
+		},
+		timeFunc: time.Now,
+		logger:   logger,
+	}
+}
+
+// wrapJWT sends passwords that look like a JWT to a and all others to next,
+// so tokens and the existing password method can be used side by side.
+// AWS secret keys never contain dots.
+func wrapJWT(a *JWTAuthenticator, next func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if bytes.Count(password, []byte(".")) == 2 {
+			return a.Authenticate(conn, password)
+		}
+		return next(conn, password)
+	}
+}
+
+func (a *JWTAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+	user := conn.User()
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", user,
+		"method", "jwt",
+	)
+
+	a.logger.Info("authentication attempt", logCtx)
+
+	claims, err := a.verify(string(password))
+	if err != nil {
+		a.logger.Warn("authentication failed: invalid token", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	// The user name must be the token subject, so logs and the user
+	// permission extension can't be chosen freely by whoever holds a token.
+	if user != claims.Subject || !principalPattern.MatchString(user) {
+		a.logger.Warn("authentication failed: user name does not match token subject", logCtx,
+			slog.String("subject", claims.Subject),
+		)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	prefix := user
+	if claims.Prefix != "" {
+		prefix = path.Clean(strings.Trim(claims.Prefix, "/"))
+		if prefix == "." || strings.HasPrefix(prefix, "..") {
+			a.logger.Warn("authentication failed: token has an invalid prefix", logCtx, slog.String("upload_prefix", claims.Prefix))
+			return nil, fmt.Errorf("invalid credentials")
+		}
+	}
+	if claims.Quota < 0 {
+		a.logger.Warn("authentication failed: token has a negative quota", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	a.logger.Info("authentication successful", logCtx,
+		slog.String("upload_prefix", prefix),
+		slog.String("bucket", claims.Bucket),
+		slog.Int64("quota", claims.Quota),
+		slog.Time("token_expires", time.Unix(claims.ExpiresAt, 0)),
+	)
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":          user,
+			"upload_prefix": prefix,
+			"bucket":        claims.Bucket,
+			"quota":         strconv.FormatInt(claims.Quota, 10),
+			"client_ip":     clientIP,
+		},
+	}, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of token and
+// returns its claims.
+func (a *JWTAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	hash, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	key, err := a.keys.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(key, header.Algorithm, h.Sum(nil), hash, signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+
+	now := a.timeFunc()
+	switch {
+	case claims.Issuer != a.issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case a.audience != "" && !slices.Contains(claims.Audience, a.audience):
+		return nil, errors.New("token is not for this audience")
+	case claims.ExpiresAt == 0:
+		return nil, errors.New("token has no expiry")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-jwtLeeway)):
+		return nil, errors.New("token not yet valid")
+	}
+	return &claims, nil
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(key crypto.PublicKey, algorithm string, digest []byte, hash crypto.Hash, signature []byte) error {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "RS") {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(algorithm, "ES") {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key does not match algorithm %s", algorithm)
+}
+
+// jwks holds the issuer's signing keys by key ID. Without an explicit URL
+// the JWKS location is found through OIDC discovery.
+type jwks struct {
+	url    string
+	issuer string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func (k *jwks) key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[kid]
+	age := time.Since(k.fetched)
+	if ok && age < jwksMaxAge {
+		return key, nil
+	}
+	if !ok && k.keys != nil && age < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+
+	keys, err := k.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	k.keys = keys
+	k.fetched = time.Now()
+
+	if key, ok = k.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+func (k *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	if k.url == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := k.getJSON(strings.TrimSuffix(k.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("issuer has no jwks_uri")
+		}
+		k.url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := k.getJSON(k.url, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			keys[jwk.KeyID] = pub
+		}
+	}
+	return keys, nil
+}
+
+func (k *jwks) getJSON(url string, v any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), k.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
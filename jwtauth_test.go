@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	b64 := base64.RawURLEncoding.EncodeToString
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.server.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// sign returns a token for claims, signed with the RSA key for RS256 and
+// the EC key for ES256.
+func (i *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest.Sum(nil))
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, i.ecKey, digest.Sum(nil))
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestJWTAuthenticator(issuer *testIssuer) *JWTAuthenticator {
+	return NewJWTAuthenticator(&Config{
+		JWTIssuer:   issuer.server.URL,
+		JWTAudience: "sftpgw",
+	}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := newTestJWTAuthenticator(issuer)
+
+	claims := map[string]any{
+		"iss":         issuer.server.URL,
+		"sub":         "uploader-1",
+		"aud":         []string{"other", "sftpgw"},
+		"exp":         time.Now().Add(5 * time.Minute).Unix(),
+		"sftp_prefix": "/partners/acme/",
+		"sftp_quota":  2048,
+	}
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa-1", "ES256": "ec-1"}[alg]
+		perms, err := auth.Authenticate(testConnMetadata{user: "uploader-1"}, []byte(issuer.sign(t, alg, kid, claims)))
+		if err != nil {
+			t.Fatalf("Authenticate() with %s unexpected error: %v", alg, err)
+		}
+		if perms.Extensions["upload_prefix"] != "partners/acme" {
+			t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "partners/acme")
+		}
+		if perms.Extensions["quota"] != "2048" {
+			t.Errorf("quota = %q, want %q", perms.Extensions["quota"], "2048")
+		}
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "someone-else"}, []byte(issuer.sign(t, "RS256", "rsa-1", claims))); err == nil {
+		t.Error("Authenticate() expected error for user name other than the subject")
+	}
+}
+
+func TestJWTAuthenticator_RejectsInvalidTokens(t *testing.T) {
+	issuer := newTestIssuer(t)
+	auth := newTestJWTAuthenticator(issuer)
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss": issuer.server.URL,
+			"sub": "uploader-1",
+			"aud": "sftpgw",
+			"exp": time.Now().Add(5 * time.Minute).Unix(),
+		}
+	}
+
+	tests := map[string]func() string{
+		"expired": func() string {
+			claims := valid()
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return issuer.sign(t, "RS256", "rsa-1", claims)
+		},
+		"no expiry": func() string {
+			claims := valid()
+			delete(claims, "exp")
+			return issuer.sign(t, "RS256", "rsa-1", claims)
+		},
+		"wrong issuer": func() string {
+			claims := valid()
+			claims["iss"] = "https://evil.example.com"
+			return issuer.sign(t, "RS256", "rsa-1", claims)
+		},
+		"wrong audience": func() string {
+			claims := valid()
+			claims["aud"] = "other"
+			return issuer.sign(t, "RS256", "rsa-1", claims)
+		},
+		"unknown key": func() string {
+			return issuer.sign(t, "RS256", "rsa-2", valid())
+		},
+		"key of other type": func() string {
+			return issuer.sign(t, "RS256", "ec-1", valid())
+		},
+		"tampered": func() string {
+			token := issuer.sign(t, "RS256", "rsa-1", valid())
+			other := issuer.sign(t, "RS256", "rsa-1", map[string]any{"sub": "admin"})
+			return token[:len(token)-10] + other[len(other)-10:]
+		},
+		"alg none": func() string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+			payload, _ := json.Marshal(valid())
+			return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		},
+	}
+
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := auth.Authenticate(testConnMetadata{user: "uploader-1"}, []byte(token())); err == nil {
+				t.Error("Authenticate() expected error")
+			}
+		})
+	}
+}
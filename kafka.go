@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A minimal Kafka producer with just what publishing files needs: metadata
+// to find the leader of each partition, Produce with one record per request,
+// TLS and SASL/PLAIN. Requests use versions from before the flexible
+// encoding that every broker since Kafka 1.0 answers, and are encoded by
+// hand.
+
+// Kafka API keys and the versions used.
+const (
+	kafkaProduce          = 0 // v3, the first with record batches
+	kafkaMetadata         = 3 // v4
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+
+	kafkaMaxResponseSize = 1 << 20
+	kafkaClientID        = "sftpgw"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by a broker.
+type kafkaError struct {
+	code int16
+}
+
+// kafkaErrorNames names the codes a producer is likely to see.
+var kafkaErrorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	56: "KAFKA_STORAGE_ERROR",
+	58: "SASL_AUTHENTICATION_FAILED",
+	87: "INVALID_RECORD",
+}
+
+func (e *kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e.code]; ok {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", e.code)
+}
+
+// retryable reports whether the request may succeed later, typically once
+// the leaders have been looked up again. Other codes mean the broker
+// refused the record or the credentials.
+func (e *kafkaError) retryable() bool {
+	switch e.code {
+	case 3, 5, 6, 7, 13, 19, 20, 56:
+		return true
+	}
+	return false
+}
+
+// kafkaHeader is a header of a record.
+type kafkaHeader struct {
+	key, value string
+}
+
+// kafkaRecord is a message published to a topic. Records with the same key
+// go to the same partition, in order.
+type kafkaRecord struct {
+	key     []byte
+	value   []byte
+	headers []kafkaHeader
+	time    time.Time
+}
+
+// kafkaProducer publishes records to a topic with acks=all, so a record is
+// only acknowledged once all in-sync replicas have it.
+type kafkaProducer struct {
+	brokers   []string // host:port to look up the topic with
+	topic     string
+	tlsConfig *tls.Config // nil for plaintext connections
+	username  string      // SASL/PLAIN, if set
+	password  string
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	leaders []string // address of the leader of each partition, looked up on first use
+	conns   map[string]*kafkaConn
+}
+
+// produce publishes record to the partition its key hashes to, like the
+// Java client's default partitioner.
+func (p *kafkaProducer) produce(ctx context.Context, record kafkaRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.leaders == nil {
+		if err := p.lookupLeaders(ctx); err != nil {
+			return err
+		}
+	}
+	partition := int32(kafkaMurmur2(record.key)&0x7fffffff) % int32(len(p.leaders))
+	address := p.leaders[partition]
+	if address == "" {
+		p.leaders = nil
+		return &kafkaError{code: 5}
+	}
+
+	conn, err := p.connect(ctx, address)
+	if err == nil {
+		err = conn.produce(ctx, p.topic, partition, record, p.timeout)
+	}
+	var brokerErr *kafkaError
+	if err != nil && (!errors.As(err, &brokerErr) || brokerErr.retryable()) {
+		// the leader may have moved, or the connection broke
+		p.disconnect(address)
+		p.leaders = nil
+	}
+	return err
+}
+
+// lookupLeaders asks the brokers in turn for the leaders of the topic's
+// partitions.
+func (p *kafkaProducer) lookupLeaders(ctx context.Context) error {
+	var err error
+	for _, address := range p.brokers {
+		var conn *kafkaConn
+		if conn, err = p.connect(ctx, address); err != nil {
+			continue
+		}
+		var leaders []string
+		if leaders, err = conn.metadata(ctx, p.topic, p.timeout); err != nil {
+			p.disconnect(address)
+			continue
+		}
+		p.leaders = leaders
+		return nil
+	}
+	return fmt.Errorf("failed to look up topic %s: %w", p.topic, err)
+}
+
+// connect returns the connection to address, dialing and authenticating
+// it first if there is none.
+func (p *kafkaProducer) connect(ctx context.Context, address string) (*kafkaConn, error) {
+	if conn, ok := p.conns[address]; ok {
+		return conn, nil
+	}
+
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var conn net.Conn
+	var err error
+	if p.tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: p.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &kafkaConn{conn: conn}
+	if p.username != "" {
+		if err := c.authenticate(ctx, p.username, p.password, p.timeout); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SASL authentication failed: %w", err)
+		}
+	}
+	if p.conns == nil {
+		p.conns = make(map[string]*kafkaConn)
+	}
+	p.conns[address] = c
+	return c, nil
+}
+
+func (p *kafkaProducer) disconnect(address string) {
+	if conn, ok := p.conns[address]; ok {
+		conn.conn.Close()
+		delete(p.conns, address)
+	}
+}
+
+type kafkaConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+// roundTrip sends a request and returns the body of its response.
+func (c *kafkaConn) roundTrip(ctx context.Context, apiKey, version int16, body []byte, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	c.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // size, filled in below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(c.correlationID)
+	req.string(kafkaClientID)
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+	if _, err := c.conn.Write(req.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("kafka response of %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != c.correlationID {
+		return nil, fmt.Errorf("kafka response %d to request %d", id, c.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// authenticate logs in with SASL/PLAIN.
+func (c *kafkaConn) authenticate(ctx context.Context, username, password string, timeout time.Duration) error {
+	var req kafkaEncoder
+	req.string("PLAIN")
+	resp, err := c.roundTrip(ctx, kafkaSaslHandshake, 1, req.buf, timeout)
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return &kafkaError{code: code}
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	req = kafkaEncoder{}
+	req.bytes([]byte("\x00" + username + "\x00" + password))
+	if resp, err = c.roundTrip(ctx, kafkaSaslAuthenticate, 0, req.buf, timeout); err != nil {
+		return err
+	}
+	d = kafkaDecoder{buf: resp}
+	code, message := d.int16(), d.nullableString()
+	if d.err != nil {
+		return d.err
+	}
+	if code != 0 {
+		return fmt.Errorf("%w: %s", &kafkaError{code: code}, message)
+	}
+	return nil
+}
+
+// metadata returns the address of the leader of each partition of topic,
+// "" for partitions without one.
+func (c *kafkaConn) metadata(ctx context.Context, topic string, timeout time.Duration) ([]string, error) {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(topic)
+	req.int8(0) // allow_auto_topic_creation
+	resp, err := c.roundTrip(ctx, kafkaMetadata, 4, req.buf, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	d := kafkaDecoder{buf: resp}
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for range d.arrayLen() {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.nullableString() // rack
+		brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.nullableString() // cluster_id
+	d.int32()          // controller_id
+
+	var leaders []string
+	for range d.arrayLen() {
+		code, name := d.int16(), d.string()
+		d.int8() // is_internal
+		partitions := d.arrayLen()
+		if name == topic && code != 0 {
+			return nil, &kafkaError{code: code}
+		}
+		for range partitions {
+			d.int16() // error_code
+			index, leader := d.int32(), d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			if name != topic || index < 0 || d.err != nil {
+				continue
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, "")
+			}
+			leaders[index] = brokers[leader]
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(leaders) == 0 {
+		return nil, &kafkaError{code: 3}
+	}
+	return leaders, nil
+}
+
+// produce sends record to partition of topic and waits for all in-sync
+// replicas to acknowledge it.
+func (c *kafkaConn) produce(ctx context.Context, topic string, partition int32, record kafkaRecord, timeout time.Duration) error {
+	var req kafkaEncoder
+	req.int16(-1) // no transactional_id
+	req.int16(-1) // acks=all
+	req.int32(int32(timeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(kafkaRecordBatch(record))
+	resp, err := c.roundTrip(ctx, kafkaProduce, 3, req.buf, timeout)
+	if err != nil {
+		return err
+	}
+
+	d := kafkaDecoder{buf: resp}
+	for range d.arrayLen() {
+		name := d.string()
+		for range d.arrayLen() {
+			index, code := d.int32(), d.int16()
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			if d.err == nil && name == topic && index == partition {
+				if code != 0 {
+					return &kafkaError{code: code}
+				}
+				return nil
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fmt.Errorf("kafka: no response for partition %d", partition)
+}
+
+// kafkaRecordBatch encodes record as a batch of one record, in the format
+// of message version 2.
+func kafkaRecordBatch(record kafkaRecord) []byte {
+	var r kafkaEncoder
+	r.int8(0)   // attributes
+	r.varint(0) // timestamp delta
+	r.varint(0) // offset delta
+	r.varbytes(record.key)
+	r.varbytes(record.value)
+	r.varint(int64(len(record.headers)))
+	for _, h := range record.headers {
+		r.varbytes([]byte(h.key))
+		r.varbytes([]byte(h.value))
+	}
+
+	// the part of the batch the CRC covers
+	var body kafkaEncoder
+	timestamp := record.time.UnixMilli()
+	body.int16(0) // attributes: no compression, create time
+	body.int32(0) // last offset delta
+	body.int64(timestamp)
+	body.int64(timestamp)
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(1)  // records
+	body.varint(int64(len(r.buf)))
+	body.buf = append(body.buf, r.buf...)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.buf, crc32c)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// kafkaMurmur2 is the hash the Java client partitions records by key with.
+func kafkaMurmur2(data []byte) int32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaEncoder appends the primitive types of the Kafka protocol.
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+
+// varint appends a zig-zag encoded variable length integer, as used in
+// records.
+func (e *kafkaEncoder) varint(v int64) { e.buf = binary.AppendVarint(e.buf, v) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// varbytes appends the key, value or a header field of a record; nil is
+// encoded as null.
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder reads the primitive types of the Kafka protocol. After the
+// response ended early, reads return zero values and err is set.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = errors.New("kafka: malformed response")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLen returns the number of elements of an array, 0 for null.
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if d.err != nil || n < 0 {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = errors.New("kafka: malformed response")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *kafkaDecoder) int32Array() {
+	d.next(4 * d.arrayLen())
+}
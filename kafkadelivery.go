@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// errKafkaMessageTooLarge is returned for files above KAFKA_MAX_MESSAGE_SIZE
+// that aren't also stored in S3.
+var errKafkaMessageTooLarge = errors.New("file too large for a Kafka message")
+
+// kafkaDelivery publishes each file as a record to KAFKA_TOPIC, so stream
+// processing pipelines can consume partner files directly. The value of the
+// record is the file; headers describe it. With KAFKA_STORE_S3 files are
+// stored in S3 first, and files above KAFKA_MAX_MESSAGE_SIZE are only
+// stored there.
+type kafkaDelivery struct {
+	producer *kafkaProducer
+	store    objectStore // nil unless KAFKA_STORE_S3 is set
+	maxSize  int64
+	retry    retryPolicy
+	timeFunc func() time.Time
+	logger   *slog.Logger
+}
+
+func newKafkaDelivery(config *Config, store objectStore, logger *slog.Logger) *kafkaDelivery {
+	producer := &kafkaProducer{
+		brokers:  config.KafkaBrokers,
+		topic:    config.KafkaTopic,
+		username: config.KafkaSASLUsername,
+		password: config.KafkaSASLPassword,
+		timeout:  30 * time.Second,
+	}
+	if config.KafkaTLS {
+		producer.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	d := &kafkaDelivery{
+		producer: producer,
+		maxSize:  config.KafkaMaxMessageSize,
+		retry:    newRetryPolicy(config),
+		timeFunc: time.Now,
+		logger:   logger,
+	}
+	if config.KafkaStoreS3 {
+		d.store = store
+	}
+	return d
+}
+
+// UploadFile publishes a whole file. Without S3 there is no bucket; the key
+// is the path of the file below the user's prefix, as in the record's
+// headers.
+func (d *kafkaDelivery) UploadFile(ctx context.Context, session uploadSession, filePath string, body io.ReaderAt, size int64) (bucket, key string, err error) {
+	key = path.Join("/", session.prefix, filePath)
+	if d.store != nil {
+		if bucket, key, err = d.store.UploadFile(ctx, session, filePath, body, size); err != nil {
+			return bucket, key, err
+		}
+	}
+
+	logCtx := slog.Group("kafka_delivery",
+		"remote_ip", session.clientIP,
+		"session_id", session.sessionID,
+		"file_path", filePath,
+		"file_size", size,
+		"topic", d.producer.topic,
+	)
+
+	if size > d.maxSize {
+		if d.store != nil {
+			d.logger.Info("file too large for Kafka, stored in S3 only", logCtx)
+			return bucket, key, nil
+		}
+		d.logger.Error("Kafka delivery failed", logCtx, slog.String("error", errKafkaMessageTooLarge.Error()))
+		return bucket, key, fmt.Errorf("failed to publish to Kafka: %w", errKafkaMessageTooLarge)
+	}
+
+	value := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(body, 0, size), value); err != nil {
+		return bucket, key, fmt.Errorf("failed to read upload data: %w", err)
+	}
+	sum := sha256.Sum256(value)
+	record := kafkaRecord{
+		key:   []byte(session.user), // a user's files stay in order
+		value: value,
+		headers: []kafkaHeader{
+			{"content-type", detectContentType(filePath, value)},
+			{"sftpgw-delivery-id", newUUID()},
+			{"sftpgw-user", session.user},
+			{"sftpgw-session-id", session.sessionID},
+			{"sftpgw-remote-ip", session.clientIP},
+			{"sftpgw-file-path", path.Join("/", session.prefix, filePath)},
+			{"sftpgw-content-sha256", hex.EncodeToString(sum[:])},
+		},
+		time: d.timeFunc(),
+	}
+	if session.accountID != "" {
+		record.headers = append(record.headers, kafkaHeader{"sftpgw-account-id", session.accountID})
+	}
+	if bucket != "" {
+		record.headers = append(record.headers, kafkaHeader{"sftpgw-s3-bucket", bucket}, kafkaHeader{"sftpgw-s3-key", key})
+	}
+
+	d.logger.Info("starting Kafka delivery", logCtx)
+	err = d.retry.do(ctx, d.logger, logCtx, "Produce", func() error {
+		return d.producer.produce(ctx, record)
+	})
+	if err != nil {
+		d.logger.Error("Kafka delivery failed", logCtx, slog.String("error", err.Error()))
+		return bucket, key, fmt.Errorf("failed to publish to Kafka: %w", err)
+	}
+	d.logger.Info("Kafka delivery successful", logCtx)
+	return bucket, key, nil
+}
+
+// StartStream refuses streaming, as a record holds a whole file; LoadConfig
+// rejects STREAM_UPLOADS with KAFKA_BROKERS.
+func (d *kafkaDelivery) StartStream(context.Context, uploadSession, string) (uploadStream, error) {
+	return nil, errors.New("streaming uploads can't be published to Kafka")
+}
+
+// Exists asks S3 with KAFKA_STORE_S3, and otherwise reports every key as
+// free, as a topic can't be searched for a file.
+func (d *kafkaDelivery) Exists(ctx context.Context, session uploadSession, key string) (bool, error) {
+	if d.store != nil {
+		return d.store.Exists(ctx, session, key)
+	}
+	return false, nil
+}
+
+func (d *kafkaDelivery) bucketFor(session uploadSession) string {
+	if d.store != nil {
+		return d.store.bucketFor(session)
+	}
+	return ""
+}
+
+func (d *kafkaDelivery) keyPrefix(session uploadSession) string {
+	if d.store != nil {
+		return d.store.keyPrefix(session)
+	}
+	return session.prefix
+}
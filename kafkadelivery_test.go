@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKafkaBroker answers Metadata and Produce requests like a cluster of
+// one broker leading every partition of a topic.
+type fakeKafkaBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int32
+
+	mu       sync.Mutex
+	codes    []int16 // error codes to answer the next Produce requests with
+	lookups  int
+	produced []fakeKafkaRecord
+}
+
+// fakeKafkaRecord is a record as the broker decoded it.
+type fakeKafkaRecord struct {
+	partition int32
+	key       string
+	value     string
+	headers   map[string]string
+}
+
+func newFakeKafkaBroker(t *testing.T, topic string, partitions int32) *fakeKafkaBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	b := &fakeKafkaBroker{t: t, listener: listener, topic: topic, partitions: partitions}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// results returns the records produced and the number of metadata lookups.
+func (b *fakeKafkaBroker) results() ([]fakeKafkaRecord, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.produced, b.lookups
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{buf: req}
+		apiKey, version, correlationID := d.int16(), d.int16(), d.int32()
+		d.nullableString() // client_id
+
+		var resp kafkaEncoder
+		resp.int32(0)
+		resp.int32(correlationID)
+		switch {
+		case apiKey == kafkaMetadata && version == 4:
+			b.metadata(&resp)
+		case apiKey == kafkaProduce && version == 3:
+			b.produce(&d, &resp)
+		default:
+			b.t.Errorf("unexpected request %d v%d", apiKey, version)
+			return
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := conn.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeKafkaBroker) metadata(resp *kafkaEncoder) {
+	b.mu.Lock()
+	b.lookups++
+	b.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.int32(1) // node_id
+	resp.string(host)
+	resp.int32(int32(portNumber))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster_id
+	resp.int32(1)  // controller_id
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(b.topic)
+	resp.int8(0)
+	resp.int32(b.partitions)
+	for i := range b.partitions {
+		resp.int16(0)
+		resp.int32(i)
+		resp.int32(1) // leader
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+	}
+}
+
+func (b *fakeKafkaBroker) produce(d *kafkaDecoder, resp *kafkaEncoder) {
+	d.nullableString() // transactional_id
+	if acks := d.int16(); acks != -1 {
+		b.t.Errorf("acks = %d, want all", acks)
+	}
+	d.int32() // timeout_ms
+	d.arrayLen()
+	topic := d.string()
+	d.arrayLen()
+	partition := d.int32()
+	batch := d.next(int(d.int32()))
+	if d.err != nil {
+		b.t.Errorf("malformed Produce request: %v", d.err)
+		return
+	}
+
+	b.mu.Lock()
+	var code int16
+	if len(b.codes) > 0 {
+		code, b.codes = b.codes[0], b.codes[1:]
+	}
+	if code == 0 {
+		record := decodeKafkaRecordBatch(b.t, batch)
+		record.partition = partition
+		b.produced = append(b.produced, record)
+	}
+	b.mu.Unlock()
+
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(partition)
+	resp.int16(code)
+	resp.int64(0)  // base_offset
+	resp.int64(-1) // log_append_time_ms
+	resp.int32(0)  // throttle_time_ms
+}
+
+// decodeKafkaRecordBatch checks the CRC of a batch of one record and
+// returns the record.
+func decodeKafkaRecordBatch(t *testing.T, batch []byte) fakeKafkaRecord {
+	d := kafkaDecoder{buf: batch}
+	d.int64() // base offset
+	if length := d.int32(); int(length) != len(d.buf) {
+		t.Errorf("batch length = %d, want %d", length, len(d.buf))
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != 2 {
+		t.Errorf("magic = %d, want 2", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.buf, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("batch CRC %08x doesn't match", crc)
+	}
+	d.next(2 + 4 + 8 + 8 + 8 + 2 + 4) // attributes to base sequence
+	if count := d.int32(); count != 1 {
+		t.Errorf("batch of %d records, want 1", count)
+	}
+
+	buf := d.buf
+	varint := func() int64 {
+		v, n := binary.Varint(buf)
+		buf = buf[n:]
+		return v
+	}
+	varbytes := func() string {
+		n := varint()
+		v := string(buf[:n])
+		buf = buf[n:]
+		return v
+	}
+	varint() // length
+	buf = buf[1:]
+	varint() // timestamp delta
+	varint() // offset delta
+	record := fakeKafkaRecord{key: varbytes(), value: varbytes(), headers: make(map[string]string)}
+	for range varint() {
+		key := varbytes()
+		record.headers[key] = varbytes()
+	}
+	return record
+}
+
+func newTestKafkaDelivery(t *testing.T, broker *fakeKafkaBroker, store objectStore) *kafkaDelivery {
+	t.Helper()
+	config := &Config{
+		KafkaBrokers:         []string{broker.listener.Addr().String()},
+		KafkaTopic:           broker.topic,
+		KafkaStoreS3:         store != nil,
+		KafkaMaxMessageSize:  16,
+		UploadRetryAttempts:  2,
+		UploadRetryBaseDelay: time.Millisecond,
+	}
+	d := newKafkaDelivery(config, store, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	d.timeFunc = func() time.Time { return time.Unix(1705329045, 0) }
+	return d
+}
+
+func TestKafkaDelivery_UploadFile(t *testing.T) {
+	broker := newFakeKafkaBroker(t, "partner-files", 3)
+	d := newTestKafkaDelivery(t, broker, nil)
+
+	session := uploadSession{user: "acme", prefix: "acme", sessionID: "0123456789abcdef", clientIP: "203.0.113.7"}
+	bucket, key, err := d.UploadFile(context.Background(), session, "/uploads/order.csv", strings.NewReader("a,b\n"), 4)
+	if err != nil {
+		t.Fatalf("UploadFile() unexpected error: %v", err)
+	}
+	if bucket != "" || key != "/acme/uploads/order.csv" {
+		t.Errorf("UploadFile() = %q, %q, want no bucket and the path below the prefix", bucket, key)
+	}
+
+	produced, _ := broker.results()
+	if len(produced) != 1 {
+		t.Fatalf("%d records produced, want 1", len(produced))
+	}
+	record := produced[0]
+	if want := (kafkaMurmur2([]byte("acme")) & 0x7fffffff) % 3; record.partition != want {
+		t.Errorf("partition = %d, want %d for the user's key", record.partition, want)
+	}
+	if record.key != "acme" || record.value != "a,b\n" {
+		t.Errorf("record = %q: %q, want the file keyed by user", record.key, record.value)
+	}
+	for name, want := range map[string]string{
+		"content-type":          "text/csv",
+		"sftpgw-user":           "acme",
+		"sftpgw-session-id":     "0123456789abcdef",
+		"sftpgw-file-path":      "/acme/uploads/order.csv",
+		"sftpgw-content-sha256": "5be08c9684a1d25efcee09318204824278b08bbfb4aef973ffefd0b9d7478313",
+	} {
+		if got := record.headers[name]; got != want {
+			t.Errorf("header %s = %q, want %q", name, got, want)
+		}
+	}
+
+	_, _, err = d.UploadFile(context.Background(), session, "/uploads/large.csv", strings.NewReader(strings.Repeat("x", 17)), 17)
+	if !errors.Is(err, errKafkaMessageTooLarge) {
+		t.Errorf("UploadFile() of a large file error = %v, want %v", err, errKafkaMessageTooLarge)
+	}
+}
+
+func TestKafkaDelivery_StoreS3(t *testing.T) {
+	broker := newFakeKafkaBroker(t, "partner-files", 1)
+	store := &fakeObjectStore{}
+	d := newTestKafkaDelivery(t, broker, store)
+
+	session := uploadSession{user: "acme", prefix: "acme"}
+	if _, _, err := d.UploadFile(context.Background(), session, "/a.txt", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("UploadFile() unexpected error: %v", err)
+	}
+	if _, _, err := d.UploadFile(context.Background(), session, "/large.txt", strings.NewReader(strings.Repeat("x", 17)), 17); err != nil {
+		t.Fatalf("UploadFile() of a large file unexpected error: %v", err)
+	}
+
+	if len(store.files) != 2 {
+		t.Errorf("%d files stored in S3, want both", len(store.files))
+	}
+	if produced, _ := broker.results(); len(produced) != 1 || produced[0].headers["sftpgw-s3-key"] == "" {
+		t.Errorf("records = %v, want the small file with its S3 key", produced)
+	}
+}
+
+func TestKafkaDelivery_Retry(t *testing.T) {
+	for _, tt := range []struct {
+		code         int16
+		wantErr      bool
+		wantLookups  int
+		wantProduced int
+	}{
+		{6, false, 2, 1}, // NOT_LEADER_OR_FOLLOWER: look up the leader again
+		{10, true, 1, 0}, // MESSAGE_TOO_LARGE
+		{29, true, 1, 0}, // TOPIC_AUTHORIZATION_FAILED
+	} {
+		broker := newFakeKafkaBroker(t, "partner-files", 1)
+		broker.codes = []int16{tt.code}
+		d := newTestKafkaDelivery(t, broker, nil)
+
+		_, _, err := d.UploadFile(context.Background(), uploadSession{user: "acme"}, "/a.txt", strings.NewReader("x"), 1)
+		var kafkaErr *kafkaError
+		if gotErr := errors.As(err, &kafkaErr); gotErr != tt.wantErr {
+			t.Errorf("code %d: UploadFile() error = %v", tt.code, err)
+		}
+		if produced, lookups := broker.results(); lookups != tt.wantLookups || len(produced) != tt.wantProduced {
+			t.Errorf("code %d: %d lookups and %d records, want %d and %d", tt.code, lookups, len(produced), tt.wantLookups, tt.wantProduced)
+		}
+	}
+}
+
+func TestKafkaDelivery_UnknownTopic(t *testing.T) {
+	broker := newFakeKafkaBroker(t, "partner-files", 1)
+	d := newTestKafkaDelivery(t, broker, nil)
+	d.producer.topic = "other-files"
+
+	_, _, err := d.UploadFile(context.Background(), uploadSession{user: "acme"}, "/a.txt", strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "UNKNOWN_TOPIC_OR_PARTITION") {
+		t.Errorf("UploadFile() error = %v, want the topic to be unknown", err)
+	}
+}
+
+func TestKafkaMurmur2(t *testing.T) {
+	// values of the Java client's Utils.murmur2
+	for in, want := range map[string]int32{
+		"21":     -973932308,
+		"foobar": -790332482,
+		"abc":    479470107,
+	} {
+		if got := kafkaMurmur2([]byte(in)); got != want {
+			t.Errorf("kafkaMurmur2(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultKeyTemplate produces PREFIX/YYYY-MM-DD/FILENAME, or YYYY-MM-DD/FILENAME
+// when no prefix is configured.
+const defaultKeyTemplate = "{prefix}/{date}/{filename}"
+
+// Layouts of the {date} placeholder, chosen with KEY_DATE_LAYOUT.
+const (
+	keyDateDay    = "day"    // 2024-01-15
+	keyDateYMD    = "ymd"    // 2024/01/15
+	keyDateHourly = "hourly" // 2024/01/15/09
+	keyDateNone   = "none"   // empty, so the segment is dropped
+)
+
+// keyDate formats t as the {date} of a key in the given layout, keyDateDay
+// if empty.
+func keyDate(t time.Time, layout string) string {
+	switch layout {
+	case keyDateYMD:
+		return t.Format("2006/01/02")
+	case keyDateHourly:
+		return t.Format("2006/01/02/15")
+	case keyDateNone:
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// keyTemplateVariables lists the placeholders S3_KEY_TEMPLATE may use.
+var keyTemplateVariables = map[string]bool{
+	"prefix":        true,
+	"date":          true,
+	"yyyy":          true,
+	"mm":            true,
+	"dd":            true,
+	"hh":            true,
+	"filename":      true,
+	"access_key_id": true,
+	"account_id":    true,
+	"client_ip":     true,
+	"session_id":    true,
+	"uuid":          true,
+}
+
+var keyTemplatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validateKeyTemplate checks that a template only uses known placeholders and
+// includes something that tells files apart.
+func validateKeyTemplate(template string) error {
+	for _, match := range keyTemplatePlaceholder.FindAllStringSubmatch(template, -1) {
+		if !keyTemplateVariables[match[1]] {
+			return fmt.Errorf("unknown variable {%s}", match[1])
+		}
+	}
+
+	if strings.ContainsAny(keyTemplatePlaceholder.ReplaceAllString(template, ""), "{}") {
+		return fmt.Errorf("unbalanced braces")
+	}
+
+	if !strings.Contains(template, "{filename}") && !strings.Contains(template, "{uuid}") {
+		return fmt.Errorf("must contain {filename} or {uuid}")
+	}
+
+	return nil
+}
+
+// expandKeyTemplate substitutes vars into template. Empty path segments, for
+// example from an unset {prefix}, are dropped so keys never contain "//" or
+// start with "/".
+func expandKeyTemplate(template string, vars map[string]string) string {
+	key := keyTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return vars[placeholder[1:len(placeholder)-1]]
+	})
+
+	segments := strings.Split(key, "/")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
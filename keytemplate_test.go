@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestValidateKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template    string
+		expectError bool
+	}{
+		{template: defaultKeyTemplate},
+		{template: "{prefix}/{account_id}/{yyyy}/{mm}/{dd}/{filename}"},
+		{template: "incoming/{client_ip}/{hh}/{uuid}"},
+		{template: "{prefix}/{date}/{access_key_id}-{filename}"},
+		{template: "{prefix}/{date}/{name}", expectError: true},
+		{template: "{prefix}/{date}/{filename", expectError: true},
+		{template: "{prefix}/{date}}/{filename}", expectError: true},
+		{template: "{prefix}/{date}", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			err := validateKeyTemplate(tt.template)
+			if tt.expectError && err == nil {
+				t.Errorf("validateKeyTemplate(%q) expected error but got none", tt.template)
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("validateKeyTemplate(%q) unexpected error: %v", tt.template, err)
+			}
+		})
+	}
+}
+
+func TestExpandKeyTemplate(t *testing.T) {
+	vars := map[string]string{
+		"prefix":     "",
+		"date":       "2023-12-25",
+		"account_id": "123456789012",
+		"filename":   "test.txt",
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{template: "{prefix}/{date}/{filename}", expected: "2023-12-25/test.txt"},
+		{template: "/{account_id}//{date}/{filename}/", expected: "123456789012/2023-12-25/test.txt"},
+		{template: "{account_id}-{filename}", expected: "123456789012-test.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if result := expandKeyTemplate(tt.template, vars); result != tt.expected {
+				t.Errorf("expandKeyTemplate(%q) = %q, want %q", tt.template, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	first, second := newUUID(), newUUID()
+	if !uuidPattern.MatchString(first) {
+		t.Errorf("newUUID() = %q, not a version 4 UUID", first)
+	}
+	if first == second {
+		t.Errorf("newUUID() returned %q twice", first)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A minimal LDAPv3 client (RFC 4511) with just what password checks and
+// group lookups need: simple bind, StartTLS and a subtree search with an
+// equality filter. Messages are BER encoded by hand.
+
+// BER tags of the LDAP protocol operations used here.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berBoolean     = 0x01
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapExtendedRequest   = 0x77
+	ldapExtendedResponse  = 0x78
+
+	ldapSimpleAuth      = 0x80 // [0] in AuthenticationChoice
+	ldapEqualityMatch   = 0xa3 // [3] in Filter
+	ldapExtendedReqName = 0x80 // [0] in ExtendedRequest
+)
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+	ldapStartTLSOID              = "1.3.6.1.4.1.1466.20037"
+	ldapMaxMessageSize           = 1 << 20
+)
+
+// errLDAPInvalidCredentials is returned by bind for a wrong DN or password.
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+type ldapConn struct {
+	conn   net.Conn
+	nextID int
+}
+
+// dialLDAP connects to an ldaps:// or ldap:// URL. Plain ldap:// connections
+// are upgraded with StartTLS before anything else is sent.
+func dialLDAP(address string, useTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c := &ldapConn{conn: conn}
+	if !useTLS {
+		if err := c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berTLV(ldapUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	id, err := c.send(berTLV(ldapExtendedRequest, berTLV(ldapExtendedReqName, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+	if err := c.result(id, ldapExtendedResponse); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	return nil
+}
+
+// bind authenticates as dn with a simple bind.
+func (c *ldapConn) bind(dn, password string) error {
+	id, err := c.send(berTLV(ldapBindRequest, berConcat(
+		berInt(3),
+		berTLV(berOctetString, []byte(dn)),
+		berTLV(ldapSimpleAuth, []byte(password)),
+	)))
+	if err != nil {
+		return err
+	}
+	return c.result(id, ldapBindResponse)
+}
+
+// searchAttribute returns the values of attribute in the entries below
+// baseDN where filterAttribute equals value.
+func (c *ldapConn) searchAttribute(baseDN, filterAttribute, value, attribute string) ([]string, error) {
+	id, err := c.send(berTLV(ldapSearchRequest, berConcat(
+		berTLV(berOctetString, []byte(baseDN)),
+		berTLV(berEnumerated, []byte{2}), // wholeSubtree
+		berTLV(berEnumerated, []byte{0}), // neverDerefAliases
+		berInt(2),                        // sizeLimit
+		berInt(10),                       // timeLimit in seconds
+		berTLV(berBoolean, []byte{0}),    // typesOnly
+		berTLV(ldapEqualityMatch, berConcat(
+			berTLV(berOctetString, []byte(filterAttribute)),
+			berTLV(berOctetString, []byte(value)),
+		)),
+		berTLV(berSequence, berTLV(berOctetString, []byte(attribute))),
+	)))
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for {
+		msgID, tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		if msgID != id {
+			continue
+		}
+
+		switch tag {
+		case ldapSearchResultEntry:
+			entryValues, err := parseSearchEntry(op, attribute)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, entryValues...)
+		case ldapSearchResultRef:
+			// referrals to other servers are not followed
+		case ldapSearchResultDone:
+			if err := parseLDAPResult(op); err != nil {
+				return nil, err
+			}
+			return values, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response 0x%x", tag)
+		}
+	}
+}
+
+// send writes an LDAPMessage with the given protocol operation and returns
+// its message ID.
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.nextID++
+	_, err := c.conn.Write(berTLV(berSequence, berConcat(berInt(c.nextID), op)))
+	return c.nextID, err
+}
+
+// receive reads the next LDAPMessage.
+func (c *ldapConn) receive() (id int, tag byte, op []byte, err error) {
+	msgTag, msg, err := readBER(c.conn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if msgTag != berSequence {
+		return 0, 0, nil, fmt.Errorf("malformed LDAP message")
+	}
+
+	idTag, idBytes, rest, err := parseBER(msg)
+	if err != nil || idTag != berInteger {
+		return 0, 0, nil, fmt.Errorf("malformed LDAP message ID")
+	}
+	tag, op, _, err = parseBER(rest)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("malformed LDAP operation")
+	}
+	return berIntValue(idBytes), tag, op, nil
+}
+
+// result waits for the response to message id and returns its result code
+// as an error unless it is success.
+func (c *ldapConn) result(id int, wantTag byte) error {
+	for {
+		msgID, tag, op, err := c.receive()
+		if err != nil {
+			return err
+		}
+		if msgID != id {
+			continue
+		}
+		if tag != wantTag {
+			return fmt.Errorf("unexpected LDAP response 0x%x", tag)
+		}
+		return parseLDAPResult(op)
+	}
+}
+
+// parseLDAPResult decodes the resultCode and diagnosticMessage of an
+// LDAPResult.
+func parseLDAPResult(op []byte) error {
+	tag, code, rest, err := parseBER(op)
+	if err != nil || tag != berEnumerated {
+		return fmt.Errorf("malformed LDAP result")
+	}
+
+	resultCode := berIntValue(code)
+	switch resultCode {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return errLDAPInvalidCredentials
+	}
+
+	var message []byte
+	if _, _, rest, err = parseBER(rest); err == nil { // matchedDN
+		_, message, _, _ = parseBER(rest)
+	}
+	return fmt.Errorf("LDAP error %d: %s", resultCode, message)
+}
+
+func parseSearchEntry(op []byte, attribute string) ([]string, error) {
+	_, _, rest, err := parseBER(op) // objectName
+	if err != nil {
+		return nil, fmt.Errorf("malformed search entry")
+	}
+	_, attributes, _, err := parseBER(rest)
+	if err != nil {
+		return nil, fmt.Errorf("malformed search entry")
+	}
+
+	var values []string
+	for len(attributes) > 0 {
+		var attr []byte
+		if _, attr, attributes, err = parseBER(attributes); err != nil {
+			return nil, fmt.Errorf("malformed search entry attribute")
+		}
+		_, name, vals, err := parseBER(attr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed search entry attribute")
+		}
+		if !strings.EqualFold(string(name), attribute) {
+			continue
+		}
+		_, set, _, err := parseBER(vals)
+		if err != nil {
+			return nil, fmt.Errorf("malformed search entry values")
+		}
+		for len(set) > 0 {
+			var value []byte
+			if _, value, set, err = parseBER(set); err != nil {
+				return nil, fmt.Errorf("malformed search entry value")
+			}
+			values = append(values, string(value))
+		}
+	}
+	return values, nil
+}
+
+func berTLV(tag byte, content []byte) []byte {
+	var length []byte
+	switch n := len(content); {
+	case n < 0x80:
+		length = []byte{byte(n)}
+	case n <= 0xff:
+		length = []byte{0x81, byte(n)}
+	case n <= 0xffff:
+		length = []byte{0x82, byte(n >> 8), byte(n)}
+	default:
+		length = []byte{0x83, byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return berConcat([]byte{tag}, length, content)
+}
+
+func berConcat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func berInt(n int) []byte {
+	content := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		content = append([]byte{byte(n)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(berInteger, content)
+}
+
+func berIntValue(content []byte) int {
+	n := 0
+	for _, b := range content {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// parseBER splits the first TLV off data.
+func parseBER(data []byte) (tag byte, content, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag = data[0]
+	length, header := int(data[1]), 2
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 || len(data) < 2+size {
+			return 0, nil, nil, fmt.Errorf("unsupported BER length")
+		}
+		length = berIntValue(data[2 : 2+size])
+		header += size
+	}
+	if len(data) < header+length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, data[header : header+length], data[header+length:], nil
+}
+
+// readBER reads one TLV from r.
+func readBER(r io.Reader) (tag byte, content []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 {
+			return 0, nil, fmt.Errorf("unsupported BER length")
+		}
+		lengthBytes := make([]byte, size)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return 0, nil, err
+		}
+		length = berIntValue(lengthBytes)
+	}
+	if length > ldapMaxMessageSize {
+		return 0, nil, fmt.Errorf("LDAP message too large")
+	}
+
+	content = make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return header[0], content, nil
+}
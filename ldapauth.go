@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ldapGroup maps members of a directory group to an upload prefix.
+type ldapGroup struct {
+	name   string // common name of the group, matched case-insensitively
+	prefix string
+}
+
+// String returns the group in the form of LDAP_GROUP_PREFIXES.
+func (g ldapGroup) String() string {
+	return g.name + ":" + g.prefix
+}
+
+// LDAPAuthenticator verifies passwords by binding to an LDAP or Active
+// Directory server as the user. With LDAP_GROUP_PREFIXES set, only members
+// of the listed groups may log in and the first matching group decides the
+// upload prefix. Like local users, directory users have no AWS credentials
+// and their uploads are stored with the gateway's own credentials.
+type LDAPAuthenticator struct {
+	bindDN        string // DN template, {user} is replaced by the SSH user name
+	baseDN        string
+	userAttribute string
+	groups        []ldapGroup
+	dial          func() (*ldapConn, error)
+	logger        *slog.Logger
+}
+
+func NewLDAPAuthenticator(config *Config, logger *slog.Logger) *LDAPAuthenticator {
+	u, _ := url.Parse(config.LDAPURL) // validated by LoadConfig
+	useTLS := u.Scheme == "ldaps"
+
+	address := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if useTLS {
+			port = "636"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+
+	return &LDAPAuthenticator{
+		bindDN:        config.LDAPBindDN,
+		baseDN:        config.LDAPBaseDN,
+		userAttribute: config.LDAPUserAttribute,
+		groups:        config.LDAPGroupPrefixes,
+		dial: func() (*ldapConn, error) {
+			return dialLDAP(address, useTLS, tlsConfig, config.LDAPTimeout)
+		},
+		logger: logger,
+	}
+}
+
+func (a *LDAPAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+	user := conn.User()
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", user,
+		"method", "ldap",
+	)
+
+	a.logger.Info("authentication attempt", logCtx)
+
+	// An empty password would be an unauthenticated bind, which most servers
+	// accept without checking anything.
+	if !principalPattern.MatchString(user) || len(password) == 0 {
+		a.logger.Warn("authentication failed: invalid user name or empty password", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	ldap, err := a.dial()
+	if err != nil {
+		a.logger.Error("failed to connect to LDAP server", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("authentication unavailable")
+	}
+	defer ldap.Close()
+
+	if err := ldap.bind(strings.ReplaceAll(a.bindDN, "{user}", user), string(password)); err != nil {
+		if errors.Is(err, errLDAPInvalidCredentials) {
+			a.logger.Warn("authentication failed: invalid credentials", logCtx)
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		a.logger.Error("LDAP bind failed", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("authentication unavailable")
+	}
+
+	prefix := user
+	if len(a.groups) > 0 {
+		memberOf, err := ldap.searchAttribute(a.baseDN, a.userAttribute, user, "memberOf")
+		if err != nil {
+			a.logger.Error("LDAP group lookup failed", logCtx, slog.String("error", err.Error()))
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+
+		group, ok := a.matchGroup(memberOf)
+		if !ok {
+			a.logger.Warn("authentication failed: user is not in an allowed group", logCtx)
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		prefix = group.prefix
+	}
+
+	a.logger.Info("authentication successful", logCtx, slog.String("upload_prefix", prefix))
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":          user,
+			"upload_prefix": prefix,
+			"client_ip":     clientIP,
+		},
+	}, nil
+}
+
+// matchGroup returns the first configured group that appears in memberOf.
+func (a *LDAPAuthenticator) matchGroup(memberOf []string) (ldapGroup, bool) {
+	for _, group := range a.groups {
+		for _, dn := range memberOf {
+			if strings.EqualFold(groupCommonName(dn), group.name) {
+				return group, true
+			}
+		}
+	}
+	return ldapGroup{}, false
+}
+
+// groupCommonName returns the value of the first RDN of a group DN, the
+// "acme" in "CN=acme,OU=Groups,DC=example,DC=com".
+func groupCommonName(dn string) string {
+	rdn, _, _ := strings.Cut(dn, ",")
+	_, name, _ := strings.Cut(rdn, "=")
+	return strings.TrimSpace(name)
+}
+
+// parseLDAPGroups parses LDAP_GROUP_PREFIXES, a comma separated list of
+// group:prefix pairs.
+func parseLDAPGroups(value string) ([]ldapGroup, error) {
+	var groups []ldapGroup
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, prefix, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not a group:prefix pair", entry)
+		}
+		prefix = path.Clean(strings.Trim(strings.TrimSpace(prefix), "/"))
+		if prefix == "." || strings.HasPrefix(prefix, "..") {
+			return nil, fmt.Errorf("group %s: invalid prefix %q", name, prefix)
+		}
+		groups = append(groups, ldapGroup{name: name, prefix: prefix})
+	}
+	return groups, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+)
+
+// fakeDirectory answers LDAP requests on the server end of a pipe. Users
+// bind as uid=NAME,ou=people,dc=example,dc=com.
+type fakeDirectory struct {
+	passwords map[string]string
+	memberOf  map[string][]string
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_, msg, err := readBER(conn)
+		if err != nil {
+			return
+		}
+		_, idBytes, rest, _ := parseBER(msg)
+		id := berIntValue(idBytes)
+		tag, op, _, _ := parseBER(rest)
+
+		switch tag {
+		case ldapBindRequest:
+			_, _, rest, _ := parseBER(op) // version
+			_, dn, rest, _ := parseBER(rest)
+			_, password, _, _ := parseBER(rest)
+			code := ldapResultInvalidCredentials
+			if want, ok := d.passwords[string(dn)]; ok && want == string(password) {
+				code = ldapResultSuccess
+			}
+			conn.Write(ldapMessage(id, ldapBindResponse, ldapResult(code)))
+		case ldapSearchRequest:
+			// the filter is the seventh field of the request
+			fields := op
+			for i := 0; i < 6; i++ {
+				_, _, fields, _ = parseBER(fields)
+			}
+			_, filter, _, _ := parseBER(fields)
+			_, _, rest, _ := parseBER(filter)
+			_, user, _, _ := parseBER(rest)
+
+			if groups, ok := d.memberOf[string(user)]; ok {
+				var values []byte
+				for _, group := range groups {
+					values = append(values, berTLV(berOctetString, []byte(group))...)
+				}
+				conn.Write(ldapMessage(id, ldapSearchResultEntry, berConcat(
+					berTLV(berOctetString, []byte("uid="+string(user)+",ou=people,dc=example,dc=com")),
+					berTLV(berSequence, berTLV(berSequence, berConcat(
+						berTLV(berOctetString, []byte("memberOf")),
+						berTLV(berSet, values),
+					))),
+				)))
+			}
+			conn.Write(ldapMessage(id, ldapSearchResultDone, ldapResult(ldapResultSuccess)))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int, tag byte, op []byte) []byte {
+	return berTLV(berSequence, berConcat(berInt(id), berTLV(tag, op)))
+}
+
+func ldapResult(code int) []byte {
+	return berConcat(
+		berTLV(berEnumerated, []byte{byte(code)}),
+		berTLV(berOctetString, nil),
+		berTLV(berOctetString, []byte("diagnostic")),
+	)
+}
+
+func newTestLDAPAuthenticator(directory *fakeDirectory, groups []ldapGroup) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		bindDN:        "uid={user},ou=people,dc=example,dc=com",
+		baseDN:        "dc=example,dc=com",
+		userAttribute: "uid",
+		groups:        groups,
+		dial: func() (*ldapConn, error) {
+			client, server := net.Pipe()
+			go directory.serve(server)
+			return &ldapConn{conn: client}, nil
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+}
+
+func TestLDAPAuthenticator_Authenticate(t *testing.T) {
+	directory := &fakeDirectory{
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=example,dc=com": "s3cret",
+			"uid=bob,ou=people,dc=example,dc=com":   "hunter2",
+		},
+		memberOf: map[string][]string{
+			"alice": {"cn=staff,ou=groups,dc=example,dc=com", "CN=SFTP-Acme,ou=groups,dc=example,dc=com"},
+			"bob":   {"cn=staff,ou=groups,dc=example,dc=com"},
+		},
+	}
+
+	auth := newTestLDAPAuthenticator(directory, nil)
+	perms, err := auth.Authenticate(testConnMetadata{user: "bob"}, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "bob" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "bob")
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("wrong")); err == nil {
+		t.Error("Authenticate() expected error for wrong password")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, nil); err == nil {
+		t.Error("Authenticate() expected error for empty password")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice,ou=admins"}, []byte("s3cret")); err == nil {
+		t.Error("Authenticate() expected error for user name with DN syntax")
+	}
+
+	auth = newTestLDAPAuthenticator(directory, []ldapGroup{
+		{name: "sftp-globex", prefix: "partners/globex"},
+		{name: "sftp-acme", prefix: "partners/acme"},
+	})
+	perms, err = auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "partners/acme" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "partners/acme")
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "bob"}, []byte("hunter2")); err == nil {
+		t.Error("Authenticate() expected error for user outside the allowed groups")
+	}
+}
+
+func TestGroupCommonName(t *testing.T) {
+	tests := map[string]string{
+		"CN=sftp-acme,OU=Groups,DC=example,DC=com": "sftp-acme",
+		"cn=staff": "staff",
+		"":         "",
+	}
+	for dn, want := range tests {
+		if got := groupCommonName(dn); got != want {
+			t.Errorf("groupCommonName(%q) = %q, want %q", dn, got, want)
+		}
+	}
+}
+
+func TestBERRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 70000} {
+		tag, content, rest, err := parseBER(berInt(n))
+		if err != nil || tag != berInteger || len(rest) != 0 {
+			t.Fatalf("parseBER(berInt(%d)) = %x, %v, %v", n, tag, rest, err)
+		}
+		if got := berIntValue(content); got != n {
+			t.Errorf("berIntValue(berInt(%d)) = %d", n, got)
+		}
+	}
+
+	long := make([]byte, 300)
+	_, content, _, err := parseBER(berTLV(berOctetString, long))
+	if err != nil || len(content) != len(long) {
+		t.Errorf("parseBER() of long value = %d bytes, %v, want %d bytes", len(content), err, len(long))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	liveEventBuffer      = 256 // records a watcher may fall behind before records are dropped
+	liveEventKeepalive   = 30 * time.Second
+	liveEventRetryMillis = 5000
+)
+
+// liveEvents passes the audit records to the watchers of /events as they
+// happen. Watchers that can't keep up miss records rather than slowing
+// down sessions. A nil liveEvents passes nothing.
+type liveEvents struct {
+	mu       sync.Mutex
+	watchers map[*liveWatcher]struct{}
+}
+
+type liveWatcher struct {
+	records chan auditRecord
+	user    string // only records of this user, all if empty
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func newLiveEvents() *liveEvents {
+	return &liveEvents{watchers: make(map[*liveWatcher]struct{})}
+}
+
+func (l *liveEvents) publish(r auditRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for w := range l.watchers {
+		if w.user != "" && w.user != r.User {
+			continue
+		}
+		select {
+		case w.records <- r:
+		default:
+			w.mu.Lock()
+			w.dropped++
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (l *liveEvents) watch(user string) *liveWatcher {
+	w := &liveWatcher{records: make(chan auditRecord, liveEventBuffer), user: user}
+	l.mu.Lock()
+	l.watchers[w] = struct{}{}
+	l.mu.Unlock()
+	return w
+}
+
+func (l *liveEvents) stop(w *liveWatcher) {
+	l.mu.Lock()
+	delete(l.watchers, w)
+	l.mu.Unlock()
+}
+
+// takeDropped returns the number of records dropped since the last call.
+func (w *liveWatcher) takeDropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dropped := w.dropped
+	w.dropped = 0
+	return dropped
+}
+
+// ServeHTTP streams the records as server-sent events named after their
+// type, until the client disconnects. With ?user= only the records of that
+// user are sent.
+func (l *liveEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	watcher := l.watch(r.URL.Query().Get("user"))
+	defer l.stop(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let proxies hold events back
+	fmt.Fprintf(w, "retry: %d\n\n", liveEventRetryMillis)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(liveEventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case record := <-watcher.records:
+			if dropped := watcher.takeDropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: Dropped\ndata: {\"records\":%d}\n\n", dropped)
+			}
+			data, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", record.Type, data)
+		}
+		flusher.Flush()
+	}
+}
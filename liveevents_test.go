@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminMux_Events(t *testing.T) {
+	config := &Config{AdminToken: "0123456789abcdef"}
+	s := &SFTPServer{config: config, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	s.audit = newAuditTrail(config, nil, s.logger)
+	s.audit.live = newLiveEvents()
+	server := httptest.NewServer(s.adminMux())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/events without token status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events?user=alice", nil)
+	req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s, want text/event-stream", ct)
+	}
+
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		t.Helper()
+		var name, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading /events failed: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && name != "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+	// the watcher is registered once the stream started
+	if line, _ := events.ReadString('\n'); !strings.HasPrefix(line, "retry: ") {
+		t.Fatalf("first line = %q, want the retry interval", line)
+	}
+
+	s.audit.session(eventSessionStarted, &activeSession{id: "0000000000000001", user: "bob"})
+	s.audit.request(accessRequest{sessionID: "9f86d081884c7d65", user: "alice"}, "Put", "/uploads/a.csv", "", nil, 2048)
+
+	name, data := readEvent()
+	if name != auditRequest {
+		t.Fatalf("event = %s, want %s of alice", name, auditRequest)
+	}
+	var record auditRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		t.Fatalf("invalid event data %q: %v", data, err)
+	}
+	if record.User != "alice" || record.Path != "/uploads/a.csv" || record.Bytes != 2048 || record.Result != "OK" {
+		t.Errorf("event data = %+v, want the Put of alice", record)
+	}
+}
+
+func TestLiveEvents_DropsForSlowWatchers(t *testing.T) {
+	l := newLiveEvents()
+	w := l.watch("")
+	defer l.stop(w)
+
+	for range liveEventBuffer + 3 {
+		l.publish(auditRecord{Type: auditRequest})
+	}
+	if got := w.takeDropped(); got != 3 {
+		t.Errorf("dropped = %d, want 3", got)
+	}
+	if got := w.takeDropped(); got != 0 {
+		t.Errorf("dropped after taking = %d, want 0", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// localUser is an entry of the USERS_FILE.
+type localUser struct {
+	name       string
+	hash       string // bcrypt or argon2id password hash
+	prefix     string // S3 prefix below S3_BUCKET_PREFIX
+	quota      int64  // bytes the user may upload per day, unlimited if zero
+	roleARN    string // role assumed for the user's uploads, see USERS_SECRET
+	allowedIPs string // networks the user may log in from, any if empty
+}
+
+// LocalAuthenticator checks passwords against a users file instead of AWS.
+// Local users have no AWS credentials; like certificate users their uploads
+// are stored with the gateway's own credentials under their prefix.
+type LocalAuthenticator struct {
+	mu     sync.RWMutex
+	users  map[string]localUser
+	logger *slog.Logger
+
+	// assumeRole returns credentials for users with a role. Only set when
+	// users come from USERS_SECRET.
+	assumeRole func(ctx context.Context, roleARN, user string) (*types.Credentials, error)
+}
+
+func NewLocalAuthenticator(users map[string]localUser, logger *slog.Logger) *LocalAuthenticator {
+	return &LocalAuthenticator{
+		users:  users,
+		logger: logger,
+	}
+}
+
+// dummyHash is compared against for unknown users, so a login for a user
+// that doesn't exist takes as long as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("sftpgw"), bcrypt.DefaultCost)
+
+func (a *LocalAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", conn.User(),
+		"method", "local",
+	)
+
+	a.logger.Info("authentication attempt", logCtx)
+
+	a.mu.RLock()
+	user, ok := a.users[conn.User()]
+	a.mu.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, password)
+		a.logger.Warn("authentication failed: unknown user", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	if match, err := verifyPassword(user.hash, password); err != nil {
+		a.logger.Error("authentication failed: unusable password hash", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("invalid credentials")
+	} else if !match {
+		a.logger.Warn("authentication failed: wrong password", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	extensions := map[string]string{
+		"user":          user.name,
+		"upload_prefix": user.prefix,
+		"quota":         strconv.FormatInt(user.quota, 10),
+		"allowed_ips":   user.allowedIPs,
+		"client_ip":     clientIP,
+	}
+
+	if user.roleARN != "" {
+		if a.assumeRole == nil {
+			a.logger.Error("authentication failed: user has a role but roles are not supported", logCtx)
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		creds, err := a.assumeRole(ctx, user.roleARN, user.name)
+		if err != nil {
+			a.logger.Error("STS AssumeRole failed", logCtx,
+				slog.String("role_arn", user.roleARN),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+		extensions["aws_access_key_id"] = aws.ToString(creds.AccessKeyId)
+		extensions["aws_secret_access_key"] = aws.ToString(creds.SecretAccessKey)
+		extensions["aws_session_token"] = aws.ToString(creds.SessionToken)
+		extensions["role_arn"] = user.roleARN
+	}
+
+	a.logger.Info("authentication successful", logCtx,
+		slog.String("upload_prefix", user.prefix),
+		slog.Int64("quota", user.quota),
+		slog.String("role_arn", user.roleARN),
+	)
+
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// setUsers replaces the users, for example after USERS_SECRET changed.
+func (a *LocalAuthenticator) setUsers(users map[string]localUser) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+}
+
+// verifyPassword compares password with a bcrypt hash ($2a$, $2b$ or $2y$)
+// or an argon2id hash in PHC format ($argon2id$v=19$m=...,t=...,p=...$salt$key).
+func verifyPassword(hash string, password []byte) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	default:
+		return false, fmt.Errorf("unsupported password hash")
+	}
+}
+
+func verifyArgon2id(hash string, password []byte) (bool, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version")
+	}
+
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+
+	derived := argon2.IDKey(password, salt, iterations, memory, parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// loadUsers reads a users file. Each line has the form
+//
+//	name:hash[:prefix[:quota[:allowed_ips]]]
+//
+// where prefix defaults to the user name, quota is the number of bytes the
+// user may upload per day and allowed_ips is a comma separated list of
+// addresses and CIDR ranges the user may log in from. Blank lines and lines
+// starting with # are ignored.
+func loadUsers(filePath string) (map[string]localUser, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]localUser)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, err := parseUserLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filePath, lineNumber, err)
+		}
+		if _, ok := users[user.name]; ok {
+			return nil, fmt.Errorf("%s line %d: duplicate user %q", filePath, lineNumber, user.name)
+		}
+		users[user.name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users found in %s", filePath)
+	}
+	return users, nil
+}
+
+// newLocalUser validates a user entry. prefix defaults to the user name.
+func newLocalUser(name, hash, prefix string) (localUser, error) {
+	user := localUser{name: name, hash: hash, prefix: name}
+	if !principalPattern.MatchString(user.name) {
+		return localUser{}, fmt.Errorf("invalid user name %q", user.name)
+	}
+	if !strings.HasPrefix(user.hash, "$2") && !strings.HasPrefix(user.hash, "$argon2id$") {
+		return localUser{}, fmt.Errorf("user %q: password hash must be bcrypt or argon2id", user.name)
+	}
+
+	if prefix != "" {
+		cleaned := path.Clean(strings.Trim(prefix, "/"))
+		if cleaned == "." || strings.HasPrefix(cleaned, "..") {
+			return localUser{}, fmt.Errorf("user %q: invalid prefix %q", user.name, prefix)
+		}
+		user.prefix = cleaned
+	}
+
+	return user, nil
+}
+
+func parseUserLine(line string) (localUser, error) {
+	// allowed_ips comes last, as IPv6 addresses contain colons
+	fields := strings.SplitN(line, ":", 5)
+	if len(fields) < 2 {
+		return localUser{}, fmt.Errorf("expected name:hash[:prefix[:quota[:allowed_ips]]]")
+	}
+
+	var prefix string
+	if len(fields) > 2 {
+		prefix = fields[2]
+	}
+	user, err := newLocalUser(fields[0], fields[1], prefix)
+	if err != nil {
+		return localUser{}, err
+	}
+
+	if len(fields) > 3 && fields[3] != "" {
+		quota, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil || quota < 0 {
+			return localUser{}, fmt.Errorf("user %q: invalid quota %q", user.name, fields[3])
+		}
+		user.quota = quota
+	}
+
+	if len(fields) > 4 && fields[4] != "" {
+		allowedIPs, err := normalizeAllowedIPs(fields[4])
+		if err != nil {
+			return localUser{}, fmt.Errorf("user %q: invalid allowed IPs: %w", user.name, err)
+		}
+		user.allowedIPs = allowedIPs
+	}
+
+	return user, nil
+}
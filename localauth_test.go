@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPassword(t *testing.T) {
+	for name, hash := range map[string]string{
+		"bcrypt":   bcryptHash(t, "s3cret"),
+		"argon2id": argon2idHash("s3cret"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if ok, err := verifyPassword(hash, []byte("s3cret")); err != nil || !ok {
+				t.Errorf("verifyPassword() with correct password = %v, %v", ok, err)
+			}
+			if ok, err := verifyPassword(hash, []byte("wrong")); err != nil || ok {
+				t.Errorf("verifyPassword() with wrong password = %v, %v", ok, err)
+			}
+		})
+	}
+
+	if _, err := verifyPassword("plaintext", []byte("plaintext")); err == nil {
+		t.Error("verifyPassword() expected error for unsupported hash")
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte(`# partners
+alice:$2y$10$abcdefghijklmnopqrstuu
+bob:$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$a2V5:partners/bob:1048576:10.0.0.0/8 2001:db8::/32
+
+`), 0600)
+
+	users, err := loadUsers(path)
+	if err != nil {
+		t.Fatalf("loadUsers() unexpected error: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("loadUsers() returned %d users, want 2", len(users))
+	}
+	if alice := users["alice"]; alice.prefix != "alice" || alice.quota != 0 {
+		t.Errorf("alice = %+v, want prefix alice and no quota", alice)
+	}
+	if bob := users["bob"]; bob.prefix != "partners/bob" || bob.quota != 1048576 {
+		t.Errorf("bob = %+v, want prefix partners/bob and quota 1048576", bob)
+	}
+	if bob := users["bob"]; bob.allowedIPs != "10.0.0.0/8,2001:db8::/32" {
+		t.Errorf("bob.allowedIPs = %q, want %q", bob.allowedIPs, "10.0.0.0/8,2001:db8::/32")
+	}
+}
+
+func TestParseUserLine_Invalid(t *testing.T) {
+	for _, line := range []string{
+		"alice",
+		"alice:plaintext",
+		"../alice:$2y$10$hash",
+		"alice:$2y$10$hash:../other",
+		"alice:$2y$10$hash:alice:lots",
+		"alice:$2y$10$hash:alice:1:extra",
+	} {
+		if _, err := parseUserLine(line); err == nil {
+			t.Errorf("parseUserLine(%q) expected error", line)
+		}
+	}
+}
+
+func TestLocalAuthenticator_Authenticate(t *testing.T) {
+	auth := NewLocalAuthenticator(map[string]localUser{
+		"alice": {name: "alice", hash: bcryptHash(t, "s3cret"), prefix: "partners/alice", quota: 100},
+	}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	perms, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "partners/alice" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "partners/alice")
+	}
+	if perms.Extensions["quota"] != "100" {
+		t.Errorf("quota = %q, want %q", perms.Extensions["quota"], "100")
+	}
+	if _, ok := perms.Extensions["aws_access_key_id"]; ok {
+		t.Error("expected no AWS credentials for a local user")
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("wrong")); err == nil {
+		t.Error("Authenticate() expected error for wrong password")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "mallory"}, []byte("s3cret")); err == nil {
+		t.Error("Authenticate() expected error for unknown user")
+	}
+}
+
+func TestUploadQuotas(t *testing.T) {
+	var quotas uploadQuotas
+	now := time.Date(2024, 1, 15, 23, 0, 0, 0, time.UTC)
+
+	quotas.add("alice", 40, now)
+	quotas.add("alice", 2, now)
+	if used := quotas.used("alice", now); used != 42 {
+		t.Errorf("used() = %d, want 42", used)
+	}
+	if used := quotas.used("bob", now); used != 0 {
+		t.Errorf("used() for other user = %d, want 0", used)
+	}
+	if used := quotas.used("alice", now.Add(2*time.Hour)); used != 0 {
+		t.Errorf("used() on the next day = %d, want 0", used)
+	}
+}
+
+func TestFileWriter_QuotaExceeded(t *testing.T) {
+	handler := NewSFTPHandler(&Config{VirtualDir: "/uploads", MaxFileSize: 1024}, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	handler.quotas.add("alice", 90, time.Now())
+
+	writer := &FileWriter{
+		upload:  &FileUpload{path: "/uploads/test.txt", user: "alice", quota: 100},
+		handler: handler,
+		logger:  handler.logger,
+	}
+
+	if _, err := writer.WriteAt(make([]byte, 10), 0); err != nil {
+		t.Fatalf("WriteAt() within quota unexpected error: %v", err)
+	}
+	if _, err := writer.WriteAt(make([]byte, 1), 10); err == nil {
+		t.Error("WriteAt() beyond quota expected error")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileTimeFormat names rotated files, such as sftpgw.log.20240115T143045.123,
+// so they sort by age.
+const logFileTimeFormat = "20060102T150405.000"
+
+// logFile writes logs to LOG_FILE for installs that don't capture stdout.
+// The file is rotated when it grows beyond LOG_FILE_MAX_SIZE or gets older
+// than LOG_FILE_MAX_AGE: it is renamed with a timestamp suffix, gzipped in
+// the background with LOG_FILE_COMPRESS, and only the newest
+// LOG_FILE_MAX_BACKUPS rotated files are kept.
+type logFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	timeFunc   func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	wg       sync.WaitGroup // background compression
+	backupMu sync.Mutex     // serializes compressing and removing backups
+}
+
+// newLogFile opens path, rotated with the LOG_FILE_* settings of config.
+func newLogFile(path string, config *Config) (*logFile, error) {
+	f := &logFile{
+		path:       path,
+		maxSize:    config.LogFileMaxSize,
+		maxAge:     config.LogFileMaxAge,
+		maxBackups: config.LogFileMaxBackups,
+		compress:   config.LogFileCompress,
+		timeFunc:   time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), f.timeFunc()
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && f.timeFunc().Sub(f.opened) >= f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// keep logging to the current file rather than losing the entry
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. f.mu must be
+// held.
+func (f *logFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := f.path + "." + f.timeFunc().Format(logFileTimeFormat)
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.cleanUpBackups()
+	}()
+	return nil
+}
+
+// cleanUpBackups deletes all but the newest maxBackups rotated files and
+// compresses those that aren't yet.
+func (f *logFile) cleanUpBackups() {
+	f.backupMu.Lock()
+	defer f.backupMu.Unlock()
+
+	backups := f.backups()
+	if f.maxBackups > 0 && len(backups) > f.maxBackups {
+		for _, backup := range backups[f.maxBackups:] {
+			os.Remove(backup)
+		}
+		backups = backups[:f.maxBackups]
+	}
+
+	if f.compress {
+		for _, backup := range backups {
+			if strings.HasSuffix(backup, ".gz") {
+				continue
+			}
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress log file %s: %v\n", backup, err)
+			}
+		}
+	}
+}
+
+// compressFile replaces path with path.gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backups returns the rotated files, newest first.
+func (f *logFile) backups() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, f.path+"."), ".gz")
+		if _, err := time.Parse(logFileTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	// the timestamps sort by age
+	slices.SortFunc(backups, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(b, ".gz"), strings.TrimSuffix(a, ".gz"))
+	})
+	return backups
+}
+
+// Close waits for background compression and closes the file.
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wg.Wait()
+	return f.file.Close()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogFile(t *testing.T, config *Config) (*logFile, *time.Time) {
+	t.Helper()
+	config.LogFile = filepath.Join(t.TempDir(), "sftpgw.log")
+	now := time.Date(2024, 1, 15, 14, 30, 0, 0, time.UTC)
+
+	f, err := newLogFile(config.LogFile, config)
+	if err != nil {
+		t.Fatalf("newLogFile() unexpected error: %v", err)
+	}
+	f.timeFunc = func() time.Time { return now }
+	f.opened = now
+	t.Cleanup(func() { f.Close() })
+	return f, &now
+}
+
+func rotatedLogFiles(t *testing.T, f *logFile) []string {
+	t.Helper()
+	f.mu.Lock()
+	f.wg.Wait()
+	f.mu.Unlock()
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestLogFile_RotatesBySize(t *testing.T) {
+	f, now := newTestLogFile(t, &Config{LogFileMaxSize: 10})
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n")) // would exceed 10 bytes
+	*now = now.Add(time.Second)
+	f.Write([]byte("third\n"))
+
+	rotated := rotatedLogFiles(t, f)
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files = %v, want 2", rotated)
+	}
+	if got, _ := os.ReadFile(rotated[0]); string(got) != "first\n" {
+		t.Errorf("oldest rotated file = %q, want %q", got, "first\n")
+	}
+	if got, _ := os.ReadFile(f.path); string(got) != "third\n" {
+		t.Errorf("log file = %q, want %q", got, "third\n")
+	}
+	if !strings.HasSuffix(rotated[0], ".20240115T143000.000") {
+		t.Errorf("rotated file %s not named after the rotation time", rotated[0])
+	}
+}
+
+func TestLogFile_RotatesByAge(t *testing.T) {
+	f, now := newTestLogFile(t, &Config{LogFileMaxAge: time.Hour})
+
+	f.Write([]byte("first\n"))
+	*now = now.Add(30 * time.Minute)
+	f.Write([]byte("second\n"))
+	if rotated := rotatedLogFiles(t, f); len(rotated) != 0 {
+		t.Fatalf("rotated files = %v before the maximum age", rotated)
+	}
+
+	*now = now.Add(30 * time.Minute)
+	f.Write([]byte("third\n"))
+	rotated := rotatedLogFiles(t, f)
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files = %v, want 1", rotated)
+	}
+	if got, _ := os.ReadFile(rotated[0]); string(got) != "first\nsecond\n" {
+		t.Errorf("rotated file = %q, want the first two lines", got)
+	}
+}
+
+func TestLogFile_CompressesAndPrunes(t *testing.T) {
+	f, now := newTestLogFile(t, &Config{LogFileMaxSize: 1, LogFileMaxBackups: 2, LogFileCompress: true})
+
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		f.Write([]byte(line))
+		*now = now.Add(time.Second)
+	}
+
+	rotated := rotatedLogFiles(t, f)
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files = %v, want the 2 newest", rotated)
+	}
+	for i, want := range []string{"b\n", "c\n"} {
+		if !strings.HasSuffix(rotated[i], ".gz") {
+			t.Fatalf("rotated file %s not compressed", rotated[i])
+		}
+		file, err := os.Open(rotated[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("rotated file %s: %v", rotated[i], err)
+		}
+		got, _ := io.ReadAll(gz)
+		file.Close()
+		if string(got) != want {
+			t.Errorf("rotated file %s = %q, want %q", rotated[i], got, want)
+		}
+	}
+}
+
+func TestLogFile_AppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sftpgw.log")
+	os.WriteFile(path, []byte("before restart\n"), 0o640)
+
+	f, err := newLogFile(path, &Config{LogFileMaxSize: 20})
+	if err != nil {
+		t.Fatalf("newLogFile() unexpected error: %v", err)
+	}
+	defer f.Close()
+	if f.size != 15 {
+		t.Errorf("size = %d, want the existing 15 bytes", f.size)
+	}
+
+	f.Write([]byte("after restart\n"))
+	if rotated := rotatedLogFiles(t, f); len(rotated) != 1 {
+		t.Errorf("rotated files = %v, want the existing file rotated", rotated)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attributes that, with the level and message, tell whether log entries are
+// the same event repeated. The same message for different sessions or files
+// is sampled separately.
+var sampleKeys = []string{"session_id", "remote_ip", "file_path"}
+
+// logSampler lets through the first LOG_SAMPLE_BURST entries of an event
+// per LOG_SAMPLE_INTERVAL and drops the rest, so a misconfigured client
+// retrying a rejected request thousands of times doesn't flood the logs. At
+// the end of the interval one entry reports how many were dropped.
+type logSampler struct {
+	burst    int
+	interval time.Duration
+
+	mu     sync.Mutex
+	events map[string]*sampledEvent
+}
+
+// sampledEvent counts the entries of an event in the current interval.
+type sampledEvent struct {
+	seen       int
+	suppressed int
+	level      slog.Level
+	message    string
+	keyAttrs   []slog.Attr
+	next       slog.Handler // writes the summary, with the attributes of the first entry's logger
+	timer      *time.Timer  // ends the interval
+}
+
+func newLogSampler(config *Config) *logSampler {
+	return &logSampler{
+		burst:    config.LogSampleBurst,
+		interval: config.LogSampleInterval,
+		events:   make(map[string]*sampledEvent),
+	}
+}
+
+// allow counts an entry of the event key and tells whether to write it.
+func (s *logSampler) allow(key string, level slog.Level, message string, keyAttrs []slog.Attr, next slog.Handler) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.events[key]
+	if !ok {
+		event = &sampledEvent{level: level, message: message, keyAttrs: keyAttrs, next: next}
+		event.timer = time.AfterFunc(s.interval, func() { s.end(key, event) })
+		s.events[key] = event
+	}
+	event.seen++
+	if event.seen <= s.burst {
+		return true
+	}
+	event.suppressed++
+	return false
+}
+
+// end finishes the interval of an event, summarizing the entries dropped.
+func (s *logSampler) end(key string, event *sampledEvent) {
+	s.mu.Lock()
+	if s.events[key] == event {
+		delete(s.events, key)
+	}
+	s.mu.Unlock()
+
+	if event.suppressed > 0 {
+		record := slog.NewRecord(time.Now(), event.level, "log entries suppressed", 0)
+		record.AddAttrs(
+			slog.String("suppressed_msg", event.message),
+			slog.Int("suppressed", event.suppressed),
+			slog.Duration("interval", s.interval),
+		)
+		record.AddAttrs(event.keyAttrs...)
+		event.next.Handle(context.Background(), record)
+	}
+}
+
+// close summarizes the entries dropped in the current intervals.
+func (s *logSampler) close() {
+	s.mu.Lock()
+	events := s.events
+	s.events = make(map[string]*sampledEvent)
+	s.mu.Unlock()
+
+	for key, event := range events {
+		if event.timer.Stop() {
+			s.end(key, event)
+		}
+	}
+}
+
+// samplingHandler passes log entries on to the next handler as far as the
+// sampler allows.
+type samplingHandler struct {
+	slog.Handler
+	sampler  *logSampler
+	keyAttrs map[string]string // from WithAttrs
+}
+
+func newSamplingHandler(next slog.Handler, sampler *logSampler) slog.Handler {
+	return &samplingHandler{Handler: next, sampler: sampler}
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	values := make(map[string]string, len(sampleKeys))
+	for name, value := range h.keyAttrs {
+		values[name] = value
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		findSampleKeys(values, a)
+		return true
+	})
+
+	var key strings.Builder
+	var keyAttrs []slog.Attr
+	key.WriteString(record.Level.String() + "\x00" + record.Message)
+	for _, name := range sampleKeys {
+		key.WriteString("\x00" + values[name])
+		if values[name] != "" {
+			keyAttrs = append(keyAttrs, slog.String(name, values[name]))
+		}
+	}
+	if !h.sampler.allow(key.String(), record.Level, record.Message, keyAttrs, h.Handler) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	keyAttrs := make(map[string]string, len(h.keyAttrs))
+	for name, value := range h.keyAttrs {
+		keyAttrs[name] = value
+	}
+	for _, a := range attrs {
+		findSampleKeys(keyAttrs, a)
+	}
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler, keyAttrs: keyAttrs}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler, keyAttrs: h.keyAttrs}
+}
+
+// findSampleKeys adds the sampleKeys in a, or in its groups, to values.
+func findSampleKeys(values map[string]string, a slog.Attr) {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			findSampleKeys(values, member)
+		}
+		return
+	}
+	for _, name := range sampleKeys {
+		if a.Key == name {
+			values[name] = value.String()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that summaries can be written to from the
+// sampler's timers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the JSON log entries written so far.
+func (b *syncBuffer) entries(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func newTestSampler(burst int, interval time.Duration) (*logSampler, *slog.Logger, *syncBuffer) {
+	var out syncBuffer
+	sampler := newLogSampler(&Config{LogSampleBurst: burst, LogSampleInterval: interval})
+	logger := slog.New(newSamplingHandler(slog.NewJSONHandler(&out, nil), sampler))
+	return sampler, logger, &out
+}
+
+func TestSamplingHandler_Summarizes(t *testing.T) {
+	sampler, logger, out := newTestSampler(2, time.Hour)
+
+	session := logger.With(slog.String("session_id", "9f86d081884c7d65"))
+	for range 5 {
+		session.Warn("list denied", slog.Group("sftp", slog.String("file_path", "/uploads")))
+	}
+	session.Warn("list denied", slog.Group("sftp", slog.String("file_path", "/other")))
+	logger.Warn("list denied", slog.String("session_id", "0123456789abcdef"), slog.String("file_path", "/uploads"))
+
+	if got := len(out.entries(t)); got != 4 {
+		t.Fatalf("%d entries written before close, want 4", got)
+	}
+
+	sampler.close()
+	entries := out.entries(t)
+	if len(entries) != 5 {
+		t.Fatalf("%d entries written, want 4 and a summary", len(entries))
+	}
+	summary := entries[4]
+	if summary["msg"] != "log entries suppressed" || summary["level"] != "WARN" || summary["suppressed_msg"] != "list denied" ||
+		summary["suppressed"] != float64(3) || summary["session_id"] != "9f86d081884c7d65" || summary["file_path"] != "/uploads" {
+		t.Errorf("summary = %v, want 3 list denied entries of the session suppressed", summary)
+	}
+}
+
+func TestSamplingHandler_Interval(t *testing.T) {
+	sampler, logger, out := newTestSampler(1, 20*time.Millisecond)
+	defer sampler.close()
+
+	for range 3 {
+		logger.Error("authentication failed", slog.String("remote_ip", "203.0.113.7"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(out.entries(t)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := out.entries(t)
+	if len(entries) != 2 || entries[1]["suppressed"] != float64(2) {
+		t.Fatalf("entries = %v, want the first one and a summary of 2 suppressed", entries)
+	}
+
+	// a new interval starts with the next entry
+	logger.Error("authentication failed", slog.String("remote_ip", "203.0.113.7"))
+	if got := len(out.entries(t)); got != 3 {
+		t.Errorf("%d entries written, want the entry of the new interval", got)
+	}
+}
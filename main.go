@@ -2,63 +2,231 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	_ "time/tzdata" // the scratch image has no zoneinfo for KEY_TIMESTAMP_TZ
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve runs the gateway until it is stopped and returns the exit code.
+func serve() int {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
 
+	parameters, err := loadConfigParameters(context.Background())
+	if err != nil {
+		logger.Error("failed to load configuration parameters", slog.String("error", err.Error()))
+		return 1
+	}
+
+	// after Parameter Store, whose settings take precedence
+	profile, err := loadConfigProfile(context.Background())
+	if err != nil {
+		logger.Error("failed to load configuration profile", slog.String("error", err.Error()))
+		return 1
+	}
+
 	config, err := LoadConfig()
 	if err != nil {
 		logger.Error("failed to load configuration", slog.String("error", err.Error()))
-		os.Exit(1)
+		return 1
+	}
+
+	// before anything talks to AWS, CloudWatch Logs included
+	if config.S3Region == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		region, source, err := newRegionDetector(config, newAWSHTTPClient(config, false)).detect(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn("AWS_REGION not set and the region couldn't be detected", slog.String("error", err.Error()))
+		} else {
+			config.S3Region = region
+			logger.Info("AWS region detected", slog.String("region", region), slog.String("source", source))
+		}
+	}
+
+	// closeLogs sends or writes out buffered log entries before exiting
+	var logOutput io.Writer = os.Stdout
+	closeLogs := func() {}
+
+	if config.LogFile != "" {
+		logFile, err := newLogFile(config.LogFile, config)
+		if err != nil {
+			logger.Error("failed to open log file", slog.String("path", config.LogFile), slog.String("error", err.Error()))
+			return 1
+		}
+		logOutput = logFile
+		closeLogs = func() { logFile.Close() }
+	}
+
+	if config.CloudWatchLogGroup != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cloudWatch, err := startCloudWatchLogs(ctx, config)
+		cancel()
+		if err != nil {
+			logger.Error("failed to set up CloudWatch Logs",
+				slog.String("log_group", config.CloudWatchLogGroup),
+				slog.String("error", err.Error()),
+			)
+			closeLogs()
+			return 1
+		}
+		logOutput = io.MultiWriter(logOutput, cloudWatch)
+		closeFile := closeLogs
+		closeLogs = func() {
+			cloudWatch.close()
+			closeFile()
+		}
+	}
+
+	var requests *accessLog
+	if config.AccessLog != "" {
+		accessFile, err := newLogFile(config.AccessLog, config)
+		if err != nil {
+			logger.Error("failed to open access log", slog.String("path", config.AccessLog), slog.String("error", err.Error()))
+			closeLogs()
+			return 1
+		}
+		requests = newAccessLog(accessFile)
+		closeOthers := closeLogs
+		closeLogs = func() {
+			accessFile.Close()
+			closeOthers()
+		}
+	}
+
+	var handler slog.Handler = slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})
+
+	if config.OTLPLogs {
+		otlp := newOTLPLogs(config)
+		otlp.start()
+		handler = newOTLPLogHandler(handler, otlp)
+		closeOthers := closeLogs
+		closeLogs = func() {
+			otlp.close()
+			closeOthers()
+		}
 	}
 
-	logger.Info("starting SFTP server", 
+	var reporter *errorReporter
+	if config.SentryDSN != "" {
+		reporter, err = newErrorReporter(config)
+		if err != nil {
+			logger.Error("failed to set up error reporting", slog.String("error", err.Error()))
+			closeLogs()
+			return 1
+		}
+		reporter.start()
+		handler = newReportingHandler(handler, reporter)
+		closeOthers := closeLogs
+		closeLogs = func() {
+			reporter.close()
+			closeOthers()
+		}
+	}
+
+	// after error reporting, so repeated errors aren't all reported either
+	if config.LogSampleBurst > 0 {
+		sampler := newLogSampler(config)
+		handler = newSamplingHandler(handler, sampler)
+		closeOthers := closeLogs
+		closeLogs = func() {
+			sampler.close()
+			closeOthers()
+		}
+	}
+
+	logger = slog.New(handler)
+
+	build := currentBuildInfo()
+	logger.Info("starting SFTP server",
+		slog.String("version", build.Version),
+		slog.String("commit", build.Commit),
+		slog.String("build_date", build.BuildDate),
 		slog.Int("port", config.ServerPort),
 		slog.String("virtual_dir", config.VirtualDir),
 		slog.Int64("max_file_size", config.MaxFileSize),
 		slog.String("s3_bucket", config.S3Bucket),
 		slog.String("required_account_id", config.RequiredAccountID),
+		slog.String("key_timestamp_tz", config.KeyTimestampTZ.String()),
 	)
+	logger.Info("effective configuration", slog.Group("config", effectiveConfig(config)...))
+	if config.AllowAnyAccount {
+		logger.Warn("ACCOUNT CHECK DISABLED: principals of any AWS account may log in",
+			slog.Any("allowed_principals", config.AllowedPrincipals),
+			slog.String("policy_tag_prefix", config.PolicyTagPrefix),
+		)
+	}
 
 	server := &SFTPServer{
-		config: config,
-		logger: logger,
+		config:     config,
+		logger:     logger,
+		accessLog:  requests,
+		reporter:   reporter,
+		parameters: parameters,
+		profile:    profile,
 	}
 
 	if err := server.Run(); err != nil {
 		logger.Error("server failed", slog.String("error", err.Error()))
-		os.Exit(1)
+		closeLogs()
+		return 1
 	}
+	closeLogs()
+	return 0
 }
 
 type SFTPServer struct {
-	config     *Config
-	logger     *slog.Logger
-	listener   net.Listener
-	sshConfig  *ssh.ServerConfig
-	uploader   *S3Uploader
-	handler    *SFTPHandler
-	auth       *Authenticator
+	config      *Config
+	logger      *slog.Logger
+	listeners   []net.Listener
+	sshConfig   *ssh.ServerConfig
+	uploader    *S3Uploader
+	handler     *SFTPHandler
+	auth        *Authenticator
+	bans        *ipBans
+	geoIP       *geoIPPolicy
+	usersSecret *secretUserSource
+	findings    *securityFindings
 	activeConns sync.WaitGroup
+	sessions    sync.Map      // session ID to *activeSession, see ADMIN_TOKEN
+	connSlots   chan struct{} // one per open connection, nil if MAX_CONNECTIONS is unlimited
+	ftps        *ftpsServer   // nil without FTPS_PORT
+	hostKeys    *hostKeyRing  // nil until setupSSHConfig
+	preAuth     *preAuthConns // nil if MAX_PREAUTH_CONNECTIONS is unlimited
+
+	ready         atomic.Bool       // accepting connections, see /readyz
+	awsHTTPClient aws.HTTPClient    // for the READY_CHECK_AWS probe
+	tracer        *tracer           // nil without OTEL_EXPORTER_OTLP_ENDPOINT
+	metrics       *metrics          // nil without ADMIN_ADDR, see /metrics
+	events        *lifecycleEvents  // nil without EVENTBRIDGE_BUS
+	accessLog     *accessLog        // nil without ACCESS_LOG
+	reporter      *errorReporter    // nil without SENTRY_DSN
+	audit         *auditTrail       // nil without AUDIT_BUCKET
+	parameters    *configParameters // nil without settings in Parameter Store
+	profile       *configProfile    // nil without APPCONFIG_PROFILE
 }
 
 func (s *SFTPServer) Run() error {
@@ -66,66 +234,560 @@ func (s *SFTPServer) Run() error {
 		return fmt.Errorf("failed to setup SSH config: %w", err)
 	}
 
-	s.uploader = NewS3Uploader(s.config.S3Bucket, s.config.S3BucketPrefix, s.config.S3Region, s.logger)
-	s.handler = NewSFTPHandler(s.config, s.uploader, s.logger)
-	s.auth = NewAuthenticator(s.config.RequiredAccountID, s.config.S3Region, s.logger)
+	s.tracer = newTracer(s.config, s.logger)
+	if s.config.AdminAddr != "" {
+		s.metrics = newMetrics()
+	}
+	s.uploader = NewS3Uploader(s.config, s.logger)
+	s.uploader.tracer = s.tracer
+	s.uploader.metrics = s.metrics
+	s.uploader.httpClient = s.tracer.httpClient(s.uploader.httpClient)
+	if s.config.DeliveryWebhookURL != "" {
+		s.handler = NewSFTPHandler(s.config, newWebhookDelivery(s.config, s.logger), s.logger)
+		s.logger.Info("uploads delivered to webhook", slog.String("url", redactURL(s.config.DeliveryWebhookURL)))
+	} else if len(s.config.KafkaBrokers) > 0 {
+		s.handler = NewSFTPHandler(s.config, newKafkaDelivery(s.config, s.uploader, s.logger), s.logger)
+		s.logger.Info("uploads published to Kafka",
+			slog.String("topic", s.config.KafkaTopic),
+			slog.Any("brokers", s.config.KafkaBrokers),
+			slog.Bool("store_s3", s.config.KafkaStoreS3),
+		)
+	} else {
+		s.handler = NewSFTPHandler(s.config, s.uploader, s.logger)
+	}
+	s.handler.tracer = s.tracer
+	s.handler.metrics = s.metrics
+	if s.metrics != nil {
+		s.metrics.buffers = s.bufferUsage
+	}
+	s.handler.accessLog = s.accessLog
+	s.handler.reporter = s.reporter
+	s.auth = NewAuthenticator(s.config, s.tracer.httpClient(newAWSHTTPClient(s.config, false)), s.logger)
+	s.auth.tracer = s.tracer
+	if s.tracer != nil {
+		s.logger.Info("tracing enabled",
+			slog.String("endpoint", s.tracer.endpoint),
+			slog.String("service_name", s.tracer.service),
+		)
+	}
+
+	if s.config.VerifyWriteAccess {
+		s.auth.writeCheck = s.uploader.checkWriteAccess
+	}
 
 	s.sshConfig.PasswordCallback = s.auth.Authenticate
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.ServerPort))
-	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", s.config.ServerPort, err)
+	if s.config.UsersFile != "" {
+		users, err := loadUsers(s.config.UsersFile)
+		if err != nil {
+			return fmt.Errorf("failed to load users file: %w", err)
+		}
+		s.sshConfig.PasswordCallback = NewLocalAuthenticator(users, s.logger).Authenticate
+		s.logger.Info("local user authentication enabled", slog.Int("users", len(users)))
 	}
-	s.listener = listener
 
-	s.logger.Info("SFTP server listening", slog.String("address", listener.Addr().String()))
+	if s.config.UsersSecret != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for users secret: %w", err)
+		}
+
+		local := NewLocalAuthenticator(nil, s.logger)
+		stsClient := sts.NewFromConfig(awsConfig)
+		local.assumeRole = func(ctx context.Context, roleARN, user string) (*types.Credentials, error) {
+			return s.auth.assumeRole(ctx, stsClient, roleARN, user)
+		}
+
+		s.usersSecret = newSecretUserSource(s.config, awsConfig, local, s.logger)
+		if err := s.usersSecret.refresh(context.Background()); err != nil {
+			return fmt.Errorf("failed to load users secret: %w", err)
+		}
+		s.sshConfig.PasswordCallback = local.Authenticate
+		s.logger.Info("local user authentication enabled",
+			slog.String("secret_id", s.config.UsersSecret),
+			slog.Duration("refresh_interval", s.config.UsersSecretRefresh),
+		)
+	}
+
+	if s.config.AuthWebhookURL != "" {
+		s.sshConfig.PasswordCallback = NewWebhookAuthenticator(s.config, s.logger).Authenticate
+		s.logger.Info("webhook authentication enabled", slog.String("url", s.config.AuthWebhookURL))
+	}
+
+	if s.config.LDAPURL != "" {
+		s.sshConfig.PasswordCallback = NewLDAPAuthenticator(s.config, s.logger).Authenticate
+		s.logger.Info("LDAP authentication enabled",
+			slog.String("url", s.config.LDAPURL),
+			slog.Int("groups", len(s.config.LDAPGroupPrefixes)),
+		)
+	}
+
+	if s.config.JWTIssuer != "" {
+		s.sshConfig.PasswordCallback = wrapJWT(NewJWTAuthenticator(s.config, s.logger), s.sshConfig.PasswordCallback)
+		s.logger.Info("token authentication enabled", slog.String("issuer", s.config.JWTIssuer))
+	}
+
+	if s.config.VaultAddr != "" {
+		s.sshConfig.PasswordCallback = wrapVault(NewVaultAuthenticator(s.config, s.logger), s.sshConfig.PasswordCallback)
+		s.logger.Info("Vault token authentication enabled",
+			slog.String("addr", s.config.VaultAddr),
+			slog.String("aws_role", s.config.VaultAWSRole),
+		)
+	}
+
+	// the guest login without a password, in the form of the other
+	// callbacks so the same checks apply, see guestNoneCallback
+	var guestNone func(ssh.ConnMetadata, struct{}) (*ssh.Permissions, error)
+	if s.config.GuestUser != "" {
+		guest := NewGuestAuthenticator(s.config, s.logger)
+		s.sshConfig.PasswordCallback = wrapGuest(guest, s.sshConfig.PasswordCallback)
+		if s.config.GuestPassword == "" {
+			s.sshConfig.NoClientAuth = true
+			guestNone = func(conn ssh.ConnMetadata, _ struct{}) (*ssh.Permissions, error) {
+				return guest.AuthenticateNone(conn)
+			}
+		}
+		s.logger.Info("guest drop-box enabled",
+			slog.String("user", s.config.GuestUser),
+			slog.String("upload_prefix", s.config.GuestPrefix),
+			slog.Bool("password", s.config.GuestPassword != ""),
+		)
+	}
+
+	if s.config.SSHCAKeys != "" {
+		caKeys, err := loadCAKeys(s.config.SSHCAKeys)
+		if err != nil {
+			return fmt.Errorf("failed to load SSH CA keys: %w", err)
+		}
+		s.sshConfig.PublicKeyCallback = NewCertAuthenticator(caKeys, s.logger).Authenticate
+		s.logger.Info("SSH certificate authentication enabled", slog.Int("ca_keys", len(caKeys)))
+	}
+
+	// before the per-user configuration, whose entries take precedence
+	if s.config.PolicyTagPrefix != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for IAM tag lookups: %w", err)
+		}
+		accountID, err := gatewayAccountID(context.Background(), s.config, awsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to get gateway AWS account: %w", err)
+		}
+		policy := &tagPolicy{
+			tags:   newIAMTagLookup(awsConfig, accountID),
+			prefix: s.config.PolicyTagPrefix,
+			// without the account check or an allowlist, the tags are what admits a principal
+			required: s.config.AllowAnyAccount && len(s.config.AllowedPrincipals) == 0,
+			logger:   s.logger,
+		}
+		s.sshConfig.PasswordCallback = wrapTagPolicy(policy, s.sshConfig.PasswordCallback)
+		if s.sshConfig.PublicKeyCallback != nil {
+			s.sshConfig.PublicKeyCallback = wrapTagPolicy(policy, s.sshConfig.PublicKeyCallback)
+		}
+		s.logger.Info("session policy from IAM tags enabled", slog.String("tag_prefix", s.config.PolicyTagPrefix))
+	}
+
+	if s.config.UserConfigTable != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for per-user configuration: %w", err)
+		}
+		store := newUserConfigStore(s.config, awsConfig, s.logger)
+		s.sshConfig.PasswordCallback = wrapUserConfig(store, s.sshConfig.PasswordCallback)
+		if s.sshConfig.PublicKeyCallback != nil {
+			s.sshConfig.PublicKeyCallback = wrapUserConfig(store, s.sshConfig.PublicKeyCallback)
+		}
+		if guestNone != nil {
+			guestNone = wrapUserConfig(store, guestNone)
+		}
+		s.logger.Info("per-user configuration enabled", slog.String("table", s.config.UserConfigTable))
+	}
+
+	sourceIPs := &sourceIPPolicy{tagKey: s.config.AllowedIPsTag, logger: s.logger}
+	if s.config.AllowedIPsTag != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for IAM tag lookups: %w", err)
+		}
+		accountID, err := gatewayAccountID(context.Background(), s.config, awsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to get gateway AWS account: %w", err)
+		}
+		sourceIPs.tags = newIAMTagLookup(awsConfig, accountID)
+		s.logger.Info("source IP restrictions from IAM tags enabled", slog.String("tag", s.config.AllowedIPsTag))
+	}
+	s.sshConfig.PasswordCallback = wrapSourceIP(sourceIPs, s.sshConfig.PasswordCallback)
+	if s.sshConfig.PublicKeyCallback != nil {
+		s.sshConfig.PublicKeyCallback = wrapSourceIP(sourceIPs, s.sshConfig.PublicKeyCallback)
+	}
+	if guestNone != nil {
+		guestNone = wrapSourceIP(sourceIPs, guestNone)
+	}
+
+	if s.config.TOTPSecretsFile != "" {
+		secrets, err := loadTOTPSecrets(s.config.TOTPSecretsFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TOTP secrets: %w", err)
+		}
+		mfa := NewTOTPVerifier(secrets, s.config.MFARequired, s.logger)
+		s.sshConfig.PasswordCallback = wrapMFA(mfa, s.sshConfig.PasswordCallback)
+		if s.sshConfig.PublicKeyCallback != nil {
+			s.sshConfig.PublicKeyCallback = wrapMFA(mfa, s.sshConfig.PublicKeyCallback)
+		}
+		if guestNone != nil {
+			guestNone = wrapMFA(mfa, guestNone)
+		}
+		s.logger.Info("TOTP second factor enabled",
+			slog.Int("users", len(secrets)),
+			slog.Bool("required", s.config.MFARequired),
+		)
+	}
+
+	s.bans = newIPBans(s.config, s.logger)
+
+	if s.config.SecurityFindings != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for security findings: %w", err)
+		}
+		identity, err := sts.NewFromConfig(awsConfig).GetCallerIdentity(context.Background(), &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return fmt.Errorf("failed to get gateway AWS account: %w", err)
+		}
+
+		s.findings = newSecurityFindings(s.config, awsConfig, aws.ToString(identity.Account), s.logger)
+		s.auth.findings = s.findings
+		if s.bans != nil {
+			s.bans.findings = s.findings
+		}
+		s.logger.Info("security findings enabled",
+			slog.String("target", s.config.SecurityFindings),
+			slog.String("account_id", aws.ToString(identity.Account)),
+		)
+	}
+
+	if s.config.UploadFailureTopic != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for upload failure notifications: %w", err)
+		}
+		s.handler.notifier = newFailureNotifier(s.config, awsConfig, s.logger)
+		s.logger.Info("upload failure notifications enabled", slog.String("topic", s.config.UploadFailureTopic))
+	}
+
+	if s.config.UploadQueueURL != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for the upload queue: %w", err)
+		}
+		s.handler.uploadQueue = newUploadQueue(s.config, awsConfig, s.logger)
+		s.logger.Info("upload queue messages enabled", slog.String("queue_url", s.config.UploadQueueURL))
+	}
+
+	if s.config.EventBridgeBus != "" {
+		awsConfig, err := loadGatewayAWSConfig(context.Background(), s.config, newAWSHTTPClient(s.config, false))
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config for lifecycle events: %w", err)
+		}
+		s.events = newLifecycleEvents(s.config, awsConfig, s.logger)
+		s.handler.events = s.events
+		s.logger.Info("lifecycle events enabled", slog.String("bus", s.config.EventBridgeBus))
+	}
+
+	if s.config.AuditBucket != "" || s.config.AdminToken != "" {
+		var client auditS3API
+		if s.config.AuditBucket != "" {
+			c, err := s.uploader.newClient(context.Background(), "", "", "")
+			if err != nil {
+				return fmt.Errorf("failed to create S3 client for audit batches: %w", err)
+			}
+			client = c
+			s.logger.Info("audit batches enabled",
+				slog.String("bucket", s.config.AuditBucket),
+				slog.String("prefix", s.config.AuditPrefix),
+				slog.Duration("interval", s.config.AuditInterval),
+			)
+		}
+		s.audit = newAuditTrail(s.config, client, s.logger)
+		if s.config.AdminToken != "" {
+			s.audit.live = newLiveEvents()
+		}
+		s.handler.audit = s.audit
+		if s.bans != nil {
+			s.bans.audit = s.audit
+		}
+		s.sshConfig.AuthLogCallback = s.audit.authAttempt
+	}
+
+	if s.config.GeoIPDB != "" {
+		db, err := loadGeoIPDB(s.config.GeoIPDB)
+		if err != nil {
+			return fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+		s.geoIP = newGeoIPPolicy(db, s.config.GeoIPAllowCountries, s.config.GeoIPDenyCountries)
+		s.logger.Info("GeoIP connection policy enabled",
+			slog.Int("networks", len(db.ranges)),
+			slog.Any("allow_countries", s.config.GeoIPAllowCountries),
+			slog.Any("deny_countries", s.config.GeoIPDenyCountries),
+		)
+	}
+
+	if limiter := newAuthLimiter(s.config); limiter != nil {
+		limiter.findings = s.findings
+		s.sshConfig.PasswordCallback = wrapRateLimit(limiter, s.logger, s.sshConfig.PasswordCallback)
+		if s.sshConfig.PublicKeyCallback != nil {
+			s.sshConfig.PublicKeyCallback = wrapRateLimitPublicKey(limiter, s.logger, s.sshConfig.PublicKeyCallback)
+		}
+		if guestNone != nil {
+			guestNone = wrapRateLimit(limiter, s.logger, guestNone)
+		}
+	}
+	if guestNone != nil {
+		s.sshConfig.NoClientAuthCallback = guestNoneCallback(s.config.GuestUser, guestNone)
+	}
+
+	ports := s.config.ServerPorts
+	if len(ports) == 0 {
+		ports = []int{s.config.ServerPort}
+	}
+	listenConfig := newListenConfig(s.config)
+	for _, port := range ports {
+		listener, err := listenConfig.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on port %d: %w", port, err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+	if s.config.FTPSPort != 0 {
+		ftps, err := newFTPSServer(s.config, listenConfig)
+		if err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to start FTPS listener: %w", err)
+		}
+		s.ftps = ftps
+	}
+
+	var adminListener net.Listener
+	if s.config.AdminAddr != "" {
+		var err error
+		if adminListener, err = net.Listen("tcp", s.config.AdminAddr); err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			if s.ftps != nil {
+				s.ftps.listener.Close()
+			}
+			return fmt.Errorf("failed to listen on admin address %s: %w", s.config.AdminAddr, err)
+		}
+		s.awsHTTPClient = newAWSHTTPClient(s.config, false)
+	}
+
+	if s.config.MaxConnections > 0 {
+		s.connSlots = make(chan struct{}, s.config.MaxConnections)
+	}
+	if s.config.MaxPreAuthConnections > 0 {
+		s.preAuth = newPreAuthConns(s.config.MaxPreAuthConnections)
+	}
+
+	for _, listener := range s.listeners {
+		s.logger.Info("SFTP server listening", slog.String("address", listener.Addr().String()))
+	}
+	if s.ftps != nil {
+		s.logger.Info("FTPS server listening", slog.String("address", s.ftps.listener.Addr().String()))
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	go s.handleSignals(cancel)
 
-	go s.acceptConnections(ctx)
+	// started before accepting connections, to have the credentials by
+	// the first upload
+	if usesGatewayCredentials(s.config) {
+		go s.uploader.warmGatewayClient(ctx)
+	}
+
+	for _, listener := range s.listeners {
+		go s.acceptConnections(ctx, listener, s.handleConnection)
+	}
+	if s.ftps != nil {
+		go s.acceptConnections(ctx, s.ftps.listener, s.handleFTPSConnection)
+	}
+	s.ready.Store(true)
+
+	// The admin listener stays up while open sessions finish, so health
+	// checks see the gateway draining rather than gone.
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	defer stopAdmin()
+	if adminListener != nil {
+		go s.serveAdmin(adminCtx, adminListener)
+	}
+
+	if s.usersSecret != nil {
+		go s.usersSecret.run(ctx)
+	}
+
+	if s.findings != nil {
+		go s.findings.run(ctx)
+	}
+
+	if s.handler.notifier != nil {
+		go s.handler.notifier.run(ctx)
+	}
+
+	if s.handler.uploadQueue != nil {
+		go s.handler.uploadQueue.run(ctx)
+	}
+
+	if s.events != nil {
+		go s.events.run(ctx)
+	}
+
+	if s.config.AuditBucket != "" {
+		go s.audit.run(ctx, s.config.AuditInterval)
+	}
+
+	if s.tracer != nil {
+		go s.tracer.run(ctx)
+	}
+
+	if s.parameters != nil && s.config.ConfigParameterRefresh > 0 {
+		go s.parameters.run(ctx, s.config.ConfigParameterRefresh, s.logger, cancel)
+	}
+
+	if s.profile != nil {
+		go s.profile.run(ctx, s.logger, cancel, s.reloadSettings)
+	}
 
 	<-ctx.Done()
 	s.logger.Info("shutting down server")
+	s.ready.Store(false)
 
-	s.listener.Close()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.ftps != nil {
+		s.ftps.listener.Close()
+	}
 	s.activeConns.Wait()
+	s.tracer.flush()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 30*time.Second)
+	s.audit.flush(flushCtx)
+	cancelFlush()
 
 	s.logger.Info("server shutdown complete")
 	return nil
 }
 
+// reloadSettings applies the hot-reloadable settings of config, see
+// hotReloadSettings. Open files keep the route they were opened with and
+// open sessions their session limits.
+func (s *SFTPServer) reloadSettings(config *Config) {
+	s.handler.live.Store(config)
+}
+
+// newListenConfig applies the TCP keepalive settings to accepted
+// connections, so clients that vanished behind a NAT or firewall are
+// dropped instead of holding a session until the gateway restarts.
+func newListenConfig(config *Config) net.ListenConfig {
+	if !config.TCPKeepAlive {
+		return net.ListenConfig{KeepAlive: -1}
+	}
+	return net.ListenConfig{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     config.TCPKeepAliveInterval,
+			Interval: config.TCPKeepAliveInterval,
+			Count:    config.TCPKeepAliveCount,
+		},
+	}
+}
+
 func (s *SFTPServer) setupSSHConfig() error {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	signers, err := s.loadHostKeys()
 	if err != nil {
-		return fmt.Errorf("failed to generate private key: %w", err)
+		return err
+	}
+
+	s.sshConfig = &ssh.ServerConfig{
+		MaxAuthTries:     3,
+		PasswordCallback: nil, // Will be set later
+		ServerVersion:    s.config.SSHServerVersion,
+	}
+	s.sshConfig.Ciphers = s.config.SSHCiphers
+	s.sshConfig.MACs = s.config.SSHMACs
+	s.sshConfig.KeyExchanges = s.config.SSHKeyExchanges
+
+	banner := s.config.SSHBanner
+	if s.config.SSHBannerFile != "" {
+		data, err := os.ReadFile(s.config.SSHBannerFile)
+		if err != nil {
+			return fmt.Errorf("failed to read SSH banner: %w", err)
+		}
+		banner = string(data)
+	}
+	if banner != "" {
+		if !strings.HasSuffix(banner, "\n") {
+			banner += "\n"
+		}
+		s.sshConfig.BannerCallback = func(ssh.ConnMetadata) string { return banner }
+	}
+
+	if insecure := insecureSSHAlgorithms(s.sshConfig.Config); len(insecure) > 0 {
+		s.logger.Warn("insecure SSH algorithms enabled", slog.Any("algorithms", insecure))
 	}
 
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	s.hostKeys = newHostKeyRing(s.sshConfig, signers, s.logger)
+	for _, signer := range signers {
+		s.logger.Info("host key loaded",
+			slog.String("type", signer.PublicKey().Type()),
+			slog.String("fingerprint", ssh.FingerprintSHA256(signer.PublicKey())),
+		)
 	}
+	return nil
+}
 
-	privateKeyBytes := pem.EncodeToMemory(privateKeyPEM)
+// loadHostKeys returns the host keys shared through HOST_KEY_SECRET or
+// HOST_KEY_PARAMETER, or keys generated for this process only.
+func (s *SFTPServer) loadHostKeys() ([]ssh.Signer, error) {
+	if s.config.HostKeySecret == "" && s.config.HostKeyParameter == "" {
+		keys, err := generateHostKeys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host keys: %w", err)
+		}
+		return parseHostKeys(keys)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+	awsConfig, err := loadGatewayAWSConfig(ctx, s.config, newAWSHTTPClient(s.config, false))
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return nil, fmt.Errorf("failed to load AWS config for host key: %w", err)
 	}
 
-	s.sshConfig = &ssh.ServerConfig{
-		MaxAuthTries:      3,
-		PasswordCallback:  nil, // Will be set later
-		ServerVersion:     "SSH-2.0-SFTPGW",
+	var store hostKeyStore
+	if s.config.HostKeySecret != "" {
+		store = newSecretHostKey(s.config, awsConfig)
+	} else {
+		store = newParameterHostKey(s.config, awsConfig)
 	}
 
-	s.sshConfig.AddHostKey(signer)
-	return nil
+	signers, err := loadSharedHostKeys(ctx, store, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host key from %s: %w", store.name(), err)
+	}
+	return signers, nil
 }
 
-func (s *SFTPServer) acceptConnections(ctx context.Context) {
+// acceptConnections hands the connections of listener that pass the bans,
+// the GeoIP policy and MAX_CONNECTIONS to handle, in a goroutine each.
+func (s *SFTPServer) acceptConnections(ctx context.Context, listener net.Listener, handle func(context.Context, net.Conn)) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -133,49 +795,169 @@ func (s *SFTPServer) acceptConnections(ctx context.Context) {
 		default:
 		}
 
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				s.logger.Error("failed to accept connection", slog.String("error", err.Error()))
+				s.logger.Error("failed to accept connection",
+					slog.String("address", listener.Addr().String()),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+		}
+
+		if s.bans != nil && s.bans.isBanned(getClientIP(conn.RemoteAddr())) {
+			if s.findings != nil {
+				s.findings.bannedConnection(getClientIP(conn.RemoteAddr()))
+			}
+			conn.Close()
+			continue
+		}
+
+		if s.geoIP != nil {
+			clientIP := getClientIP(conn.RemoteAddr())
+			if country, allowed := s.geoIP.check(clientIP); !allowed {
+				s.logger.Warn("connection rejected: country not allowed",
+					slog.String("remote_ip", clientIP),
+					slog.String("country", country),
+				)
+				conn.Close()
+				continue
+			}
+		}
+
+		if s.connSlots != nil {
+			select {
+			case s.connSlots <- struct{}{}:
+			default:
+				s.logger.Warn("connection rejected: too many connections",
+					slog.String("remote_ip", getClientIP(conn.RemoteAddr())),
+					slog.Int("max_connections", s.config.MaxConnections),
+				)
+				conn.Close()
 				continue
 			}
 		}
 
 		s.activeConns.Add(1)
-		go s.handleConnection(ctx, conn)
+		go handle(ctx, conn)
 	}
 }
 
+// clientVersionAllowed applies CLIENT_VERSION_ALLOW and CLIENT_VERSION_DENY
+// to the identification string sent by a client.
+func clientVersionAllowed(config *Config, version string) bool {
+	if config.ClientVersionDeny != nil && config.ClientVersionDeny.MatchString(version) {
+		return false
+	}
+	return config.ClientVersionAllow == nil || config.ClientVersionAllow.MatchString(version)
+}
+
 func (s *SFTPServer) handleConnection(ctx context.Context, conn net.Conn) {
+	defer s.reporter.recoverPanic()
 	defer s.activeConns.Done()
 	defer conn.Close()
+	if s.connSlots != nil {
+		defer func() { <-s.connSlots }()
+	}
 
 	clientIP := getClientIP(conn.RemoteAddr())
+	port := getPort(conn.LocalAddr())
 
-	conn.SetDeadline(time.Now().Add(s.config.ConnectionTimeout))
+	var country string
+	if s.geoIP != nil {
+		country = s.geoIP.db.country(clientIP)
+	}
+
+	// The key exchange must finish within HANDSHAKE_TIMEOUT, the whole login
+	// within CONNECTION_TIMEOUT.
+	loginDeadline := time.Now().Add(s.config.ConnectionTimeout)
+	conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+
+	sshConfig := *s.sshConfig
+	if s.hostKeys != nil {
+		sshConfig = *s.hostKeys.serverConfig()
+	}
+	sshConfig.PreAuthConnCallback = func(ssh.ServerPreAuthConn) {
+		conn.SetDeadline(loginDeadline)
+	}
 
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if s.preAuth != nil {
+		s.preAuth.add(conn)
+	}
+	tconn := newTimeoutConn(conn, s.config, s.logger)
+	sshConn, chans, reqs, err := ssh.NewServerConn(tconn, &sshConfig)
+	if s.preAuth != nil && s.preAuth.done(conn) {
+		s.logger.Warn("connection dropped: too many connections logging in",
+			slog.String("remote_ip", clientIP),
+			slog.Int("max_preauth_connections", s.config.MaxPreAuthConnections),
+		)
+		if sshConn != nil {
+			sshConn.Close()
+		}
+		return
+	}
 	if err != nil {
-		s.logger.Warn("SSH handshake failed", 
+		s.logger.Warn("SSH handshake failed",
 			slog.String("remote_ip", clientIP),
+			slog.Int("port", port),
+			slog.String("country", country),
 			slog.String("error", err.Error()),
 		)
+		if s.bans != nil {
+			s.bans.recordFailure(clientIP)
+		}
 		return
 	}
 	defer sshConn.Close()
 
 	conn.SetDeadline(time.Time{})
+	tconn.start()
+
+	sessionID := getSessionID(sshConn)
+	clientVersion := string(sshConn.ClientVersion())
+	if !clientVersionAllowed(s.config, clientVersion) {
+		s.logger.Warn("connection rejected: client version not allowed",
+			slog.String("remote_ip", clientIP),
+			slog.String("session_id", sessionID),
+			slog.String("user", sshConn.User()),
+			slog.String("client_version", clientVersion),
+		)
+		return
+	}
 
-	s.logger.Info("SSH connection established", 
+	if sshConn.Permissions != nil && sshConn.Permissions.Extensions != nil {
+		sshConn.Permissions.Extensions["country"] = country
+	}
+
+	s.logger.Info("SSH connection established",
 		slog.String("remote_ip", clientIP),
+		slog.String("session_id", sessionID),
+		slog.Int("port", port),
+		slog.String("country", country),
 		slog.String("user", sshConn.User()),
-		slog.String("client_version", string(sshConn.ClientVersion())),
+		slog.String("client_version", clientVersion),
 	)
 
-	go ssh.DiscardRequests(reqs)
+	s.metrics.observeConnection(port)
+
+	session := newActiveSession(sshConn, sshConn.Permissions, tconn)
+	s.sessions.Store(sessionID, session)
+	defer s.sessions.Delete(sessionID)
+	s.events.sessionStarted(session)
+	defer s.events.sessionEnded(session)
+	s.audit.session(eventSessionStarted, session)
+	defer s.audit.session(eventSessionEnded, session)
+
+	if s.hostKeys != nil {
+		go s.hostKeys.handleGlobalRequests(sshConn, reqs)
+		s.hostKeys.announce(sshConn)
+	} else {
+		go ssh.DiscardRequests(reqs)
+	}
 
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
@@ -185,68 +967,105 @@ func (s *SFTPServer) handleConnection(ctx context.Context, conn net.Conn) {
 
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			s.logger.Error("failed to accept channel", 
+			s.logger.Error("failed to accept channel",
 				slog.String("remote_ip", clientIP),
+				slog.String("session_id", sessionID),
 				slog.String("error", err.Error()),
 			)
 			continue
 		}
 
-		go s.handleChannel(ctx, channel, requests, sshConn)
+		go s.handleChannel(ctx, channel, requests, sshConn, tconn)
 	}
 }
 
-func (s *SFTPServer) handleChannel(ctx context.Context, channel ssh.Channel, requests <-chan *ssh.Request, sshConn *ssh.ServerConn) {
+func (s *SFTPServer) handleChannel(ctx context.Context, channel ssh.Channel, requests <-chan *ssh.Request, sshConn *ssh.ServerConn, conn *timeoutConn) {
+	defer s.reporter.recoverPanic()
 	defer channel.Close()
 
 	clientIP := getClientIP(sshConn.RemoteAddr())
+	sessionID := getSessionID(sshConn)
 
 	for req := range requests {
 		switch req.Type {
 		case "subsystem":
 			if string(req.Payload[4:]) == "sftp" {
 				req.Reply(true, nil)
-				s.handleSFTP(ctx, channel, sshConn)
+				s.handleSFTP(ctx, channel, sshConn, conn)
 				return
 			}
 			req.Reply(false, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				if cmd, ok := parseSCPCommand(payload.Command); ok {
+					req.Reply(true, nil)
+					s.handleSCP(channel, sshConn, conn, cmd)
+					return
+				}
+			}
+			fallthrough
+		case "shell":
+			req.Reply(true, nil)
+			s.logger.Info("shell or command request rejected",
+				slog.String("remote_ip", clientIP),
+				slog.String("session_id", sessionID),
+				slog.String("request", req.Type),
+			)
+			s.explainUploadOnly(channel, getPort(sshConn.LocalAddr()))
+			return
+		case "pty-req", "env":
+			// accepted so clients don't print warnings before the shell
+			// request is answered
+			req.Reply(true, nil)
 		default:
 			req.Reply(false, nil)
 		}
 	}
 
-	s.logger.Info("SSH channel closed", slog.String("remote_ip", clientIP))
+	s.logger.Info("SSH channel closed",
+		slog.String("remote_ip", clientIP),
+		slog.String("session_id", sessionID),
+	)
+}
+
+// explainUploadOnly tells clients that open a shell or run a command that
+// this is an SFTP endpoint, and ends the session with a failed exit status
+// instead of leaving the client hanging. port is the listener the client
+// connected to, which may be one of several, see SFTP_PORT.
+func (s *SFTPServer) explainUploadOnly(channel ssh.Channel, port int) {
+	fmt.Fprintf(channel.Stderr(), "This is an upload-only SFTP server; shell access and commands are not available.\r\n"+
+		"Connect with an SFTP client instead, for example: sftp -P %d user@host\r\n", port)
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
 }
 
-func (s *SFTPServer) handleSFTP(ctx context.Context, channel ssh.Channel, sshConn *ssh.ServerConn) {
+// handleSCP receives files from "scp -t" and sends the exit status back.
+func (s *SFTPServer) handleSCP(channel ssh.Channel, sshConn *ssh.ServerConn, conn *timeoutConn, cmd scpCommand) {
 	clientIP := getClientIP(sshConn.RemoteAddr())
-	
-	permissions := sshConn.Permissions
-	if permissions == nil {
-		s.logger.Error("no permissions found in SSH connection", slog.String("remote_ip", clientIP))
-		return
-	}
 
-	accessKeyID := permissions.Extensions["aws_access_key_id"]
-	secretAccessKey := permissions.Extensions["aws_secret_access_key"]
-	accountID := permissions.Extensions["aws_account_id"]
+	status := uint32(1)
+	if sessionHandler := s.newSessionHandler(sshConn, sshConn.Permissions, conn, "SCP session started"); sessionHandler != nil {
+		status = newSCPSink(channel, sessionHandler, s.logger).run(cmd)
+	}
+	channel.CloseWrite()
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
 
-	s.logger.Info("SFTP session started", 
+	s.logger.Info("SCP session ended",
 		slog.String("remote_ip", clientIP),
-		slog.String("access_key_id", accessKeyID),
-		slog.String("account_id", accountID),
+		slog.String("session_id", getSessionID(sshConn)),
+		slog.Int("exit_status", int(status)),
 	)
+}
 
-	// Create a custom handler for this session with context
-	sessionHandler := &SessionSFTPHandler{
-		handler:         s.handler,
-		clientIP:        clientIP,
-		accessKeyID:     accessKeyID,
-		secretAccessKey: secretAccessKey,
-		accountID:       accountID,
+func (s *SFTPServer) handleSFTP(ctx context.Context, channel ssh.Channel, sshConn *ssh.ServerConn, conn *timeoutConn) {
+	clientIP := getClientIP(sshConn.RemoteAddr())
+
+	sessionHandler := s.newSessionHandler(sshConn, sshConn.Permissions, conn, "SFTP session started")
+	if sessionHandler == nil {
+		return
 	}
 
-	server := sftp.NewRequestServer(channel, sftp.Handlers{
+	server := sftp.NewRequestServer(newHashConn(channel, sessionHandler, s.logger), sftp.Handlers{
 		FileGet:  sessionHandler,
 		FilePut:  sessionHandler,
 		FileCmd:  sessionHandler,
@@ -254,64 +1073,216 @@ func (s *SFTPServer) handleSFTP(ctx context.Context, channel ssh.Channel, sshCon
 	})
 
 	if err := server.Serve(); err != nil {
-		s.logger.Info("SFTP session ended", 
+		s.logger.Info("SFTP session ended",
 			slog.String("remote_ip", clientIP),
+			slog.String("session_id", sessionHandler.sessionID),
 			slog.String("error", err.Error()),
 		)
 	} else {
-		s.logger.Info("SFTP session ended normally", slog.String("remote_ip", clientIP))
+		s.logger.Info("SFTP session ended normally",
+			slog.String("remote_ip", clientIP),
+			slog.String("session_id", sessionHandler.sessionID),
+		)
+	}
+}
+
+// newSessionHandler creates the upload handler for a session from the
+// permissions the user authenticated with, and logs msg with the session's
+// settings. It returns nil if the connection has no permissions.
+func (s *SFTPServer) newSessionHandler(meta ssh.ConnMetadata, permissions *ssh.Permissions, conn *timeoutConn, msg string) *SessionSFTPHandler {
+	clientIP := getClientIP(meta.RemoteAddr())
+	sessionID := getSessionID(meta)
+
+	if permissions == nil {
+		s.logger.Error("no permissions found in SSH connection",
+			slog.String("remote_ip", clientIP),
+			slog.String("session_id", sessionID),
+		)
+		return nil
+	}
+
+	user := permissions.Extensions["user"]
+	accessKeyID := permissions.Extensions["aws_access_key_id"]
+	secretAccessKey := permissions.Extensions["aws_secret_access_key"]
+	sessionToken := permissions.Extensions["aws_session_token"]
+	accountID := permissions.Extensions["aws_account_id"]
+	uploadPrefix := permissions.Extensions["upload_prefix"]
+	roleARN := permissions.Extensions["role_arn"]
+	quota, _ := strconv.ParseInt(permissions.Extensions["quota"], 10, 64)
+	country := permissions.Extensions["country"]
+	bucket := permissions.Extensions["bucket"]
+	maxFileSize, _ := strconv.ParseInt(permissions.Extensions["max_file_size"], 10, 64)
+	var allowedExtensions []string
+	if extensions := permissions.Extensions["allowed_extensions"]; extensions != "" {
+		allowedExtensions = strings.Split(extensions, ",")
+	}
+
+	s.logger.Info(msg,
+		slog.String("remote_ip", clientIP),
+		slog.String("session_id", sessionID),
+		slog.String("user", user),
+		slog.String("access_key_id", accessKeyID),
+		slog.String("account_id", accountID),
+		slog.String("upload_prefix", uploadPrefix),
+		slog.String("role_arn", roleARN),
+		slog.String("country", country),
+		slog.String("bucket", bucket),
+		slog.Int64("max_file_size", maxFileSize),
+		slog.Any("allowed_extensions", allowedExtensions),
+	)
+
+	// Create a custom handler for this session with context
+	return &SessionSFTPHandler{
+		handler:           s.handler,
+		clientIP:          clientIP,
+		sessionID:         sessionID,
+		port:              getPort(meta.LocalAddr()),
+		user:              user,
+		accessKeyID:       accessKeyID,
+		secretAccessKey:   secretAccessKey,
+		sessionToken:      sessionToken,
+		accountID:         accountID,
+		uploadPrefix:      uploadPrefix,
+		quota:             quota,
+		country:           country,
+		bucket:            bucket,
+		maxFileSize:       maxFileSize,
+		allowedExtensions: allowedExtensions,
+		usage:             newSessionUsage(s.handler.settings()),
+		conn:              conn,
+		traceParent:       permissions.Extensions["traceparent"],
 	}
 }
 
 type SessionSFTPHandler struct {
-	handler         *SFTPHandler
-	clientIP        string
-	accessKeyID     string
-	secretAccessKey string
-	accountID       string
+	handler           *SFTPHandler
+	clientIP          string
+	sessionID         string // see getSessionID
+	port              int    // the listener the client connected to, see SFTP_PORT
+	user              string
+	accessKeyID       string
+	secretAccessKey   string
+	sessionToken      string
+	accountID         string
+	uploadPrefix      string
+	quota             int64
+	country           string
+	bucket            string
+	maxFileSize       int64
+	allowedExtensions []string
+	usage             *sessionUsage // see SESSION_MAX_FILES and SESSION_MAX_BYTES
+	conn              *timeoutConn  // see READ_TIMEOUT
+	traceParent       string        // span of the login, see OTEL_EXPORTER_OTLP_ENDPOINT
+}
+
+// access identifies the session in the access log.
+func (h *SessionSFTPHandler) access() accessRequest {
+	return accessRequest{clientIP: h.clientIP, sessionID: h.sessionID, user: h.user}
 }
 
-func (h *SessionSFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+func (h *SessionSFTPHandler) Fileread(r *sftp.Request) (_ io.ReaderAt, err error) {
+	defer func() { h.handler.logRequest(h.access(), r.Method, r.Filepath, "", err, 0) }()
 	return h.handler.Fileread(r)
 }
 
-func (h *SessionSFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	// Create file upload with session context
-	upload := &FileUpload{
-		data:      make([]byte, 0, h.handler.config.MaxFileSize),
-		path:      r.Filepath,
-		clientIP:  h.clientIP,
-		accessKey: h.accessKeyID,
-		secretKey: h.secretAccessKey,
-	}
+// Filewrite opens a file for upload. Files that were opened are written to
+// the access log when they are closed, see FileWriter.Close.
+func (h *SessionSFTPHandler) Filewrite(r *sftp.Request) (_ io.WriterAt, err error) {
+	defer func() {
+		if err != nil {
+			h.handler.logRequest(h.access(), r.Method, r.Filepath, "", err, 0)
+		}
+	}()
 
 	if !h.handler.isPathAllowed(r.Filepath) {
-		h.handler.logger.Warn("file write rejected: path not allowed", 
+		h.handler.logger.Warn("file write rejected: path not allowed",
 			slog.String("remote_ip", h.clientIP),
+			slog.String("session_id", h.sessionID),
 			slog.String("access_key_id", h.accessKeyID),
 			slog.String("file_path", r.Filepath),
 		)
 		return nil, os.ErrPermission
 	}
 
+	name := r.Filepath
+	if target := tempFileTarget(name, h.handler.config.TempFileSuffixes); target != "" {
+		name = target
+	}
+	if err := h.handler.checkExtension(name, h.allowedExtensions); err != nil {
+		h.handler.logger.Warn("file write rejected: file extension not allowed",
+			slog.String("remote_ip", h.clientIP),
+			slog.String("session_id", h.sessionID),
+			slog.String("access_key_id", h.accessKeyID),
+			slog.String("file_path", r.Filepath),
+		)
+		return nil, err
+	}
+
+	if err := h.usage.startFile(); err != nil {
+		h.handler.logger.Warn("file write rejected: session file limit reached",
+			slog.String("remote_ip", h.clientIP),
+			slog.String("session_id", h.sessionID),
+			slog.String("access_key_id", h.accessKeyID),
+			slog.String("file_path", r.Filepath),
+			slog.Int("session_max_files", h.usage.maxFiles),
+		)
+		return nil, err
+	}
+
 	h.handler.logger.Info("file write request",
 		slog.String("remote_ip", h.clientIP),
+		slog.String("session_id", h.sessionID),
 		slog.String("access_key_id", h.accessKeyID),
 		slog.String("file_path", r.Filepath),
 	)
 
+	// Create file upload with session context
+	upload, err := h.handler.openUpload(r, uploadSession{
+		user:              h.user,
+		accessKeyID:       h.accessKeyID,
+		secretAccessKey:   h.secretAccessKey,
+		sessionToken:      h.sessionToken,
+		accountID:         h.accountID,
+		clientIP:          h.clientIP,
+		sessionID:         h.sessionID,
+		port:              h.port,
+		prefix:            h.uploadPrefix,
+		quota:             h.quota,
+		country:           h.country,
+		bucket:            h.bucket,
+		maxFileSize:       h.maxFileSize,
+		allowedExtensions: h.allowedExtensions,
+		traceParent:       h.traceParent,
+	})
+	if err != nil {
+		h.handler.logger.Error("failed to prepare upload",
+			slog.String("remote_ip", h.clientIP),
+			slog.String("session_id", h.sessionID),
+			slog.String("access_key_id", h.accessKeyID),
+			slog.String("file_path", r.Filepath),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
 	h.handler.activeUploads.Store(r.Filepath, upload)
+	h.conn.startTransfer()
 
 	return &FileWriter{
 		upload:  upload,
 		handler: h.handler,
 		logger:  h.handler.logger,
+		usage:   h.usage,
+		conn:    h.conn,
 	}, nil
 }
 
-func (h *SessionSFTPHandler) Filecmd(r *sftp.Request) error {
+func (h *SessionSFTPHandler) Filecmd(r *sftp.Request) (err error) {
+	defer func() { h.handler.logRequest(h.access(), r.Method, r.Filepath, r.Target, err, 0) }()
+
 	logCtx := slog.Group("file_cmd",
 		"remote_ip", h.clientIP,
+		"session_id", h.sessionID,
 		"access_key_id", h.accessKeyID,
 		"file_path", r.Filepath,
 		"method", r.Method,
@@ -322,8 +1293,7 @@ func (h *SessionSFTPHandler) Filecmd(r *sftp.Request) error {
 		h.handler.logger.Warn("file remove rejected: operation not allowed", logCtx)
 		return os.ErrPermission
 	case "Rename":
-		h.handler.logger.Warn("file rename rejected: operation not allowed", logCtx)
-		return os.ErrPermission
+		return h.handler.renameTempFile(h.user, r.Filepath, r.Target, logCtx)
 	case "Mkdir":
 		h.handler.logger.Info("mkdir request (virtual operation)", logCtx)
 		return nil
@@ -332,6 +1302,7 @@ func (h *SessionSFTPHandler) Filecmd(r *sftp.Request) error {
 		return os.ErrPermission
 	case "Setstat":
 		h.handler.logger.Info("setstat request (ignored)", logCtx)
+		h.handler.recordDeclaredSize(r)
 		return nil
 	default:
 		h.handler.logger.Warn("unknown file command rejected", logCtx)
@@ -343,16 +1314,42 @@ func (h *SessionSFTPHandler) Fileinfo(r *sftp.Request) ([]os.FileInfo, error) {
 	return nil, os.ErrPermission
 }
 
-func (h *SessionSFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+func (h *SessionSFTPHandler) Filelist(r *sftp.Request) (_ sftp.ListerAt, err error) {
+	defer func() { h.handler.logRequest(h.access(), r.Method, r.Filepath, "", err, 0) }()
+
+	if r.Method == "Stat" {
+		if lister, ok := h.handler.statSuspendedUpload(h.user, r.Filepath); ok {
+			return lister, nil
+		}
+	}
 	return nil, os.ErrPermission
 }
 
 func (s *SFTPServer) handleSignals(cancel context.CancelFunc) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	sig := <-sigChan
-	s.logger.Info("received signal", slog.String("signal", sig.String()))
-	cancel()
+	for sig := range sigChan {
+		s.logger.Info("received signal", slog.String("signal", sig.String()))
+		if sig == syscall.SIGHUP {
+			s.rotateHostKeys()
+			continue
+		}
+		cancel()
+		return
+	}
 }
 
+// rotateHostKeys reloads the host keys for new connections. On failure the
+// current keys stay in use.
+func (s *SFTPServer) rotateHostKeys() {
+	if s.hostKeys == nil {
+		return
+	}
+	signers, err := s.loadHostKeys()
+	if err != nil {
+		s.logger.Error("failed to reload host keys", slog.String("error", err.Error()))
+		return
+	}
+	s.hostKeys.rotate(signers, s.config.HostKeyRollover)
+}
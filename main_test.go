@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAcceptConnections_MaxConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	s := &SFTPServer{
+		config:    &Config{MaxConnections: 1, ConnectionTimeout: time.Minute, HandshakeTimeout: time.Minute},
+		logger:    slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		sshConfig: &ssh.ServerConfig{NoClientAuth: true},
+		connSlots: make(chan struct{}, 1),
+	}
+	s.sshConfig.AddHostKey(newTestSigner(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.acceptConnections(ctx, listener, s.handleConnection)
+
+	// The first connection holds the only slot while its handshake is pending.
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("first dial failed: %v", err)
+	}
+	defer first.Close()
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("first connection expected the server version, got: %v", err)
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("second dial failed: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("second connection read error = %v, want it closed by the server", err)
+	}
+
+	// Once the first connection is gone its slot is free again.
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.connSlots) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.connSlots) != 0 {
+		t.Error("slot of the closed connection was not released")
+	}
+}
+
+func TestNewListenConfig(t *testing.T) {
+	lc := newListenConfig(&Config{TCPKeepAlive: true, TCPKeepAliveInterval: time.Minute, TCPKeepAliveCount: 3})
+	want := net.KeepAliveConfig{Enable: true, Idle: time.Minute, Interval: time.Minute, Count: 3}
+	if lc.KeepAliveConfig != want {
+		t.Errorf("KeepAliveConfig = %+v, want %+v", lc.KeepAliveConfig, want)
+	}
+
+	if lc := newListenConfig(&Config{TCPKeepAlive: false}); lc.KeepAlive >= 0 {
+		t.Errorf("KeepAlive = %v, want keepalives disabled", lc.KeepAlive)
+	}
+}
+
+func TestClientVersionAllowed(t *testing.T) {
+	config := &Config{
+		ClientVersionAllow: regexp.MustCompile(`^SSH-2\.0-(OpenSSH|WinSCP)`),
+		ClientVersionDeny:  regexp.MustCompile(`OpenSSH_[1-6]\.`),
+	}
+
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13", true},
+		{"SSH-2.0-WinSCP_release_6.3.3", true},
+		{"SSH-2.0-OpenSSH_5.3", false},
+		{"SSH-2.0-libssh_0.9.6", false},
+	}
+	for _, tt := range tests {
+		if got := clientVersionAllowed(config, tt.version); got != tt.want {
+			t.Errorf("clientVersionAllowed(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+
+	if !clientVersionAllowed(&Config{}, "SSH-2.0-anything") {
+		t.Error("clientVersionAllowed() without rules = false, want true")
+	}
+}
+
+func TestHandleChannel_ShellAndExecRejected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	s := &SFTPServer{
+		config:    &Config{ServerPort: 2222, ConnectionTimeout: time.Minute, HandshakeTimeout: time.Minute},
+		logger:    slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		sshConfig: &ssh.ServerConfig{NoClientAuth: true},
+	}
+	s.sshConfig.AddHostKey(newTestSigner(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.acceptConnections(ctx, listener, s.handleConnection)
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput("ls")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("exec error = %v, want exit status 1", err)
+	}
+	if !strings.Contains(string(output), "upload-only SFTP server") {
+		t.Errorf("exec output = %q, want an explanation", output)
+	}
+	if want := fmt.Sprintf("sftp -P %d ", getPort(listener.Addr())); !strings.Contains(string(output), want) {
+		t.Errorf("exec output = %q, want the port the client connected to", output)
+	}
+}
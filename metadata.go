@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metadataEntry is an entry of OBJECT_METADATA. The value may contain
+// placeholders such as {user}, filled in for each upload.
+type metadataEntry struct {
+	key   string
+	value string
+}
+
+// String returns the entry in the form of OBJECT_METADATA.
+func (e metadataEntry) String() string {
+	return e.key + "=" + e.value
+}
+
+// builtinMetadataKeys are set on every object and can't be replaced.
+var builtinMetadataKeys = map[string]bool{
+	"client-ip":       true,
+	"session-id":      true,
+	"access-key-id":   true,
+	"upload-time":     true,
+	"original-path":   true,
+	"checksum-sha256": true,
+	"checksum-crc32":  true,
+}
+
+// metadataVariables lists the placeholders OBJECT_METADATA values may use.
+var metadataVariables = map[string]bool{
+	"user":          true,
+	"partner":       true,
+	"account_id":    true,
+	"access_key_id": true,
+	"client_ip":     true,
+	"session_id":    true,
+	"country":       true,
+}
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// parseObjectMetadata reads comma separated key=value pairs, such as
+// "environment=production,partner={partner}". Keys are lower-cased, as S3
+// does.
+func parseObjectMetadata(value string) ([]metadataEntry, error) {
+	var entries []metadataEntry
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("key %q must consist of letters, digits and hyphens", key)
+		}
+		if builtinMetadataKeys[key] {
+			return nil, fmt.Errorf("key %q is set by the gateway", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("key %q listed twice", key)
+		}
+		for _, match := range keyTemplatePlaceholder.FindAllStringSubmatch(value, -1) {
+			if !metadataVariables[match[1]] {
+				return nil, fmt.Errorf("key %q: unknown variable {%s}", key, match[1])
+			}
+		}
+		if strings.ContainsAny(keyTemplatePlaceholder.ReplaceAllString(value, ""), "{}") {
+			return nil, fmt.Errorf("key %q: unbalanced braces", key)
+		}
+		seen[key] = true
+		entries = append(entries, metadataEntry{key: key, value: value})
+	}
+	return entries, nil
+}
+
+// partnerID derives the partner of a user with PARTNER_ID_PATTERN: the first
+// group of the pattern, or the whole match if it has no group. Without a
+// pattern, or if the user name doesn't match, it is the user name.
+func partnerID(pattern *regexp.Regexp, user string) string {
+	if pattern == nil {
+		return user
+	}
+	match := pattern.FindStringSubmatch(user)
+	switch {
+	case match == nil:
+		return user
+	case len(match) > 1:
+		return match[1]
+	default:
+		return match[0]
+	}
+}
+
+// addCustomMetadata fills in the OBJECT_METADATA entries for session and
+// adds them to metadata. Entries that expand to an empty value are left
+// out.
+func addCustomMetadata(metadata map[string]string, entries []metadataEntry, partnerPattern *regexp.Regexp, session uploadSession) map[string]string {
+	if len(entries) == 0 {
+		return metadata
+	}
+	vars := map[string]string{
+		"user":          session.user,
+		"partner":       partnerID(partnerPattern, session.user),
+		"account_id":    session.accountID,
+		"access_key_id": session.accessKeyID,
+		"client_ip":     session.clientIP,
+		"session_id":    session.sessionID,
+		"country":       session.country,
+	}
+	for _, entry := range entries {
+		value := keyTemplatePlaceholder.ReplaceAllStringFunc(entry.value, func(placeholder string) string {
+			return vars[placeholder[1:len(placeholder)-1]]
+		})
+		if value != "" {
+			metadata[entry.key] = value
+		}
+	}
+	return metadata
+}
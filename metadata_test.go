@@ -0,0 +1,89 @@
+package main
+
+import (
+	"maps"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseObjectMetadata(t *testing.T) {
+	entries, err := parseObjectMetadata("Deployment=eu-1, environment = production,partner={partner}-{country},")
+	if err != nil {
+		t.Fatalf("parseObjectMetadata() unexpected error: %v", err)
+	}
+	want := []metadataEntry{
+		{"deployment", "eu-1"},
+		{"environment", "production"},
+		{"partner", "{partner}-{country}"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("parseObjectMetadata() = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	for _, value := range []string{
+		"environment",
+		"my key=value",
+		"upload-time=now",
+		"team=a,team=b",
+		"partner={bucket}",
+		"partner={user",
+	} {
+		if _, err := parseObjectMetadata(value); err == nil {
+			t.Errorf("parseObjectMetadata(%q) expected error", value)
+		}
+	}
+}
+
+func TestPartnerID(t *testing.T) {
+	tests := []struct {
+		pattern string
+		user    string
+		want    string
+	}{
+		{"", "acme-eu", "acme-eu"},
+		{"^([a-z]+)-", "acme-eu", "acme"},
+		{"^[a-z]+", "acme-eu", "acme"},
+		{"^([a-z]+)-", "globex", "globex"},
+	}
+	for _, tt := range tests {
+		var pattern *regexp.Regexp
+		if tt.pattern != "" {
+			pattern = regexp.MustCompile(tt.pattern)
+		}
+		if got := partnerID(pattern, tt.user); got != tt.want {
+			t.Errorf("partnerID(%q, %q) = %q, want %q", tt.pattern, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestS3Uploader_objectMetadata_Custom(t *testing.T) {
+	entries, err := parseObjectMetadata("environment=production,partner={partner},region={country}")
+	if err != nil {
+		t.Fatalf("parseObjectMetadata() unexpected error: %v", err)
+	}
+	uploader := &S3Uploader{
+		timeFunc:  func() time.Time { return time.Date(2023, 12, 25, 10, 30, 0, 0, time.UTC) },
+		metadata:  entries,
+		partnerID: regexp.MustCompile(`^([a-z]+)-`),
+	}
+
+	metadata := uploader.objectMetadata(uploadSession{user: "acme-eu", clientIP: "192.0.2.1", sessionID: "abc"}, "/uploads/a.csv")
+	want := map[string]string{
+		"client-ip":     "192.0.2.1",
+		"session-id":    "abc",
+		"access-key-id": "",
+		"upload-time":   "2023-12-25T10:30:00Z",
+		"original-path": "/uploads/a.csv",
+		"environment":   "production",
+		"partner":       "acme",
+	}
+	if !maps.Equal(metadata, want) {
+		t.Errorf("objectMetadata() = %v, want %v", metadata, want)
+	}
+}
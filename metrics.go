@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram buckets: file sizes from 1KB to 10GB, durations from 100ms to
+// 30 minutes.
+var (
+	fileSizeBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30}
+	durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 600, 1800}
+)
+
+// metricLabels identifies a series. outcome is empty for series without it.
+type metricLabels struct {
+	bucket  string
+	prefix  string
+	port    int    // the listener the client connected to, see SFTP_PORT
+	outcome string // "success" or "failure"
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one counts +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets)+1)
+	}
+	i, _ := slices.BinarySearch(buckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics counts connections and stored files and records their sizes and
+// timings, labeled by listener port, bucket and key prefix, for the /metrics
+// endpoint of the admin listener.
+// The Prometheus text format is simple enough to write here instead of
+// pulling in the client library. A nil metrics records nothing.
+type metrics struct {
+	mu          sync.Mutex
+	connections map[int]uint64 // by port
+	uploads     map[metricLabels]uint64
+	fileSize    map[metricLabels]*histogram
+	buffering   map[metricLabels]*histogram
+	s3Put       map[metricLabels]*histogram
+
+	// buffers reports the memory held by open files when scraped; set by
+	// the server.
+	buffers func() bufferUsage
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		connections: make(map[int]uint64),
+		uploads:     make(map[metricLabels]uint64),
+		fileSize:    make(map[metricLabels]*histogram),
+		buffering:   make(map[metricLabels]*histogram),
+		s3Put:       make(map[metricLabels]*histogram),
+	}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeConnection counts an SSH connection that completed the handshake
+// on the listener at port.
+func (m *metrics) observeConnection(port int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections[port]++
+}
+
+// observeUpload records a file the gateway tried to store: its size, how
+// long it took the client to send it, and whether storing it succeeded.
+func (m *metrics) observeUpload(bucket, prefix string, port int, size int64, buffering time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	labels := metricLabels{bucket: bucket, prefix: prefix, port: port}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[metricLabels{bucket: bucket, prefix: prefix, port: port, outcome: outcome(err)}]++
+	observe(m.fileSize, labels, fileSizeBuckets, float64(size))
+	observe(m.buffering, labels, durationBuckets, buffering.Seconds())
+}
+
+// observeS3Put records the latency of storing a file in S3 with PutObject,
+// including retries.
+func (m *metrics) observeS3Put(bucket, prefix string, port int, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.s3Put, metricLabels{bucket: bucket, prefix: prefix, port: port, outcome: outcome(err)}, durationBuckets, latency.Seconds())
+}
+
+func observe(series map[metricLabels]*histogram, labels metricLabels, buckets []float64, v float64) {
+	h, ok := series[labels]
+	if !ok {
+		h = &histogram{}
+		series[labels] = h
+	}
+	h.observe(buckets, v)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP sftpgw_connections_total SSH connections that completed the handshake, by listener port.")
+	fmt.Fprintln(w, "# TYPE sftpgw_connections_total counter")
+	ports := slices.Sorted(maps.Keys(m.connections))
+	for _, port := range ports {
+		fmt.Fprintf(w, "sftpgw_connections_total{port=\"%d\"} %d\n", port, m.connections[port])
+	}
+
+	fmt.Fprintln(w, "# HELP sftpgw_uploads_total Files the gateway tried to store in S3, by outcome.")
+	fmt.Fprintln(w, "# TYPE sftpgw_uploads_total counter")
+	for _, labels := range sortedLabels(m.uploads) {
+		fmt.Fprintf(w, "sftpgw_uploads_total{%s} %d\n", labels, m.uploads[labels])
+	}
+	writeHistogram(w, "sftpgw_upload_file_size_bytes", "Size of the files the gateway tried to store.", m.fileSize, fileSizeBuckets)
+	writeHistogram(w, "sftpgw_upload_buffering_duration_seconds", "Time from the first write of a file until the client closed it.", m.buffering, durationBuckets)
+	writeHistogram(w, "sftpgw_s3_put_duration_seconds", "Latency of storing a file with PutObject, including retries.", m.s3Put, durationBuckets)
+
+	if m.buffers != nil {
+		usage := m.buffers()
+		fmt.Fprintln(w, "# HELP sftpgw_upload_buffered_bytes Memory held by the files being received or stored.")
+		fmt.Fprintln(w, "# TYPE sftpgw_upload_buffered_bytes gauge")
+		fmt.Fprintf(w, "sftpgw_upload_buffered_bytes %d\n", usage.BufferedBytes)
+		fmt.Fprintln(w, "# HELP sftpgw_upload_largest_buffer_bytes Memory held by the largest file being received or stored.")
+		fmt.Fprintln(w, "# TYPE sftpgw_upload_largest_buffer_bytes gauge")
+		fmt.Fprintf(w, "sftpgw_upload_largest_buffer_bytes %d\n", usage.LargestBufferBytes)
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, series map[metricLabels]*histogram, buckets []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, labels := range sortedLabels(series) {
+		h := series[labels]
+		var cumulative uint64
+		for i, le := range buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (l metricLabels) String() string {
+	s := `bucket="` + labelEscaper.Replace(l.bucket) + `",prefix="` + labelEscaper.Replace(l.prefix) + `"`
+	if l.port != 0 {
+		s += `,port="` + strconv.Itoa(l.port) + `"`
+	}
+	if l.outcome != "" {
+		s += `,outcome="` + l.outcome + `"`
+	}
+	return s
+}
+
+// sortedLabels returns the series of a metric in a stable order.
+func sortedLabels[V any](series map[metricLabels]V) []metricLabels {
+	labels := make([]metricLabels, 0, len(series))
+	for l := range series {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, func(a, b metricLabels) int {
+		return cmp.Or(cmp.Compare(a.bucket, b.bucket), cmp.Compare(a.prefix, b.prefix), cmp.Compare(a.port, b.port), cmp.Compare(a.outcome, b.outcome))
+	})
+	return labels
+}
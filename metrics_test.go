@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := newMetrics()
+	m.observeUpload("bucket-a", "partner/acme", 0, 2048, 3*time.Second, nil)
+	m.observeUpload("bucket-a", "partner/acme", 0, 20<<20, 40*time.Second, nil)
+	m.observeUpload("bucket-a", "partner/acme", 0, 512, time.Second, errors.New("access denied"))
+	m.observeS3Put("bucket-a", "partner/acme", 0, 200*time.Millisecond, nil)
+
+	var out strings.Builder
+	m.writeTo(&out)
+	got := out.String()
+
+	for _, want := range []string{
+		"# TYPE sftpgw_uploads_total counter\n",
+		`sftpgw_uploads_total{bucket="bucket-a",prefix="partner/acme",outcome="failure"} 1` + "\n",
+		`sftpgw_uploads_total{bucket="bucket-a",prefix="partner/acme",outcome="success"} 2` + "\n",
+		"# TYPE sftpgw_upload_file_size_bytes histogram\n",
+		`sftpgw_upload_file_size_bytes_bucket{bucket="bucket-a",prefix="partner/acme",le="1024"} 1` + "\n",
+		`sftpgw_upload_file_size_bytes_bucket{bucket="bucket-a",prefix="partner/acme",le="10240"} 2` + "\n",
+		`sftpgw_upload_file_size_bytes_bucket{bucket="bucket-a",prefix="partner/acme",le="+Inf"} 3` + "\n",
+		`sftpgw_upload_file_size_bytes_sum{bucket="bucket-a",prefix="partner/acme"} 2.097408e+07` + "\n",
+		`sftpgw_upload_buffering_duration_seconds_bucket{bucket="bucket-a",prefix="partner/acme",le="30"} 2` + "\n",
+		`sftpgw_upload_buffering_duration_seconds_count{bucket="bucket-a",prefix="partner/acme"} 3` + "\n",
+		`sftpgw_s3_put_duration_seconds_bucket{bucket="bucket-a",prefix="partner/acme",outcome="success",le="0.1"} 0` + "\n",
+		`sftpgw_s3_put_duration_seconds_bucket{bucket="bucket-a",prefix="partner/acme",outcome="success",le="0.25"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetrics_Ports(t *testing.T) {
+	m := newMetrics()
+	m.observeConnection(2222)
+	m.observeConnection(22)
+	m.observeConnection(2222)
+	m.observeUpload("bucket-a", "", 22, 2048, time.Second, nil)
+	m.observeS3Put("bucket-a", "", 22, 200*time.Millisecond, nil)
+
+	var out strings.Builder
+	m.writeTo(&out)
+	for _, want := range []string{
+		"# TYPE sftpgw_connections_total counter\n" +
+			`sftpgw_connections_total{port="22"} 1` + "\n" +
+			`sftpgw_connections_total{port="2222"} 2` + "\n",
+		`sftpgw_uploads_total{bucket="bucket-a",prefix="",port="22",outcome="success"} 1` + "\n",
+		`sftpgw_upload_file_size_bytes_count{bucket="bucket-a",prefix="",port="22"} 1` + "\n",
+		`sftpgw_s3_put_duration_seconds_count{bucket="bucket-a",prefix="",port="22",outcome="success"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetrics_BufferedBytes(t *testing.T) {
+	m := newMetrics()
+	m.buffers = func() bufferUsage { return bufferUsage{BufferedBytes: 5120, LargestBufferBytes: 4096} }
+
+	var out strings.Builder
+	m.writeTo(&out)
+	for _, want := range []string{
+		"# TYPE sftpgw_upload_buffered_bytes gauge\nsftpgw_upload_buffered_bytes 5120\n",
+		"# TYPE sftpgw_upload_largest_buffer_bytes gauge\nsftpgw_upload_largest_buffer_bytes 4096\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestFileWriter_WriteAt_TracksBufferedBytes(t *testing.T) {
+	handler := NewSFTPHandler(&Config{MaxFileSize: 1024}, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	upload := &FileUpload{path: "/uploads/a.csv", data: make([]byte, 0, 16)}
+	handler.activeUploads.Store(upload.path, upload)
+	writer := &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+
+	writer.WriteAt(make([]byte, 100), 0)
+	if got := upload.buffered.Load(); got != int64(cap(upload.data)) || got < 100 {
+		t.Errorf("buffered = %d, want the capacity of the buffer (%d)", got, cap(upload.data))
+	}
+
+	s := &SFTPServer{handler: handler}
+	if usage := s.bufferUsage(); usage.BufferedBytes != upload.buffered.Load() || usage.LargestBufferPath != "/uploads/a.csv" {
+		t.Errorf("bufferUsage() = %+v, want the buffer of /uploads/a.csv", usage)
+	}
+}
+
+func TestMetrics_EscapesLabels(t *testing.T) {
+	labels := metricLabels{bucket: "b", prefix: `a"b\c`}
+	if got, want := labels.String(), `bucket="b",prefix="a\"b\\c"`; got != want {
+		t.Errorf("labels = %s, want %s", got, want)
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *metrics
+	m.observeConnection(2222)
+	m.observeUpload("bucket", "", 2222, 1, time.Second, nil)
+	m.observeS3Put("bucket", "", 2222, time.Second, nil)
+}
+
+func TestFileWriter_Close_RecordsMetrics(t *testing.T) {
+	config := &Config{MaxFileSize: 1024, StreamUploads: true, MultipartPartSize: 1024}
+	client := &fakeS3Client{}
+	stream := newTestStream(client, config.MultipartPartSize)
+	stream.uploader.bucketPrefix = "incoming"
+
+	handler := NewSFTPHandler(config, stream.uploader, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	handler.metrics = newMetrics()
+	upload := &FileUpload{path: "/uploads/a.csv", prefix: "alice", port: 2222, stream: stream}
+	writer := &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+
+	writer.WriteAt([]byte("abc"), 0)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	server := httptest.NewServer(handler.metrics)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading /metrics failed: %v", err)
+	}
+
+	for _, want := range []string{
+		`sftpgw_uploads_total{bucket="test-bucket",prefix="incoming/alice",port="2222",outcome="success"} 1`,
+		`sftpgw_upload_file_size_bytes_sum{bucket="test-bucket",prefix="incoming/alice",port="2222"} 3`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// totpPeriod and totpDigits are the RFC 6238 defaults used by authenticator
+// apps.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+)
+
+// TOTPVerifier adds a second authentication step: after the first method
+// succeeds, users with a TOTP secret are asked for a verification code with
+// keyboard-interactive authentication.
+type TOTPVerifier struct {
+	secrets  map[string][]byte // by the "user" permission extension
+	required bool              // reject users without a secret
+	timeFunc func() time.Time
+	logger   *slog.Logger
+
+	// lastStep remembers the time step of the last accepted code per user,
+	// so a code can't be used twice.
+	mu       sync.Mutex
+	lastStep map[string]int64
+}
+
+func NewTOTPVerifier(secrets map[string][]byte, required bool, logger *slog.Logger) *TOTPVerifier {
+	return &TOTPVerifier{
+		secrets:  secrets,
+		required: required,
+		timeFunc: time.Now,
+		logger:   logger,
+		lastStep: make(map[string]int64),
+	}
+}
+
+// wrapMFA requires a verification code after next succeeds.
+func wrapMFA[T any](v *TOTPVerifier, next func(ssh.ConnMetadata, T) (*ssh.Permissions, error)) func(ssh.ConnMetadata, T) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, credential T) (*ssh.Permissions, error) {
+		perms, err := next(conn, credential)
+		if err != nil {
+			return nil, err
+		}
+		return v.challenge(conn, perms)
+	}
+}
+
+func (v *TOTPVerifier) challenge(conn ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	user := perms.Extensions["user"]
+	logCtx := slog.Group("auth",
+		"remote_ip", getClientIP(conn.RemoteAddr()),
+		"session_id", getSessionID(conn),
+		"user", user,
+		"method", "totp",
+	)
+
+	secret, ok := v.secrets[user]
+	if !ok {
+		if v.required {
+			v.logger.Warn("authentication failed: no TOTP secret for user", logCtx)
+			return nil, fmt.Errorf("second factor required")
+		}
+		return perms, nil
+	}
+
+	// perms goes along with the partial success so the SSH server still
+	// checks the source-address of a certificate
+	return perms, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client(conn.User(), "", []string{"Verification code: "}, []bool{true})
+				if err != nil {
+					return nil, err
+				}
+				if len(answers) != 1 || !v.verify(user, secret, strings.TrimSpace(answers[0])) {
+					v.logger.Warn("authentication failed: wrong verification code", logCtx)
+					return nil, fmt.Errorf("invalid verification code")
+				}
+
+				v.logger.Info("second factor accepted", logCtx)
+				return perms, nil
+			},
+		},
+	}
+}
+
+// verify checks code against the current time step and one step on either
+// side, to allow for clock drift.
+func (v *TOTPVerifier) verify(user string, secret []byte, code string) bool {
+	step := v.timeFunc().Unix() / int64(totpPeriod/time.Second)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, candidate := range []int64{step - 1, step, step + 1} {
+		if candidate <= v.lastStep[user] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, candidate)), []byte(code)) == 1 {
+			v.lastStep[user] = candidate
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// loadTOTPSecrets reads a file of user:SECRET lines, where SECRET is the
+// base32 secret shared with the user's authenticator app. Blank lines and
+// lines starting with # are ignored.
+func loadTOTPSecrets(filePath string) (map[string][]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, encoded, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s line %d: expected user:secret", filePath, lineNumber)
+		}
+
+		encoded = strings.TrimRight(strings.ToUpper(strings.ReplaceAll(encoded, " ", "")), "=")
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("%s line %d: invalid base32 secret for %q", filePath, lineNumber, user)
+		}
+		secrets[user] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// SHA-1 test vectors from RFC 6238 appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/30); got != tt.want {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func newTestTOTPVerifier(required bool, now time.Time) *TOTPVerifier {
+	v := NewTOTPVerifier(map[string][]byte{"alice": []byte("12345678901234567890")}, required, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	v.timeFunc = func() time.Time { return now }
+	return v
+}
+
+func TestTOTPVerifier_Verify(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	v := newTestTOTPVerifier(false, now)
+	secret := v.secrets["alice"]
+
+	if v.verify("alice", secret, "000000") {
+		t.Error("verify() accepted a wrong code")
+	}
+	if !v.verify("alice", secret, totpCode(secret, now.Unix()/30-1)) {
+		t.Error("verify() rejected the code of the previous time step")
+	}
+	if !v.verify("alice", secret, "005924") {
+		t.Error("verify() rejected the current code")
+	}
+	if v.verify("alice", secret, "005924") {
+		t.Error("verify() accepted a code twice")
+	}
+}
+
+func TestTOTPVerifier_Challenge(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	perms := func(user string) *ssh.Permissions {
+		return &ssh.Permissions{Extensions: map[string]string{"user": user}}
+	}
+	answer := func(code string) ssh.KeyboardInteractiveChallenge {
+		return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{code}, nil
+		}
+	}
+
+	v := newTestTOTPVerifier(false, now)
+	if got, err := v.challenge(testConnMetadata{user: "bob"}, perms("bob")); err != nil || got == nil {
+		t.Errorf("challenge() for user without secret = %v, %v, want permissions", got, err)
+	}
+
+	challenged, err := v.challenge(testConnMetadata{user: "alice"}, perms("alice"))
+	var partial *ssh.PartialSuccessError
+	if !errors.As(err, &partial) {
+		t.Fatalf("challenge() error = %v, want PartialSuccessError", err)
+	}
+	if challenged == nil {
+		t.Error("challenge() dropped the permissions, the SSH server checks their source-address")
+	}
+	next := partial.Next.KeyboardInteractiveCallback
+	if _, err := next(testConnMetadata{user: "alice"}, answer("000000")); err == nil {
+		t.Error("keyboard-interactive step accepted a wrong code")
+	}
+	if got, err := next(testConnMetadata{user: "alice"}, answer("005924")); err != nil || got.Extensions["user"] != "alice" {
+		t.Errorf("keyboard-interactive step = %v, %v, want alice's permissions", got, err)
+	}
+
+	required := newTestTOTPVerifier(true, now)
+	if _, err := required.challenge(testConnMetadata{user: "bob"}, perms("bob")); err == nil {
+		t.Error("challenge() expected error for user without secret when MFA is required")
+	}
+}
+
+func TestLoadTOTPSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "totp")
+	os.WriteFile(path, []byte("# users\nalice:GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\nbob:gezd gnbv gy3t qojq\n"), 0600)
+
+	secrets, err := loadTOTPSecrets(path)
+	if err != nil {
+		t.Fatalf("loadTOTPSecrets() unexpected error: %v", err)
+	}
+	if string(secrets["alice"]) != "12345678901234567890" {
+		t.Errorf("alice's secret = %q, want %q", secrets["alice"], "12345678901234567890")
+	}
+	if string(secrets["bob"]) != "1234567890" {
+		t.Errorf("bob's secret = %q, want %q", secrets["bob"], "1234567890")
+	}
+
+	os.WriteFile(path, []byte("alice:not-base32!\n"), 0600)
+	if _, err := loadTOTPSecrets(path); err == nil {
+		t.Error("loadTOTPSecrets() expected error for invalid secret")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// objectStore is the part of S3Uploader the SFTP handler stores files with,
+// so tests can run the handler against a fake instead of S3, and so other
+// backends can take its place.
+type objectStore interface {
+	// UploadFile stores a whole file and returns the bucket and key it is
+	// stored under, also when storing it failed.
+	UploadFile(ctx context.Context, session uploadSession, filePath string, body io.ReaderAt, size int64) (bucket, key string, err error)
+
+	// StartStream prepares an upload that receives the file as it is
+	// written, for STREAM_UPLOADS.
+	StartStream(ctx context.Context, session uploadSession, filePath string) (uploadStream, error)
+
+	// Exists reports whether key is already stored for session, see
+	// S3_KEY_COLLISION.
+	Exists(ctx context.Context, session uploadSession, key string) (bool, error)
+
+	// bucketFor and keyPrefix name where the files of session are stored,
+	// for logs, events and metrics.
+	bucketFor(session uploadSession) string
+	keyPrefix(session uploadSession) string
+}
+
+// uploadStream receives a file from StartStream while the client writes it.
+type uploadStream interface {
+	// Write appends p to the file. Writes are sequential.
+	Write(p []byte) (int, error)
+
+	// Complete stores the file once all of it has been written.
+	Complete() error
+
+	// Abort discards what has been sent so far.
+	Abort()
+
+	// location returns the bucket and key of the file, which may change
+	// until Complete returns, and memory the bytes it holds in memory.
+	location() (bucket, key string)
+	memory() int64
+}
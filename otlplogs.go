@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxPendingLogRecords = 10000 // records beyond this are dropped until the next export
+
+// OTLP severity numbers of the slog levels, see opentelemetry-proto's
+// logs.proto.
+var otlpSeverities = map[slog.Level]int{
+	slog.LevelDebug: 5,
+	slog.LevelInfo:  9,
+	slog.LevelWarn:  13,
+	slog.LevelError: 17,
+}
+
+// otlpLogs sends the gateway's log entries to the OpenTelemetry collector
+// at OTEL_EXPORTER_OTLP_ENDPOINT with OTLP over HTTP, next to the traces,
+// when OTEL_LOGS_EXPORTER=otlp. Entries are exported every
+// traceExportInterval, with their attributes as OTLP attributes rather than
+// as JSON text. Problems are reported on stderr, since logging them would
+// export them again.
+type otlpLogs struct {
+	endpoint string // OTLP logs URL
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []otlpLogRecord
+	dropped int
+
+	stop context.CancelFunc
+	done chan struct{} // closed when run returns
+}
+
+// OTLP/JSON log record, see opentelemetry-proto's logs.proto.
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           map[string]any `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+	TraceID        string         `json:"traceId,omitempty"`
+	SpanID         string         `json:"spanId,omitempty"`
+}
+
+func newOTLPLogs(config *Config) *otlpLogs {
+	return &otlpLogs{
+		endpoint: strings.TrimSuffix(config.OTLPEndpoint, "/") + "/v1/logs",
+		service:  config.OTelServiceName,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		done:     make(chan struct{}),
+	}
+}
+
+// start exports log entries until close is called.
+func (o *otlpLogs) start() {
+	ctx, stop := context.WithCancel(context.Background())
+	o.stop = stop
+	go o.run(ctx)
+}
+
+// close exports the remaining entries and stops run.
+func (o *otlpLogs) close() {
+	o.stop()
+	<-o.done
+}
+
+func (o *otlpLogs) queue(record otlpLogRecord) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) >= maxPendingLogRecords {
+		o.dropped++
+		return
+	}
+	o.pending = append(o.pending, record)
+}
+
+// run exports the queued entries every traceExportInterval until ctx is
+// done, then exports what is left.
+func (o *otlpLogs) run(ctx context.Context) {
+	defer close(o.done)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.flush()
+			return
+		case <-ticker.C:
+			o.flush()
+		}
+	}
+}
+
+func (o *otlpLogs) flush() {
+	o.mu.Lock()
+	records, dropped := o.pending, o.dropped
+	o.pending, o.dropped = nil, 0
+	o.mu.Unlock()
+
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "dropped %d log entries for OTLP: buffer full\n", dropped)
+	}
+	if len(records) == 0 {
+		return
+	}
+	if err := o.export(records); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to export %d log entries to %s: %v\n", len(records), o.endpoint, err)
+	}
+}
+
+func (o *otlpLogs) export(records []otlpLogRecord) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]slog.Attr{
+					slog.String("service.name", o.service),
+					slog.String("service.version", version),
+				}),
+			},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "sftpgw"},
+				"logRecords": records,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpLogHandler queues log entries for export before passing them on.
+// Attributes in groups are named after their group, such as
+// s3_upload.file_path.
+type otlpLogHandler struct {
+	slog.Handler
+	logs  *otlpLogs
+	attrs []slog.Attr // from WithAttrs, with their full names
+	group string      // prefix of the attributes added later
+}
+
+func newOTLPLogHandler(next slog.Handler, logs *otlpLogs) slog.Handler {
+	return &otlpLogHandler{Handler: next, logs: logs}
+}
+
+func (h *otlpLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = appendOTLPAttr(attrs, h.group, a)
+		return true
+	})
+
+	severity, ok := otlpSeverities[record.Level]
+	if !ok {
+		severity = otlpSeverities[slog.LevelInfo]
+	}
+	entry := otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(record.Time.UnixNano(), 10),
+		SeverityNumber: severity,
+		SeverityText:   record.Level.String(),
+		Body:           map[string]any{"stringValue": record.Message},
+		Attributes:     otlpAttributes(attrs),
+	}
+	if s := spanFromContext(ctx); s != nil {
+		entry.TraceID = hex.EncodeToString(s.traceID[:])
+		entry.SpanID = hex.EncodeToString(s.spanID[:])
+	}
+	h.logs.queue(entry)
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *otlpLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		all = appendOTLPAttr(all, h.group, a)
+	}
+	return &otlpLogHandler{Handler: h.Handler.WithAttrs(attrs), logs: h.logs, attrs: all, group: h.group}
+}
+
+func (h *otlpLogHandler) WithGroup(name string) slog.Handler {
+	return &otlpLogHandler{Handler: h.Handler.WithGroup(name), logs: h.logs, attrs: h.attrs, group: h.group + name + "."}
+}
+
+// appendOTLPAttr appends a, or the members of a group, under their full
+// name.
+func appendOTLPAttr(attrs []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			attrs = appendOTLPAttr(attrs, prefix+a.Key+".", member)
+		}
+		return attrs
+	}
+	return append(attrs, slog.Attr{Key: prefix + a.Key, Value: value})
+}
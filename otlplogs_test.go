@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPLogHandler(t *testing.T) {
+	var received struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpKeyValue
+			}
+			ScopeLogs []struct {
+				LogRecords []otlpLogRecord
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" {
+			t.Errorf("request to %s, want /v1/logs", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("invalid OTLP request: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	logs := newOTLPLogs(&Config{OTLPEndpoint: server.URL + "/", OTelServiceName: "sftpgw-test"})
+	logs.start()
+	logger := slog.New(newOTLPLogHandler(slog.NewJSONHandler(io.Discard, nil), logs))
+
+	tracer := &tracer{}
+	ctx, span := tracer.start(context.Background(), "upload")
+	logger.With(slog.String("session_id", "9f86d081884c7d65")).ErrorContext(ctx, "failed to upload file to S3",
+		slog.Group("s3_upload", slog.String("file_path", "/uploads/a.csv"), slog.Int64("size", 2048)))
+	logger.Debug("not enabled")
+	logs.close()
+
+	if len(received.ResourceLogs) != 1 || len(received.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("received %+v, want one resource and scope", received)
+	}
+	if attrs := received.ResourceLogs[0].Resource.Attributes; len(attrs) == 0 || attrs[0].Value["stringValue"] != "sftpgw-test" {
+		t.Errorf("resource attributes = %+v, want service.name sftpgw-test", attrs)
+	}
+	records := received.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 1 {
+		t.Fatalf("received %d log records, want 1", len(records))
+	}
+	record := records[0]
+	if record.SeverityNumber != 17 || record.SeverityText != "ERROR" || record.Body["stringValue"] != "failed to upload file to S3" {
+		t.Errorf("record = %+v", record)
+	}
+	if record.TraceID == "" || record.SpanID != span.traceParent()[36:52] {
+		t.Errorf("record trace %s/%s, want the span of the context", record.TraceID, record.SpanID)
+	}
+	attrs := make(map[string]map[string]any)
+	for _, attr := range record.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs["session_id"]["stringValue"] != "9f86d081884c7d65" || attrs["s3_upload.file_path"]["stringValue"] != "/uploads/a.csv" || attrs["s3_upload.size"]["intValue"] != "2048" {
+		t.Errorf("attributes = %v", attrs)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const parameterScheme = "ssm://"
+
+// configParameters keeps configuration values in SSM Parameter Store:
+// environment variables set to ssm://<parameter name>, and with
+// CONFIG_PARAMETER_PATH every parameter directly below that path named after
+// a setting, such as /sftpgw/prod/MAX_FILE_SIZE. Variables set directly take
+// precedence over the path. The values are resolved into the environment
+// before LoadConfig reads it.
+type configParameters struct {
+	path    string            // CONFIG_PARAMETER_PATH
+	refs    map[string]string // environment variable to parameter name
+	direct  map[string]bool   // environment variables set without ssm://
+	client  *awsJSONClient
+	applied map[string]string // values resolved into the environment
+}
+
+// newConfigParameters returns nil if no setting is kept in Parameter Store.
+func newConfigParameters() *configParameters {
+	p := &configParameters{
+		path:   getenv("CONFIG_PARAMETER_PATH"),
+		refs:   make(map[string]string),
+		direct: make(map[string]bool),
+	}
+	for _, name := range configEnvVars {
+		if value := getenv(name); strings.HasPrefix(value, parameterScheme) {
+			p.refs[name] = strings.TrimPrefix(value, parameterScheme)
+		} else if value != "" {
+			p.direct[name] = true
+		}
+	}
+	if p.path == "" && len(p.refs) == 0 {
+		return nil
+	}
+	return p
+}
+
+// loadConfigParameters resolves the settings kept in Parameter Store into the
+// environment, with the gateway's own credentials. It returns nil if there
+// are none.
+func loadConfigParameters(ctx context.Context) (*configParameters, error) {
+	p := newConfigParameters()
+	if p == nil {
+		return nil, nil
+	}
+
+	cfg := &Config{S3Region: getenv("AWS_REGION")}
+	awsConfig, err := loadGatewayAWSConfig(ctx, cfg, newAWSHTTPClient(cfg, false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config for Parameter Store: %w", err)
+	}
+	p.client = newAWSJSONClient(awsConfig, "ssm", "AmazonSSM", "1.1")
+
+	values, err := p.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.apply(values)
+	return p, nil
+}
+
+// resolve reads the current values of the parameters, by environment
+// variable.
+func (p *configParameters) resolve(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	values := make(map[string]string)
+	var errs []error
+
+	if p.path != "" {
+		byPath, err := p.getParametersByPath(ctx)
+		if err != nil {
+			errs = append(errs, invalidSetting("CONFIG_PARAMETER_PATH", "failed to read parameters below %s: %w", p.path, err))
+		}
+		for name, value := range byPath {
+			// parameters named after no setting, such as a host key, are left alone
+			if slices.Contains(configEnvVars, name) && !p.direct[name] && p.refs[name] == "" {
+				values[name] = value
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(p.refs)) {
+		parameter := p.refs[name]
+		value, err := p.getParameter(ctx, parameter)
+		if isAWSErrorCode(err, "ParameterNotFound") {
+			errs = append(errs, invalidSetting(name, "parameter %s not found", parameter))
+		} else if err != nil {
+			errs = append(errs, invalidSetting(name, "failed to read parameter %s: %w", parameter, err))
+		} else {
+			values[name] = value
+		}
+	}
+
+	return values, errors.Join(errs...)
+}
+
+func (p *configParameters) getParameter(ctx context.Context, name string) (string, error) {
+	var result struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	err := p.client.call(ctx, "GetParameter", map[string]any{"Name": name, "WithDecryption": true}, &result)
+	return result.Parameter.Value, err
+}
+
+// getParametersByPath returns the parameters directly below the path, by
+// the last segment of their name.
+func (p *configParameters) getParametersByPath(ctx context.Context) (map[string]string, error) {
+	parameters := make(map[string]string)
+	input := map[string]any{"Path": p.path, "Recursive": false, "WithDecryption": true}
+	for {
+		var result struct {
+			Parameters []struct {
+				Name  string `json:"Name"`
+				Value string `json:"Value"`
+			} `json:"Parameters"`
+			NextToken string `json:"NextToken"`
+		}
+		if err := p.client.call(ctx, "GetParametersByPath", input, &result); err != nil {
+			return nil, err
+		}
+		for _, parameter := range result.Parameters {
+			parameters[path.Base(parameter.Name)] = parameter.Value
+		}
+		if result.NextToken == "" {
+			return parameters, nil
+		}
+		input["NextToken"] = result.NextToken
+	}
+}
+
+// apply sets the environment variables to values, and clears the ones no
+// longer found below the path. A namespaced variable that held the ssm://
+// reference gets the value too, as it takes precedence.
+func (p *configParameters) apply(values map[string]string) {
+	for name := range p.applied {
+		if _, ok := values[name]; !ok {
+			os.Unsetenv(name)
+			os.Unsetenv(namespacedEnv(name))
+		}
+	}
+	for name, value := range values {
+		os.Setenv(name, value)
+		if os.Getenv(namespacedEnv(name)) != "" {
+			os.Setenv(namespacedEnv(name), value)
+		}
+	}
+	p.applied = values
+}
+
+// run resolves the parameters every interval until ctx is done. Most
+// settings are only read at startup, so when a value changed restart is
+// called to shut the gateway down gracefully; its supervisor then starts it
+// with the new values.
+func (p *configParameters) run(ctx context.Context, interval time.Duration, logger *slog.Logger, restart func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := p.refresh(ctx)
+			if err != nil {
+				logger.Error("failed to refresh configuration parameters", slog.String("error", err.Error()))
+				continue
+			}
+			if len(changed) > 0 {
+				logger.Info("configuration parameters changed, shutting down to apply them",
+					slog.String("settings", strings.Join(changed, ",")),
+				)
+				restart()
+				return
+			}
+		}
+	}
+}
+
+// refresh resolves the parameters again and returns the settings that
+// changed. Changes that make the configuration invalid are not applied.
+func (p *configParameters) refresh(ctx context.Context) ([]string, error) {
+	values, err := p.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for name, value := range values {
+		if previous, ok := p.applied[name]; !ok || previous != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range p.applied {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	slices.Sort(changed)
+
+	previous := p.applied
+	p.apply(values)
+	if _, err := LoadConfig(); err != nil {
+		p.apply(previous)
+		return nil, fmt.Errorf("new values of %s are invalid: %w", strings.Join(changed, ", "), err)
+	}
+	return changed, nil
+}
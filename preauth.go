@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// preAuthConns tracks the connections that haven't finished logging in.
+// When MAX_PREAUTH_CONNECTIONS of them are open, the one that has been
+// logging in the longest is dropped to make room, so clients that open
+// connections and then stall can't lock out everyone else.
+type preAuthConns struct {
+	max int
+
+	mu      sync.Mutex
+	conns   map[net.Conn]time.Time // start of the login
+	dropped map[net.Conn]bool
+}
+
+func newPreAuthConns(max int) *preAuthConns {
+	return &preAuthConns{
+		max:     max,
+		conns:   make(map[net.Conn]time.Time),
+		dropped: make(map[net.Conn]bool),
+	}
+}
+
+// add starts tracking conn, and closes the oldest connection if there are
+// too many.
+func (p *preAuthConns) add(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.conns) >= p.max {
+		var oldest net.Conn
+		var started time.Time
+		for c, t := range p.conns {
+			if oldest == nil || t.Before(started) {
+				oldest, started = c, t
+			}
+		}
+		delete(p.conns, oldest)
+		p.dropped[oldest] = true
+		oldest.Close()
+	}
+
+	p.conns[conn] = time.Now()
+}
+
+// done stops tracking conn once the login finished or failed. It reports
+// whether conn was dropped to make room for another connection.
+func (p *preAuthConns) done(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dropped := p.dropped[conn]
+	delete(p.conns, conn)
+	delete(p.dropped, conn)
+	return dropped
+}
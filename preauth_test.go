@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPreAuthConns_DropsOldest(t *testing.T) {
+	p := newPreAuthConns(2)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		server, client := net.Pipe()
+		defer client.Close()
+		conns = append(conns, server)
+		p.add(server)
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := conns[0].Read(make([]byte, 1)); err == nil {
+		t.Error("oldest connection still open, want it closed")
+	}
+	if !p.done(conns[0]) {
+		t.Error("done() = false for the dropped connection, want true")
+	}
+	for _, conn := range conns[1:] {
+		if p.done(conn) {
+			t.Error("done() = true for a connection that wasn't dropped")
+		}
+		conn.Close()
+	}
+}
+
+func TestPreAuthConns_FinishedLoginsFreeRoom(t *testing.T) {
+	p := newPreAuthConns(1)
+
+	first, client := net.Pipe()
+	defer client.Close()
+	defer first.Close()
+	p.add(first)
+	p.done(first)
+
+	second, client2 := net.Pipe()
+	defer client2.Close()
+	defer second.Close()
+	p.add(second)
+
+	first.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	go client.Write([]byte{1})
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Errorf("finished connection was closed: %v", err)
+	}
+	if p.done(second) {
+		t.Error("done() = true, want the second connection kept")
+	}
+}
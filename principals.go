@@ -0,0 +1,37 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// principalAllowlist restricts logins to IAM principals whose ARN, as
+// returned by GetCallerIdentity, matches one of a set of patterns. A * in
+// a pattern matches any run of characters, including / and :. A nil
+// allowlist allows every principal.
+type principalAllowlist []*regexp.Regexp
+
+func newPrincipalAllowlist(patterns []string) principalAllowlist {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	allowlist := make(principalAllowlist, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+		allowlist = append(allowlist, regexp.MustCompile("^"+expr+"$"))
+	}
+	return allowlist
+}
+
+func (l principalAllowlist) allows(arn string) bool {
+	if l == nil {
+		return true
+	}
+	for _, pattern := range l {
+		if pattern.MatchString(arn) {
+			return true
+		}
+	}
+	return false
+}
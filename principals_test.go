@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestPrincipalAllowlist(t *testing.T) {
+	allowlist := newPrincipalAllowlist([]string{
+		"arn:aws:iam::123456789012:user/partners/*",
+		"arn:aws:sts::123456789012:assumed-role/sftp-upload/*",
+		"arn:aws:iam::123456789012:user/ops",
+	})
+
+	tests := []struct {
+		arn  string
+		want bool
+	}{
+		{"arn:aws:iam::123456789012:user/partners/acme", true},
+		{"arn:aws:iam::123456789012:user/partners/eu/acme", true},
+		{"arn:aws:sts::123456789012:assumed-role/sftp-upload/session", true},
+		{"arn:aws:iam::123456789012:user/ops", true},
+		{"arn:aws:iam::123456789012:user/ops2", false},
+		{"arn:aws:iam::123456789012:user/admin", false},
+		{"arn:aws:sts::123456789012:assumed-role/admin/session", false},
+	}
+
+	for _, tt := range tests {
+		if got := allowlist.allows(tt.arn); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.arn, got, tt.want)
+		}
+	}
+
+	if !newPrincipalAllowlist(nil).allows("arn:aws:iam::123456789012:user/anyone") {
+		t.Error("expected an empty allowlist to allow every principal")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// writeProbeName is the file name checkWriteAccess pretends to upload.
+const writeProbeName = ".sftpgw-write-check"
+
+// writeProbeMD5 is the Content-MD5 of an empty body. The probe sends one
+// byte, so S3 rejects it with BadDigest, but only after authorizing it.
+const writeProbeMD5 = "1B2M2Y8AsgTpgAmY4PhCfw=="
+
+// checkWriteAccess tells whether session may store objects where its
+// uploads go. It sends a PutObject whose Content-MD5 doesn't match the body:
+// S3 checks permissions before the digest, so a BadDigest error means the
+// upload would have been allowed, and nothing is stored either way.
+func (u *S3Uploader) checkWriteAccess(ctx context.Context, session uploadSession) error {
+	client, err := u.newClient(ctx, session.accessKeyID, session.secretAccessKey, session.sessionToken)
+	if err != nil {
+		return fmt.Errorf("failed to configure AWS client: %w", err)
+	}
+
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(u.bucketFor(session)),
+		Key:                  aws.String(u.generateS3Key(writeProbeName, session)),
+		Body:                 strings.NewReader("x"),
+		ContentLength:        aws.Int64(1),
+		ContentMD5:           aws.String(writeProbeMD5),
+		StorageClass:         u.storageClass,
+		ServerSideEncryption: u.sse,
+		SSEKMSKeyId:          u.kmsKeyID(),
+	})
+	if err == nil || isDigestMismatch(err) {
+		return nil
+	}
+	return err
+}
+
+func isDigestMismatch(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "BadDigest" || apiErr.ErrorCode() == "InvalidDigest"
+}
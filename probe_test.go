@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsDigestMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad digest", &smithy.GenericAPIError{Code: "BadDigest"}, true},
+		{"invalid digest", &smithy.GenericAPIError{Code: "InvalidDigest"}, true},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, false},
+		{"other error", errors.New("connection reset"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDigestMismatch(tt.err); got != tt.want {
+				t.Errorf("isDigestMismatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
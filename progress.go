@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// uploadProgress tracks how fast a file is being received, so slow partner
+// uploads can be diagnosed from the logs.
+type uploadProgress struct {
+	started      time.Time
+	lastLogged   time.Time
+	declaredSize int64 // size announced by the client with setstat, 0 if unknown
+}
+
+// record notes that data arrived and reports whether a progress record is
+// due, given the configured interval.
+func (p *uploadProgress) record(now time.Time, interval time.Duration) bool {
+	if p.started.IsZero() {
+		p.started = now
+		p.lastLogged = now
+		return false
+	}
+
+	if interval <= 0 || now.Sub(p.lastLogged) < interval {
+		return false
+	}
+	p.lastLogged = now
+	return true
+}
+
+// elapsed returns how long ago the first data arrived.
+func (p *uploadProgress) elapsed(now time.Time) time.Duration {
+	if p.started.IsZero() {
+		return 0
+	}
+	return now.Sub(p.started)
+}
+
+// attrs returns the progress of a transfer that has received size bytes.
+func (p *uploadProgress) attrs(now time.Time, size int64) []any {
+	elapsed := p.elapsed(now)
+	attrs := []any{
+		slog.Int64("bytes_received", size),
+		slog.Duration("elapsed", elapsed),
+		slog.Float64("throughput_mb_s", throughputMBs(size, elapsed)),
+	}
+	if p.declaredSize > 0 {
+		attrs = append(attrs, slog.Float64("percent", math.Round(float64(size)/float64(p.declaredSize)*1000)/10))
+	}
+	return attrs
+}
+
+// throughputMBs returns the transfer rate in MB/s, rounded to two decimals.
+func throughputMBs(size int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return math.Round(float64(size)/(1024*1024)/elapsed.Seconds()*100) / 100
+}
+
+// recordDeclaredSize remembers the size a client announces for a file it is
+// uploading, which some clients do with setstat before or during the
+// transfer. It is only used to report progress.
+func (h *SFTPHandler) recordDeclaredSize(r *sftp.Request) {
+	if !r.AttrFlags().Size {
+		return
+	}
+
+	value, ok := h.activeUploads.Load(r.Filepath)
+	if !ok {
+		return
+	}
+
+	upload := value.(*FileUpload)
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	upload.progress.declaredSize = int64(r.Attributes().Size)
+}
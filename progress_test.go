@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestUploadProgress_Record(t *testing.T) {
+	start := time.Date(2023, 12, 25, 10, 0, 0, 0, time.UTC)
+	var p uploadProgress
+
+	if p.record(start, 30*time.Second) {
+		t.Error("Expected no progress record for the first write")
+	}
+	if p.record(start.Add(10*time.Second), 30*time.Second) {
+		t.Error("Expected no progress record before the interval has passed")
+	}
+	if !p.record(start.Add(30*time.Second), 30*time.Second) {
+		t.Error("Expected a progress record after the interval")
+	}
+	if p.record(start.Add(40*time.Second), 30*time.Second) {
+		t.Error("Expected the interval to restart after a progress record")
+	}
+	if p.record(start.Add(time.Hour), 0) {
+		t.Error("Expected no progress records with interval 0")
+	}
+}
+
+func TestUploadProgress_Attrs(t *testing.T) {
+	start := time.Date(2023, 12, 25, 10, 0, 0, 0, time.UTC)
+	p := uploadProgress{started: start, declaredSize: 40 * 1024 * 1024}
+
+	attrs := map[string]slog.Value{}
+	for _, a := range p.attrs(start.Add(4*time.Second), 10*1024*1024) {
+		attr := a.(slog.Attr)
+		attrs[attr.Key] = attr.Value
+	}
+
+	if got := attrs["throughput_mb_s"].Float64(); got != 2.5 {
+		t.Errorf("throughput_mb_s = %v, want 2.5", got)
+	}
+	if got := attrs["percent"].Float64(); got != 25 {
+		t.Errorf("percent = %v, want 25", got)
+	}
+	if got := attrs["bytes_received"].Int64(); got != 10*1024*1024 {
+		t.Errorf("bytes_received = %v, want %d", got, 10*1024*1024)
+	}
+
+	p.declaredSize = 0
+	for _, a := range p.attrs(start.Add(4*time.Second), 10*1024*1024) {
+		if a.(slog.Attr).Key == "percent" {
+			t.Error("Expected no percent without a declared size")
+		}
+	}
+}
+
+func TestThroughputMBs(t *testing.T) {
+	if got := throughputMBs(3*1024*1024, 2*time.Second); got != 1.5 {
+		t.Errorf("throughputMBs() = %v, want 1.5", got)
+	}
+	if got := throughputMBs(1024, 0); got != 0 {
+		t.Errorf("throughputMBs() with no elapsed time = %v, want 0", got)
+	}
+}
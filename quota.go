@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// uploadQuotas tracks how many bytes each user stored today, for the daily
+// quota of local users. Usage is kept in memory and starts over when the
+// gateway restarts.
+type uploadQuotas struct {
+	mu    sync.Mutex
+	usage map[string]quotaUsage
+}
+
+type quotaUsage struct {
+	day   string
+	bytes int64
+}
+
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// used returns the bytes user stored on the day of now.
+func (q *uploadQuotas) used(user string, now time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.usage[user]
+	if usage.day != quotaDay(now) {
+		return 0
+	}
+	return usage.bytes
+}
+
+// add records that user stored n bytes.
+func (q *uploadQuotas) add(user string, n int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.usage == nil {
+		q.usage = make(map[string]quotaUsage)
+	}
+	usage := q.usage[user]
+	if day := quotaDay(now); usage.day != day {
+		usage = quotaUsage{day: day}
+	}
+	usage.bytes += n
+	q.usage[user] = usage
+}
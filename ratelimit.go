@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxTrackedClients bounds the per-IP state of the authLimiter. Beyond it,
+// clients that are back to a full bucket and have no failures are dropped.
+const maxTrackedClients = 10000
+
+var (
+	errAuthRateLimited = errors.New("too many authentication attempts")
+	errAuthLockedOut   = errors.New("client locked out after repeated failures")
+)
+
+// authLimiter throttles authentication attempts per client IP with a token
+// bucket, and locks an IP out for a while after too many consecutive
+// failures, so credential stuffing can't hammer STS or flood the logs.
+type authLimiter struct {
+	rate             float64 // tokens added per second, no rate limit if zero
+	burst            float64
+	lockoutThreshold int // consecutive failures before a lockout, none if zero
+	lockoutDuration  time.Duration
+	timeFunc         func() time.Time
+	findings         *securityFindings // reports lockouts, nil without SECURITY_FINDINGS
+
+	mu      sync.Mutex
+	clients map[string]*clientAuthState
+}
+
+type clientAuthState struct {
+	tokens      float64
+	updated     time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+func newAuthLimiter(config *Config) *authLimiter {
+	if config.AuthRateLimit <= 0 && config.AuthLockoutThreshold <= 0 {
+		return nil
+	}
+	return &authLimiter{
+		rate:             float64(config.AuthRateLimit) / 60,
+		burst:            float64(config.AuthRateBurst),
+		lockoutThreshold: config.AuthLockoutThreshold,
+		lockoutDuration:  config.AuthLockoutDuration,
+		timeFunc:         time.Now,
+		clients:          make(map[string]*clientAuthState),
+	}
+}
+
+// allow takes a token for an attempt from ip, or returns why the attempt is
+// refused.
+func (l *authLimiter) allow(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeFunc()
+	state := l.client(ip, now)
+
+	if now.Before(state.lockedUntil) {
+		return errAuthLockedOut
+	}
+
+	if l.rate > 0 {
+		state.tokens = min(l.burst, state.tokens+now.Sub(state.updated).Seconds()*l.rate)
+		state.updated = now
+		if state.tokens < 1 {
+			return errAuthRateLimited
+		}
+		state.tokens--
+	}
+	return nil
+}
+
+// failure records a failed attempt and reports whether it locked ip out.
+func (l *authLimiter) failure(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeFunc()
+	state := l.client(ip, now)
+	state.failures++
+
+	if l.lockoutThreshold > 0 && state.failures >= l.lockoutThreshold {
+		state.failures = 0
+		state.lockedUntil = now.Add(l.lockoutDuration)
+		return true
+	}
+	return false
+}
+
+// success clears the failures of ip.
+func (l *authLimiter) success(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state, ok := l.clients[ip]; ok {
+		state.failures = 0
+	}
+}
+
+func (l *authLimiter) client(ip string, now time.Time) *clientAuthState {
+	state, ok := l.clients[ip]
+	if ok {
+		return state
+	}
+
+	if len(l.clients) >= maxTrackedClients {
+		l.prune(now)
+	}
+	state = &clientAuthState{tokens: l.burst, updated: now}
+	l.clients[ip] = state
+	return state
+}
+
+// prune forgets clients whose state is back to that of a new client.
+func (l *authLimiter) prune(now time.Time) {
+	for ip, state := range l.clients {
+		refilled := l.rate <= 0 || state.tokens+now.Sub(state.updated).Seconds()*l.rate >= l.burst
+		if refilled && state.failures == 0 && !now.Before(state.lockedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// wrapRateLimit applies the limiter to an authentication callback.
+func wrapRateLimit[T any](l *authLimiter, logger *slog.Logger, next func(ssh.ConnMetadata, T) (*ssh.Permissions, error)) func(ssh.ConnMetadata, T) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, credential T) (*ssh.Permissions, error) {
+		clientIP := getClientIP(conn.RemoteAddr())
+
+		if err := l.allow(clientIP); err != nil {
+			logger.Debug("authentication attempt refused",
+				slog.String("remote_ip", clientIP),
+				slog.String("session_id", getSessionID(conn)),
+				slog.String("reason", err.Error()),
+			)
+			return nil, err
+		}
+
+		perms, err := next(conn, credential)
+		var partial *ssh.PartialSuccessError
+		if errors.As(err, &partial) {
+			// verification codes count against the same limits
+			partial.Next = l.wrapCallbacks(logger, partial.Next)
+			return perms, err
+		}
+		if err == nil {
+			l.success(clientIP)
+			return perms, nil
+		}
+
+		if l.failure(clientIP) {
+			logger.Warn("client locked out after repeated authentication failures",
+				slog.String("remote_ip", clientIP),
+				slog.String("session_id", getSessionID(conn)),
+				slog.Int("failures", l.lockoutThreshold),
+				slog.Duration("lockout_duration", l.lockoutDuration),
+			)
+			if l.findings != nil {
+				l.findings.repeatedFailures(clientIP, l.lockoutThreshold)
+			}
+		}
+		return nil, err
+	}
+}
+
+// wrapCallbacks applies the limiter to the callbacks of the next step of a
+// login, such as the keyboard-interactive step of MFA.
+func (l *authLimiter) wrapCallbacks(logger *slog.Logger, callbacks ssh.ServerAuthCallbacks) ssh.ServerAuthCallbacks {
+	if callbacks.PasswordCallback != nil {
+		callbacks.PasswordCallback = wrapRateLimit(l, logger, callbacks.PasswordCallback)
+	}
+	if callbacks.PublicKeyCallback != nil {
+		callbacks.PublicKeyCallback = wrapRateLimitPublicKey(l, logger, callbacks.PublicKeyCallback)
+	}
+	if callbacks.KeyboardInteractiveCallback != nil {
+		callbacks.KeyboardInteractiveCallback = wrapRateLimit(l, logger, callbacks.KeyboardInteractiveCallback)
+	}
+	return callbacks
+}
+
+// wrapRateLimitPublicKey applies the limiter to certificate logins. Clients
+// offer every key of their agent before falling back to a password, and
+// plain keys are refused without checking anything, so only certificates
+// count against the limits.
+func wrapRateLimitPublicKey(l *authLimiter, logger *slog.Logger, next func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	limited := wrapRateLimit(l, logger, next)
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if _, ok := key.(*ssh.Certificate); !ok {
+			return next(conn, key)
+		}
+		return limited(conn, key)
+	}
+}
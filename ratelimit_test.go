@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestAuthLimiter(config *Config, now *time.Time) *authLimiter {
+	l := newAuthLimiter(config)
+	l.timeFunc = func() time.Time { return *now }
+	return l
+}
+
+func TestAuthLimiter_RateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	l := newTestAuthLimiter(&Config{AuthRateLimit: 6, AuthRateBurst: 2}, &now)
+
+	for i := 0; i < 2; i++ {
+		if err := l.allow("192.168.1.100"); err != nil {
+			t.Fatalf("allow() attempt %d unexpected error: %v", i+1, err)
+		}
+	}
+	if err := l.allow("192.168.1.100"); !errors.Is(err, errAuthRateLimited) {
+		t.Errorf("allow() beyond burst = %v, want %v", err, errAuthRateLimited)
+	}
+	if err := l.allow("192.168.1.101"); err != nil {
+		t.Errorf("allow() for another IP unexpected error: %v", err)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := l.allow("192.168.1.100"); err != nil {
+		t.Errorf("allow() after refill unexpected error: %v", err)
+	}
+}
+
+func TestAuthLimiter_Lockout(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	l := newTestAuthLimiter(&Config{AuthLockoutThreshold: 3, AuthLockoutDuration: time.Minute}, &now)
+
+	l.failure("192.168.1.100")
+	l.failure("192.168.1.100")
+	l.success("192.168.1.100")
+	l.failure("192.168.1.100")
+	l.failure("192.168.1.100")
+	if err := l.allow("192.168.1.100"); err != nil {
+		t.Fatalf("allow() after success reset unexpected error: %v", err)
+	}
+
+	if !l.failure("192.168.1.100") {
+		t.Fatal("failure() expected the third consecutive failure to lock out")
+	}
+	if err := l.allow("192.168.1.100"); !errors.Is(err, errAuthLockedOut) {
+		t.Errorf("allow() while locked out = %v, want %v", err, errAuthLockedOut)
+	}
+
+	now = now.Add(time.Minute)
+	if err := l.allow("192.168.1.100"); err != nil {
+		t.Errorf("allow() after lockout unexpected error: %v", err)
+	}
+}
+
+func TestWrapRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	l := newTestAuthLimiter(&Config{AuthLockoutThreshold: 2, AuthLockoutDuration: time.Minute}, &now)
+
+	calls := 0
+	callback := wrapRateLimit(l, slog.New(slog.NewTextHandler(os.Stderr, nil)), func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		calls++
+		return nil, errors.New("invalid credentials")
+	})
+
+	for i := 0; i < 3; i++ {
+		callback(testConnMetadata{user: "AKIATEST"}, []byte("wrong"))
+	}
+	if calls != 2 {
+		t.Errorf("credentials checked %d times, want 2 before the lockout", calls)
+	}
+}
+
+func TestWrapRateLimit_SecondFactor(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	l := newTestAuthLimiter(&Config{AuthLockoutThreshold: 2, AuthLockoutDuration: time.Minute}, &now)
+
+	codes := 0
+	callback := wrapRateLimit(l, slog.New(slog.NewTextHandler(os.Stderr, nil)), func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				codes++
+				return nil, errors.New("invalid verification code")
+			},
+		}}
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := callback(testConnMetadata{user: "alice"}, []byte("secret"))
+		var partial *ssh.PartialSuccessError
+		if !errors.As(err, &partial) {
+			break
+		}
+		partial.Next.KeyboardInteractiveCallback(testConnMetadata{user: "alice"}, nil)
+	}
+	if codes != 2 {
+		t.Errorf("verification codes checked %d times, want 2 before the lockout", codes)
+	}
+}
+
+func TestWrapRateLimitPublicKey(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	l := newTestAuthLimiter(&Config{AuthRateLimit: 1, AuthRateBurst: 1}, &now)
+
+	callback := wrapRateLimitPublicKey(l, slog.New(slog.NewTextHandler(os.Stderr, nil)), func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, errors.New("certificate rejected")
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := callback(testConnMetadata{user: "alice"}, newTestSigner(t).PublicKey()); errors.Is(err, errAuthRateLimited) {
+			t.Fatal("plain keys offered by the client's agent counted against the rate limit")
+		}
+	}
+
+	ca := newTestSigner(t)
+	callback(testConnMetadata{user: "alice"}, newTestCert(t, ca, []string{"alice"}, now.Add(time.Hour)))
+	if _, err := callback(testConnMetadata{user: "alice"}, newTestCert(t, ca, []string{"alice"}, now.Add(time.Hour))); !errors.Is(err, errAuthRateLimited) {
+		t.Errorf("second certificate = %v, want %v", err, errAuthRateLimited)
+	}
+}
+
+func TestNewAuthLimiter_Disabled(t *testing.T) {
+	if l := newAuthLimiter(&Config{AuthRateBurst: 5}); l != nil {
+		t.Error("expected no limiter without a rate limit or lockout threshold")
+	}
+}
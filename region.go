@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// regionDetector finds the AWS region when AWS_REGION isn't set. Without a
+// region requests are signed for the wrong one and S3 answers with
+// signature errors that don't mention the region at all.
+type regionDetector struct {
+	bucket       string
+	httpClient   aws.HTTPClient // for the bucket lookup
+	metadata     *http.Client   // for instance metadata, which must not go through a proxy
+	ecsEndpoint  string         // ECS_CONTAINER_METADATA_URI_V4, empty outside ECS
+	imdsEndpoint string         // EC2 instance metadata, empty if disabled
+	s3Endpoint   string
+}
+
+func newRegionDetector(cfg *Config, httpClient aws.HTTPClient) *regionDetector {
+	d := &regionDetector{
+		bucket:       cfg.S3Bucket,
+		httpClient:   httpClient,
+		metadata:     &http.Client{Timeout: 2 * time.Second},
+		ecsEndpoint:  os.Getenv("ECS_CONTAINER_METADATA_URI_V4"),
+		imdsEndpoint: "http://169.254.169.254",
+		s3Endpoint:   "https://s3.amazonaws.com",
+	}
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		d.imdsEndpoint = ""
+	}
+	// the bucket of an S3-compatible store can't be looked up at AWS
+	if cfg.S3EndpointURL != "" {
+		d.bucket = ""
+	}
+	return d
+}
+
+// detect returns the region and where it was found: the AWS SDK's own
+// settings (AWS_DEFAULT_REGION or a profile), ECS task metadata, EC2
+// instance metadata, or the location of the upload bucket.
+func (d *regionDetector) detect(ctx context.Context) (region, source string, err error) {
+	if cfg, err := config.LoadDefaultConfig(ctx); err == nil && cfg.Region != "" {
+		return cfg.Region, "sdk", nil
+	}
+
+	var errs []string
+	for _, lookup := range []struct {
+		source string
+		fn     func(context.Context) (string, error)
+	}{
+		{"ecs", d.ecsRegion},
+		{"imds", d.imdsRegion},
+		{"bucket", d.bucketRegion},
+	} {
+		region, err := lookup.fn(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", lookup.source, err))
+			continue
+		}
+		if region != "" {
+			return region, lookup.source, nil
+		}
+	}
+	if len(errs) == 0 {
+		return "", "", fmt.Errorf("not running on ECS or EC2 and no bucket to look up")
+	}
+	return "", "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// ecsRegion reads the region from the ARN of the task, or returns "" outside
+// ECS.
+func (d *regionDetector) ecsRegion(ctx context.Context) (string, error) {
+	if d.ecsEndpoint == "" {
+		return "", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.ecsEndpoint+"/task", nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := d.metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var task struct {
+		TaskARN string `json:"TaskARN"`
+	}
+	if err := json.Unmarshal(body, &task); err != nil {
+		return "", fmt.Errorf("invalid task metadata: %w", err)
+	}
+	parsed, err := arn.Parse(task.TaskARN)
+	if err != nil {
+		return "", fmt.Errorf("invalid task ARN: %w", err)
+	}
+	return parsed.Region, nil
+}
+
+// imdsRegion asks the EC2 instance metadata service (IMDSv2) for the region.
+// Outside EC2 the address doesn't answer and the request times out quickly.
+func (d *regionDetector) imdsRegion(ctx context.Context) (string, error) {
+	if d.imdsEndpoint == "" {
+		return "", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, d.imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := d.metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, d.imdsEndpoint+"/latest/meta-data/placement/region", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	region, err := d.metadataRequest(req)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(region)), nil
+}
+
+func (d *regionDetector) metadataRequest(req *http.Request) ([]byte, error) {
+	resp, err := d.metadata.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Path, resp.Status)
+	}
+	return body, nil
+}
+
+// bucketRegion looks up the region of the upload bucket. S3 names it in the
+// x-amz-bucket-region header of every HEAD response, including redirects
+// and access denied, so no credentials or permissions are needed.
+func (d *regionDetector) bucketRegion(ctx context.Context) (string, error) {
+	if d.bucket == "" {
+		return "", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, d.s3Endpoint+"/"+url.PathEscape(d.bucket), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if region := resp.Header.Get("X-Amz-Bucket-Region"); region != "" {
+		return region, nil
+	}
+	return "", fmt.Errorf("no region for bucket %s (%s)", d.bucket, resp.Status)
+}
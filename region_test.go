@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegionDetector_ECS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/abc/task" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"Cluster":"default","TaskARN":"arn:aws:ecs:eu-west-1:123456789012:task/default/abc","AvailabilityZone":"eu-west-1a"}`)
+	}))
+	defer server.Close()
+
+	d := &regionDetector{metadata: server.Client(), ecsEndpoint: server.URL + "/v4/abc"}
+	if region, err := d.ecsRegion(context.Background()); err != nil || region != "eu-west-1" {
+		t.Errorf("ecsRegion() = %q, %v, want eu-west-1", region, err)
+	}
+
+	d.ecsEndpoint = ""
+	if region, err := d.ecsRegion(context.Background()); err != nil || region != "" {
+		t.Errorf("ecsRegion() outside ECS = %q, %v, want none", region, err)
+	}
+}
+
+func TestRegionDetector_IMDS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "token")
+		case r.URL.Path == "/latest/meta-data/placement/region":
+			if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "ap-southeast-2")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	d := &regionDetector{metadata: server.Client(), imdsEndpoint: server.URL}
+	if region, err := d.imdsRegion(context.Background()); err != nil || region != "ap-southeast-2" {
+		t.Errorf("imdsRegion() = %q, %v, want ap-southeast-2", region, err)
+	}
+}
+
+func TestRegionDetector_Bucket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/test-bucket" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// S3 answers with a redirect when the bucket is in another region
+		w.Header().Set("X-Amz-Bucket-Region", "us-west-2")
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+
+	d := &regionDetector{bucket: "test-bucket", httpClient: server.Client(), s3Endpoint: server.URL}
+	if region, err := d.bucketRegion(context.Background()); err != nil || region != "us-west-2" {
+		t.Errorf("bucketRegion() = %q, %v, want us-west-2", region, err)
+	}
+
+	d.bucket = "missing-bucket"
+	if _, err := d.bucketRegion(context.Background()); err == nil {
+		t.Error("bucketRegion() expected error for a bucket without region")
+	}
+}
+
+func TestRegionDetector_Detect(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Bucket-Region", "eu-central-1")
+	}))
+	defer bucket.Close()
+
+	d := &regionDetector{
+		bucket:       "test-bucket",
+		httpClient:   bucket.Client(),
+		metadata:     http.DefaultClient,
+		imdsEndpoint: unreachable.URL,
+		s3Endpoint:   bucket.URL,
+	}
+	region, source, err := d.detect(context.Background())
+	if err != nil || region != "eu-central-1" || source != "bucket" {
+		t.Errorf("detect() = %q, %q, %v, want eu-central-1 from the bucket", region, source, err)
+	}
+
+	d.bucket = ""
+	if _, _, err := d.detect(context.Background()); err == nil {
+		t.Error("detect() expected error when no lookup finds a region")
+	}
+
+	t.Setenv("AWS_REGION", "us-east-2")
+	if region, source, err := d.detect(context.Background()); err != nil || region != "us-east-2" || source != "sdk" {
+		t.Errorf("detect() = %q, %q, %v, want us-east-2 from the SDK", region, source, err)
+	}
+}
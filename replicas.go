@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// What the client is told when a file reached its bucket but not all of
+// its replicas, see REPLICA_POLICY.
+const (
+	replicaPolicyPrimary = "primary" // the upload succeeds, the failures are logged
+	replicaPolicyAll     = "all"     // the upload fails
+)
+
+// maxCopySize is the largest object CopyObject copies in one request.
+const maxCopySize = 5 << 30
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// regionalBucket is a bucket that may be in another region than AWS_REGION,
+// such as a replica of a route or FAILOVER_BUCKET.
+type regionalBucket struct {
+	bucket string
+	region string // of the bucket, AWS_REGION if empty
+}
+
+// parseRegionalBucket reads a bucket in the form bucket or bucket@region.
+func parseRegionalBucket(value string) (regionalBucket, error) {
+	bucket, region, _ := strings.Cut(value, "@")
+	if err := validateBucketName(bucket); err != nil {
+		return regionalBucket{}, err
+	}
+	if region != "" && !regionPattern.MatchString(region) {
+		return regionalBucket{}, fmt.Errorf("invalid region %q", region)
+	}
+	return regionalBucket{bucket: bucket, region: region}, nil
+}
+
+func (r regionalBucket) String() string {
+	if r.region == "" {
+		return r.bucket
+	}
+	return r.bucket + "@" + r.region
+}
+
+// inRegion sends a request to the region of the bucket.
+func (r regionalBucket) inRegion(o *s3.Options) {
+	if r.region != "" {
+		o.Region = r.region
+	}
+}
+
+// storeReplicas stores a file that was put into its bucket with input in
+// each of replicas as well, under the same key. Replicas are overwritten
+// rather than following S3_KEY_COLLISION, which already picked the key. With
+// S3_SSE=aws:kms they are encrypted with the AWS managed key, as
+// S3_SSE_KMS_KEY_ID belongs to the region of S3_BUCKET.
+func (u *S3Uploader) storeReplicas(ctx context.Context, client s3API, logCtx slog.Attr, replicas []regionalBucket, input *s3.PutObjectInput, body io.ReaderAt, size int64) error {
+	return u.replicate(logCtx, replicas, aws.ToString(input.Key), func(replica regionalBucket) error {
+		put := *input
+		put.Bucket = aws.String(replica.bucket)
+		put.IfNoneMatch = nil
+		put.SSEKMSKeyId = nil
+		return u.retry.do(ctx, u.logger, logCtx, "PutObject", func() error {
+			putCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			put.Body = io.NewSectionReader(body, 0, size)
+			_, err := client.PutObject(putCtx, &put, replica.inRegion)
+			return err
+		})
+	})
+}
+
+// copyToReplicas copies an object that was streamed into bucket to each of
+// replicas, as its data is no longer at hand.
+func (u *S3Uploader) copyToReplicas(ctx context.Context, client s3API, logCtx slog.Attr, replicas []regionalBucket, bucket, key string, size int64) error {
+	return u.replicate(logCtx, replicas, key, func(replica regionalBucket) error {
+		if size > maxCopySize {
+			return errors.New("streamed files over 5GB can't be copied to replicas")
+		}
+		return u.retry.do(ctx, u.logger, logCtx, "CopyObject", func() error {
+			copyCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+
+			_, err := client.CopyObject(copyCtx, &s3.CopyObjectInput{
+				Bucket:               aws.String(replica.bucket),
+				Key:                  aws.String(key),
+				CopySource:           aws.String(url.PathEscape(bucket) + "/" + escapeKey(key)),
+				StorageClass:         u.storageClass,
+				ServerSideEncryption: u.sse,
+			}, replica.inRegion)
+			return err
+		})
+	})
+}
+
+// replicate stores the file in every replica with store, and returns an
+// error if that failed for any of them and REPLICA_POLICY is all.
+func (u *S3Uploader) replicate(logCtx slog.Attr, replicas []regionalBucket, key string, store func(regionalBucket) error) error {
+	var failed []string
+	for _, replica := range replicas {
+		if err := store(replica); err != nil {
+			u.logger.Error("S3 replica upload failed", logCtx,
+				slog.String("replica", replica.String()),
+				slog.String("s3_key", key),
+				slog.String("error", err.Error()),
+			)
+			failed = append(failed, replica.bucket)
+			continue
+		}
+		u.logger.Info("S3 replica upload successful", logCtx,
+			slog.String("replica", replica.String()),
+			slog.String("s3_key", key),
+		)
+	}
+
+	if len(failed) > 0 && u.replication == replicaPolicyAll {
+		return fmt.Errorf("failed to store replicas in %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// escapeKey escapes the segments of an S3 key for a copy source.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestS3Stream_Replicas(t *testing.T) {
+	replicas := []regionalBucket{{bucket: "acme-dr", region: "eu-west-1"}, {bucket: "acme-archive"}}
+
+	client := &fakeS3Client{}
+	stream := newTestStream(client, 10)
+	stream.replicas = replicas
+	stream.Write([]byte("hello"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+	want := map[string]string{"acme-dr@eu-west-1": "2023-12-25/test.txt", "acme-archive@": "2023-12-25/test.txt"}
+	if !maps.Equal(client.replicas, want) {
+		t.Errorf("replicas of a small file = %v, want %v", client.replicas, want)
+	}
+
+	// multipart uploads are copied from the bucket, as their data is gone
+	client = &fakeS3Client{}
+	stream = newTestStream(client, 5)
+	stream.key = "2023-12-25/a b.txt"
+	stream.replicas = replicas
+	stream.Write([]byte("hello world"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+	want = map[string]string{"acme-dr@eu-west-1": "test-bucket/2023-12-25/a%20b.txt", "acme-archive@": "test-bucket/2023-12-25/a%20b.txt"}
+	if !maps.Equal(client.replicas, want) {
+		t.Errorf("copies of a multipart upload = %v, want %v", client.replicas, want)
+	}
+}
+
+func TestS3Stream_ReplicaPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		wantErr bool
+	}{
+		{replicaPolicyPrimary, false},
+		{replicaPolicyAll, true},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			client := &fakeS3Client{failBucket: "acme-dr"}
+			stream := newTestStream(client, 10)
+			stream.uploader.replication = tt.policy
+			stream.replicas = []regionalBucket{{bucket: "acme-dr"}, {bucket: "acme-archive"}}
+
+			stream.Write([]byte("hello"))
+			if err := stream.Complete(); (err != nil) != tt.wantErr {
+				t.Errorf("Complete() error = %v, want error %v", err, tt.wantErr)
+			}
+			if string(client.putObject) != "hello" || client.replicas["acme-archive@"] == "" {
+				t.Error("expected the file in its bucket and the replica that works")
+			}
+		})
+	}
+}
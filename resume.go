@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// suspendedUpload is an upload whose connection dropped before the file was
+// closed. It is kept for RESUME_TIMEOUT so the client can reconnect and
+// continue where it stopped.
+type suspendedUpload struct {
+	upload *FileUpload
+	timer  *time.Timer
+}
+
+// resumeKey identifies a suspended upload. Only the same user can resume an
+// upload, as the data is stored with their credentials.
+func resumeKey(user, path string) string {
+	return user + ":" + path
+}
+
+// TransferError is called by the SFTP server when the connection ends while
+// the file is still open. Close follows right after.
+func (fw *FileWriter) TransferError(err error) {
+	fw.upload.mu.Lock()
+	defer fw.upload.mu.Unlock()
+
+	fw.transferErr = err
+}
+
+// interruptUpload handles an upload whose connection dropped. The partial
+// file is never stored in S3; it is kept for resuming if that is enabled and
+// discarded otherwise.
+func (h *SFTPHandler) interruptUpload(upload *FileUpload, transferErr error, logCtx slog.Attr) error {
+	if h.config.ResumeTimeout <= 0 {
+		h.logger.Warn("upload interrupted, discarding partial file", logCtx, slog.String("error", transferErr.Error()))
+		h.discardUpload(upload)
+		return fmt.Errorf("upload interrupted: %w", transferErr)
+	}
+
+	key := resumeKey(upload.user, upload.path)
+	suspended := &suspendedUpload{upload: upload}
+	suspended.timer = time.AfterFunc(h.config.ResumeTimeout, func() {
+		if h.suspendedUploads.CompareAndDelete(key, suspended) {
+			h.logger.Warn("interrupted upload was not resumed, discarding partial file", logCtx)
+			h.discardUpload(upload)
+		}
+	})
+
+	if previous, ok := h.suspendedUploads.Swap(key, suspended); ok {
+		previous := previous.(*suspendedUpload)
+		previous.timer.Stop()
+		h.discardUpload(previous.upload)
+	}
+
+	h.logger.Warn("upload interrupted, keeping partial file for resume", logCtx,
+		slog.Int64("resume_offset", upload.resumeOffset()),
+		slog.Duration("resume_timeout", h.config.ResumeTimeout),
+		slog.String("error", transferErr.Error()),
+	)
+	return fmt.Errorf("upload interrupted: %w", transferErr)
+}
+
+// resumeUpload returns the suspended upload for path, prepared to continue at
+// its resume offset, or nil if there is none. Opening the file with O_TRUNC
+// means the client starts over, so the suspended upload is discarded.
+func (h *SFTPHandler) resumeUpload(user, path string, truncate bool) *FileUpload {
+	value, ok := h.suspendedUploads.LoadAndDelete(resumeKey(user, path))
+	if !ok {
+		return nil
+	}
+
+	suspended := value.(*suspendedUpload)
+	suspended.timer.Stop()
+
+	if truncate {
+		h.discardUpload(suspended.upload)
+		return nil
+	}
+
+	upload := suspended.upload
+	if upload.stream != nil {
+		upload.pending = nil
+		upload.pendingBytes = 0
+	} else {
+		if err := upload.truncate(upload.received); err != nil {
+			h.logger.Error("failed to truncate interrupted upload", slog.String("file_path", path), slog.String("error", err.Error()))
+			h.discardUpload(upload)
+			return nil
+		}
+		upload.ranges = nil
+	}
+	upload.state.Store(uploadReceiving)
+	return upload
+}
+
+// statSuspendedUpload reports the size of a suspended upload, which is how
+// clients find the offset to resume from.
+func (h *SFTPHandler) statSuspendedUpload(user, filePath string) (sftp.ListerAt, bool) {
+	value, ok := h.suspendedUploads.Load(resumeKey(user, filePath))
+	if !ok {
+		return nil, false
+	}
+
+	upload := value.(*suspendedUpload).upload
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	return fileInfoLister{uploadFileInfo{
+		name:    path.Base(filePath),
+		size:    upload.resumeOffset(),
+		modTime: time.Now(),
+	}}, true
+}
+
+// uploadFileInfo describes a partially received file.
+type uploadFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi uploadFileInfo) Name() string       { return fi.name }
+func (fi uploadFileInfo) Size() int64        { return fi.size }
+func (fi uploadFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi uploadFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi uploadFileInfo) IsDir() bool        { return false }
+func (fi uploadFileInfo) Sys() any           { return nil }
+
+type fileInfoLister []os.FileInfo
+
+func (l fileInfoLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileUpload_MarkReceived(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes [][2]int64
+		want   int64
+	}{
+		{"sequential", [][2]int64{{0, 4}, {4, 8}}, 8},
+		{"gap", [][2]int64{{0, 4}, {8, 12}}, 4},
+		{"gap filled", [][2]int64{{0, 4}, {8, 12}, {4, 8}}, 12},
+		{"out of order", [][2]int64{{8, 12}, {4, 8}, {0, 4}}, 12},
+		{"rewrite", [][2]int64{{0, 8}, {2, 4}}, 8},
+		{"nothing at start", [][2]int64{{4, 8}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := &FileUpload{}
+			for _, w := range tt.writes {
+				upload.markReceived(w[0], w[1])
+			}
+			if upload.received != tt.want {
+				t.Errorf("received = %d, want %d", upload.received, tt.want)
+			}
+		})
+	}
+}
+
+func newInterruptedWriter(handler *SFTPHandler, client *fakeS3Client) *FileWriter {
+	return &FileWriter{
+		upload: &FileUpload{
+			path:      "/uploads/test.txt",
+			user:      "AKIATEST123",
+			accessKey: "AKIATEST123",
+			stream:    newTestStream(client, handler.config.MultipartPartSize),
+		},
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+}
+
+func TestSFTPHandler_ResumeUpload(t *testing.T) {
+	config := &Config{
+		VirtualDir:        "/uploads",
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 1024,
+		ResumeTimeout:     time.Minute,
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	client := &fakeS3Client{}
+	writer := newInterruptedWriter(handler, client)
+
+	writer.WriteAt([]byte("abc"), 0)
+	writer.WriteAt([]byte("xyz"), 6) // arrived ahead of a chunk that was lost
+	writer.TransferError(io.ErrUnexpectedEOF)
+	if err := writer.Close(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Close() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if client.putObject != nil {
+		t.Fatal("expected nothing to be uploaded for an interrupted transfer")
+	}
+
+	lister, ok := handler.statSuspendedUpload("AKIATEST123", "/uploads/test.txt")
+	if !ok {
+		t.Fatal("expected interrupted upload to be suspended")
+	}
+	info := make([]os.FileInfo, 1)
+	lister.ListAt(info, 0)
+	if info[0].Size() != 3 {
+		t.Errorf("suspended upload size = %d, want 3", info[0].Size())
+	}
+
+	if handler.resumeUpload("AKIAOTHER", "/uploads/test.txt", false) != nil {
+		t.Error("expected other credentials not to resume the upload")
+	}
+
+	upload := handler.resumeUpload("AKIATEST123", "/uploads/test.txt", false)
+	if upload == nil {
+		t.Fatal("resumeUpload() returned nil")
+	}
+
+	writer = &FileWriter{upload: upload, handler: handler, logger: writer.logger}
+	if _, err := writer.WriteAt([]byte("defxyz"), 3); err != nil {
+		t.Fatalf("WriteAt() unexpected error: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	if string(client.putObject) != "abcdefxyz" {
+		t.Errorf("uploaded data = %q, want %q", client.putObject, "abcdefxyz")
+	}
+}
+
+func TestSFTPHandler_InterruptedUploadDiscarded(t *testing.T) {
+	config := &Config{
+		VirtualDir:        "/uploads",
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 1024,
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	client := &fakeS3Client{}
+	writer := newInterruptedWriter(handler, client)
+
+	writer.WriteAt([]byte("abc"), 0)
+	writer.TransferError(io.ErrUnexpectedEOF)
+	if err := writer.Close(); err == nil {
+		t.Error("Close() expected error for an interrupted transfer")
+	}
+	if client.putObject != nil {
+		t.Error("expected nothing to be uploaded for an interrupted transfer")
+	}
+	if _, ok := handler.statSuspendedUpload("AKIATEST123", "/uploads/test.txt"); ok {
+		t.Error("expected no suspended upload when RESUME_TIMEOUT is not set")
+	}
+}
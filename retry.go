@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// maxRetryDelay caps the backoff between two attempts.
+const maxRetryDelay = 30 * time.Second
+
+// retryPolicy retries S3 operations that fail with transient errors, on top
+// of the retries the AWS SDK already performs for individual requests.
+type retryPolicy struct {
+	attempts  int           // total attempts, values below 1 mean a single attempt
+	baseDelay time.Duration // delay before the second attempt, doubled for each one after that
+	jitter    float64       // random extra delay as a fraction of the backoff
+}
+
+func newRetryPolicy(config *Config) retryPolicy {
+	return retryPolicy{
+		attempts:  config.UploadRetryAttempts,
+		baseDelay: config.UploadRetryBaseDelay,
+		jitter:    config.UploadRetryJitter,
+	}
+}
+
+// do runs fn until it succeeds, returns an error that is not worth retrying,
+// or the attempts are used up. The last error is returned.
+func (p retryPolicy) do(ctx context.Context, logger *slog.Logger, logCtx slog.Attr, operation string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		if attempt >= p.attempts || !isRetryableError(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		logger.Warn("S3 operation failed, retrying", logCtx,
+			slog.String("operation", operation),
+			slog.Int("attempt", attempt),
+			slog.Duration("retry_in", delay),
+			slog.String("error", err.Error()),
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay before the attempt following the given one.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.baseDelay << (attempt - 1)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	if p.jitter > 0 {
+		delay += time.Duration(rand.Float64() * p.jitter * float64(delay))
+	}
+	return delay
+}
+
+// nonRetryableErrorCodes are S3 error codes that will not go away by trying
+// again, typically because the credentials or the bucket are wrong.
+var nonRetryableErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"NoSuchBucket":          true,
+	"InvalidBucketName":     true,
+	"NoSuchUpload":          true,
+	"EntityTooLarge":        true,
+	"InvalidArgument":       true,
+	"PreconditionFailed":    true,
+}
+
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return !nonRetryableErrorCodes[apiErr.ErrorCode()]
+	}
+
+	var deliveryErr *webhookDeliveryError
+	if errors.As(err, &deliveryErr) {
+		return deliveryErr.retryable()
+	}
+
+	var kafkaErr *kafkaError
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.retryable()
+	}
+
+	return true
+}
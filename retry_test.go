@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestRetryPolicy_do(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	policy := retryPolicy{attempts: 3, baseDelay: time.Millisecond}
+
+	tests := []struct {
+		name          string
+		errs          []error
+		expectError   bool
+		expectedCalls int
+	}{
+		{
+			name:          "succeeds first time",
+			errs:          []error{nil},
+			expectedCalls: 1,
+		},
+		{
+			name:          "succeeds after transient failures",
+			errs:          []error{errors.New("connection reset"), errors.New("timeout"), nil},
+			expectedCalls: 3,
+		},
+		{
+			name:          "gives up after all attempts",
+			errs:          []error{errors.New("a"), errors.New("b"), errors.New("c"), nil},
+			expectError:   true,
+			expectedCalls: 3,
+		},
+		{
+			name:          "does not retry access denied",
+			errs:          []error{&smithy.GenericAPIError{Code: "AccessDenied"}, nil},
+			expectError:   true,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := policy.do(context.Background(), logger, slog.Group("test"), "PutObject", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+
+			if tt.expectError && err == nil {
+				t.Error("do() expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("do() unexpected error: %v", err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("do() made %d calls, want %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_doSingleAttemptByDefault(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	calls := 0
+	err := retryPolicy{}.do(context.Background(), logger, slog.Group("test"), "PutObject", func() error {
+		calls++
+		return errors.New("failed")
+	})
+
+	if err == nil {
+		t.Error("do() expected error but got none")
+	}
+	if calls != 1 {
+		t.Errorf("do() made %d calls, want 1", calls)
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := retryPolicy{baseDelay: 100 * time.Millisecond, jitter: 0.5}
+
+	for attempt, base := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		delay := policy.backoff(attempt + 1)
+		if delay < base || delay > base+base/2 {
+			t.Errorf("backoff(%d) = %v, want between %v and %v", attempt+1, delay, base, base+base/2)
+		}
+	}
+
+	if delay := (retryPolicy{baseDelay: time.Second}).backoff(20); delay != maxRetryDelay {
+		t.Errorf("backoff(20) = %v, want cap %v", delay, maxRetryDelay)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// uploadRoute sends the files that match all of its conditions to another
+// bucket or prefix, see UPLOAD_ROUTES. Conditions that are empty match any
+// upload.
+type uploadRoute struct {
+	user    string // path.Match pattern for the user name, such as acme-*
+	account string // AWS account ID of the user
+	dir     string // subdirectory of VIRTUAL_DIR the file is uploaded to
+	bucket  string // replaces S3_BUCKET
+	prefix  string // replaces S3_BUCKET_PREFIX
+
+	replicas []regionalBucket // receive a copy of every upload
+}
+
+// String returns the route in the form of UPLOAD_ROUTES.
+func (r uploadRoute) String() string {
+	var pairs []string
+	for _, pair := range [][2]string{
+		{"user", r.user}, {"account", r.account}, {"dir", r.dir},
+		{"bucket", r.bucket}, {"prefix", r.prefix},
+	} {
+		if pair[1] != "" {
+			pairs = append(pairs, pair[0]+"="+pair[1])
+		}
+	}
+	for _, replica := range r.replicas {
+		pairs = append(pairs, "replica="+replica.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseUploadRoutes reads routes separated by semicolons, each a comma
+// separated list of key=value pairs such as
+// "user=acme-*,bucket=acme-ingest,prefix=inbound". Every route needs at
+// least one condition (user, account or dir) and a bucket, prefix or
+// replica; replica may be given several times.
+func parseUploadRoutes(value string) ([]uploadRoute, error) {
+	var routes []uploadRoute
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var route uploadRoute
+		for _, pair := range strings.Split(entry, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("route %q: %q is not a key=value pair", entry, pair)
+			}
+			switch key {
+			case "user":
+				if _, err := path.Match(value, ""); err != nil {
+					return nil, fmt.Errorf("route %q: invalid user pattern %q", entry, value)
+				}
+				route.user = value
+			case "account":
+				if !accountIDPattern.MatchString(value) {
+					return nil, fmt.Errorf("route %q: %q is not a 12-digit account ID", entry, value)
+				}
+				route.account = value
+			case "dir":
+				dir, err := normalizeKeyPrefix(value)
+				if err != nil || dir == "" {
+					return nil, fmt.Errorf("route %q: invalid dir %q", entry, value)
+				}
+				route.dir = dir
+			case "bucket":
+				if err := validateBucketName(value); err != nil {
+					return nil, fmt.Errorf("route %q: %w", entry, err)
+				}
+				route.bucket = value
+			case "prefix":
+				prefix, err := normalizeKeyPrefix(value)
+				if err != nil {
+					return nil, fmt.Errorf("route %q: %w", entry, err)
+				}
+				route.prefix = prefix
+			case "replica":
+				replica, err := parseRegionalBucket(value)
+				if err != nil {
+					return nil, fmt.Errorf("route %q: replica: %w", entry, err)
+				}
+				route.replicas = append(route.replicas, replica)
+			default:
+				return nil, fmt.Errorf("route %q: unknown key %q", entry, key)
+			}
+		}
+
+		if route.user == "" && route.account == "" && route.dir == "" {
+			return nil, fmt.Errorf("route %q: needs a user, account or dir condition", entry)
+		}
+		if route.bucket == "" && route.prefix == "" && len(route.replicas) == 0 {
+			return nil, fmt.Errorf("route %q: needs a bucket, prefix or replica", entry)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// matches reports whether the file at relPath, relative to VIRTUAL_DIR, of
+// session is sent to this route.
+func (r *uploadRoute) matches(session uploadSession, relPath string) bool {
+	if r.user != "" {
+		if ok, _ := path.Match(r.user, session.user); !ok {
+			return false
+		}
+	}
+	if r.account != "" && r.account != session.accountID {
+		return false
+	}
+	if r.dir != "" && !strings.HasPrefix(relPath, r.dir+"/") {
+		return false
+	}
+	return true
+}
+
+// findUploadRoute returns the first of routes that matches the file at
+// filePath, or nil if none does.
+func findUploadRoute(routes []uploadRoute, virtualDir string, session uploadSession, filePath string) *uploadRoute {
+	relPath := strings.TrimPrefix(strings.TrimPrefix(path.Clean(filePath), path.Clean(virtualDir)), "/")
+	for i := range routes {
+		if routes[i].matches(session, relPath) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
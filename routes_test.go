@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUploadRoutes(t *testing.T) {
+	routes, err := parseUploadRoutes("user=acme-*, bucket=acme-ingest, prefix=/inbound/; account=210987654321,dir=invoices,prefix=finance; user=*,replica=acme-dr@eu-west-1,replica=acme-archive;")
+	if err != nil {
+		t.Fatalf("parseUploadRoutes() unexpected error: %v", err)
+	}
+	want := []uploadRoute{
+		{user: "acme-*", bucket: "acme-ingest", prefix: "inbound"},
+		{account: "210987654321", dir: "invoices", prefix: "finance"},
+		{user: "*", replicas: []regionalBucket{{bucket: "acme-dr", region: "eu-west-1"}, {bucket: "acme-archive"}}},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("parseUploadRoutes() = %+v, want %+v", routes, want)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(routes[i], want[i]) {
+			t.Errorf("route %d = %+v, want %+v", i, routes[i], want[i])
+		}
+	}
+
+	if got, want := routes[2].String(), "user=*,replica=acme-dr@eu-west-1,replica=acme-archive"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	for _, value := range []string{
+		"bucket=acme-ingest",
+		"user=acme",
+		"user=acme,bucket=Acme_Ingest",
+		"user=[acme,bucket=acme-ingest",
+		"account=42,bucket=acme-ingest",
+		"dir=../other,prefix=finance",
+		"user=acme,prefix=../other",
+		"user=acme,region=eu-west-1",
+		"user=acme,bucket",
+		"user=acme,replica=Acme_DR",
+		"user=acme,replica=acme-dr@Europe",
+	} {
+		if _, err := parseUploadRoutes(value); err == nil {
+			t.Errorf("parseUploadRoutes(%q) expected error", value)
+		}
+	}
+}
+
+func TestFindUploadRoute(t *testing.T) {
+	routes := []uploadRoute{
+		{user: "acme-*", account: "210987654321", bucket: "acme-ingest"},
+		{dir: "invoices", prefix: "finance"},
+		{user: "globex", prefix: "globex"},
+	}
+
+	tests := []struct {
+		name      string
+		session   uploadSession
+		filePath  string
+		wantRoute int // index into routes, -1 for none
+	}{
+		{"user and account", uploadSession{user: "acme-eu", accountID: "210987654321"}, "/uploads/invoices/a.csv", 0},
+		{"wrong account", uploadSession{user: "acme-eu", accountID: "123456789012"}, "/uploads/invoices/a.csv", 1},
+		{"subdirectory", uploadSession{user: "initech"}, "/uploads/invoices/2024/a.csv", 1},
+		{"file named like the directory", uploadSession{user: "initech"}, "/uploads/invoices", -1},
+		{"similar directory", uploadSession{user: "initech"}, "/uploads/invoices-old/a.csv", -1},
+		{"user", uploadSession{user: "globex"}, "/uploads/a.csv", 2},
+		{"no match", uploadSession{user: "initech"}, "/uploads/a.csv", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := findUploadRoute(routes, "/uploads", tt.session, tt.filePath)
+			switch {
+			case tt.wantRoute < 0 && route != nil:
+				t.Errorf("findUploadRoute() = %+v, want none", route)
+			case tt.wantRoute >= 0 && route != &routes[tt.wantRoute]:
+				t.Errorf("findUploadRoute() = %+v, want %+v", route, routes[tt.wantRoute])
+			}
+		})
+	}
+}
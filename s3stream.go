@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Stream uploads a file to S3 while it is still being received. Data is
+// buffered until a full part is available and then sent with UploadPart, so
+// memory use is bounded by the part size instead of the file size. Files
+// that never fill a single part are sent with a plain PutObject on Complete.
+type S3Stream struct {
+	uploader *S3Uploader
+	client   s3API
+	ctx      context.Context // carries the trace of the upload; never canceled
+	logCtx   slog.Attr
+	bucket   string
+	filePath string
+	key      string
+	metadata map[string]string
+	replicas []regionalBucket // copied to once complete, see UPLOAD_ROUTES
+
+	buf      []byte
+	size     int64
+	uploadID string
+	nextPart int32
+
+	// With MULTIPART_CONCURRENCY above 1, parts are sent in the background.
+	// inflight limits how many are sent at once; mu guards parts and err,
+	// which those uploads update.
+	inflight chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	parts    []types.CompletedPart
+	err      error
+}
+
+// StartStream prepares a streaming upload for filePath. No request is made
+// to S3 until the first part is full or the stream is complete.
+func (u *S3Uploader) StartStream(ctx context.Context, session uploadSession, filePath string) (uploadStream, error) {
+	key := u.generateS3Key(filePath, session)
+	bucket := u.bucketFor(session)
+
+	logCtx := slog.Group("s3_stream",
+		"remote_ip", session.clientIP,
+		"session_id", session.sessionID,
+		"country", session.country,
+		"access_key_id", session.accessKeyID,
+		"file_path", filePath,
+		"bucket", bucket,
+		"s3_key", key,
+	)
+
+	s3Client, err := u.newClient(ctx, session.accessKeyID, session.secretAccessKey, session.sessionToken)
+	if err != nil {
+		u.logger.Error("failed to load AWS config for upload", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to configure AWS client: %w", err)
+	}
+
+	return &S3Stream{
+		uploader: u,
+		client:   s3Client,
+		ctx:      context.WithoutCancel(ctx),
+		logCtx:   logCtx,
+		bucket:   bucket,
+		filePath: filePath,
+		key:      key,
+		metadata: u.objectMetadata(session, filePath),
+		replicas: session.replicas,
+	}, nil
+}
+
+// Write appends p to the object. Writes must be sequential.
+func (s *S3Stream) Write(p []byte) (int, error) {
+	if err := s.failed(); err != nil {
+		return 0, err
+	}
+
+	s.buf = append(s.buf, p...)
+	s.size += int64(len(p))
+
+	partSize := s.uploader.partSize
+	for int64(len(s.buf)) >= partSize {
+		if err := s.uploadPart(s.buf[:partSize]); err != nil {
+			s.fail(err)
+			return 0, err
+		}
+		n := copy(s.buf, s.buf[partSize:])
+		s.buf = s.buf[:n]
+	}
+
+	return len(p), nil
+}
+
+// Complete uploads any buffered data and completes the object. If anything
+// fails the multipart upload is aborted so no orphaned parts are left behind.
+func (s *S3Stream) Complete() error {
+	s.wg.Wait()
+
+	if err := s.failed(); err != nil {
+		s.Abort()
+		return err
+	}
+
+	if s.uploadID == "" {
+		input := s.uploader.putObjectInput(s.key, detectContentType(s.filePath, s.buf), s.metadata, s.uploader.checksum.digest(s.buf))
+		input.Bucket = aws.String(s.bucket)
+		err := s.uploader.putObject(s.ctx, s.client, s.logCtx, input, bytes.NewReader(s.buf), int64(len(s.buf)))
+		if err != nil {
+			err = s.uploader.storeFailover(s.ctx, s.client, s.logCtx, input, bytes.NewReader(s.buf), int64(len(s.buf)), err)
+			s.bucket = aws.ToString(input.Bucket)
+		}
+		s.key = aws.ToString(input.Key)
+		if err != nil {
+			s.uploader.logger.Error("S3 upload failed", s.logCtx, slog.String("error", err.Error()))
+			return fmt.Errorf("failed to upload to S3: %w", err)
+		}
+		s.uploader.logger.Info("S3 upload successful", s.logCtx,
+			slog.String("s3_key", s.key),
+			slog.Int64("file_size", s.size),
+		)
+		return s.uploader.storeReplicas(s.ctx, s.client, s.logCtx, s.replicas, input, bytes.NewReader(s.buf), int64(len(s.buf)))
+	}
+
+	if len(s.buf) > 0 {
+		if err := s.uploadPart(s.buf); err != nil {
+			s.Abort()
+			return err
+		}
+		s.buf = s.buf[:0]
+	}
+
+	s.wg.Wait()
+	if err := s.failed(); err != nil {
+		s.Abort()
+		return err
+	}
+
+	slices.SortFunc(s.parts, func(a, b types.CompletedPart) int {
+		return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber))
+	})
+
+	err := s.withRetry("CompleteMultipartUpload", func(ctx context.Context) error {
+		_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(s.key),
+			UploadId:        aws.String(s.uploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: s.parts},
+			IfNoneMatch:     s.uploader.ifNoneMatch(),
+		})
+		return err
+	})
+	if isPreconditionFailed(err) {
+		err = errObjectExists
+	}
+	if err != nil {
+		s.uploader.logger.Error("failed to complete S3 multipart upload", s.logCtx, slog.String("error", err.Error()))
+		s.Abort()
+		return fmt.Errorf("failed to upload to S3: %w", err)
+	}
+
+	s.uploader.logger.Info("S3 upload successful", s.logCtx,
+		slog.String("s3_key", s.key),
+		slog.Int64("file_size", s.size),
+		slog.Int("parts", len(s.parts)),
+	)
+	return s.uploader.copyToReplicas(s.ctx, s.client, s.logCtx, s.replicas, s.bucket, s.key, s.size)
+}
+
+func (s *S3Stream) location() (bucket, key string) {
+	return s.bucket, s.key
+}
+
+// memory returns the size of the part buffer, which is kept at its
+// capacity between parts.
+func (s *S3Stream) memory() int64 {
+	return int64(cap(s.buf))
+}
+
+// Abort discards the upload and any parts already stored in S3.
+func (s *S3Stream) Abort() {
+	s.wg.Wait()
+
+	if s.uploadID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+	defer cancel()
+
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.key),
+		UploadId: aws.String(s.uploadID),
+	})
+	if err != nil {
+		s.uploader.logger.Error("failed to abort S3 multipart upload", s.logCtx, slog.String("error", err.Error()))
+		return
+	}
+
+	s.uploader.logger.Info("S3 multipart upload aborted", s.logCtx)
+	s.uploadID = ""
+}
+
+// withRetry runs an S3 call under the retry policy, giving each attempt its
+// own timeout.
+func (s *S3Stream) withRetry(operation string, fn func(ctx context.Context) error) error {
+	return s.uploader.retry.do(s.ctx, s.uploader.logger, s.logCtx, operation, func() error {
+		ctx, cancel := context.WithTimeout(s.ctx, 5*time.Minute)
+		defer cancel()
+		return fn(ctx)
+	})
+}
+
+// checkCollision applies the collision policy before a multipart upload is
+// started, so parts are not uploaded for a key that will be rejected. The
+// conditional CompleteMultipartUpload still catches keys taken in between.
+func (s *S3Stream) checkCollision() error {
+	if s.uploader.ifNoneMatch() == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+	defer cancel()
+
+	// when that can't be determined the key is assumed to be free; the
+	// conditional write that follows still protects the existing object
+	exists, err := objectExists(ctx, s.client, s.bucket, s.key)
+	if err != nil {
+		s.uploader.logger.Warn("failed to check whether S3 key exists", s.logCtx, slog.String("error", err.Error()))
+	}
+	if !exists {
+		return nil
+	}
+
+	if s.uploader.keyCollision != keyCollisionUniquify {
+		s.uploader.logger.Error("S3 key already exists", s.logCtx)
+		return fmt.Errorf("failed to upload to S3: %w", errObjectExists)
+	}
+
+	key := uniqueKey(s.key)
+	s.uploader.logger.Info("S3 key already exists, using unique key", s.logCtx, slog.String("unique_key", key))
+	s.key = key
+	return nil
+}
+
+func (s *S3Stream) uploadPart(data []byte) error {
+	if s.uploadID == "" {
+		if err := s.checkCollision(); err != nil {
+			return err
+		}
+
+		var out *s3.CreateMultipartUploadOutput
+		err := s.withRetry("CreateMultipartUpload", func(ctx context.Context) error {
+			input := s.uploader.createMultipartUploadInput(s.key, detectContentType(s.filePath, data), s.metadata)
+			input.Bucket = aws.String(s.bucket)
+
+			var err error
+			out, err = s.client.CreateMultipartUpload(ctx, input)
+			return err
+		})
+		if err != nil {
+			s.uploader.logger.Error("failed to start S3 multipart upload", s.logCtx, slog.String("error", err.Error()))
+			return fmt.Errorf("failed to upload to S3: %w", err)
+		}
+		s.uploadID = aws.ToString(out.UploadId)
+		s.uploader.logger.Info("started S3 multipart upload", s.logCtx, slog.String("upload_id", s.uploadID))
+	}
+
+	s.nextPart++
+	partNumber := s.nextPart
+
+	concurrency := s.uploader.concurrency
+	if concurrency <= 1 {
+		return s.sendPart(partNumber, data)
+	}
+
+	if s.inflight == nil {
+		s.inflight = make(chan struct{}, concurrency)
+	}
+	s.inflight <- struct{}{}
+	if err := s.failed(); err != nil {
+		<-s.inflight
+		return err
+	}
+
+	data = bytes.Clone(data)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.inflight }()
+
+		if err := s.sendPart(partNumber, data); err != nil {
+			s.fail(err)
+		}
+	}()
+	return nil
+}
+
+// failed returns the error of an earlier failed part, if any.
+func (s *S3Stream) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail records the first error of the upload; later writes return it.
+func (s *S3Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *S3Stream) sendPart(partNumber int32, data []byte) error {
+	checksum := s.uploader.checksum
+	checksumSHA256, checksumCRC32 := checksum.fields(checksum.digest(data))
+
+	var out *s3.UploadPartOutput
+	err := s.withRetry("UploadPart", func(ctx context.Context) error {
+		var err error
+		out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(s.key),
+			UploadId:          aws.String(s.uploadID),
+			PartNumber:        aws.Int32(partNumber),
+			Body:              bytes.NewReader(data),
+			ChecksumAlgorithm: checksum.algorithm,
+			ChecksumSHA256:    checksumSHA256,
+			ChecksumCRC32:     checksumCRC32,
+		})
+		return err
+	})
+	if err != nil {
+		s.uploader.logger.Error("failed to upload S3 part", s.logCtx,
+			slog.Int("part_number", int(partNumber)),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf("failed to upload part %d to S3: %w", partNumber, err)
+	}
+
+	s.mu.Lock()
+	s.parts = append(s.parts, types.CompletedPart{
+		ETag:           out.ETag,
+		PartNumber:     aws.Int32(partNumber),
+		ChecksumSHA256: checksumSHA256,
+		ChecksumCRC32:  checksumCRC32,
+	})
+	s.mu.Unlock()
+
+	s.uploader.logger.Debug("uploaded S3 part", s.logCtx,
+		slog.Int("part_number", int(partNumber)),
+		slog.Int("part_size", len(data)),
+	)
+	return nil
+}
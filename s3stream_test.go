@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3Client stores objects in memory. Keys listed in existing are
+// treated as already present in the bucket.
+type fakeS3Client struct {
+	mu        sync.Mutex
+	existing  map[string]bool
+	putObject []byte
+	putKey    string
+	parts     [][]byte
+	created   bool
+	completed bool
+	aborted   bool
+	failPart  int
+
+	replicas   map[string]string // key of PutObject and CopyObject by bucket@region
+	failBucket string            // bucket whose requests fail
+	tagging    string            // of the last PutObject
+}
+
+// replicated records a request for a replica bucket.
+func (f *fakeS3Client) replicated(bucket, key string, optFns []func(*s3.Options)) error {
+	if bucket == f.failBucket {
+		return errors.New("replica unavailable")
+	}
+	var options s3.Options
+	for _, fn := range optFns {
+		fn(&options)
+	}
+	if f.replicas == nil {
+		f.replicas = make(map[string]string)
+	}
+	f.replicas[bucket+"@"+options.Region] = key
+	return nil
+}
+
+func (f *fakeS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if err := f.replicated(aws.ToString(params.Bucket), aws.ToString(params.CopySource), optFns); err != nil {
+		return nil, err
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func preconditionFailed() error {
+	return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+}
+
+func (f *fakeS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if f.existing[aws.ToString(params.Key)] {
+		return &s3.HeadObjectOutput{}, nil
+	}
+	return nil, &types.NotFound{}
+}
+
+func (f *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if aws.ToString(params.IfNoneMatch) == "*" && f.existing[aws.ToString(params.Key)] {
+		return nil, preconditionFailed()
+	}
+	f.tagging = aws.ToString(params.Tagging)
+	if bucket := aws.ToString(params.Bucket); bucket == f.failBucket || bucket != "" && bucket != "test-bucket" {
+		if err := f.replicated(bucket, aws.ToString(params.Key), optFns); err != nil {
+			return nil, err
+		}
+		return &s3.PutObjectOutput{}, nil
+	}
+	data, _ := io.ReadAll(params.Body)
+	f.putObject = data
+	f.putKey = aws.ToString(params.Key)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3Client) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.created = true
+	f.putKey = aws.ToString(params.Key)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeS3Client) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if f.failPart != 0 && int(aws.ToInt32(params.PartNumber)) == f.failPart {
+		return nil, errors.New("part failed")
+	}
+	data, _ := io.ReadAll(params.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// parts are stored by part number, as they may arrive out of order
+	index := int(aws.ToInt32(params.PartNumber)) - 1
+	for len(f.parts) <= index {
+		f.parts = append(f.parts, nil)
+	}
+	f.parts[index] = data
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+}
+
+func (f *fakeS3Client) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if aws.ToString(params.IfNoneMatch) == "*" && f.existing[aws.ToString(params.Key)] {
+		return nil, preconditionFailed()
+	}
+	f.completed = true
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3Client) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func newTestStream(client s3API, partSize int64) *S3Stream {
+	return &S3Stream{
+		uploader: &S3Uploader{
+			bucket:   "test-bucket",
+			logger:   slog.New(slog.NewTextHandler(os.Stderr, nil)),
+			partSize: partSize,
+		},
+		client: client,
+		ctx:    context.Background(),
+		logCtx: slog.Group("s3_stream"),
+		bucket: "test-bucket",
+		key:    "2023-12-25/test.txt",
+	}
+}
+
+func TestS3Stream_SmallFileUsesPutObject(t *testing.T) {
+	client := &fakeS3Client{}
+	stream := newTestStream(client, 10)
+
+	stream.Write([]byte("hello"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+
+	if client.created {
+		t.Error("expected no multipart upload for a file smaller than one part")
+	}
+	if string(client.putObject) != "hello" {
+		t.Errorf("PutObject body = %q, want %q", client.putObject, "hello")
+	}
+}
+
+func TestS3Stream_LargeFileUsesParts(t *testing.T) {
+	client := &fakeS3Client{}
+	stream := newTestStream(client, 4)
+
+	stream.Write([]byte("abcdef"))
+	stream.Write([]byte("ghij"))
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+
+	if !client.completed {
+		t.Error("expected multipart upload to be completed")
+	}
+	want := [][]byte{[]byte("abcd"), []byte("efgh"), []byte("ij")}
+	if len(client.parts) != len(want) {
+		t.Fatalf("uploaded %d parts, want %d", len(client.parts), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(client.parts[i], want[i]) {
+			t.Errorf("part %d = %q, want %q", i+1, client.parts[i], want[i])
+		}
+	}
+}
+
+func TestS3Stream_FailedPartAborts(t *testing.T) {
+	client := &fakeS3Client{failPart: 2}
+	stream := newTestStream(client, 4)
+
+	if _, err := stream.Write([]byte("abcdefgh")); err == nil {
+		t.Fatal("Write() expected error for failed part")
+	}
+	if _, err := stream.Write([]byte("more")); err == nil {
+		t.Error("Write() after failure expected error")
+	}
+	if err := stream.Complete(); err == nil {
+		t.Error("Complete() after failure expected error")
+	}
+	if !client.aborted {
+		t.Error("expected multipart upload to be aborted")
+	}
+	if client.completed {
+		t.Error("expected multipart upload not to be completed")
+	}
+}
+
+func TestS3Stream_ConcurrentParts(t *testing.T) {
+	client := &fakeS3Client{}
+	stream := newTestStream(client, 4)
+	stream.uploader.concurrency = 3
+
+	for _, chunk := range []string{"abcdef", "ghijkl", "mnopqr", "st"} {
+		if _, err := stream.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+	}
+	if err := stream.Complete(); err != nil {
+		t.Fatalf("Complete() unexpected error: %v", err)
+	}
+
+	if !client.completed {
+		t.Error("expected multipart upload to be completed")
+	}
+	var got []byte
+	for _, part := range client.parts {
+		got = append(got, part...)
+	}
+	if string(got) != "abcdefghijklmnopqrst" {
+		t.Errorf("uploaded data = %q, want %q", got, "abcdefghijklmnopqrst")
+	}
+	for i, part := range stream.parts {
+		if aws.ToInt32(part.PartNumber) != int32(i+1) {
+			t.Errorf("completed part %d has number %d, want parts in order", i, aws.ToInt32(part.PartNumber))
+		}
+	}
+}
+
+func TestS3Stream_ConcurrentFailedPartAborts(t *testing.T) {
+	client := &fakeS3Client{failPart: 2}
+	stream := newTestStream(client, 4)
+	stream.uploader.concurrency = 3
+
+	stream.Write([]byte("abcdefghijkl"))
+	if err := stream.Complete(); err == nil {
+		t.Error("Complete() expected error for failed part")
+	}
+	if !client.aborted {
+		t.Error("expected multipart upload to be aborted")
+	}
+	if client.completed {
+		t.Error("expected multipart upload not to be completed")
+	}
+}
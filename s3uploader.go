@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
-	"path/filepath"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -13,99 +14,330 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// s3API is the part of the S3 client used by the uploader, so tests can
+// substitute a fake.
+type s3API interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// uploadSession identifies the SFTP session a file arrived on. Uploads are
+// signed with the session's credentials, or with the gateway's own
+// credentials when the user authenticated without AWS keys.
+type uploadSession struct {
+	user              string // SSH user name
+	accessKeyID       string
+	secretAccessKey   string
+	sessionToken      string // set for temporary credentials of an assumed role
+	accountID         string
+	clientIP          string
+	sessionID         string   // see getSessionID
+	port              int      // the listener the client connected to, see SFTP_PORT
+	prefix            string   // per-user prefix below S3_BUCKET_PREFIX
+	quota             int64    // bytes the user may upload per day, unlimited if zero
+	country           string   // ISO country code of the client, see GEOIP_DB
+	bucket            string   // overrides S3_BUCKET for this session if set
+	bucketPrefix      string   // overrides S3_BUCKET_PREFIX if set, see UPLOAD_ROUTES
+	maxFileSize       int64    // overrides MAX_FILE_SIZE for this session if set
+	allowedExtensions []string // file extensions the user may upload, any if empty
+	traceParent       string   // W3C traceparent of the login, see OTEL_EXPORTER_OTLP_ENDPOINT
+	replicas          []regionalBucket
+}
+
 type S3Uploader struct {
 	bucket       string
 	bucketPrefix string
 	region       string
 	logger       *slog.Logger
 	timeFunc     func() time.Time
+	keyLocation  *time.Location // time zone for the date partition, UTC if nil
+	keyTolerance time.Duration  // grace period after midnight that still counts as the previous day
+	dateLayout   string         // layout of {date}, keyDateDay if empty
+	partSize     int64          // multipart part size for streaming uploads
+	concurrency  int            // parts of a streaming upload sent at the same time
+	retry        retryPolicy
+	checksum     checksum
+	storageClass types.StorageClass
+	sse          types.ServerSideEncryption
+	sseKMSKeyID  string
+	endpointURL  string          // custom endpoint for S3-compatible stores
+	httpClient   aws.HTTPClient  // shared client for S3 requests, SDK default if nil
+	pathStyle    bool            // use path-style instead of virtual-hosted style URLs
+	keyTemplate  string          // layout of generated keys, defaultKeyTemplate if empty
+	keyCollision string          // what to do when a key is already taken, see keyCollisionOverwrite
+	replication  string          // whether a failed replica fails the upload, see replicaPolicyPrimary
+	failover     regionalBucket  // where files go when their bucket can't be reached, see FAILOVER_BUCKET
+	metadata     []metadataEntry // added to every object, see OBJECT_METADATA
+	partnerID    *regexp.Regexp  // derives {partner} from the user name, nil for the whole name
+	tracer       *tracer         // nil without OTEL_EXPORTER_OTLP_ENDPOINT
+	metrics      *metrics        // nil without ADMIN_ADDR
+	gateway      gatewayClient   // signs uploads of users without AWS keys of their own
 }
 
-func NewS3Uploader(bucket, bucketPrefix, region string, logger *slog.Logger) *S3Uploader {
+func NewS3Uploader(config *Config, logger *slog.Logger) *S3Uploader {
 	return &S3Uploader{
-		bucket:       bucket,
-		bucketPrefix: bucketPrefix,
-		region:       region,
+		bucket:       config.S3Bucket,
+		bucketPrefix: config.S3BucketPrefix,
+		region:       config.S3Region,
 		logger:       logger,
 		timeFunc:     time.Now,
+		keyLocation:  config.KeyTimestampTZ,
+		keyTolerance: config.KeyTimestampTolerance,
+		dateLayout:   config.KeyDateLayout,
+		partSize:     config.MultipartPartSize,
+		concurrency:  config.MultipartConcurrency,
+		retry:        newRetryPolicy(config),
+		checksum:     newChecksum(config.UploadChecksum),
+		storageClass: types.StorageClass(config.S3StorageClass),
+		sse:          types.ServerSideEncryption(config.S3SSE),
+		sseKMSKeyID:  config.S3SSEKMSKeyID,
+		endpointURL:  config.S3EndpointURL,
+		httpClient:   newAWSHTTPClient(config, config.S3InsecureSkipVerify),
+		pathStyle:    config.S3ForcePathStyle,
+		keyTemplate:  config.S3KeyTemplate,
+		keyCollision: config.S3KeyCollision,
+		replication:  config.ReplicaPolicy,
+		failover:     config.FailoverBucket,
+		metadata:     config.ObjectMetadata,
+		partnerID:    config.PartnerIDPattern,
 	}
 }
 
-func (u *S3Uploader) UploadFile(ctx context.Context, accessKeyID, secretAccessKey, clientIP, filePath string, data []byte) error {
+// UploadFile stores the size bytes of body as a single object and returns
+// its bucket and key, also when storing it failed. The bucket is
+// FAILOVER_BUCKET if the file had to be stored there. body may be an
+// in-memory buffer or a spill file on disk.
+func (u *S3Uploader) UploadFile(ctx context.Context, session uploadSession, filePath string, body io.ReaderAt, size int64) (bucket, key string, err error) {
+	bucket = u.bucketFor(session)
+
+	ctx, span := u.tracer.start(ctx, "s3.upload",
+		slog.String("aws.s3.bucket", bucket),
+		slog.String("file.path", filePath),
+		slog.Int64("file.size", size),
+	)
+	defer func() { span.finish(err) }()
+
 	logCtx := slog.Group("s3_upload",
-		"remote_ip", clientIP,
-		"access_key_id", accessKeyID,
+		"remote_ip", session.clientIP,
+		"session_id", session.sessionID,
+		"country", session.country,
+		"access_key_id", session.accessKeyID,
 		"file_path", filePath,
-		"file_size", len(data),
-		"bucket", u.bucket,
+		"file_size", size,
+		"bucket", bucket,
 	)
 
 	u.logger.Info("starting S3 upload", logCtx)
 
-	configOptions := []func(*config.LoadOptions) error{
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			accessKeyID,
-			secretAccessKey,
-			"",
-		)),
+	s3Client, err := u.newClient(ctx, session.accessKeyID, session.secretAccessKey, session.sessionToken)
+	if err != nil {
+		u.logger.Error("failed to load AWS config for upload", logCtx, slog.String("error", err.Error()))
+		return bucket, "", fmt.Errorf("failed to configure AWS client: %w", err)
+	}
+
+	key = u.generateS3Key(filePath, session)
+
+	digest, err := u.checksum.digestReader(io.NewSectionReader(body, 0, size))
+	if err != nil {
+		u.logger.Error("failed to read upload data", logCtx, slog.String("error", err.Error()))
+		return bucket, key, fmt.Errorf("failed to read upload data: %w", err)
 	}
 
+	input := u.putObjectInput(key, detectContentType(filePath, readHead(body, size)), u.objectMetadata(session, filePath), digest)
+	input.Bucket = aws.String(bucket)
+
+	started := time.Now()
+	err = u.putObject(ctx, s3Client, logCtx, input, body, size)
+	u.metrics.observeS3Put(bucket, u.keyPrefix(session), session.port, time.Since(started), err)
+	if err != nil {
+		err = u.storeFailover(ctx, s3Client, logCtx, input, body, size, err)
+		bucket = aws.ToString(input.Bucket)
+	}
+	key = aws.ToString(input.Key)
+	span.setAttrs(slog.String("aws.s3.key", key))
+
+	if err != nil {
+		u.logger.Error("S3 upload failed", logCtx,
+			slog.String("s3_key", key),
+			slog.String("error", err.Error()),
+		)
+		return bucket, key, fmt.Errorf("failed to upload to S3: %w", err)
+	}
+
+	u.logger.Info("S3 upload successful", logCtx, slog.String("s3_key", key))
+	if err := u.storeReplicas(ctx, s3Client, logCtx, session.replicas, input, body, size); err != nil {
+		return bucket, key, err
+	}
+	return bucket, key, nil
+}
+
+// bucketFor returns the bucket uploads of session are stored in.
+func (u *S3Uploader) bucketFor(session uploadSession) string {
+	if session.bucket != "" {
+		return session.bucket
+	}
+	return u.bucket
+}
+
+// keyPrefix returns the prefix of the keys uploads of session are stored
+// under.
+func (u *S3Uploader) keyPrefix(session uploadSession) string {
+	if session.bucketPrefix != "" {
+		return path.Join(session.bucketPrefix, session.prefix)
+	}
+	return path.Join(u.bucketPrefix, session.prefix)
+}
+
+// keyTime returns the time used for the date partition of generated keys.
+// Uploads that arrive within keyTolerance after midnight are attributed to
+// the previous day, so small clock differences between partners and the
+// gateway don't split a day's batch across two folders. They get the last
+// hour of that day for {hh}; at any other time the tolerance doesn't move
+// files to the previous hour.
+func (u *S3Uploader) keyTime() time.Time {
+	loc := u.keyLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+	now := u.timeFunc().In(loc)
+	earlier := now.Add(-u.keyTolerance)
+	if y, m, d := earlier.Date(); y != now.Year() || m != now.Month() || d != now.Day() {
+		return earlier
+	}
+	return now
+}
+
+// newClient creates an S3 client that signs requests with the credentials
+// the SFTP user authenticated with. Without an access key the gateway's own
+// client is returned, see gatewayClient.
+func (u *S3Uploader) newClient(ctx context.Context, accessKeyID, secretAccessKey, sessionToken string) (*s3.Client, error) {
+	if accessKeyID == "" {
+		return u.gatewayClient(ctx)
+	}
+	return u.loadClient(ctx, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+		accessKeyID,
+		secretAccessKey,
+		sessionToken,
+	)))
+}
+
+// loadClient creates an S3 client with the gateway's S3 settings and the
+// given options, with the credentials from the default chain unless they
+// set others.
+func (u *S3Uploader) loadClient(ctx context.Context, options ...func(*config.LoadOptions) error) (*s3.Client, error) {
+	configOptions := options
 	if u.region != "" {
 		configOptions = append(configOptions, config.WithRegion(u.region))
 	}
 
+	if u.httpClient != nil {
+		configOptions = append(configOptions, config.WithHTTPClient(u.httpClient))
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx, configOptions...)
 	if err != nil {
-		u.logger.Error("failed to load AWS config for upload", logCtx, slog.String("error", err.Error()))
-		return fmt.Errorf("failed to configure AWS client: %w", err)
+		return nil, err
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if u.endpointURL != "" {
+			o.BaseEndpoint = aws.String(u.endpointURL)
+		}
+		o.UsePathStyle = u.pathStyle
+	}), nil
+}
 
-	key := u.generateS3Key(filePath)
+// putObjectInput builds the PutObject request for a whole file, applying the
+// per-object settings shared by buffered and streaming uploads. digest is the
+// checksum of the file; the body is set by putObject.
+func (u *S3Uploader) putObjectInput(key, contentType string, metadata map[string]string, digest []byte) *s3.PutObjectInput {
+	checksumSHA256, checksumCRC32 := u.checksum.fields(digest)
 
-	uploadCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	defer cancel()
+	return &s3.PutObjectInput{
+		Bucket:               aws.String(u.bucket),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		Metadata:             u.checksum.addMetadata(metadata, digest),
+		StorageClass:         u.storageClass,
+		ServerSideEncryption: u.sse,
+		SSEKMSKeyId:          u.kmsKeyID(),
+		ChecksumAlgorithm:    u.checksum.algorithm,
+		ChecksumSHA256:       checksumSHA256,
+		ChecksumCRC32:        checksumCRC32,
+		IfNoneMatch:          u.ifNoneMatch(),
+	}
+}
 
-	_, err = s3Client.PutObject(uploadCtx, &s3.PutObjectInput{
-		Bucket: aws.String(u.bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(data),
-		Metadata: map[string]string{
-			"client-ip":       clientIP,
-			"access-key-id":   accessKeyID,
-			"upload-time":     u.timeFunc().UTC().Format(time.RFC3339),
-			"original-path":   filePath,
-		},
-	})
+// createMultipartUploadInput is the multipart counterpart of putObjectInput.
+func (u *S3Uploader) createMultipartUploadInput(key, contentType string, metadata map[string]string) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(u.bucket),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		Metadata:             metadata,
+		StorageClass:         u.storageClass,
+		ServerSideEncryption: u.sse,
+		SSEKMSKeyId:          u.kmsKeyID(),
+		ChecksumAlgorithm:    u.checksum.algorithm,
+	}
+}
 
-	if err != nil {
-		u.logger.Error("S3 upload failed", logCtx, 
-			slog.String("s3_key", key),
-			slog.String("error", err.Error()),
-		)
-		return fmt.Errorf("failed to upload to S3: %w", err)
+// kmsKeyID returns the KMS key for SSE-KMS, or nil to use the AWS managed key.
+func (u *S3Uploader) kmsKeyID() *string {
+	if u.sseKMSKeyID == "" {
+		return nil
 	}
+	return aws.String(u.sseKMSKeyID)
+}
 
-	u.logger.Info("S3 upload successful", logCtx, slog.String("s3_key", key))
-	return nil
+// objectMetadata returns the user metadata stored with the object: where
+// and when the file arrived, and the entries of OBJECT_METADATA.
+func (u *S3Uploader) objectMetadata(session uploadSession, filePath string) map[string]string {
+	return addCustomMetadata(map[string]string{
+		"client-ip":     session.clientIP,
+		"session-id":    session.sessionID,
+		"access-key-id": session.accessKeyID,
+		"upload-time":   u.timeFunc().UTC().Format(time.RFC3339),
+		"original-path": filePath,
+	}, u.metadata, u.partnerID, session)
 }
 
-func (u *S3Uploader) generateS3Key(filePath string) string {
-	timestamp := u.timeFunc().UTC().Format("2006-01-02")
-	
-	filename := filepath.Base(filePath)
+func (u *S3Uploader) generateS3Key(filePath string, session uploadSession) string {
+	keyTime := u.keyTime()
+
+	filename := path.Base(filePath)
 	if filename == "" || filename == "." || filename == "/" {
 		filename = "unknown"
 	}
-	
+
 	sanitizedFilename := strings.ReplaceAll(filename, " ", "_")
 	sanitizedFilename = strings.ReplaceAll(sanitizedFilename, "..", "_")
-	
-	if u.bucketPrefix != "" {
-		return fmt.Sprintf("%s/%s/%s", u.bucketPrefix, timestamp, sanitizedFilename)
+
+	template := u.keyTemplate
+	if template == "" {
+		template = defaultKeyTemplate
 	}
-	return fmt.Sprintf("%s/%s", timestamp, sanitizedFilename)
-}
\ No newline at end of file
+
+	return expandKeyTemplate(template, map[string]string{
+		"prefix":        u.keyPrefix(session),
+		"date":          keyDate(keyTime, u.dateLayout),
+		"yyyy":          keyTime.Format("2006"),
+		"mm":            keyTime.Format("01"),
+		"dd":            keyTime.Format("02"),
+		"hh":            keyTime.Format("15"),
+		"filename":      sanitizedFilename,
+		"access_key_id": session.accessKeyID,
+		"account_id":    session.accountID,
+		"client_ip":     session.clientIP,
+		"session_id":    session.sessionID,
+		"uuid":          newUUID(),
+	})
+}
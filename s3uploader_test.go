@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func TestS3Uploader_generateS3Key(t *testing.T) {
 	// Mock time for consistent testing
 	now := time.Date(2023, 12, 25, 10, 30, 0, 0, time.UTC)
-	
+
 	tests := []struct {
 		name         string
 		uploader     *S3Uploader
@@ -31,7 +35,7 @@ func TestS3Uploader_generateS3Key(t *testing.T) {
 			expectPrefix: false,
 		},
 		{
-			name: "simple filename with prefix", 
+			name: "simple filename with prefix",
 			uploader: &S3Uploader{
 				bucket:       "test-bucket",
 				bucketPrefix: "sftp-uploads",
@@ -43,7 +47,7 @@ func TestS3Uploader_generateS3Key(t *testing.T) {
 		{
 			name: "filename with spaces",
 			uploader: &S3Uploader{
-				bucket:       "test-bucket", 
+				bucket:       "test-bucket",
 				bucketPrefix: "",
 			},
 			filePath:     "/uploads/my file.txt",
@@ -86,14 +90,14 @@ func TestS3Uploader_generateS3Key(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Set custom time function for consistent testing
 			tt.uploader.timeFunc = func() time.Time { return now }
-			
-			result := tt.uploader.generateS3Key(tt.filePath)
-			
+
+			result := tt.uploader.generateS3Key(tt.filePath, uploadSession{})
+
 			// Check if result contains expected date
 			if !strings.Contains(result, tt.expectedDate) {
 				t.Errorf("generateS3Key() = %q, expected to contain date %q", result, tt.expectedDate)
 			}
-			
+
 			// Check prefix handling
 			if tt.expectPrefix {
 				if !strings.HasPrefix(result, tt.uploader.bucketPrefix+"/") {
@@ -105,17 +109,17 @@ func TestS3Uploader_generateS3Key(t *testing.T) {
 					t.Errorf("generateS3Key() = %q, expected to start with date %q when no prefix", result, tt.expectedDate)
 				}
 			}
-			
+
 			// Check sanitization of spaces
 			if strings.Contains(tt.filePath, " ") && strings.Contains(result, " ") {
 				t.Errorf("generateS3Key() = %q, expected spaces to be replaced with underscores", result)
 			}
-			
-			// Check sanitization of .. 
+
+			// Check sanitization of ..
 			if strings.Contains(tt.filePath, "..") && strings.Contains(result, "..") {
 				t.Errorf("generateS3Key() = %q, expected .. to be replaced with underscores", result)
 			}
-			
+
 			// Check that only specific edge cases become "unknown"
 			filename := filepath.Base(tt.filePath)
 			if (filename == "" || filename == "." || filename == "/") && !strings.Contains(result, "unknown") {
@@ -132,11 +136,11 @@ func TestS3Uploader_generateS3Key_Sanitization(t *testing.T) {
 		logger:       slog.New(slog.NewTextHandler(os.Stderr, nil)),
 		timeFunc:     time.Now,
 	}
-	
+
 	tests := []struct {
-		name         string
-		filePath     string
-		expectInKey  string
+		name           string
+		filePath       string
+		expectInKey    string
 		notExpectInKey string
 	}{
 		{
@@ -147,7 +151,7 @@ func TestS3Uploader_generateS3Key_Sanitization(t *testing.T) {
 		},
 		{
 			name:           "path traversal replaced",
-			filePath:       "/uploads/my..file.txt", 
+			filePath:       "/uploads/my..file.txt",
 			expectInKey:    "my_file.txt",
 			notExpectInKey: "..",
 		},
@@ -161,12 +165,12 @@ func TestS3Uploader_generateS3Key_Sanitization(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := uploader.generateS3Key(tt.filePath)
-			
+			result := uploader.generateS3Key(tt.filePath, uploadSession{})
+
 			if !strings.Contains(result, tt.expectInKey) {
 				t.Errorf("generateS3Key() = %q, expected to contain %q", result, tt.expectInKey)
 			}
-			
+
 			if strings.Contains(result, tt.notExpectInKey) {
 				t.Errorf("generateS3Key() = %q, expected NOT to contain %q", result, tt.notExpectInKey)
 			}
@@ -191,13 +195,13 @@ func TestS3Uploader_generateS3Key_EdgeCases(t *testing.T) {
 
 	for _, filePath := range edgeCases {
 		t.Run("edge_case_"+filePath, func(t *testing.T) {
-			result := uploader.generateS3Key(filePath)
-			
+			result := uploader.generateS3Key(filePath, uploadSession{})
+
 			// All edge cases should result in "unknown" filename
 			if !strings.Contains(result, "unknown") {
 				t.Errorf("generateS3Key(%q) = %q, expected to contain 'unknown' for edge case", filePath, result)
 			}
-			
+
 			// Should still have proper structure with prefix and date
 			expectedParts := []string{uploader.bucketPrefix, "unknown"}
 			for _, part := range expectedParts {
@@ -207,29 +211,263 @@ func TestS3Uploader_generateS3Key_EdgeCases(t *testing.T) {
 			}
 		})
 	}
-	
+
 	// Test cases that do NOT become "unknown"
-	nonUnknownCases := []struct{
-		input string
+	nonUnknownCases := []struct {
+		input            string
 		expectedFilename string
 	}{
 		{"/uploads/", "uploads"},
 		{"/uploads/..", "_"},
 		{"/uploads/...", "_."},
+		{`/uploads/a\b.txt`, `a\b.txt`}, // a backslash is part of the name, on every OS
 	}
-	
+
 	for _, tc := range nonUnknownCases {
 		t.Run("non_unknown_case_"+tc.input, func(t *testing.T) {
-			result := uploader.generateS3Key(tc.input)
-			
+			result := uploader.generateS3Key(tc.input, uploadSession{})
+
 			// Should contain the expected filename, not "unknown"
 			if !strings.Contains(result, tc.expectedFilename) {
 				t.Errorf("generateS3Key(%q) = %q, expected to contain filename %q", tc.input, result, tc.expectedFilename)
 			}
-			
+
 			if strings.Contains(result, "unknown") {
 				t.Errorf("generateS3Key(%q) = %q, expected NOT to contain 'unknown'", tc.input, result)
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestS3Uploader_generateS3Key_KeyTimestamp(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		location  *time.Location
+		tolerance time.Duration
+		template  string
+		layout    string
+		expected  string
+	}{
+		{
+			name:     "defaults to UTC",
+			now:      time.Date(2023, 12, 25, 2, 0, 0, 0, time.UTC),
+			expected: "2023-12-25/test.txt",
+		},
+		{
+			name:     "local business day",
+			now:      time.Date(2023, 12, 25, 2, 0, 0, 0, time.UTC),
+			location: newYork,
+			expected: "2023-12-24/test.txt",
+		},
+		{
+			name:      "within tolerance after midnight",
+			now:       time.Date(2023, 12, 25, 0, 3, 0, 0, time.UTC),
+			tolerance: 5 * time.Minute,
+			expected:  "2023-12-24/test.txt",
+		},
+		{
+			name:      "past tolerance after midnight",
+			now:       time.Date(2023, 12, 25, 0, 6, 0, 0, time.UTC),
+			tolerance: 5 * time.Minute,
+			expected:  "2023-12-25/test.txt",
+		},
+		{
+			name:      "hour within tolerance after midnight",
+			now:       time.Date(2023, 12, 25, 0, 3, 0, 0, time.UTC),
+			tolerance: 5 * time.Minute,
+			template:  "{yyyy}/{mm}/{dd}/{hh}/{filename}",
+			expected:  "2023/12/24/23/test.txt",
+		},
+		{
+			name:      "hour within tolerance after the hour",
+			now:       time.Date(2023, 12, 25, 9, 3, 0, 0, time.UTC),
+			tolerance: 5 * time.Minute,
+			template:  "{yyyy}/{mm}/{dd}/{hh}/{filename}",
+			expected:  "2023/12/25/09/test.txt",
+		},
+		{
+			name:      "hourly layout within tolerance after the hour",
+			now:       time.Date(2023, 12, 25, 9, 3, 0, 0, time.UTC),
+			tolerance: 5 * time.Minute,
+			layout:    keyDateHourly,
+			expected:  "2023/12/25/09/test.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &S3Uploader{
+				bucket:       "test-bucket",
+				timeFunc:     func() time.Time { return tt.now },
+				keyLocation:  tt.location,
+				keyTolerance: tt.tolerance,
+				keyTemplate:  tt.template,
+				dateLayout:   tt.layout,
+			}
+
+			if result := uploader.generateS3Key("/uploads/test.txt", uploadSession{}); result != tt.expected {
+				t.Errorf("generateS3Key() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestS3Uploader_generateS3Key_DateLayout(t *testing.T) {
+	now := time.Date(2023, 12, 25, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		layout   string
+		expected string
+	}{
+		{layout: "", expected: "uploads/2023-12-25/test.txt"},
+		{layout: keyDateDay, expected: "uploads/2023-12-25/test.txt"},
+		{layout: keyDateYMD, expected: "uploads/2023/12/25/test.txt"},
+		{layout: keyDateHourly, expected: "uploads/2023/12/25/09/test.txt"},
+		{layout: keyDateNone, expected: "uploads/test.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			uploader := &S3Uploader{
+				bucket:       "test-bucket",
+				bucketPrefix: "uploads",
+				timeFunc:     func() time.Time { return now },
+				dateLayout:   tt.layout,
+			}
+
+			if result := uploader.generateS3Key("/uploads/test.txt", uploadSession{}); result != tt.expected {
+				t.Errorf("generateS3Key() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestS3Uploader_putObjectInput(t *testing.T) {
+	uploader := &S3Uploader{
+		bucket:       "test-bucket",
+		storageClass: types.StorageClassGlacierIr,
+		sse:          types.ServerSideEncryptionAwsKms,
+		sseKMSKeyID:  "arn:aws:kms:us-east-1:123456789012:key/test",
+	}
+
+	input := uploader.putObjectInput("2023-12-25/test.txt", "text/plain; charset=utf-8", map[string]string{"client-ip": "127.0.0.1"}, nil)
+
+	if aws.ToString(input.Bucket) != "test-bucket" {
+		t.Errorf("Bucket = %q, want %q", aws.ToString(input.Bucket), "test-bucket")
+	}
+	if aws.ToString(input.Key) != "2023-12-25/test.txt" {
+		t.Errorf("Key = %q, want %q", aws.ToString(input.Key), "2023-12-25/test.txt")
+	}
+	if input.StorageClass != types.StorageClassGlacierIr {
+		t.Errorf("StorageClass = %q, want %q", input.StorageClass, types.StorageClassGlacierIr)
+	}
+	if input.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("ServerSideEncryption = %q, want %q", input.ServerSideEncryption, types.ServerSideEncryptionAwsKms)
+	}
+	if aws.ToString(input.SSEKMSKeyId) != uploader.sseKMSKeyID {
+		t.Errorf("SSEKMSKeyId = %q, want %q", aws.ToString(input.SSEKMSKeyId), uploader.sseKMSKeyID)
+	}
+	if input.Metadata["client-ip"] != "127.0.0.1" {
+		t.Errorf("Metadata = %v, expected client-ip to be set", input.Metadata)
+	}
+
+	if aws.ToString(input.ContentType) != "text/plain; charset=utf-8" {
+		t.Errorf("ContentType = %q, want %q", aws.ToString(input.ContentType), "text/plain; charset=utf-8")
+	}
+
+	multipart := uploader.createMultipartUploadInput("2023-12-25/test.txt", "text/plain; charset=utf-8", nil)
+	if multipart.StorageClass != types.StorageClassGlacierIr {
+		t.Errorf("multipart StorageClass = %q, want %q", multipart.StorageClass, types.StorageClassGlacierIr)
+	}
+	if aws.ToString(multipart.SSEKMSKeyId) != uploader.sseKMSKeyID {
+		t.Errorf("multipart SSEKMSKeyId = %q, want %q", aws.ToString(multipart.SSEKMSKeyId), uploader.sseKMSKeyID)
+	}
+
+	if input := (&S3Uploader{}).putObjectInput("key", "application/octet-stream", nil, nil); input.SSEKMSKeyId != nil {
+		t.Errorf("SSEKMSKeyId = %q, want nil when no key is configured", aws.ToString(input.SSEKMSKeyId))
+	}
+}
+
+func TestS3Uploader_newClient_Endpoint(t *testing.T) {
+	uploader := &S3Uploader{
+		region:      "us-east-1",
+		endpointURL: "http://localhost:9000",
+		pathStyle:   true,
+	}
+
+	client, err := uploader.newClient(context.Background(), "AKIATEST", "secret", "")
+	if err != nil {
+		t.Fatalf("newClient() unexpected error: %v", err)
+	}
+
+	if endpoint := aws.ToString(client.Options().BaseEndpoint); endpoint != "http://localhost:9000" {
+		t.Errorf("BaseEndpoint = %q, want %q", endpoint, "http://localhost:9000")
+	}
+	if !client.Options().UsePathStyle {
+		t.Error("UsePathStyle = false, want true")
+	}
+}
+
+func TestS3Uploader_generateS3Key_Template(t *testing.T) {
+	session := uploadSession{
+		accessKeyID: "AKIATEST123",
+		accountID:   "123456789012",
+		clientIP:    "192.168.1.100",
+	}
+
+	uploader := &S3Uploader{
+		bucket:       "test-bucket",
+		bucketPrefix: "ingest",
+		timeFunc:     func() time.Time { return time.Date(2023, 12, 25, 10, 30, 0, 0, time.UTC) },
+		keyTemplate:  "{prefix}/{account_id}/{yyyy}/{mm}/{dd}/{hh}/{client_ip}-{filename}",
+	}
+
+	expected := "ingest/123456789012/2023/12/25/10/192.168.1.100-my_file.txt"
+	if result := uploader.generateS3Key("/uploads/my file.txt", session); result != expected {
+		t.Errorf("generateS3Key() = %q, want %q", result, expected)
+	}
+
+	session.sessionID = "0123456789abcdef"
+	uploader.keyTemplate = "{prefix}/{date}/{session_id}/{filename}"
+	expected = "ingest/2023-12-25/0123456789abcdef/my_file.txt"
+	if result := uploader.generateS3Key("/uploads/my file.txt", session); result != expected {
+		t.Errorf("generateS3Key() = %q, want %q", result, expected)
+	}
+	if metadata := uploader.objectMetadata(session, "/uploads/my file.txt"); metadata["session-id"] != session.sessionID {
+		t.Errorf("objectMetadata() = %v, want session-id %s", metadata, session.sessionID)
+	}
+}
+func TestS3Uploader_generateS3Key_SessionPrefix(t *testing.T) {
+	uploader := &S3Uploader{
+		bucket:   "test-bucket",
+		timeFunc: func() time.Time { return time.Date(2023, 12, 25, 10, 30, 0, 0, time.UTC) },
+	}
+
+	session := uploadSession{prefix: "alice"}
+	if result := uploader.generateS3Key("/uploads/test.txt", session); result != "alice/2023-12-25/test.txt" {
+		t.Errorf("generateS3Key() = %q, want %q", result, "alice/2023-12-25/test.txt")
+	}
+
+	uploader.bucketPrefix = "partners"
+	if result := uploader.generateS3Key("/uploads/test.txt", session); result != "partners/alice/2023-12-25/test.txt" {
+		t.Errorf("generateS3Key() = %q, want %q", result, "partners/alice/2023-12-25/test.txt")
+	}
+}
+
+func TestS3Uploader_generateS3Key_RoutePrefix(t *testing.T) {
+	uploader := &S3Uploader{
+		bucket:       "test-bucket",
+		bucketPrefix: "partners",
+		timeFunc:     func() time.Time { return time.Date(2023, 12, 25, 10, 30, 0, 0, time.UTC) },
+	}
+
+	session := uploadSession{prefix: "alice", bucketPrefix: "finance"}
+	if result := uploader.generateS3Key("/uploads/test.txt", session); result != "finance/alice/2023-12-25/test.txt" {
+		t.Errorf("generateS3Key() = %q, want %q", result, "finance/alice/2023-12-25/test.txt")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// scpOpenFlags are the SFTP open flags (write, create, truncate) SCP uploads
+// are made with. SCP always sends whole files, so a suspended upload of the
+// same path is never resumed.
+const scpOpenFlags = 0x02 | 0x08 | 0x10
+
+// scpCommand is a parsed "scp -t" command, the sink side of the legacy SCP
+// protocol that "scp -O" and older clients run on the server.
+type scpCommand struct {
+	target    string
+	recursive bool // -r, the client may send directories
+	targetDir bool // -d, the target must be a directory
+}
+
+// parseSCPCommand parses the command of an exec request. It returns false if
+// the command is not an SCP upload.
+func parseSCPCommand(command string) (scpCommand, bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || path.Base(fields[0]) != "scp" {
+		return scpCommand{}, false
+	}
+
+	var cmd scpCommand
+	sink := false
+	args := fields[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag := args[0]
+		args = args[1:]
+		if flag == "--" {
+			break
+		}
+		for _, c := range flag[1:] {
+			switch c {
+			case 't':
+				sink = true
+			case 'r':
+				cmd.recursive = true
+			case 'd':
+				cmd.targetDir = true
+			case 'p', 'v', 'q':
+				// times are ignored, and verbose and quiet only change
+				// what the client prints
+			default:
+				return scpCommand{}, false
+			}
+		}
+	}
+	if !sink || len(args) == 0 {
+		return scpCommand{}, false
+	}
+
+	cmd.target = strings.Join(args, " ")
+	if len(cmd.target) >= 2 && (cmd.target[0] == '"' || cmd.target[0] == '\'') && cmd.target[len(cmd.target)-1] == cmd.target[0] {
+		cmd.target = cmd.target[1 : len(cmd.target)-1]
+	}
+	return cmd, true
+}
+
+// scpSink receives files over the SCP protocol and uploads them through the
+// session's SFTP handler, so they get the same path checks, limits and S3
+// pipeline as SFTP uploads.
+type scpSink struct {
+	rw      io.ReadWriter
+	in      *bufio.Reader
+	handler *SessionSFTPHandler
+	logger  *slog.Logger
+	failed  bool // a file was rejected, the exit status is 1
+}
+
+func newSCPSink(rw io.ReadWriter, handler *SessionSFTPHandler, logger *slog.Logger) *scpSink {
+	return &scpSink{
+		rw:      rw,
+		in:      bufio.NewReader(rw),
+		handler: handler,
+		logger:  logger,
+	}
+}
+
+// run receives files until the client is done and returns the exit status
+// for the session.
+func (s *scpSink) run(cmd scpCommand) uint32 {
+	target := cmd.target
+	if !path.IsAbs(target) {
+		target = path.Join(s.handler.handler.config.VirtualDir, target)
+	}
+	target = path.Clean(target)
+
+	// The target is a directory if the client says so, or if it names one;
+	// otherwise a single file is stored under the target name, as with cp.
+	targetIsDir := cmd.targetDir || cmd.recursive || strings.HasSuffix(cmd.target, "/") ||
+		target == path.Clean(s.handler.handler.config.VirtualDir)
+
+	dirs := []string{target}
+	if err := s.ack(); err != nil {
+		return 1
+	}
+
+	for {
+		line, err := s.in.ReadSlice('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			s.logger.Warn("SCP upload ended: failed to read command",
+				slog.String("remote_ip", s.handler.clientIP),
+				slog.String("session_id", s.handler.sessionID),
+				slog.String("error", err.Error()),
+			)
+			return 1
+		}
+		record := strings.TrimSuffix(string(line), "\n")
+		if record == "" {
+			s.fatal("protocol error: empty command")
+			return 1
+		}
+
+		switch record[0] {
+		case 'T':
+			// modification times are not kept in S3
+			err = s.ack()
+		case 'C':
+			dest := ""
+			if len(dirs) == 1 && !targetIsDir {
+				dest = target
+			}
+			err = s.receiveFile(record, dirs[len(dirs)-1], dest)
+		case 'D':
+			if !cmd.recursive {
+				s.fatal("protocol error: directory sent without -r")
+				return 1
+			}
+			var name string
+			if name, err = scpName(record); err != nil {
+				s.fatal(err.Error())
+				return 1
+			}
+			dirs = append(dirs, path.Join(dirs[len(dirs)-1], name))
+			err = s.ack()
+		case 'E':
+			if len(dirs) == 1 {
+				s.fatal("protocol error: unexpected end of directory")
+				return 1
+			}
+			dirs = dirs[:len(dirs)-1]
+			err = s.ack()
+		case '\x01', '\x02':
+			// an error on the client side, such as a file it could not read
+			s.logger.Warn("SCP client reported an error",
+				slog.String("remote_ip", s.handler.clientIP),
+				slog.String("session_id", s.handler.sessionID),
+				slog.String("error", record[1:]),
+			)
+			s.failed = true
+			if record[0] == '\x02' {
+				return 1
+			}
+		default:
+			s.fatal(fmt.Sprintf("protocol error: unknown command %q", record[0]))
+			return 1
+		}
+		if err != nil {
+			s.logger.Warn("SCP upload ended",
+				slog.String("remote_ip", s.handler.clientIP),
+				slog.String("session_id", s.handler.sessionID),
+				slog.String("error", err.Error()),
+			)
+			return 1
+		}
+	}
+
+	if s.failed {
+		return 1
+	}
+	return 0
+}
+
+// receiveFile handles a "C<mode> <size> <name>" record and the file data
+// following it. The file is stored as dir/name, or as dest if that is set.
+// Errors with a single file are reported to the client, which moves on to
+// the next one; only connection errors are returned.
+func (s *scpSink) receiveFile(record, dir, dest string) error {
+	fields := strings.SplitN(record, " ", 3)
+	if len(fields) != 3 {
+		return s.fatal("protocol error: malformed file record")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return s.fatal("protocol error: invalid file size")
+	}
+	name, err := scpName(record)
+	if err != nil {
+		return s.fatal(err.Error())
+	}
+	if dest == "" {
+		dest = path.Join(dir, name)
+	}
+
+	r := sftp.NewRequest("Put", dest)
+	r.Flags = scpOpenFlags
+	writer, err := s.handler.Filewrite(r)
+	if err != nil {
+		// the client skips the file data after an error
+		return s.reject(dest, err)
+	}
+	fw := writer.(*FileWriter)
+
+	if err := s.ack(); err != nil {
+		fw.discard(err)
+		return err
+	}
+
+	// Read all the data even once writing failed, the client sends it
+	// regardless and waits for an answer at the end.
+	var writeErr error
+	buf := make([]byte, 32*1024)
+	for off := int64(0); off < size; {
+		n, err := s.in.Read(buf[:min(int64(len(buf)), size-off)])
+		if n > 0 && writeErr == nil {
+			_, writeErr = fw.WriteAt(buf[:n], off)
+		}
+		off += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			fw.discard(err)
+			return err
+		}
+	}
+
+	// The data is followed by a status byte, zero unless the client failed
+	// to read the file.
+	status, err := s.in.ReadByte()
+	if err != nil {
+		fw.discard(err)
+		return err
+	}
+	if status != 0 && writeErr == nil {
+		writeErr = errors.New("client failed to send the file")
+	}
+
+	if writeErr != nil {
+		fw.discard(writeErr)
+		return s.reject(dest, writeErr)
+	}
+	if err := fw.Close(); err != nil {
+		return s.reject(dest, err)
+	}
+	return s.ack()
+}
+
+// discard drops an upload that failed. Unlike an interrupted SFTP upload it
+// is never kept for resuming, as SCP can't continue a partial file.
+func (fw *FileWriter) discard(err error) {
+	fw.upload.mu.Lock()
+	defer fw.upload.mu.Unlock()
+
+	if fw.closed {
+		return
+	}
+	fw.closed = true
+	fw.conn.endTransfer()
+	fw.handler.activeUploads.Delete(fw.upload.path)
+
+	fw.logger.Warn("upload failed, discarding partial file",
+		slog.String("remote_ip", fw.upload.clientIP),
+		slog.String("session_id", fw.upload.sessionID),
+		slog.String("file_path", fw.upload.path),
+		slog.String("error", err.Error()),
+	)
+	fw.handler.discardUpload(fw.upload)
+}
+
+// scpName returns the file or directory name of a C or D record. Names must
+// not contain a path, as in OpenSSH.
+func scpName(record string) (string, error) {
+	fields := strings.SplitN(record, " ", 3)
+	if len(fields) != 3 {
+		return "", errors.New("protocol error: malformed record")
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("protocol error: invalid name %q", name)
+	}
+	return name, nil
+}
+
+// ack tells the client the last command succeeded.
+func (s *scpSink) ack() error {
+	_, err := s.rw.Write([]byte{0})
+	return err
+}
+
+// reject tells the client a file failed; the client carries on with the next
+// one.
+func (s *scpSink) reject(dest string, err error) error {
+	s.failed = true
+	s.logger.Warn("SCP file rejected",
+		slog.String("remote_ip", s.handler.clientIP),
+		slog.String("session_id", s.handler.sessionID),
+		slog.String("file_path", dest),
+		slog.String("error", err.Error()),
+	)
+	_, werr := fmt.Fprintf(s.rw, "\x01scp: %s: %s\n", dest, scpErrorMessage(err))
+	return werr
+}
+
+// fatal tells the client the transfer is aborted.
+func (s *scpSink) fatal(msg string) error {
+	s.failed = true
+	fmt.Fprintf(s.rw, "\x02scp: %s\n", msg)
+	return errors.New(msg)
+}
+
+// scpErrorMessage turns upload errors into the messages cp would print.
+func scpErrorMessage(err error) string {
+	if errors.Is(err, errExtensionNotAllowed) {
+		return errExtensionNotAllowed.Error()
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return "Permission denied"
+	}
+	return err.Error()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    scpCommand
+		ok      bool
+	}{
+		{"scp -t /uploads", scpCommand{target: "/uploads"}, true},
+		{"scp -v -d -t -- /uploads/dir", scpCommand{target: "/uploads/dir", targetDir: true}, true},
+		{"/usr/bin/scp -rt .", scpCommand{target: ".", recursive: true}, true},
+		{"scp -t '/uploads/my file.txt'", scpCommand{target: "/uploads/my file.txt"}, true},
+		{"scp -f /uploads/file.txt", scpCommand{}, false},
+		{"scp -t", scpCommand{}, false},
+		{"scp -x -t /uploads", scpCommand{}, false},
+		{"ls -la", scpCommand{}, false},
+		{"", scpCommand{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseSCPCommand(tt.command)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseSCPCommand(%q) = %+v, %v, want %+v, %v", tt.command, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// scpConn is the client side of an SCP session: input holds what the client
+// sends, output collects the server's responses.
+type scpConn struct {
+	input  *strings.Reader
+	output bytes.Buffer
+}
+
+func (c *scpConn) Read(p []byte) (int, error)  { return c.input.Read(p) }
+func (c *scpConn) Write(p []byte) (int, error) { return c.output.Write(p) }
+
+func newTestSCPSink(t *testing.T, config *Config, input string) (*scpSink, *scpConn) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	handler := &SessionSFTPHandler{
+		handler:  NewSFTPHandler(config, nil, logger),
+		clientIP: "192.168.1.100",
+		user:     "alice",
+		usage:    newSessionUsage(config),
+	}
+	conn := &scpConn{input: strings.NewReader(input)}
+	return newSCPSink(conn, handler, logger), conn
+}
+
+func TestSCPSink_ReceiveFiles(t *testing.T) {
+	config := &Config{
+		VirtualDir:       "/uploads",
+		MaxFileSize:      1024,
+		TempFileSuffixes: []string{".part"},
+	}
+	sink, conn := newTestSCPSink(t, config,
+		"T1700000000 0 1700000000 0\nC0644 5 a.txt.part\nhello\x00D0755 0 sub\nC0644 3 b.txt.part\nbye\x00E\n")
+
+	if status := sink.run(scpCommand{target: "/uploads", recursive: true}); status != 0 {
+		t.Fatalf("run() = %d, want 0; output %q", status, conn.output.String())
+	}
+	// one ack for the start, T, C header, C data, D, C header, C data and E
+	if want := strings.Repeat("\x00", 8); conn.output.String() != want {
+		t.Errorf("output = %q, want %q", conn.output.String(), want)
+	}
+
+	for path, want := range map[string]string{"/uploads/a.txt.part": "hello", "/uploads/sub/b.txt.part": "bye"} {
+		staged, ok := sink.handler.handler.stagedUploads.Load(resumeKey("alice", path))
+		if !ok {
+			t.Errorf("%s was not received", path)
+			continue
+		}
+		if got := string(staged.(*stagedUpload).upload.data); got != want {
+			t.Errorf("%s data = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestSCPSink_SingleFileTarget(t *testing.T) {
+	config := &Config{
+		VirtualDir:       "/uploads",
+		MaxFileSize:      1024,
+		TempFileSuffixes: []string{".part"},
+	}
+	sink, conn := newTestSCPSink(t, config, "C0644 5 local.txt\nhello\x00")
+
+	if status := sink.run(scpCommand{target: "renamed.txt.part"}); status != 0 {
+		t.Fatalf("run() = %d, want 0; output %q", status, conn.output.String())
+	}
+	if _, ok := sink.handler.handler.stagedUploads.Load(resumeKey("alice", "/uploads/renamed.txt.part")); !ok {
+		t.Error("expected the file to be stored under the target name")
+	}
+}
+
+func TestSCPSink_RejectedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		target string
+		input  string
+		want   string
+	}{
+		{
+			name:   "path outside virtual dir",
+			config: &Config{VirtualDir: "/uploads", MaxFileSize: 1024},
+			target: "/etc/",
+			input:  "C0644 5 passwd\n",
+			want:   "\x00\x01scp: /etc/passwd: Permission denied\n",
+		},
+		{
+			name:   "file too large",
+			config: &Config{VirtualDir: "/uploads", MaxFileSize: 4},
+			target: "/uploads",
+			input:  "C0644 5 a.txt\nhello\x00",
+			want:   "\x00\x00\x01scp: /uploads/a.txt: file too large\n",
+		},
+		{
+			name:   "session file limit",
+			config: &Config{VirtualDir: "/uploads", MaxFileSize: 1024, SessionMaxFiles: 1, TempFileSuffixes: []string{".part"}},
+			target: "/uploads",
+			input:  "C0644 2 a.part\nhi\x00C0644 2 b.part\n",
+			want:   "\x00\x00\x00\x01scp: /uploads/b.part: " + errSessionFileLimit.Error() + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, conn := newTestSCPSink(t, tt.config, tt.input)
+			if status := sink.run(scpCommand{target: tt.target}); status != 1 {
+				t.Errorf("run() = %d, want 1", status)
+			}
+			if conn.output.String() != tt.want {
+				t.Errorf("output = %q, want %q", conn.output.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSCPSink_ProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"directory without -r", "D0755 0 sub\n"},
+		{"path in file name", "C0644 5 ../a.txt\n"},
+		{"invalid size", "C0644 -1 a.txt\n"},
+		{"unknown command", "X\n"},
+		{"unexpected end of directory", "E\n"},
+		{"truncated data", "C0644 5 a.txt\nhel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{VirtualDir: "/uploads", MaxFileSize: 1024}
+			sink, _ := newTestSCPSink(t, config, tt.input)
+			if status := sink.run(scpCommand{target: "/uploads"}); status != 1 {
+				t.Errorf("run() = %d, want 1", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// secretUser is an entry of the USERS_SECRET document, which maps user names
+// to their settings:
+//
+//	{"alice": {"password_hash": "$2b$...", "prefix": "partners/alice", "quota": 1073741824, "role_arn": "sftp-upload"}}
+//
+// Only password_hash is required. role_arn may be a role name or an ARN in
+// AWS_ACCOUNT_ID, allowed_ips a list of addresses and CIDR ranges.
+type secretUser struct {
+	PasswordHash string   `json:"password_hash"`
+	Prefix       string   `json:"prefix"`
+	Quota        int64    `json:"quota"`
+	RoleARN      string   `json:"role_arn"`
+	AllowedIPs   []string `json:"allowed_ips"`
+}
+
+// secretUserSource keeps a LocalAuthenticator in sync with a Secrets Manager
+// secret, so users and passwords can be rotated without a restart.
+type secretUserSource struct {
+	secretID  string
+	interval  time.Duration
+	accountID string
+	client    *awsJSONClient
+	auth      *LocalAuthenticator
+	logger    *slog.Logger
+	versionID string // of the secret the current users were loaded from
+}
+
+func newSecretUserSource(cfg *Config, awsConfig aws.Config, auth *LocalAuthenticator, logger *slog.Logger) *secretUserSource {
+	return &secretUserSource{
+		secretID:  cfg.UsersSecret,
+		interval:  cfg.UsersSecretRefresh,
+		accountID: cfg.RequiredAccountID,
+		client:    newAWSJSONClient(awsConfig, "secretsmanager", "secretsmanager", "1.1"),
+		auth:      auth,
+		logger:    logger,
+	}
+}
+
+// run refreshes the users every interval until ctx is done. A failed
+// refresh keeps the users loaded before.
+func (s *secretUserSource) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refresh(ctx); err != nil {
+				s.logger.Error("failed to refresh users from secret",
+					slog.String("secret_id", s.secretID),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+	}
+}
+
+// refresh loads the secret and replaces the users if it changed.
+func (s *secretUserSource) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+		VersionID    string `json:"VersionId"`
+	}
+	if err := s.client.call(ctx, "GetSecretValue", map[string]string{"SecretId": s.secretID}, &secret); err != nil {
+		return err
+	}
+	if secret.VersionID == s.versionID {
+		return nil
+	}
+	if secret.SecretString == "" {
+		return fmt.Errorf("secret has no string value")
+	}
+
+	users, err := parseSecretUsers([]byte(secret.SecretString), s.accountID)
+	if err != nil {
+		return err
+	}
+
+	s.auth.setUsers(users)
+	s.versionID = secret.VersionID
+	s.logger.Info("loaded users from secret",
+		slog.String("secret_id", s.secretID),
+		slog.String("version_id", secret.VersionID),
+		slog.Int("users", len(users)),
+	)
+	return nil
+}
+
+func parseSecretUsers(data []byte, accountID string) (map[string]localUser, error) {
+	var entries map[string]secretUser
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid users secret: %w", err)
+	}
+
+	users := make(map[string]localUser, len(entries))
+	for name, entry := range entries {
+		user, err := newLocalUser(name, entry.PasswordHash, entry.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Quota < 0 {
+			return nil, fmt.Errorf("user %q: invalid quota %d", name, entry.Quota)
+		}
+		user.quota = entry.Quota
+
+		if entry.RoleARN != "" {
+			if user.roleARN, err = resolveRoleARN(entry.RoleARN, accountID); err != nil {
+				return nil, fmt.Errorf("user %q: %w", name, err)
+			}
+		}
+		if len(entry.AllowedIPs) > 0 {
+			if user.allowedIPs, err = normalizeAllowedIPs(strings.Join(entry.AllowedIPs, ",")); err != nil {
+				return nil, fmt.Errorf("user %q: invalid allowed IPs: %w", name, err)
+			}
+		}
+		users[name] = user
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users found in secret")
+	}
+	return users, nil
+}
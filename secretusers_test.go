@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseSecretUsers(t *testing.T) {
+	users, err := parseSecretUsers([]byte(`{
+		"alice": {"password_hash": "$2y$10$hash"},
+		"bob": {"password_hash": "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$a2V5", "prefix": "/partners/bob/", "quota": 1024, "role_arn": "sftp-upload"}
+	}`), "123456789012")
+	if err != nil {
+		t.Fatalf("parseSecretUsers() unexpected error: %v", err)
+	}
+
+	if users["alice"].prefix != "alice" {
+		t.Errorf("alice prefix = %q, want %q", users["alice"].prefix, "alice")
+	}
+	bob := users["bob"]
+	if bob.prefix != "partners/bob" || bob.quota != 1024 {
+		t.Errorf("bob = %+v, want prefix partners/bob and quota 1024", bob)
+	}
+	if bob.roleARN != "arn:aws:iam::123456789012:role/sftp-upload" {
+		t.Errorf("bob roleARN = %q, want role in the account", bob.roleARN)
+	}
+
+	invalid := []string{
+		`not json`,
+		`{}`,
+		`{"alice": {"password_hash": "plaintext"}}`,
+		`{"alice": {"password_hash": "$2y$10$hash", "prefix": "../other"}}`,
+		`{"alice": {"password_hash": "$2y$10$hash", "quota": -1}}`,
+		`{"alice": {"password_hash": "$2y$10$hash", "role_arn": "arn:aws:iam::999999999999:role/other"}}`,
+		`{"bad name": {"password_hash": "$2y$10$hash"}}`,
+	}
+	for _, secret := range invalid {
+		if _, err := parseSecretUsers([]byte(secret), "123456789012"); err == nil {
+			t.Errorf("parseSecretUsers(%s) expected error", secret)
+		}
+	}
+}
+
+func TestSecretUserSource_Refresh(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	secret := map[string]string{
+		"VersionId":    "v1",
+		"SecretString": `{"alice": {"password_hash": "` + string(hash) + `", "role_arn": "sftp-upload"}}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			t.Errorf("X-Amz-Target = %q, want GetSecretValue", r.Header.Get("X-Amz-Target"))
+		}
+		var request map[string]string
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		if request["SecretId"] != "sftpgw/users" {
+			t.Errorf("SecretId = %q, want %q", request["SecretId"], "sftpgw/users")
+		}
+		json.NewEncoder(w).Encode(secret)
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	auth := NewLocalAuthenticator(nil, logger)
+	auth.assumeRole = func(ctx context.Context, roleARN, user string) (*types.Credentials, error) {
+		return &types.Credentials{
+			AccessKeyId:     aws.String("ASIAROLE"),
+			SecretAccessKey: aws.String("role-secret"),
+			SessionToken:    aws.String("role-token"),
+		}, nil
+	}
+
+	source := newSecretUserSource(&Config{
+		UsersSecret:       "sftpgw/users",
+		RequiredAccountID: "123456789012",
+	}, testAWSConfig(server), auth, logger)
+	source.client.endpoint = server.URL
+
+	if err := source.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() unexpected error: %v", err)
+	}
+	perms, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["aws_session_token"] != "role-token" {
+		t.Errorf("aws_session_token = %q, want credentials of the assumed role", perms.Extensions["aws_session_token"])
+	}
+	if perms.Extensions["role_arn"] != "arn:aws:iam::123456789012:role/sftp-upload" {
+		t.Errorf("role_arn = %q, want the user's role", perms.Extensions["role_arn"])
+	}
+
+	// A broken new version keeps the users loaded before.
+	secret["VersionId"] = "v2"
+	secret["SecretString"] = `{"alice": {"password_hash": "plaintext"}}`
+	if err := source.refresh(context.Background()); err == nil {
+		t.Error("refresh() expected error for invalid secret")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret")); err != nil {
+		t.Errorf("Authenticate() after failed refresh unexpected error: %v", err)
+	}
+
+	secret["VersionId"] = "v3"
+	secret["SecretString"] = `{"bob": {"password_hash": "` + string(hash) + `"}}`
+	if err := source.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() unexpected error: %v", err)
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret")); err == nil {
+		t.Error("Authenticate() expected error for user removed from the secret")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "bob"}, []byte("s3cret")); err != nil {
+		t.Errorf("Authenticate() unexpected error for new user: %v", err)
+	}
+}
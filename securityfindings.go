@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Targets for SECURITY_FINDINGS.
+const (
+	findingsSecurityHub = "securityhub"
+	findingsEventBridge = "eventbridge"
+)
+
+// findingKinds describes the events reported as findings, keyed by the kind
+// used in finding IDs.
+var findingKinds = map[string]struct {
+	findingType string
+	severity    string
+	title       string
+}{
+	"repeated-failures": {"TTPs/Credential Access/Brute Force", "MEDIUM", "Repeated SFTP authentication failures"},
+	"wrong-account":     {"TTPs/Initial Access/Unauthorized Account", "MEDIUM", "SFTP login with credentials of another AWS account"},
+	"banned-connection": {"TTPs/Credential Access/Brute Force", "LOW", "SFTP connection from a banned client IP"},
+}
+
+// asffFinding is a finding in the AWS Security Finding Format. Only the
+// fields the gateway fills are listed.
+type asffFinding struct {
+	SchemaVersion string
+	Id            string
+	ProductArn    string
+	GeneratorId   string
+	AwsAccountId  string
+	Types         []string
+	CreatedAt     string
+	UpdatedAt     string
+	Severity      struct{ Label string }
+	Title         string
+	Description   string
+	Network       asffNetwork
+	Resources     []asffResource
+	ProductFields map[string]string `json:",omitempty"`
+}
+
+type asffNetwork struct {
+	Direction       string
+	Protocol        string
+	SourceIpV4      string `json:",omitempty"`
+	SourceIpV6      string `json:",omitempty"`
+	DestinationPort int
+}
+
+type asffResource struct {
+	Type   string
+	Id     string
+	Region string
+}
+
+// securityFindings publishes brute-force activity against the gateway to
+// Security Hub, or to an EventBridge bus, so it shows up in the tools the
+// security team already watches.
+type securityFindings struct {
+	asyncSender[asffFinding]
+
+	target    string // findingsSecurityHub or findingsEventBridge
+	bus       string // EventBridge bus, see SECURITY_FINDINGS_BUS
+	accountID string // the gateway's own account
+	resource  string // ID of the gateway in findings
+	port      int
+
+	mu       sync.Mutex
+	reported map[string]bool // finding IDs already queued this hour
+	hour     time.Time
+}
+
+func newSecurityFindings(cfg *Config, awsConfig aws.Config, accountID string, logger *slog.Logger) *securityFindings {
+	// the most findings a single request may carry
+	client, batchSize := newAWSJSONClient(awsConfig, "securityhub", "", ""), 100
+	if cfg.SecurityFindings == findingsEventBridge {
+		client, batchSize = newAWSJSONClient(awsConfig, "events", "AWSEvents", "1.1"), 10
+	}
+
+	f := &securityFindings{
+		asyncSender: newAsyncSender[asffFinding]("security findings", client, 100, batchSize, logger),
+		target:      cfg.SecurityFindings,
+		bus:         cfg.SecurityFindingsBus,
+		accountID:   accountID,
+		resource:    "sftpgw",
+		port:        cfg.ServerPort,
+		reported:    make(map[string]bool),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		f.resource = "sftpgw/" + hostname
+	}
+	f.logAttrs = []any{slog.String("target", f.target)}
+	f.deliver = f.publish
+	return f
+}
+
+// repeatedFailures reports a client that was locked out or banned after
+// failing to authenticate failures times.
+func (f *securityFindings) repeatedFailures(clientIP string, failures int) {
+	f.report("repeated-failures", clientIP, fmt.Sprintf("Client %s failed to authenticate %d times and was blocked.", clientIP, failures), nil)
+}
+
+// wrongAccount reports valid AWS credentials of an account other than
+// AWS_ACCOUNT_ID.
+func (f *securityFindings) wrongAccount(clientIP, accessKeyID, accountID string) {
+	f.report("wrong-account", clientIP, fmt.Sprintf("Client %s tried to log in with credentials of AWS account %s.", clientIP, accountID), map[string]string{
+		"sftpgw/AccessKeyId": accessKeyID,
+		"sftpgw/AccountId":   accountID,
+	})
+}
+
+// bannedConnection reports a connection dropped because its IP is banned.
+func (f *securityFindings) bannedConnection(clientIP string) {
+	f.report("banned-connection", clientIP, fmt.Sprintf("Client %s kept connecting while banned.", clientIP), nil)
+}
+
+// report queues a finding. Findings of the same kind for the same client are
+// only sent once an hour; they share an ID, so Security Hub keeps a single
+// finding per client and hour.
+func (f *securityFindings) report(kind, clientIP, description string, fields map[string]string) {
+	now := f.timeFunc().UTC()
+	hour := now.Truncate(time.Hour)
+	id := fmt.Sprintf("%s/%s/%s/%s", f.resource, kind, clientIP, hour.Format("2006-01-02T15"))
+
+	f.mu.Lock()
+	if !hour.Equal(f.hour) || len(f.reported) >= maxTrackedClients {
+		clear(f.reported)
+		f.hour = hour
+	}
+	if f.reported[id] {
+		f.mu.Unlock()
+		return
+	}
+	f.reported[id] = true
+	f.mu.Unlock()
+
+	info := findingKinds[kind]
+	finding := asffFinding{
+		SchemaVersion: "2018-10-08",
+		Id:            id,
+		ProductArn:    fmt.Sprintf("arn:aws:securityhub:%s:%s:product/%s/default", f.client.region, f.accountID, f.accountID),
+		GeneratorId:   "sftpgw/" + kind,
+		AwsAccountId:  f.accountID,
+		Types:         []string{info.findingType},
+		CreatedAt:     now.Format(time.RFC3339),
+		UpdatedAt:     now.Format(time.RFC3339),
+		Title:         info.title,
+		Description:   description,
+		Network: asffNetwork{
+			Direction:       "IN",
+			Protocol:        "TCP",
+			DestinationPort: f.port,
+		},
+		Resources:     []asffResource{{Type: "Other", Id: f.resource, Region: f.client.region}},
+		ProductFields: fields,
+	}
+	finding.Severity.Label = info.severity
+	if addr, err := netip.ParseAddr(clientIP); err == nil && addr.Unmap().Is4() {
+		finding.Network.SourceIpV4 = addr.Unmap().String()
+	} else {
+		finding.Network.SourceIpV6 = clientIP
+	}
+
+	f.enqueue(finding, slog.String("id", id))
+}
+
+func (f *securityFindings) publish(ctx context.Context, batch []asffFinding) error {
+	if f.target == findingsEventBridge {
+		return f.putEvents(ctx, batch)
+	}
+	return f.importFindings(ctx, batch)
+}
+
+// importFindings sends findings with Security Hub's BatchImportFindings.
+func (f *securityFindings) importFindings(ctx context.Context, batch []asffFinding) error {
+	body, err := json.Marshal(map[string]any{"Findings": batch})
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.client.post(ctx, "/findings/import", body, map[string]string{
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		FailedCount    int
+		FailedFindings []struct{ Id, ErrorCode, ErrorMessage string }
+		Message        string
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("securityhub BatchImportFindings failed: %s: %s", resp.Status, result.Message)
+	}
+	if result.FailedCount > 0 && len(result.FailedFindings) > 0 {
+		failed := result.FailedFindings[0]
+		return fmt.Errorf("securityhub rejected %d findings: %s: %s", result.FailedCount, failed.ErrorCode, failed.ErrorMessage)
+	}
+	return nil
+}
+
+// putEvents sends findings to an EventBridge bus, one event per finding with
+// the finding as detail.
+func (f *securityFindings) putEvents(ctx context.Context, batch []asffFinding) error {
+	type entry struct {
+		Source       string
+		DetailType   string
+		Detail       string
+		EventBusName string
+	}
+	entries := make([]entry, len(batch))
+	for i, finding := range batch {
+		detail, err := json.Marshal(finding)
+		if err != nil {
+			return err
+		}
+		entries[i] = entry{
+			Source:       "sftpgw",
+			DetailType:   "SFTP Gateway Security Finding",
+			Detail:       string(detail),
+			EventBusName: f.bus,
+		}
+	}
+
+	var result struct {
+		FailedEntryCount int
+		Entries          []struct{ ErrorCode, ErrorMessage string }
+	}
+	if err := f.client.call(ctx, "PutEvents", map[string]any{"Entries": entries}, &result); err != nil {
+		return err
+	}
+	if result.FailedEntryCount > 0 {
+		for _, e := range result.Entries {
+			if e.ErrorCode != "" {
+				return fmt.Errorf("eventbridge rejected %d events: %s: %s", result.FailedEntryCount, e.ErrorCode, e.ErrorMessage)
+			}
+		}
+		return fmt.Errorf("eventbridge rejected %d events", result.FailedEntryCount)
+	}
+	return nil
+}
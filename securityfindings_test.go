@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func newTestSecurityFindings(t *testing.T, target string, handler http.HandlerFunc) *securityFindings {
+	f := newTestAWSSender(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), handler, func(awsConfig aws.Config) *securityFindings {
+		return newSecurityFindings(&Config{SecurityFindings: target, SecurityFindingsBus: "security", ServerPort: 2222},
+			awsConfig, "111122223333", slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	})
+	f.resource = "sftpgw/test"
+	return f
+}
+
+func TestSecurityFindings_SecurityHub(t *testing.T) {
+	var path string
+	var request struct{ Findings []asffFinding }
+	f := newTestSecurityFindings(t, findingsSecurityHub, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Write([]byte(`{"FailedCount": 0, "SuccessCount": 2, "FailedFindings": []}`))
+	})
+
+	f.repeatedFailures("203.0.113.7", 5)
+	f.repeatedFailures("203.0.113.7", 5)
+	f.wrongAccount("2001:db8::1", "AKIAEXAMPLE", "444455556666")
+	if len(f.queue) != 2 {
+		t.Fatalf("queued %d findings, want 2 after deduplication", len(f.queue))
+	}
+
+	batch := []asffFinding{<-f.queue, <-f.queue}
+	if err := f.publish(context.Background(), batch); err != nil {
+		t.Fatalf("publish() unexpected error: %v", err)
+	}
+
+	if path != "/findings/import" {
+		t.Errorf("path = %q, want /findings/import", path)
+	}
+	if len(request.Findings) != 2 {
+		t.Fatalf("imported %d findings, want 2", len(request.Findings))
+	}
+
+	brute := request.Findings[0]
+	if brute.Id != "sftpgw/test/repeated-failures/203.0.113.7/2024-03-01T12" {
+		t.Errorf("Id = %q", brute.Id)
+	}
+	if brute.ProductArn != "arn:aws:securityhub:us-east-1:111122223333:product/111122223333/default" {
+		t.Errorf("ProductArn = %q", brute.ProductArn)
+	}
+	if brute.Network.SourceIpV4 != "203.0.113.7" || brute.Severity.Label != "MEDIUM" {
+		t.Errorf("finding = %+v, want source 203.0.113.7 with MEDIUM severity", brute)
+	}
+
+	wrongAccount := request.Findings[1]
+	if wrongAccount.Network.SourceIpV6 != "2001:db8::1" || wrongAccount.ProductFields["sftpgw/AccountId"] != "444455556666" {
+		t.Errorf("finding = %+v, want source 2001:db8::1 and account 444455556666", wrongAccount)
+	}
+}
+
+func TestSecurityFindings_SecurityHubRejected(t *testing.T) {
+	f := newTestSecurityFindings(t, findingsSecurityHub, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"FailedCount": 1, "FailedFindings": [{"Id": "x", "ErrorCode": "InvalidInput", "ErrorMessage": "bad"}]}`))
+	})
+
+	f.bannedConnection("203.0.113.7")
+	if err := f.publish(context.Background(), []asffFinding{<-f.queue}); err == nil {
+		t.Error("publish() expected error for rejected finding")
+	}
+}
+
+func TestSecurityFindings_EventBridge(t *testing.T) {
+	var target string
+	var request struct {
+		Entries []struct{ Source, DetailType, Detail, EventBusName string }
+	}
+	f := newTestSecurityFindings(t, findingsEventBridge, func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Write([]byte(`{"FailedEntryCount": 0, "Entries": [{"EventId": "1"}]}`))
+	})
+
+	f.bannedConnection("203.0.113.7")
+	if err := f.publish(context.Background(), []asffFinding{<-f.queue}); err != nil {
+		t.Fatalf("publish() unexpected error: %v", err)
+	}
+
+	if target != "AWSEvents.PutEvents" {
+		t.Errorf("X-Amz-Target = %q, want AWSEvents.PutEvents", target)
+	}
+	if len(request.Entries) != 1 || request.Entries[0].EventBusName != "security" || request.Entries[0].Source != "sftpgw" {
+		t.Fatalf("entries = %+v, want one sftpgw event on bus security", request.Entries)
+	}
+
+	var finding asffFinding
+	if err := json.Unmarshal([]byte(request.Entries[0].Detail), &finding); err != nil {
+		t.Fatalf("detail is not a finding: %v", err)
+	}
+	if finding.GeneratorId != "sftpgw/banned-connection" {
+		t.Errorf("GeneratorId = %q, want sftpgw/banned-connection", finding.GeneratorId)
+	}
+}
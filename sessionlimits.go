@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errSessionFileLimit = errors.New("session file limit reached")
+	errSessionByteLimit = errors.New("session byte limit reached")
+)
+
+// sessionUsage enforces SESSION_MAX_FILES and SESSION_MAX_BYTES for one SFTP
+// session, so runaway automation can't fill the bucket over a single
+// connection. A nil sessionUsage has no limits.
+type sessionUsage struct {
+	maxFiles int   // files a session may upload, unlimited if zero
+	maxBytes int64 // bytes a session may upload, unlimited if zero
+
+	mu    sync.Mutex
+	files int
+	bytes int64
+}
+
+func newSessionUsage(config *Config) *sessionUsage {
+	if config.SessionMaxFiles <= 0 && config.SessionMaxBytes <= 0 {
+		return nil
+	}
+	return &sessionUsage{
+		maxFiles: config.SessionMaxFiles,
+		maxBytes: config.SessionMaxBytes,
+	}
+}
+
+// startFile counts a file opened for writing.
+func (u *sessionUsage) startFile() error {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.maxFiles > 0 && u.files >= u.maxFiles {
+		return errSessionFileLimit
+	}
+	u.files++
+	return nil
+}
+
+// addBytes counts n more bytes written in the session.
+func (u *sessionUsage) addBytes(n int64) error {
+	if u == nil || n <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.maxBytes > 0 && u.bytes+n > u.maxBytes {
+		return errSessionByteLimit
+	}
+	u.bytes += n
+	return nil
+}
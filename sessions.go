@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errUploadNotFound  = errors.New("upload not found")
+	errUploadStoring   = errors.New("upload is already being stored")
+	errUploadCancelled = errors.New("upload cancelled by an administrator")
+)
+
+// activeSession is a logged in SSH or FTPS connection, as listed by the
+// admin API.
+type activeSession struct {
+	id            string
+	user          string
+	remoteIP      string
+	country       string // see GEOIP_DB
+	port          int
+	clientVersion string
+	connected     time.Time
+	conn          *timeoutConn // closing it ends the session
+}
+
+func newActiveSession(meta ssh.ConnMetadata, permissions *ssh.Permissions, conn *timeoutConn) *activeSession {
+	user, country := meta.User(), ""
+	if permissions != nil {
+		if permissions.Extensions["user"] != "" {
+			user = permissions.Extensions["user"]
+		}
+		country = permissions.Extensions["country"]
+	}
+	return &activeSession{
+		id:            getSessionID(meta),
+		user:          user,
+		remoteIP:      getClientIP(meta.RemoteAddr()),
+		country:       country,
+		port:          getPort(meta.LocalAddr()),
+		clientVersion: string(meta.ClientVersion()),
+		connected:     time.Now(),
+		conn:          conn,
+	}
+}
+
+type sessionStatus struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	RemoteIP      string    `json:"remote_ip"`
+	Port          int       `json:"port"`
+	ClientVersion string    `json:"client_version"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	BytesReceived int64     `json:"bytes_received"` // on the connection, including SSH overhead
+	BytesSent     int64     `json:"bytes_sent"`
+	Uploads       int       `json:"uploads"`
+}
+
+type uploadStatus struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	RemoteIP      string    `json:"remote_ip"`
+	FilePath      string    `json:"file_path"`
+	OpenedAt      time.Time `json:"opened_at"`
+	BytesReceived int64     `json:"bytes_received"`
+	BufferedBytes int64     `json:"buffered_bytes"` // held in memory
+	Streaming     bool      `json:"streaming"`
+	State         string    `json:"state"` // "receiving", "storing" once closed, or "cancelled"
+}
+
+// bufferUsage is the memory held by the files being received or stored.
+type bufferUsage struct {
+	BufferedBytes      int64  `json:"buffered_bytes"`
+	LargestBufferBytes int64  `json:"largest_buffer_bytes"`
+	LargestBufferPath  string `json:"largest_buffer_path,omitempty"`
+}
+
+// sessionStatuses lists the logged in sessions, oldest first.
+func (s *SFTPServer) sessionStatuses() []sessionStatus {
+	uploads := make(map[string]int)
+	for _, upload := range s.uploadStatuses() {
+		uploads[upload.SessionID]++
+	}
+
+	statuses := []sessionStatus{}
+	s.sessions.Range(func(_, value any) bool {
+		session := value.(*activeSession)
+		statuses = append(statuses, sessionStatus{
+			SessionID:     session.id,
+			User:          session.user,
+			RemoteIP:      session.remoteIP,
+			Port:          session.port,
+			ClientVersion: session.clientVersion,
+			ConnectedAt:   session.connected.UTC(),
+			BytesReceived: session.conn.received.Load(),
+			BytesSent:     session.conn.sent.Load(),
+			Uploads:       uploads[session.id],
+		})
+		return true
+	})
+	slices.SortFunc(statuses, func(a, b sessionStatus) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return statuses
+}
+
+// uploadStatuses lists the files being received or stored, by path.
+func (s *SFTPServer) uploadStatuses() []uploadStatus {
+	statuses := []uploadStatus{}
+	if s.handler == nil {
+		return statuses
+	}
+
+	s.handler.activeUploads.Range(func(_, value any) bool {
+		upload := value.(*FileUpload)
+		state := "receiving"
+		switch upload.state.Load() {
+		case uploadClosed:
+			state = "storing"
+		case uploadCancelled:
+			state = "cancelled"
+		}
+		statuses = append(statuses, uploadStatus{
+			SessionID:     upload.sessionID,
+			User:          upload.user,
+			RemoteIP:      upload.clientIP,
+			FilePath:      upload.path,
+			OpenedAt:      upload.opened.UTC(),
+			BytesReceived: upload.sizeSeen.Load(),
+			BufferedBytes: upload.buffered.Load(),
+			Streaming:     upload.stream != nil,
+			State:         state,
+		})
+		return true
+	})
+	slices.SortFunc(statuses, func(a, b uploadStatus) int {
+		return cmp.Compare(a.FilePath, b.FilePath)
+	})
+	return statuses
+}
+
+// bufferUsage adds up the memory held by the open files, as of their last
+// write.
+func (s *SFTPServer) bufferUsage() bufferUsage {
+	var usage bufferUsage
+	if s.handler == nil {
+		return usage
+	}
+
+	s.handler.activeUploads.Range(func(_, value any) bool {
+		upload := value.(*FileUpload)
+		buffered := upload.buffered.Load()
+		usage.BufferedBytes += buffered
+		if buffered > usage.LargestBufferBytes {
+			usage.LargestBufferBytes = buffered
+			usage.LargestBufferPath = upload.path
+		}
+		return true
+	})
+	return usage
+}
+
+// terminateSession closes the connection of a session. Files it still has
+// open are handled like after any dropped connection, see RESUME_TIMEOUT.
+func (s *SFTPServer) terminateSession(id string) error {
+	value, ok := s.sessions.Load(id)
+	if !ok {
+		return errSessionNotFound
+	}
+	session := value.(*activeSession)
+
+	s.logger.Warn("session terminated by an administrator",
+		slog.String("remote_ip", session.remoteIP),
+		slog.String("session_id", session.id),
+		slog.String("user", session.user),
+	)
+	s.audit.session(auditSessionTerminated, session)
+	return session.conn.Close()
+}
+
+// cancelUpload marks an open file to be discarded. Its next write fails, and
+// closing it discards the data instead of storing it in S3. Files that are
+// already being stored can't be cancelled.
+func (s *SFTPServer) cancelUpload(path string) error {
+	if s.handler == nil {
+		return errUploadNotFound
+	}
+	value, ok := s.handler.activeUploads.Load(path)
+	if !ok {
+		return errUploadNotFound
+	}
+	upload := value.(*FileUpload)
+	if !upload.state.CompareAndSwap(uploadReceiving, uploadCancelled) {
+		if upload.state.Load() == uploadCancelled {
+			return nil
+		}
+		return errUploadStoring
+	}
+
+	s.logger.Warn("upload cancelled by an administrator",
+		slog.String("remote_ip", upload.clientIP),
+		slog.String("session_id", upload.sessionID),
+		slog.String("user", upload.user),
+		slog.String("file_path", upload.path),
+	)
+	s.audit.record(auditRecord{Type: auditUploadCancelled, SessionID: upload.sessionID, User: upload.user, RemoteIP: upload.clientIP, Path: upload.path})
+	return nil
+}
@@ -13,7 +13,7 @@ func TestSFTPHandler_Filecmd(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	tests := []struct {
@@ -32,7 +32,7 @@ func TestSFTPHandler_Filecmd(t *testing.T) {
 		},
 		{
 			name:        "Rename operation should be rejected",
-			method:      "Rename", 
+			method:      "Rename",
 			filepath:    "/uploads/test.txt",
 			expectError: true,
 			expectedErr: os.ErrPermission,
@@ -70,15 +70,15 @@ func TestSFTPHandler_Filecmd(t *testing.T) {
 			// Create a context with mock values
 			ctx := context.WithValue(context.Background(), "client_ip", "127.0.0.1")
 			ctx = context.WithValue(ctx, "access_key_id", "test-key")
-			
+
 			request := &sftp.Request{
 				Method:   tt.method,
 				Filepath: tt.filepath,
 			}
 			request = request.WithContext(ctx)
-			
+
 			err := handler.Filecmd(request)
-			
+
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("Filecmd() expected error but got none")
@@ -98,7 +98,7 @@ func TestSFTPHandler_Fileread(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	request := &sftp.Request{
@@ -107,11 +107,11 @@ func TestSFTPHandler_Fileread(t *testing.T) {
 	}
 
 	reader, err := handler.Fileread(request)
-	
+
 	if err != os.ErrPermission {
 		t.Errorf("Fileread() error = %v, want %v", err, os.ErrPermission)
 	}
-	
+
 	if reader != nil {
 		t.Errorf("Fileread() returned non-nil reader, expected nil")
 	}
@@ -121,7 +121,7 @@ func TestSFTPHandler_Fileinfo(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	request := &sftp.Request{
@@ -130,11 +130,11 @@ func TestSFTPHandler_Fileinfo(t *testing.T) {
 	}
 
 	fileInfo, err := handler.Fileinfo(request)
-	
+
 	if err != os.ErrPermission {
 		t.Errorf("Fileinfo() error = %v, want %v", err, os.ErrPermission)
 	}
-	
+
 	if fileInfo != nil {
 		t.Errorf("Fileinfo() returned non-nil fileInfo, expected nil")
 	}
@@ -144,7 +144,7 @@ func TestSFTPHandler_Filelist(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	request := &sftp.Request{
@@ -153,13 +153,13 @@ func TestSFTPHandler_Filelist(t *testing.T) {
 	}
 
 	lister, err := handler.Filelist(request)
-	
+
 	if err != os.ErrPermission {
 		t.Errorf("Filelist() error = %v, want %v", err, os.ErrPermission)
 	}
-	
+
 	if lister != nil {
-		t.Errorf("Filelist() returned non-nil lister, expected nil") 
+		t.Errorf("Filelist() returned non-nil lister, expected nil")
 	}
 }
 
@@ -167,9 +167,9 @@ func TestSessionSFTPHandler_Filecmd(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	baseHandler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
-	
+
 	sessionHandler := &SessionSFTPHandler{
 		handler:         baseHandler,
 		clientIP:        "192.168.1.100",
@@ -200,7 +200,7 @@ func TestSessionSFTPHandler_Filecmd(t *testing.T) {
 		},
 		{
 			name:        "Setstat operation should succeed",
-			method:      "Setstat", 
+			method:      "Setstat",
 			filepath:    "/uploads/test.txt",
 			expectError: false,
 		},
@@ -212,9 +212,9 @@ func TestSessionSFTPHandler_Filecmd(t *testing.T) {
 				Method:   tt.method,
 				Filepath: tt.filepath,
 			}
-			
+
 			err := sessionHandler.Filecmd(request)
-			
+
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("SessionSFTPHandler.Filecmd() expected error but got none")
@@ -228,4 +228,4 @@ func TestSessionSFTPHandler_Filecmd(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
@@ -6,31 +6,199 @@ import (
 	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
 )
 
 type SFTPHandler struct {
-	config     *Config
-	uploader   *S3Uploader
-	logger     *slog.Logger
-	activeUploads sync.Map // track active file uploads
+	config           *Config
+	uploader         objectStore // an *S3Uploader outside of tests
+	logger           *slog.Logger
+	activeUploads    sync.Map         // track active file uploads
+	stagedUploads    sync.Map         // temp files waiting to be renamed by resumeKey, see TEMP_FILE_SUFFIXES
+	suspendedUploads sync.Map         // interrupted uploads that can be resumed, see RESUME_TIMEOUT
+	receivedFiles    sync.Map         // hashes of recently stored files, for check-file
+	quotas           uploadQuotas     // bytes stored per user today, see USERS_FILE
+	tracer           *tracer          // nil without OTEL_EXPORTER_OTLP_ENDPOINT
+	metrics          *metrics         // nil without ADMIN_ADDR
+	notifier         *failureNotifier // nil without UPLOAD_FAILURE_TOPIC
+	uploadQueue      *uploadQueue     // nil without UPLOAD_QUEUE_URL
+	events           *lifecycleEvents // nil without EVENTBRIDGE_BUS
+	accessLog        *accessLog       // nil without ACCESS_LOG
+	reporter         *errorReporter   // nil without SENTRY_DSN
+	audit            *auditTrail      // nil without AUDIT_BUCKET
+
+	// replaces config for the settings that are reloaded while the gateway
+	// runs, see APPCONFIG_PROFILE
+	live atomic.Pointer[Config]
 }
 
 type FileUpload struct {
-	data      []byte
-	path      string
-	clientIP  string
-	accessKey string
-	secretKey string
-	mu        sync.Mutex
+	data         []byte
+	path         string
+	clientIP     string
+	sessionID    string // the session that opened the file last, see getSessionID
+	port         int    // listener of that session, see SFTP_PORT
+	user         string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	accountID    string
+	prefix       string
+	quota        int64
+	country      string
+	bucket       string
+	bucketPrefix string   // overrides S3_BUCKET_PREFIX if set, see UPLOAD_ROUTES
+	maxFileSize  int64    // overrides MAX_FILE_SIZE if set
+	extensions   []string // allowed extensions of the user, any if empty
+	replicas     []regionalBucket
+	mu           sync.Mutex
+
+	// commitPath is the final name of a temp file, such as name for
+	// name.filepart. Temp files are stored under that name once the client
+	// renames them. Empty for regular files.
+	commitPath string
+
+	// received is the length of the data at the start of the file that has
+	// been written without gaps. Writes beyond it are tracked in ranges
+	// (offset to end) until the gap is filled. Buffered uploads only.
+	received int64
+	ranges   map[int64]int64
+
+	// counted is the end of the furthest write charged to the session, see
+	// SESSION_MAX_BYTES. Rewrites and writes that arrive out of order below
+	// it are not charged again.
+	counted int64
+
+	progress  uploadProgress
+	buffering time.Duration // from the first write until the client closed the file
+
+	// Buffered uploads larger than SPILL_THRESHOLD are moved to spill, a
+	// temp file on local disk, instead of being held in data.
+	spill     *os.File
+	spillSize int64
+
+	// Streaming uploads send data to S3 as it arrives instead of buffering
+	// it in data. Writes that arrive ahead of a gap are held in pending
+	// until the missing bytes show up.
+	stream       uploadStream
+	streamed     int64
+	pending      map[int64][]byte
+	pendingBytes int64
+	digest       *fileDigest // hashes of the data streamed so far
+
+	span *span // the file being open, see OTEL_EXPORTER_OTLP_ENDPOINT
+
+	// For the admin API, which must not wait for mu while a closed file is
+	// stored in S3.
+	opened   time.Time
+	sizeSeen atomic.Int64 // size() after the last write
+	buffered atomic.Int64 // memory() after the last write
+	state    atomic.Int32 // uploadReceiving, uploadClosed or uploadCancelled
 }
 
-func NewSFTPHandler(config *Config, uploader *S3Uploader, logger *slog.Logger) *SFTPHandler {
+// States of a FileUpload.
+const (
+	uploadReceiving = iota
+	uploadClosed    // the file is being stored, staged or suspended
+	uploadCancelled // discard instead of storing, see DELETE /uploads
+)
+
+func (u *FileUpload) session() uploadSession {
+	return uploadSession{
+		user:              u.user,
+		accessKeyID:       u.accessKey,
+		secretAccessKey:   u.secretKey,
+		sessionToken:      u.sessionToken,
+		accountID:         u.accountID,
+		clientIP:          u.clientIP,
+		sessionID:         u.sessionID,
+		port:              u.port,
+		prefix:            u.prefix,
+		quota:             u.quota,
+		country:           u.country,
+		bucket:            u.bucket,
+		bucketPrefix:      u.bucketPrefix,
+		maxFileSize:       u.maxFileSize,
+		allowedExtensions: u.extensions,
+		replicas:          u.replicas,
+	}
+}
+
+// objectPath returns the path the S3 key is generated from.
+func (u *FileUpload) objectPath() string {
+	if u.commitPath != "" {
+		return u.commitPath
+	}
+	return u.path
+}
+
+// resumeOffset returns the offset an interrupted upload can continue from.
+func (u *FileUpload) resumeOffset() int64 {
+	if u.stream != nil {
+		return u.streamed
+	}
+	return u.received
+}
+
+// markReceived records that data was written to [off, end).
+func (u *FileUpload) markReceived(off, end int64) {
+	if off > u.received {
+		if u.ranges == nil {
+			u.ranges = make(map[int64]int64)
+		}
+		u.ranges[off] = max(u.ranges[off], end)
+		return
+	}
+
+	u.received = max(u.received, end)
+	for merged := true; merged; {
+		merged = false
+		for start, rangeEnd := range u.ranges {
+			if start <= u.received {
+				u.received = max(u.received, rangeEnd)
+				delete(u.ranges, start)
+				merged = true
+			}
+		}
+	}
+}
+
+// maxSize returns the largest file the upload may grow to.
+func (u *FileUpload) maxSize(config *Config) int64 {
+	if u.maxFileSize > 0 {
+		return u.maxFileSize
+	}
+	return config.MaxFileSize
+}
+
+// size returns the number of bytes received so far.
+func (u *FileUpload) size() int64 {
+	if u.stream != nil {
+		return u.streamed
+	}
+	if u.spill != nil {
+		return u.spillSize
+	}
+	return int64(len(u.data))
+}
+
+// memory returns the number of bytes held in memory for the file: the
+// buffer of a buffered upload, or the part being filled and the writes
+// waiting for a gap of a streaming one.
+func (u *FileUpload) memory() int64 {
+	if u.stream != nil {
+		return u.stream.memory() + u.pendingBytes
+	}
+	return int64(cap(u.data))
+}
+
+func NewSFTPHandler(config *Config, uploader objectStore, logger *slog.Logger) *SFTPHandler {
 	return &SFTPHandler{
 		config:   config,
 		uploader: uploader,
@@ -38,6 +206,16 @@ func NewSFTPHandler(config *Config, uploader *S3Uploader, logger *slog.Logger) *
 	}
 }
 
+// settings returns the configuration to read hot-reloadable settings from,
+// such as MAX_FILE_SIZE or UPLOAD_ROUTES, which may have changed since
+// startup.
+func (h *SFTPHandler) settings() *Config {
+	if config := h.live.Load(); config != nil {
+		return config
+	}
+	return h.config
+}
+
 func (h *SFTPHandler) Fileread(*sftp.Request) (io.ReaderAt, error) {
 	return nil, os.ErrPermission // read operations not allowed
 }
@@ -46,6 +224,10 @@ func (h *SFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	clientIP, _ := r.Context().Value("client_ip").(string)
 	accessKey, _ := r.Context().Value("access_key_id").(string)
 	secretKey, _ := r.Context().Value("secret_access_key").(string)
+	sessionToken, _ := r.Context().Value("session_token").(string)
+	accountID, _ := r.Context().Value("account_id").(string)
+	user, _ := r.Context().Value("user").(string)
+	prefix, _ := r.Context().Value("upload_prefix").(string)
 
 	logCtx := slog.Group("file_write",
 		"remote_ip", clientIP,
@@ -58,14 +240,29 @@ func (h *SFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, os.ErrPermission
 	}
 
+	name := r.Filepath
+	if target := tempFileTarget(name, h.config.TempFileSuffixes); target != "" {
+		name = target
+	}
+	if err := h.checkExtension(name, nil); err != nil {
+		h.logger.Warn("file write rejected: file extension not allowed", logCtx)
+		return nil, err
+	}
+
 	h.logger.Info("file write request", logCtx)
 
-	upload := &FileUpload{
-		data:      make([]byte, 0, h.config.MaxFileSize),
-		path:      r.Filepath,
-		clientIP:  clientIP,
-		accessKey: accessKey,
-		secretKey: secretKey,
+	upload, err := h.openUpload(r, uploadSession{
+		user:            user,
+		accessKeyID:     accessKey,
+		secretAccessKey: secretKey,
+		sessionToken:    sessionToken,
+		accountID:       accountID,
+		clientIP:        clientIP,
+		prefix:          prefix,
+	})
+	if err != nil {
+		h.logger.Error("failed to prepare upload", logCtx, slog.String("error", err.Error()))
+		return nil, err
 	}
 
 	h.activeUploads.Store(r.Filepath, upload)
@@ -77,6 +274,99 @@ func (h *SFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	}, nil
 }
 
+// openUpload continues a suspended upload of the file, if there is one,
+// and starts a new upload otherwise.
+func (h *SFTPHandler) openUpload(r *sftp.Request, session uploadSession) (*FileUpload, error) {
+	ctx, span := h.tracer.start(withTraceParent(context.Background(), session.traceParent), "upload",
+		slog.String("client.address", session.clientIP),
+		slog.String("enduser.id", session.user),
+		slog.String("aws.access_key_id", session.accessKeyID),
+		slog.String("file.path", r.Filepath),
+	)
+
+	if upload := h.resumeUpload(session.user, r.Filepath, r.Pflags().Trunc); upload != nil {
+		h.logger.Info("resuming interrupted upload",
+			slog.String("remote_ip", session.clientIP),
+			slog.String("session_id", session.sessionID),
+			slog.String("previous_session_id", upload.sessionID),
+			slog.String("access_key_id", session.accessKeyID),
+			slog.String("file_path", r.Filepath),
+			slog.Int64("resume_offset", upload.resumeOffset()),
+		)
+		span.setAttrs(slog.Int64("resume_offset", upload.resumeOffset()))
+		upload.sessionID = session.sessionID
+		upload.port = session.port
+		upload.extensions = session.allowedExtensions
+		upload.span = span
+		return upload, nil
+	}
+
+	upload, err := h.newFileUpload(ctx, r.Filepath, session)
+	if err != nil {
+		span.finish(err)
+		return nil, err
+	}
+	upload.span = span
+	return upload, nil
+}
+
+// newFileUpload prepares the buffer, or the S3 stream when STREAM_UPLOADS is
+// enabled, that receives the data for a single file.
+func (h *SFTPHandler) newFileUpload(ctx context.Context, path string, session uploadSession) (*FileUpload, error) {
+	// users with a bucket of their own aren't routed
+	if route := findUploadRoute(h.settings().UploadRoutes, h.config.VirtualDir, session, path); route != nil && session.bucket == "" {
+		session.bucket = route.bucket
+		session.bucketPrefix = route.prefix
+		session.replicas = route.replicas
+		h.logger.Info("upload routed",
+			slog.String("remote_ip", session.clientIP),
+			slog.String("session_id", session.sessionID),
+			slog.String("file_path", path),
+			slog.String("bucket", h.uploader.bucketFor(session)),
+			slog.String("prefix", h.uploader.keyPrefix(session)),
+		)
+	}
+
+	upload := &FileUpload{
+		path:         path,
+		clientIP:     session.clientIP,
+		sessionID:    session.sessionID,
+		port:         session.port,
+		user:         session.user,
+		accessKey:    session.accessKeyID,
+		secretKey:    session.secretAccessKey,
+		sessionToken: session.sessionToken,
+		accountID:    session.accountID,
+		prefix:       session.prefix,
+		quota:        session.quota,
+		country:      session.country,
+		bucket:       session.bucket,
+		bucketPrefix: session.bucketPrefix,
+		maxFileSize:  session.maxFileSize,
+		extensions:   session.allowedExtensions,
+		replicas:     session.replicas,
+		commitPath:   tempFileTarget(path, h.config.TempFileSuffixes),
+		opened:       time.Now(),
+	}
+
+	if !h.config.StreamUploads {
+		capacity := upload.maxSize(h.settings())
+		if h.config.SpillThreshold > 0 {
+			capacity = min(capacity, h.config.SpillThreshold)
+		}
+		upload.data = make([]byte, 0, capacity)
+		return upload, nil
+	}
+
+	stream, err := h.uploader.StartStream(ctx, session, upload.objectPath())
+	if err != nil {
+		return nil, err
+	}
+	upload.stream = stream
+	upload.digest = newFileDigest()
+	return upload, nil
+}
+
 func (h *SFTPHandler) Filecmd(r *sftp.Request) error {
 	clientIP, _ := r.Context().Value("client_ip").(string)
 	accessKey, _ := r.Context().Value("access_key_id").(string)
@@ -93,8 +383,8 @@ func (h *SFTPHandler) Filecmd(r *sftp.Request) error {
 		h.logger.Warn("file remove rejected: operation not allowed", logCtx)
 		return os.ErrPermission
 	case "Rename":
-		h.logger.Warn("file rename rejected: operation not allowed", logCtx)
-		return os.ErrPermission
+		user, _ := r.Context().Value("user").(string)
+		return h.renameTempFile(user, r.Filepath, r.Target, logCtx)
 	case "Mkdir":
 		h.logger.Info("mkdir request (virtual operation)", logCtx)
 		return nil // Allow mkdir for client compatibility but don't actually create directories
@@ -103,6 +393,7 @@ func (h *SFTPHandler) Filecmd(r *sftp.Request) error {
 		return os.ErrPermission
 	case "Setstat":
 		h.logger.Info("setstat request (ignored)", logCtx)
+		h.recordDeclaredSize(r)
 		return nil // Ignore setstat requests for compatibility
 	default:
 		h.logger.Warn("unknown file command rejected", logCtx)
@@ -115,12 +406,21 @@ func (h *SFTPHandler) Fileinfo(r *sftp.Request) ([]os.FileInfo, error) {
 }
 
 func (h *SFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method == "Stat" {
+		user, _ := r.Context().Value("user").(string)
+		if lister, ok := h.statSuspendedUpload(user, r.Filepath); ok {
+			return lister, nil
+		}
+	}
 	return nil, os.ErrPermission // no directory listing allowed
 }
 
-func (h *SFTPHandler) isPathAllowed(path string) bool {
-	cleanPath := filepath.Clean(path)
-	virtualDir := filepath.Clean(h.config.VirtualDir)
+// isPathAllowed reports whether name is inside the virtual directory. SFTP
+// paths always use forward slashes, so they are handled with package path
+// rather than filepath, which would use backslashes on Windows.
+func (h *SFTPHandler) isPathAllowed(name string) bool {
+	cleanPath := path.Clean(name)
+	virtualDir := path.Clean(h.config.VirtualDir)
 
 	// Ensure the path is inside the virtual directory
 	// Check for exact match or that it starts with virtualDir followed by a separator
@@ -139,49 +439,184 @@ type FileWriter struct {
 	upload  *FileUpload
 	handler *SFTPHandler
 	logger  *slog.Logger
+	usage   *sessionUsage // limits of the SFTP session, nil if unlimited
+	conn    *timeoutConn  // client connection, see READ_TIMEOUT
 	closed  bool
+
+	// receive covers the writes from the first to Close, which are
+	// counted instead of traced one by one.
+	receive       *span
+	writes        int
+	bytesReceived int64
+
+	transferErr error // set when the connection dropped while the file was open
 }
 
 func (fw *FileWriter) WriteAt(p []byte, off int64) (int, error) {
+	defer fw.handler.reporter.recoverPanic()
 	fw.upload.mu.Lock()
 	defer fw.upload.mu.Unlock()
+	defer func() {
+		fw.upload.sizeSeen.Store(fw.upload.size())
+		fw.upload.buffered.Store(fw.upload.memory())
+	}()
 
 	if fw.closed {
 		return 0, os.ErrClosed
 	}
+	if fw.upload.state.Load() == uploadCancelled {
+		return 0, errUploadCancelled
+	}
+
+	if fw.receive == nil {
+		_, fw.receive = fw.handler.tracer.start(contextWithSpan(context.Background(), fw.upload.span), "receive")
+	}
+	fw.writes++
+	fw.bytesReceived += int64(len(p))
 
 	logCtx := slog.Group("file_write_at",
 		"remote_ip", fw.upload.clientIP,
+		"session_id", fw.upload.sessionID,
 		"access_key_id", fw.upload.accessKey,
 		"file_path", fw.upload.path,
 		"offset", off,
 		"length", len(p),
-		"current_size", len(fw.upload.data),
+		"current_size", fw.upload.size(),
 	)
 
 	endPos := off + int64(len(p))
-	if endPos > fw.handler.config.MaxFileSize {
+	if maxSize := fw.upload.maxSize(fw.handler.settings()); endPos > maxSize {
 		fw.logger.Warn("file write rejected: exceeds size limit", logCtx,
-			slog.Int64("max_size", fw.handler.config.MaxFileSize),
+			slog.Int64("max_size", maxSize),
 			slog.Int64("attempted_size", endPos),
 		)
 		return 0, fmt.Errorf("file too large")
 	}
 
-	if int64(len(fw.upload.data)) < endPos {
-		newData := make([]byte, endPos)
-		copy(newData, fw.upload.data)
-		fw.upload.data = newData
+	if quota := fw.upload.quota; quota > 0 {
+		if used := fw.handler.quotas.used(fw.upload.user, time.Now()); used+endPos > quota {
+			fw.logger.Warn("file write rejected: exceeds daily quota", logCtx,
+				slog.Int64("quota", quota),
+				slog.Int64("quota_used", used),
+				slog.Int64("attempted_size", endPos),
+			)
+			return 0, fmt.Errorf("quota exceeded")
+		}
 	}
 
-	copy(fw.upload.data[off:], p)
+	if err := fw.usage.addBytes(endPos - fw.upload.counted); err != nil {
+		fw.logger.Warn("file write rejected: exceeds session byte limit", logCtx,
+			slog.Int64("session_max_bytes", fw.usage.maxBytes),
+		)
+		return 0, err
+	}
+	fw.upload.counted = max(fw.upload.counted, endPos)
+
+	if fw.upload.stream != nil {
+		if err := fw.writeStream(p, off); err != nil {
+			fw.logger.Error("streaming write failed", logCtx, slog.String("error", err.Error()))
+			return 0, err
+		}
+		fw.logger.Debug("file data streamed", logCtx, slog.Int("bytes_written", len(p)))
+		fw.logProgress()
+		return len(p), nil
+	}
+
+	threshold := fw.handler.config.SpillThreshold
+	if fw.upload.spill == nil && threshold > 0 && endPos > threshold {
+		if err := fw.upload.spillToDisk(fw.handler.config.SpillDir); err != nil {
+			fw.logger.Error("failed to spill upload to disk", logCtx, slog.String("error", err.Error()))
+			return 0, fmt.Errorf("failed to spill upload to disk: %w", err)
+		}
+		fw.logger.Info("upload exceeds memory threshold, spilling to disk", logCtx,
+			slog.Int64("spill_threshold", threshold),
+			slog.String("spill_file", fw.upload.spill.Name()),
+		)
+	}
+
+	if fw.upload.spill != nil {
+		if err := fw.upload.writeSpill(p, off); err != nil {
+			fw.logger.Error("failed to write spill file", logCtx, slog.String("error", err.Error()))
+			return 0, fmt.Errorf("failed to write spill file: %w", err)
+		}
+	} else {
+		if int64(len(fw.upload.data)) < endPos {
+			newData := make([]byte, endPos)
+			copy(newData, fw.upload.data)
+			fw.upload.data = newData
+		}
+
+		copy(fw.upload.data[off:], p)
+	}
+	fw.upload.markReceived(off, endPos)
 
 	fw.logger.Debug("file data written", logCtx, slog.Int("bytes_written", len(p)))
+	fw.logProgress()
 
 	return len(p), nil
 }
 
-func (fw *FileWriter) Close() error {
+// logProgress logs how much of the file has arrived every
+// PROGRESS_LOG_INTERVAL while the transfer is running.
+func (fw *FileWriter) logProgress() {
+	now := time.Now()
+	if !fw.upload.progress.record(now, fw.handler.config.ProgressLogInterval) {
+		return
+	}
+
+	logCtx := slog.Group("upload_progress",
+		append([]any{
+			"remote_ip", fw.upload.clientIP,
+			"session_id", fw.upload.sessionID,
+			"access_key_id", fw.upload.accessKey,
+			"file_path", fw.upload.path,
+		}, fw.upload.progress.attrs(now, fw.upload.size())...)...,
+	)
+	fw.logger.Info("file upload in progress", logCtx)
+}
+
+// writeStream passes p on to the S3 stream. SFTP clients pipeline writes,
+// so chunks can arrive out of order; those are held back until the data in
+// front of them has been received. Rewriting data that was already streamed
+// is not possible.
+func (fw *FileWriter) writeStream(p []byte, off int64) error {
+	upload := fw.upload
+
+	if off < upload.streamed {
+		return fmt.Errorf("cannot rewrite offset %d of a streaming upload", off)
+	}
+
+	if off > upload.streamed {
+		if upload.pendingBytes+int64(len(p)) > fw.handler.config.MultipartPartSize {
+			return fmt.Errorf("too much out-of-order data for a streaming upload")
+		}
+		if upload.pending == nil {
+			upload.pending = make(map[int64][]byte)
+		}
+		upload.pending[off] = append([]byte(nil), p...)
+		upload.pendingBytes += int64(len(p))
+		return nil
+	}
+
+	for {
+		if _, err := upload.stream.Write(p); err != nil {
+			return err
+		}
+		upload.digest.Write(p)
+		upload.streamed += int64(len(p))
+
+		next, ok := upload.pending[upload.streamed]
+		if !ok {
+			return nil
+		}
+		delete(upload.pending, upload.streamed)
+		upload.pendingBytes -= int64(len(next))
+		p = next
+	}
+}
+
+func (fw *FileWriter) Close() (err error) {
+	defer fw.handler.reporter.recoverPanic()
 	fw.upload.mu.Lock()
 	defer fw.upload.mu.Unlock()
 
@@ -189,35 +624,148 @@ func (fw *FileWriter) Close() error {
 		return nil
 	}
 	fw.closed = true
+	fw.conn.endTransfer()
+
+	fw.receive.setAttrs(slog.Int("writes", fw.writes), slog.Int64("bytes", fw.bytesReceived))
+	fw.receive.finish(fw.transferErr)
+	defer func() {
+		fw.upload.span.setAttrs(slog.Int64("file.size", fw.upload.size()))
+		fw.upload.span.finish(err)
+		access := accessRequest{clientIP: fw.upload.clientIP, sessionID: fw.upload.sessionID, user: fw.upload.user}
+		fw.handler.logRequest(access, "Put", fw.upload.path, "", err, fw.bytesReceived)
+	}()
 
 	defer fw.handler.activeUploads.Delete(fw.upload.path)
 
+	elapsed := fw.upload.progress.elapsed(time.Now())
 	logCtx := slog.Group("file_close",
 		"remote_ip", fw.upload.clientIP,
+		"session_id", fw.upload.sessionID,
 		"access_key_id", fw.upload.accessKey,
 		"file_path", fw.upload.path,
-		"final_size", len(fw.upload.data),
+		"final_size", fw.upload.size(),
+		"transfer_duration", elapsed,
+		"throughput_mb_s", throughputMBs(fw.upload.size(), elapsed),
 	)
 
-	fw.logger.Info("file upload completed, starting S3 upload", logCtx)
+	if !fw.upload.state.CompareAndSwap(uploadReceiving, uploadClosed) {
+		fw.handler.logger.Warn("upload cancelled, discarding partial file", logCtx)
+		fw.handler.discardUpload(fw.upload)
+		return errUploadCancelled
+	}
+	fw.upload.buffering = elapsed
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	if fw.transferErr != nil {
+		return fw.handler.interruptUpload(fw.upload, fw.transferErr, logCtx)
+	}
+
+	// again, as a resumed upload may have been opened under other settings
+	// of the user
+	if err := fw.handler.checkExtension(fw.upload.objectPath(), fw.upload.extensions); err != nil {
+		fw.handler.logger.Warn("upload rejected: file extension not allowed, discarding file", logCtx)
+		fw.handler.discardUpload(fw.upload)
+		return err
+	}
+
+	if fw.upload.commitPath != "" {
+		fw.handler.stageTempFile(fw.upload, logCtx)
+		return nil
+	}
+
+	return fw.handler.commitUpload(fw.upload, logCtx)
+}
+
+// commitUpload stores a fully received file in S3.
+func (h *SFTPHandler) commitUpload(upload *FileUpload, logCtx slog.Attr) error {
+	if upload.stream != nil {
+		return h.commitStream(upload, logCtx)
+	}
+
+	h.logger.Info("file upload completed, starting S3 upload", logCtx)
+	defer h.removeSpill(upload)
+
+	ctx, cancel := context.WithTimeout(contextWithSpan(context.Background(), upload.span), 10*time.Minute)
 	defer cancel()
 
-	err := fw.handler.uploader.UploadFile(
+	body, size := upload.body()
+	bucket, key, err := h.uploader.UploadFile(
 		ctx,
-		fw.upload.accessKey,
-		fw.upload.secretKey,
-		fw.upload.clientIP,
-		fw.upload.path,
-		fw.upload.data,
+		upload.session(),
+		upload.objectPath(),
+		body,
+		size,
 	)
 
+	h.observeUpload(upload, size, err)
 	if err != nil {
-		fw.logger.Error("S3 upload failed", logCtx, slog.String("error", err.Error()))
+		h.logger.Error("S3 upload failed", logCtx, slog.String("error", err.Error()))
+		h.uploadFailed(upload, bucket, key, size, err)
 		return fmt.Errorf("upload failed: %w", err)
 	}
 
-	fw.logger.Info("file upload successful", logCtx)
+	digests := h.recordDigests(upload)
+	h.uploadCompleted(upload, bucket, key, size, digests)
+	h.quotas.add(upload.user, size, time.Now())
+	h.logger.Info("file upload successful", logCtx)
 	return nil
-}
\ No newline at end of file
+}
+
+// uploadCompleted reports a file stored under key in bucket, see
+// UPLOAD_QUEUE_URL, EVENTBRIDGE_BUS and AUDIT_BUCKET.
+func (h *SFTPHandler) uploadCompleted(upload *FileUpload, bucket, key string, size int64, digests fileDigests) {
+	h.uploadQueue.uploadStored(upload.session(), upload.objectPath(), bucket, key, size, digests)
+	h.events.uploadCompleted(upload.session(), upload.objectPath(), bucket, key, size)
+	h.audit.upload(upload.session(), upload.objectPath(), bucket, key, size, nil)
+}
+
+// uploadFailed reports a file that couldn't be stored under key in bucket,
+// see UPLOAD_FAILURE_TOPIC, EVENTBRIDGE_BUS and AUDIT_BUCKET.
+func (h *SFTPHandler) uploadFailed(upload *FileUpload, bucket, key string, size int64, err error) {
+	h.notifier.uploadFailed(upload.session(), upload.objectPath(), bucket, key, size, err)
+	h.events.uploadFailed(upload.session(), upload.objectPath(), bucket, key, size, err)
+	h.audit.upload(upload.session(), upload.objectPath(), bucket, key, size, err)
+}
+
+// logRequest records an SFTP request in the access log and audit trail.
+func (h *SFTPHandler) logRequest(req accessRequest, method, filePath, target string, err error, bytes int64) {
+	h.accessLog.log(req, method, filePath, target, err, bytes)
+	h.audit.request(req, method, filePath, target, err, bytes)
+}
+
+// observeUpload records the outcome of storing upload, see /metrics.
+func (h *SFTPHandler) observeUpload(upload *FileUpload, size int64, err error) {
+	if h.metrics == nil {
+		return
+	}
+	session := upload.session()
+	h.metrics.observeUpload(h.uploader.bucketFor(session), h.uploader.keyPrefix(session), session.port, size, upload.buffering, err)
+}
+
+func (h *SFTPHandler) commitStream(upload *FileUpload, logCtx slog.Attr) error {
+	if len(upload.pending) > 0 {
+		upload.stream.Abort()
+		err := fmt.Errorf("upload failed: missing data at offset %d", upload.streamed)
+		h.observeUpload(upload, upload.streamed, err)
+		h.logger.Error("streaming upload incomplete", logCtx, slog.Int64("missing_offset", upload.streamed))
+		bucket, key := upload.stream.location()
+		h.uploadFailed(upload, bucket, key, upload.streamed, err)
+		return err
+	}
+
+	h.logger.Info("file upload completed, finishing S3 upload", logCtx)
+
+	err := upload.stream.Complete()
+	h.observeUpload(upload, upload.streamed, err)
+	bucket, key := upload.stream.location()
+	if err != nil {
+		h.logger.Error("S3 upload failed", logCtx, slog.String("error", err.Error()))
+		h.uploadFailed(upload, bucket, key, upload.streamed, err)
+		return fmt.Errorf("upload failed: %w", err)
+	}
+
+	digests := h.recordDigests(upload)
+	h.uploadCompleted(upload, bucket, key, upload.streamed, digests)
+	h.quotas.add(upload.user, upload.streamed, time.Now())
+	h.logger.Info("file upload successful", logCtx)
+	return nil
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSFTPHandler_isPathAllowed(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/uploads",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	tests := []struct {
@@ -85,7 +89,7 @@ func TestSFTPHandler_isPathAllowed_CustomVirtualDir(t *testing.T) {
 	config := &Config{
 		VirtualDir: "/custom/upload/path",
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
 
 	tests := []struct {
@@ -120,13 +124,76 @@ func TestSFTPHandler_isPathAllowed_CustomVirtualDir(t *testing.T) {
 	}
 }
 
+// fakeObjectStore keeps the files the handler stores in memory.
+type fakeObjectStore struct {
+	files map[string][]byte // by path
+	err   error             // returned by UploadFile if set
+}
+
+func (s *fakeObjectStore) UploadFile(_ context.Context, session uploadSession, filePath string, body io.ReaderAt, size int64) (string, string, error) {
+	if s.err != nil {
+		return "fake-bucket", "", s.err
+	}
+	data, err := io.ReadAll(io.NewSectionReader(body, 0, size))
+	if err != nil {
+		return "fake-bucket", "", err
+	}
+	if s.files == nil {
+		s.files = make(map[string][]byte)
+	}
+	s.files[filePath] = data
+	return "fake-bucket", session.prefix + filePath, nil
+}
+
+func (s *fakeObjectStore) StartStream(context.Context, uploadSession, string) (uploadStream, error) {
+	return nil, errors.New("streaming not supported")
+}
+
+func (s *fakeObjectStore) Exists(_ context.Context, session uploadSession, key string) (bool, error) {
+	for filePath := range s.files {
+		if session.prefix+filePath == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *fakeObjectStore) bucketFor(uploadSession) string         { return "fake-bucket" }
+func (s *fakeObjectStore) keyPrefix(session uploadSession) string { return session.prefix }
+
+func TestFileWriter_Close_StoresFile(t *testing.T) {
+	store := &fakeObjectStore{}
+	handler := NewSFTPHandler(&Config{MaxFileSize: 1024}, store, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	upload := &FileUpload{path: "/uploads/a.csv", user: "alice", prefix: "alice", data: make([]byte, 0, 16)}
+	writer := &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+
+	writer.WriteAt([]byte("a,b\n"), 0)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	if got := string(store.files["/uploads/a.csv"]); got != "a,b\n" {
+		t.Errorf("stored file = %q, want %q", got, "a,b\n")
+	}
+	if got := handler.quotas.used("alice", time.Now()); got != 4 {
+		t.Errorf("quota used = %d, want 4", got)
+	}
+
+	store.err = errors.New("access denied")
+	upload = &FileUpload{path: "/uploads/b.csv", user: "alice", data: make([]byte, 0, 16)}
+	writer = &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+	writer.WriteAt([]byte("x"), 0)
+	if err := writer.Close(); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Close() error = %v, want the store's error", err)
+	}
+}
+
 func TestFileWriter_WriteAt(t *testing.T) {
 	config := &Config{
 		MaxFileSize: 1024, // 1KB limit for testing
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
-	
+
 	upload := &FileUpload{
 		data:      make([]byte, 0, config.MaxFileSize),
 		path:      "/uploads/test.txt",
@@ -155,7 +222,7 @@ func TestFileWriter_WriteAt(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name:        "write at offset",  
+			name:        "write at offset",
 			data:        []byte("test"),
 			offset:      100,
 			expectError: false,
@@ -181,9 +248,9 @@ func TestFileWriter_WriteAt(t *testing.T) {
 			// Reset the upload data for each test
 			upload.data = make([]byte, 0, config.MaxFileSize)
 			writer.closed = false
-			
+
 			n, err := writer.WriteAt(tt.data, tt.offset)
-			
+
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("WriteAt() expected error but got none")
@@ -202,13 +269,89 @@ func TestFileWriter_WriteAt(t *testing.T) {
 	}
 }
 
+func TestFileWriter_WriteAt_PerUserMaxFileSize(t *testing.T) {
+	handler := NewSFTPHandler(&Config{MaxFileSize: 1024}, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	writer := &FileWriter{
+		upload:  &FileUpload{path: "/uploads/test.txt", maxFileSize: 4096},
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	if _, err := writer.WriteAt(make([]byte, 2048), 0); err != nil {
+		t.Errorf("WriteAt() unexpected error below the per-user limit: %v", err)
+	}
+	if _, err := writer.WriteAt(make([]byte, 2048), 3072); err == nil {
+		t.Error("WriteAt() expected error beyond the per-user limit")
+	}
+}
+
+func TestFileWriter_WriteAt_SessionByteLimit(t *testing.T) {
+	config := &Config{MaxFileSize: 4096, SessionMaxBytes: 3000}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	usage := newSessionUsage(config)
+
+	first := &FileWriter{upload: &FileUpload{path: "/uploads/a.txt"}, handler: handler, logger: handler.logger, usage: usage}
+	second := &FileWriter{upload: &FileUpload{path: "/uploads/b.txt"}, handler: handler, logger: handler.logger, usage: usage}
+
+	if _, err := first.WriteAt(make([]byte, 2048), 0); err != nil {
+		t.Fatalf("WriteAt() unexpected error below the session limit: %v", err)
+	}
+	if _, err := first.WriteAt(make([]byte, 1024), 0); err != nil {
+		t.Errorf("WriteAt() rewriting received data unexpected error: %v", err)
+	}
+	if _, err := second.WriteAt(make([]byte, 1024), 0); !errors.Is(err, errSessionByteLimit) {
+		t.Errorf("WriteAt() error = %v, want %v", err, errSessionByteLimit)
+	}
+}
+
+func TestFileWriter_WriteAt_SessionByteLimitOutOfOrder(t *testing.T) {
+	config := &Config{MaxFileSize: 4096, SessionMaxBytes: 4000, StreamUploads: true, MultipartPartSize: 4096}
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	usage := newSessionUsage(config)
+
+	writer := &FileWriter{
+		upload:  &FileUpload{path: "/uploads/a.txt", stream: newTestStream(&fakeS3Client{}, config.MultipartPartSize)},
+		handler: handler,
+		logger:  handler.logger,
+		usage:   usage,
+	}
+
+	// pipelined writes arrive ahead of the first one, which leaves a gap
+	// in the stream until it shows up
+	for _, off := range []int64{1024, 2048, 0} {
+		if _, err := writer.WriteAt(make([]byte, 1024), off); err != nil {
+			t.Fatalf("WriteAt(%d) unexpected error: %v", off, err)
+		}
+	}
+	if usage.bytes != 3072 {
+		t.Errorf("session bytes = %d, want 3072", usage.bytes)
+	}
+}
+
+func TestSessionUsage_FileLimit(t *testing.T) {
+	usage := newSessionUsage(&Config{SessionMaxFiles: 2})
+	for i := 0; i < 2; i++ {
+		if err := usage.startFile(); err != nil {
+			t.Fatalf("startFile() unexpected error for file %d: %v", i+1, err)
+		}
+	}
+	if err := usage.startFile(); !errors.Is(err, errSessionFileLimit) {
+		t.Errorf("startFile() error = %v, want %v", err, errSessionFileLimit)
+	}
+
+	if unlimited := newSessionUsage(&Config{}); unlimited.startFile() != nil || unlimited.addBytes(1<<40) != nil {
+		t.Error("expected no limits without SESSION_MAX_FILES and SESSION_MAX_BYTES")
+	}
+}
+
 func TestFileWriter_WriteAt_ClosedWriter(t *testing.T) {
 	config := &Config{
 		MaxFileSize: 1024,
 	}
-	
+
 	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
-	
+
 	upload := &FileUpload{
 		data: make([]byte, 0, config.MaxFileSize),
 	}
@@ -224,4 +367,106 @@ func TestFileWriter_WriteAt_ClosedWriter(t *testing.T) {
 	if err != os.ErrClosed {
 		t.Errorf("WriteAt() on closed writer = %v, want %v", err, os.ErrClosed)
 	}
-}
\ No newline at end of file
+}
+
+func TestFileWriter_CancelledUpload(t *testing.T) {
+	handler := NewSFTPHandler(&Config{MaxFileSize: 1024}, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	upload := &FileUpload{path: "/uploads/a.csv", data: make([]byte, 0, 1024)}
+	handler.activeUploads.Store(upload.path, upload)
+	writer := &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+
+	if _, err := writer.WriteAt([]byte("partial"), 0); err != nil {
+		t.Fatalf("WriteAt() unexpected error: %v", err)
+	}
+	upload.state.Store(uploadCancelled)
+
+	if _, err := writer.WriteAt([]byte("more"), 7); err != errUploadCancelled {
+		t.Errorf("WriteAt() after cancelling = %v, want %v", err, errUploadCancelled)
+	}
+	if err := writer.Close(); err != errUploadCancelled {
+		t.Errorf("Close() after cancelling = %v, want %v", err, errUploadCancelled)
+	}
+	if _, ok := handler.activeUploads.Load(upload.path); ok {
+		t.Error("cancelled upload is still active after Close()")
+	}
+}
+
+func TestFileWriter_WriteAt_StreamingOutOfOrder(t *testing.T) {
+	config := &Config{
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 4,
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	client := &fakeS3Client{}
+	upload := &FileUpload{
+		path:   "/uploads/test.txt",
+		stream: newTestStream(client, config.MultipartPartSize),
+	}
+
+	writer := &FileWriter{
+		upload:  upload,
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	// The second chunk arrives before the first
+	if _, err := writer.WriteAt([]byte("def"), 3); err != nil {
+		t.Fatalf("WriteAt() unexpected error: %v", err)
+	}
+	if upload.streamed != 0 {
+		t.Errorf("streamed = %d before gap was filled, want 0", upload.streamed)
+	}
+	if _, err := writer.WriteAt([]byte("abc"), 0); err != nil {
+		t.Fatalf("WriteAt() unexpected error: %v", err)
+	}
+	if upload.streamed != 6 {
+		t.Errorf("streamed = %d, want 6", upload.streamed)
+	}
+
+	if _, err := writer.WriteAt([]byte("x"), 1); err == nil {
+		t.Error("WriteAt() expected error when rewriting streamed data")
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	var got []byte
+	for _, part := range client.parts {
+		got = append(got, part...)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("uploaded data = %q, want %q", got, "abcdef")
+	}
+}
+
+func TestFileWriter_Close_StreamingWithGap(t *testing.T) {
+	config := &Config{
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 1024,
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	client := &fakeS3Client{}
+	writer := &FileWriter{
+		upload: &FileUpload{
+			path:   "/uploads/test.txt",
+			stream: newTestStream(client, config.MultipartPartSize),
+		},
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	writer.WriteAt([]byte("later"), 10)
+	if err := writer.Close(); err == nil {
+		t.Error("Close() expected error for upload with missing data")
+	}
+	if client.putObject != nil {
+		t.Error("expected nothing to be uploaded for an incomplete file")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types and status codes handled by hashConn, see
+// draft-ietf-secsh-filexfer-02.
+const (
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketExtended = 200
+
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+
+	// sftpMaxPacket is the largest packet pkg/sftp accepts.
+	sftpMaxPacket = 256 * 1024
+)
+
+// hashExtensions are advertised in the server's version packet, in addition
+// to the extensions of pkg/sftp.
+var hashExtensions = []struct{ Name, Data string }{
+	{"check-file", "md5,sha256"},
+	{"md5-hash", "1"},
+}
+
+// hashConn sits between the SSH channel and the SFTP server and answers the
+// check-file and md5-hash extension requests, which pkg/sftp doesn't know,
+// so clients can verify what the gateway received. All other packets pass
+// through. Open handles are tracked so requests can name a file by handle.
+type hashConn struct {
+	channel io.ReadWriteCloser
+	handler *SessionSFTPHandler
+	logger  *slog.Logger
+
+	in          []byte // rest of the client packet being passed to the server
+	passthrough int    // bytes of that packet still to be copied from the channel
+
+	writeMu sync.Mutex // whole packets are written to the channel
+	out     []byte     // server output up to the end of its current packet
+
+	mu      sync.Mutex
+	opens   map[uint32]string // pending open requests by ID
+	handles map[string]string // paths of open handles
+}
+
+func newHashConn(channel io.ReadWriteCloser, handler *SessionSFTPHandler, logger *slog.Logger) *hashConn {
+	return &hashConn{
+		channel: channel,
+		handler: handler,
+		logger:  logger,
+		opens:   make(map[uint32]string),
+		handles: make(map[string]string),
+	}
+}
+
+// Read passes client packets to the SFTP server, except for the hash
+// requests, which are answered right away.
+func (c *hashConn) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		if c.passthrough > 0 {
+			n, err := c.channel.Read(p[:min(len(p), c.passthrough)])
+			c.passthrough -= n
+			return n, err
+		}
+		if err := c.readPacket(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// readPacket reads the start of the next client packet. Packets hashConn
+// needs to look at are read completely; the rest is copied as it arrives.
+func (c *hashConn) readPacket() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.channel, header[:4]); err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length == 0 {
+		// invalid, but rejecting it is up to the server
+		c.in = header[:4]
+		return nil
+	}
+	if _, err := io.ReadFull(c.channel, header[4:]); err != nil {
+		return err
+	}
+
+	switch header[4] {
+	case sftpPacketOpen, sftpPacketClose, sftpPacketExtended:
+		if length <= sftpMaxPacket {
+			packet := make([]byte, 4+length)
+			copy(packet, header)
+			if _, err := io.ReadFull(c.channel, packet[5:]); err != nil {
+				return err
+			}
+			if !c.handleRequest(packet[4:]) {
+				c.in = packet
+			}
+			return nil
+		}
+	}
+	c.in = header
+	c.passthrough = length - 1
+	return nil
+}
+
+// handleRequest looks at a client packet and answers it if it is a hash
+// request. It returns false if the packet is for the SFTP server.
+func (c *hashConn) handleRequest(packet []byte) bool {
+	switch packet[0] {
+	case sftpPacketOpen:
+		var open struct {
+			ID   uint32 `sshtype:"3"`
+			Path string
+			Rest []byte `ssh:"rest"`
+		}
+		if ssh.Unmarshal(packet, &open) == nil {
+			c.mu.Lock()
+			c.opens[open.ID] = sftpPath(open.Path)
+			c.mu.Unlock()
+		}
+	case sftpPacketClose:
+		var req struct {
+			ID     uint32 `sshtype:"4"`
+			Handle string
+		}
+		if ssh.Unmarshal(packet, &req) == nil {
+			c.mu.Lock()
+			delete(c.handles, req.Handle)
+			c.mu.Unlock()
+		}
+	case sftpPacketExtended:
+		var extended struct {
+			ID      uint32 `sshtype:"200"`
+			Request string
+			Rest    []byte `ssh:"rest"`
+		}
+		if ssh.Unmarshal(packet, &extended) != nil {
+			return false
+		}
+		switch extended.Request {
+		case "check-file-name", "check-file-handle":
+			c.checkFile(extended.ID, extended.Request, packet)
+			return true
+		case "md5-hash", "md5-hash-handle":
+			c.md5Hash(extended.ID, extended.Request, packet)
+			return true
+		}
+	}
+	return false
+}
+
+// checkFile answers a check-file request from the filexfer extensions
+// draft with the hashes of a range of the file.
+func (c *hashConn) checkFile(id uint32, request string, packet []byte) {
+	var req struct {
+		ID         uint32 `sshtype:"200"`
+		Request    string
+		Name       string
+		Algorithms string
+		Start      uint64
+		Length     uint64
+		BlockSize  uint32
+	}
+	if err := ssh.Unmarshal(packet, &req); err != nil {
+		c.sendStatus(id, sftpStatusBadMessage, "malformed check-file request")
+		return
+	}
+
+	filePath, ok := c.resolve(request == "check-file-handle", req.Name)
+	if !ok {
+		c.sendStatus(id, sftpStatusFailure, "invalid handle")
+		return
+	}
+	algorithm, hashes, err := c.handler.hashFile(filePath, strings.Split(req.Algorithms, ","), int64(req.Start), int64(req.Length), int64(req.BlockSize), nil)
+	c.logRequest("check-file", filePath, algorithm, err)
+	if err != nil {
+		c.sendError(id, err)
+		return
+	}
+	c.send(ssh.Marshal(struct {
+		ID        uint32 `sshtype:"201"`
+		Extension string
+		Algorithm string
+		Hashes    []byte `ssh:"rest"`
+	}{id, "check-file", algorithm, hashes}))
+}
+
+// md5Hash answers an md5-hash request from draft-ietf-secsh-filexfer-09.
+// The hash is left empty if the start of the file doesn't match the
+// client's quick-check hash.
+func (c *hashConn) md5Hash(id uint32, request string, packet []byte) {
+	var req struct {
+		ID         uint32 `sshtype:"200"`
+		Request    string
+		Name       string
+		Start      uint64
+		Length     uint64
+		QuickCheck []byte
+	}
+	if err := ssh.Unmarshal(packet, &req); err != nil {
+		c.sendStatus(id, sftpStatusBadMessage, "malformed md5-hash request")
+		return
+	}
+
+	filePath, ok := c.resolve(request == "md5-hash-handle", req.Name)
+	if !ok {
+		c.sendStatus(id, sftpStatusFailure, "invalid handle")
+		return
+	}
+	if len(req.QuickCheck) == 0 {
+		req.QuickCheck = nil
+	}
+	_, hash, err := c.handler.hashFile(filePath, []string{"md5"}, int64(req.Start), int64(req.Length), 0, req.QuickCheck)
+	c.logRequest("md5-hash", filePath, "md5", err)
+	if err != nil {
+		c.sendError(id, err)
+		return
+	}
+	c.send(ssh.Marshal(struct {
+		ID        uint32 `sshtype:"201"`
+		Extension string
+		Hash      []byte
+	}{id, "md5-hash", hash}))
+}
+
+// resolve returns the path of a request that names a file by path or by
+// handle.
+func (c *hashConn) resolve(byHandle bool, name string) (string, bool) {
+	if !byHandle {
+		return sftpPath(name), true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	filePath, ok := c.handles[name]
+	return filePath, ok
+}
+
+func (c *hashConn) logRequest(request, filePath, algorithm string, err error) {
+	logCtx := slog.Group("hash_request",
+		"remote_ip", c.handler.clientIP,
+		"session_id", c.handler.sessionID,
+		"access_key_id", c.handler.accessKeyID,
+		"file_path", filePath,
+		"request", request,
+		"algorithm", algorithm,
+	)
+	if err != nil {
+		c.logger.Info("hash request rejected", logCtx, slog.String("error", err.Error()))
+	} else {
+		c.logger.Info("hash request", logCtx)
+	}
+}
+
+func (c *hashConn) sendError(id uint32, err error) {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		c.sendStatus(id, sftpStatusPermissionDenied, "permission denied")
+	case errors.Is(err, os.ErrNotExist):
+		c.sendStatus(id, sftpStatusNoSuchFile, "no such upload")
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		c.sendStatus(id, sftpStatusOpUnsupported, "hash not available for this range")
+	default:
+		c.sendStatus(id, sftpStatusFailure, err.Error())
+	}
+}
+
+func (c *hashConn) sendStatus(id, code uint32, message string) {
+	c.send(ssh.Marshal(struct {
+		ID       uint32 `sshtype:"101"`
+		Code     uint32
+		Message  string
+		Language string
+	}{id, code, message, ""}))
+}
+
+// send writes a packet to the client.
+func (c *hashConn) send(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writePacket(packet)
+}
+
+func (c *hashConn) writePacket(packet []byte) error {
+	_, err := c.channel.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(packet))), packet...))
+	return err
+}
+
+// Write collects the server's output and passes it on one packet at a time,
+// so it can't mix with hash replies. The version packet is extended to
+// advertise the hash extensions, and handles of opened files are recorded.
+func (c *hashConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.out = append(c.out, p...)
+	for len(c.out) >= 4 {
+		length := int(binary.BigEndian.Uint32(c.out))
+		if len(c.out) < 4+length {
+			break
+		}
+		packet := c.out[4 : 4+length]
+		if length > 0 {
+			packet = c.handleResponse(packet)
+		}
+		if err := c.writePacket(packet); err != nil {
+			return 0, err
+		}
+		c.out = c.out[4+length:]
+	}
+	if len(c.out) == 0 {
+		c.out = nil
+	}
+	return len(p), nil
+}
+
+// handleResponse looks at a server packet and returns it as it should be
+// sent to the client.
+func (c *hashConn) handleResponse(packet []byte) []byte {
+	switch packet[0] {
+	case sftpPacketVersion:
+		packet = packet[:len(packet):len(packet)] // append to a copy
+		for _, extension := range hashExtensions {
+			packet = append(packet, ssh.Marshal(extension)...)
+		}
+	case sftpPacketHandle:
+		var handle struct {
+			ID     uint32 `sshtype:"102"`
+			Handle string
+		}
+		if ssh.Unmarshal(packet, &handle) == nil {
+			c.mu.Lock()
+			if filePath, ok := c.opens[handle.ID]; ok {
+				c.handles[handle.Handle] = filePath
+				delete(c.opens, handle.ID)
+			}
+			c.mu.Unlock()
+		}
+	case sftpPacketStatus:
+		if len(packet) >= 5 {
+			c.mu.Lock()
+			delete(c.opens, binary.BigEndian.Uint32(packet[1:]))
+			c.mu.Unlock()
+		}
+	}
+	return packet
+}
+
+func (c *hashConn) Close() error {
+	return c.channel.Close()
+}
+
+// sftpPath cleans a path from a client the way the SFTP server does.
+func sftpPath(p string) string {
+	return path.Clean("/" + p)
+}
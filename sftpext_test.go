@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSFTPChannel holds the packets sent by the client in input and collects
+// everything sent to the client in output.
+type fakeSFTPChannel struct {
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+func (c *fakeSFTPChannel) Read(p []byte) (int, error)  { return c.input.Read(p) }
+func (c *fakeSFTPChannel) Write(p []byte) (int, error) { return c.output.Write(p) }
+func (c *fakeSFTPChannel) Close() error                { return nil }
+
+func sftpPacket(msg any) []byte {
+	payload := ssh.Marshal(msg)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+func readSFTPPacket(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(r, packet); err != nil {
+		t.Fatalf("failed to read packet: %v", err)
+	}
+	return packet
+}
+
+type checkFileRequest struct {
+	ID         uint32 `sshtype:"200"`
+	Request    string
+	Name       string
+	Algorithms string
+	Start      uint64
+	Length     uint64
+	BlockSize  uint32
+}
+
+type checkFileReply struct {
+	ID        uint32 `sshtype:"201"`
+	Extension string
+	Algorithm string
+	Hashes    []byte `ssh:"rest"`
+}
+
+func TestHashConn_AdvertisesExtensions(t *testing.T) {
+	channel := &fakeSFTPChannel{input: bytes.NewReader(nil)}
+	conn := newHashConn(channel, newHashTestHandler(), slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	// the server may write a packet in pieces
+	version := sftpPacket(struct {
+		Version uint32 `sshtype:"2"`
+	}{3})
+	conn.Write(version[:3])
+	conn.Write(version[3:])
+
+	var reply struct {
+		Version uint32 `sshtype:"2"`
+		Name    string
+		Data    string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(readSFTPPacket(t, &channel.output), &reply); err != nil {
+		t.Fatalf("failed to parse version packet: %v", err)
+	}
+	if reply.Version != 3 || reply.Name != "check-file" || reply.Data != "md5,sha256" {
+		t.Errorf("version packet = %+v, want version 3 with check-file", reply)
+	}
+}
+
+func TestHashConn_CheckFileByHandle(t *testing.T) {
+	handler := newHashTestHandler()
+	data := bytes.Repeat([]byte("x"), 300)
+	handler.handler.activeUploads.Store("/uploads/a.txt", &FileUpload{path: "/uploads/a.txt", user: "alice", data: data})
+
+	open := sftpPacket(struct {
+		ID     uint32 `sshtype:"3"`
+		Path   string
+		Pflags uint32
+		Attrs  uint32
+	}{1, "uploads/a.txt", 0x1a, 0})
+	checkFile := sftpPacket(checkFileRequest{2, "check-file-handle", "h1", "md5", 0, 0, 256})
+
+	channel := &fakeSFTPChannel{input: bytes.NewReader(open)}
+	conn := newHashConn(channel, handler, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, open) {
+		t.Fatalf("server read %x, %v, want the open request", got, err)
+	}
+	conn.Write(sftpPacket(struct {
+		ID     uint32 `sshtype:"102"`
+		Handle string
+	}{1, "h1"}))
+	readSFTPPacket(t, &channel.output)
+
+	channel.input = bytes.NewReader(checkFile)
+	if got, err := io.ReadAll(conn); err != nil || len(got) != 0 {
+		t.Fatalf("server read %x, %v, want the check-file request answered", got, err)
+	}
+
+	var reply checkFileReply
+	if err := ssh.Unmarshal(readSFTPPacket(t, &channel.output), &reply); err != nil {
+		t.Fatalf("failed to parse reply: %v", err)
+	}
+	first, second := md5.Sum(data[:256]), md5.Sum(data[256:])
+	if want := append(first[:], second[:]...); reply.ID != 2 || reply.Algorithm != "md5" || !bytes.Equal(reply.Hashes, want) {
+		t.Errorf("reply = %+v, want md5 hashes %x", reply, want)
+	}
+}
+
+func TestHashConn_CheckFileErrors(t *testing.T) {
+	var input []byte
+	input = append(input, sftpPacket(checkFileRequest{1, "check-file-name", "/uploads/missing.txt", "md5", 0, 0, 0})...)
+	input = append(input, sftpPacket(checkFileRequest{2, "check-file-handle", "unknown", "md5", 0, 0, 0})...)
+	input = append(input, sftpPacket(checkFileRequest{3, "check-file-name", "/etc/passwd", "md5", 0, 0, 0})...)
+
+	channel := &fakeSFTPChannel{input: bytes.NewReader(input)}
+	conn := newHashConn(channel, newHashTestHandler(), slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if got, err := io.ReadAll(conn); err != nil || len(got) != 0 {
+		t.Fatalf("server read %x, %v, want all requests answered", got, err)
+	}
+
+	for _, want := range []struct{ id, code uint32 }{{1, sftpStatusNoSuchFile}, {2, sftpStatusFailure}, {3, sftpStatusPermissionDenied}} {
+		var status struct {
+			ID       uint32 `sshtype:"101"`
+			Code     uint32
+			Message  string
+			Language string
+		}
+		if err := ssh.Unmarshal(readSFTPPacket(t, &channel.output), &status); err != nil {
+			t.Fatalf("failed to parse status: %v", err)
+		}
+		if status.ID != want.id || status.Code != want.code {
+			t.Errorf("status = %+v, want code %d for request %d", status, want.code, want.id)
+		}
+	}
+}
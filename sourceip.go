@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseAllowedIPs parses a list of addresses and CIDR ranges separated by
+// commas or spaces. Single addresses match only themselves.
+func parseAllowedIPs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// normalizeAllowedIPs validates a list for parseAllowedIPs and returns it in
+// the form stored in the allowed_ips permission extension.
+func normalizeAllowedIPs(value string) (string, error) {
+	prefixes, err := parseAllowedIPs(value)
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		values[i] = prefix.String()
+	}
+	return strings.Join(values, ","), nil
+}
+
+// ipAllowed reports whether the client address is inside one of prefixes.
+func ipAllowed(clientIP string, prefixes []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIPPolicy binds users to the networks they may log in from. The
+// networks come from the allowed_ips permission extension, set from the
+// user's entry in USERS_FILE, USERS_SECRET or USER_CONFIG_TABLE, and with
+// ALLOWED_IPS_TAG from a tag on the caller's IAM user or role. A client
+// must be inside every list that is set.
+type sourceIPPolicy struct {
+	tags   *iamTagLookup // nil without ALLOWED_IPS_TAG
+	tagKey string
+	logger *slog.Logger
+}
+
+// wrapSourceIP rejects logins from outside the user's allowed networks after
+// next succeeds.
+func wrapSourceIP[T any](p *sourceIPPolicy, next func(ssh.ConnMetadata, T) (*ssh.Permissions, error)) func(ssh.ConnMetadata, T) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, credential T) (*ssh.Permissions, error) {
+		perms, err := next(conn, credential)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.check(conn, perms); err != nil {
+			return nil, err
+		}
+		return perms, nil
+	}
+}
+
+func (p *sourceIPPolicy) check(conn ssh.ConnMetadata, perms *ssh.Permissions) error {
+	clientIP := getClientIP(conn.RemoteAddr())
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", perms.Extensions["user"],
+	)
+
+	lists := map[string]string{"user mapping": perms.Extensions["allowed_ips"]}
+
+	if principalARN := perms.Extensions["principal_arn"]; p.tags != nil && principalARN != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		value, found, err := p.tags.tag(ctx, principalARN, p.tagKey)
+		switch {
+		case errors.Is(err, errForeignPrincipal):
+			// principals of other accounts have no tags the gateway can read
+		case err != nil:
+			p.logger.Error("failed to read IAM tags", logCtx,
+				slog.String("arn", principalARN),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf("authentication unavailable")
+		case found:
+			lists["IAM tag "+p.tagKey] = value
+		}
+	}
+
+	for source, value := range lists {
+		if value == "" {
+			continue
+		}
+		prefixes, err := parseAllowedIPs(value)
+		if err != nil || len(prefixes) == 0 {
+			p.logger.Error("authentication failed: invalid allowed IPs", logCtx,
+				slog.String("source", source),
+				slog.String("allowed_ips", value),
+			)
+			return fmt.Errorf("authentication unavailable")
+		}
+		if !ipAllowed(clientIP, prefixes) {
+			p.logger.Warn("authentication failed: client IP not allowed for user", logCtx,
+				slog.String("source", source),
+				slog.String("allowed_ips", value),
+			)
+			return fmt.Errorf("client IP not allowed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIPAllowed(t *testing.T) {
+	prefixes, err := parseAllowedIPs("10.0.0.0/8, 192.168.1.100 2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseAllowedIPs() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.100", true},
+		{"192.168.1.101", false},
+		{"::ffff:10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := ipAllowed(tt.ip, prefixes); got != tt.want {
+			t.Errorf("ipAllowed(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowedIPs_Invalid(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "example.com", "10.0.0.1,,bad"} {
+		if _, err := parseAllowedIPs(value); err == nil {
+			t.Errorf("parseAllowedIPs(%q) expected error", value)
+		}
+	}
+}
+
+func TestWrapSourceIP(t *testing.T) {
+	policy := &sourceIPPolicy{logger: slog.New(slog.NewTextHandler(os.Stderr, nil))}
+
+	tests := []struct {
+		allowedIPs string
+		wantErr    bool
+	}{
+		{"", false},
+		{"192.168.1.0/24", false},
+		{"10.0.0.0/8", true},
+	}
+	for _, tt := range tests {
+		callback := wrapSourceIP(policy, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"user": "alice", "allowed_ips": tt.allowedIPs}}, nil
+		})
+		_, err := callback(testConnMetadata{user: "alice"}, []byte("s3cret"))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("allowed_ips %q: error = %v, wantErr %v", tt.allowedIPs, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWrapSourceIP_IAMTag(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+		w.Write([]byte(`<ListRoleTagsResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/">
+  <ListRoleTagsResult>
+    <Tags>
+      <member><Key>team</Key><Value>partners</Value></member>
+      <member><Key>sftpgw:allowed-ips</Key><Value>203.0.113.0/24</Value></member>
+    </Tags>
+  </ListRoleTagsResult>
+</ListRoleTagsResponse>`))
+	}))
+	defer server.Close()
+
+	lookup := newIAMTagLookup(testAWSConfig(server), "123456789012")
+	lookup.client.endpoint = server.URL
+	policy := &sourceIPPolicy{
+		tags:   lookup,
+		tagKey: "sftpgw:allowed-ips",
+		logger: slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	callback := wrapSourceIP(policy, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return &ssh.Permissions{Extensions: map[string]string{
+			"user":          "AKIAEXAMPLE",
+			"principal_arn": "arn:aws:sts::123456789012:assumed-role/partner-upload/session",
+		}}, nil
+	})
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err == nil {
+		t.Error("expected login from 192.168.1.100 to be rejected by the IAM tag")
+	}
+	if form.Get("Action") != "ListRoleTags" || form.Get("RoleName") != "partner-upload" {
+		t.Errorf("request = %v, want ListRoleTags for partner-upload", form)
+	}
+}
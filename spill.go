@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// spillToDisk moves the data received so far to a temp file in dir. From
+// then on writes go to the file, so a large buffered upload only holds
+// SPILL_THRESHOLD bytes in memory.
+func (u *FileUpload) spillToDisk(dir string) error {
+	file, err := os.CreateTemp(dir, "sftpgw-upload-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(u.data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	u.spill = file
+	u.spillSize = int64(len(u.data))
+	u.data = nil
+	return nil
+}
+
+func (u *FileUpload) writeSpill(p []byte, off int64) error {
+	if _, err := u.spill.WriteAt(p, off); err != nil {
+		return err
+	}
+	u.spillSize = max(u.spillSize, off+int64(len(p)))
+	return nil
+}
+
+// body returns the received data of a buffered upload, from memory or from
+// the spill file.
+func (u *FileUpload) body() (io.ReaderAt, int64) {
+	if u.spill != nil {
+		return u.spill, u.spillSize
+	}
+	return bytes.NewReader(u.data), int64(len(u.data))
+}
+
+// truncate drops any data beyond size, so an interrupted upload can resume
+// at size.
+func (u *FileUpload) truncate(size int64) error {
+	if u.spill != nil {
+		u.spillSize = size
+		return u.spill.Truncate(size)
+	}
+	u.data = u.data[:size]
+	return nil
+}
+
+// removeSpill deletes the spill file of an upload, if it has one.
+func (h *SFTPHandler) removeSpill(upload *FileUpload) {
+	if upload.spill == nil {
+		return
+	}
+
+	name := upload.spill.Name()
+	upload.spill.Close()
+	upload.spill = nil
+
+	if err := os.Remove(name); err != nil {
+		h.logger.Warn("failed to remove spill file",
+			slog.String("file_path", upload.path),
+			slog.String("spill_file", name),
+			slog.String("error", err.Error()),
+		)
+	}
+}
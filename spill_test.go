@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestFileWriter_WriteAt_Spill(t *testing.T) {
+	config := &Config{
+		MaxFileSize:    1024,
+		SpillThreshold: 4,
+		SpillDir:       t.TempDir(),
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	upload := &FileUpload{path: "/uploads/test.txt"}
+	writer := &FileWriter{
+		upload:  upload,
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	writer.WriteAt([]byte("abc"), 0)
+	if upload.spill != nil {
+		t.Fatal("Expected data below the threshold to stay in memory")
+	}
+
+	writer.WriteAt([]byte("defgh"), 3)
+	if upload.spill == nil {
+		t.Fatal("Expected data above the threshold to be spilled to disk")
+	}
+	if upload.data != nil {
+		t.Error("Expected in-memory data to be released after spilling")
+	}
+	if upload.size() != 8 {
+		t.Errorf("size() = %d, want 8", upload.size())
+	}
+
+	body, size := upload.body()
+	data, _ := io.ReadAll(io.NewSectionReader(body, 0, size))
+	if string(data) != "abcdefgh" {
+		t.Errorf("body = %q, want %q", data, "abcdefgh")
+	}
+
+	if err := upload.truncate(5); err != nil {
+		t.Fatalf("truncate() unexpected error: %v", err)
+	}
+	body, size = upload.body()
+	data, _ = io.ReadAll(io.NewSectionReader(body, 0, size))
+	if string(data) != "abcde" {
+		t.Errorf("body after truncate = %q, want %q", data, "abcde")
+	}
+
+	name := upload.spill.Name()
+	handler.removeSpill(upload)
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Expected spill file %s to be removed", name)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseSSHAlgorithms parses a comma separated list of SSH algorithm names,
+// in preference order. Algorithms that are known to be weak are accepted,
+// for old partner clients that need them, but reported by
+// insecureSSHAlgorithms.
+func parseSSHAlgorithms(value string, supported, insecure []string) ([]string, error) {
+	var algorithms []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(supported, name) && !slices.Contains(insecure, name) {
+			return nil, fmt.Errorf("unsupported algorithm %q, supported are %s", name, strings.Join(supported, ", "))
+		}
+		algorithms = append(algorithms, name)
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("no algorithms listed")
+	}
+	return algorithms, nil
+}
+
+// insecureSSHAlgorithms returns the algorithms of config that the SSH
+// package considers insecure, so they can be logged at startup.
+func insecureSSHAlgorithms(config ssh.Config) []string {
+	insecure := ssh.InsecureAlgorithms()
+
+	var found []string
+	for _, list := range []struct{ configured, insecure []string }{
+		{config.Ciphers, insecure.Ciphers},
+		{config.MACs, insecure.MACs},
+		{config.KeyExchanges, insecure.KeyExchanges},
+	} {
+		for _, name := range list.configured {
+			if slices.Contains(list.insecure, name) {
+				found = append(found, name)
+			}
+		}
+	}
+	return found
+}
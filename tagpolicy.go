@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tags below POLICY_TAG_PREFIX that set the session policy of a principal.
+const (
+	policyTagBucket            = "bucket"
+	policyTagPrefix            = "prefix"
+	policyTagMaxSize           = "max-size"
+	policyTagAllowedExtensions = "allowed-extensions"
+)
+
+// tagPolicy applies per-principal settings from tags on the caller's IAM
+// user or role, such as sftpgw:prefix, so partner policy can live in IAM
+// rather than in the gateway's configuration. The settings are those of
+// USER_CONFIG_TABLE, whose entries take precedence.
+type tagPolicy struct {
+	tags     *iamTagLookup
+	prefix   string // POLICY_TAG_PREFIX
+	required bool   // refuse principals without policy tags, see ALLOW_ANY_ACCOUNT
+	logger   *slog.Logger
+}
+
+// wrapTagPolicy applies the policy tags of the caller after next succeeds.
+// Logins are refused if the tags can't be read or are invalid, rather than
+// falling back to the defaults. Principals of other accounts than the
+// gateway's have no tags it can read.
+func wrapTagPolicy[T any](p *tagPolicy, next func(ssh.ConnMetadata, T) (*ssh.Permissions, error)) func(ssh.ConnMetadata, T) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, credential T) (*ssh.Permissions, error) {
+		perms, err := next(conn, credential)
+		if err != nil {
+			return nil, err
+		}
+		principalARN := perms.Extensions["principal_arn"]
+		if principalARN == "" {
+			return perms, nil
+		}
+
+		logCtx := slog.Group("auth",
+			"remote_ip", getClientIP(conn.RemoteAddr()),
+			"session_id", getSessionID(conn),
+			"user", perms.Extensions["user"],
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		tags, err := p.tags.tags(ctx, principalARN)
+		if errors.Is(err, errForeignPrincipal) {
+			// admitted by the allowlist, with the defaults; without it the
+			// tags are what admits a principal, and there are none to read
+			if p.required {
+				p.logger.Warn("authentication failed: principal of another account", logCtx, slog.String("arn", principalARN))
+				return nil, fmt.Errorf("unauthorized principal")
+			}
+			return perms, nil
+		}
+		if err != nil {
+			p.logger.Error("failed to read IAM tags", logCtx,
+				slog.String("arn", principalARN),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+		settings, err := parseTagPolicy(tags, p.prefix)
+		if err != nil {
+			p.logger.Error("authentication failed: invalid policy tags", logCtx,
+				slog.String("arn", principalARN),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+		if settings == nil {
+			if p.required {
+				p.logger.Warn("authentication failed: no policy tags", logCtx, slog.String("arn", principalARN))
+				return nil, fmt.Errorf("unauthorized principal")
+			}
+			return perms, nil
+		}
+
+		settings.apply(perms.Extensions)
+		p.logger.Info("applied IAM tag policy", logCtx,
+			slog.String("arn", principalARN),
+			slog.String("bucket", settings.bucket),
+			slog.String("upload_prefix", settings.prefix),
+			slog.Int64("max_file_size", settings.maxFileSize),
+			slog.Any("allowed_extensions", settings.allowedExtensions),
+		)
+		return perms, nil
+	}
+}
+
+// parseTagPolicy reads the policy tags below prefix. It returns nil if none
+// is set. IAM doesn't allow commas in tag values, so the extensions are
+// separated by spaces.
+func parseTagPolicy(tags map[string]string, prefix string) (*userConfig, error) {
+	settings := &userConfig{}
+	found := false
+
+	if value, ok := tags[prefix+policyTagBucket]; ok {
+		if err := validateBucketName(value); err != nil {
+			return nil, fmt.Errorf("invalid %s%s: %w", prefix, policyTagBucket, err)
+		}
+		settings.bucket = value
+		found = true
+	}
+
+	if value, ok := tags[prefix+policyTagPrefix]; ok {
+		cleaned := path.Clean(strings.Trim(value, "/"))
+		if cleaned == "." || strings.HasPrefix(cleaned, "..") {
+			return nil, fmt.Errorf("invalid %s%s %q", prefix, policyTagPrefix, value)
+		}
+		settings.prefix = cleaned
+		found = true
+	}
+
+	if value, ok := tags[prefix+policyTagMaxSize]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid %s%s %q", prefix, policyTagMaxSize, value)
+		}
+		settings.maxFileSize = size
+		found = true
+	}
+
+	if value, ok := tags[prefix+policyTagAllowedExtensions]; ok {
+		settings.allowedExtensions = normalizeExtensions(strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }))
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return settings, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseTagPolicy(t *testing.T) {
+	settings, err := parseTagPolicy(map[string]string{
+		"team":                      "partners",
+		"sftpgw:bucket":             "partner-drops",
+		"sftpgw:prefix":             "/partners/acme/",
+		"sftpgw:max-size":           "1048576",
+		"sftpgw:allowed-extensions": "CSV .xml",
+	}, "sftpgw:")
+	if err != nil {
+		t.Fatalf("parseTagPolicy() unexpected error: %v", err)
+	}
+	if settings.bucket != "partner-drops" || settings.prefix != "partners/acme" || settings.maxFileSize != 1048576 {
+		t.Errorf("settings = %+v", settings)
+	}
+	if !slices.Equal(settings.allowedExtensions, []string{".csv", ".xml"}) {
+		t.Errorf("allowedExtensions = %v, want [.csv .xml]", settings.allowedExtensions)
+	}
+
+	if settings, err := parseTagPolicy(map[string]string{"team": "partners"}, "sftpgw:"); settings != nil || err != nil {
+		t.Errorf("parseTagPolicy() without policy tags = %+v, %v, want nil", settings, err)
+	}
+
+	for _, tags := range []map[string]string{
+		{"sftpgw:bucket": "Partner_Drops"},
+		{"sftpgw:prefix": "../other"},
+		{"sftpgw:max-size": "0"},
+		{"sftpgw:max-size": "lots"},
+	} {
+		if _, err := parseTagPolicy(tags, "sftpgw:"); err == nil {
+			t.Errorf("parseTagPolicy(%v) expected error", tags)
+		}
+	}
+}
+
+func TestWrapTagPolicy(t *testing.T) {
+	var status int
+	var tags string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprintf(w, `<ListUserTagsResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/">
+  <ListUserTagsResult><Tags>%s</Tags></ListUserTagsResult>
+</ListUserTagsResponse>`, tags)
+	}))
+	defer server.Close()
+
+	lookup := newIAMTagLookup(testAWSConfig(server), "123456789012")
+	lookup.client.endpoint = server.URL
+	policy := &tagPolicy{tags: lookup, prefix: "sftpgw:", logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	callback := wrapTagPolicy(policy, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return &ssh.Permissions{Extensions: map[string]string{
+			"user":          "AKIAEXAMPLE",
+			"principal_arn": "arn:aws:iam::123456789012:user/partners/acme",
+		}}, nil
+	})
+
+	tags = `<member><Key>sftpgw:prefix</Key><Value>partners/acme</Value></member>
+    <member><Key>sftpgw:max-size</Key><Value>4096</Value></member>`
+	perms, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret"))
+	if err != nil {
+		t.Fatalf("callback() unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "partners/acme" || perms.Extensions["max_file_size"] != "4096" {
+		t.Errorf("extensions = %v, want the prefix and size from the tags", perms.Extensions)
+	}
+	if _, ok := perms.Extensions["bucket"]; ok {
+		t.Errorf("extensions = %v, want no bucket without its tag", perms.Extensions)
+	}
+
+	tags = `<member><Key>sftpgw:max-size</Key><Value>-1</Value></member>`
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("callback() with invalid tag error = %v, want authentication unavailable", err)
+	}
+
+	tags = ``
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err != nil {
+		t.Errorf("callback() without tags unexpected error: %v", err)
+	}
+	policy.required = true
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("callback() without tags error = %v, want unauthorized when tags are required", err)
+	}
+	policy.required = false
+
+	status = http.StatusForbidden
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err == nil {
+		t.Error("callback() expected error when the tags can't be read")
+	}
+	status = 0
+}
+
+func TestWrapTagPolicy_ForeignAccount(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `<ListRoleTagsResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/">
+  <ListRoleTagsResult><Tags><member><Key>sftpgw:prefix</Key><Value>partners/acme</Value></member></Tags></ListRoleTagsResult>
+</ListRoleTagsResponse>`)
+	}))
+	defer server.Close()
+
+	lookup := newIAMTagLookup(testAWSConfig(server), "123456789012")
+	lookup.client.endpoint = server.URL
+	policy := &tagPolicy{tags: lookup, prefix: "sftpgw:", logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	// a role of another account with the name of a tagged role of the gateway's
+	callback := wrapTagPolicy(policy, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return &ssh.Permissions{Extensions: map[string]string{
+			"user":          "AKIAEXAMPLE",
+			"principal_arn": "arn:aws:sts::210987654321:assumed-role/partner-upload/session",
+		}}, nil
+	})
+
+	perms, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret"))
+	if err != nil {
+		t.Fatalf("callback() unexpected error: %v", err)
+	}
+	if _, ok := perms.Extensions["upload_prefix"]; ok {
+		t.Errorf("extensions = %v, want no policy from the gateway account's role", perms.Extensions)
+	}
+
+	policy.required = true
+	if _, err := callback(testConnMetadata{user: "AKIAEXAMPLE"}, []byte("secret")); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("callback() error = %v, want unauthorized when tags are required", err)
+	}
+	if requests != 0 {
+		t.Errorf("IAM was asked %d times for the tags of a principal of another account", requests)
+	}
+}
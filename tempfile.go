@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// tempFileRenameTimeout is how long a temp file that has been written
+// completely waits for the client to rename it before it is discarded.
+const tempFileRenameTimeout = 10 * time.Minute
+
+// stagedUpload is a temp file that has been closed but not renamed yet.
+type stagedUpload struct {
+	upload *FileUpload
+	timer  *time.Timer
+}
+
+// tempFileTarget returns the name a temp file will be renamed to, for example
+// /uploads/report.csv for /uploads/report.csv.filepart. It returns "" when
+// path does not end in one of the suffixes.
+func tempFileTarget(path string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if target, ok := strings.CutSuffix(path, suffix); ok && !strings.HasSuffix(target, "/") {
+			return target
+		}
+	}
+	return ""
+}
+
+// stageTempFile keeps a closed temp file until the client renames it to its
+// final name. Nothing is stored in S3 until then. Temp files are kept per
+// user, like suspended uploads, as they are stored with the user's
+// credentials.
+func (h *SFTPHandler) stageTempFile(upload *FileUpload, logCtx slog.Attr) {
+	key := resumeKey(upload.user, upload.path)
+	staged := &stagedUpload{upload: upload}
+	staged.timer = time.AfterFunc(tempFileRenameTimeout, func() {
+		if h.stagedUploads.CompareAndDelete(key, staged) {
+			h.logger.Warn("temp file was not renamed, discarding upload", logCtx)
+			h.discardUpload(upload)
+		}
+	})
+
+	if previous, ok := h.stagedUploads.Swap(key, staged); ok {
+		previous := previous.(*stagedUpload)
+		previous.timer.Stop()
+		h.discardUpload(previous.upload)
+	}
+
+	h.logger.Info("temp file received, waiting for rename", logCtx, slog.String("commit_path", upload.commitPath))
+}
+
+// renameTempFile commits user's staged temp file when they rename it to its
+// final name. Any other rename is rejected, as S3 objects can't be moved.
+func (h *SFTPHandler) renameTempFile(user, source, target string, logCtx slog.Attr) error {
+	commitPath := tempFileTarget(source, h.config.TempFileSuffixes)
+	if commitPath == "" || commitPath != target || !h.isPathAllowed(target) {
+		h.logger.Warn("file rename rejected: operation not allowed", logCtx, slog.String("target", target))
+		return os.ErrPermission
+	}
+
+	// another user's temp file of the same name is not found
+	value, ok := h.stagedUploads.LoadAndDelete(resumeKey(user, source))
+	if !ok {
+		h.logger.Warn("file rename rejected: temp file not found", logCtx, slog.String("target", target))
+		return os.ErrNotExist
+	}
+
+	staged := value.(*stagedUpload)
+	staged.timer.Stop()
+
+	h.logger.Info("temp file renamed, committing upload", logCtx, slog.String("target", target))
+	return h.commitUpload(staged.upload, logCtx)
+}
+
+func (h *SFTPHandler) discardUpload(upload *FileUpload) {
+	if upload.stream != nil {
+		upload.stream.Abort()
+	}
+	h.removeSpill(upload)
+}
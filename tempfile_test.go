@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestTempFileTarget(t *testing.T) {
+	suffixes := []string{".filepart", ".part"}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/uploads/report.csv.filepart", "/uploads/report.csv"},
+		{"/uploads/report.csv.part", "/uploads/report.csv"},
+		{"/uploads/report.csv", ""},
+		{"/uploads/.part", ""},
+		{"/uploads/report.partial", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := tempFileTarget(tt.path, suffixes); got != tt.want {
+				t.Errorf("tempFileTarget(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if got := tempFileTarget("/uploads/report.csv.filepart", nil); got != "" {
+		t.Errorf("tempFileTarget() without suffixes = %q, want empty", got)
+	}
+}
+
+func TestSFTPHandler_RenameTempFile(t *testing.T) {
+	config := &Config{
+		VirtualDir:        "/uploads",
+		MaxFileSize:       1024,
+		StreamUploads:     true,
+		MultipartPartSize: 1024,
+		TempFileSuffixes:  []string{".filepart"},
+	}
+
+	handler := NewSFTPHandler(config, nil, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	logCtx := slog.Group("test")
+
+	client := &fakeS3Client{}
+	writer := &FileWriter{
+		upload: &FileUpload{
+			user:       "alice",
+			path:       "/uploads/test.txt.filepart",
+			commitPath: "/uploads/test.txt",
+			stream:     newTestStream(client, config.MultipartPartSize),
+		},
+		handler: handler,
+		logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+
+	writer.WriteAt([]byte("hello"), 0)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+	if client.putObject != nil {
+		t.Fatal("expected nothing to be uploaded before the rename")
+	}
+
+	if err := handler.renameTempFile("alice", "/uploads/test.txt.filepart", "/uploads/other.txt", logCtx); err != os.ErrPermission {
+		t.Errorf("renameTempFile() to another name = %v, want %v", err, os.ErrPermission)
+	}
+	if err := handler.renameTempFile("bob", "/uploads/test.txt.filepart", "/uploads/test.txt", logCtx); err != os.ErrNotExist {
+		t.Errorf("renameTempFile() by another user = %v, want %v", err, os.ErrNotExist)
+	}
+	if client.putObject != nil {
+		t.Fatal("expected another user's rename to leave the temp file staged")
+	}
+	if err := handler.renameTempFile("alice", "/uploads/test.txt.filepart", "/uploads/test.txt", logCtx); err != nil {
+		t.Fatalf("renameTempFile() unexpected error: %v", err)
+	}
+	if string(client.putObject) != "hello" {
+		t.Errorf("uploaded data = %q, want %q", client.putObject, "hello")
+	}
+
+	if err := handler.renameTempFile("alice", "/uploads/test.txt.filepart", "/uploads/test.txt", logCtx); err != os.ErrNotExist {
+		t.Errorf("second renameTempFile() = %v, want %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutConn applies READ_TIMEOUT and WRITE_TIMEOUT to a client connection
+// once the SSH handshake is done. Every write must complete within the write
+// timeout. Reads only time out while an upload is open, so a session may sit
+// idle between transfers, but one that stalls in the middle of a file is
+// closed instead of holding its buffer and connection slot forever.
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	logger       *slog.Logger
+
+	started   atomic.Bool
+	transfers atomic.Int32 // open uploads
+	received  atomic.Int64 // bytes read, for the admin API
+	sent      atomic.Int64 // bytes written
+}
+
+func newTimeoutConn(conn net.Conn, config *Config, logger *slog.Logger) *timeoutConn {
+	return &timeoutConn{
+		Conn:         conn,
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		logger:       logger,
+	}
+}
+
+// start enables the timeouts; the handshake has its own deadline.
+func (c *timeoutConn) start() {
+	c.started.Store(true)
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.started.Load() && c.readTimeout > 0 && c.transfers.Load() > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		// the last upload may have been closed in the meantime
+		if c.transfers.Load() == 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.logger.Warn("connection closed: no data from client during upload",
+			slog.String("remote_ip", getClientIP(c.RemoteAddr())),
+			slog.Duration("read_timeout", c.readTimeout),
+		)
+	}
+	return n, err
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.started.Load() && c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.logger.Warn("connection closed: client stopped receiving",
+			slog.String("remote_ip", getClientIP(c.RemoteAddr())),
+			slog.Duration("write_timeout", c.writeTimeout),
+		)
+	}
+	return n, err
+}
+
+// startTransfer is called when an upload is opened. A nil timeoutConn
+// ignores transfers.
+func (c *timeoutConn) startTransfer() {
+	if c == nil {
+		return
+	}
+	if c.transfers.Add(1) == 1 && c.readTimeout > 0 {
+		// a read may already be waiting without a deadline
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+}
+
+// endTransfer is called when an upload is closed, before it is stored, so
+// a slow S3 upload doesn't count against the client.
+func (c *timeoutConn) endTransfer() {
+	if c == nil {
+		return
+	}
+	if c.transfers.Add(-1) == 0 {
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestTimeoutConn(t *testing.T) (*timeoutConn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	conn := newTimeoutConn(server, &Config{ReadTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	conn.start()
+	return conn, client
+}
+
+func TestTimeoutConn_ReadTimesOutDuringTransfer(t *testing.T) {
+	conn, _ := newTestTimeoutConn(t)
+	conn.startTransfer()
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestTimeoutConn_IdleReadWithoutTransfer(t *testing.T) {
+	conn, client := newTestTimeoutConn(t)
+	conn.startTransfer()
+	conn.endTransfer()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Read() returned %v while idle, want it to wait", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	client.Write([]byte{1})
+	if err := <-done; err != nil {
+		t.Errorf("Read() unexpected error: %v", err)
+	}
+}
+
+func TestTimeoutConn_WriteTimeout(t *testing.T) {
+	conn, _ := newTestTimeoutConn(t)
+
+	if _, err := conn.Write([]byte("nobody reads this")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
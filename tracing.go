@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+)
+
+const (
+	traceExportInterval = 5 * time.Second
+	maxPendingSpans     = 4096 // spans beyond this are dropped until the next export
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// tracer records spans of logins and uploads and sends them to an
+// OpenTelemetry collector with OTLP over HTTP, using the JSON encoding. The
+// gateway records a handful of spans per file, so they are collected here
+// instead of pulling in the OpenTelemetry SDK. A nil tracer records nothing.
+type tracer struct {
+	endpoint string // OTLP traces URL
+	service  string
+	client   *http.Client
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int
+}
+
+func newTracer(config *Config, logger *slog.Logger) *tracer {
+	if config.OTLPEndpoint == "" {
+		return nil
+	}
+	return &tracer{
+		endpoint: strings.TrimSuffix(config.OTLPEndpoint, "/") + "/v1/traces",
+		service:  config.OTelServiceName,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+	}
+}
+
+// span is one timed operation. Its methods do nothing on a nil span, so
+// callers don't need to check whether tracing is enabled.
+type span struct {
+	tracer   *tracer // nil for the remote parent of a span, see withTraceParent
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	attrs  []slog.Attr
+	end    time.Time
+	errMsg string
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span ctx belongs to, if any.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// contextWithSpan returns ctx with s as the parent of new spans.
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// withTraceParent returns ctx with the span of a W3C traceparent header as
+// the parent of new spans. Invalid or empty values are ignored.
+func withTraceParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+	parent := &span{}
+	if n, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || n != len(parent.traceID) {
+		return ctx
+	}
+	if n, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || n != len(parent.spanID) {
+		return ctx
+	}
+	return contextWithSpan(ctx, parent)
+}
+
+// start begins a span named name, as a child of the span in ctx if there is
+// one, and returns a context for its children.
+func (t *tracer) start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		tracer: t,
+		name:   name,
+		kind:   spanKindInternal,
+		start:  time.Now(),
+		attrs:  attrs,
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return contextWithSpan(ctx, s), s
+}
+
+// setAttrs adds attributes to the span, replacing those with the same key.
+func (s *span) setAttrs(attrs ...slog.Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.attrs {
+			if s.attrs[i].Key == attr.Key {
+				s.attrs[i], replaced = attr, true
+			}
+		}
+		if !replaced {
+			s.attrs = append(s.attrs, attr)
+		}
+	}
+}
+
+// finish ends the span, marking it failed if err is set, and queues it for
+// export. Only the first call has an effect.
+func (s *span) finish(err error) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.errMsg = err.Error()
+	}
+	s.mu.Unlock()
+
+	s.tracer.queue(s)
+}
+
+// traceParent returns the span as a W3C traceparent header value, so it can
+// be the parent of spans elsewhere, or "" for a nil span.
+func (s *span) traceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+func (t *tracer) queue(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// run exports the recorded spans every traceExportInterval until ctx is done.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+// flush exports the spans recorded since the last export.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warn("trace spans dropped", slog.Int("spans", dropped))
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := t.export(spans); err != nil {
+		t.logger.Warn("failed to export trace spans",
+			slog.String("endpoint", t.endpoint),
+			slog.Int("spans", len(spans)),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// OTLP/JSON messages, see opentelemetry-proto's trace.proto. IDs are hex
+// encoded and 64-bit integers are strings.
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (t *tracer) export(spans []*span) error {
+	var out []otlpSpan
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			o.Status = &otlpStatus{Code: spanStatusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]slog.Attr{slog.String("service.name", t.service)}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "sftpgw"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func otlpAttributes(attrs []slog.Attr) []otlpKeyValue {
+	var out []otlpKeyValue
+	for _, attr := range attrs {
+		var value map[string]any
+		switch v := attr.Value.Resolve(); v.Kind() {
+		case slog.KindBool:
+			value = map[string]any{"boolValue": v.Bool()}
+		case slog.KindInt64:
+			value = map[string]any{"intValue": strconv.FormatInt(v.Int64(), 10)}
+		case slog.KindUint64:
+			value = map[string]any{"intValue": strconv.FormatUint(v.Uint64(), 10)}
+		case slog.KindFloat64:
+			value = map[string]any{"doubleValue": v.Float64()}
+		default:
+			value = map[string]any{"stringValue": v.String()}
+		}
+		out = append(out, otlpKeyValue{Key: attr.Key, Value: value})
+	}
+	return out
+}
+
+// tracingHTTPClient records a span for every request the AWS SDK sends,
+// named after the API operation, such as "S3.UploadPart". Retries get a
+// span each.
+type tracingHTTPClient struct {
+	next   aws.HTTPClient
+	tracer *tracer
+}
+
+// httpClient returns client, wrapped to trace AWS requests if tracing is
+// enabled.
+func (t *tracer) httpClient(client aws.HTTPClient) aws.HTTPClient {
+	if t == nil {
+		return client
+	}
+	return &tracingHTTPClient{next: client, tracer: t}
+}
+
+func (c *tracingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+
+	name := "HTTP " + req.Method
+	if operation != "" {
+		name = service + "." + operation
+	}
+	_, s := c.tracer.start(ctx, name,
+		slog.String("rpc.system", "aws-api"),
+		slog.String("rpc.service", service),
+		slog.String("rpc.method", operation),
+		slog.String("http.request.method", req.Method),
+		slog.String("server.address", req.URL.Hostname()),
+	)
+	s.kind = spanKindClient
+
+	resp, err := c.next.Do(req)
+	if err != nil {
+		s.finish(err)
+		return resp, err
+	}
+
+	s.setAttrs(slog.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		s.finish(fmt.Errorf("%s", resp.Status))
+	} else {
+		s.finish(nil)
+	}
+	return resp, nil
+}
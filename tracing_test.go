@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func newTestTracer(t *testing.T) (*tracer, chan otlpRequest) {
+	t.Helper()
+	requests := make(chan otlpRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export to %s with content type %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode export: %v", err)
+		}
+		requests <- req
+	}))
+	t.Cleanup(collector.Close)
+
+	config := &Config{OTLPEndpoint: collector.URL, OTelServiceName: "sftpgw"}
+	return newTracer(config, slog.New(slog.NewTextHandler(os.Stderr, nil))), requests
+}
+
+func TestTracer_ExportsSpans(t *testing.T) {
+	tr, requests := newTestTracer(t)
+
+	ctx, parent := tr.start(context.Background(), "upload", slog.String("file.path", "/uploads/a.txt"))
+	_, child := tr.start(ctx, "s3.upload", slog.Int64("file.size", 42))
+	child.finish(errors.New("access denied"))
+	parent.finish(nil)
+	parent.finish(errors.New("ignored"))
+
+	tr.flush()
+	req := <-requests
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+
+	got, want := spans[0], spans[1]
+	if got.Name != "s3.upload" || got.TraceID != want.TraceID || got.ParentSpanID != want.SpanID {
+		t.Errorf("child span = %+v, want s3.upload below %s", got, want.SpanID)
+	}
+	if got.Status == nil || got.Status.Code != spanStatusError || got.Status.Message != "access denied" {
+		t.Errorf("child status = %+v, want the error", got.Status)
+	}
+	if len(got.Attributes) != 1 || got.Attributes[0].Value["intValue"] != "42" {
+		t.Errorf("child attributes = %+v, want file.size 42", got.Attributes)
+	}
+	if want.ParentSpanID != "" || want.Status != nil {
+		t.Errorf("parent span = %+v, want a root span without error", want)
+	}
+
+	tr.flush()
+	select {
+	case <-requests:
+		t.Error("flush() exported again without new spans")
+	default:
+	}
+}
+
+func TestTracer_TraceParent(t *testing.T) {
+	tr, requests := newTestTracer(t)
+
+	_, login := tr.start(context.Background(), "authenticate")
+	ctx := withTraceParent(context.Background(), login.traceParent())
+	_, upload := tr.start(ctx, "upload")
+	upload.finish(nil)
+	login.finish(nil)
+
+	tr.flush()
+	spans := (<-requests).ResourceSpans[0].ScopeSpans[0].Spans
+	if spans[0].TraceID != spans[1].TraceID || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("upload span = %+v, want it below the login %+v", spans[0], spans[1])
+	}
+
+	for _, invalid := range []string{"", "00-abc-def-01", "01-" + login.traceParent()[3:]} {
+		if spanFromContext(withTraceParent(context.Background(), invalid)) != nil {
+			t.Errorf("withTraceParent(%q) set a parent", invalid)
+		}
+	}
+}
+
+func TestTracer_Disabled(t *testing.T) {
+	var tr *tracer
+	ctx, s := tr.start(context.Background(), "upload")
+	if s != nil || spanFromContext(ctx) != nil {
+		t.Error("nil tracer started a span")
+	}
+	s.setAttrs(slog.String("file.path", "/uploads/a.txt"))
+	s.finish(nil)
+	tr.flush()
+
+	if s.traceParent() != "" {
+		t.Error("traceParent() of a nil span not empty")
+	}
+	if client := tr.httpClient(http.DefaultClient); client != http.DefaultClient {
+		t.Error("httpClient() wrapped the client without tracing")
+	}
+}
+
+func TestTracingHTTPClient(t *testing.T) {
+	tr, requests := newTestTracer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	ctx, parent := tr.start(context.Background(), "authenticate")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, nil)
+	resp, err := tr.httpClient(http.DefaultClient).Do(req)
+	if err != nil {
+		t.Fatalf("Do() unexpected error: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	parent.finish(nil)
+
+	tr.flush()
+	spans := (<-requests).ResourceSpans[0].ScopeSpans[0].Spans
+	got := spans[0]
+	if got.Name != "HTTP POST" || got.Kind != spanKindClient || got.ParentSpanID != spans[1].SpanID {
+		t.Errorf("request span = %+v, want a client span below the login", got)
+	}
+	if got.Status == nil || got.Status.Code != spanStatusError {
+		t.Errorf("request span status = %+v, want an error for 403", got.Status)
+	}
+}
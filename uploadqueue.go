@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// sqsHostPattern matches the hosts of SQS queue URLs, in the current and the
+// legacy form, and captures the region.
+var sqsHostPattern = regexp.MustCompile(`^(?:sqs\.([a-z0-9-]+)|([a-z0-9-]+)\.queue)\.amazonaws\.com(?:\.cn)?$`)
+
+// storedUpload is the message sent for a file stored in S3.
+type storedUpload struct {
+	Event string    `json:"event"` // always "UploadCompleted"
+	Time  time.Time `json:"time"`
+	uploadFields
+	SHA256 string `json:"sha256,omitempty"` // hex, of the data the client sent
+}
+
+// uploadQueue sends a message to the SQS queue UPLOAD_QUEUE_URL for every
+// file stored in S3, so workers can pick up new files without S3 event
+// notifications on the bucket. A nil uploadQueue sends nothing.
+type uploadQueue struct {
+	asyncSender[storedUpload]
+
+	queueURL string
+	fifo     bool // needs a message group and deduplication ID
+}
+
+func newUploadQueue(cfg *Config, awsConfig aws.Config, logger *slog.Logger) *uploadQueue {
+	client := newAWSJSONClient(awsConfig, "sqs", "AmazonSQS", "1.0")
+	// requests go to the host of the queue URL, which may be in another
+	// region than the gateway or a local endpoint
+	if queueURL, err := url.Parse(cfg.UploadQueueURL); err == nil {
+		client.endpoint = queueURL.Scheme + "://" + queueURL.Host
+		if region := sqsQueueRegion(queueURL.Hostname()); region != "" {
+			client.region = region
+		}
+	}
+	q := &uploadQueue{
+		asyncSender: newAsyncSender[storedUpload]("upload queue message", client, 1000, 1, logger),
+		queueURL:    cfg.UploadQueueURL,
+		fifo:        strings.HasSuffix(cfg.UploadQueueURL, ".fifo"),
+	}
+	q.logAttrs = []any{slog.String("queue_url", q.queueURL)}
+	q.deliver = func(ctx context.Context, batch []storedUpload) error {
+		return q.send(ctx, batch[0])
+	}
+	return q
+}
+
+// sqsQueueRegion returns the region in the host of an SQS queue URL, or ""
+// for hosts that don't name one.
+func sqsQueueRegion(host string) string {
+	m := sqsHostPattern.FindStringSubmatch(host)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2]
+}
+
+// uploadStored queues a message for a file of session stored under key in
+// bucket.
+func (q *uploadQueue) uploadStored(session uploadSession, filePath, bucket, key string, size int64, digests fileDigests) {
+	if q == nil {
+		return
+	}
+	q.enqueue(storedUpload{
+		Event:        "UploadCompleted",
+		Time:         q.timeFunc().UTC(),
+		uploadFields: newUploadFields(session, filePath, bucket, key, size),
+		SHA256:       hex.EncodeToString(digests.sha256),
+	}, slog.String("file_path", filePath))
+}
+
+// send sends one message with SQS SendMessage. Messages to a FIFO queue are
+// grouped by user, so each user's files are processed in order.
+func (q *uploadQueue) send(ctx context.Context, upload storedUpload) error {
+	body, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	input := map[string]string{
+		"QueueUrl":    q.queueURL,
+		"MessageBody": string(body),
+	}
+	if q.fifo {
+		input["MessageGroupId"] = upload.User
+		input["MessageDeduplicationId"] = newUUID()
+	}
+	return q.client.call(ctx, "SendMessage", input, nil)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func newTestUploadQueue(t *testing.T, queueURL string, handler http.HandlerFunc) *uploadQueue {
+	return newTestAWSSender(t, time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC), handler, func(awsConfig aws.Config) *uploadQueue {
+		return newUploadQueue(&Config{UploadQueueURL: queueURL}, awsConfig, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	})
+}
+
+func TestUploadQueue_Send(t *testing.T) {
+	var input map[string]string
+	var target, authorization string
+	q := newTestUploadQueue(t, "https://sqs.eu-west-1.amazonaws.com/123456789012/sftp-uploads", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &input)
+		target = r.Header.Get("X-Amz-Target")
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"MessageId":"1"}`))
+	})
+	if q.client.region != "eu-west-1" || q.fifo {
+		t.Errorf("region = %s and fifo %v, want the queue's region eu-west-1 and a standard queue", q.client.region, q.fifo)
+	}
+
+	session := uploadSession{user: "acme", accessKeyID: "AKIATEST", accountID: "123456789012", sessionID: "0123456789abcdef", clientIP: "203.0.113.7"}
+	d := newFileDigest()
+	d.Write([]byte("hello"))
+	q.uploadStored(session, "/uploads/orders.csv", "partner-drops", "2024-01-15/orders.csv", 5, d.sums())
+	if err := q.send(context.Background(), <-q.queue); err != nil {
+		t.Fatalf("send() unexpected error: %v", err)
+	}
+
+	if target != "AmazonSQS.SendMessage" || input["QueueUrl"] != "https://sqs.eu-west-1.amazonaws.com/123456789012/sftp-uploads" {
+		t.Errorf("request = %s %v, want SendMessage to the queue", target, input)
+	}
+	if !strings.Contains(authorization, "/eu-west-1/sqs/") {
+		t.Errorf("Authorization = %s, want signed for sqs in eu-west-1", authorization)
+	}
+	if _, ok := input["MessageGroupId"]; ok {
+		t.Error("MessageGroupId set for a standard queue")
+	}
+
+	var message storedUpload
+	if err := json.Unmarshal([]byte(input["MessageBody"]), &message); err != nil {
+		t.Fatalf("MessageBody is not JSON: %v", err)
+	}
+	want := storedUpload{
+		Event: "UploadCompleted",
+		Time:  time.Date(2024, 1, 15, 14, 30, 45, 0, time.UTC),
+		uploadFields: uploadFields{
+			User:        "acme",
+			AccessKeyID: "AKIATEST",
+			AccountID:   "123456789012",
+			SessionID:   "0123456789abcdef",
+			RemoteIP:    "203.0.113.7",
+			FilePath:    "/uploads/orders.csv",
+			Bucket:      "partner-drops",
+			Key:         "2024-01-15/orders.csv",
+			Size:        5,
+		},
+		SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if message != want {
+		t.Errorf("MessageBody = %+v, want %+v", message, want)
+	}
+}
+
+func TestUploadQueue_SendFIFO(t *testing.T) {
+	var input map[string]string
+	q := newTestUploadQueue(t, "https://sqs.us-east-1.amazonaws.com/123456789012/sftp-uploads.fifo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Write([]byte(`{"MessageId":"1"}`))
+	})
+
+	if err := q.send(context.Background(), storedUpload{uploadFields: uploadFields{User: "acme"}}); err != nil {
+		t.Fatalf("send() unexpected error: %v", err)
+	}
+	if input["MessageGroupId"] != "acme" || input["MessageDeduplicationId"] == "" {
+		t.Errorf("request = %v, want the user's message group and a deduplication ID", input)
+	}
+}
+
+func TestUploadQueue_SendError(t *testing.T) {
+	q := newTestUploadQueue(t, "https://sqs.us-east-1.amazonaws.com/123456789012/sftp-uploads", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"The specified queue does not exist."}`))
+	})
+
+	err := q.send(context.Background(), storedUpload{uploadFields: uploadFields{FilePath: "/uploads/a.csv"}})
+	if !isAWSErrorCode(err, "QueueDoesNotExist") {
+		t.Errorf("send() error = %v, want QueueDoesNotExist", err)
+	}
+}
+
+func TestSQSQueueRegion(t *testing.T) {
+	for host, want := range map[string]string{
+		"sqs.eu-west-1.amazonaws.com":      "eu-west-1",
+		"us-east-2.queue.amazonaws.com":    "us-east-2",
+		"sqs.cn-north-1.amazonaws.com.cn":  "cn-north-1",
+		"localhost":                        "",
+		"sqs.eu-west-1.amazonaws.com.evil": "",
+	} {
+		if got := sqsQueueRegion(host); got != want {
+			t.Errorf("sqsQueueRegion(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestFileWriter_Close_QueuesUpload(t *testing.T) {
+	handler := NewSFTPHandler(&Config{MaxFileSize: 1024}, &fakeObjectStore{}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	handler.uploadQueue = &uploadQueue{asyncSender: newAsyncSender[storedUpload]("upload queue message", nil, 1, 1, handler.logger)}
+	upload := &FileUpload{path: "/uploads/a.csv", user: "alice", prefix: "alice", data: make([]byte, 0, 16)}
+	writer := &FileWriter{upload: upload, handler: handler, logger: handler.logger}
+
+	writer.WriteAt([]byte("hello"), 0)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	select {
+	case message := <-handler.uploadQueue.queue:
+		if message.Bucket != "fake-bucket" || message.Key != "alice/uploads/a.csv" || message.Size != 5 || !strings.HasPrefix(message.SHA256, "2cf24dba") {
+			t.Errorf("message = %+v, want the stored file", message)
+		}
+	default:
+		t.Error("no message queued for the stored file")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"golang.org/x/crypto/ssh"
+)
+
+// userConfig holds per-user settings from USER_CONFIG_TABLE. Empty fields
+// keep the gateway defaults.
+type userConfig struct {
+	bucket            string
+	prefix            string
+	maxFileSize       int64
+	allowedExtensions []string // lower case, with the leading dot
+	allowedIPs        string   // see sourceIPPolicy
+}
+
+// dynamoAttribute is a DynamoDB attribute value in the JSON protocol.
+type dynamoAttribute struct {
+	S  *string           `json:"S,omitempty"`
+	N  *string           `json:"N,omitempty"`
+	SS []string          `json:"SS,omitempty"`
+	L  []dynamoAttribute `json:"L,omitempty"`
+}
+
+// strings returns the values of a string set, a list of strings or a comma
+// separated string.
+func (a dynamoAttribute) strings() []string {
+	values := a.SS
+	for _, element := range a.L {
+		if element.S != nil {
+			values = append(values, *element.S)
+		}
+	}
+	if a.S != nil {
+		values = append(values, strings.Split(*a.S, ",")...)
+	}
+	return values
+}
+
+// userConfigStore reads per-user settings from a DynamoDB table.
+type userConfigStore struct {
+	table        string
+	keyAttribute string
+	client       *awsJSONClient
+	logger       *slog.Logger
+}
+
+func newUserConfigStore(cfg *Config, awsConfig aws.Config, logger *slog.Logger) *userConfigStore {
+	return &userConfigStore{
+		table:        cfg.UserConfigTable,
+		keyAttribute: cfg.UserConfigKey,
+		client:       newAWSJSONClient(awsConfig, "dynamodb", "DynamoDB_20120810", "1.0"),
+		logger:       logger,
+	}
+}
+
+// wrapUserConfig applies the settings stored for the user after next
+// succeeds. The caller's ARN is looked up first, so a single entry can cover
+// every key of an IAM user or role, then the user name, which is the access
+// key ID for AWS credentials. Users without an entry keep the defaults.
+func wrapUserConfig[T any](store *userConfigStore, next func(ssh.ConnMetadata, T) (*ssh.Permissions, error)) func(ssh.ConnMetadata, T) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, credential T) (*ssh.Permissions, error) {
+		perms, err := next(conn, credential)
+		if err != nil {
+			return nil, err
+		}
+
+		logCtx := slog.Group("auth",
+			"remote_ip", getClientIP(conn.RemoteAddr()),
+			"session_id", getSessionID(conn),
+			"user", perms.Extensions["user"],
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		for _, key := range []string{perms.Extensions["principal_arn"], perms.Extensions["user"]} {
+			if key == "" {
+				continue
+			}
+			settings, found, err := store.lookup(ctx, key)
+			if err != nil {
+				store.logger.Error("per-user configuration lookup failed", logCtx, slog.String("error", err.Error()))
+				return nil, fmt.Errorf("authentication unavailable")
+			}
+			if !found {
+				continue
+			}
+
+			settings.apply(perms.Extensions)
+			store.logger.Info("applied per-user configuration", logCtx,
+				slog.String("key", key),
+				slog.String("bucket", settings.bucket),
+				slog.String("upload_prefix", settings.prefix),
+				slog.Int64("max_file_size", settings.maxFileSize),
+				slog.Any("allowed_extensions", settings.allowedExtensions),
+			)
+			break
+		}
+		return perms, nil
+	}
+}
+
+// apply stores the settings in the permission extensions the SFTP session
+// is set up from.
+func (c *userConfig) apply(extensions map[string]string) {
+	if c.bucket != "" {
+		extensions["bucket"] = c.bucket
+	}
+	if c.prefix != "" {
+		extensions["upload_prefix"] = c.prefix
+	}
+	if c.maxFileSize > 0 {
+		extensions["max_file_size"] = strconv.FormatInt(c.maxFileSize, 10)
+	}
+	if len(c.allowedExtensions) > 0 {
+		extensions["allowed_extensions"] = strings.Join(c.allowedExtensions, ",")
+	}
+	if c.allowedIPs != "" {
+		extensions["allowed_ips"] = c.allowedIPs
+	}
+}
+
+// lookup returns the settings stored under key.
+func (s *userConfigStore) lookup(ctx context.Context, key string) (*userConfig, bool, error) {
+	request := map[string]any{
+		"TableName": s.table,
+		"Key":       map[string]dynamoAttribute{s.keyAttribute: {S: aws.String(key)}},
+	}
+
+	var response struct {
+		Item map[string]dynamoAttribute `json:"Item"`
+	}
+	if err := s.client.call(ctx, "GetItem", request, &response); err != nil {
+		return nil, false, err
+	}
+	if response.Item == nil {
+		return nil, false, nil
+	}
+
+	settings, err := parseUserConfig(response.Item)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid entry for %s: %w", key, err)
+	}
+	return settings, true, nil
+}
+
+// parseUserConfig reads the bucket, prefix, max_file_size,
+// allowed_extensions and allowed_ips attributes of a table item. The lists
+// may be a string set, a list or a comma separated string.
+func parseUserConfig(item map[string]dynamoAttribute) (*userConfig, error) {
+	settings := &userConfig{}
+
+	if attr, ok := item["bucket"]; ok && attr.S != nil {
+		settings.bucket = *attr.S
+	}
+
+	if attr, ok := item["prefix"]; ok && attr.S != nil && *attr.S != "" {
+		prefix := path.Clean(strings.Trim(*attr.S, "/"))
+		if prefix == "." || strings.HasPrefix(prefix, "..") {
+			return nil, fmt.Errorf("invalid prefix %q", *attr.S)
+		}
+		settings.prefix = prefix
+	}
+
+	if attr, ok := item["max_file_size"]; ok && attr.N != nil {
+		size, err := strconv.ParseInt(*attr.N, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid max_file_size %q", *attr.N)
+		}
+		settings.maxFileSize = size
+	}
+
+	if attr, ok := item["allowed_extensions"]; ok {
+		settings.allowedExtensions = normalizeExtensions(attr.strings())
+	}
+
+	if attr, ok := item["allowed_ips"]; ok {
+		allowedIPs, err := normalizeAllowedIPs(strings.Join(attr.strings(), ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_ips: %w", err)
+		}
+		settings.allowedIPs = allowedIPs
+	}
+
+	return settings, nil
+}
+
+// normalizeExtensions lower-cases extensions and adds the leading dot, so
+// "CSV", "csv" and ".csv" all match data.csv.
+func normalizeExtensions(values []string) []string {
+	var extensions []string
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		if !strings.HasPrefix(value, ".") {
+			value = "." + value
+		}
+		extensions = append(extensions, value)
+	}
+	return extensions
+}
+
+// extensionAllowed reports whether the file name ends in one of allowed, or
+// if no extensions are configured.
+func extensionAllowed(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, extension := range allowed {
+		if strings.HasSuffix(lower, extension) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestUserConfigStore(t *testing.T, items map[string]string) *userConfigStore {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "DynamoDB_20120810.GetItem" {
+			t.Errorf("X-Amz-Target = %q, want GetItem", r.Header.Get("X-Amz-Target"))
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			t.Errorf("request is not signed")
+		}
+
+		var request struct {
+			TableName string
+			Key       map[string]dynamoAttribute
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		if request.TableName != "sftpgw-users" {
+			t.Errorf("TableName = %q, want %q", request.TableName, "sftpgw-users")
+		}
+
+		key := request.Key["principal"]
+		if key.S == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ValidationException","message":"missing key"}`)
+			return
+		}
+		if item, ok := items[*key.S]; ok {
+			io.WriteString(w, `{"Item":`+item+`}`)
+			return
+		}
+		io.WriteString(w, `{}`)
+	}))
+	t.Cleanup(server.Close)
+
+	store := newUserConfigStore(&Config{
+		UserConfigTable: "sftpgw-users",
+		UserConfigKey:   "principal",
+	}, testAWSConfig(server), slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	store.client.endpoint = server.URL
+	return store
+}
+
+// testAWSConfig returns static gateway credentials and an HTTP client for
+// server.
+func testAWSConfig(server *httptest.Server) aws.Config {
+	return aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIAGATEWAY", "secret", ""),
+		HTTPClient:  server.Client(),
+	}
+}
+
+func TestWrapUserConfig(t *testing.T) {
+	store := newTestUserConfigStore(t, map[string]string{
+		"arn:aws:iam::123456789012:user/acme": `{
+			"principal": {"S": "arn:aws:iam::123456789012:user/acme"},
+			"bucket": {"S": "partner-drops"},
+			"prefix": {"S": "/partners/acme/"},
+			"max_file_size": {"N": "4096"},
+			"allowed_extensions": {"SS": ["CSV", ".xml"]}
+		}`,
+		"bob": `{"principal": {"S": "bob"}, "allowed_extensions": {"S": "txt, tar.gz"}}`,
+	})
+
+	authenticate := wrapUserConfig(store, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		extensions := map[string]string{"user": conn.User(), "upload_prefix": conn.User()}
+		if conn.User() == "AKIAACME" {
+			extensions["principal_arn"] = "arn:aws:iam::123456789012:user/acme"
+		}
+		return &ssh.Permissions{Extensions: extensions}, nil
+	})
+
+	perms, err := authenticate(testConnMetadata{user: "AKIAACME"}, nil)
+	if err != nil {
+		t.Fatalf("authenticate() unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"bucket":             "partner-drops",
+		"upload_prefix":      "partners/acme",
+		"max_file_size":      "4096",
+		"allowed_extensions": ".csv,.xml",
+	} {
+		if perms.Extensions[key] != want {
+			t.Errorf("%s = %q, want %q", key, perms.Extensions[key], want)
+		}
+	}
+
+	perms, err = authenticate(testConnMetadata{user: "bob"}, nil)
+	if err != nil {
+		t.Fatalf("authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["allowed_extensions"] != ".txt,.tar.gz" {
+		t.Errorf("allowed_extensions = %q, want %q", perms.Extensions["allowed_extensions"], ".txt,.tar.gz")
+	}
+	if perms.Extensions["upload_prefix"] != "bob" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "bob")
+	}
+
+	perms, err = authenticate(testConnMetadata{user: "carol"}, nil)
+	if err != nil {
+		t.Fatalf("authenticate() unexpected error for user without an item: %v", err)
+	}
+	if _, ok := perms.Extensions["bucket"]; ok {
+		t.Error("expected no bucket for user without an item")
+	}
+}
+
+func TestWrapUserConfig_Errors(t *testing.T) {
+	store := newTestUserConfigStore(t, map[string]string{
+		"mallory": `{"principal": {"S": "mallory"}, "prefix": {"S": "../other"}}`,
+	})
+
+	authenticate := wrapUserConfig(store, func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if conn.User() == "denied" {
+			return nil, errors.New("invalid credentials")
+		}
+		return &ssh.Permissions{Extensions: map[string]string{"user": conn.User()}}, nil
+	})
+
+	if _, err := authenticate(testConnMetadata{user: "mallory"}, nil); err == nil {
+		t.Error("authenticate() expected error for item with invalid prefix")
+	}
+	if _, err := authenticate(testConnMetadata{user: "denied"}, nil); err == nil {
+		t.Error("authenticate() expected error when authentication fails")
+	}
+
+	store.keyAttribute = "other"
+	if _, err := authenticate(testConnMetadata{user: "alice"}, nil); err == nil {
+		t.Error("authenticate() expected error when DynamoDB rejects the request")
+	}
+}
+
+func TestExtensionAllowed(t *testing.T) {
+	allowed := normalizeExtensions([]string{"csv", ".TAR.GZ"})
+	if !slices.Equal(allowed, []string{".csv", ".tar.gz"}) {
+		t.Fatalf("normalizeExtensions() = %v", allowed)
+	}
+
+	tests := map[string]bool{
+		"/uploads/data.csv":      true,
+		"/uploads/DATA.CSV":      true,
+		"/uploads/backup.tar.gz": true,
+		"/uploads/archive.gz":    false,
+		"/uploads/report.pdf":    false,
+		"/uploads/csv":           false,
+	}
+	for name, want := range tests {
+		if got := extensionAllowed(name, allowed); got != want {
+			t.Errorf("extensionAllowed(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if !extensionAllowed("/uploads/anything.bin", nil) {
+		t.Error("extensionAllowed() with no extensions should allow everything")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// vaultTokenPrefixes are the prefixes of Vault service and batch tokens, and
+// of tokens from Vault versions before 1.10. AWS secret keys never contain
+// dots, so these can't be mistaken for one.
+var vaultTokenPrefixes = []string{"hvs.", "hvb.", "s.", "b."}
+
+// vaultResponse is the envelope of Vault API responses.
+type vaultResponse[T any] struct {
+	Data   T        `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// vaultTokenInfo is the part of a token lookup the gateway uses.
+type vaultTokenInfo struct {
+	DisplayName string   `json:"display_name"`
+	Policies    []string `json:"policies"`
+	TTL         int64    `json:"ttl"`
+}
+
+// vaultAWSCredentials is returned by the AWS secrets engine.
+type vaultAWSCredentials struct {
+	AccessKey     string `json:"access_key"`
+	SecretKey     string `json:"secret_key"`
+	SecurityToken string `json:"security_token"`
+}
+
+// VaultAuthenticator accepts a HashiCorp Vault token in place of a password.
+// The token is checked with Vault itself, and with VAULT_AWS_ROLE set it is
+// also used to fetch short-lived AWS credentials for the session from the
+// AWS secrets engine, so uploads are signed with credentials that exist only
+// for as long as the session needs them.
+type VaultAuthenticator struct {
+	addr     string
+	awsMount string
+	awsRole  string // fetch upload credentials for this role if set
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+func NewVaultAuthenticator(config *Config, logger *slog.Logger) *VaultAuthenticator {
+	return &VaultAuthenticator{
+		addr:     strings.TrimSuffix(config.VaultAddr, "/"),
+		awsMount: config.VaultAWSMount,
+		awsRole:  config.VaultAWSRole,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+	}
+}
+
+// wrapVault sends passwords that look like a Vault token to a and all others
+// to next.
+func wrapVault(a *VaultAuthenticator, next func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		for _, prefix := range vaultTokenPrefixes {
+			if strings.HasPrefix(string(password), prefix) && strings.Count(string(password), ".") == 1 {
+				return a.Authenticate(conn, password)
+			}
+		}
+		return next(conn, password)
+	}
+}
+
+func (a *VaultAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+	user := conn.User()
+	token := string(password)
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", user,
+		"method", "vault",
+	)
+
+	a.logger.Info("authentication attempt", logCtx)
+
+	if !principalPattern.MatchString(user) {
+		a.logger.Warn("authentication failed: invalid user name", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	var info vaultResponse[vaultTokenInfo]
+	status, err := a.get("auth/token/lookup-self", token, &info)
+	if status == http.StatusForbidden {
+		a.logger.Warn("authentication failed: invalid Vault token", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	if err != nil {
+		a.logger.Error("Vault token lookup failed", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("authentication unavailable")
+	}
+
+	// Vault display names are the auth mount followed by the name the token
+	// was issued to, for example "userpass-alice" or "token-ci-uploader".
+	if name := info.Data.DisplayName; name != user && !strings.HasSuffix(name, "-"+user) {
+		a.logger.Warn("authentication failed: user name does not match Vault token", logCtx,
+			slog.String("display_name", name),
+		)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	extensions := map[string]string{
+		"user":          user,
+		"upload_prefix": user,
+		"client_ip":     clientIP,
+	}
+
+	if a.awsRole != "" {
+		var creds vaultResponse[vaultAWSCredentials]
+		if _, err := a.get(a.awsMount+"/creds/"+url.PathEscape(a.awsRole), token, &creds); err != nil {
+			a.logger.Error("failed to fetch AWS credentials from Vault", logCtx,
+				slog.String("role", a.awsRole),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+		if creds.Data.AccessKey == "" || creds.Data.SecretKey == "" {
+			a.logger.Error("Vault returned no AWS credentials", logCtx, slog.String("role", a.awsRole))
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+		extensions["aws_access_key_id"] = creds.Data.AccessKey
+		extensions["aws_secret_access_key"] = creds.Data.SecretKey
+		extensions["aws_session_token"] = creds.Data.SecurityToken
+	}
+
+	a.logger.Info("authentication successful", logCtx,
+		slog.Any("policies", info.Data.Policies),
+		slog.Duration("token_ttl", time.Duration(info.Data.TTL)*time.Second),
+		slog.String("aws_access_key_id", extensions["aws_access_key_id"]),
+	)
+
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// get calls the Vault API with token and decodes the response into v. The
+// HTTP status is returned as well, so callers can tell a rejected token from
+// an unreachable server.
+func (a *VaultAuthenticator) get(path, token string, v any) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.addr+"/v1/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode != http.StatusOK {
+		var failure vaultResponse[struct{}]
+		json.NewDecoder(body).Decode(&failure)
+		return resp.StatusCode, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.Join(failure.Errors, "; "))
+	}
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newTestVaultAuthenticator(t *testing.T, role string) *VaultAuthenticator {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "hvs.valid" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+				"display_name": "userpass-alice",
+				"policies":     []string{"default", "sftp"},
+				"ttl":          3600,
+			}})
+		case "/v1/aws/creds/sftp-upload":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{
+				"access_key":     "ASIAVAULTEXAMPLE",
+				"secret_key":     "vault-secret",
+				"security_token": "vault-session-token",
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return NewVaultAuthenticator(&Config{
+		VaultAddr:     server.URL,
+		VaultAWSMount: "aws",
+		VaultAWSRole:  role,
+	}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+func TestVaultAuthenticator_Authenticate(t *testing.T) {
+	auth := newTestVaultAuthenticator(t, "")
+
+	perms, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("hvs.valid"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	if perms.Extensions["upload_prefix"] != "alice" {
+		t.Errorf("upload_prefix = %q, want %q", perms.Extensions["upload_prefix"], "alice")
+	}
+	if perms.Extensions["aws_access_key_id"] != "" {
+		t.Errorf("aws_access_key_id = %q, want none without VAULT_AWS_ROLE", perms.Extensions["aws_access_key_id"])
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("hvs.revoked")); err == nil {
+		t.Error("Authenticate() expected error for rejected token")
+	}
+	if _, err := auth.Authenticate(testConnMetadata{user: "bob"}, []byte("hvs.valid")); err == nil {
+		t.Error("Authenticate() expected error for token of another user")
+	}
+}
+
+func TestVaultAuthenticator_FetchesAWSCredentials(t *testing.T) {
+	auth := newTestVaultAuthenticator(t, "sftp-upload")
+
+	perms, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("hvs.valid"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"aws_access_key_id":     "ASIAVAULTEXAMPLE",
+		"aws_secret_access_key": "vault-secret",
+		"aws_session_token":     "vault-session-token",
+	} {
+		if perms.Extensions[key] != want {
+			t.Errorf("%s = %q, want %q", key, perms.Extensions[key], want)
+		}
+	}
+
+	auth.awsRole = "missing"
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("hvs.valid")); err == nil {
+		t.Error("Authenticate() expected error when Vault has no credentials for the role")
+	}
+}
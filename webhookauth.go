@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// webhookAuthRequest is POSTed to AUTH_WEBHOOK_URL for every password login.
+type webhookAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip"`
+}
+
+// webhookAuthResponse is the decision of the webhook. Prefix defaults to the
+// user name and Bucket to S3_BUCKET; a Quota of zero means unlimited.
+type webhookAuthResponse struct {
+	Allow  bool   `json:"allow"`
+	Prefix string `json:"prefix"`
+	Bucket string `json:"bucket"`
+	Quota  int64  `json:"quota"`
+}
+
+// WebhookAuthenticator delegates password checks to an external HTTP
+// endpoint, so organizations can plug in their existing identity systems.
+// Like local users, webhook users have no AWS credentials and their uploads
+// are stored with the gateway's own credentials.
+type WebhookAuthenticator struct {
+	url    string
+	token  string // sent as a bearer token if set
+	client *http.Client
+	logger *slog.Logger
+}
+
+func NewWebhookAuthenticator(config *Config, logger *slog.Logger) *WebhookAuthenticator {
+	return &WebhookAuthenticator{
+		url:    config.AuthWebhookURL,
+		token:  config.AuthWebhookToken,
+		client: &http.Client{Timeout: config.AuthWebhookTimeout},
+		logger: logger,
+	}
+}
+
+func (a *WebhookAuthenticator) Authenticate(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	clientIP := getClientIP(conn.RemoteAddr())
+	user := conn.User()
+
+	logCtx := slog.Group("auth",
+		"remote_ip", clientIP,
+		"session_id", getSessionID(conn),
+		"user", user,
+		"method", "webhook",
+	)
+
+	a.logger.Info("authentication attempt", logCtx)
+
+	if !principalPattern.MatchString(user) || len(password) == 0 {
+		a.logger.Warn("authentication failed: invalid user name or empty password", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	decision, err := a.ask(webhookAuthRequest{Username: user, Password: string(password), ClientIP: clientIP})
+	if err != nil {
+		a.logger.Error("authentication webhook failed", logCtx, slog.String("error", err.Error()))
+		return nil, fmt.Errorf("authentication unavailable")
+	}
+
+	if !decision.Allow {
+		a.logger.Warn("authentication failed: denied by webhook", logCtx)
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	prefix := user
+	if decision.Prefix != "" {
+		prefix = path.Clean(strings.Trim(decision.Prefix, "/"))
+		if prefix == "." || strings.HasPrefix(prefix, "..") {
+			a.logger.Error("authentication failed: webhook returned an invalid prefix", logCtx, slog.String("upload_prefix", decision.Prefix))
+			return nil, fmt.Errorf("authentication unavailable")
+		}
+	}
+
+	a.logger.Info("authentication successful", logCtx,
+		slog.String("upload_prefix", prefix),
+		slog.String("bucket", decision.Bucket),
+		slog.Int64("quota", decision.Quota),
+	)
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":          user,
+			"upload_prefix": prefix,
+			"bucket":        decision.Bucket,
+			"quota":         strconv.FormatInt(decision.Quota, 10),
+			"client_ip":     clientIP,
+		},
+	}, nil
+}
+
+// ask posts the login to the webhook. Any status other than 200 OK is an
+// error, so a misbehaving endpoint never lets users in.
+func (a *WebhookAuthenticator) ask(login webhookAuthRequest) (*webhookAuthResponse, error) {
+	body, err := json.Marshal(login)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var decision webhookAuthResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decision); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if decision.Quota < 0 {
+		return nil, fmt.Errorf("invalid response: negative quota")
+	}
+	return &decision, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestWebhookAuthenticator(t *testing.T, handler http.HandlerFunc) *WebhookAuthenticator {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewWebhookAuthenticator(&Config{
+		AuthWebhookURL:     server.URL,
+		AuthWebhookToken:   "hook-token",
+		AuthWebhookTimeout: 5 * time.Second,
+	}, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+func TestWebhookAuthenticator_Authenticate(t *testing.T) {
+	auth := newTestWebhookAuthenticator(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hook-token" {
+			t.Errorf("Authorization = %q, want bearer token", r.Header.Get("Authorization"))
+		}
+
+		var login webhookAuthRequest
+		json.NewDecoder(r.Body).Decode(&login)
+		if login.ClientIP != "192.168.1.100" {
+			t.Errorf("client_ip = %q, want %q", login.ClientIP, "192.168.1.100")
+		}
+
+		json.NewEncoder(w).Encode(webhookAuthResponse{
+			Allow:  login.Username == "alice" && login.Password == "s3cret",
+			Prefix: "/partners/alice/",
+			Bucket: "partner-drops",
+			Quota:  1024,
+		})
+	})
+
+	perms, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Authenticate() unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"user":          "alice",
+		"upload_prefix": "partners/alice",
+		"bucket":        "partner-drops",
+		"quota":         "1024",
+	} {
+		if perms.Extensions[key] != want {
+			t.Errorf("%s = %q, want %q", key, perms.Extensions[key], want)
+		}
+	}
+
+	if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("wrong")); err == nil {
+		t.Error("Authenticate() expected error when the webhook denies the login")
+	}
+}
+
+func TestWebhookAuthenticator_Failures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"allow": true}`))
+		}},
+		{"invalid JSON", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`allow`))
+		}},
+		{"invalid prefix", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"allow": true, "prefix": "../other"}`))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := newTestWebhookAuthenticator(t, tt.handler)
+			if _, err := auth.Authenticate(testConnMetadata{user: "alice"}, []byte("s3cret")); err == nil {
+				t.Error("Authenticate() expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookDelivery stores files by POSTing each one to DELIVERY_WEBHOOK_URL
+// instead of putting it into S3, for consumers that are an API rather than
+// a bucket. The body of the request is the file; headers describe it.
+type webhookDelivery struct {
+	url      string
+	secret   []byte // signs the requests if set, see DELIVERY_WEBHOOK_SECRET
+	client   *http.Client
+	retry    retryPolicy
+	timeFunc func() time.Time
+	logger   *slog.Logger
+}
+
+func newWebhookDelivery(config *Config, logger *slog.Logger) *webhookDelivery {
+	return &webhookDelivery{
+		url:      config.DeliveryWebhookURL,
+		secret:   []byte(config.DeliveryWebhookSecret),
+		client:   &http.Client{},
+		retry:    newRetryPolicy(config),
+		timeFunc: time.Now,
+		logger:   logger,
+	}
+}
+
+// webhookDeliveryError is a response of the webhook other than 2xx.
+type webhookDeliveryError struct {
+	status  int
+	message string // the start of the body
+}
+
+func (e *webhookDeliveryError) Error() string {
+	return fmt.Sprintf("delivery webhook returned %d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// retryable reports whether sending the file again may succeed. Other
+// client errors mean the endpoint refused the file.
+func (e *webhookDeliveryError) retryable() bool {
+	return e.status >= 500 || e.status == http.StatusRequestTimeout || e.status == http.StatusTooManyRequests
+}
+
+// UploadFile POSTs a whole file to the webhook. There is no bucket; the key
+// is the path of the file below the user's prefix, as the webhook sees it.
+func (d *webhookDelivery) UploadFile(ctx context.Context, session uploadSession, filePath string, body io.ReaderAt, size int64) (bucket, key string, err error) {
+	key = path.Join("/", session.prefix, filePath)
+	logCtx := slog.Group("webhook_delivery",
+		"remote_ip", session.clientIP,
+		"session_id", session.sessionID,
+		"file_path", filePath,
+		"file_size", size,
+	)
+
+	// the same headers and signature for every attempt, so the endpoint can
+	// recognize a retry by its delivery ID
+	timestamp := strconv.FormatInt(d.timeFunc().Unix(), 10)
+	hash := sha256.New()
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(timestamp + "."))
+	if _, err := io.Copy(io.MultiWriter(hash, mac), io.NewSectionReader(body, 0, size)); err != nil {
+		return "", key, fmt.Errorf("failed to read upload data: %w", err)
+	}
+	header := http.Header{
+		"Content-Type":            {detectContentType(filePath, readHead(body, size))},
+		"X-Sftpgw-Delivery-Id":    {newUUID()},
+		"X-Sftpgw-Timestamp":      {timestamp},
+		"X-Sftpgw-User":           {session.user},
+		"X-Sftpgw-Session-Id":     {session.sessionID},
+		"X-Sftpgw-Remote-Ip":      {session.clientIP},
+		"X-Sftpgw-File-Path":      {escapeKey(key)},
+		"X-Sftpgw-Content-Sha256": {hex.EncodeToString(hash.Sum(nil))},
+	}
+	if session.accountID != "" {
+		header.Set("X-Sftpgw-Account-Id", session.accountID)
+	}
+	if len(d.secret) > 0 {
+		header.Set("X-Sftpgw-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	d.logger.Info("starting webhook delivery", logCtx)
+	err = d.retry.do(ctx, d.logger, logCtx, "POST", func() error {
+		return d.post(ctx, header, io.NewSectionReader(body, 0, size), size)
+	})
+	if err != nil {
+		d.logger.Error("webhook delivery failed", logCtx, slog.String("error", err.Error()))
+		return "", key, fmt.Errorf("failed to deliver to webhook: %w", err)
+	}
+	d.logger.Info("webhook delivery successful", logCtx)
+	return "", key, nil
+}
+
+// post sends one attempt of a delivery.
+func (d *webhookDelivery) post(ctx context.Context, header http.Header, body io.Reader, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.ContentLength = size
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &webhookDeliveryError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return nil
+}
+
+// StartStream refuses streaming: the signature and X-Sftpgw-Content-Sha256
+// header cover the whole file, so the request can't start before the file
+// is complete. LoadConfig rejects STREAM_UPLOADS with DELIVERY_WEBHOOK_URL.
+func (d *webhookDelivery) StartStream(context.Context, uploadSession, string) (uploadStream, error) {
+	return nil, errors.New("streaming uploads can't be delivered to a webhook")
+}
+
+// Exists reports every key as free, as the webhook can't be asked which
+// files it has received.
+func (d *webhookDelivery) Exists(context.Context, uploadSession, string) (bool, error) {
+	return false, nil
+}
+
+// bucketFor returns no bucket, as files don't go to S3.
+func (d *webhookDelivery) bucketFor(uploadSession) string {
+	return ""
+}
+
+// keyPrefix returns the user's prefix, which the webhook sees in front of
+// the path of every file.
+func (d *webhookDelivery) keyPrefix(session uploadSession) string {
+	return session.prefix
+}
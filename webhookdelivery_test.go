@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWebhookDelivery(t *testing.T, handler http.HandlerFunc) *webhookDelivery {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config := &Config{DeliveryWebhookURL: server.URL, DeliveryWebhookSecret: "s3cret", UploadRetryAttempts: 2, UploadRetryBaseDelay: time.Millisecond}
+	d := newWebhookDelivery(config, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	d.timeFunc = func() time.Time { return time.Unix(1705329045, 0) }
+	return d
+}
+
+func TestWebhookDelivery_UploadFile(t *testing.T) {
+	var header http.Header
+	var body []byte
+	d := newTestWebhookDelivery(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	session := uploadSession{user: "acme", prefix: "acme", sessionID: "0123456789abcdef", clientIP: "203.0.113.7"}
+	bucket, key, err := d.UploadFile(context.Background(), session, "/uploads/order 1.csv", strings.NewReader("a,b\n"), 4)
+	if err != nil {
+		t.Fatalf("UploadFile() unexpected error: %v", err)
+	}
+	if bucket != "" || key != "/acme/uploads/order 1.csv" {
+		t.Errorf("UploadFile() = %q, %q, want no bucket and the path below the prefix", bucket, key)
+	}
+
+	if string(body) != "a,b\n" || header.Get("Content-Type") != "text/csv" {
+		t.Errorf("request = %q as %s, want the file as CSV", body, header.Get("Content-Type"))
+	}
+	if header.Get("X-Sftpgw-File-Path") != "/acme/uploads/order%201.csv" || header.Get("X-Sftpgw-User") != "acme" || header.Get("X-Sftpgw-Delivery-Id") == "" {
+		t.Errorf("headers = %v, want the escaped path, user and a delivery ID", header)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1705329045.a,b\n"))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Sftpgw-Signature") != want {
+		t.Errorf("X-Sftpgw-Signature = %s, want %s", header.Get("X-Sftpgw-Signature"), want)
+	}
+}
+
+func TestWebhookDelivery_Retry(t *testing.T) {
+	for _, tt := range []struct {
+		status       int
+		wantAttempts int
+	}{
+		{http.StatusServiceUnavailable, 2},
+		{http.StatusTooManyRequests, 2},
+		{http.StatusUnprocessableEntity, 1},
+	} {
+		attempts := 0
+		d := newTestWebhookDelivery(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tt.status)
+		})
+
+		_, _, err := d.UploadFile(context.Background(), uploadSession{user: "acme"}, "/a.txt", strings.NewReader("x"), 1)
+		if err == nil || !strings.Contains(err.Error(), http.StatusText(tt.status)) {
+			t.Errorf("status %d: UploadFile() error = %v", tt.status, err)
+		}
+		if attempts != tt.wantAttempts {
+			t.Errorf("status %d: %d attempts, want %d", tt.status, attempts, tt.wantAttempts)
+		}
+	}
+}